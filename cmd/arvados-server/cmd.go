@@ -17,6 +17,7 @@ import (
 
 	"git.arvados.org/arvados.git/lib/boot"
 	"git.arvados.org/arvados.git/lib/cloud/cloudtest"
+	"git.arvados.org/arvados.git/lib/cloud/instancetypes"
 	"git.arvados.org/arvados.git/lib/cmd"
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/lib/controller"
@@ -24,6 +25,7 @@ import (
 	"git.arvados.org/arvados.git/lib/crunchstat"
 	"git.arvados.org/arvados.git/lib/dispatchcloud"
 	"git.arvados.org/arvados.git/lib/install"
+	"git.arvados.org/arvados.git/lib/keepstoreadmin"
 	"git.arvados.org/arvados.git/lib/lsf"
 	"git.arvados.org/arvados.git/lib/recovercollection"
 	"git.arvados.org/arvados.git/lib/service"
@@ -47,7 +49,7 @@ var (
 		"boot":               boot.Command,
 		"check":              health.CheckCommand,
 		"cloudtest":          cloudtest.Command,
-		"config-check":       config.CheckCommand,
+		"config-check":       configCheckCommand(),
 		"config-defaults":    config.DumpDefaultsCommand,
 		"config-dump":        config.DumpCommand,
 		"controller":         controller.Command,
@@ -59,16 +61,27 @@ var (
 		"health":             healthCommand,
 		"install":            install.Command,
 		"init":               install.InitCommand,
+		"instance-types":     instancetypes.Command,
 		"keep-balance":       keepbalance.Command,
 		"keep-web":           keepweb.Command,
 		"keepproxy":          keepproxy.Command,
 		"keepstore":          keepstore.Command,
+		"keepstore-admin":    keepstoreadmin.Command,
 		"recover-collection": recovercollection.Command,
 		"workbench2":         wb2command{},
 		"ws":                 ws.Command,
 	})
 )
 
+// configCheckCommand returns a config-check command that also checks
+// cloud driver parameters, which lib/config can't do on its own
+// because it doesn't import the drivers.
+func configCheckCommand() cmd.Handler {
+	cc := config.CheckCommand
+	cc.CloudDriverSchemas = dispatchcloud.DriverSchemas()
+	return cc
+}
+
 func main() {
 	os.Exit(handler.RunCommand(os.Args[0], os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
@@ -0,0 +1,162 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	azcloud "github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+// The wrapper interfaces (virtualMachinesClientWrapper, etc.) are
+// the seams where tests substitute stubs for the Azure API. They
+// take and return the model types from the azcore-based "arm*" SDK
+// packages, and the *ClientImpl types implement them using the
+// corresponding arm* clients.
+
+// apiPipeline holds the settings and policies shared by all ARM
+// clients: credentials, cloud endpoints, transport, budgets,
+// retries, timeouts, and metrics.
+type apiPipeline struct {
+	credential azcore.TokenCredential
+	cloud      azcloud.Configuration
+	httpClient *http.Client
+	budgets    *apiBudgets
+	retries    *apiRetryPolicy
+	timeouts   apiTimeouts
+	metrics    *apiMetrics
+}
+
+// clientOptions returns the options for an ARM client. The given
+// name identifies the client in metrics (e.g., "virtualMachines").
+//
+// Each call is counted against the API budget once. Each attempt
+// (including retries, which are done by the SDK's retry policy) gets
+// its own request timeout and is measured separately.
+func (p *apiPipeline) clientOptions(name string) *arm.ClientOptions {
+	opts := &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Cloud:            p.cloud,
+			Retry:            p.retries.options(),
+			PerCallPolicies:  []policy.Policy{p.budgets, p.retries.perCallPolicy()},
+			PerRetryPolicies: []policy.Policy{p.retries.perAttemptPolicy(), p.timeouts, p.metrics.pipelinePolicy(name)},
+		},
+	}
+	if p.httpClient != nil {
+		opts.Transport = p.httpClient
+	}
+	return opts
+}
+
+// azureEnvironment holds the endpoints of an Azure cloud.
+type azureEnvironment struct {
+	Name                    string
+	ActiveDirectoryEndpoint string
+	ResourceManagerEndpoint string
+	TokenAudience           string
+	StorageEndpointSuffix   string
+}
+
+// Known cloud environments.
+var (
+	azurePublicCloud = azureEnvironment{
+		Name:                    "AzurePublicCloud",
+		ActiveDirectoryEndpoint: "https://login.microsoftonline.com/",
+		ResourceManagerEndpoint: "https://management.azure.com/",
+		TokenAudience:           "https://management.azure.com/",
+		StorageEndpointSuffix:   "core.windows.net",
+	}
+	azureUSGovernmentCloud = azureEnvironment{
+		Name:                    "AzureUSGovernmentCloud",
+		ActiveDirectoryEndpoint: "https://login.microsoftonline.us/",
+		ResourceManagerEndpoint: "https://management.usgovcloudapi.net/",
+		TokenAudience:           "https://management.usgovcloudapi.net/",
+		StorageEndpointSuffix:   "core.usgovcloudapi.net",
+	}
+	azureChinaCloud = azureEnvironment{
+		Name:                    "AzureChinaCloud",
+		ActiveDirectoryEndpoint: "https://login.chinacloudapi.cn/",
+		ResourceManagerEndpoint: "https://management.chinacloudapi.cn/",
+		TokenAudience:           "https://management.chinacloudapi.cn/",
+		StorageEndpointSuffix:   "core.chinacloudapi.cn",
+	}
+	azureGermanCloud = azureEnvironment{
+		Name:                    "AzureGermanCloud",
+		ActiveDirectoryEndpoint: "https://login.microsoftonline.de/",
+		ResourceManagerEndpoint: "https://management.microsoftazure.de/",
+		TokenAudience:           "https://management.microsoftazure.de/",
+		StorageEndpointSuffix:   "core.cloudapi.de",
+	}
+)
+
+// Accepted CloudEnvironment values, in upper case. These are the
+// names accepted by previous versions, which used the autorest
+// environment table.
+var azureEnvironments = map[string]azureEnvironment{
+	"AZURECHINACLOUD":        azureChinaCloud,
+	"AZUREGERMANCLOUD":       azureGermanCloud,
+	"AZURECLOUD":             azurePublicCloud,
+	"AZUREPUBLICCLOUD":       azurePublicCloud,
+	"AZUREUSGOVERNMENT":      azureUSGovernmentCloud,
+	"AZUREUSGOVERNMENTCLOUD": azureUSGovernmentCloud,
+}
+
+// environmentFromName returns the cloud environment with the given
+// (case-insensitive) name.
+func environmentFromName(name string) (azureEnvironment, error) {
+	env, ok := azureEnvironments[strings.ToUpper(name)]
+	if !ok {
+		return env, fmt.Errorf("unknown CloudEnvironment %q", name)
+	}
+	return env, nil
+}
+
+// cloudConfiguration returns the azcore cloud configuration
+// (authority host and Resource Manager endpoint) for the given
+// environment.
+func cloudConfiguration(env azureEnvironment) azcloud.Configuration {
+	return azcloud.Configuration{
+		ActiveDirectoryAuthorityHost: env.ActiveDirectoryEndpoint,
+		Services: map[azcloud.ServiceName]azcloud.ServiceConfiguration{
+			azcloud.ResourceManager: {
+				Audience: env.TokenAudience,
+				Endpoint: env.ResourceManagerEndpoint,
+			},
+		},
+	}
+}
+
+// policyFunc is a policy.Policy implemented by a function.
+type policyFunc func(*policy.Request) (*http.Response, error)
+
+// Do implements policy.Policy.
+func (f policyFunc) Do(req *policy.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// listAll returns the items from all pages of the given pager. page
+// returns the items from a page.
+func listAll[T, R any](ctx context.Context, pager *runtime.Pager[R], page func(R) []*T) ([]T, error) {
+	var all []T
+	for pager.More() {
+		resp, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, wrapAzureError(err)
+		}
+		for _, item := range page(resp) {
+			if item != nil {
+				all = append(all, *item)
+			}
+		}
+	}
+	return all, nil
+}
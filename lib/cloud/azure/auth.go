@@ -0,0 +1,189 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// Values for the AuthMethod config.
+const (
+	authMethodAuto            = "auto"
+	authMethodManagedIdentity = "managed-identity"
+	authMethodClientSecret    = "client-secret"
+	authMethodClientCert      = "client-certificate"
+	authMethodCLI             = "cli"
+)
+
+// How long to wait for the instance metadata service when checking
+// whether a managed identity is available.
+var msiProbeTimeout = 5 * time.Second
+
+// Get a new token when the cached one will expire within this
+// interval.
+var tokenRefreshMargin = 5 * time.Minute
+
+// probeCredential checks that a credential is usable by getting a
+// token for the given scope. Stubbed by tests.
+var probeCredential = func(ctx context.Context, cred azcore.TokenCredential, scope string) error {
+	_, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{scope}})
+	return err
+}
+
+// authMethods returns the authentication methods to try, in order.
+//
+// If AuthMethod is empty, the configured client secret is used if
+// there is one (as in previous versions), otherwise the "auto"
+// fallback chain.
+func (azcfg azureInstanceSetConfig) authMethods() ([]string, error) {
+	switch azcfg.AuthMethod {
+	case "":
+		if azcfg.ClientSecret != "" {
+			return []string{authMethodClientSecret}, nil
+		}
+		fallthrough
+	case authMethodAuto:
+		methods := []string{authMethodManagedIdentity}
+		if azcfg.ClientCertificatePath != "" {
+			methods = append(methods, authMethodClientCert)
+		}
+		if azcfg.ClientSecret != "" {
+			methods = append(methods, authMethodClientSecret)
+		}
+		return append(methods, authMethodCLI), nil
+	case authMethodManagedIdentity, authMethodClientSecret, authMethodClientCert, authMethodCLI:
+		return []string{azcfg.AuthMethod}, nil
+	default:
+		return nil, fmt.Errorf("invalid AuthMethod %q: must be %q, %q, %q, %q, or %q", azcfg.AuthMethod, authMethodAuto, authMethodManagedIdentity, authMethodClientCert, authMethodClientSecret, authMethodCLI)
+	}
+}
+
+// credential returns a credential for Azure Resource Manager API
+// calls, using the first usable authentication method (see
+// authMethods), along with the configured cloud environment.
+//
+// Tokens are cached and shared by all clients that use the returned
+// credential. If httpClient is not nil, it is used to request
+// tokens.
+func (azcfg azureInstanceSetConfig) credential(httpClient *http.Client) (azcore.TokenCredential, azureEnvironment, error) {
+	env, err := environmentFromName(azcfg.CloudEnvironment)
+	if err != nil {
+		return nil, env, err
+	}
+	opts := azcore.ClientOptions{Cloud: cloudConfiguration(env)}
+	if httpClient != nil {
+		opts.Transport = httpClient
+	}
+	methods, err := azcfg.authMethods()
+	if err != nil {
+		return nil, env, err
+	}
+	var errs []string
+	for _, method := range methods {
+		cred, err := azcfg.credentialFor(method, opts, env.TokenAudience+"/.default")
+		if err == nil {
+			return &cachedCredential{TokenCredential: cred}, env, nil
+		}
+		if len(methods) == 1 {
+			return nil, env, err
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", method, err))
+	}
+	return nil, env, fmt.Errorf("no usable Azure credentials (%s)", strings.Join(errs, "; "))
+}
+
+func (azcfg azureInstanceSetConfig) credentialFor(method string, opts azcore.ClientOptions, scope string) (azcore.TokenCredential, error) {
+	switch method {
+	case authMethodManagedIdentity:
+		miOpts := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: opts}
+		if azcfg.ManagedIdentityClientID != "" {
+			// If not specified, the system-assigned
+			// identity is used.
+			miOpts.ID = azidentity.ClientID(azcfg.ManagedIdentityClientID)
+		}
+		cred, err := azidentity.NewManagedIdentityCredential(miOpts)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), msiProbeTimeout)
+		defer cancel()
+		if err := probeCredential(ctx, cred, scope); err != nil {
+			return nil, fmt.Errorf("managed identity is not available: %w", err)
+		}
+		return cred, nil
+	case authMethodClientSecret:
+		if azcfg.ClientID == "" || azcfg.ClientSecret == "" {
+			return nil, errors.New("ClientID and ClientSecret must be set")
+		}
+		return azidentity.NewClientSecretCredential(azcfg.TenantID, azcfg.ClientID, azcfg.ClientSecret, &azidentity.ClientSecretCredentialOptions{ClientOptions: opts})
+	case authMethodClientCert:
+		if azcfg.ClientID == "" || azcfg.ClientCertificatePath == "" {
+			return nil, errors.New("ClientID and ClientCertificatePath must be set")
+		}
+		data, err := os.ReadFile(azcfg.ClientCertificatePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the certificate file: %w", err)
+		}
+		certs, key, err := azidentity.ParseCertificates(data, []byte(azcfg.ClientCertificatePassword))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the certificate file %s: %w", azcfg.ClientCertificatePath, err)
+		}
+		return azidentity.NewClientCertificateCredential(azcfg.TenantID, azcfg.ClientID, certs, key, &azidentity.ClientCertificateCredentialOptions{ClientOptions: opts})
+	case authMethodCLI:
+		cred, err := azidentity.NewAzureCLICredential(&azidentity.AzureCLICredentialOptions{TenantID: azcfg.TenantID})
+		if err != nil {
+			return nil, err
+		}
+		if err := probeCredential(context.Background(), cred, scope); err != nil {
+			return nil, fmt.Errorf("error getting token from Azure CLI: %w", err)
+		}
+		return cred, nil
+	default:
+		return nil, fmt.Errorf("unsupported auth method %q", method)
+	}
+}
+
+// cachedCredential is an azcore.TokenCredential that caches the
+// tokens it gets from the wrapped credential, and gets a new one
+// whenever the cached one is about to expire. Each SDK client also
+// caches its current token, but without this, each client (and each
+// token refresh) would get a new token from the identity provider
+// -- which, for the CLI method, means running "az account
+// get-access-token".
+type cachedCredential struct {
+	azcore.TokenCredential
+	mtx    sync.Mutex
+	tokens map[string]azcore.AccessToken
+}
+
+// GetToken implements azcore.TokenCredential.
+func (cc *cachedCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	key := opts.TenantID + "\x00" + strings.Join(opts.Scopes, " ")
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	if token, ok := cc.tokens[key]; ok && time.Until(token.ExpiresOn) > tokenRefreshMargin {
+		return token, nil
+	}
+	token, err := cc.TokenCredential.GetToken(ctx, opts)
+	if err != nil {
+		return token, err
+	}
+	if cc.tokens == nil {
+		cc.tokens = map[string]azcore.AccessToken{}
+	}
+	cc.tokens[key] = token
+	return token, nil
+}
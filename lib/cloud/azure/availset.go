@@ -0,0 +1,120 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+// Availability set name that means "create and use a set for this
+// dispatcher".
+const autoAvailabilitySet = "auto"
+
+// Defaults for auto-created availability sets.
+const (
+	defaultFaultDomains  = 2
+	defaultUpdateDomains = 5
+)
+
+// azureAvailabilitySet describes the availability set that new VMs
+// are placed in, so the platform spreads them across fault and
+// update domains.
+type azureAvailabilitySet struct {
+	// Name of an existing availability set in ResourceGroup, or
+	// "auto" to create one named after the dispatcher. If
+	// empty, VMs are not placed in an availability set.
+	Name string
+
+	// Fault/update domain counts for an auto-created set. If
+	// zero, defaultFaultDomains/defaultUpdateDomains are used.
+	FaultDomains  int
+	UpdateDomains int
+}
+
+func (as azureAvailabilitySet) enabled() bool {
+	return as.Name != ""
+}
+
+type availabilitySetsClientWrapper interface {
+	get(ctx context.Context, resourceGroupName string, name string) (armcompute.AvailabilitySet, error)
+	createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armcompute.AvailabilitySet) (armcompute.AvailabilitySet, error)
+}
+
+type availabilitySetsClientImpl struct {
+	inner *armcompute.AvailabilitySetsClient
+}
+
+func (cl *availabilitySetsClientImpl) get(ctx context.Context, resourceGroupName string, name string) (armcompute.AvailabilitySet, error) {
+	resp, err := cl.inner.Get(ctx, resourceGroupName, name, nil)
+	if err != nil {
+		return armcompute.AvailabilitySet{}, wrapAzureError(err)
+	}
+	return resp.AvailabilitySet, nil
+}
+
+func (cl *availabilitySetsClientImpl) createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armcompute.AvailabilitySet) (armcompute.AvailabilitySet, error) {
+	resp, err := cl.inner.CreateOrUpdate(ctx, resourceGroupName, name, parameters, nil)
+	if err != nil {
+		return armcompute.AvailabilitySet{}, wrapAzureError(err)
+	}
+	return resp.AvailabilitySet, nil
+}
+
+// setupAvailabilitySet looks up (or, for "auto", creates) the
+// configured availability set and returns its resource ID.
+func (az *azureInstanceSet) setupAvailabilitySet() (string, error) {
+	cfg := az.azconfig.AvailabilitySet
+	var set armcompute.AvailabilitySet
+	var err error
+	if cfg.Name == autoAvailabilitySet {
+		faultDomains, updateDomains := cfg.FaultDomains, cfg.UpdateDomains
+		if faultDomains == 0 {
+			faultDomains = defaultFaultDomains
+		}
+		if updateDomains == 0 {
+			updateDomains = defaultUpdateDomains
+		}
+		set, err = az.availSetClient.createOrUpdate(az.ctx, az.azconfig.ResourceGroup, az.namePrefix+"avset", armcompute.AvailabilitySet{
+			Location: &az.azconfig.Location,
+			// "Aligned" is required for VMs with managed
+			// disks.
+			SKU: &armcompute.SKU{Name: to.Ptr(string(armcompute.AvailabilitySetSKUTypesAligned))},
+			Properties: &armcompute.AvailabilitySetProperties{
+				PlatformFaultDomainCount:  to.Ptr(int32(faultDomains)),
+				PlatformUpdateDomainCount: to.Ptr(int32(updateDomains)),
+			},
+		})
+	} else {
+		set, err = az.availSetClient.get(az.ctx, az.azconfig.ResourceGroup, cfg.Name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error setting up availability set %q: %w", cfg.Name, err)
+	}
+	if set.ID == nil {
+		return "", fmt.Errorf("error setting up availability set %q: no ID in API response", cfg.Name)
+	}
+	return *set.ID, nil
+}
+
+// domainTags returns instance tags indicating the fault and update
+// domains the platform assigned to the given VM.
+func (az *azureInstanceSet) domainTags(vmName string) (map[string]string, error) {
+	iv, err := az.vmClient.instanceView(az.ctx, az.azconfig.ResourceGroup, vmName)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	if iv.PlatformFaultDomain != nil {
+		tags["fault-domain"] = fmt.Sprintf("%d", *iv.PlatformFaultDomain)
+	}
+	if iv.PlatformUpdateDomain != nil {
+		tags["update-domain"] = fmt.Sprintf("%d", *iv.PlatformUpdateDomain)
+	}
+	return tags, nil
+}
@@ -6,41 +6,60 @@ package azure
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"git.arvados.org/arvados.git/lib/cloud"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
-	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
-	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-06-01/network"
-	storageacct "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2018-02-01/storage"
-	"github.com/Azure/azure-sdk-for-go/storage"
-	"github.com/Azure/go-autorest/autorest"
-	"github.com/Azure/go-autorest/autorest/azure"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
-	"github.com/Azure/go-autorest/autorest/to"
-	"github.com/jmcvetta/randutil"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/lease"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 )
 
 // Driver is the azure implementation of the cloud.Driver interface.
-var Driver = cloud.DriverFunc(newAzureInstanceSet)
+var Driver = azureDriver{cloud.HTTPClientDriverFunc(newAzureInstanceSet)}
+
+type azureDriver struct {
+	cloud.HTTPClientDriver
+}
+
+// ConfigSchema implements cloud.SchemaDriver.
+func (azureDriver) ConfigSchema() *cloud.ConfigSchema {
+	return cloud.ConfigSchemaOf(azureInstanceSetConfig{})
+}
 
 type azureInstanceSetConfig struct {
 	SubscriptionID                 string
 	ClientID                       string
 	ClientSecret                   string
+	ClientCertificatePath          string
+	ClientCertificatePassword      string
 	TenantID                       string
+	AuthMethod                     string
+	ManagedIdentityClientID        string
 	CloudEnvironment               string
 	ResourceGroup                  string
 	ImageResourceGroup             string
@@ -48,124 +67,307 @@ type azureInstanceSetConfig struct {
 	Network                        string
 	NetworkResourceGroup           string
 	Subnet                         string
+	Subnets                        []string
+	NetworkSecurityGroup           string
+	Locations                      []azureLocation
+	Bootstrap                      bool
 	StorageAccount                 string
 	BlobContainer                  string
 	SharedImageGalleryName         string
 	SharedImageGalleryImageVersion string
 	DeleteDanglingResourcesAfter   arvados.Duration
+	DryRunDeletes                  bool
+	GCConcurrency                  int
+	GCInterval                     arvados.Duration
 	AdminUsername                  string
+	ReadCallsPerHour               int
+	WriteCallsPerHour              int
+	APIRetryAttempts               int
+	APIRetryBaseDelay              arvados.Duration
+	APIRetryMaxDelay               arvados.Duration
+	APIRequestTimeout              arvados.Duration
+	APIOperationTimeout            arvados.Duration
+	SharedMount                    azureSharedMount
+	AvailabilitySet                azureAvailabilitySet
+	Zones                          []string
+	AcceleratedNetworking          []string
+	HostGroup                      string
+	OSDisks                        map[string]azureOSDisk
+	ImagePlans                     map[string]azureImagePlan
+	CustomDataTemplate             string
+	ScaleSets                      bool
+	CreatePublicIP                 bool
+	BootDiagnostics                bool
+	DiskEncryptionSetID            string
+	ResourceTags                   map[string]string
+	SecurityProfile                azureSecurityProfile
+	HostKeyVerification            string
+	EventQueue                     azureEventQueue
+}
+
+// authorizedKeysPath returns the location of the admin user's
+// authorized_keys file on new VMs. Azure only accepts
+// /home/{AdminUsername}/.ssh/authorized_keys here, so it is not
+// configurable separately.
+func (azcfg azureInstanceSetConfig) authorizedKeysPath() string {
+	return "/home/" + azcfg.AdminUsername + "/.ssh/authorized_keys"
 }
 
 type containerWrapper interface {
-	GetBlobReference(name string) *storage.Blob
-	ListBlobs(params storage.ListBlobsParameters) (storage.BlobListResponse, error)
+	// listBlobs returns the blobs whose names start with prefix.
+	listBlobs(ctx context.Context, prefix string) ([]container.BlobItem, error)
+	// deleteBlob deletes the named blob, if it exists.
+	deleteBlob(ctx context.Context, name string) error
+	setMetadata(ctx context.Context, name string, metadata map[string]*string) error
+	// createIfNotExists creates the container if it does not
+	// already exist, and returns true if it was created.
+	createIfNotExists(ctx context.Context) (bool, error)
+}
+
+type containerImpl struct {
+	inner *container.Client
+}
+
+func (cl *containerImpl) listBlobs(ctx context.Context, prefix string) ([]container.BlobItem, error) {
+	return listAll[container.BlobItem](ctx, cl.inner.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix}), func(page container.ListBlobsFlatResponse) []*container.BlobItem {
+		if page.Segment == nil {
+			return nil
+		}
+		return page.Segment.BlobItems
+	})
+}
+
+func (cl *containerImpl) deleteBlob(ctx context.Context, name string) error {
+	_, err := cl.inner.NewBlobClient(name).Delete(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil
+	}
+	return wrapAzureError(err)
+}
+
+func (cl *containerImpl) setMetadata(ctx context.Context, name string, metadata map[string]*string) error {
+	_, err := cl.inner.NewBlobClient(name).SetMetadata(ctx, metadata, nil)
+	return wrapAzureError(err)
+}
+
+func (cl *containerImpl) createIfNotExists(ctx context.Context) (bool, error) {
+	_, err := cl.inner.Create(ctx, nil)
+	if bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return false, nil
+	} else if err != nil {
+		return false, wrapAzureError(err)
+	}
+	return true, nil
 }
 
 type virtualMachinesClientWrapper interface {
 	createOrUpdate(ctx context.Context,
 		resourceGroupName string,
 		VMName string,
-		parameters compute.VirtualMachine) (result compute.VirtualMachine, err error)
-	delete(ctx context.Context, resourceGroupName string, VMName string) (result *http.Response, err error)
-	listComplete(ctx context.Context, resourceGroupName string) (result compute.VirtualMachineListResultIterator, err error)
+		parameters armcompute.VirtualMachine) (armcompute.VirtualMachine, error)
+	get(ctx context.Context, resourceGroupName string, VMName string) (armcompute.VirtualMachine, error)
+	delete(ctx context.Context, resourceGroupName string, VMName string) error
+	// listComplete returns the VMs in the resource group that
+	// have all of the given tags.
+	listComplete(ctx context.Context, resourceGroupName string, tags cloud.InstanceTags) ([]armcompute.VirtualMachine, error)
+	instanceView(ctx context.Context, resourceGroupName string, VMName string) (armcompute.VirtualMachineInstanceView, error)
+	start(ctx context.Context, resourceGroupName string, VMName string) error
+	deallocate(ctx context.Context, resourceGroupName string, VMName string) error
+	runCommand(ctx context.Context, resourceGroupName string, VMName string, script string) (string, error)
 }
 
 type virtualMachinesClientImpl struct {
-	inner compute.VirtualMachinesClient
+	inner     *armcompute.VirtualMachinesClient
+	opTimeout time.Duration
 }
 
 func (cl *virtualMachinesClientImpl) createOrUpdate(ctx context.Context,
 	resourceGroupName string,
 	VMName string,
-	parameters compute.VirtualMachine) (result compute.VirtualMachine, err error) {
+	parameters armcompute.VirtualMachine) (armcompute.VirtualMachine, error) {
 
-	future, err := cl.inner.CreateOrUpdate(ctx, resourceGroupName, VMName, parameters)
+	poller, err := cl.inner.BeginCreateOrUpdate(ctx, resourceGroupName, VMName, parameters, nil)
+	if err != nil {
+		return armcompute.VirtualMachine{}, wrapAzureError(err)
+	}
+	resp, err := waitForCompletion(ctx, poller, cl.opTimeout)
 	if err != nil {
-		return compute.VirtualMachine{}, wrapAzureError(err)
+		return armcompute.VirtualMachine{}, wrapAzureError(err)
 	}
-	future.WaitForCompletionRef(ctx, cl.inner.Client)
-	r, err := future.Result(cl.inner)
-	return r, wrapAzureError(err)
+	return resp.VirtualMachine, nil
 }
 
-func (cl *virtualMachinesClientImpl) delete(ctx context.Context, resourceGroupName string, VMName string) (result *http.Response, err error) {
-	future, err := cl.inner.Delete(ctx, resourceGroupName, VMName)
+func (cl *virtualMachinesClientImpl) get(ctx context.Context, resourceGroupName string, VMName string) (armcompute.VirtualMachine, error) {
+	resp, err := cl.inner.Get(ctx, resourceGroupName, VMName, nil)
 	if err != nil {
-		return nil, wrapAzureError(err)
+		return armcompute.VirtualMachine{}, wrapAzureError(err)
+	}
+	return resp.VirtualMachine, nil
+}
+
+func (cl *virtualMachinesClientImpl) delete(ctx context.Context, resourceGroupName string, VMName string) error {
+	poller, err := cl.inner.BeginDelete(ctx, resourceGroupName, VMName, nil)
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	_, err = waitForCompletion(ctx, poller, cl.opTimeout)
+	return wrapAzureError(err)
+}
+
+func (cl *virtualMachinesClientImpl) listComplete(ctx context.Context, resourceGroupName string, tags cloud.InstanceTags) ([]armcompute.VirtualMachine, error) {
+	return listAll[armcompute.VirtualMachine](ctx, cl.inner.NewListPager(resourceGroupName, nil), func(page armcompute.VirtualMachinesClientListResponse) []*armcompute.VirtualMachine {
+		// Skip other VMs (e.g., other dispatchers' VMs in
+		// the same resource group).
+		var vms []*armcompute.VirtualMachine
+		for _, vm := range page.Value {
+			if vm != nil && hasTags(vm.Tags, tags) {
+				vms = append(vms, vm)
+			}
+		}
+		return vms
+	})
+}
+
+func (cl *virtualMachinesClientImpl) instanceView(ctx context.Context, resourceGroupName string, VMName string) (armcompute.VirtualMachineInstanceView, error) {
+	resp, err := cl.inner.InstanceView(ctx, resourceGroupName, VMName, nil)
+	if err != nil {
+		return armcompute.VirtualMachineInstanceView{}, wrapAzureError(err)
+	}
+	return resp.VirtualMachineInstanceView, nil
+}
+
+func (cl *virtualMachinesClientImpl) start(ctx context.Context, resourceGroupName string, VMName string) error {
+	poller, err := cl.inner.BeginStart(ctx, resourceGroupName, VMName, nil)
+	if err != nil {
+		return wrapAzureError(err)
 	}
-	err = future.WaitForCompletionRef(ctx, cl.inner.Client)
-	return future.Response(), wrapAzureError(err)
+	_, err = waitForCompletion(ctx, poller, cl.opTimeout)
+	return wrapAzureError(err)
 }
 
-func (cl *virtualMachinesClientImpl) listComplete(ctx context.Context, resourceGroupName string) (result compute.VirtualMachineListResultIterator, err error) {
-	r, err := cl.inner.ListComplete(ctx, resourceGroupName)
-	return r, wrapAzureError(err)
+func (cl *virtualMachinesClientImpl) deallocate(ctx context.Context, resourceGroupName string, VMName string) error {
+	poller, err := cl.inner.BeginDeallocate(ctx, resourceGroupName, VMName, nil)
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	_, err = waitForCompletion(ctx, poller, cl.opTimeout)
+	return wrapAzureError(err)
+}
+
+func (cl *virtualMachinesClientImpl) runCommand(ctx context.Context, resourceGroupName string, VMName string, script string) (string, error) {
+	poller, err := cl.inner.BeginRunCommand(ctx, resourceGroupName, VMName, armcompute.RunCommandInput{
+		CommandID: to.Ptr("RunShellScript"),
+		Script:    []*string{&script},
+	}, nil)
+	if err != nil {
+		return "", wrapAzureError(err)
+	}
+	resp, err := waitForCompletion(ctx, poller, cl.opTimeout)
+	if err != nil {
+		return "", wrapAzureError(err)
+	}
+	return runCommandStdout(resp.RunCommandResult), nil
 }
 
 type interfacesClientWrapper interface {
 	createOrUpdate(ctx context.Context,
 		resourceGroupName string,
 		networkInterfaceName string,
-		parameters network.Interface) (result network.Interface, err error)
-	delete(ctx context.Context, resourceGroupName string, networkInterfaceName string) (result *http.Response, err error)
-	listComplete(ctx context.Context, resourceGroupName string) (result network.InterfaceListResultIterator, err error)
+		parameters armnetwork.Interface) (armnetwork.Interface, error)
+	get(ctx context.Context, resourceGroupName string, networkInterfaceName string) (armnetwork.Interface, error)
+	delete(ctx context.Context, resourceGroupName string, networkInterfaceName string) error
+	listComplete(ctx context.Context, resourceGroupName string) ([]armnetwork.Interface, error)
+	updateTags(ctx context.Context, resourceGroupName string, networkInterfaceName string, tags map[string]*string) error
 }
 
 type interfacesClientImpl struct {
-	inner network.InterfacesClient
+	inner     *armnetwork.InterfacesClient
+	opTimeout time.Duration
 }
 
-func (cl *interfacesClientImpl) delete(ctx context.Context, resourceGroupName string, VMName string) (result *http.Response, err error) {
-	future, err := cl.inner.Delete(ctx, resourceGroupName, VMName)
+func (cl *interfacesClientImpl) delete(ctx context.Context, resourceGroupName string, networkInterfaceName string) error {
+	poller, err := cl.inner.BeginDelete(ctx, resourceGroupName, networkInterfaceName, nil)
 	if err != nil {
-		return nil, wrapAzureError(err)
+		return wrapAzureError(err)
 	}
-	err = future.WaitForCompletionRef(ctx, cl.inner.Client)
-	return future.Response(), wrapAzureError(err)
+	_, err = waitForCompletion(ctx, poller, cl.opTimeout)
+	return wrapAzureError(err)
 }
 
 func (cl *interfacesClientImpl) createOrUpdate(ctx context.Context,
 	resourceGroupName string,
 	networkInterfaceName string,
-	parameters network.Interface) (result network.Interface, err error) {
+	parameters armnetwork.Interface) (armnetwork.Interface, error) {
 
-	future, err := cl.inner.CreateOrUpdate(ctx, resourceGroupName, networkInterfaceName, parameters)
+	poller, err := cl.inner.BeginCreateOrUpdate(ctx, resourceGroupName, networkInterfaceName, parameters, nil)
+	if err != nil {
+		return armnetwork.Interface{}, wrapAzureError(err)
+	}
+	resp, err := waitForCompletion(ctx, poller, cl.opTimeout)
 	if err != nil {
-		return network.Interface{}, wrapAzureError(err)
+		return armnetwork.Interface{}, wrapAzureError(err)
 	}
-	future.WaitForCompletionRef(ctx, cl.inner.Client)
-	r, err := future.Result(cl.inner)
-	return r, wrapAzureError(err)
+	return resp.Interface, nil
+}
+
+func (cl *interfacesClientImpl) get(ctx context.Context, resourceGroupName string, networkInterfaceName string) (armnetwork.Interface, error) {
+	resp, err := cl.inner.Get(ctx, resourceGroupName, networkInterfaceName, nil)
+	if err != nil {
+		return armnetwork.Interface{}, wrapAzureError(err)
+	}
+	return resp.Interface, nil
+}
+
+func (cl *interfacesClientImpl) listComplete(ctx context.Context, resourceGroupName string) ([]armnetwork.Interface, error) {
+	return listAll[armnetwork.Interface](ctx, cl.inner.NewListPager(resourceGroupName, nil), func(page armnetwork.InterfacesClientListResponse) []*armnetwork.Interface {
+		return page.Value
+	})
 }
 
-func (cl *interfacesClientImpl) listComplete(ctx context.Context, resourceGroupName string) (result network.InterfaceListResultIterator, err error) {
-	r, err := cl.inner.ListComplete(ctx, resourceGroupName)
-	return r, wrapAzureError(err)
+func (cl *interfacesClientImpl) updateTags(ctx context.Context, resourceGroupName string, networkInterfaceName string, tags map[string]*string) error {
+	_, err := cl.inner.UpdateTags(ctx, resourceGroupName, networkInterfaceName, armnetwork.TagsObject{Tags: tags}, nil)
+	return wrapAzureError(err)
 }
 
 type disksClientWrapper interface {
-	listByResourceGroup(ctx context.Context, resourceGroupName string) (result compute.DiskListPage, err error)
-	delete(ctx context.Context, resourceGroupName string, diskName string) (result compute.DisksDeleteFuture, err error)
+	listByResourceGroup(ctx context.Context, resourceGroupName string) ([]armcompute.Disk, error)
+	delete(ctx context.Context, resourceGroupName string, diskName string) error
+	updateTags(ctx context.Context, resourceGroupName string, diskName string, tags map[string]*string) error
 }
 
 type disksClientImpl struct {
-	inner compute.DisksClient
+	inner     *armcompute.DisksClient
+	opTimeout time.Duration
 }
 
-func (cl *disksClientImpl) listByResourceGroup(ctx context.Context, resourceGroupName string) (result compute.DiskListPage, err error) {
-	r, err := cl.inner.ListByResourceGroup(ctx, resourceGroupName)
-	return r, wrapAzureError(err)
+func (cl *disksClientImpl) listByResourceGroup(ctx context.Context, resourceGroupName string) ([]armcompute.Disk, error) {
+	return listAll[armcompute.Disk](ctx, cl.inner.NewListByResourceGroupPager(resourceGroupName, nil), func(page armcompute.DisksClientListByResourceGroupResponse) []*armcompute.Disk {
+		return page.Value
+	})
 }
 
-func (cl *disksClientImpl) delete(ctx context.Context, resourceGroupName string, diskName string) (result compute.DisksDeleteFuture, err error) {
-	r, err := cl.inner.Delete(ctx, resourceGroupName, diskName)
-	return r, wrapAzureError(err)
+func (cl *disksClientImpl) delete(ctx context.Context, resourceGroupName string, diskName string) error {
+	poller, err := cl.inner.BeginDelete(ctx, resourceGroupName, diskName, nil)
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	_, err = waitForCompletion(ctx, poller, cl.opTimeout)
+	return wrapAzureError(err)
+}
+
+func (cl *disksClientImpl) updateTags(ctx context.Context, resourceGroupName string, diskName string, tags map[string]*string) error {
+	poller, err := cl.inner.BeginUpdate(ctx, resourceGroupName, diskName, armcompute.DiskUpdate{Tags: tags}, nil)
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	_, err = waitForCompletion(ctx, poller, cl.opTimeout)
+	return wrapAzureError(err)
 }
 
 var quotaRe = regexp.MustCompile(`(?i:exceed|quota|limit)`)
 
 type azureRateLimitError struct {
-	azure.RequestError
+	*azcore.ResponseError
 	firstRetry time.Time
 }
 
@@ -174,7 +376,7 @@ func (ar *azureRateLimitError) EarliestRetry() time.Time {
 }
 
 type azureQuotaError struct {
-	azure.RequestError
+	*azcore.ResponseError
 }
 
 func (ar *azureQuotaError) IsQuotaError() bool {
@@ -182,20 +384,13 @@ func (ar *azureQuotaError) IsQuotaError() bool {
 }
 
 func wrapAzureError(err error) error {
-	de, ok := err.(autorest.DetailedError)
-	if !ok {
-		return err
-	}
-	rq, ok := de.Original.(*azure.RequestError)
-	if !ok {
+	var rerr *azcore.ResponseError
+	if !errors.As(err, &rerr) || rerr.RawResponse == nil {
 		return err
 	}
-	if rq.Response == nil {
-		return err
-	}
-	if rq.Response.StatusCode == 429 || len(rq.Response.Header["Retry-After"]) >= 1 {
+	resp := rerr.RawResponse
+	if ra := resp.Header.Get("Retry-After"); resp.StatusCode == http.StatusTooManyRequests || ra != "" {
 		// API throttling
-		ra := rq.Response.Header["Retry-After"][0]
 		earliestRetry, parseErr := http.ParseTime(ra)
 		if parseErr != nil {
 			// Could not parse as a timestamp, must be number of seconds
@@ -208,181 +403,436 @@ func wrapAzureError(err error) error {
 				earliestRetry = time.Now().Add(20 * time.Second)
 			}
 		}
-		return &azureRateLimitError{*rq, earliestRetry}
-	}
-	if rq.ServiceError == nil {
-		return err
+		return &azureRateLimitError{rerr, earliestRetry}
 	}
-	if quotaRe.FindString(rq.ServiceError.Code) != "" || quotaRe.FindString(rq.ServiceError.Message) != "" {
-		return &azureQuotaError{*rq}
+	if quotaRe.FindString(rerr.ErrorCode) != "" || quotaRe.FindString(azureErrorMessage(rerr)) != "" {
+		return &azureQuotaError{rerr}
 	}
 	return err
 }
 
+// azureErrorMessage returns the service error message from the
+// response body of a failed Azure API call, or "" if there isn't
+// one.
+func azureErrorMessage(rerr *azcore.ResponseError) string {
+	if rerr.RawResponse == nil {
+		return ""
+	}
+	body, err := runtime.Payload(rerr.RawResponse)
+	if err != nil {
+		return ""
+	}
+	var errResp struct {
+		Error struct {
+			Message string
+		}
+	}
+	json.Unmarshal(body, &errResp)
+	return errResp.Error.Message
+}
+
+// azureErrorCode returns the service error code (e.g.,
+// "AllocationFailed") from an error returned by an Azure API call,
+// or "" if there isn't one.
+func azureErrorCode(err error) string {
+	var qerr *azureQuotaError
+	var rerr *azcore.ResponseError
+	if errors.As(err, &qerr) {
+		return qerr.ErrorCode
+	} else if errors.As(err, &rerr) {
+		return rerr.ErrorCode
+	}
+	return ""
+}
+
 type azureInstanceSet struct {
 	azconfig           azureInstanceSetConfig
 	vmClient           virtualMachinesClientWrapper
 	netClient          interfacesClientWrapper
 	disksClient        disksClientWrapper
+	availSetClient     availabilitySetsClientWrapper
+	ssClient           scaleSetsClientWrapper
+	availSetID         string
+	zonePicker         azureZonePicker
+	hostsClient        dedicatedHostsClientWrapper
+	hostPicker         azureHostPicker
+	subnetPicker       azureSubnetPicker
+	secondaryRegions   []*azureRegion
+	regionPicker       azureRegionPicker
+	customDataTemplate *template.Template
+	groupsClient       resourceGroupsClientWrapper
+	nsgClient          securityGroupsClientWrapper
+	nsgID              string
+	pipClient          publicIPAddressesClientWrapper
+	usageClient        usageClientWrapper
+	skusClient         resourceSkusClientWrapper
+	skuFamilies        azureSkuFamilies
+	publicIPs          map[string]string // lowercase resource ID => address
+	publicIPsMtx       sync.Mutex
 	imageResourceGroup string
 	blobcont           containerWrapper
-	azureEnv           azure.Environment
-	interfaces         map[string]network.Interface
+	blobReader         blobReaderWrapper
+	azureEnv           azureEnvironment
+	interfaces         map[string]armnetwork.Interface
 	dispatcherID       string
 	namePrefix         string
 	ctx                context.Context
 	stopFunc           context.CancelFunc
 	stopWg             sync.WaitGroup
-	deleteNIC          chan string
-	deleteBlob         chan storage.Blob
-	deleteDisk         chan compute.Disk
+	nicGC              *azureGCQueue
+	blobGC             *azureGCQueue
+	diskGC             *azureGCQueue
+	publicIPGC         *azureGCQueue
+	budgets            *apiBudgets
+	generations        *azureGenerations
+	powerStates        azurePowerStates
+	eventQueue         eventQueueWrapper
+	events             chan cloud.InstanceEvent
+	eventMetrics       *eventMetrics
 	logger             logrus.FieldLogger
+	// If not nil, used instead of the Azure SDK's default
+	// HTTP client for management and storage API calls.
+	httpClient *http.Client
 }
 
-func newAzureInstanceSet(config json.RawMessage, dispatcherID cloud.InstanceSetID, _ cloud.SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (prv cloud.InstanceSet, err error) {
+func newAzureInstanceSet(httpClient *http.Client, config json.RawMessage, dispatcherID cloud.InstanceSetID, _ cloud.SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (prv cloud.InstanceSet, err error) {
 	azcfg := azureInstanceSetConfig{}
 	err = json.Unmarshal(config, &azcfg)
 	if err != nil {
 		return nil, err
 	}
 
-	az := azureInstanceSet{logger: logger}
+	az := azureInstanceSet{logger: logger, httpClient: httpClient}
 	az.ctx, az.stopFunc = context.WithCancel(context.Background())
-	err = az.setup(azcfg, string(dispatcherID))
+	err = az.setup(azcfg, string(dispatcherID), reg)
 	if err != nil {
 		az.stopFunc()
 		return nil, err
 	}
+	if az.azconfig.ScaleSets {
+		return newAzureScaleSetInstanceSet(&az), nil
+	}
 	return &az, nil
 }
 
-func (az *azureInstanceSet) setup(azcfg azureInstanceSetConfig, dispatcherID string) (err error) {
+func (az *azureInstanceSet) setup(azcfg azureInstanceSetConfig, dispatcherID string, reg *prometheus.Registry) (err error) {
 	az.azconfig = azcfg
-	vmClient := compute.NewVirtualMachinesClient(az.azconfig.SubscriptionID)
-	netClient := network.NewInterfacesClient(az.azconfig.SubscriptionID)
-	disksClient := compute.NewDisksClient(az.azconfig.SubscriptionID)
-	storageAcctClient := storageacct.NewAccountsClient(az.azconfig.SubscriptionID)
-
-	az.azureEnv, err = azure.EnvironmentFromName(az.azconfig.CloudEnvironment)
+	if azcfg.AdminUsername == "" {
+		return errors.New("invalid configuration: AdminUsername must be set")
+	}
+	if err = azcfg.SharedMount.check(); err != nil {
+		return err
+	}
+	credential, env, err := az.azconfig.credential(az.httpClient)
 	if err != nil {
 		return err
 	}
-
-	authorizer, err := auth.ClientCredentialsConfig{
-		ClientID:     az.azconfig.ClientID,
-		ClientSecret: az.azconfig.ClientSecret,
-		TenantID:     az.azconfig.TenantID,
-		Resource:     az.azureEnv.ResourceManagerEndpoint,
-		AADEndpoint:  az.azureEnv.ActiveDirectoryEndpoint,
-	}.Authorizer()
+	az.azureEnv = env
+
+	az.budgets = newAPIBudgets(az.azconfig.ReadCallsPerHour, az.azconfig.WriteCallsPerHour, reg)
+	az.generations = newAzureGenerations(reg)
+	metrics := newAPIMetrics(reg)
+	pipeline := &apiPipeline{
+		credential: credential,
+		cloud:      cloudConfiguration(env),
+		httpClient: az.httpClient,
+		budgets:    az.budgets,
+		retries:    newAPIRetryPolicy(az.azconfig.APIRetryAttempts, az.azconfig.APIRetryBaseDelay.Duration(), az.azconfig.APIRetryMaxDelay.Duration(), reg),
+		timeouts:   newAPITimeouts(az.azconfig.APIRequestTimeout.Duration(), az.azconfig.APIOperationTimeout.Duration()),
+		metrics:    metrics,
+	}
+	subscriptionID := az.azconfig.SubscriptionID
+	vmClient, err := armcompute.NewVirtualMachinesClient(subscriptionID, credential, pipeline.clientOptions("virtualMachines"))
+	if err != nil {
+		return err
+	}
+	netClient, err := armnetwork.NewInterfacesClient(subscriptionID, credential, pipeline.clientOptions("networkInterfaces"))
+	if err != nil {
+		return err
+	}
+	disksClient, err := armcompute.NewDisksClient(subscriptionID, credential, pipeline.clientOptions("disks"))
+	if err != nil {
+		return err
+	}
+	storageAcctClient, err := armstorage.NewAccountsClient(subscriptionID, credential, pipeline.clientOptions("storageAccounts"))
+	if err != nil {
+		return err
+	}
+	availSetClient, err := armcompute.NewAvailabilitySetsClient(subscriptionID, credential, pipeline.clientOptions("availabilitySets"))
+	if err != nil {
+		return err
+	}
+	groupsClient, err := armresources.NewResourceGroupsClient(subscriptionID, credential, pipeline.clientOptions("resourceGroups"))
+	if err != nil {
+		return err
+	}
+	nsgClient, err := armnetwork.NewSecurityGroupsClient(subscriptionID, credential, pipeline.clientOptions("networkSecurityGroups"))
+	if err != nil {
+		return err
+	}
+	ssClient, err := armcompute.NewVirtualMachineScaleSetsClient(subscriptionID, credential, pipeline.clientOptions("virtualMachineScaleSets"))
+	if err != nil {
+		return err
+	}
+	ssVMClient, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionID, credential, pipeline.clientOptions("virtualMachineScaleSetVMs"))
+	if err != nil {
+		return err
+	}
+	pipClient, err := armnetwork.NewPublicIPAddressesClient(subscriptionID, credential, pipeline.clientOptions("publicIPAddresses"))
+	if err != nil {
+		return err
+	}
+	usageClient, err := armcompute.NewUsageClient(subscriptionID, credential, pipeline.clientOptions("usages"))
+	if err != nil {
+		return err
+	}
+	skusClient, err := armcompute.NewResourceSKUsClient(subscriptionID, credential, pipeline.clientOptions("resourceSkus"))
+	if err != nil {
+		return err
+	}
+	hostsClient, err := armcompute.NewDedicatedHostsClient(subscriptionID, credential, pipeline.clientOptions("dedicatedHosts"))
 	if err != nil {
 		return err
 	}
 
-	vmClient.Authorizer = authorizer
-	netClient.Authorizer = authorizer
-	disksClient.Authorizer = authorizer
-	storageAcctClient.Authorizer = authorizer
-
-	az.vmClient = &virtualMachinesClientImpl{vmClient}
-	az.netClient = &interfacesClientImpl{netClient}
-	az.disksClient = &disksClientImpl{disksClient}
+	opTimeout := pipeline.timeouts.operation
+	az.vmClient = &virtualMachinesClientImpl{vmClient, opTimeout}
+	az.netClient = &interfacesClientImpl{netClient, opTimeout}
+	az.disksClient = &disksClientImpl{disksClient, opTimeout}
+	az.availSetClient = &availabilitySetsClientImpl{availSetClient}
+	az.groupsClient = &resourceGroupsClientImpl{groupsClient}
+	az.nsgClient = &securityGroupsClientImpl{nsgClient, opTimeout}
+	az.ssClient = &scaleSetsClientImpl{ssClient, ssVMClient, netClient, opTimeout}
+	az.pipClient = &publicIPAddressesClientImpl{pipClient, opTimeout}
+	az.usageClient = &usageClientImpl{usageClient}
+	az.skusClient = &resourceSkusClientImpl{skusClient}
+	az.hostsClient = &dedicatedHostsClientImpl{hostsClient}
+
+	if az.azconfig.Bootstrap {
+		if az.azconfig.Location == "" {
+			return errors.New("invalid configuration: Location must be set when Bootstrap is enabled")
+		}
+		if err = az.setupResourceGroup(); err != nil {
+			return err
+		}
+	}
 
 	az.imageResourceGroup = az.azconfig.ImageResourceGroup
 	if az.imageResourceGroup == "" {
 		az.imageResourceGroup = az.azconfig.ResourceGroup
 	}
 
-	var client storage.Client
 	if az.azconfig.StorageAccount != "" && az.azconfig.BlobContainer != "" {
-		result, err := storageAcctClient.ListKeys(az.ctx, az.azconfig.ResourceGroup, az.azconfig.StorageAccount)
+		// The blob storage client (which manages the
+		// unmanaged disk images in BlobContainer) is
+		// authenticated with an account key.
+		key, err := az.storageAccountKey(storageAcctClient, az.azconfig.StorageAccount)
 		if err != nil {
-			az.logger.WithError(err).Warn("Couldn't get account keys")
 			return err
 		}
-
-		key1 := *(*result.Keys)[0].Value
-		client, err = storage.NewBasicClientOnSovereignCloud(az.azconfig.StorageAccount, key1, az.azureEnv)
+		cred, err := azblob.NewSharedKeyCredential(az.azconfig.StorageAccount, key)
 		if err != nil {
-			az.logger.WithError(err).Warn("Couldn't make client")
 			return err
 		}
-
-		blobsvc := client.GetBlobService()
-		az.blobcont = blobsvc.GetContainerReference(az.azconfig.BlobContainer)
+		client, err := azblob.NewClientWithSharedKeyCredential(az.storageURL(az.azconfig.StorageAccount, "blob"), cred, &azblob.ClientOptions{
+			ClientOptions: azcore.ClientOptions{Transport: metrics.httpClient("blobStorage", az.httpClient)},
+		})
+		if err != nil {
+			return err
+		}
+		az.blobcont = &containerImpl{client.ServiceClient().NewContainerClient(az.azconfig.BlobContainer)}
+		az.blobReader = &blobReaderImpl{client}
+		if az.azconfig.Bootstrap {
+			if err = az.setupBlobContainer(); err != nil {
+				return err
+			}
+		}
 	} else if az.azconfig.StorageAccount != "" || az.azconfig.BlobContainer != "" {
 		az.logger.Error("Invalid configuration: StorageAccount and BlobContainer must both be empty or both be set")
 	}
 
+	if err = az.azconfig.EventQueue.check(); err != nil {
+		return err
+	}
+	az.eventMetrics = newEventMetrics(reg)
+	if az.azconfig.EventQueue.enabled() {
+		account := az.azconfig.EventQueue.StorageAccount
+		key, err := az.storageAccountKey(storageAcctClient, account)
+		if err != nil {
+			return err
+		}
+		cred, err := azqueue.NewSharedKeyCredential(account, key)
+		if err != nil {
+			return err
+		}
+		client, err := azqueue.NewQueueClientWithSharedKeyCredential(az.storageURL(account, "queue")+az.azconfig.EventQueue.QueueName, cred, &azqueue.ClientOptions{
+			ClientOptions: azcore.ClientOptions{Transport: metrics.httpClient("eventQueue", az.httpClient)},
+		})
+		if err != nil {
+			return err
+		}
+		az.eventQueue = eventQueueImpl{client}
+		az.events = make(chan cloud.InstanceEvent, eventBufferSize)
+	}
+
 	az.dispatcherID = dispatcherID
 	az.namePrefix = fmt.Sprintf("compute-%s-", az.dispatcherID)
 
-	go func() {
-		az.stopWg.Add(1)
-		defer az.stopWg.Done()
-
-		tk := time.NewTicker(5 * time.Minute)
-		for {
-			select {
-			case <-az.ctx.Done():
-				tk.Stop()
-				return
-			case <-tk.C:
-				if az.blobcont != nil {
-					az.manageBlobs()
-				}
-				az.manageDisks()
-			}
+	if az.azconfig.NetworkSecurityGroup != "" {
+		az.nsgID, err = az.setupSecurityGroup()
+		if err != nil {
+			return err
 		}
-	}()
+	}
 
-	az.deleteNIC = make(chan string)
-	az.deleteBlob = make(chan storage.Blob)
-	az.deleteDisk = make(chan compute.Disk)
+	if err = az.checkSubnetsConfig(); err != nil {
+		return err
+	}
+	if err = az.checkLocationsConfig(); err != nil {
+		return err
+	}
+	if err = az.setupRegions(); err != nil {
+		return err
+	}
+	if err = az.checkResourceTagsConfig(); err != nil {
+		return err
+	}
+	if err = az.checkZonesConfig(); err != nil {
+		return err
+	}
+	if err = az.loadCustomDataTemplate(); err != nil {
+		return err
+	}
+	if err = az.checkScaleSetsConfig(); err != nil {
+		return err
+	}
+	if err = az.checkBootDiagnosticsConfig(); err != nil {
+		return err
+	}
+	if err = az.checkDiskEncryptionConfig(); err != nil {
+		return err
+	}
+	if err = az.azconfig.checkHostKeyVerification(); err != nil {
+		return err
+	}
+	if err = az.azconfig.SecurityProfile.check(); err != nil {
+		return err
+	}
+	if err = az.checkOSDisksConfig(); err != nil {
+		return err
+	}
+	if err = az.checkImagePlansConfig(); err != nil {
+		return err
+	}
+	if err = az.checkHostGroupConfig(); err != nil {
+		return err
+	}
 
-	for i := 0; i < 4; i++ {
-		go func() {
-			for nicname := range az.deleteNIC {
-				_, delerr := az.netClient.delete(context.Background(), az.azconfig.ResourceGroup, nicname)
-				if delerr != nil {
-					az.logger.WithError(delerr).Warnf("Error deleting %v", nicname)
-				} else {
-					az.logger.Printf("Deleted NIC %v", nicname)
-				}
-			}
-		}()
-		go func() {
-			for blob := range az.deleteBlob {
-				err := blob.Delete(nil)
-				if err != nil {
-					az.logger.WithError(err).Warnf("Error deleting %v", blob.Name)
-				} else {
-					az.logger.Printf("Deleted blob %v", blob.Name)
-				}
-			}
-		}()
-		go func() {
-			for disk := range az.deleteDisk {
-				_, err := az.disksClient.delete(az.ctx, az.imageResourceGroup, *disk.Name)
-				if err != nil {
-					az.logger.WithError(err).Warnf("Error deleting disk %+v", *disk.Name)
-				} else {
-					az.logger.Printf("Deleted disk %v", *disk.Name)
-				}
-			}
-		}()
+	if az.azconfig.AvailabilitySet.enabled() {
+		az.availSetID, err = az.setupAvailabilitySet()
+		if err != nil {
+			return err
+		}
+	}
+
+	az.stopWg.Add(1)
+	go az.runGC()
+
+	if az.eventQueue != nil {
+		az.stopWg.Add(1)
+		go az.runEvents()
+	}
+
+	az.setupGCQueues(reg)
+	for _, q := range []*azureGCQueue{az.nicGC, az.blobGC, az.diskGC, az.publicIPGC} {
+		q.start(az.azconfig.GCConcurrency)
 	}
 
 	return nil
 }
 
-func (az *azureInstanceSet) cleanupNic(nic network.Interface) {
-	_, delerr := az.netClient.delete(context.Background(), az.azconfig.ResourceGroup, *nic.Name)
+// storageAccountKey returns the first access key of the given
+// storage account in ResourceGroup.
+func (az *azureInstanceSet) storageAccountKey(accountsClient *armstorage.AccountsClient, account string) (string, error) {
+	result, err := accountsClient.ListKeys(az.ctx, az.azconfig.ResourceGroup, account, nil)
+	if err != nil {
+		az.logger.WithError(err).Warn("Couldn't get account keys")
+		return "", wrapAzureError(err)
+	}
+	if len(result.Keys) == 0 || result.Keys[0].Value == nil {
+		return "", fmt.Errorf("no access keys found for storage account %s", account)
+	}
+	return *result.Keys[0].Value, nil
+}
+
+// storageURL returns the endpoint of the given service ("blob" or
+// "queue") of the given storage account, with a trailing slash.
+func (az *azureInstanceSet) storageURL(account, service string) string {
+	return fmt.Sprintf("https://%s.%s.%s/", account, service, az.azureEnv.StorageEndpointSuffix)
+}
+
+func (az *azureInstanceSet) cleanupNic(nic armnetwork.Interface) {
+	delerr := az.destroyNic(context.Background(), nic)
 	if delerr != nil {
 		az.logger.WithError(delerr).Warnf("Error cleaning up NIC after failed create")
 	}
 }
 
+// checkDeletable returns an error if the named resource does not
+// look like one created by this dispatcher, i.e., its name lacks
+// namePrefix, or (for resource types that carry our tags) it has no
+// created-at tag. This guards against deleting unrelated resources
+// if, e.g., ResourceGroup is misconfigured.
+func (az *azureInstanceSet) checkDeletable(name string, tags map[string]*string, checkTags bool) error {
+	if !strings.HasPrefix(name, az.namePrefix) {
+		return fmt.Errorf("refusing to delete %s: name does not start with %q", name, az.namePrefix)
+	}
+	if checkTags && tags["created-at"] == nil {
+		return fmt.Errorf("refusing to delete %s: no created-at tag", name)
+	}
+	return nil
+}
+
+// dryRun returns true, after logging the delete operation that
+// would have happened, if DryRunDeletes is enabled.
+func (az *azureInstanceSet) dryRun(kind, name string) bool {
+	if !az.azconfig.DryRunDeletes {
+		return false
+	}
+	az.logger.Infof("DryRunDeletes is enabled, not deleting %s %s", kind, name)
+	return true
+}
+
+func (az *azureInstanceSet) destroyNic(ctx context.Context, nic armnetwork.Interface) error {
+	if err := az.checkDeletable(*nic.Name, nic.Tags, true); err != nil {
+		return err
+	}
+	if az.dryRun("NIC", *nic.Name) {
+		return nil
+	}
+	return az.netClient.delete(ctx, az.azconfig.ResourceGroup, *nic.Name)
+}
+
+func (az *azureInstanceSet) destroyBlob(name string) error {
+	if err := az.checkDeletable(name, nil, false); err != nil {
+		return err
+	}
+	if az.dryRun("blob", name) {
+		return nil
+	}
+	return az.blobcont.deleteBlob(az.ctx, name)
+}
+
+func (az *azureInstanceSet) destroyDisk(disk armcompute.Disk) error {
+	if err := az.checkDeletable(*disk.Name, nil, false); err != nil {
+		return err
+	}
+	if az.dryRun("disk", *disk.Name) {
+		return nil
+	}
+	return az.disksClient.delete(az.ctx, az.imageResourceGroup, *disk.Name)
+}
+
 func (az *azureInstanceSet) Create(
 	instanceType arvados.InstanceType,
 	imageID cloud.ImageID,
@@ -397,59 +847,266 @@ func (az *azureInstanceSet) Create(
 		return nil, fmt.Errorf("cannot create instance type %q: driver does not implement non-zero AddedScratch (%d)", instanceType.Name, instanceType.AddedScratch)
 	}
 
-	name, err := randutil.String(15, "abcdefghijklmnopqrstuvwxyz0123456789")
-	if err != nil {
+	name := az.creationName(instanceType, imageID, newTags, initCommand, publicKey)
+	// If there are secondary regions (Locations), try the next
+	// one when a region has no capacity.
+	regions := az.pickRegions(instanceType, newTags)
+	var inst *azureInstance
+	var err error
+	var region *azureRegion
+	for i := range regions {
+		region = regions[i]
+		if _, _, err = az.regionImage(region, instanceType, imageID); err != nil {
+			az.logger.WithError(err).Warnf("cannot create %s in location %s, skipping it", instanceType.ProviderType, region.location)
+			continue
+		}
+		inst, err = az.createVM(region.vmName(az.namePrefix, name), region, instanceType, imageID, newTags, initCommand, publicKey)
+		if err == nil || len(az.secondaryRegions) == 0 || !az.regionExhausted(region, instanceType, err) {
+			break
+		}
+	}
+	if qerr, ok := err.(*azureQuotaError); ok && region.primary {
+		return nil, az.probeQuota(instanceType, qerr)
+	} else if err != nil {
 		return nil, err
 	}
+	return inst, nil
+}
 
-	name = az.namePrefix + name
+// creationName returns a VM name derived from the arguments to
+// Create, so that if a Create call is retried with the same
+// arguments (e.g., after the response to the first attempt was
+// lost), the retry finds and reuses the NIC and VM created by the
+// earlier attempt instead of leaking them.
+//
+// The dispatcher includes a random secret in the tags of each new
+// instance, so distinct Create calls get distinct names.
+func (az *azureInstanceSet) creationName(instanceType arvados.InstanceType, imageID cloud.ImageID, tags cloud.InstanceTags, initCommand cloud.InitCommand, publicKey ssh.PublicKey) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%+v\x00%s\x00%s\x00", az.dispatcherID, instanceType, imageID, initCommand)
+	if publicKey != nil {
+		h.Write(publicKey.Marshal())
+	}
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\x00", k, tags[k])
+	}
+	return az.namePrefix + fmt.Sprintf("%x", h.Sum(nil))[:15]
+}
 
-	tags := map[string]*string{}
-	for k, v := range newTags {
-		tags[k] = to.StringPtr(v)
+// acceleratedNetworking returns true if NICs for the given instance
+// type should have accelerated networking enabled. Not all VM sizes
+// support it, so it is enabled only for the instance types listed in
+// the AcceleratedNetworking config.
+func (az *azureInstanceSet) acceleratedNetworking(instanceType arvados.InstanceType) bool {
+	for _, name := range az.azconfig.AcceleratedNetworking {
+		if name == instanceType.Name {
+			return true
+		}
 	}
-	tags["created-at"] = to.StringPtr(time.Now().Format(time.RFC3339Nano))
+	return false
+}
+
+// initScript returns the shell script that a new VM runs at boot
+// (as custom data), or a scale set VM runs when it is assigned to a
+// Create call.
+func (az *azureInstanceSet) initScript(initCommand cloud.InitCommand) string {
+	return "#!/bin/sh\n" + az.azconfig.SharedMount.initScript() + string(initCommand) + "\n"
+}
 
-	networkResourceGroup := az.azconfig.NetworkResourceGroup
-	if networkResourceGroup == "" {
-		networkResourceGroup = az.azconfig.ResourceGroup
+// imageResourceID returns the Azure resource ID of the managed image
+// or shared image gallery image identified by imageID, which is one
+// of:
+//
+//   - a complete resource ID ("/subscriptions/...")
+//   - "gallery/image/version", a shared image gallery image version
+//     in ImageResourceGroup
+//   - "gallery/image", the latest version of a shared image gallery
+//     image in ImageResourceGroup
+//   - the name of an image definition in the gallery given by
+//     SharedImageGalleryName, if set, using
+//     SharedImageGalleryImageVersion
+//   - otherwise, the name of a managed image in ImageResourceGroup
+func (az *azureInstanceSet) imageResourceID(imageID cloud.ImageID) (string, error) {
+	if strings.HasPrefix(string(imageID), "/subscriptions/") {
+		return string(imageID), nil
+	}
+	prefix := "/subscriptions/" + az.azconfig.SubscriptionID + "/resourceGroups/" + az.imageResourceGroup + "/providers/Microsoft.Compute"
+	parts := strings.Split(string(imageID), "/")
+	for _, part := range parts {
+		if part == "" {
+			return "", fmt.Errorf("invalid image ID %q: expected gallery/image/version or gallery/image", imageID)
+		}
 	}
+	switch len(parts) {
+	case 3:
+		return prefix + "/galleries/" + parts[0] + "/images/" + parts[1] + "/versions/" + parts[2], nil
+	case 2:
+		return prefix + "/galleries/" + parts[0] + "/images/" + parts[1], nil
+	case 1:
+	default:
+		return "", fmt.Errorf("invalid image ID %q: expected gallery/image/version or gallery/image", imageID)
+	}
+	gallery, version := az.azconfig.SharedImageGalleryName, az.azconfig.SharedImageGalleryImageVersion
+	if gallery != "" && version != "" {
+		return prefix + "/galleries/" + gallery + "/images/" + string(imageID) + "/versions/" + version, nil
+	} else if gallery != "" || version != "" {
+		return "", errors.New("Invalid configuration: SharedImageGalleryName and SharedImageGalleryImageVersion must both be set or both be empty")
+	}
+	return prefix + "/images/" + string(imageID), nil
+}
 
-	nicParameters := network.Interface{
-		Location: &az.azconfig.Location,
+// createVM creates a new VM with the given name, and its NIC, in the
+// given region.
+//
+// If a NIC or VM with the given name already exists (left behind by
+// an earlier attempt with the same name), it is reused. If the VM
+// cannot be created, the NIC is deleted.
+func (az *azureInstanceSet) createVM(
+	name string,
+	region *azureRegion,
+	instanceType arvados.InstanceType,
+	imageID cloud.ImageID,
+	newTags cloud.InstanceTags,
+	initCommand cloud.InitCommand,
+	publicKey ssh.PublicKey) (*azureInstance, error) {
+
+	tags := az.resourceTags()
+	for k, v := range newTags {
+		tags[k] = to.Ptr(v)
+	}
+	tags["created-at"] = to.Ptr(time.Now().Format(time.RFC3339Nano))
+	for k, v := range az.azconfig.SharedMount.tags() {
+		tags[k] = to.Ptr(v)
+	}
+	tags[tagLocation] = to.Ptr(region.location)
+	zone := az.pickZone(region.zones)
+	if zone != "" {
+		tags[tagAvailabilityZone] = to.Ptr(zone)
+	}
+	if gen := az.generations.get(); gen != "" {
+		tags[tagGeneration] = to.Ptr(gen)
+	}
+	host, err := az.pickHost(instanceType)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		tags[tagDedicatedHost] = to.Ptr(host[strings.LastIndex(host, "/")+1:])
+	}
+
+	ipConfig := &armnetwork.InterfaceIPConfiguration{
+		Name: to.Ptr("ip1"),
+		Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{
+			PrivateIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodDynamic),
+		},
+	}
+	nicParameters := armnetwork.Interface{
+		Location: &region.location,
 		Tags:     tags,
-		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
-			IPConfigurations: &[]network.InterfaceIPConfiguration{
-				{
-					Name: to.StringPtr("ip1"),
-					InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
-						Subnet: &network.Subnet{
-							ID: to.StringPtr(fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers"+
-								"/Microsoft.Network/virtualnetworks/%s/subnets/%s",
-								az.azconfig.SubscriptionID,
-								networkResourceGroup,
-								az.azconfig.Network,
-								az.azconfig.Subnet)),
-						},
-						PrivateIPAllocationMethod: network.Dynamic,
-					},
-				},
-			},
+		Properties: &armnetwork.InterfacePropertiesFormat{
+			IPConfigurations: []*armnetwork.InterfaceIPConfiguration{ipConfig},
 		},
 	}
-	nic, err := az.netClient.createOrUpdate(az.ctx, az.azconfig.ResourceGroup, name+"-nic", nicParameters)
-	if err != nil {
+	if region.nsgID != "" {
+		nicParameters.Properties.NetworkSecurityGroup = &armnetwork.SecurityGroup{ID: to.Ptr(region.nsgID)}
+	}
+	if az.acceleratedNetworking(instanceType) {
+		nicParameters.Properties.EnableAcceleratedNetworking = to.Ptr(true)
+	}
+	var pip *armnetwork.PublicIPAddress
+	if az.azconfig.CreatePublicIP {
+		p, err := az.setupPublicIP(name, region.location, tags, zone)
+		if err != nil {
+			return nil, err
+		}
+		pip = &p
+		ipConfig.Properties.PublicIPAddress = &armnetwork.PublicIPAddress{ID: p.ID}
+	}
+	// cleanupPublicIP deletes the public IP (if any) after a
+	// failed create. It must be called after the NIC is deleted.
+	cleanupPublicIP := func() {
+		if pip != nil {
+			az.cleanupPublicIP(*pip)
+		}
+	}
+	nic, err := az.netClient.get(az.ctx, az.azconfig.ResourceGroup, name+"-nic")
+	if err == nil {
+		az.logger.Infof("reusing NIC %s from earlier attempt to create %s", *nic.Name, name)
+	} else if !isNotFound(err) {
+		cleanupPublicIP()
+		return nil, wrapAzureError(err)
+	} else {
+		subnets, err := region.subnetPicker.pick(region.subnets)
+		if err != nil {
+			cleanupPublicIP()
+			return nil, err
+		}
+		// Try the next subnet if this one is out of
+		// addresses.
+		exhausted := false
+		for _, subnet := range subnets {
+			ipConfig.Properties.Subnet = &armnetwork.Subnet{ID: to.Ptr(region.networkID + "/subnets/" + subnet)}
+			nic, err = az.netClient.createOrUpdate(az.ctx, az.azconfig.ResourceGroup, name+"-nic", nicParameters)
+			exhausted = err != nil && az.subnetExhausted(region.subnetPicker, subnet, err)
+			if !exhausted {
+				break
+			}
+		}
+		if exhausted {
+			cleanupPublicIP()
+			return nil, &azureSubnetsExhaustedError{fmt.Errorf("all subnets are out of private IP addresses: %w", err)}
+		} else if err != nil {
+			cleanupPublicIP()
+			return nil, wrapAzureError(err)
+		}
+	}
+
+	if vm, err := az.vmClient.get(az.ctx, az.azconfig.ResourceGroup, name); err == nil &&
+		vm.Properties != nil &&
+		vm.Properties.ProvisioningState != nil && *vm.Properties.ProvisioningState != "Failed" {
+		// An earlier attempt got as far as creating the VM.
+		az.logger.Infof("reusing VM %s from earlier attempt", name)
+		return &azureInstance{
+			provider: az,
+			nic:      nic,
+			vm:       vm,
+		}, nil
+	} else if err != nil && !isNotFound(err) {
+		az.cleanupNic(nic)
+		cleanupPublicIP()
 		return nil, wrapAzureError(err)
 	}
 
 	var blobname string
-	customData := base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\n" + initCommand + "\n"))
-	var storageProfile *compute.StorageProfile
+	script, err := az.customData(name, instanceType, newTags, initCommand)
+	if err != nil {
+		az.cleanupNic(nic)
+		cleanupPublicIP()
+		return nil, err
+	}
+	customData := base64.StdEncoding.EncodeToString([]byte(script))
+	var storageProfile *armcompute.StorageProfile
 
-	re := regexp.MustCompile(`^http(s?)://`)
-	if re.MatchString(string(imageID)) {
+	imageID, plan, err := az.regionImage(region, instanceType, imageID)
+	if err != nil {
+		az.cleanupNic(nic)
+		cleanupPublicIP()
+		return nil, wrapAzureError(err)
+	}
+	if unmanagedImageRe.MatchString(string(imageID)) {
+		if plan != nil {
+			az.cleanupNic(nic)
+			cleanupPublicIP()
+			return nil, wrapAzureError(errors.New("Invalid configuration: can't use ImagePlans with unmanaged image URL"))
+		}
 		if az.blobcont == nil {
 			az.cleanupNic(nic)
+			cleanupPublicIP()
 			return nil, wrapAzureError(errors.New("Invalid configuration: can't configure unmanaged image URL without StorageAccount and BlobContainer"))
 		}
 		blobname = fmt.Sprintf("%s-os.vhd", name)
@@ -459,88 +1116,110 @@ func (az *azureInstanceSet) Create(
 			az.azconfig.BlobContainer,
 			blobname)
 		az.logger.Warn("using deprecated unmanaged image, see https://doc.arvados.org/ to migrate to managed disks")
-		storageProfile = &compute.StorageProfile{
-			OsDisk: &compute.OSDisk{
-				OsType:       compute.Linux,
-				Name:         to.StringPtr(name + "-os"),
-				CreateOption: compute.DiskCreateOptionTypesFromImage,
-				Image: &compute.VirtualHardDisk{
-					URI: to.StringPtr(string(imageID)),
+		storageProfile = &armcompute.StorageProfile{
+			OSDisk: &armcompute.OSDisk{
+				OSType:       to.Ptr(armcompute.OperatingSystemTypesLinux),
+				Name:         to.Ptr(name + "-os"),
+				CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesFromImage),
+				Image: &armcompute.VirtualHardDisk{
+					URI: to.Ptr(string(imageID)),
 				},
-				Vhd: &compute.VirtualHardDisk{
+				Vhd: &armcompute.VirtualHardDisk{
 					URI: &instanceVhd,
 				},
 			},
 		}
 	} else {
-		id := to.StringPtr("/subscriptions/" + az.azconfig.SubscriptionID + "/resourceGroups/" + az.imageResourceGroup + "/providers/Microsoft.Compute/images/" + string(imageID))
-		if az.azconfig.SharedImageGalleryName != "" && az.azconfig.SharedImageGalleryImageVersion != "" {
-			id = to.StringPtr("/subscriptions/" + az.azconfig.SubscriptionID + "/resourceGroups/" + az.imageResourceGroup + "/providers/Microsoft.Compute/galleries/" + az.azconfig.SharedImageGalleryName + "/images/" + string(imageID) + "/versions/" + az.azconfig.SharedImageGalleryImageVersion)
-		} else if az.azconfig.SharedImageGalleryName != "" || az.azconfig.SharedImageGalleryImageVersion != "" {
+		imageRef, err := az.imageReference(imageID)
+		if err != nil {
 			az.cleanupNic(nic)
-			return nil, wrapAzureError(errors.New("Invalid configuration: SharedImageGalleryName and SharedImageGalleryImageVersion must both be set or both be empty"))
+			cleanupPublicIP()
+			return nil, wrapAzureError(err)
 		}
-		storageProfile = &compute.StorageProfile{
-			ImageReference: &compute.ImageReference{
-				ID: id,
-			},
-			OsDisk: &compute.OSDisk{
-				OsType:       compute.Linux,
-				Name:         to.StringPtr(name + "-os"),
-				CreateOption: compute.DiskCreateOptionTypesFromImage,
+		storageProfile = &armcompute.StorageProfile{
+			ImageReference: imageRef,
+			OSDisk: &armcompute.OSDisk{
+				OSType:       to.Ptr(armcompute.OperatingSystemTypesLinux),
+				Name:         to.Ptr(name + "-os"),
+				CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesFromImage),
 			},
 		}
 	}
+	if err := az.applyOSDisk(instanceType, storageProfile); err != nil {
+		az.cleanupNic(nic)
+		cleanupPublicIP()
+		return nil, wrapAzureError(err)
+	}
+	if err := az.applyDiskEncryption(storageProfile); err != nil {
+		az.cleanupNic(nic)
+		cleanupPublicIP()
+		return nil, wrapAzureError(err)
+	}
 
-	vmParameters := compute.VirtualMachine{
-		Location: &az.azconfig.Location,
+	vmParameters := armcompute.VirtualMachine{
+		Location: &region.location,
 		Tags:     tags,
-		VirtualMachineProperties: &compute.VirtualMachineProperties{
-			HardwareProfile: &compute.HardwareProfile{
-				VMSize: compute.VirtualMachineSizeTypes(instanceType.ProviderType),
+		Plan:     plan,
+		Properties: &armcompute.VirtualMachineProperties{
+			HardwareProfile: &armcompute.HardwareProfile{
+				VMSize: to.Ptr(armcompute.VirtualMachineSizeTypes(instanceType.ProviderType)),
 			},
 			StorageProfile: storageProfile,
-			NetworkProfile: &compute.NetworkProfile{
-				NetworkInterfaces: &[]compute.NetworkInterfaceReference{
+			NetworkProfile: &armcompute.NetworkProfile{
+				NetworkInterfaces: []*armcompute.NetworkInterfaceReference{
 					{
 						ID: nic.ID,
-						NetworkInterfaceReferenceProperties: &compute.NetworkInterfaceReferenceProperties{
-							Primary: to.BoolPtr(true),
+						Properties: &armcompute.NetworkInterfaceReferenceProperties{
+							Primary: to.Ptr(true),
 						},
 					},
 				},
 			},
-			OsProfile: &compute.OSProfile{
+			OSProfile: &armcompute.OSProfile{
 				ComputerName:  &name,
-				AdminUsername: to.StringPtr(az.azconfig.AdminUsername),
-				LinuxConfiguration: &compute.LinuxConfiguration{
-					DisablePasswordAuthentication: to.BoolPtr(true),
+				AdminUsername: to.Ptr(az.azconfig.AdminUsername),
+				LinuxConfiguration: &armcompute.LinuxConfiguration{
+					DisablePasswordAuthentication: to.Ptr(true),
 				},
 				CustomData: &customData,
 			},
+			DiagnosticsProfile: az.diagnosticsProfile(),
+			SecurityProfile:    az.securityProfile(),
 		},
 	}
 
 	if publicKey != nil {
-		vmParameters.VirtualMachineProperties.OsProfile.LinuxConfiguration.SSH = &compute.SSHConfiguration{
-			PublicKeys: &[]compute.SSHPublicKey{
+		vmParameters.Properties.OSProfile.LinuxConfiguration.SSH = &armcompute.SSHConfiguration{
+			PublicKeys: []*armcompute.SSHPublicKey{
 				{
-					Path:    to.StringPtr("/home/" + az.azconfig.AdminUsername + "/.ssh/authorized_keys"),
-					KeyData: to.StringPtr(string(ssh.MarshalAuthorizedKey(publicKey))),
+					Path:    to.Ptr(az.azconfig.authorizedKeysPath()),
+					KeyData: to.Ptr(string(ssh.MarshalAuthorizedKey(publicKey))),
 				},
 			},
 		}
 	}
 
+	if az.availSetID != "" {
+		vmParameters.Properties.AvailabilitySet = &armcompute.SubResource{ID: &az.availSetID}
+	}
+
+	if zone != "" {
+		vmParameters.Zones = []*string{&zone}
+	}
+
+	if host != "" {
+		vmParameters.Properties.Host = &armcompute.SubResource{ID: &host}
+	}
+
 	if instanceType.Preemptible {
 		// Setting maxPrice to -1 is the equivalent of paying spot price, up to the
 		// normal price. This means the node will not be pre-empted for price
 		// reasons. It may still be pre-empted for capacity reasons though. And
 		// Azure offers *no* SLA on spot instances.
 		var maxPrice float64 = -1
-		vmParameters.VirtualMachineProperties.Priority = compute.Spot
-		vmParameters.VirtualMachineProperties.EvictionPolicy = compute.Delete
-		vmParameters.VirtualMachineProperties.BillingProfile = &compute.BillingProfile{MaxPrice: &maxPrice}
+		vmParameters.Properties.Priority = to.Ptr(armcompute.VirtualMachinePriorityTypesSpot)
+		vmParameters.Properties.EvictionPolicy = to.Ptr(armcompute.VirtualMachineEvictionPolicyTypesDelete)
+		vmParameters.Properties.BillingProfile = &armcompute.BillingProfile{MaxPrice: &maxPrice}
 	}
 
 	vm, err := az.vmClient.createOrUpdate(az.ctx, az.azconfig.ResourceGroup, name, vmParameters)
@@ -551,9 +1230,10 @@ func (az *azureInstanceSet) Create(
 		// and manageNics is only triggered periodically. This is most important
 		// for nics, because those are subject to a quota.
 		az.cleanupNic(nic)
+		cleanupPublicIP()
 
 		if blobname != "" {
-			_, delerr := az.blobcont.GetBlobReference(blobname).DeleteIfExists(nil)
+			delerr := az.destroyBlob(blobname)
 			if delerr != nil {
 				az.logger.WithError(delerr).Warnf("Error cleaning up vhd blob after failed create")
 			}
@@ -561,17 +1241,36 @@ func (az *azureInstanceSet) Create(
 
 		// Leave cleaning up of managed disks to the garbage collection in manageDisks()
 
+		if host != "" {
+			return nil, wrapHostCapacityError(wrapAzureError(err), host)
+		}
 		return nil, wrapAzureError(err)
 	}
 
-	return &azureInstance{
+	az.tagOSDisk(vm, tags)
+
+	inst := &azureInstance{
 		provider: az,
 		nic:      nic,
 		vm:       vm,
-	}, nil
+	}
+	if az.availSetID != "" {
+		// Surface the platform-assigned fault/update
+		// domains. Failure here doesn't make the instance
+		// unusable, so just log it.
+		domainTags, err := az.domainTags(name)
+		if err == nil {
+			err = inst.SetTags(domainTags)
+		}
+		if err != nil {
+			az.logger.WithError(err).Warnf("error tagging %s with fault/update domain", name)
+		}
+	}
+	return inst, nil
 }
 
-func (az *azureInstanceSet) Instances(cloud.InstanceTags) ([]cloud.Instance, error) {
+// Instances returns the VMs that have all of the given tags.
+func (az *azureInstanceSet) Instances(tags cloud.InstanceTags) ([]cloud.Instance, error) {
 	az.stopWg.Add(1)
 	defer az.stopWg.Done()
 
@@ -579,58 +1278,71 @@ func (az *azureInstanceSet) Instances(cloud.InstanceTags) ([]cloud.Instance, err
 	if err != nil {
 		return nil, err
 	}
+	if az.azconfig.CreatePublicIP {
+		if err := az.managePublicIPs(); err != nil {
+			return nil, err
+		}
+	}
 
-	result, err := az.vmClient.listComplete(az.ctx, az.azconfig.ResourceGroup)
+	vms, err := az.vmClient.listComplete(az.ctx, az.azconfig.ResourceGroup, tags)
 	if err != nil {
 		return nil, wrapAzureError(err)
 	}
 
 	var instances []cloud.Instance
-	for ; result.NotDone(); err = result.Next() {
-		if err != nil {
-			return nil, wrapAzureError(err)
-		}
+	az.refreshPowerStates(vms)
+	for _, vm := range vms {
+		power, _ := az.powerStates.get(*vm.ID)
 		instances = append(instances, &azureInstance{
 			provider: az,
-			vm:       result.Value(),
-			nic:      interfaces[*(*result.Value().NetworkProfile.NetworkInterfaces)[0].ID],
+			vm:       vm,
+			nic:      interfaces[*vm.Properties.NetworkProfile.NetworkInterfaces[0].ID],
+			power:    power,
 		})
 	}
+	az.generations.update(instances)
 	return instances, nil
 }
 
+// hasTags returns true if the given Azure resource tags include all
+// of the wanted tags.
+func hasTags(tags map[string]*string, want cloud.InstanceTags) bool {
+	for k, v := range want {
+		if tag := tags[k]; tag == nil || *tag != v {
+			return false
+		}
+	}
+	return true
+}
+
 // manageNics returns a list of Azure network interface resources.
 // Also performs garbage collection of NICs which have "namePrefix",
 // are not associated with a virtual machine and have a "created-at"
 // time more than DeleteDanglingResourcesAfter (to prevent racing and
 // deleting newly created NICs) in the past are deleted.
-func (az *azureInstanceSet) manageNics() (map[string]network.Interface, error) {
+func (az *azureInstanceSet) manageNics() (map[string]armnetwork.Interface, error) {
 	az.stopWg.Add(1)
 	defer az.stopWg.Done()
 
-	result, err := az.netClient.listComplete(az.ctx, az.azconfig.ResourceGroup)
+	nics, err := az.netClient.listComplete(az.ctx, az.azconfig.ResourceGroup)
 	if err != nil {
 		return nil, wrapAzureError(err)
 	}
 
-	interfaces := make(map[string]network.Interface)
+	interfaces := make(map[string]armnetwork.Interface)
 
 	timestamp := time.Now()
-	for ; result.NotDone(); err = result.Next() {
-		if err != nil {
-			az.logger.WithError(err).Warnf("Error listing nics")
-			return interfaces, nil
-		}
-		if strings.HasPrefix(*result.Value().Name, az.namePrefix) {
-			if result.Value().VirtualMachine != nil {
-				interfaces[*result.Value().ID] = result.Value()
+	for _, nic := range nics {
+		if strings.HasPrefix(*nic.Name, az.namePrefix) {
+			if nic.Properties != nil && nic.Properties.VirtualMachine != nil {
+				interfaces[*nic.ID] = nic
 			} else {
-				if result.Value().Tags["created-at"] != nil {
-					createdAt, err := time.Parse(time.RFC3339Nano, *result.Value().Tags["created-at"])
+				if nic.Tags["created-at"] != nil {
+					createdAt, err := time.Parse(time.RFC3339Nano, *nic.Tags["created-at"])
 					if err == nil {
 						if timestamp.Sub(createdAt) > az.azconfig.DeleteDanglingResourcesAfter.Duration() {
-							az.logger.Printf("Will delete %v because it is older than %s", *result.Value().Name, az.azconfig.DeleteDanglingResourcesAfter)
-							az.deleteNIC <- *result.Value().Name
+							az.logger.Printf("Will delete %v because it is older than %s", *nic.Name, az.azconfig.DeleteDanglingResourcesAfter)
+							az.nicGC.enqueue(*nic.Name, nic)
 						}
 					}
 				}
@@ -640,39 +1352,104 @@ func (az *azureInstanceSet) manageNics() (map[string]network.Interface, error) {
 	return interfaces, nil
 }
 
+// runGC periodically garbage collects blobs and managed disks, every
+// GCInterval, until the instance set is stopped. NICs and public IPs
+// are garbage collected by Instances() instead. The caller must call
+// az.stopWg.Add(1) first.
+func (az *azureInstanceSet) runGC() {
+	defer az.stopWg.Done()
+	interval := az.azconfig.GCInterval.Duration()
+	if interval <= 0 {
+		interval = defaultGCInterval
+	}
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-az.ctx.Done():
+			return
+		case <-tk.C:
+			if err := az.manageStorage(); err != nil {
+				az.logger.WithError(err).Warn("error garbage collecting storage")
+			}
+		}
+	}
+}
+
+// GarbageCollect implements cloud.InstanceSetWithGarbageCollection.
+// It looks for dangling NICs, public IPs, blobs, and managed disks
+// now, instead of waiting for the next Instances() call or
+// GCInterval, and queues them for deletion.
+func (az *azureInstanceSet) GarbageCollect() error {
+	az.stopWg.Add(1)
+	defer az.stopWg.Done()
+
+	var errs []string
+	if !az.azconfig.ScaleSets {
+		// Scale set VMs' NICs are managed by Azure.
+		if _, err := az.manageNics(); err != nil {
+			errs = append(errs, fmt.Sprintf("error garbage collecting NICs: %s", err))
+		}
+	}
+	if az.azconfig.CreatePublicIP {
+		if err := az.managePublicIPs(); err != nil {
+			errs = append(errs, fmt.Sprintf("error garbage collecting public IPs: %s", err))
+		}
+	}
+	if err := az.manageStorage(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// manageStorage garbage collects blobs (if an unmanaged disk
+// container is configured) and managed disks.
+func (az *azureInstanceSet) manageStorage() error {
+	var errs []string
+	if az.blobcont != nil {
+		if err := az.manageBlobs(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := az.manageDisks(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
 // manageBlobs garbage collects blobs (VM disk images) in the
 // configured storage account container.  It will delete blobs which
 // have "namePrefix", are "available" (which means they are not
 // leased to a VM) and haven't been modified for
 // DeleteDanglingResourcesAfter seconds.
-func (az *azureInstanceSet) manageBlobs() {
-
-	page := storage.ListBlobsParameters{Prefix: az.namePrefix}
+func (az *azureInstanceSet) manageBlobs() error {
+	blobs, err := az.blobcont.listBlobs(az.ctx, az.namePrefix)
+	if err != nil {
+		return fmt.Errorf("error listing blobs: %w", err)
+	}
 	timestamp := time.Now()
-
-	for {
-		response, err := az.blobcont.ListBlobs(page)
-		if err != nil {
-			az.logger.WithError(err).Warn("Error listing blobs")
-			return
+	for _, b := range blobs {
+		props := b.Properties
+		if b.Name == nil || props == nil || props.LastModified == nil {
+			continue
 		}
-		for _, b := range response.Blobs {
-			age := timestamp.Sub(time.Time(b.Properties.LastModified))
-			if b.Properties.BlobType == storage.BlobTypePage &&
-				b.Properties.LeaseState == "available" &&
-				b.Properties.LeaseStatus == "unlocked" &&
-				age.Seconds() > az.azconfig.DeleteDanglingResourcesAfter.Duration().Seconds() {
-
-				az.logger.Printf("Blob %v is unlocked and not modified for %v seconds, will delete", b.Name, age.Seconds())
-				az.deleteBlob <- b
-			}
-		}
-		if response.NextMarker != "" {
-			page.Marker = response.NextMarker
-		} else {
-			break
+		age := timestamp.Sub(*props.LastModified)
+		if props.BlobType != nil && *props.BlobType == container.BlobTypePageBlob &&
+			props.LeaseState != nil && *props.LeaseState == lease.StateTypeAvailable &&
+			props.LeaseStatus != nil && *props.LeaseStatus == lease.StatusTypeUnlocked &&
+			age.Seconds() > az.azconfig.DeleteDanglingResourcesAfter.Duration().Seconds() {
+
+			az.logger.Printf("Blob %v is unlocked and not modified for %v seconds, will delete", *b.Name, age.Seconds())
+			az.blobGC.enqueue(*b.Name, *b.Name)
 		}
 	}
+	return nil
 }
 
 // manageDisks garbage collects managed compute disks (VM disk images) in the
@@ -680,32 +1457,29 @@ func (az *azureInstanceSet) manageBlobs() {
 // are "unattached" (which means they are not leased to a VM) and were created
 // more than DeleteDanglingResourcesAfter seconds ago.  (Azure provides no
 // modification timestamp on managed disks, there is only a creation timestamp)
-func (az *azureInstanceSet) manageDisks() {
+func (az *azureInstanceSet) manageDisks() error {
 
 	re := regexp.MustCompile(`^` + regexp.QuoteMeta(az.namePrefix) + `.*-os$`)
 	threshold := time.Now().Add(-az.azconfig.DeleteDanglingResourcesAfter.Duration())
 
-	response, err := az.disksClient.listByResourceGroup(az.ctx, az.imageResourceGroup)
+	disks, err := az.disksClient.listByResourceGroup(az.ctx, az.imageResourceGroup)
 	if err != nil {
-		az.logger.WithError(err).Warn("Error listing disks")
-		return
+		return fmt.Errorf("error listing disks: %w", wrapAzureError(err))
 	}
 
-	for ; response.NotDone(); err = response.Next() {
-		if err != nil {
-			az.logger.WithError(err).Warn("Error getting next page of disks")
-			return
+	for _, d := range disks {
+		if d.Properties == nil || d.Properties.DiskState == nil || d.Properties.TimeCreated == nil {
+			continue
 		}
-		for _, d := range response.Values() {
-			if d.DiskProperties.DiskState == compute.Unattached &&
-				d.Name != nil && re.MatchString(*d.Name) &&
-				d.DiskProperties.TimeCreated.ToTime().Before(threshold) {
+		if *d.Properties.DiskState == armcompute.DiskStateUnattached &&
+			d.Name != nil && re.MatchString(*d.Name) &&
+			d.Properties.TimeCreated.Before(threshold) {
 
-				az.logger.Printf("Disk %v is unlocked and was created at %+v, will delete", *d.Name, d.DiskProperties.TimeCreated.ToTime())
-				az.deleteDisk <- d
-			}
+			az.logger.Printf("Disk %v is unlocked and was created at %+v, will delete", *d.Name, *d.Properties.TimeCreated)
+			az.diskGC.enqueue(*d.Name, d)
 		}
 	}
+	return nil
 }
 
 func (az *azureInstanceSet) InstanceQuotaGroup(arvados.InstanceType) cloud.InstanceQuotaGroup {
@@ -716,15 +1490,20 @@ func (az *azureInstanceSet) InstanceQuotaGroup(arvados.InstanceType) cloud.Insta
 func (az *azureInstanceSet) Stop() {
 	az.stopFunc()
 	az.stopWg.Wait()
-	close(az.deleteNIC)
-	close(az.deleteBlob)
-	close(az.deleteDisk)
+	if az.events != nil {
+		close(az.events)
+	}
+	az.nicGC.close()
+	az.blobGC.close()
+	az.diskGC.close()
+	az.publicIPGC.close()
 }
 
 type azureInstance struct {
 	provider *azureInstanceSet
-	nic      network.Interface
-	vm       compute.VirtualMachine
+	nic      armnetwork.Interface
+	vm       armcompute.VirtualMachine
+	power    cloud.PowerState
 }
 
 func (ai *azureInstance) ID() cloud.InstanceID {
@@ -736,7 +1515,7 @@ func (ai *azureInstance) String() string {
 }
 
 func (ai *azureInstance) ProviderType() string {
-	return string(ai.vm.VirtualMachineProperties.HardwareProfile.VMSize)
+	return string(*ai.vm.Properties.HardwareProfile.VMSize)
 }
 
 func (ai *azureInstance) SetTags(newTags cloud.InstanceTags) error {
@@ -748,11 +1527,16 @@ func (ai *azureInstance) SetTags(newTags cloud.InstanceTags) error {
 		tags[k] = v
 	}
 	for k, v := range newTags {
-		tags[k] = to.StringPtr(v)
+		tags[k] = to.Ptr(v)
 	}
 
-	vmParameters := compute.VirtualMachine{
-		Location: &ai.provider.azconfig.Location,
+	// The VM might be in one of the secondary Locations.
+	location := ai.provider.azconfig.Location
+	if ai.vm.Location != nil {
+		location = *ai.vm.Location
+	}
+	vmParameters := armcompute.VirtualMachine{
+		Location: &location,
 		Tags:     tags,
 	}
 	vm, err := ai.provider.vmClient.createOrUpdate(ai.provider.ctx, ai.provider.azconfig.ResourceGroup, *ai.vm.Name, vmParameters)
@@ -776,16 +1560,35 @@ func (ai *azureInstance) Destroy() error {
 	ai.provider.stopWg.Add(1)
 	defer ai.provider.stopWg.Done()
 
-	_, err := ai.provider.vmClient.delete(ai.provider.ctx, ai.provider.azconfig.ResourceGroup, *ai.vm.Name)
+	if err := ai.provider.checkDeletable(*ai.vm.Name, ai.vm.Tags, true); err != nil {
+		return err
+	}
+	if ai.provider.dryRun("VM", *ai.vm.Name) {
+		return nil
+	}
+	err := ai.provider.vmClient.delete(ai.provider.ctx, ai.provider.azconfig.ResourceGroup, *ai.vm.Name)
 	return wrapAzureError(err)
 }
 
+// Address returns the instance's public IP address if CreatePublicIP
+// is enabled, otherwise its private IP address.
 func (ai *azureInstance) Address() string {
-	if iprops := ai.nic.InterfacePropertiesFormat; iprops == nil {
+	if ai.provider.azconfig.CreatePublicIP {
+		if addr := ai.provider.publicIP(ai.nic); addr != "" {
+			return addr
+		}
+	}
+	return nicAddress(ai.nic)
+}
+
+// nicAddress returns the private IP address of the given NIC, or ""
+// if it has none.
+func nicAddress(nic armnetwork.Interface) string {
+	if iprops := nic.Properties; iprops == nil {
 		return ""
-	} else if ipconfs := iprops.IPConfigurations; ipconfs == nil || len(*ipconfs) == 0 {
+	} else if ipconfs := iprops.IPConfigurations; len(ipconfs) == 0 || ipconfs[0] == nil {
 		return ""
-	} else if ipconfprops := (*ipconfs)[0].InterfaceIPConfigurationPropertiesFormat; ipconfprops == nil {
+	} else if ipconfprops := ipconfs[0].Properties; ipconfprops == nil {
 		return ""
 	} else if addr := ipconfprops.PrivateIPAddress; addr == nil {
 		return ""
@@ -802,6 +1605,8 @@ func (ai *azureInstance) RemoteUser() string {
 	return ai.provider.azconfig.AdminUsername
 }
 
-func (ai *azureInstance) VerifyHostKey(ssh.PublicKey, *ssh.Client) error {
-	return cloud.ErrNotImplemented
+func (ai *azureInstance) VerifyHostKey(key ssh.PublicKey, _ *ssh.Client) error {
+	return ai.provider.verifyHostKey(key, func(script string) (string, error) {
+		return ai.provider.vmClient.runCommand(ai.provider.ctx, ai.provider.azconfig.ResourceGroup, *ai.vm.Name, script)
+	})
 }
@@ -30,16 +30,23 @@
 package azure
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -47,12 +54,20 @@ import (
 	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/config"
-	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
-	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-06-01/network"
-	"github.com/Azure/azure-sdk-for-go/storage"
-	"github.com/Azure/go-autorest/autorest"
-	"github.com/Azure/go-autorest/autorest/azure"
-	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/lease"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	check "gopkg.in/check.v1"
@@ -70,54 +85,496 @@ var _ = check.Suite(&AzureInstanceSetSuite{})
 const testNamePrefix = "compute-test123-"
 
 type VirtualMachinesClientStub struct {
-	vmParameters compute.VirtualMachine
+	vmParameters armcompute.VirtualMachine
+	vms          map[string]armcompute.VirtualMachine
+	createErr    error
+	deleted      []string
+	started      []string
+	deallocated  []string
+	commands     []string
+	// Output and error returned by runCommand.
+	commandOutput string
+	commandErr    error
+	// Locations where createOrUpdate fails with AllocationFailed.
+	fullLocations map[string]bool
+	// Power state status code reported by instanceView, by VM
+	// name.
+	powerStates   map[string]string
+	instanceViews int
 }
 
 func (stub *VirtualMachinesClientStub) createOrUpdate(ctx context.Context,
 	resourceGroupName string,
 	VMName string,
-	parameters compute.VirtualMachine) (result compute.VirtualMachine, err error) {
+	parameters armcompute.VirtualMachine) (result armcompute.VirtualMachine, err error) {
+	if stub.createErr != nil {
+		return armcompute.VirtualMachine{}, stub.createErr
+	}
+	if parameters.Properties != nil && parameters.Location != nil && stub.fullLocations[*parameters.Location] {
+		return armcompute.VirtualMachine{}, newAzureResponseError(http.StatusConflict, "AllocationFailed", "Allocation failed")
+	}
 	parameters.ID = &VMName
 	parameters.Name = &VMName
+	if parameters.Properties == nil {
+		// Tag update (see SetTags)
+		if vm, ok := stub.vms[VMName]; ok {
+			parameters.Properties = vm.Properties
+		} else {
+			parameters.Properties = stub.vmParameters.Properties
+		}
+	} else {
+		parameters.Properties.ProvisioningState = to.Ptr("Succeeded")
+		if sp := parameters.Properties.StorageProfile; sp != nil && sp.OSDisk != nil && sp.OSDisk.Vhd == nil && sp.OSDisk.ManagedDisk == nil {
+			osDisk := *sp.OSDisk
+			osDisk.ManagedDisk = &armcompute.ManagedDiskParameters{
+				ID: to.Ptr("/subscriptions/zzzzz/resourceGroups/" + resourceGroupName + "/providers/Microsoft.Compute/disks/" + *osDisk.Name),
+			}
+			storageProfile := *sp
+			storageProfile.OSDisk = &osDisk
+			props := *parameters.Properties
+			props.StorageProfile = &storageProfile
+			parameters.Properties = &props
+		}
+	}
 	stub.vmParameters = parameters
+	if stub.vms == nil {
+		stub.vms = map[string]armcompute.VirtualMachine{}
+	}
+	stub.vms[VMName] = parameters
 	return parameters, nil
 }
 
-func (*VirtualMachinesClientStub) delete(ctx context.Context, resourceGroupName string, VMName string) (result *http.Response, err error) {
-	return nil, nil
+func (stub *VirtualMachinesClientStub) get(ctx context.Context, resourceGroupName string, VMName string) (armcompute.VirtualMachine, error) {
+	vm, ok := stub.vms[VMName]
+	if !ok {
+		return armcompute.VirtualMachine{}, errAzureNotFound
+	}
+	return vm, nil
+}
+
+func (stub *VirtualMachinesClientStub) delete(ctx context.Context, resourceGroupName string, VMName string) error {
+	stub.deleted = append(stub.deleted, VMName)
+	return nil
+}
+
+func (stub *VirtualMachinesClientStub) listComplete(ctx context.Context, resourceGroupName string, tags cloud.InstanceTags) ([]armcompute.VirtualMachine, error) {
+	var list []armcompute.VirtualMachine
+	for _, vm := range stub.vms {
+		if hasTags(vm.Tags, tags) {
+			list = append(list, vm)
+		}
+	}
+	return list, nil
+}
+
+func (stub *VirtualMachinesClientStub) instanceView(ctx context.Context, resourceGroupName string, VMName string) (result armcompute.VirtualMachineInstanceView, err error) {
+	stub.instanceViews++
+	view := armcompute.VirtualMachineInstanceView{
+		PlatformFaultDomain:  to.Ptr(int32(1)),
+		PlatformUpdateDomain: to.Ptr(int32(3)),
+	}
+	if code, ok := stub.powerStates[VMName]; ok {
+		view.Statuses = []*armcompute.InstanceViewStatus{
+			{Code: to.Ptr("ProvisioningState/succeeded")},
+			{Code: to.Ptr(code)},
+		}
+	}
+	if vm, ok := stub.vms[VMName]; ok && vm.Properties != nil && vm.Properties.DiagnosticsProfile != nil {
+		view.BootDiagnostics = &armcompute.BootDiagnosticsInstanceView{
+			SerialConsoleLogBlobURI: to.Ptr(*vm.Properties.DiagnosticsProfile.BootDiagnostics.StorageURI + "bootdiagnostics-test/" + VMName + ".serialconsole.log"),
+		}
+	}
+	return view, nil
+}
+
+func (stub *VirtualMachinesClientStub) start(ctx context.Context, resourceGroupName string, VMName string) error {
+	stub.started = append(stub.started, VMName)
+	return nil
+}
+
+func (stub *VirtualMachinesClientStub) deallocate(ctx context.Context, resourceGroupName string, VMName string) error {
+	stub.deallocated = append(stub.deallocated, VMName)
+	return nil
+}
+
+func (stub *VirtualMachinesClientStub) runCommand(ctx context.Context, resourceGroupName string, VMName string, script string) (string, error) {
+	stub.commands = append(stub.commands, script)
+	return stub.commandOutput, stub.commandErr
+}
+
+type AvailabilitySetsClientStub struct {
+	created map[string]armcompute.AvailabilitySet
 }
 
-func (*VirtualMachinesClientStub) listComplete(ctx context.Context, resourceGroupName string) (result compute.VirtualMachineListResultIterator, err error) {
-	return compute.VirtualMachineListResultIterator{}, nil
+func (stub *AvailabilitySetsClientStub) get(ctx context.Context, resourceGroupName string, name string) (armcompute.AvailabilitySet, error) {
+	if name != "existing-avset" {
+		return armcompute.AvailabilitySet{}, errors.New("not found")
+	}
+	return armcompute.AvailabilitySet{ID: to.Ptr("/subscriptions/zzzzz/resourceGroups/" + resourceGroupName + "/providers/Microsoft.Compute/availabilitySets/" + name)}, nil
+}
+
+func (stub *AvailabilitySetsClientStub) createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armcompute.AvailabilitySet) (armcompute.AvailabilitySet, error) {
+	if stub.created == nil {
+		stub.created = map[string]armcompute.AvailabilitySet{}
+	}
+	stub.created[name] = parameters
+	parameters.ID = to.Ptr("/subscriptions/zzzzz/resourceGroups/" + resourceGroupName + "/providers/Microsoft.Compute/availabilitySets/" + name)
+	return parameters, nil
 }
 
-type InterfacesClientStub struct{}
+type InterfacesClientStub struct {
+	nics        map[string]armnetwork.Interface
+	created     []string
+	deleted     []string
+	fullSubnets map[string]bool // subnet name => out of addresses
+}
 
-func (*InterfacesClientStub) createOrUpdate(ctx context.Context,
+func (stub *InterfacesClientStub) createOrUpdate(ctx context.Context,
 	resourceGroupName string,
 	nicName string,
-	parameters network.Interface) (result network.Interface, err error) {
-	parameters.ID = to.StringPtr(nicName)
-	(*parameters.IPConfigurations)[0].PrivateIPAddress = to.StringPtr("192.168.5.5")
+	parameters armnetwork.Interface) (result armnetwork.Interface, err error) {
+	if subnet := parameters.Properties.IPConfigurations[0].Properties.Subnet; subnet != nil && stub.fullSubnets[path.Base(*subnet.ID)] {
+		return armnetwork.Interface{}, newAzureResponseError(http.StatusBadRequest, "SubnetIsFull", "Subnet is full")
+	}
+	parameters.ID = to.Ptr(nicName)
+	parameters.Name = to.Ptr(nicName)
+	parameters.Properties.IPConfigurations[0].Properties.PrivateIPAddress = to.Ptr("192.168.5.5")
+	if stub.nics == nil {
+		stub.nics = map[string]armnetwork.Interface{}
+	}
+	stub.nics[nicName] = parameters
+	stub.created = append(stub.created, nicName)
 	return parameters, nil
 }
 
-func (*InterfacesClientStub) delete(ctx context.Context, resourceGroupName string, VMName string) (result *http.Response, err error) {
+func (stub *InterfacesClientStub) get(ctx context.Context, resourceGroupName string, nicName string) (armnetwork.Interface, error) {
+	nic, ok := stub.nics[nicName]
+	if !ok {
+		return armnetwork.Interface{}, errAzureNotFound
+	}
+	return nic, nil
+}
+
+func (stub *InterfacesClientStub) delete(ctx context.Context, resourceGroupName string, nicName string) error {
+	delete(stub.nics, nicName)
+	stub.deleted = append(stub.deleted, nicName)
+	return nil
+}
+
+func (*InterfacesClientStub) listComplete(ctx context.Context, resourceGroupName string) ([]armnetwork.Interface, error) {
 	return nil, nil
 }
 
-func (*InterfacesClientStub) listComplete(ctx context.Context, resourceGroupName string) (result network.InterfaceListResultIterator, err error) {
-	return network.InterfaceListResultIterator{}, nil
+func (stub *InterfacesClientStub) updateTags(ctx context.Context, resourceGroupName string, nicName string, tags map[string]*string) error {
+	nic, ok := stub.nics[nicName]
+	if !ok {
+		return errAzureNotFound
+	}
+	nic.Tags = tags
+	stub.nics[nicName] = nic
+	return nil
+}
+
+type DisksClientStub struct {
+	tags    map[string]map[string]*string // "resourcegroup/diskname" => tags
+	disks   []armcompute.Disk
+	listErr error
+}
+
+func (stub *DisksClientStub) listByResourceGroup(ctx context.Context, resourceGroupName string) ([]armcompute.Disk, error) {
+	return stub.disks, stub.listErr
+}
+
+func (*DisksClientStub) delete(ctx context.Context, resourceGroupName string, diskName string) error {
+	return nil
+}
+
+func (stub *DisksClientStub) updateTags(ctx context.Context, resourceGroupName string, diskName string, tags map[string]*string) error {
+	if stub.tags == nil {
+		stub.tags = map[string]map[string]*string{}
+	}
+	stub.tags[resourceGroupName+"/"+diskName] = tags
+	return nil
+}
+
+type PublicIPAddressesClientStub struct {
+	pips    map[string]armnetwork.PublicIPAddress
+	deleted []string
+}
+
+func (stub *PublicIPAddressesClientStub) createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armnetwork.PublicIPAddress) (armnetwork.PublicIPAddress, error) {
+	if stub.pips == nil {
+		stub.pips = map[string]armnetwork.PublicIPAddress{}
+	}
+	parameters.ID = to.Ptr("/subscriptions/zzzzz/resourceGroups/" + resourceGroupName + "/providers/Microsoft.Network/publicIPAddresses/" + name)
+	parameters.Name = to.Ptr(name)
+	parameters.Properties.IPAddress = to.Ptr(fmt.Sprintf("203.0.113.%d", len(stub.pips)+1))
+	stub.pips[name] = parameters
+	return parameters, nil
+}
+
+func (stub *PublicIPAddressesClientStub) get(ctx context.Context, resourceGroupName string, name string) (armnetwork.PublicIPAddress, error) {
+	pip, ok := stub.pips[name]
+	if !ok {
+		return armnetwork.PublicIPAddress{}, errAzureNotFound
+	}
+	return pip, nil
+}
+
+func (stub *PublicIPAddressesClientStub) delete(ctx context.Context, resourceGroupName string, name string) error {
+	delete(stub.pips, name)
+	stub.deleted = append(stub.deleted, name)
+	return nil
+}
+
+func (stub *PublicIPAddressesClientStub) listComplete(ctx context.Context, resourceGroupName string) ([]armnetwork.PublicIPAddress, error) {
+	var list []armnetwork.PublicIPAddress
+	for _, pip := range stub.pips {
+		list = append(list, pip)
+	}
+	return list, nil
+}
+
+type ScaleSetsClientStub struct {
+	mtx      sync.Mutex
+	sets     map[string]armcompute.VirtualMachineScaleSet
+	vms      map[string][]armcompute.VirtualMachineScaleSetVM
+	nextID   int
+	scaleOps int
+	commands []string
+	deleted  []string
+	// Output returned by runCommand.
+	commandOutput string
+}
+
+func (stub *ScaleSetsClientStub) createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armcompute.VirtualMachineScaleSet) (armcompute.VirtualMachineScaleSet, error) {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	if stub.sets == nil {
+		stub.sets = map[string]armcompute.VirtualMachineScaleSet{}
+		stub.vms = map[string][]armcompute.VirtualMachineScaleSetVM{}
+	}
+	parameters.Name = to.Ptr(name)
+	stub.sets[name] = parameters
+	stub.scaleOps++
+	stub.resize(name, *parameters.SKU.Capacity)
+	return parameters, nil
+}
+
+func (stub *ScaleSetsClientStub) get(ctx context.Context, resourceGroupName string, name string) (armcompute.VirtualMachineScaleSet, error) {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	set, ok := stub.sets[name]
+	if !ok {
+		return armcompute.VirtualMachineScaleSet{}, errAzureNotFound
+	}
+	return set, nil
+}
+
+func (stub *ScaleSetsClientStub) list(ctx context.Context, resourceGroupName string) ([]armcompute.VirtualMachineScaleSet, error) {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	var sets []armcompute.VirtualMachineScaleSet
+	for _, set := range stub.sets {
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+func (stub *ScaleSetsClientStub) setCapacity(ctx context.Context, resourceGroupName string, name string, capacity int64) error {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	stub.scaleOps++
+	stub.resize(name, capacity)
+	return nil
+}
+
+// Caller must have lock.
+func (stub *ScaleSetsClientStub) resize(name string, capacity int64) {
+	set := stub.sets[name]
+	set.SKU.Capacity = to.Ptr(capacity)
+	stub.sets[name] = set
+	for int64(len(stub.vms[name])) < capacity {
+		id := fmt.Sprintf("%d", stub.nextID)
+		stub.nextID++
+		stub.vms[name] = append(stub.vms[name], armcompute.VirtualMachineScaleSetVM{
+			InstanceID: to.Ptr(id),
+			ID:         to.Ptr("/" + name + "/virtualMachines/" + id),
+			Name:       to.Ptr(name + "_" + id),
+			SKU:        &armcompute.SKU{Name: set.SKU.Name},
+		})
+	}
+}
+
+func (stub *ScaleSetsClientStub) deleteInstances(ctx context.Context, resourceGroupName string, name string, instanceIDs []string) error {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	var keep []armcompute.VirtualMachineScaleSetVM
+	for _, vm := range stub.vms[name] {
+		deleted := false
+		for _, id := range instanceIDs {
+			if *vm.InstanceID == id {
+				deleted = true
+				stub.deleted = append(stub.deleted, *vm.Name)
+			}
+		}
+		if !deleted {
+			keep = append(keep, vm)
+		}
+	}
+	stub.vms[name] = keep
+	set := stub.sets[name]
+	set.SKU.Capacity = to.Ptr(int64(len(keep)))
+	stub.sets[name] = set
+	return nil
+}
+
+func (stub *ScaleSetsClientStub) listVMs(ctx context.Context, resourceGroupName string, name string) ([]armcompute.VirtualMachineScaleSetVM, error) {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	return append([]armcompute.VirtualMachineScaleSetVM(nil), stub.vms[name]...), nil
+}
+
+func (stub *ScaleSetsClientStub) updateVM(ctx context.Context, resourceGroupName string, name string, instanceID string, parameters armcompute.VirtualMachineScaleSetVM) (armcompute.VirtualMachineScaleSetVM, error) {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	for i, vm := range stub.vms[name] {
+		if *vm.InstanceID == instanceID {
+			vm.Tags = parameters.Tags
+			stub.vms[name][i] = vm
+			return vm, nil
+		}
+	}
+	return armcompute.VirtualMachineScaleSetVM{}, errAzureNotFound
+}
+
+func (stub *ScaleSetsClientStub) runCommand(ctx context.Context, resourceGroupName string, name string, instanceID string, script string) (string, error) {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	stub.commands = append(stub.commands, script)
+	return stub.commandOutput, nil
+}
+
+func (stub *ScaleSetsClientStub) listNICs(ctx context.Context, resourceGroupName string, name string) ([]armnetwork.Interface, error) {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	var nics []armnetwork.Interface
+	for i, vm := range stub.vms[name] {
+		nics = append(nics, armnetwork.Interface{
+			Properties: &armnetwork.InterfacePropertiesFormat{
+				VirtualMachine: &armnetwork.SubResource{ID: vm.ID},
+				IPConfigurations: []*armnetwork.InterfaceIPConfiguration{{
+					Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{
+						PrivateIPAddress: to.Ptr(fmt.Sprintf("192.168.6.%d", i+1)),
+					},
+				}},
+			},
+		})
+	}
+	return nics, nil
+}
+
+type BlobContainerStub struct {
+	created bool
+	blobs   []container.BlobItem
+}
+
+func (stub *BlobContainerStub) listBlobs(ctx context.Context, prefix string) ([]container.BlobItem, error) {
+	var blobs []container.BlobItem
+	for _, b := range stub.blobs {
+		if strings.HasPrefix(*b.Name, prefix) {
+			blobs = append(blobs, b)
+		}
+	}
+	return blobs, nil
+}
+
+func (*BlobContainerStub) deleteBlob(ctx context.Context, name string) error {
+	return nil
+}
+
+func (*BlobContainerStub) setMetadata(ctx context.Context, name string, metadata map[string]*string) error {
+	return nil
+}
+
+func (stub *BlobContainerStub) createIfNotExists(ctx context.Context) (bool, error) {
+	if stub.created {
+		return false, nil
+	}
+	stub.created = true
+	return true, nil
+}
+
+var errAzureNotFound = newAzureResponseError(http.StatusNotFound, "NotFound", "not found")
+
+// newAzureResponseError returns the error an ARM client would return
+// for a response with the given status and service error.
+func newAzureResponseError(status int, code, message string) error {
+	body, _ := json.Marshal(map[string]interface{}{"error": map[string]string{"code": code, "message": message}})
+	return runtime.NewResponseError(&http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    httptest.NewRequest("PUT", "https://management.azure.com/x", nil),
+	})
+}
+
+type eventQueueStub struct {
+	msgs    []*azqueue.DequeuedMessage
+	deleted []string
 }
 
-type BlobContainerStub struct{}
+func (stub *eventQueueStub) getMessages(ctx context.Context) ([]*azqueue.DequeuedMessage, error) {
+	msgs := stub.msgs
+	stub.msgs = nil
+	return msgs, nil
+}
 
-func (*BlobContainerStub) GetBlobReference(name string) *storage.Blob {
+func (stub *eventQueueStub) deleteMessage(ctx context.Context, msg *azqueue.DequeuedMessage) error {
+	stub.deleted = append(stub.deleted, *msg.MessageID)
 	return nil
 }
 
-func (*BlobContainerStub) ListBlobs(params storage.ListBlobsParameters) (storage.BlobListResponse, error) {
-	return storage.BlobListResponse{}, nil
+type ResourceGroupsClientStub struct {
+	groups map[string]armresources.ResourceGroup
+}
+
+func (stub *ResourceGroupsClientStub) get(ctx context.Context, resourceGroupName string) (armresources.ResourceGroup, error) {
+	group, ok := stub.groups[resourceGroupName]
+	if !ok {
+		return armresources.ResourceGroup{}, errAzureNotFound
+	}
+	return group, nil
+}
+
+func (stub *ResourceGroupsClientStub) createOrUpdate(ctx context.Context, resourceGroupName string, parameters armresources.ResourceGroup) (armresources.ResourceGroup, error) {
+	if stub.groups == nil {
+		stub.groups = map[string]armresources.ResourceGroup{}
+	}
+	parameters.ID = to.Ptr("/subscriptions/zzzzz/resourceGroups/" + resourceGroupName)
+	stub.groups[resourceGroupName] = parameters
+	return parameters, nil
+}
+
+type SecurityGroupsClientStub struct {
+	nsgs map[string]armnetwork.SecurityGroup
+}
+
+func (stub *SecurityGroupsClientStub) get(ctx context.Context, resourceGroupName string, name string) (armnetwork.SecurityGroup, error) {
+	nsg, ok := stub.nsgs[name]
+	if !ok {
+		return armnetwork.SecurityGroup{}, errAzureNotFound
+	}
+	return nsg, nil
+}
+
+func (stub *SecurityGroupsClientStub) createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armnetwork.SecurityGroup) (armnetwork.SecurityGroup, error) {
+	if stub.nsgs == nil {
+		stub.nsgs = map[string]armnetwork.SecurityGroup{}
+	}
+	parameters.ID = to.Ptr("/subscriptions/zzzzz/resourceGroups/" + resourceGroupName + "/providers/Microsoft.Network/networkSecurityGroups/" + name)
+	stub.nsgs[name] = parameters
+	return parameters, nil
 }
 
 type testConfig struct {
@@ -127,6 +584,18 @@ type testConfig struct {
 
 var live = flag.String("live-azure-cfg", "", "Test with real azure API, provide config file")
 
+type BlobReaderStub struct {
+	blobs map[string]string
+}
+
+func (stub *BlobReaderStub) readBlob(ctx context.Context, container, name string) ([]byte, error) {
+	data, ok := stub.blobs[container+"/"+name]
+	if !ok {
+		return nil, errAzureNotFound
+	}
+	return []byte(data), nil
+}
+
 func GetInstanceSet() (*azureInstanceSet, cloud.ImageID, arvados.Cluster, error) {
 	cluster := arvados.Cluster{
 		InstanceTypes: arvados.InstanceTypeMap(map[string]arvados.InstanceType{
@@ -156,23 +625,27 @@ func GetInstanceSet() (*azureInstanceSet, cloud.ImageID, arvados.Cluster, error)
 			return nil, cloud.ImageID(""), cluster, err
 		}
 
-		ap, err := newAzureInstanceSet(exampleCfg.DriverParameters, "test123", nil, logrus.StandardLogger(), nil)
+		ap, err := newAzureInstanceSet(nil, exampleCfg.DriverParameters, "test123", nil, logrus.StandardLogger(), nil)
 		return ap.(*azureInstanceSet), cloud.ImageID(exampleCfg.ImageIDForTestSuite), cluster, err
 	}
 	ap := azureInstanceSet{
 		azconfig: azureInstanceSetConfig{
+			ResourceGroup: "rg",
 			BlobContainer: "vhds",
 		},
 		dispatcherID: "test123",
 		namePrefix:   testNamePrefix,
 		logger:       logrus.StandardLogger(),
-		deleteNIC:    make(chan string),
-		deleteBlob:   make(chan storage.Blob),
-		deleteDisk:   make(chan compute.Disk),
+		generations:  newAzureGenerations(nil),
+		eventMetrics: newEventMetrics(nil),
 	}
+	ap.setupGCQueues(nil)
 	ap.ctx, ap.stopFunc = context.WithCancel(context.Background())
 	ap.vmClient = &VirtualMachinesClientStub{}
 	ap.netClient = &InterfacesClientStub{}
+	ap.disksClient = &DisksClientStub{}
+	ap.ssClient = &ScaleSetsClientStub{}
+	ap.pipClient = &PublicIPAddressesClientStub{}
 	ap.blobcont = &BlobContainerStub{}
 	return &ap, cloud.ImageID("blob"), cluster, nil
 }
@@ -197,7 +670,7 @@ func (*AzureInstanceSetSuite) TestCreate(c *check.C) {
 	c.Check(tags["TestTagName"], check.Equals, "test tag value")
 	c.Logf("inst.String()=%v Address()=%v Tags()=%v", inst.String(), inst.Address(), tags)
 	if *live == "" {
-		c.Check(ap.vmClient.(*VirtualMachinesClientStub).vmParameters.VirtualMachineProperties.OsProfile.LinuxConfiguration.SSH, check.NotNil)
+		c.Check(ap.vmClient.(*VirtualMachinesClientStub).vmParameters.Properties.OSProfile.LinuxConfiguration.SSH, check.NotNil)
 	}
 
 	instPreemptable, err := ap.Create(cluster.InstanceTypes["tinyp"],
@@ -213,8 +686,109 @@ func (*AzureInstanceSetSuite) TestCreate(c *check.C) {
 	if *live == "" {
 		// Should not have set SSH option, because publickey
 		// arg was nil
-		c.Check(ap.vmClient.(*VirtualMachinesClientStub).vmParameters.VirtualMachineProperties.OsProfile.LinuxConfiguration.SSH, check.IsNil)
+		c.Check(ap.vmClient.(*VirtualMachinesClientStub).vmParameters.Properties.OSProfile.LinuxConfiguration.SSH, check.IsNil)
+	}
+}
+
+func (*AzureInstanceSetSuite) TestCreateIdempotent(c *check.C) {
+	if *live != "" {
+		c.Skip("test uses stubs")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	vmStub := ap.vmClient.(*VirtualMachinesClientStub)
+	nicStub := ap.netClient.(*InterfacesClientStub)
+	tags := cloud.InstanceTags{"InstanceSecret": "secret1"}
+
+	// VM creation fails: the NIC is cleaned up.
+	vmStub.createErr = errors.New("test error")
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, tags, "", nil)
+	c.Check(err, check.ErrorMatches, "test error")
+	c.Check(nicStub.created, check.HasLen, 1)
+	c.Check(nicStub.deleted, check.DeepEquals, nicStub.created)
+	c.Check(nicStub.nics, check.HasLen, 0)
+
+	// An earlier attempt created the NIC but not the VM (e.g.,
+	// the dispatcher crashed): the NIC is reused.
+	vmStub.createErr = nil
+	nicStub.created, nicStub.deleted = nil, nil
+	name := ap.creationName(cluster.InstanceTypes["tiny"], img, tags, "", nil)
+	c.Check(strings.HasPrefix(name, testNamePrefix), check.Equals, true)
+	_, err = nicStub.createOrUpdate(context.Background(), "", name+"-nic", armnetwork.Interface{
+		Properties: &armnetwork.InterfacePropertiesFormat{
+			IPConfigurations: []*armnetwork.InterfaceIPConfiguration{{Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{}}},
+		},
+	})
+	c.Assert(err, check.IsNil)
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, tags, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(string(inst.ID()), check.Equals, name)
+	c.Check(inst.Address(), check.Equals, "192.168.5.5")
+	c.Check(nicStub.created, check.HasLen, 1)
+	c.Check(nicStub.deleted, check.HasLen, 0)
+
+	// Retrying the same Create returns the same VM without
+	// creating anything new.
+	vmStub.createErr = errors.New("should not be called")
+	inst2, err := ap.Create(cluster.InstanceTypes["tiny"], img, tags, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(inst2.ID(), check.Equals, inst.ID())
+	c.Check(nicStub.created, check.HasLen, 1)
+
+	// Different arguments get a different name.
+	vmStub.createErr = nil
+	inst3, err := ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"InstanceSecret": "secret2"}, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(inst3.ID(), check.Not(check.Equals), inst.ID())
+	c.Check(nicStub.created, check.HasLen, 2)
+}
+
+func (*AzureInstanceSetSuite) TestImageResourceID(c *check.C) {
+	if *live != "" {
+		c.Skip("test uses stubs")
+	}
+	ap, _, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	ap.azconfig.SubscriptionID = "sub1"
+	ap.imageResourceGroup = "imagerg"
+	prefix := "/subscriptions/sub1/resourceGroups/imagerg/providers/Microsoft.Compute"
+
+	for _, trial := range []struct {
+		imageID string
+		gallery string
+		version string
+		expect  string
+	}{
+		{"img1", "", "", prefix + "/images/img1"},
+		{"img1", "gallery1", "1.2.3", prefix + "/galleries/gallery1/images/img1/versions/1.2.3"},
+		{"gallery2/img2/2.0.0", "", "", prefix + "/galleries/gallery2/images/img2/versions/2.0.0"},
+		{"gallery2/img2/2.0.0", "gallery1", "1.2.3", prefix + "/galleries/gallery2/images/img2/versions/2.0.0"},
+		{"gallery2/img2", "", "", prefix + "/galleries/gallery2/images/img2"},
+		{"/subscriptions/sub2/resourceGroups/rg2/providers/Microsoft.Compute/galleries/g/images/i/versions/1", "gallery1", "1.2.3", "/subscriptions/sub2/resourceGroups/rg2/providers/Microsoft.Compute/galleries/g/images/i/versions/1"},
+		{"img1", "gallery1", "", ""},
+		{"gallery2//2.0.0", "", "", ""},
+		{"a/b/c/d", "", "", ""},
+	} {
+		c.Logf("trial %+v", trial)
+		ap.azconfig.SharedImageGalleryName = trial.gallery
+		ap.azconfig.SharedImageGalleryImageVersion = trial.version
+		id, err := ap.imageResourceID(cloud.ImageID(trial.imageID))
+		if trial.expect == "" {
+			c.Check(err, check.NotNil)
+			continue
+		}
+		c.Check(err, check.IsNil)
+		c.Check(id, check.Equals, trial.expect)
 	}
+
+	// The image reference is passed through to the VM.
+	ap.azconfig.SharedImageGalleryName = ""
+	ap.azconfig.SharedImageGalleryImageVersion = ""
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], "gallery2/img2/2.0.0", nil, "", nil)
+	c.Assert(err, check.IsNil)
+	ref := ap.vmClient.(*VirtualMachinesClientStub).vmParameters.Properties.StorageProfile.ImageReference
+	c.Assert(ref, check.NotNil)
+	c.Check(*ref.ID, check.Equals, prefix+"/galleries/gallery2/images/img2/versions/2.0.0")
 }
 
 func (*AzureInstanceSetSuite) TestListInstances(c *check.C) {
@@ -233,6 +807,43 @@ func (*AzureInstanceSetSuite) TestListInstances(c *check.C) {
 	}
 }
 
+func (*AzureInstanceSetSuite) TestListInstancesByTags(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	for _, tags := range []cloud.InstanceTags{
+		{"InstanceSetID": "test123", "InstanceSecret": "secret1"},
+		{"InstanceSetID": "test123", "InstanceSecret": "secret2"},
+		{"InstanceSetID": "other", "InstanceSecret": "secret3"},
+	} {
+		_, err := ap.Create(cluster.InstanceTypes["tiny"], img, tags, "echo ok", nil)
+		c.Assert(err, check.IsNil)
+	}
+
+	for _, trial := range []struct {
+		tags    cloud.InstanceTags
+		secrets []string
+	}{
+		{nil, []string{"secret1", "secret2", "secret3"}},
+		{cloud.InstanceTags{"InstanceSetID": "test123"}, []string{"secret1", "secret2"}},
+		{cloud.InstanceTags{"InstanceSetID": "test123", "InstanceSecret": "secret2"}, []string{"secret2"}},
+		{cloud.InstanceTags{"InstanceSetID": "other"}, []string{"secret3"}},
+		{cloud.InstanceTags{"InstanceSetID": ""}, nil},
+		{cloud.InstanceTags{"NoSuchTag": "x"}, nil},
+	} {
+		insts, err := ap.Instances(trial.tags)
+		c.Assert(err, check.IsNil)
+		var secrets []string
+		for _, inst := range insts {
+			secrets = append(secrets, inst.Tags()["InstanceSecret"])
+		}
+		sort.Strings(secrets)
+		c.Check(secrets, check.DeepEquals, trial.secrets, check.Commentf("%v", trial.tags))
+	}
+}
+
 func (*AzureInstanceSetSuite) TestManageNics(c *check.C) {
 	ap, _, _, err := GetInstanceSet()
 	if err != nil {
@@ -253,6 +864,74 @@ func (*AzureInstanceSetSuite) TestManageBlobs(c *check.C) {
 	ap.Stop()
 }
 
+func (*AzureInstanceSetSuite) TestGarbageCollect(c *check.C) {
+	ap, _, _, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	defer ap.Stop()
+	ap.azconfig.DeleteDanglingResourcesAfter = arvados.Duration(time.Hour)
+	ap.imageResourceGroup = "rg"
+
+	old := time.Now().Add(-2 * time.Hour)
+	disksStub := ap.disksClient.(*DisksClientStub)
+	for _, name := range []string{"old-os", "recent-os", "attached-os"} {
+		d := armcompute.Disk{
+			Name: to.Ptr(testNamePrefix + name),
+			Properties: &armcompute.DiskProperties{
+				DiskState:   to.Ptr(armcompute.DiskStateUnattached),
+				TimeCreated: &old,
+			},
+		}
+		if name == "recent-os" {
+			d.Properties.TimeCreated = to.Ptr(time.Now())
+		} else if name == "attached-os" {
+			d.Properties.DiskState = to.Ptr(armcompute.DiskStateAttached)
+		}
+		disksStub.disks = append(disksStub.disks, d)
+	}
+	blobStub := ap.blobcont.(*BlobContainerStub)
+	for _, name := range []string{"old", "leased"} {
+		b := container.BlobItem{
+			Name: to.Ptr(testNamePrefix + name),
+			Properties: &container.BlobProperties{
+				BlobType:     to.Ptr(container.BlobTypePageBlob),
+				LeaseState:   to.Ptr(lease.StateTypeAvailable),
+				LeaseStatus:  to.Ptr(lease.StatusTypeUnlocked),
+				LastModified: &old,
+			},
+		}
+		if name == "leased" {
+			b.Properties.LeaseState = to.Ptr(lease.StateTypeLeased)
+		}
+		blobStub.blobs = append(blobStub.blobs, b)
+	}
+
+	c.Check(ap.GarbageCollect(), check.IsNil)
+	c.Check(ap.diskGC.pending, check.HasLen, 1)
+	c.Check(ap.diskGC.pending[testNamePrefix+"old-os"], check.NotNil)
+	c.Check(ap.blobGC.pending, check.HasLen, 1)
+	c.Check(ap.blobGC.pending[testNamePrefix+"old"], check.NotNil)
+
+	disksStub.listErr = errors.New("test error")
+	c.Check(ap.GarbageCollect(), check.ErrorMatches, `error listing disks: test error`)
+
+	// The periodic check runs every GCInterval.
+	b := blobStub.blobs[0]
+	b.Name = to.Ptr(testNamePrefix + "old2")
+	blobStub.blobs = append(blobStub.blobs, b)
+	ap.azconfig.GCInterval = arvados.Duration(time.Millisecond)
+	ap.stopWg.Add(1)
+	go ap.runGC()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		ap.blobGC.mtx.Lock()
+		n := len(ap.blobGC.pending)
+		ap.blobGC.mtx.Unlock()
+		if n > 1 || time.Now().After(deadline) {
+			c.Check(n, check.Equals, 2)
+			break
+		}
+	}
+}
+
 func (*AzureInstanceSetSuite) TestDestroyInstances(c *check.C) {
 	ap, _, _, err := GetInstanceSet()
 	if err != nil {
@@ -267,53 +946,71 @@ func (*AzureInstanceSetSuite) TestDestroyInstances(c *check.C) {
 	}
 }
 
-func (*AzureInstanceSetSuite) TestDeleteFake(c *check.C) {
+func (*AzureInstanceSetSuite) TestDeleteSafety(c *check.C) {
 	ap, _, _, err := GetInstanceSet()
 	if err != nil {
 		c.Fatal("Error making provider", err)
 	}
+	if *live != "" {
+		c.Skip("uses stub clients")
+	}
+	stub := ap.vmClient.(*VirtualMachinesClientStub)
+	createdAt := map[string]*string{"created-at": to.Ptr(time.Now().Format(time.RFC3339Nano))}
+	vm := func(name string, tags map[string]*string) *azureInstance {
+		return &azureInstance{provider: ap, vm: armcompute.VirtualMachine{Name: to.Ptr(name), Tags: tags}}
+	}
 
-	_, err = ap.netClient.delete(context.Background(), "fakefakefake", "fakefakefake")
+	c.Check(vm("important-server", createdAt).Destroy(), check.ErrorMatches, `refusing to delete important-server: name does not start with "compute-test123-"`)
+	c.Check(vm(testNamePrefix+"untagged", nil).Destroy(), check.ErrorMatches, `refusing to delete compute-test123-untagged: no created-at tag`)
+	c.Check(ap.destroyNic(context.Background(), armnetwork.Interface{Name: to.Ptr("important-server-nic"), Tags: createdAt}), check.ErrorMatches, `refusing to delete important-server-nic: .*`)
+	c.Check(ap.destroyDisk(armcompute.Disk{Name: to.Ptr("important-server-os")}), check.ErrorMatches, `refusing to delete important-server-os: .*`)
+	c.Check(stub.deleted, check.HasLen, 0)
 
-	de, ok := err.(autorest.DetailedError)
-	if ok {
-		rq := de.Original.(*azure.RequestError)
+	c.Check(vm(testNamePrefix+"ok", createdAt).Destroy(), check.IsNil)
+	c.Check(stub.deleted, check.DeepEquals, []string{testNamePrefix + "ok"})
+
+	ap.azconfig.DryRunDeletes = true
+	c.Check(vm(testNamePrefix+"dryrun", createdAt).Destroy(), check.IsNil)
+	c.Check(ap.destroyNic(context.Background(), armnetwork.Interface{Name: to.Ptr(testNamePrefix + "dryrun-nic"), Tags: createdAt}), check.IsNil)
+	c.Check(stub.deleted, check.DeepEquals, []string{testNamePrefix + "ok"})
+}
+
+func (*AzureInstanceSetSuite) TestDeleteFake(c *check.C) {
+	ap, _, _, err := GetInstanceSet()
+	if err != nil {
+		c.Fatal("Error making provider", err)
+	}
+
+	err = ap.netClient.delete(context.Background(), "fakefakefake", "fakefakefake")
 
-		log.Printf("%v %q %q", rq.Response.StatusCode, rq.ServiceError.Code, rq.ServiceError.Message)
+	var rerr *azcore.ResponseError
+	if errors.As(err, &rerr) {
+		log.Printf("%v %q %q", rerr.StatusCode, rerr.ErrorCode, azureErrorMessage(rerr))
 	}
 }
 
 func (*AzureInstanceSetSuite) TestWrapError(c *check.C) {
-	retryError := autorest.DetailedError{
-		Original: &azure.RequestError{
-			DetailedError: autorest.DetailedError{
-				Response: &http.Response{
-					StatusCode: 429,
-					Header:     map[string][]string{"Retry-After": {"123"}},
-				},
-			},
-			ServiceError: &azure.ServiceError{},
-		},
-	}
+	retryError := runtime.NewResponseError(&http.Response{
+		StatusCode: 429,
+		Header:     http.Header{"Retry-After": {"123"}},
+		Body:       http.NoBody,
+		Request:    httptest.NewRequest("PUT", "https://management.azure.com/x", nil),
+	})
 	wrapped := wrapAzureError(retryError)
-	_, ok := wrapped.(cloud.RateLimitError)
+	rlerr, ok := wrapped.(cloud.RateLimitError)
 	c.Check(ok, check.Equals, true)
-
-	quotaError := autorest.DetailedError{
-		Original: &azure.RequestError{
-			DetailedError: autorest.DetailedError{
-				Response: &http.Response{
-					StatusCode: 503,
-				},
-			},
-			ServiceError: &azure.ServiceError{
-				Message: "No more quota",
-			},
-		},
+	if ok {
+		c.Check(rlerr.EarliestRetry().After(time.Now().Add(100*time.Second)), check.Equals, true)
 	}
+
+	quotaError := newAzureResponseError(503, "OperationNotAllowed", "No more quota")
 	wrapped = wrapAzureError(quotaError)
 	_, ok = wrapped.(cloud.QuotaError)
 	c.Check(ok, check.Equals, true)
+
+	otherError := newAzureResponseError(400, "InvalidParameter", "Bad request")
+	c.Check(wrapAzureError(otherError), check.Equals, otherError)
+	c.Check(azureErrorCode(otherError), check.Equals, "InvalidParameter")
 }
 
 func (*AzureInstanceSetSuite) TestSetTags(c *check.C) {
@@ -422,3 +1119,1926 @@ func filterInstances(c *check.C, instances []cloud.Instance) []cloud.Instance {
 	}
 	return r
 }
+
+func (*AzureInstanceSetSuite) TestAPIBudget(c *check.C) {
+	reg := prometheus.NewRegistry()
+	budgets := newAPIBudgets(3600*100, 2, reg)
+	c.Check(budgets.forMethod("GET"), check.Equals, budgets.read)
+	c.Check(budgets.forMethod("PUT"), check.Equals, budgets.write)
+	c.Check(budgets.forMethod("DELETE"), check.Equals, budgets.write)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c.Check(budgets.write.wait(ctx), check.IsNil)
+	c.Check(budgets.write.wait(ctx), check.IsNil)
+	// Write budget is exhausted, and won't be replenished
+	// before ctx expires.
+	c.Check(budgets.write.wait(ctx), check.Equals, context.DeadlineExceeded)
+
+	// Server reports fewer remaining reads than we expected.
+	budgets.read.update(&http.Response{Header: http.Header{"X-Ms-Ratelimit-Remaining-Subscription-Reads": {"0"}}})
+	// 100 reads per second => next read allowed in ~10ms.
+	t0 := time.Now()
+	c.Check(budgets.read.wait(context.Background()), check.IsNil)
+	c.Check(time.Since(t0) > 5*time.Millisecond, check.Equals, true)
+
+	// Negative limit means unlimited.
+	unlimited := newAPIBudgets(-1, -1, nil)
+	for i := 0; i < 10; i++ {
+		c.Check(unlimited.write.wait(ctx), check.IsNil)
+	}
+}
+
+// testPipeline returns an apiPipeline that sends requests to the
+// given stub transport, with no API budget limits.
+func testPipeline(rp *apiRetryPolicy, t apiTimeouts, m *apiMetrics, transport func(*http.Request) (*http.Response, error)) *apiPipeline {
+	if m == nil {
+		m = newAPIMetrics(nil)
+	}
+	return &apiPipeline{
+		credential: stubCredential{},
+		cloud:      cloudConfiguration(azurePublicCloud),
+		httpClient: &http.Client{Transport: roundTripperFunc(transport)},
+		budgets:    newAPIBudgets(-1, -1, nil),
+		retries:    rp,
+		timeouts:   t,
+		metrics:    m,
+	}
+}
+
+// send sends a request through the policies that an ARM client with
+// the given name would use.
+func (p *apiPipeline) send(ctx context.Context, name, method, body string) (*http.Response, error) {
+	opts := p.clientOptions(name)
+	pl := runtime.NewPipeline("azure", "v0.0.0", runtime.PipelineOptions{}, &opts.ClientOptions)
+	req, err := runtime.NewRequest(ctx, method, "https://management.azure.com/x")
+	if err != nil {
+		return nil, err
+	}
+	if body != "" {
+		err = req.SetBody(streaming.NopCloser(strings.NewReader(body)), "application/json")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pl.Do(req)
+}
+
+type stubCredential struct{}
+
+func (stubCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "stub", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func (*AzureInstanceSetSuite) TestAPIRetry(c *check.C) {
+	rp := newAPIRetryPolicy(3, time.Millisecond, 100*time.Millisecond, prometheus.NewRegistry())
+	var statuses []int
+	var headers []http.Header
+	var bodies []string
+	stub := func(req *http.Request) (*http.Response, error) {
+		if req.Body != nil {
+			buf, _ := ioutil.ReadAll(req.Body)
+			bodies = append(bodies, string(buf))
+		}
+		status := statuses[0]
+		statuses = statuses[1:]
+		if status == 0 {
+			return nil, errors.New("connection reset")
+		}
+		hdr := http.Header{}
+		if len(headers) > 0 {
+			hdr, headers = headers[0], headers[1:]
+		}
+		return &http.Response{StatusCode: status, Header: hdr, Body: ioutil.NopCloser(strings.NewReader("{}")), Request: req}, nil
+	}
+	p := testPipeline(rp, newAPITimeouts(0, 0), nil, stub)
+	do := func(method string) (*http.Response, error) {
+		return p.send(context.Background(), "test", method, "body")
+	}
+
+	// Transient errors are retried, and the request body is
+	// resent each time.
+	statuses = []int{503, 0, 200}
+	resp, err := do("PUT")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, 200)
+	c.Check(bodies, check.DeepEquals, []string{"body", "body", "body"})
+	c.Check(testutil.ToFloat64(rp.mRetries.WithLabelValues("503")), check.Equals, float64(1))
+	c.Check(testutil.ToFloat64(rp.mRetries.WithLabelValues("0")), check.Equals, float64(1))
+
+	// Give up after 3 attempts.
+	statuses = []int{500, 500, 500, 200}
+	resp, err = do("GET")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, 500)
+	c.Check(statuses, check.HasLen, 1)
+	c.Check(testutil.ToFloat64(rp.mRetries.WithLabelValues("500")), check.Equals, float64(2))
+
+	// Client errors and POST requests are not retried.
+	statuses = []int{404, 200}
+	resp, err = do("DELETE")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, 404)
+	statuses = []int{503, 200}
+	resp, err = do("POST")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, 503)
+	c.Check(statuses, check.HasLen, 1)
+
+	// Retry-After is honored, unless it exceeds the max delay.
+	p = testPipeline(newAPIRetryPolicy(3, time.Millisecond, 2*time.Second, nil), newAPITimeouts(0, 0), nil, stub)
+	statuses = []int{429, 200}
+	headers = []http.Header{{"Retry-After": {"1"}}}
+	t0 := time.Now()
+	resp, err = do("GET")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, 200)
+	c.Check(time.Since(t0) >= time.Second, check.Equals, true)
+	statuses = []int{429, 200}
+	headers = []http.Header{{"Retry-After": {"60"}}}
+	t0 = time.Now()
+	resp, err = do("GET")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, 429)
+	c.Check(time.Since(t0) < time.Second, check.Equals, true)
+
+	// Negative attempts means no retries.
+	p = testPipeline(newAPIRetryPolicy(-1, 0, 0, nil), newAPITimeouts(0, 0), nil, stub)
+	statuses = []int{503, 200}
+	resp, err = do("GET")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, 503)
+}
+
+func (*AzureInstanceSetSuite) TestAPITimeouts(c *check.C) {
+	t := newAPITimeouts(0, 0)
+	c.Check(t, check.Equals, apiTimeouts{request: time.Minute, operation: 20 * time.Minute})
+	t = newAPITimeouts(50*time.Millisecond, time.Hour)
+
+	var reqctx context.Context
+	hang := true
+	p := testPipeline(newAPIRetryPolicy(-1, 0, 0, nil), t, nil, func(req *http.Request) (*http.Response, error) {
+		reqctx = req.Context()
+		if hang {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		return &http.Response{StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("{}")), Request: req}, nil
+	})
+
+	// A hung request fails after the request timeout.
+	t0 := time.Now()
+	_, err := p.send(context.Background(), "test", "GET", "")
+	c.Check(err, check.ErrorMatches, `GET /x: no response after 50ms: .*context deadline exceeded`)
+	c.Check(time.Since(t0) < time.Second, check.Equals, true)
+
+	// A sooner caller-supplied deadline takes effect first, and
+	// the error is returned as is.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = p.send(ctx, "test", "GET", "")
+	c.Check(err, check.Equals, context.DeadlineExceeded)
+
+	// The response body can still be read after the policy
+	// returns, and the request context is released.
+	hang = false
+	resp, err := p.send(context.Background(), "test", "GET", "")
+	c.Assert(err, check.IsNil)
+	c.Check(reqctx.Err(), check.Equals, context.Canceled)
+	buf, err := ioutil.ReadAll(resp.Body)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "{}")
+	resp.Body.Close()
+
+	// A VM that never finishes provisioning causes
+	// createOrUpdate to return an error instead of blocking
+	// forever.
+	defer func(orig time.Duration) { pollFrequency = orig }(pollFrequency)
+	pollFrequency = time.Millisecond
+	p = testPipeline(newAPIRetryPolicy(-1, 0, 0, nil), newAPITimeouts(time.Second, 50*time.Millisecond), nil, func(req *http.Request) (*http.Response, error) {
+		hdr := http.Header{"Content-Type": {"application/json"}}
+		status := http.StatusOK
+		if req.Method == "PUT" {
+			status = http.StatusCreated
+			hdr.Set("Azure-AsyncOperation", "https://management.azure.com/operations/1")
+		}
+		return &http.Response{StatusCode: status, Header: hdr, Body: ioutil.NopCloser(strings.NewReader(`{"status":"InProgress"}`)), Request: req}, nil
+	})
+	client, err := armcompute.NewVirtualMachinesClient("subscription", p.credential, p.clientOptions("virtualMachines"))
+	c.Assert(err, check.IsNil)
+	vmClient := &virtualMachinesClientImpl{client, p.timeouts.operation}
+	vm := armcompute.VirtualMachine{Location: to.Ptr("eastus")}
+	t0 = time.Now()
+	_, err = vmClient.createOrUpdate(context.Background(), "rg", "vm", vm)
+	c.Check(err, check.ErrorMatches, `operation did not complete within APIOperationTimeout \(50ms\): .*`)
+	c.Check(time.Since(t0) < time.Second, check.Equals, true)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = vmClient.createOrUpdate(ctx, "rg", "vm", vm)
+	c.Check(err, check.ErrorMatches, `operation did not complete before deadline: .*`)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = vmClient.createOrUpdate(ctx, "rg", "vm", vm)
+	c.Check(errors.Is(err, context.Canceled), check.Equals, true)
+}
+
+func (*AzureInstanceSetSuite) TestAPIMetrics(c *check.C) {
+	m := newAPIMetrics(prometheus.NewRegistry())
+	statuses := []int{500, 200}
+	stub := func(req *http.Request) (*http.Response, error) {
+		status := statuses[0]
+		statuses = statuses[1:]
+		return &http.Response{StatusCode: status, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("{}")), Request: req}, nil
+	}
+
+	// Each attempt is counted separately.
+	p := testPipeline(newAPIRetryPolicy(3, time.Millisecond, time.Second, nil), newAPITimeouts(0, 0), m, stub)
+	resp, err := p.send(context.Background(), "virtualMachines", "GET", "")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, 200)
+	c.Check(testutil.ToFloat64(m.mCalls.WithLabelValues("virtualMachines.GET", "500", "false")), check.Equals, float64(1))
+	c.Check(testutil.ToFloat64(m.mCalls.WithLabelValues("virtualMachines.GET", "200", "false")), check.Equals, float64(1))
+
+	statuses = []int{429}
+	p = testPipeline(newAPIRetryPolicy(-1, 0, 0, nil), newAPITimeouts(0, 0), m, stub)
+	resp, err = p.send(context.Background(), "disks", "PUT", "{}")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, 429)
+	c.Check(testutil.ToFloat64(m.mCalls.WithLabelValues("disks.PUT", "429", "true")), check.Equals, float64(1))
+
+	// Blob storage requests are instrumented via http.Client.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Ms-Error-Code", "ServerBusy")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	resp, err = m.httpClient("blobStorage", nil).Get(srv.URL)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Check(testutil.ToFloat64(m.mCalls.WithLabelValues("blobStorage.GET", "503", "true")), check.Equals, float64(1))
+	srv.Close()
+	_, err = m.httpClient("blobStorage", nil).Get(srv.URL)
+	c.Check(err, check.NotNil)
+	c.Check(testutil.ToFloat64(m.mCalls.WithLabelValues("blobStorage.GET", "0", "false")), check.Equals, float64(1))
+
+	c.Check(testutil.CollectAndCount(m.mDuration), check.Equals, 5)
+}
+
+func (*AzureInstanceSetSuite) TestGenerations(c *check.C) {
+	if *live != "" {
+		c.Skip("test uses stub VM list")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	var _ cloud.InstanceSetWithGenerations = ap
+	reg := prometheus.NewRegistry()
+	ap.generations = newAzureGenerations(reg)
+
+	inst1, err := ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"InstanceSecret": "1"}, "", nil)
+	c.Assert(err, check.IsNil)
+	counts, err := ap.SetGeneration("g1")
+	c.Check(err, check.IsNil)
+	c.Check(counts, check.DeepEquals, map[string]int{"": 1})
+	inst2, err := ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"InstanceSecret": "2"}, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(inst2.(cloud.InstanceWithGeneration).Generation(), check.Equals, "g1")
+
+	outdated := func() map[string]bool {
+		insts, err := ap.Instances(nil)
+		c.Assert(err, check.IsNil)
+		ret := map[string]bool{}
+		for _, inst := range insts {
+			ret[inst.String()] = inst.(cloud.InstanceWithGeneration).Outdated()
+		}
+		return ret
+	}
+	c.Check(outdated(), check.DeepEquals, map[string]bool{inst1.String(): true, inst2.String(): false})
+	c.Check(testutil.ToFloat64(ap.generations.mCount.WithLabelValues("", "true")), check.Equals, float64(1))
+	c.Check(testutil.ToFloat64(ap.generations.mCount.WithLabelValues("g1", "false")), check.Equals, float64(1))
+
+	// Roll back to the unlabeled generation.
+	counts, err = ap.SetGeneration("")
+	c.Check(err, check.IsNil)
+	c.Check(counts, check.DeepEquals, map[string]int{"": 1, "g1": 1})
+	c.Check(outdated(), check.DeepEquals, map[string]bool{inst1.String(): false, inst2.String(): true})
+	c.Check(testutil.CollectAndCount(ap.generations.mCount), check.Equals, 2)
+	c.Check(testutil.ToFloat64(ap.generations.mCount.WithLabelValues("g1", "true")), check.Equals, float64(1))
+}
+
+func (*AzureInstanceSetSuite) TestGCQueue(c *check.C) {
+	var mtx sync.Mutex
+	attempts := map[string]int{}
+	q := newAzureGCQueue("NIC", func(item interface{}) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		name := item.(string)
+		attempts[name]++
+		if name == "bad" || attempts[name] < 3 {
+			return errors.New("conflict")
+		}
+		return nil
+	}, logrus.StandardLogger(), newGCMetrics(nil))
+	q.baseDelay, q.maxDelay = time.Millisecond, 4*time.Millisecond
+	defer q.close()
+
+	// Items already pending are not added again.
+	q.enqueue("good", "good")
+	q.enqueue("good", "good")
+	q.enqueue("bad", "bad")
+	c.Check(testutil.ToFloat64(q.mPending), check.Equals, float64(2))
+
+	q.start(2)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		q.mtx.Lock()
+		n := len(q.pending)
+		q.mtx.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mtx.Lock()
+	c.Check(attempts, check.DeepEquals, map[string]int{"good": 3, "bad": gcMaxAttempts})
+	mtx.Unlock()
+	c.Check(testutil.ToFloat64(q.mPending), check.Equals, float64(0))
+	c.Check(testutil.ToFloat64(q.mFailed), check.Equals, float64(2+gcMaxAttempts))
+	c.Check(testutil.ToFloat64(q.mDropped), check.Equals, float64(1))
+
+	// When the queue is full, new items are dropped instead of
+	// blocking the caller.
+	full := newAzureGCQueue("blob", func(interface{}) error { return nil }, logrus.StandardLogger(), newGCMetrics(nil))
+	for i := 0; i <= gcQueueMax; i++ {
+		full.enqueue(fmt.Sprintf("blob%d", i), nil)
+	}
+	c.Check(full.pending, check.HasLen, gcQueueMax)
+	c.Check(testutil.ToFloat64(full.mDropped), check.Equals, float64(1))
+}
+
+func (*AzureInstanceSetSuite) TestSharedMount(c *check.C) {
+	for _, trial := range []struct {
+		sm  azureSharedMount
+		err string
+	}{
+		{azureSharedMount{}, ""},
+		{azureSharedMount{Source: "example.file.core.windows.net:/example/refdata", MountPoint: "/mnt/refdata"}, ""},
+		{azureSharedMount{MountPoint: "/mnt/refdata"}, `.*Source is empty`},
+		{azureSharedMount{Source: "example.file.core.windows.net", MountPoint: "/mnt/refdata"}, `.*not an NFS export.*`},
+		{azureSharedMount{Source: "example.file.core.windows.net:/example/refdata", MountPoint: "mnt"}, `.*must be an absolute path.*`},
+		{azureSharedMount{Source: "example.file.core.windows.net:/example/refdata", MountPoint: "/"}, `.*must be an absolute path.*`},
+	} {
+		err := trial.sm.check()
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err)
+		}
+	}
+
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	ap.azconfig.SharedMount = azureSharedMount{
+		Source:     "example.file.core.windows.net:/example/refdata",
+		MountPoint: "/mnt/ref'data",
+	}
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, nil, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(inst.Tags()["shared-mount-source"], check.Equals, "example.file.core.windows.net:/example/refdata")
+	c.Check(inst.Tags()["shared-mount-point"], check.Equals, "/mnt/ref'data")
+
+	customData := ap.vmClient.(*VirtualMachinesClientStub).vmParameters.Properties.OSProfile.CustomData
+	script, err := base64.StdEncoding.DecodeString(*customData)
+	c.Assert(err, check.IsNil)
+	c.Check(string(script), check.Equals, `#!/bin/sh
+mkdir -p '/mnt/ref'\''data' && mount -t nfs -o 'vers=4,minorversion=1,sec=sys' 'example.file.core.windows.net:/example/refdata' '/mnt/ref'\''data' || echo >&2 'warning: could not mount shared filesystem'
+echo ok
+`)
+}
+
+func (*AzureInstanceSetSuite) TestAvailabilitySet(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	stub := &AvailabilitySetsClientStub{}
+	ap.availSetClient = stub
+	ap.azconfig.ResourceGroup = "rg"
+
+	ap.azconfig.AvailabilitySet = azureAvailabilitySet{Name: "missing-avset"}
+	_, err = ap.setupAvailabilitySet()
+	c.Check(err, check.ErrorMatches, `error setting up availability set "missing-avset": not found`)
+
+	ap.azconfig.AvailabilitySet = azureAvailabilitySet{Name: "existing-avset"}
+	ap.availSetID, err = ap.setupAvailabilitySet()
+	c.Check(err, check.IsNil)
+	c.Check(ap.availSetID, check.Equals, "/subscriptions/zzzzz/resourceGroups/rg/providers/Microsoft.Compute/availabilitySets/existing-avset")
+	c.Check(stub.created, check.HasLen, 0)
+
+	ap.azconfig.AvailabilitySet = azureAvailabilitySet{Name: "auto", FaultDomains: 3}
+	ap.availSetID, err = ap.setupAvailabilitySet()
+	c.Check(err, check.IsNil)
+	c.Check(ap.availSetID, check.Matches, `.*/availabilitySets/`+testNamePrefix+`avset`)
+	created := stub.created[testNamePrefix+"avset"]
+	c.Check(*created.Properties.PlatformFaultDomainCount, check.Equals, int32(3))
+	c.Check(*created.Properties.PlatformUpdateDomainCount, check.Equals, int32(defaultUpdateDomains))
+	c.Check(*created.SKU.Name, check.Equals, "Aligned")
+
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"TestTagName": "test tag value"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	vmParameters := ap.vmClient.(*VirtualMachinesClientStub).vmParameters
+	c.Check(*vmParameters.Properties.AvailabilitySet.ID, check.Equals, ap.availSetID)
+	c.Check(inst.Tags()["TestTagName"], check.Equals, "test tag value")
+	c.Check(inst.Tags()["fault-domain"], check.Equals, "1")
+	c.Check(inst.Tags()["update-domain"], check.Equals, "3")
+}
+
+func (*AzureInstanceSetSuite) TestAcceleratedNetworking(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	ap.azconfig.AcceleratedNetworking = []string{"tiny"}
+	nicStub := ap.netClient.(*InterfacesClientStub)
+
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, nil, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	nic := nicStub.nics[string(inst.ID())+"-nic"]
+	c.Assert(nic.Properties.EnableAcceleratedNetworking, check.NotNil)
+	c.Check(*nic.Properties.EnableAcceleratedNetworking, check.Equals, true)
+
+	other := cluster.InstanceTypes["tiny"]
+	other.Name = "other"
+	inst, err = ap.Create(other, img, nil, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	nic = nicStub.nics[string(inst.ID())+"-nic"]
+	c.Check(nic.Properties.EnableAcceleratedNetworking, check.IsNil)
+}
+
+func (*AzureInstanceSetSuite) TestCreatePublicIP(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	ap.azconfig.CreatePublicIP = true
+	vmStub := ap.vmClient.(*VirtualMachinesClientStub)
+	nicStub := ap.netClient.(*InterfacesClientStub)
+	pipStub := ap.pipClient.(*PublicIPAddressesClientStub)
+
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, nil, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	pip, ok := pipStub.pips[string(inst.ID())+"-ip"]
+	c.Assert(ok, check.Equals, true)
+	c.Check(*pip.SKU.Name, check.Equals, armnetwork.PublicIPAddressSKUNameStandard)
+	c.Check(*pip.Properties.PublicIPAllocationMethod, check.Equals, armnetwork.IPAllocationMethodStatic)
+	c.Check(pip.Tags["created-at"], check.NotNil)
+	nic := nicStub.nics[string(inst.ID())+"-nic"]
+	c.Check(*nic.Properties.IPConfigurations[0].Properties.PublicIPAddress.ID, check.Equals, *pip.ID)
+	c.Check(inst.Address(), check.Equals, "203.0.113.1")
+
+	// Without a known public address, Address() falls back to
+	// the private address.
+	ap.publicIPs = nil
+	c.Check(inst.Address(), check.Equals, "192.168.5.5")
+	ap.azconfig.CreatePublicIP = false
+	ap.publicIPs = map[string]string{strings.ToLower(*pip.ID): "203.0.113.1"}
+	c.Check(inst.Address(), check.Equals, "192.168.5.5")
+	ap.azconfig.CreatePublicIP = true
+
+	// VM creation fails: the NIC and public IP are cleaned up.
+	vmStub.createErr = errors.New("test error")
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"InstanceSecret": "fail"}, "echo ok", nil)
+	c.Check(err, check.ErrorMatches, "test error")
+	c.Check(pipStub.deleted, check.HasLen, 1)
+	c.Check(pipStub.pips, check.HasLen, 1)
+	vmStub.createErr = nil
+
+	// Public IPs attached to NICs are cached, dangling ones are
+	// garbage collected once they're old enough.
+	ap.azconfig.DeleteDanglingResourcesAfter = arvados.Duration(time.Hour)
+	attached := pipStub.pips[string(inst.ID())+"-ip"]
+	attached.ID = to.Ptr(strings.ToUpper(*attached.ID))
+	attached.Properties.IPConfiguration = &armnetwork.IPConfiguration{ID: nic.ID}
+	pipStub.pips[*attached.Name] = attached
+	old := to.Ptr(time.Now().Add(-2 * time.Hour).Format(time.RFC3339Nano))
+	recent := to.Ptr(time.Now().Format(time.RFC3339Nano))
+	for name, createdAt := range map[string]*string{"old": old, "recent": recent} {
+		pipStub.pips[testNamePrefix+name+"-ip"] = armnetwork.PublicIPAddress{
+			ID:   to.Ptr("/subscriptions/zzzzz/" + name),
+			Name: to.Ptr(testNamePrefix + name + "-ip"),
+			Tags: map[string]*string{"created-at": createdAt},
+			Properties: &armnetwork.PublicIPAddressPropertiesFormat{
+				IPAddress: to.Ptr("198.51.100.1"),
+			},
+		}
+	}
+	pipStub.pips["other-ip"] = armnetwork.PublicIPAddress{
+		ID:   to.Ptr("/subscriptions/zzzzz/other"),
+		Name: to.Ptr("other-ip"),
+		Tags: map[string]*string{"created-at": old},
+	}
+	c.Assert(ap.managePublicIPs(), check.IsNil)
+	c.Assert(ap.publicIPGC.pending, check.HasLen, 1)
+	c.Check(ap.publicIPGC.pending[testNamePrefix+"old-ip"], check.NotNil)
+	c.Check(ap.publicIPs, check.HasLen, 2) // attached and recent
+	c.Check(inst.Address(), check.Equals, "203.0.113.1")
+
+	ap.azconfig.ScaleSets = true
+	c.Check(ap.checkScaleSetsConfig(), check.ErrorMatches, `.*cannot use both ScaleSets and CreatePublicIP`)
+}
+
+type UsageClientStub struct {
+	usages []armcompute.Usage
+	calls  int
+}
+
+func (stub *UsageClientStub) listComplete(ctx context.Context, location string) ([]armcompute.Usage, error) {
+	stub.calls++
+	return stub.usages, nil
+}
+
+type ResourceSKUsClientStub struct {
+	skus  []armcompute.ResourceSKU
+	calls int
+}
+
+func (stub *ResourceSKUsClientStub) listComplete(ctx context.Context, filter string) ([]armcompute.ResourceSKU, error) {
+	stub.calls++
+	return stub.skus, nil
+}
+
+func (*AzureInstanceSetSuite) TestBootDiagnostics(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	vmStub := ap.vmClient.(*VirtualMachinesClientStub)
+
+	// Disabled by default.
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, nil, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(vmStub.vmParameters.Properties.DiagnosticsProfile, check.IsNil)
+	_, err = inst.(cloud.InstanceWithConsole).ConsoleLog()
+	c.Check(err, check.Equals, cloud.ErrNotImplemented)
+
+	// Requires a storage account.
+	ap.azconfig.BootDiagnostics = true
+	c.Check(ap.checkBootDiagnosticsConfig(), check.ErrorMatches, `.*requires StorageAccount and BlobContainer`)
+	blobStub := &BlobReaderStub{blobs: map[string]string{}}
+	ap.blobReader = blobStub
+	ap.azconfig.StorageAccount = "teststorage"
+	ap.azureEnv.StorageEndpointSuffix = "core.windows.net"
+	c.Check(ap.checkBootDiagnosticsConfig(), check.IsNil)
+	ap.azconfig.ScaleSets = true
+	c.Check(ap.checkBootDiagnosticsConfig(), check.ErrorMatches, `.*cannot use both ScaleSets and BootDiagnostics`)
+	ap.azconfig.ScaleSets = false
+
+	inst, err = ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"InstanceSecret": "diag"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	bd := vmStub.vmParameters.Properties.DiagnosticsProfile.BootDiagnostics
+	c.Check(*bd.Enabled, check.Equals, true)
+	c.Check(*bd.StorageURI, check.Equals, "https://teststorage.blob.core.windows.net/")
+
+	// Console log is not available yet.
+	_, err = inst.(cloud.InstanceWithConsole).ConsoleLog()
+	c.Check(err, check.NotNil)
+
+	blobStub.blobs["bootdiagnostics-test/"+string(inst.ID())+".serialconsole.log"] = "kernel panic\n"
+	out, err := inst.(cloud.InstanceWithConsole).ConsoleLog()
+	c.Check(err, check.IsNil)
+	c.Check(out, check.Equals, "kernel panic\n")
+}
+
+func (*AzureInstanceSetSuite) TestDiskEncryptionSet(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	vmStub := ap.vmClient.(*VirtualMachinesClientStub)
+
+	// Disabled by default.
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, nil, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(vmStub.vmParameters.Properties.StorageProfile.OSDisk.ManagedDisk.DiskEncryptionSet, check.IsNil)
+
+	ap.azconfig.DiskEncryptionSetID = "des-1"
+	c.Check(ap.checkDiskEncryptionConfig(), check.ErrorMatches, `.*not a disk encryption set resource ID`)
+	desID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/diskEncryptionSets/des-1"
+	ap.azconfig.DiskEncryptionSetID = desID
+	c.Check(ap.checkDiskEncryptionConfig(), check.IsNil)
+
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"InstanceSecret": "des"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*vmStub.vmParameters.Properties.StorageProfile.OSDisk.ManagedDisk.DiskEncryptionSet.ID, check.Equals, desID)
+
+	// Data disks are encrypted too.
+	profile := &armcompute.StorageProfile{
+		OSDisk:    &armcompute.OSDisk{},
+		DataDisks: []*armcompute.DataDisk{{Lun: to.Ptr(int32(0))}},
+	}
+	c.Check(ap.applyDiskEncryption(profile), check.IsNil)
+	c.Check(*profile.DataDisks[0].ManagedDisk.DiskEncryptionSet.ID, check.Equals, desID)
+
+	ssProfile := &armcompute.VirtualMachineScaleSetStorageProfile{OSDisk: &armcompute.VirtualMachineScaleSetOSDisk{}}
+	ap.applyScaleSetDiskEncryption(ssProfile)
+	c.Check(*ssProfile.OSDisk.ManagedDisk.DiskEncryptionSet.ID, check.Equals, desID)
+
+	// Unmanaged disks cannot use a disk encryption set.
+	profile = &armcompute.StorageProfile{
+		OSDisk: &armcompute.OSDisk{Vhd: &armcompute.VirtualHardDisk{URI: to.Ptr("https://example/os.vhd")}},
+	}
+	c.Check(ap.applyDiskEncryption(profile), check.ErrorMatches, `.*cannot use DiskEncryptionSetID with unmanaged image URL`)
+}
+
+func (*AzureInstanceSetSuite) TestConfigSchema(c *check.C) {
+	schema := Driver.ConfigSchema()
+	c.Check(schema.Check(json.RawMessage(`{
+		"SubscriptionID": "sub",
+		"Location": "centralus",
+		"Zones": ["1", "2"],
+		"DeleteDanglingResourcesAfter": "20s",
+		"SharedMount": {"Source": "example:/refdata", "MountPoint": "/mnt/refdata"},
+		"OSDisks": {"tiny": {"SizeGB": 64}},
+		"SecurityProfile": {"SecurityType": "TrustedLaunch", "SecureBoot": true, "VTPM": true}
+	}`)), check.IsNil)
+	c.Check(schema.Check(json.RawMessage(`{
+		"SecretAccessKey": "ec2 key",
+		"Zones": "1",
+		"SecurityProfile": {"SecureBoot": "yes"}
+	}`)), check.ErrorMatches, `SecretAccessKey: unknown key; SecurityProfile.SecureBoot: expected boolean, got string; Zones: expected array, got string`)
+}
+
+func (*AzureInstanceSetSuite) TestSecurityProfile(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	vmStub := ap.vmClient.(*VirtualMachinesClientStub)
+
+	// Disabled by default.
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, nil, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(vmStub.vmParameters.Properties.SecurityProfile, check.IsNil)
+
+	for _, trial := range []struct {
+		profile azureSecurityProfile
+		err     string
+	}{
+		{azureSecurityProfile{}, ""},
+		{azureSecurityProfile{SecurityType: "TrustedLaunch"}, ""},
+		{azureSecurityProfile{SecurityType: "TrustedLaunch", SecureBoot: true, VTPM: true}, ""},
+		{azureSecurityProfile{SecureBoot: true}, `.*require SecurityProfile.SecurityType TrustedLaunch`},
+		{azureSecurityProfile{VTPM: true}, `.*require SecurityProfile.SecurityType TrustedLaunch`},
+		{azureSecurityProfile{SecurityType: "ConfidentialVM"}, `.*unsupported SecurityProfile.SecurityType "ConfidentialVM".*`},
+	} {
+		c.Logf("trial %+v", trial.profile)
+		if trial.err == "" {
+			c.Check(trial.profile.check(), check.IsNil)
+		} else {
+			c.Check(trial.profile.check(), check.ErrorMatches, trial.err)
+		}
+	}
+
+	ap.azconfig.SecurityProfile = azureSecurityProfile{SecurityType: "TrustedLaunch", SecureBoot: true, VTPM: true}
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"InstanceSecret": "sp"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	sp := vmStub.vmParameters.Properties.SecurityProfile
+	c.Assert(sp, check.NotNil)
+	c.Check(*sp.SecurityType, check.Equals, armcompute.SecurityTypesTrustedLaunch)
+	c.Check(*sp.UefiSettings.SecureBootEnabled, check.Equals, true)
+	c.Check(*sp.UefiSettings.VTpmEnabled, check.Equals, true)
+
+	// Scale sets get the same profile.
+	ap.azconfig.ScaleSets = true
+	azss := newAzureScaleSetInstanceSet(ap)
+	pk, _ := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+	_, err = azss.Create(cluster.InstanceTypes["tiny"], img, nil, "echo ok", pk)
+	c.Assert(err, check.IsNil)
+	set := ap.ssClient.(*ScaleSetsClientStub).sets[azss.scaleSetName(cluster.InstanceTypes["tiny"], img, pk)]
+	c.Assert(set.Properties.VirtualMachineProfile.SecurityProfile, check.NotNil)
+	c.Check(*set.Properties.VirtualMachineProfile.SecurityProfile.SecurityType, check.Equals, armcompute.SecurityTypesTrustedLaunch)
+}
+
+func (*AzureInstanceSetSuite) TestHostKeyVerification(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	vmStub := ap.vmClient.(*VirtualMachinesClientStub)
+	vmKey, _ := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_vm")
+	otherKey, _ := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+	vmKeyLine := string(ssh.MarshalAuthorizedKey(vmKey))
+
+	ap.azconfig.HostKeyVerification = "bogus"
+	c.Check(ap.azconfig.checkHostKeyVerification(), check.ErrorMatches, `invalid configuration: unsupported HostKeyVerification "bogus".*`)
+
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, nil, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+
+	// By default, the dispatcher verifies host keys itself.
+	for _, mode := range []string{"", "ssh"} {
+		ap.azconfig.HostKeyVerification = mode
+		c.Check(ap.azconfig.checkHostKeyVerification(), check.IsNil)
+		c.Check(inst.VerifyHostKey(vmKey, nil), check.Equals, cloud.ErrNotImplemented)
+	}
+	c.Check(vmStub.commands, check.HasLen, 0)
+
+	ap.azconfig.HostKeyVerification = "run-command"
+	c.Check(ap.azconfig.checkHostKeyVerification(), check.IsNil)
+	vmStub.commandOutput = "ssh-rsa AAAAbogus root@vm\n" + string(ssh.MarshalAuthorizedKey(otherKey)) + vmKeyLine
+	c.Check(inst.VerifyHostKey(vmKey, nil), check.IsNil)
+	c.Check(vmStub.commands, check.DeepEquals, []string{hostKeyScript})
+	vmStub.commandOutput = string(ssh.MarshalAuthorizedKey(otherKey))
+	c.Check(inst.VerifyHostKey(vmKey, nil), check.Equals, errHostKeyMismatch)
+	vmStub.commandOutput = "cat: /etc/ssh/ssh_host_*_key.pub: No such file or directory\n"
+	c.Check(inst.VerifyHostKey(vmKey, nil), check.ErrorMatches, `no host keys found in Run Command output .*`)
+	vmStub.commandErr = errors.New("VM agent is not ready")
+	c.Check(inst.VerifyHostKey(vmKey, nil), check.ErrorMatches, `error getting host keys using Run Command: VM agent is not ready`)
+
+	// Scale set VMs are checked the same way.
+	azss := newAzureScaleSetInstanceSet(ap)
+	ssStub := ap.ssClient.(*ScaleSetsClientStub)
+	ssStub.commandOutput = vmKeyLine
+	ssInst := &azureScaleSetInstance{provider: azss, scaleSet: "ss1", vm: armcompute.VirtualMachineScaleSetVM{InstanceID: to.Ptr("3")}}
+	c.Check(ssInst.VerifyHostKey(vmKey, nil), check.IsNil)
+	c.Check(ssInst.VerifyHostKey(otherKey, nil), check.Equals, errHostKeyMismatch)
+}
+
+func (*AzureInstanceSetSuite) TestRunCommandStdout(c *check.C) {
+	msg := "Enable succeeded: \n[stdout]\nssh-ed25519 AAAA root@vm\n\n[stderr]\nwarning\n"
+	result := armcompute.RunCommandResult{Value: []*armcompute.InstanceViewStatus{{Message: &msg}}}
+	c.Check(runCommandStdout(result), check.Equals, "ssh-ed25519 AAAA root@vm\n")
+	c.Check(runCommandStdout(armcompute.RunCommandResult{}), check.Equals, "")
+}
+
+func (*AzureInstanceSetSuite) TestOSDisks(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	vmStub := ap.vmClient.(*VirtualMachinesClientStub)
+
+	for _, trial := range []struct {
+		disks map[string]azureOSDisk
+		err   string
+	}{
+		{nil, ""},
+		{map[string]azureOSDisk{"*": {SKU: "StandardSSD_LRS"}, "tiny": {SKU: "Premium_LRS", SizeGB: 256}}, ""},
+		{map[string]azureOSDisk{"tiny": {SKU: "UltraSSD_LRS"}}, `.*UltraSSD_LRS cannot be used for OS disks`},
+		{map[string]azureOSDisk{"tiny": {SKU: "Fast_LRS"}}, `.*unsupported SKU "Fast_LRS"`},
+		{map[string]azureOSDisk{"tiny": {SizeGB: 5000}}, `.*SizeGB 5000 is out of range.*`},
+		{map[string]azureOSDisk{"tiny": {Caching: "None"}, "*": {Caching: "ReadOnly"}}, ""},
+		{map[string]azureOSDisk{"tiny": {Caching: "WriteBack"}}, `.*unsupported Caching "WriteBack".*`},
+		{map[string]azureOSDisk{"tiny": {SKU: "Premium_LRS", Caching: "None", WriteAccelerator: true}}, ""},
+		{map[string]azureOSDisk{"tiny": {SKU: "StandardSSD_LRS", Caching: "None", WriteAccelerator: true}}, `.*WriteAccelerator requires SKU "Premium_LRS"`},
+		{map[string]azureOSDisk{"tiny": {SKU: "Premium_LRS", WriteAccelerator: true}}, `.*WriteAccelerator requires Caching "None" or "ReadOnly"`},
+		{map[string]azureOSDisk{"tiny": {SKU: "Premium_LRS", Caching: "ReadWrite", WriteAccelerator: true}}, `.*WriteAccelerator requires Caching "None" or "ReadOnly"`},
+	} {
+		ap.azconfig.OSDisks = trial.disks
+		err := ap.checkOSDisksConfig()
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err)
+		}
+	}
+
+	ap.azconfig.OSDisks = map[string]azureOSDisk{"*": {SKU: "StandardSSD_LRS"}, "tiny": {SKU: "Premium_LRS", SizeGB: 256}}
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"InstanceSecret": "osdisk1"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	osDisk := vmStub.vmParameters.Properties.StorageProfile.OSDisk
+	c.Check(*osDisk.ManagedDisk.StorageAccountType, check.Equals, armcompute.StorageAccountTypesPremiumLRS)
+	c.Check(*osDisk.DiskSizeGB, check.Equals, int32(256))
+
+	// Instance types without their own entry use "*".
+	small := cluster.InstanceTypes["tiny"]
+	small.Name = "small"
+	_, err = ap.Create(small, img, cloud.InstanceTags{"InstanceSecret": "osdisk2"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	osDisk = vmStub.vmParameters.Properties.StorageProfile.OSDisk
+	c.Check(*osDisk.ManagedDisk.StorageAccountType, check.Equals, armcompute.StorageAccountTypesStandardSSDLRS)
+	c.Check(osDisk.DiskSizeGB, check.IsNil)
+	c.Check(osDisk.Caching, check.IsNil)
+	c.Check(osDisk.WriteAcceleratorEnabled, check.IsNil)
+
+	ssProfile := &armcompute.VirtualMachineScaleSetStorageProfile{OSDisk: &armcompute.VirtualMachineScaleSetOSDisk{}}
+	ap.applyScaleSetOSDisk(cluster.InstanceTypes["tiny"], ssProfile)
+	c.Check(*ssProfile.OSDisk.ManagedDisk.StorageAccountType, check.Equals, armcompute.StorageAccountTypesPremiumLRS)
+	c.Check(*ssProfile.OSDisk.DiskSizeGB, check.Equals, int32(256))
+
+	// Caching and Write Accelerator, e.g., for an M-series VM
+	// running a database.
+	ap.azconfig.OSDisks = map[string]azureOSDisk{"tiny": {SKU: "Premium_LRS", Caching: "None", WriteAccelerator: true}}
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"InstanceSecret": "osdisk3"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	osDisk = vmStub.vmParameters.Properties.StorageProfile.OSDisk
+	c.Check(*osDisk.Caching, check.Equals, armcompute.CachingTypesNone)
+	c.Check(*osDisk.WriteAcceleratorEnabled, check.Equals, true)
+
+	ssProfile = &armcompute.VirtualMachineScaleSetStorageProfile{OSDisk: &armcompute.VirtualMachineScaleSetOSDisk{}}
+	ap.applyScaleSetOSDisk(cluster.InstanceTypes["tiny"], ssProfile)
+	c.Check(*ssProfile.OSDisk.Caching, check.Equals, armcompute.CachingTypesNone)
+	c.Check(*ssProfile.OSDisk.WriteAcceleratorEnabled, check.Equals, true)
+
+	// Unmanaged disks cannot use a SKU.
+	profile := &armcompute.StorageProfile{
+		OSDisk: &armcompute.OSDisk{Vhd: &armcompute.VirtualHardDisk{URI: to.Ptr("https://example/os.vhd")}},
+	}
+	c.Check(ap.applyOSDisk(cluster.InstanceTypes["tiny"], profile), check.ErrorMatches, `.*cannot use OSDisks SKU with unmanaged image URL`)
+}
+
+func (*AzureInstanceSetSuite) TestImagePlans(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	vmStub := ap.vmClient.(*VirtualMachinesClientStub)
+
+	for _, trial := range []struct {
+		plans map[string]azureImagePlan
+		err   string
+	}{
+		{nil, ""},
+		{map[string]azureImagePlan{"gpu": {ImageID: "nvidia:ngc:base:1.0", Publisher: "nvidia", Product: "ngc", Name: "base"}}, ""},
+		{map[string]azureImagePlan{"gpu": {ImageID: "gallery/gpuimage"}}, ""},
+		{map[string]azureImagePlan{"gpu": {Publisher: "nvidia", Name: "base"}}, `.*Publisher, Product, and Name must all be set`},
+		{map[string]azureImagePlan{"gpu": {ImageID: "https://example/img.vhd"}}, `.*cannot use unmanaged image URL.*`},
+		{map[string]azureImagePlan{"gpu": {}}, `.*no ImageID or plan specified`},
+	} {
+		ap.azconfig.ImagePlans = trial.plans
+		err := ap.checkImagePlansConfig()
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err)
+		}
+	}
+
+	ap.azconfig.ImagePlans = map[string]azureImagePlan{
+		"gpu":        {ImageID: "nvidia:ngc:base:1.0", Publisher: "nvidia", Product: "ngc", Name: "base", PromotionCode: "promo"},
+		string(img):  {Publisher: "acme", Product: "img", Name: "plan1"},
+		"gpugallery": {ImageID: "gallery/gpuimage"},
+	}
+
+	// Instance type entry: marketplace image and its plan.
+	gpu := cluster.InstanceTypes["tiny"]
+	gpu.Name = "gpu"
+	_, err = ap.Create(gpu, img, cloud.InstanceTags{"InstanceSecret": "plan1"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	ref := vmStub.vmParameters.Properties.StorageProfile.ImageReference
+	c.Check(ref.ID, check.IsNil)
+	c.Check(*ref.Publisher, check.Equals, "nvidia")
+	c.Check(*ref.Offer, check.Equals, "ngc")
+	c.Check(*ref.SKU, check.Equals, "base")
+	c.Check(*ref.Version, check.Equals, "1.0")
+	c.Check(vmStub.vmParameters.Plan, check.DeepEquals, &armcompute.Plan{
+		Publisher:     to.Ptr("nvidia"),
+		Product:       to.Ptr("ngc"),
+		Name:          to.Ptr("base"),
+		PromotionCode: to.Ptr("promo"),
+	})
+
+	// Image entry: default image with a plan.
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"InstanceSecret": "plan2"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*vmStub.vmParameters.Properties.StorageProfile.ImageReference.ID, check.Matches, `.*/images/`+string(img))
+	c.Assert(vmStub.vmParameters.Plan, check.NotNil)
+	c.Check(*vmStub.vmParameters.Plan.Name, check.Equals, "plan1")
+	c.Check(vmStub.vmParameters.Plan.PromotionCode, check.IsNil)
+
+	// Instance type entry without a plan: different image, no
+	// plan.
+	gpu.Name = "gpugallery"
+	_, err = ap.Create(gpu, img, cloud.InstanceTags{"InstanceSecret": "plan3"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*vmStub.vmParameters.Properties.StorageProfile.ImageReference.ID, check.Matches, `.*/galleries/gallery/images/gpuimage`)
+	c.Check(vmStub.vmParameters.Plan, check.IsNil)
+
+	_, err = ap.imageReference("nvidia:ngc:base")
+	c.Check(err, check.ErrorMatches, `invalid image ID "nvidia:ngc:base": expected publisher:offer:sku:version`)
+}
+
+func (*AzureInstanceSetSuite) TestParseBlobURI(c *check.C) {
+	container, name, err := parseBlobURI("https://acct.blob.core.windows.net/bootdiagnostics-x-1234/vm.1234.serialconsole.log")
+	c.Check(err, check.IsNil)
+	c.Check(container, check.Equals, "bootdiagnostics-x-1234")
+	c.Check(name, check.Equals, "vm.1234.serialconsole.log")
+	for _, bad := range []string{"https://acct.blob.core.windows.net/", "https://acct.blob.core.windows.net/container", "https://acct.blob.core.windows.net//blob"} {
+		_, _, err = parseBlobURI(bad)
+		c.Check(err, check.NotNil, check.Commentf("%s", bad))
+	}
+}
+
+func (*AzureInstanceSetSuite) TestSubResourceTags(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	ap.azconfig.CreatePublicIP = true
+	nicStub := ap.netClient.(*InterfacesClientStub)
+	disksStub := ap.disksClient.(*DisksClientStub)
+	pipStub := ap.pipClient.(*PublicIPAddressesClientStub)
+
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{
+		"ArvadosContainerUUID": "zzzzz-dz642-abcdefghijklmno",
+		"ArvadosWorkflow":      "test workflow",
+	}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	for _, tags := range []map[string]*string{
+		nicStub.nics[string(inst.ID())+"-nic"].Tags,
+		pipStub.pips[string(inst.ID())+"-ip"].Tags,
+		disksStub.tags["rg/"+string(inst.ID())+"-os"],
+	} {
+		c.Assert(tags, check.NotNil)
+		c.Check(*tags["ArvadosContainerUUID"], check.Equals, "zzzzz-dz642-abcdefghijklmno")
+		c.Check(*tags["ArvadosWorkflow"], check.Equals, "test workflow")
+	}
+}
+
+func (*AzureInstanceSetSuite) TestResourceTags(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	ap.azconfig.CreatePublicIP = true
+	nicStub := ap.netClient.(*InterfacesClientStub)
+	disksStub := ap.disksClient.(*DisksClientStub)
+	pipStub := ap.pipClient.(*PublicIPAddressesClientStub)
+
+	c.Check(ap.checkResourceTagsConfig(), check.IsNil)
+	ap.azconfig.ResourceTags = map[string]string{"cost/center": "1234"}
+	c.Check(ap.checkResourceTagsConfig(), check.ErrorMatches, `.*invalid tag name "cost/center"`)
+	ap.azconfig.ResourceTags = map[string]string{"owner": strings.Repeat("x", 300)}
+	c.Check(ap.checkResourceTagsConfig(), check.ErrorMatches, `.*value is longer than 256 characters`)
+
+	ap.azconfig.ResourceTags = map[string]string{
+		"cost-center":          "1234",
+		"environment":          "production",
+		"ArvadosContainerUUID": "overridden",
+	}
+	c.Check(ap.checkResourceTagsConfig(), check.IsNil)
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{
+		"ArvadosContainerUUID": "zzzzz-dz642-abcdefghijklmno",
+	}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(inst.Tags()["cost-center"], check.Equals, "1234")
+	for _, tags := range []map[string]*string{
+		ap.vmClient.(*VirtualMachinesClientStub).vmParameters.Tags,
+		nicStub.nics[string(inst.ID())+"-nic"].Tags,
+		pipStub.pips[string(inst.ID())+"-ip"].Tags,
+		disksStub.tags["rg/"+string(inst.ID())+"-os"],
+	} {
+		c.Assert(tags, check.NotNil)
+		c.Check(*tags["cost-center"], check.Equals, "1234")
+		c.Check(*tags["environment"], check.Equals, "production")
+		c.Check(*tags["ArvadosContainerUUID"], check.Equals, "zzzzz-dz642-abcdefghijklmno")
+		c.Check(tags["created-at"], check.NotNil)
+	}
+
+	// Tags updated later (e.g., IdleBehavior) don't remove
+	// ResourceTags.
+	c.Assert(inst.SetTags(cloud.InstanceTags{"ArvadosIdleBehavior": "hold"}), check.IsNil)
+	c.Check(inst.Tags()["environment"], check.Equals, "production")
+}
+
+func (*AzureInstanceSetSuite) TestBlobMetadata(c *check.C) {
+	c.Check(blobMetadata(map[string]*string{
+		"created-at":      to.Ptr("2024-01-01T00:00:00Z"),
+		"ArvadosWorkflow": to.Ptr("test workflow"),
+		"1st":             to.Ptr("x"),
+		"nil":             nil,
+	}), check.DeepEquals, map[string]*string{
+		"created_at":      to.Ptr("2024-01-01T00:00:00Z"),
+		"ArvadosWorkflow": to.Ptr("test workflow"),
+		"_1st":            to.Ptr("x"),
+	})
+}
+
+func (*AzureInstanceSetSuite) TestAdminUsername(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	err := (&azureInstanceSet{}).setup(azureInstanceSetConfig{}, "test123", nil)
+	c.Check(err, check.ErrorMatches, `invalid configuration: AdminUsername must be set`)
+
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	ap.azconfig.AdminUsername = "crunch"
+	pk, _ := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, nil, "echo ok", pk)
+	c.Assert(err, check.IsNil)
+	c.Check(inst.RemoteUser(), check.Equals, "crunch")
+	osProfile := ap.vmClient.(*VirtualMachinesClientStub).vmParameters.Properties.OSProfile
+	c.Check(*osProfile.AdminUsername, check.Equals, "crunch")
+	c.Check(*osProfile.LinuxConfiguration.SSH.PublicKeys[0].Path, check.Equals, "/home/crunch/.ssh/authorized_keys")
+}
+
+func (*AzureInstanceSetSuite) TestQuotaProbe(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	ap.azconfig.Location = "westus2"
+	usageStub := &UsageClientStub{}
+	skusStub := &ResourceSKUsClientStub{skus: []armcompute.ResourceSKU{
+		{ResourceType: to.Ptr("virtualMachines"), Name: to.Ptr("Standard_D1_v2"), Family: to.Ptr("standardDv2Family")},
+		{ResourceType: to.Ptr("disks"), Name: to.Ptr("Premium_LRS")},
+	}}
+	ap.usageClient = usageStub
+	ap.skusClient = skusStub
+	usage := func(name string, current int32, limit int64) armcompute.Usage {
+		return armcompute.Usage{Name: &armcompute.UsageName{Value: to.Ptr(name)}, CurrentValue: &current, Limit: &limit}
+	}
+	vmStub := ap.vmClient.(*VirtualMachinesClientStub)
+	vmStub.createErr = wrapAzureError(newAzureResponseError(http.StatusConflict, "QuotaExceeded", "Operation could not be completed as it results in exceeding approved quota"))
+
+	for _, trial := range []struct {
+		usages      []armcompute.Usage
+		vcpus       int
+		preemptible bool
+		capacity    string
+	}{
+		// Family quota exhausted, other families still fit.
+		{[]armcompute.Usage{usage("cores", 10, 100), usage("standardDv2Family", 10, 10)}, 1, false, `standardDv2Family quota has 0 vCPUs available, instance type tiny needs 1: .*`},
+		// Regional quota exhausted.
+		{[]armcompute.Usage{usage("cores", 100, 100), usage("standardDv2Family", 10, 10)}, 1, false, ""},
+		// Regional quota nearly exhausted, smaller types
+		// might fit.
+		{[]armcompute.Usage{usage("cores", 98, 100), usage("standardDv2Family", 0, 10)}, 4, false, `cores quota has 2 vCPUs available, instance type tiny needs 4: .*`},
+		// vCPU quotas aren't the problem.
+		{[]armcompute.Usage{usage("cores", 0, 100), usage("standardDv2Family", 0, 10)}, 1, false, ""},
+		// Usage API doesn't list the quota.
+		{nil, 1, false, ""},
+		// Spot VMs only use the low-priority quota.
+		{[]armcompute.Usage{usage("cores", 100, 100), usage("standardDv2Family", 10, 10), usage("lowPriorityCores", 0, 100)}, 1, true, ""},
+		{[]armcompute.Usage{usage("cores", 0, 100), usage("lowPriorityCores", 99, 100)}, 4, true, `lowPriorityCores quota has 1 vCPUs available, instance type tiny needs 4: .*`},
+	} {
+		c.Logf("trial: %+v", trial)
+		usageStub.usages = trial.usages
+		it := cluster.InstanceTypes["tiny"]
+		it.VCPUs = trial.vcpus
+		it.Preemptible = trial.preemptible
+		_, err = ap.Create(it, img, nil, "echo ok", nil)
+		c.Assert(err, check.NotNil)
+		if trial.capacity != "" {
+			cerr, ok := err.(cloud.CapacityError)
+			c.Assert(ok, check.Equals, true, check.Commentf("%T", err))
+			c.Check(cerr.IsCapacityError(), check.Equals, true)
+			c.Check(cerr.IsInstanceTypeSpecific(), check.Equals, true)
+			c.Check(err, check.ErrorMatches, "(?s)"+trial.capacity+`exceeding approved quota.*`)
+			_, ok = err.(cloud.QuotaError)
+			c.Check(ok, check.Equals, false)
+		} else {
+			c.Check(err, check.FitsTypeOf, &azureQuotaError{})
+		}
+	}
+	// SKU list is loaded once.
+	c.Check(skusStub.calls, check.Equals, 1)
+}
+
+func (*AzureInstanceSetSuite) TestZones(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+
+	c.Check(ap.checkZonesConfig(), check.IsNil)
+	ap.azconfig.Zones = []string{"1", ""}
+	c.Check(ap.checkZonesConfig(), check.ErrorMatches, `.*empty string in Zones`)
+	ap.azconfig.Zones = []string{"1", "3"}
+	ap.azconfig.AvailabilitySet = azureAvailabilitySet{Name: "auto"}
+	c.Check(ap.checkZonesConfig(), check.ErrorMatches, `.*cannot use both Zones and AvailabilitySet`)
+	ap.azconfig.AvailabilitySet = azureAvailabilitySet{}
+	c.Check(ap.checkZonesConfig(), check.IsNil)
+
+	// Create() calls are spread round-robin across zones.
+	for i, expect := range []string{"1", "3", "1"} {
+		inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": fmt.Sprintf("secret%d", i)}, "echo ok", nil)
+		c.Assert(err, check.IsNil)
+		vmParameters := ap.vmClient.(*VirtualMachinesClientStub).vmParameters
+		c.Assert(vmParameters.Zones, check.NotNil)
+		c.Check(vmParameters.Zones, check.DeepEquals, []*string{&expect})
+		c.Check(inst.Tags()["availability-zone"], check.Equals, expect)
+	}
+
+	// With a single zone, all VMs are pinned to it.
+	ap.azconfig.Zones = []string{"2"}
+	for i := 0; i < 2; i++ {
+		inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": fmt.Sprintf("pinned%d", i)}, "echo ok", nil)
+		c.Assert(err, check.IsNil)
+		c.Check(ap.vmClient.(*VirtualMachinesClientStub).vmParameters.Zones, check.DeepEquals, []*string{to.Ptr("2")})
+		c.Check(inst.Tags()["availability-zone"], check.Equals, "2")
+	}
+
+	// Without zones, VMs are not placed in a zone.
+	ap.azconfig.Zones = nil
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "nozone"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(ap.vmClient.(*VirtualMachinesClientStub).vmParameters.Zones, check.IsNil)
+	_, ok := inst.Tags()["availability-zone"]
+	c.Check(ok, check.Equals, false)
+}
+
+type DedicatedHostsClientStub struct {
+	hosts []armcompute.DedicatedHost
+	calls int
+}
+
+func (stub *DedicatedHostsClientStub) listByHostGroup(ctx context.Context, resourceGroupName string, hostGroupName string) ([]armcompute.DedicatedHost, error) {
+	stub.calls++
+	return stub.hosts, nil
+}
+
+func (*AzureInstanceSetSuite) TestHostGroup(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	hostID := func(name string) string {
+		return "/subscriptions/zzzzz/resourceGroups/hostrg/providers/Microsoft.Compute/hostGroups/hg1/hosts/" + name
+	}
+	hostsStub := &DedicatedHostsClientStub{hosts: []armcompute.DedicatedHost{{ID: to.Ptr(hostID("h1"))}, {ID: to.Ptr(hostID("h2"))}}}
+	ap.hostsClient = hostsStub
+
+	c.Check(ap.checkHostGroupConfig(), check.IsNil)
+	ap.azconfig.HostGroup = "hg1"
+	ap.azconfig.Zones = []string{"1", "2"}
+	c.Check(ap.checkHostGroupConfig(), check.ErrorMatches, `.*cannot use HostGroup with more than one zone.*`)
+	ap.azconfig.Zones = nil
+	ap.azconfig.AvailabilitySet = azureAvailabilitySet{Name: "auto"}
+	c.Check(ap.checkHostGroupConfig(), check.ErrorMatches, `.*cannot use both HostGroup and AvailabilitySet`)
+	ap.azconfig.AvailabilitySet = azureAvailabilitySet{}
+	ap.azconfig.HostGroup = "/subscriptions/zzzzz/resourceGroups/hostrg/hg1"
+	c.Check(ap.checkHostGroupConfig(), check.ErrorMatches, `.*is not a host group resource ID`)
+	ap.azconfig.HostGroup = "/subscriptions/zzzzz/resourceGroups/hostrg/providers/Microsoft.Compute/hostGroups/hg1"
+	c.Check(ap.checkHostGroupConfig(), check.IsNil)
+	rg, name, err := ap.hostGroupRef()
+	c.Check(err, check.IsNil)
+	c.Check(rg, check.Equals, "hostrg")
+	c.Check(name, check.Equals, "hg1")
+
+	// Create() calls are spread round-robin across hosts.
+	vmStub := ap.vmClient.(*VirtualMachinesClientStub)
+	for i, expect := range []string{"h1", "h2", "h1"} {
+		inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": fmt.Sprintf("host%d", i)}, "echo ok", nil)
+		c.Assert(err, check.IsNil)
+		c.Assert(vmStub.vmParameters.Properties.Host, check.NotNil)
+		c.Check(*vmStub.vmParameters.Properties.Host.ID, check.Equals, hostID(expect))
+		c.Check(inst.Tags()["dedicated-host"], check.Equals, expect)
+	}
+	// Host list is cached.
+	c.Check(hostsStub.calls, check.Equals, 1)
+
+	_, err = ap.Create(cluster.InstanceTypes["tinyp"], img, nil, "echo ok", nil)
+	c.Check(err, check.ErrorMatches, `.*spot VMs cannot be placed in HostGroup`)
+
+	// Host capacity errors are quota errors.
+	vmStub.createErr = newAzureResponseError(http.StatusConflict, "AllocationFailed", "Allocation failed.")
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "full"}, "echo ok", nil)
+	c.Check(err, check.ErrorMatches, `(?s)dedicated host .*/hosts/h2 is full: .*`)
+	qerr, ok := err.(cloud.QuotaError)
+	c.Assert(ok, check.Equals, true, check.Commentf("%T", err))
+	c.Check(qerr.IsQuotaError(), check.Equals, true)
+
+	// Other errors are not.
+	vmStub.createErr = newAzureResponseError(http.StatusBadRequest, "InvalidParameter", "")
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "invalid"}, "echo ok", nil)
+	c.Check(err, check.NotNil)
+	_, ok = err.(cloud.QuotaError)
+	c.Check(ok, check.Equals, false)
+
+	// A host group with no hosts is an error.
+	vmStub.createErr = nil
+	ap.hostPicker = azureHostPicker{}
+	hostsStub.hosts = nil
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "nohosts"}, "echo ok", nil)
+	c.Check(err, check.ErrorMatches, `host group "hg1" has no dedicated hosts`)
+}
+
+func (*AzureInstanceSetSuite) TestSubnets(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	nicStub := ap.netClient.(*InterfacesClientStub)
+	nicSubnet := func(inst cloud.Instance) string {
+		return path.Base(*nicStub.nics[string(inst.ID())+"-nic"].Properties.IPConfigurations[0].Properties.Subnet.ID)
+	}
+
+	ap.azconfig.Subnet = "default"
+	c.Check(ap.checkSubnetsConfig(), check.IsNil)
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "single"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(nicSubnet(inst), check.Equals, "default")
+
+	ap.azconfig.Subnets = []string{"sn1", "sn2", "sn3"}
+	c.Check(ap.checkSubnetsConfig(), check.ErrorMatches, `.*cannot use both Subnet and Subnets`)
+	ap.azconfig.Subnet = ""
+	c.Check(ap.checkSubnetsConfig(), check.IsNil)
+	ap.azconfig.Subnets = []string{"sn1", ""}
+	c.Check(ap.checkSubnetsConfig(), check.ErrorMatches, `.*empty string in Subnets`)
+	ap.azconfig.Subnets = []string{"sn1", "sn2", "sn3"}
+
+	// Create() calls are spread round-robin across subnets, and
+	// full subnets are skipped.
+	nicStub.fullSubnets = map[string]bool{"sn3": true}
+	for i, expect := range []string{"sn2", "sn1", "sn1", "sn2"} {
+		inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": fmt.Sprintf("subnet%d", i)}, "echo ok", nil)
+		c.Assert(err, check.IsNil)
+		c.Check(nicSubnet(inst), check.Equals, expect)
+	}
+	c.Check(ap.subnetPicker.exhausted["sn3"].After(time.Now()), check.Equals, true)
+
+	// All subnets full.
+	nicStub.fullSubnets = map[string]bool{"sn1": true, "sn2": true, "sn3": true}
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "full1"}, "echo ok", nil)
+	c.Check(err, check.ErrorMatches, `(?s)all subnets are out of private IP addresses: .*Subnet is full.*`)
+	qerr, ok := err.(cloud.QuotaError)
+	c.Assert(ok, check.Equals, true, check.Commentf("%T", err))
+	c.Check(qerr.IsQuotaError(), check.Equals, true)
+	// ...and they are skipped without another API call.
+	created := len(nicStub.created)
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "full2"}, "echo ok", nil)
+	c.Check(err, check.ErrorMatches, `all subnets are out of private IP addresses .*`)
+	c.Check(err, check.FitsTypeOf, &azureSubnetsExhaustedError{})
+	c.Check(nicStub.created, check.HasLen, created)
+
+	// Subnets are tried again after subnetExhaustedTTL.
+	nicStub.fullSubnets = nil
+	for subnet := range ap.subnetPicker.exhausted {
+		ap.subnetPicker.exhausted[subnet] = time.Now().Add(-time.Second)
+	}
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "retry"}, "echo ok", nil)
+	c.Check(err, check.IsNil)
+}
+
+func (*AzureInstanceSetSuite) TestLocations(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	vmStub := ap.vmClient.(*VirtualMachinesClientStub)
+	nicStub := ap.netClient.(*InterfacesClientStub)
+	nicSubnet := func(inst cloud.Instance) string {
+		return *nicStub.nics[string(inst.ID())+"-nic"].Properties.IPConfigurations[0].Properties.Subnet.ID
+	}
+
+	ap.azconfig.Location = "eastus"
+	ap.azconfig.Network = "net1"
+	ap.azconfig.Subnet = "default"
+	ap.azconfig.Locations = []azureLocation{{Location: "westus2", Network: "net2"}}
+	c.Check(ap.checkLocationsConfig(), check.ErrorMatches, `.*cannot use both Locations and unmanaged disks.*`)
+	ap.azconfig.BlobContainer = ""
+	c.Check(ap.checkLocationsConfig(), check.ErrorMatches, `.*Locations\[0\] \(westus2\): Subnets must be set`)
+	ap.azconfig.Locations = []azureLocation{{Location: "EastUS", Network: "net2", Subnets: []string{"sn1"}}}
+	c.Check(ap.checkLocationsConfig(), check.ErrorMatches, `.*location "EastUS" is listed more than once.*`)
+	ap.azconfig.Locations = []azureLocation{{Location: "westus2", Network: "net2", Subnets: []string{"sn1"}}}
+	ap.azconfig.ScaleSets = true
+	c.Check(ap.checkLocationsConfig(), check.ErrorMatches, `.*cannot use both Locations and ScaleSets`)
+	ap.azconfig.ScaleSets = false
+	ap.azconfig.Locations = []azureLocation{{Location: "westus2", Network: "net2", Subnets: []string{"sn1"}, Images: map[string]string{"img": "https://example.blob.core.windows.net/vhds/img.vhd"}}}
+	c.Check(ap.checkLocationsConfig(), check.ErrorMatches, `.*Locations\[0\] \(westus2\): cannot use unmanaged image URL in Images`)
+	ap.azconfig.Locations = []azureLocation{
+		{Location: "westus2", Network: "net2", Subnets: []string{"sn1"}, Zones: []string{"3"}, Images: map[string]string{string(img): "img-westus2"}},
+		{Location: "northeurope", Network: "net3", NetworkResourceGroup: "netrg", Subnets: []string{"sn2"}, NetworkSecurityGroup: "/subscriptions/zzzzz/nsg3", Images: map[string]string{string(img): "img-northeurope"}},
+	}
+	c.Assert(ap.checkLocationsConfig(), check.IsNil)
+	c.Assert(ap.setupRegions(), check.IsNil)
+
+	// VMs are created in the primary location when it has
+	// capacity.
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "primary"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*vmStub.vmParameters.Location, check.Equals, "eastus")
+	c.Check(inst.Tags()[tagLocation], check.Equals, "eastus")
+	c.Check(nicSubnet(inst), check.Matches, `.*/resourceGroups/rg/.*/virtualnetworks/net1/subnets/default`)
+
+	// The hint tag selects a secondary location, with its own
+	// network, zones, and security group.
+	inst, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "hint", tagLocation: "NorthEurope"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*vmStub.vmParameters.Location, check.Equals, "northeurope")
+	c.Check(inst.Tags()[tagLocation], check.Equals, "northeurope")
+	c.Check(nicSubnet(inst), check.Matches, `.*/resourceGroups/netrg/.*/virtualnetworks/net3/subnets/sn2`)
+	c.Check(*vmStub.vmParameters.Properties.StorageProfile.ImageReference.ID, check.Matches, `.*/images/img-northeurope`)
+	c.Check(*nicStub.nics[string(inst.ID())+"-nic"].Properties.NetworkSecurityGroup.ID, check.Equals, "/subscriptions/zzzzz/nsg3")
+
+	// SetTags keeps the VM in its location.
+	c.Assert(inst.SetTags(cloud.InstanceTags{"foo": "bar"}), check.IsNil)
+	c.Check(*vmStub.vmParameters.Location, check.Equals, "northeurope")
+
+	// When the primary location has no capacity, the next
+	// location is used.
+	vmStub.fullLocations = map[string]bool{"eastus": true}
+	inst, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "overflow"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*vmStub.vmParameters.Location, check.Equals, "westus2")
+	c.Check(vmStub.vmParameters.Zones, check.DeepEquals, []*string{to.Ptr("3")})
+	c.Check(*vmStub.vmParameters.Properties.StorageProfile.ImageReference.ID, check.Matches, `.*/images/img-westus2`)
+	c.Check(nicSubnet(inst), check.Matches, `.*/virtualnetworks/net2/subnets/sn1`)
+	// The NIC created for the failed attempt in the primary
+	// location was cleaned up, and the VM in the secondary
+	// location got a different name.
+	c.Check(nicStub.deleted, check.HasLen, 1)
+	c.Check(nicStub.deleted[0], check.Not(check.Equals), string(inst.ID())+"-nic")
+
+	// A secondary location without capacity is skipped (for
+	// that VM size) on subsequent calls.
+	vmStub.fullLocations = map[string]bool{"eastus": true, "westus2": true}
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "overflow2"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*vmStub.vmParameters.Location, check.Equals, "northeurope")
+	c.Check(ap.regionPicker.exhausted["westus2/Standard_D1_v2"].After(time.Now()), check.Equals, true)
+	vmStub.fullLocations = map[string]bool{"eastus": true}
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "overflow3"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*vmStub.vmParameters.Location, check.Equals, "northeurope")
+
+	// When all locations are full, the error from the last one
+	// tried is returned.
+	vmStub.fullLocations = map[string]bool{"eastus": true, "westus2": true, "northeurope": true}
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "full"}, "echo ok", nil)
+	c.Check(err, check.ErrorMatches, `(?s).*Allocation failed.*`)
+
+	// Other errors don't cause another location to be tried.
+	vmStub.fullLocations = nil
+	vmStub.createErr = errors.New("boom")
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "boom"}, "echo ok", nil)
+	c.Check(err, check.ErrorMatches, `boom`)
+	c.Check(ap.regionPicker.exhausted["eastus/Standard_D1_v2"].IsZero(), check.Equals, true)
+	vmStub.createErr = nil
+
+	// A managed image without an entry in Images is only used
+	// in the primary location, but a gallery image can be used
+	// in any location.
+	vmStub.fullLocations = map[string]bool{"eastus": true}
+	ap.regionPicker.exhausted = nil
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], "otherimg", map[string]string{"InstanceSecret": "noimage"}, "echo ok", nil)
+	c.Check(err, check.ErrorMatches, `.*managed image "otherimg" is not available in location northeurope.*`)
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], "gallery1/img/1.0.0", map[string]string{"InstanceSecret": "gallery"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*vmStub.vmParameters.Location, check.Equals, "westus2")
+	c.Check(*vmStub.vmParameters.Properties.StorageProfile.ImageReference.ID, check.Matches, `.*/galleries/gallery1/images/img/versions/1.0.0`)
+}
+
+func (*AzureInstanceSetSuite) TestCustomDataTemplate(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	customData := func() string {
+		buf, err := base64.StdEncoding.DecodeString(*ap.vmClient.(*VirtualMachinesClientStub).vmParameters.Properties.OSProfile.CustomData)
+		c.Assert(err, check.IsNil)
+		return string(buf)
+	}
+
+	// Without a template, custom data is the init script.
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "s0"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(customData(), check.Equals, "#!/bin/sh\necho ok\n")
+
+	ap.azconfig.CustomDataTemplate = "{{.InitScript"
+	c.Check(ap.loadCustomDataTemplate(), check.ErrorMatches, `Invalid configuration: CustomDataTemplate: .*`)
+
+	ap.azconfig.CustomDataTemplate = `#cloud-config
+write_files:
+- path: /home/crunch/node-token
+  content: {{.Token}}
+- path: /etc/arvados-node
+  content: {{.DispatcherID}} {{.Name}} {{.InstanceType.Name}} {{index .Tags "role"}}
+runcmd:
+- {{printf "%q" .InitCommand}}
+`
+	c.Assert(ap.loadCustomDataTemplate(), check.IsNil)
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "s1", "role": "compute"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(customData(), check.Equals, `#cloud-config
+write_files:
+- path: /home/crunch/node-token
+  content: s1
+- path: /etc/arvados-node
+  content: test123 `+string(inst.ID())+` tiny compute
+runcmd:
+- "echo ok"
+`)
+
+	// A rendering error fails the Create call.
+	ap.azconfig.CustomDataTemplate = `{{index .Tags "role" | len | printf "%d" | call}}`
+	c.Assert(ap.loadCustomDataTemplate(), check.IsNil)
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"InstanceSecret": "s2"}, "echo ok", nil)
+	c.Check(err, check.ErrorMatches, `error rendering CustomDataTemplate: .*`)
+}
+
+func (*AzureInstanceSetSuite) TestAuthMethods(c *check.C) {
+	for _, trial := range []struct {
+		cfg    azureInstanceSetConfig
+		expect []string
+	}{
+		{azureInstanceSetConfig{ClientID: "id", ClientSecret: "secret"}, []string{"client-secret"}},
+		{azureInstanceSetConfig{}, []string{"managed-identity", "cli"}},
+		{azureInstanceSetConfig{AuthMethod: "auto", ClientSecret: "secret"}, []string{"managed-identity", "client-secret", "cli"}},
+		{azureInstanceSetConfig{AuthMethod: "managed-identity", ClientSecret: "secret"}, []string{"managed-identity"}},
+		{azureInstanceSetConfig{AuthMethod: "cli"}, []string{"cli"}},
+		{azureInstanceSetConfig{ClientCertificatePath: "/cert.pfx"}, []string{"managed-identity", "client-certificate", "cli"}},
+		{azureInstanceSetConfig{AuthMethod: "auto", ClientCertificatePath: "/cert.pfx", ClientSecret: "secret"}, []string{"managed-identity", "client-certificate", "client-secret", "cli"}},
+		{azureInstanceSetConfig{AuthMethod: "client-certificate"}, []string{"client-certificate"}},
+	} {
+		methods, err := trial.cfg.authMethods()
+		c.Check(err, check.IsNil)
+		c.Check(methods, check.DeepEquals, trial.expect)
+	}
+	_, err := azureInstanceSetConfig{AuthMethod: "bogus"}.authMethods()
+	c.Check(err, check.ErrorMatches, `invalid AuthMethod "bogus".*`)
+}
+
+// stubProbeCredential makes managed identity available if msiOK is
+// true, and the CLI method unavailable.
+func stubProbeCredential(msiOK *bool, cliCalls *int) func(context.Context, azcore.TokenCredential, string) error {
+	return func(ctx context.Context, cred azcore.TokenCredential, scope string) error {
+		switch cred.(type) {
+		case *azidentity.ManagedIdentityCredential:
+			if *msiOK {
+				return nil
+			}
+			return errors.New("no instance metadata service")
+		case *azidentity.AzureCLICredential:
+			*cliCalls++
+			return errors.New("az login required")
+		default:
+			return fmt.Errorf("unexpected credential type %T", cred)
+		}
+	}
+}
+
+func (*AzureInstanceSetSuite) TestCredentialFallback(c *check.C) {
+	defer func(orig func(context.Context, azcore.TokenCredential, string) error) { probeCredential = orig }(probeCredential)
+	msiOK := false
+	cliCalls := 0
+	probeCredential = stubProbeCredential(&msiOK, &cliCalls)
+	cfg := azureInstanceSetConfig{CloudEnvironment: "AzurePublicCloud", AuthMethod: "auto"}
+
+	_, _, err := cfg.credential(nil)
+	c.Check(err, check.ErrorMatches, `no usable Azure credentials \(managed-identity: managed identity is not available: no instance metadata service; cli: error getting token from Azure CLI: az login required\)`)
+	c.Check(cliCalls, check.Equals, 1)
+
+	// Client secret is used if MSI is unavailable.
+	cfg.ClientID, cfg.ClientSecret, cfg.TenantID = "id", "secret", "tenant"
+	cred, _, err := cfg.credential(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(cred, check.FitsTypeOf, &cachedCredential{})
+	c.Check(cred.(*cachedCredential).TokenCredential, check.FitsTypeOf, &azidentity.ClientSecretCredential{})
+	c.Check(cliCalls, check.Equals, 1)
+
+	// MSI is preferred when available.
+	msiOK = true
+	cfg.ManagedIdentityClientID = "user-assigned-id"
+	cred, _, err = cfg.credential(nil)
+	c.Assert(err, check.IsNil)
+	c.Check(cred.(*cachedCredential).TokenCredential, check.FitsTypeOf, &azidentity.ManagedIdentityCredential{})
+
+	// An explicitly configured method does not fall back.
+	msiOK = false
+	cfg.AuthMethod = "managed-identity"
+	_, _, err = cfg.credential(nil)
+	c.Check(err, check.ErrorMatches, `managed identity is not available: no instance metadata service`)
+}
+
+func (*AzureInstanceSetSuite) TestClientCertificateAuth(c *check.C) {
+	defer func(orig func(context.Context, azcore.TokenCredential, string) error) { probeCredential = orig }(probeCredential)
+	msiOK := false
+	cliCalls := 0
+	probeCredential = stubProbeCredential(&msiOK, &cliCalls)
+	cfg := azureInstanceSetConfig{CloudEnvironment: "AzurePublicCloud", AuthMethod: "client-certificate", TenantID: "tenant"}
+	_, _, err := cfg.credential(nil)
+	c.Check(err, check.ErrorMatches, `ClientID and ClientCertificatePath must be set`)
+
+	cfg.ClientID = "id"
+	cfg.ClientCertificatePath = c.MkDir() + "/nonexistent.pfx"
+	_, _, err = cfg.credential(nil)
+	c.Check(err, check.ErrorMatches, `.*failed to read the certificate file.*`)
+
+	err = os.WriteFile(cfg.ClientCertificatePath, []byte("bogus"), 0600)
+	c.Assert(err, check.IsNil)
+	_, _, err = cfg.credential(nil)
+	c.Check(err, check.ErrorMatches, `failed to parse the certificate file .*/nonexistent.pfx: .*`)
+
+	// In the fallback chain, a bad certificate doesn't prevent
+	// using the client secret.
+	cfg.AuthMethod = "auto"
+	cfg.ClientSecret = "secret"
+	cred, _, err := cfg.credential(nil)
+	c.Assert(err, check.IsNil)
+	c.Check(cred.(*cachedCredential).TokenCredential, check.FitsTypeOf, &azidentity.ClientSecretCredential{})
+}
+
+type countingCredential struct {
+	calls     int
+	expiresIn time.Duration
+}
+
+func (cc *countingCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	cc.calls++
+	return azcore.AccessToken{Token: fmt.Sprintf("token%d", cc.calls), ExpiresOn: time.Now().Add(cc.expiresIn)}, nil
+}
+
+func (*AzureInstanceSetSuite) TestCachedCredential(c *check.C) {
+	inner := &countingCredential{expiresIn: time.Hour}
+	cred := &cachedCredential{TokenCredential: inner}
+	getToken := func(scope string) string {
+		token, err := cred.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: []string{scope}})
+		c.Assert(err, check.IsNil)
+		return token.Token
+	}
+	c.Check(getToken("https://management.azure.com//.default"), check.Equals, "token1")
+	c.Check(getToken("https://management.azure.com//.default"), check.Equals, "token1")
+	c.Check(inner.calls, check.Equals, 1)
+
+	// Tokens are cached per scope.
+	c.Check(getToken("https://storage.azure.com/.default"), check.Equals, "token2")
+	c.Check(inner.calls, check.Equals, 2)
+
+	// Token is about to expire: get a new one.
+	inner.expiresIn = time.Minute
+	cred.tokens = nil
+	c.Check(getToken("https://management.azure.com//.default"), check.Equals, "token3")
+	c.Check(getToken("https://management.azure.com//.default"), check.Equals, "token4")
+	c.Check(inner.calls, check.Equals, 4)
+}
+
+func (*AzureInstanceSetSuite) TestBootstrap(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	groups := &ResourceGroupsClientStub{}
+	nsgs := &SecurityGroupsClientStub{}
+	ap.groupsClient = groups
+	ap.nsgClient = nsgs
+	ap.azconfig.ResourceGroup = "rg"
+	ap.azconfig.Location = "westus2"
+	ap.azconfig.NetworkSecurityGroup = "compute-nsg"
+
+	// Without Bootstrap, a missing security group is an error.
+	_, err = ap.setupSecurityGroup()
+	c.Check(err, check.ErrorMatches, `(?s)error setting up network security group "compute-nsg": .*not found.*`)
+	c.Check(nsgs.nsgs, check.HasLen, 0)
+
+	ap.azconfig.Bootstrap = true
+	c.Check(ap.setupResourceGroup(), check.IsNil)
+	c.Check(*groups.groups["rg"].Location, check.Equals, "westus2")
+	// Existing resource group is left alone.
+	groups.groups["rg"] = armresources.ResourceGroup{Location: to.Ptr("eastus")}
+	c.Check(ap.setupResourceGroup(), check.IsNil)
+	c.Check(*groups.groups["rg"].Location, check.Equals, "eastus")
+
+	c.Check(ap.setupBlobContainer(), check.IsNil)
+	c.Check(ap.blobcont.(*BlobContainerStub).created, check.Equals, true)
+	c.Check(ap.setupBlobContainer(), check.IsNil)
+
+	ap.nsgID, err = ap.setupSecurityGroup()
+	c.Check(err, check.IsNil)
+	c.Check(ap.nsgID, check.Equals, "/subscriptions/zzzzz/resourceGroups/rg/providers/Microsoft.Network/networkSecurityGroups/compute-nsg")
+	c.Check(*nsgs.nsgs["compute-nsg"].Location, check.Equals, "westus2")
+
+	// Existing security group is used as is.
+	nsgs.nsgs["compute-nsg"] = armnetwork.SecurityGroup{ID: to.Ptr("existing-nsg-id")}
+	ap.nsgID, err = ap.setupSecurityGroup()
+	c.Check(err, check.IsNil)
+	c.Check(ap.nsgID, check.Equals, "existing-nsg-id")
+
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, nil, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*inst.(*azureInstance).nic.Properties.NetworkSecurityGroup.ID, check.Equals, "existing-nsg-id")
+}
+
+func (*AzureInstanceSetSuite) TestNetworkSecurityGroup(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	nsgs := &SecurityGroupsClientStub{nsgs: map[string]armnetwork.SecurityGroup{
+		"compute-nsg": {ID: to.Ptr("/subscriptions/zzzzz/resourceGroups/rg/providers/Microsoft.Network/networkSecurityGroups/compute-nsg")},
+	}}
+	ap.nsgClient = nsgs
+	ap.azconfig.ResourceGroup = "rg"
+
+	// Without NetworkSecurityGroup, NICs have no security group.
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, nil, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(inst.(*azureInstance).nic.Properties.NetworkSecurityGroup, check.IsNil)
+
+	// Name of a security group in ResourceGroup.
+	ap.azconfig.NetworkSecurityGroup = "compute-nsg"
+	ap.nsgID, err = ap.setupSecurityGroup()
+	c.Assert(err, check.IsNil)
+	inst, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"x": "1"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*inst.(*azureInstance).nic.Properties.NetworkSecurityGroup.ID, check.Equals, "/subscriptions/zzzzz/resourceGroups/rg/providers/Microsoft.Network/networkSecurityGroups/compute-nsg")
+
+	// Resource ID of a security group in a different resource
+	// group is used without looking it up.
+	otherID := "/subscriptions/zzzzz/resourceGroups/netrg/providers/Microsoft.Network/networkSecurityGroups/other-nsg"
+	ap.azconfig.NetworkSecurityGroup = otherID
+	ap.nsgClient = nil
+	ap.nsgID, err = ap.setupSecurityGroup()
+	c.Assert(err, check.IsNil)
+	c.Check(ap.nsgID, check.Equals, otherID)
+	inst, err = ap.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"x": "2"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*inst.(*azureInstance).nic.Properties.NetworkSecurityGroup.ID, check.Equals, otherID)
+}
+
+func (*AzureInstanceSetSuite) TestHibernate(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	stub := ap.vmClient.(*VirtualMachinesClientStub)
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"TestTagName": "hibernate"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	hi, ok := inst.(cloud.InstanceWithHibernation)
+	c.Assert(ok, check.Equals, true)
+
+	c.Check(hi.Stop(), check.IsNil)
+	c.Check(stub.deallocated, check.DeepEquals, []string{string(inst.ID())})
+	c.Check(hi.Start(), check.IsNil)
+	c.Check(stub.started, check.DeepEquals, []string{string(inst.ID())})
+	c.Check(inst.Tags()["TestTagName"], check.Equals, "hibernate")
+	c.Check(inst.Address(), check.Not(check.Equals), "")
+
+	// Same safety checks as Destroy.
+	ap.azconfig.DryRunDeletes = true
+	c.Check(hi.Stop(), check.ErrorMatches, `.*DryRunDeletes.*`)
+	c.Check(stub.deallocated, check.HasLen, 1)
+}
+
+func (*AzureInstanceSetSuite) TestScaleSets(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	ap.azconfig.ScaleSets = true
+	c.Check(ap.checkScaleSetsConfig(), check.IsNil)
+	azss := newAzureScaleSetInstanceSet(ap)
+	stub := ap.ssClient.(*ScaleSetsClientStub)
+	pk, _ := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+
+	// Concurrent Create calls for the same instance type use
+	// the same scale set.
+	var wg sync.WaitGroup
+	insts := make([]cloud.Instance, 4)
+	for i := range insts {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inst, err := azss.Create(cluster.InstanceTypes["tiny"], img, map[string]string{"TestTagName": fmt.Sprintf("inst%d", i)}, cloud.InitCommand(fmt.Sprintf("echo %d", i)), pk)
+			c.Check(err, check.IsNil)
+			insts[i] = inst
+		}()
+	}
+	wg.Wait()
+	c.Check(stub.sets, check.HasLen, 1)
+	c.Check(stub.commands, check.HasLen, 4)
+	c.Check(stub.scaleOps <= 4, check.Equals, true)
+	seen := map[cloud.InstanceID]bool{}
+	for i, inst := range insts {
+		c.Assert(inst, check.NotNil)
+		c.Check(inst.Tags()["TestTagName"], check.Equals, fmt.Sprintf("inst%d", i))
+		c.Check(inst.ProviderType(), check.Equals, "Standard_D1_v2")
+		c.Check(inst.Address(), check.Matches, `192\.168\.6\.\d+`)
+		seen[inst.ID()] = true
+	}
+	c.Check(seen, check.HasLen, 4)
+	for _, set := range stub.sets {
+		c.Check(*set.SKU.Capacity, check.Equals, int64(4))
+		c.Check(set.Properties.VirtualMachineProfile.OSProfile.LinuxConfiguration.SSH, check.NotNil)
+		c.Check(set.Properties.VirtualMachineProfile.Priority, check.IsNil)
+	}
+
+	// Preemptible instance type uses a different scale set.
+	_, err = azss.Create(cluster.InstanceTypes["tinyp"], img, nil, "echo spot", pk)
+	c.Assert(err, check.IsNil)
+	c.Check(stub.sets, check.HasLen, 2)
+	c.Check(*stub.sets[azss.scaleSetName(cluster.InstanceTypes["tinyp"], img, pk)].Properties.VirtualMachineProfile.Priority, check.Equals, armcompute.VirtualMachinePriorityTypesSpot)
+
+	// A VM that was added to a scale set but never assigned to
+	// a Create call is deleted by Instances().
+	name := azss.scaleSetName(cluster.InstanceTypes["tiny"], img, pk)
+	c.Assert(stub.setCapacity(context.Background(), "", name, 5), check.IsNil)
+	orphan := *stub.vms[name][4].Name
+	list, err := azss.Instances(nil)
+	c.Assert(err, check.IsNil)
+	c.Check(list, check.HasLen, 5)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		stub.mtx.Lock()
+		n := len(stub.deleted)
+		stub.mtx.Unlock()
+		if n > 0 {
+			break
+		}
+	}
+	c.Check(stub.deleted, check.DeepEquals, []string{orphan})
+
+	// Destroy removes the VM from the scale set.
+	c.Assert(insts[0].Destroy(), check.IsNil)
+	c.Check(stub.deleted, check.DeepEquals, []string{orphan, insts[0].String()})
+	list, err = azss.Instances(nil)
+	c.Assert(err, check.IsNil)
+	c.Check(list, check.HasLen, 4)
+}
+
+func (*AzureInstanceSetSuite) TestEvents(c *check.C) {
+	ap, _, _, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	c.Check(ap.Events(), check.IsNil)
+
+	c.Check(azureEventQueue{}.check(), check.IsNil)
+	c.Check(azureEventQueue{StorageAccount: "acct", QueueName: "events"}.check(), check.IsNil)
+	c.Check(azureEventQueue{QueueName: "events"}.check(), check.ErrorMatches, `invalid configuration: .*`)
+	c.Check(azureEventQueue{StorageAccount: "acct"}.check(), check.ErrorMatches, `invalid configuration: .*`)
+
+	vmID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/" + testNamePrefix + "abc"
+	ssVMID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/" + testNamePrefix + "ss/virtualMachines/3"
+	otherVMID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/compute-other-abc"
+	nicID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/" + testNamePrefix + "abc-nic"
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	eventGrid := func(subject, eventType, op string) string {
+		return fmt.Sprintf(`{"subject":%q,"eventType":%q,"eventTime":%q,"data":{"operationName":%q}}`, subject, eventType, t0.Format(time.RFC3339), op)
+	}
+	cloudEvent := func(subject, eventType, op string) string {
+		return fmt.Sprintf(`{"subject":%q,"type":%q,"time":%q,"data":{"operationName":%q}}`, subject, eventType, t0.Format(time.RFC3339), op)
+	}
+
+	for _, trial := range []struct {
+		msg    string
+		expect []cloud.InstanceEvent
+	}{
+		{eventGrid(vmID, "Microsoft.Resources.ResourceWriteSuccess", "Microsoft.Compute/virtualMachines/write"),
+			[]cloud.InstanceEvent{{InstanceID: cloud.InstanceID(vmID), Type: cloud.InstanceUpdated, Time: t0}}},
+		{cloudEvent(vmID, "Microsoft.Resources.ResourceDeleteSuccess", "Microsoft.Compute/virtualMachines/delete"),
+			[]cloud.InstanceEvent{{InstanceID: cloud.InstanceID(vmID), Type: cloud.InstanceDestroyed, Time: t0}}},
+		{eventGrid(vmID, "Microsoft.Resources.ResourceActionSuccess", "Microsoft.Compute/virtualMachines/deallocate/action"),
+			[]cloud.InstanceEvent{{InstanceID: cloud.InstanceID(vmID), Type: cloud.InstanceStopped, Time: t0}}},
+		{eventGrid(ssVMID, "Microsoft.Resources.ResourceActionSuccess", "Microsoft.Compute/virtualMachineScaleSets/virtualMachines/start/action"),
+			[]cloud.InstanceEvent{{InstanceID: cloud.InstanceID(ssVMID), Type: cloud.InstanceStarted, Time: t0}}},
+		// Base64-encoded array of events.
+		{base64.StdEncoding.EncodeToString([]byte("[" +
+			eventGrid(vmID, "Microsoft.Resources.ResourceWriteSuccess", "Microsoft.Compute/virtualMachines/write") + "," +
+			eventGrid(vmID, "Microsoft.Resources.ResourceDeleteSuccess", "Microsoft.Compute/virtualMachines/delete") + "]")),
+			[]cloud.InstanceEvent{
+				{InstanceID: cloud.InstanceID(vmID), Type: cloud.InstanceUpdated, Time: t0},
+				{InstanceID: cloud.InstanceID(vmID), Type: cloud.InstanceDestroyed, Time: t0},
+			}},
+		// Ignored: actions that don't change the VM, other
+		// dispatchers' VMs, other resources, failures, and
+		// garbage.
+		{eventGrid(vmID, "Microsoft.Resources.ResourceActionSuccess", "Microsoft.Compute/virtualMachines/runCommand/action"), nil},
+		{eventGrid(otherVMID, "Microsoft.Resources.ResourceDeleteSuccess", "Microsoft.Compute/virtualMachines/delete"), nil},
+		{eventGrid(nicID, "Microsoft.Resources.ResourceWriteSuccess", "Microsoft.Network/networkInterfaces/write"), nil},
+		{eventGrid(vmID, "Microsoft.Resources.ResourceWriteFailure", "Microsoft.Compute/virtualMachines/write"), nil},
+		{"{bogus", nil},
+		{"!!!", nil},
+	} {
+		c.Check(ap.parseEventMessage(trial.msg), check.DeepEquals, trial.expect, check.Commentf("%s", trial.msg))
+	}
+
+	// Events that don't fit in the buffer are dropped, and all
+	// messages are deleted from the queue.
+	stub := &eventQueueStub{}
+	for i := 0; i < 3; i++ {
+		stub.msgs = append(stub.msgs, &azqueue.DequeuedMessage{
+			MessageID:   to.Ptr(fmt.Sprintf("msg%d", i)),
+			MessageText: to.Ptr(eventGrid(vmID, "Microsoft.Resources.ResourceWriteSuccess", "Microsoft.Compute/virtualMachines/write")),
+		})
+	}
+	stub.msgs = append(stub.msgs, &azqueue.DequeuedMessage{MessageID: to.Ptr("msg3"), MessageText: to.Ptr("{bogus")})
+	ap.eventQueue = stub
+	ap.events = make(chan cloud.InstanceEvent, 2)
+	ap.receiveEvents()
+	c.Check(stub.deleted, check.DeepEquals, []string{"msg0", "msg1", "msg2", "msg3"})
+	c.Check(ap.Events(), check.HasLen, 2)
+	c.Check(testutil.ToFloat64(ap.eventMetrics.mEvents.WithLabelValues("updated", "delivered")), check.Equals, float64(2))
+	c.Check(testutil.ToFloat64(ap.eventMetrics.mEvents.WithLabelValues("updated", "dropped")), check.Equals, float64(1))
+	ev := <-ap.Events()
+	c.Check(ev.InstanceID, check.Equals, cloud.InstanceID(vmID))
+	c.Check(ev.Type, check.Equals, cloud.InstanceUpdated)
+}
+
+func (*AzureInstanceSetSuite) TestInstanceState(c *check.C) {
+	if *live != "" {
+		c.Skip("test stub only")
+	}
+	ap, img, cluster, err := GetInstanceSet()
+	c.Assert(err, check.IsNil)
+	stub := ap.vmClient.(*VirtualMachinesClientStub)
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"InstanceSecret": "state1"}, "echo ok", nil)
+	c.Assert(err, check.IsNil)
+	name := *inst.(*azureInstance).vm.Name
+	stub.powerStates = map[string]string{name: "PowerState/running"}
+	stub.instanceViews = 0
+	// Use a real resource ID, which is what events refer to.
+	vm := stub.vms[name]
+	vm.ID = to.Ptr("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/" + name)
+	stub.vms[name] = vm
+
+	getState := func() cloud.InstanceState {
+		insts, err := ap.Instances(nil)
+		c.Assert(err, check.IsNil)
+		c.Assert(insts, check.HasLen, 1)
+		return insts[0].(cloud.InstanceWithState).State()
+	}
+	c.Check(getState(), check.Equals, cloud.InstanceState{Provisioning: cloud.ProvisioningSucceeded, Power: cloud.PowerRunning})
+	c.Check(stub.instanceViews, check.Equals, 1)
+
+	// A running VM's power state is cached...
+	stub.powerStates[name] = "PowerState/deallocated"
+	c.Check(getState().Power, check.Equals, cloud.PowerRunning)
+	c.Check(stub.instanceViews, check.Equals, 1)
+
+	// ...until an event says it changed.
+	ap.eventQueue = &eventQueueStub{msgs: []*azqueue.DequeuedMessage{{
+		MessageID:   to.Ptr("msg0"),
+		MessageText: to.Ptr(fmt.Sprintf(`{"subject":%q,"eventType":"Microsoft.Resources.ResourceActionSuccess","data":{"operationName":"Microsoft.Compute/virtualMachines/deallocate/action"}}`, "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/"+name)),
+	}}}
+	ap.events = make(chan cloud.InstanceEvent, 1)
+	ap.receiveEvents()
+	c.Check(getState().Power, check.Equals, cloud.PowerStopped)
+	c.Check(stub.instanceViews, check.Equals, 2)
+
+	// A VM whose provisioning state is not "Succeeded" is
+	// always checked.
+	vm.Properties.ProvisioningState = to.Ptr("Updating")
+	stub.vms[name] = vm
+	stub.powerStates[name] = "PowerState/starting"
+	c.Check(getState(), check.Equals, cloud.InstanceState{Provisioning: cloud.ProvisioningUpdating, Power: cloud.PowerStarting})
+	c.Check(stub.instanceViews, check.Equals, 3)
+
+	// Hibernation updates the cached power state.
+	vm.Properties.ProvisioningState = to.Ptr("Succeeded")
+	stub.vms[name] = vm
+	insts, err := ap.Instances(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(insts[0].(cloud.InstanceWithHibernation).Stop(), check.IsNil)
+	c.Check(insts[0].(cloud.InstanceWithState).State().Power, check.Equals, cloud.PowerStopped)
+	c.Check(getState().Power, check.Equals, cloud.PowerStopped)
+	c.Check(stub.instanceViews, check.Equals, 4)
+
+	for code, expect := range map[string]cloud.PowerState{
+		"PowerState/starting":      cloud.PowerStarting,
+		"PowerState/running":       cloud.PowerRunning,
+		"PowerState/stopping":      cloud.PowerStopping,
+		"PowerState/deallocating":  cloud.PowerStopping,
+		"PowerState/stopped":       cloud.PowerStopped,
+		"PowerState/deallocated":   cloud.PowerStopped,
+		"PowerState/bogus":         "",
+		"ProvisioningState/failed": "",
+	} {
+		c.Check(powerState([]*armcompute.InstanceViewStatus{{Code: to.Ptr(code)}}), check.Equals, expect, check.Commentf("%s", code))
+	}
+	for azstate, expect := range map[string]cloud.ProvisioningState{
+		"Creating":  cloud.ProvisioningCreating,
+		"Updating":  cloud.ProvisioningUpdating,
+		"Migrating": cloud.ProvisioningUpdating,
+		"Succeeded": cloud.ProvisioningSucceeded,
+		"Failed":    cloud.ProvisioningFailed,
+		"Deleting":  cloud.ProvisioningDeleting,
+		"Canceled":  "",
+	} {
+		c.Check(provisioningState(&azstate), check.Equals, expect, check.Commentf("%s", azstate))
+	}
+
+	// Scale set VMs are listed with their instance views.
+	ssInst := &azureScaleSetInstance{vm: armcompute.VirtualMachineScaleSetVM{
+		Properties: &armcompute.VirtualMachineScaleSetVMProperties{
+			ProvisioningState: to.Ptr("Failed"),
+			InstanceView: &armcompute.VirtualMachineScaleSetVMInstanceView{
+				Statuses: []*armcompute.InstanceViewStatus{{Code: to.Ptr("PowerState/stopped")}},
+			},
+		},
+	}}
+	c.Check(ssInst.State(), check.Equals, cloud.InstanceState{Provisioning: cloud.ProvisioningFailed, Power: cloud.PowerStopped})
+}
@@ -0,0 +1,105 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+type blobReaderWrapper interface {
+	readBlob(ctx context.Context, container, name string) ([]byte, error)
+}
+
+type blobReaderImpl struct {
+	inner *azblob.Client
+}
+
+func (br *blobReaderImpl) readBlob(ctx context.Context, container, name string) ([]byte, error) {
+	resp, err := br.inner.DownloadStream(ctx, container, name, nil)
+	if err != nil {
+		return nil, wrapAzureError(err)
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// checkBootDiagnosticsConfig returns an error if the BootDiagnostics
+// config cannot be used.
+func (az *azureInstanceSet) checkBootDiagnosticsConfig() error {
+	if !az.azconfig.BootDiagnostics {
+		return nil
+	}
+	if az.azconfig.ScaleSets {
+		return errors.New("invalid configuration: cannot use both ScaleSets and BootDiagnostics")
+	}
+	if az.blobReader == nil {
+		return errors.New("invalid configuration: BootDiagnostics requires StorageAccount and BlobContainer")
+	}
+	return nil
+}
+
+// diagnosticsProfile returns the diagnostics profile for new VMs, or
+// nil if BootDiagnostics is disabled.
+func (az *azureInstanceSet) diagnosticsProfile() *armcompute.DiagnosticsProfile {
+	if !az.azconfig.BootDiagnostics {
+		return nil
+	}
+	return &armcompute.DiagnosticsProfile{
+		BootDiagnostics: &armcompute.BootDiagnostics{
+			Enabled:    to.Ptr(true),
+			StorageURI: to.Ptr(az.storageURL(az.azconfig.StorageAccount, "blob")),
+		},
+	}
+}
+
+// ConsoleLog implements cloud.InstanceWithConsole.
+func (ai *azureInstance) ConsoleLog() (string, error) {
+	if !ai.provider.azconfig.BootDiagnostics {
+		return "", cloud.ErrNotImplemented
+	}
+	ai.provider.stopWg.Add(1)
+	defer ai.provider.stopWg.Done()
+
+	view, err := ai.provider.vmClient.instanceView(ai.provider.ctx, ai.provider.azconfig.ResourceGroup, *ai.vm.Name)
+	if err != nil {
+		return "", wrapAzureError(err)
+	}
+	if view.BootDiagnostics == nil || view.BootDiagnostics.SerialConsoleLogBlobURI == nil {
+		return "", cloud.ErrNotImplemented
+	}
+	container, name, err := parseBlobURI(*view.BootDiagnostics.SerialConsoleLogBlobURI)
+	if err != nil {
+		return "", err
+	}
+	buf, err := ai.provider.blobReader.readBlob(ai.provider.ctx, container, name)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// parseBlobURI returns the container and blob names from a blob URI
+// like "https://{account}.blob.core.windows.net/{container}/{blob}".
+func parseBlobURI(uri string) (container, name string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("cannot parse blob URI %q", uri)
+	}
+	return parts[0], parts[1], nil
+}
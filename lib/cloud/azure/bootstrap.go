@@ -0,0 +1,154 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+)
+
+type resourceGroupsClientWrapper interface {
+	get(ctx context.Context, resourceGroupName string) (armresources.ResourceGroup, error)
+	createOrUpdate(ctx context.Context, resourceGroupName string, parameters armresources.ResourceGroup) (armresources.ResourceGroup, error)
+}
+
+type resourceGroupsClientImpl struct {
+	inner *armresources.ResourceGroupsClient
+}
+
+func (cl *resourceGroupsClientImpl) get(ctx context.Context, resourceGroupName string) (armresources.ResourceGroup, error) {
+	resp, err := cl.inner.Get(ctx, resourceGroupName, nil)
+	if err != nil {
+		return armresources.ResourceGroup{}, wrapAzureError(err)
+	}
+	return resp.ResourceGroup, nil
+}
+
+func (cl *resourceGroupsClientImpl) createOrUpdate(ctx context.Context, resourceGroupName string, parameters armresources.ResourceGroup) (armresources.ResourceGroup, error) {
+	resp, err := cl.inner.CreateOrUpdate(ctx, resourceGroupName, parameters, nil)
+	if err != nil {
+		return armresources.ResourceGroup{}, wrapAzureError(err)
+	}
+	return resp.ResourceGroup, nil
+}
+
+type securityGroupsClientWrapper interface {
+	get(ctx context.Context, resourceGroupName string, name string) (armnetwork.SecurityGroup, error)
+	createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armnetwork.SecurityGroup) (armnetwork.SecurityGroup, error)
+}
+
+type securityGroupsClientImpl struct {
+	inner     *armnetwork.SecurityGroupsClient
+	opTimeout time.Duration
+}
+
+func (cl *securityGroupsClientImpl) get(ctx context.Context, resourceGroupName string, name string) (armnetwork.SecurityGroup, error) {
+	resp, err := cl.inner.Get(ctx, resourceGroupName, name, nil)
+	if err != nil {
+		return armnetwork.SecurityGroup{}, wrapAzureError(err)
+	}
+	return resp.SecurityGroup, nil
+}
+
+func (cl *securityGroupsClientImpl) createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armnetwork.SecurityGroup) (armnetwork.SecurityGroup, error) {
+	poller, err := cl.inner.BeginCreateOrUpdate(ctx, resourceGroupName, name, parameters, nil)
+	if err != nil {
+		return armnetwork.SecurityGroup{}, wrapAzureError(err)
+	}
+	resp, err := waitForCompletion(ctx, poller, cl.opTimeout)
+	if err != nil {
+		return armnetwork.SecurityGroup{}, wrapAzureError(err)
+	}
+	return resp.SecurityGroup, nil
+}
+
+// isNotFound returns true if err is an Azure API response with
+// status 404.
+func isNotFound(err error) bool {
+	var rerr *azcore.ResponseError
+	return errors.As(err, &rerr) && rerr.StatusCode == http.StatusNotFound
+}
+
+// setupResourceGroup creates ResourceGroup in Location if it does not
+// already exist. It is only used if Bootstrap is enabled.
+func (az *azureInstanceSet) setupResourceGroup() error {
+	name := az.azconfig.ResourceGroup
+	_, err := az.groupsClient.get(az.ctx, name)
+	if err == nil {
+		return nil
+	} else if !isNotFound(err) {
+		return fmt.Errorf("error looking up resource group %q: %w", name, err)
+	}
+	_, err = az.groupsClient.createOrUpdate(az.ctx, name, armresources.ResourceGroup{
+		Location: &az.azconfig.Location,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating resource group %q: %w", name, err)
+	}
+	az.logger.Infof("created resource group %s", name)
+	return nil
+}
+
+// setupBlobContainer creates BlobContainer if it does not already
+// exist. It is only used if Bootstrap is enabled.
+func (az *azureInstanceSet) setupBlobContainer() error {
+	created, err := az.blobcont.createIfNotExists(az.ctx)
+	if err != nil {
+		return fmt.Errorf("error creating blob container %q: %w", az.azconfig.BlobContainer, err)
+	}
+	if created {
+		az.logger.Infof("created blob container %s", az.azconfig.BlobContainer)
+	}
+	return nil
+}
+
+// setupSecurityGroup looks up (or, if Bootstrap is enabled and it
+// does not exist, creates) the configured network security group and
+// returns its resource ID.
+//
+// If NetworkSecurityGroup is a complete resource ID
+// ("/subscriptions/..."), e.g., for a security group in a different
+// resource group, it is returned as is.
+//
+// A new security group has only the default rules, which allow
+// inbound traffic from the virtual network (including the
+// dispatcher's SSH connections) and deny other inbound traffic.
+func (az *azureInstanceSet) setupSecurityGroup() (string, error) {
+	return az.setupSecurityGroupIn(az.azconfig.NetworkSecurityGroup, az.azconfig.Location)
+}
+
+// setupSecurityGroupIn is like setupSecurityGroup, but uses the
+// given security group name, and creates it (if needed) in the given
+// location. It is used for the NetworkSecurityGroup of each of the
+// configured Locations.
+func (az *azureInstanceSet) setupSecurityGroupIn(name, location string) (string, error) {
+	if strings.HasPrefix(name, "/subscriptions/") {
+		return name, nil
+	}
+	nsg, err := az.nsgClient.get(az.ctx, az.azconfig.ResourceGroup, name)
+	if err != nil && isNotFound(err) && az.azconfig.Bootstrap {
+		nsg, err = az.nsgClient.createOrUpdate(az.ctx, az.azconfig.ResourceGroup, name, armnetwork.SecurityGroup{
+			Location: &location,
+		})
+		if err == nil {
+			az.logger.Infof("created network security group %s", name)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("error setting up network security group %q: %w", name, err)
+	}
+	if nsg.ID == nil {
+		return "", fmt.Errorf("error setting up network security group %q: no ID in API response", name)
+	}
+	return *nsg.ID, nil
+}
@@ -0,0 +1,169 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Azure Resource Manager's documented per-subscription limits.
+const (
+	defaultReadCallsPerHour  = 12000
+	defaultWriteCallsPerHour = 1200
+)
+
+// apiBudget is a token bucket that tracks ARM calls of one class
+// (read or write) against a per-hour limit. When the budget is
+// exhausted, calls are delayed so they are spread out at the rate
+// the budget is replenished, instead of being sent immediately and
+// failing with 429 responses.
+type apiBudget struct {
+	class           string
+	perHour         float64
+	remainingHeader string
+
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+
+	mRemaining prometheus.Gauge
+	mDelayed   prometheus.Counter
+}
+
+func newAPIBudget(class string, perHour int, remainingHeader string, mRemaining *prometheus.GaugeVec, mDelayed *prometheus.CounterVec) *apiBudget {
+	b := &apiBudget{
+		class:           class,
+		perHour:         float64(perHour),
+		remainingHeader: remainingHeader,
+		tokens:          float64(perHour),
+		last:            time.Now(),
+		mRemaining:      mRemaining.WithLabelValues(class),
+		mDelayed:        mDelayed.WithLabelValues(class),
+	}
+	b.mRemaining.Set(b.tokens)
+	return b
+}
+
+// refill adds tokens for the time elapsed since the last refill.
+// Caller must have lock.
+func (b *apiBudget) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Hours() * b.perHour
+	if b.tokens > b.perHour {
+		b.tokens = b.perHour
+	}
+	b.last = now
+}
+
+// wait blocks until the budget allows another call, or ctx is done.
+func (b *apiBudget) wait(ctx context.Context) error {
+	if b.perHour <= 0 {
+		return nil
+	}
+	delayed := false
+	for {
+		b.mtx.Lock()
+		b.refill(time.Now())
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mRemaining.Set(b.tokens)
+			b.mtx.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - b.tokens) / b.perHour * float64(time.Hour))
+		b.mtx.Unlock()
+		if !delayed {
+			delayed = true
+			b.mDelayed.Inc()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// update reduces the remaining budget to match the number of
+// remaining calls reported by the server, if that is lower than
+// our own estimate.
+func (b *apiBudget) update(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	remaining, err := strconv.ParseFloat(resp.Header.Get(b.remainingHeader), 64)
+	if err != nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill(time.Now())
+	if remaining < b.tokens {
+		b.tokens = remaining
+		b.mRemaining.Set(b.tokens)
+	}
+}
+
+// apiBudgets holds the read and write budgets for a subscription.
+type apiBudgets struct {
+	read  *apiBudget
+	write *apiBudget
+}
+
+func newAPIBudgets(readsPerHour, writesPerHour int, reg *prometheus.Registry) *apiBudgets {
+	mRemaining := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "azure_api_budget_remaining",
+		Help:      "Estimated number of Azure Resource Manager calls remaining in the current hourly budget",
+	}, []string{"class"})
+	mDelayed := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "azure_api_budget_delayed_calls_total",
+		Help:      "Number of Azure Resource Manager calls delayed to stay within the hourly budget",
+	}, []string{"class"})
+	if reg != nil {
+		reg.MustRegister(mRemaining)
+		reg.MustRegister(mDelayed)
+	}
+	if readsPerHour == 0 {
+		readsPerHour = defaultReadCallsPerHour
+	}
+	if writesPerHour == 0 {
+		writesPerHour = defaultWriteCallsPerHour
+	}
+	return &apiBudgets{
+		read:  newAPIBudget("read", readsPerHour, "X-Ms-Ratelimit-Remaining-Subscription-Reads", mRemaining, mDelayed),
+		write: newAPIBudget("write", writesPerHour, "X-Ms-Ratelimit-Remaining-Subscription-Writes", mRemaining, mDelayed),
+	}
+}
+
+func (bs *apiBudgets) forMethod(method string) *apiBudget {
+	if method == http.MethodGet || method == http.MethodHead {
+		return bs.read
+	}
+	return bs.write
+}
+
+// Do implements policy.Policy, counting each call against the
+// appropriate budget.
+func (bs *apiBudgets) Do(req *policy.Request) (*http.Response, error) {
+	budget := bs.forMethod(req.Raw().Method)
+	if err := budget.wait(req.Raw().Context()); err != nil {
+		return nil, err
+	}
+	resp, err := req.Next()
+	if err == nil {
+		budget.update(resp)
+	}
+	return resp, err
+}
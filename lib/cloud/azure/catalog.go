@@ -0,0 +1,218 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// Catalog is the azure implementation of the
+// cloud.InstanceTypeCatalog interface. VM sizes are listed using the
+// Resource SKUs API; prices come from the public Azure Retail Prices
+// API.
+var Catalog cloud.InstanceTypeCatalog = azureCatalog{}
+
+// Default endpoint for the Azure Retail Prices API. Variable so tests
+// can point it at a stub server.
+var retailPricesURL = "https://prices.azure.com/api/retail/prices"
+
+type azureCatalog struct {
+	// Stub for testing. If nil, SKUs are retrieved from the
+	// Resource SKUs API.
+	listSkus func(ctx context.Context, azcfg azureInstanceSetConfig) ([]armcompute.ResourceSKU, error)
+}
+
+func (cat azureCatalog) InstanceTypes(ctx context.Context, config json.RawMessage, logger logrus.FieldLogger) ([]arvados.InstanceType, error) {
+	var azcfg azureInstanceSetConfig
+	err := json.Unmarshal(config, &azcfg)
+	if err != nil {
+		return nil, err
+	}
+	if azcfg.Location == "" {
+		return nil, fmt.Errorf("Location must be configured")
+	}
+	listSkus := cat.listSkus
+	if listSkus == nil {
+		listSkus = listResourceSkus
+	}
+	skus, err := listSkus(ctx, azcfg)
+	if err != nil {
+		return nil, fmt.Errorf("error listing resource SKUs: %w", err)
+	}
+	prices, err := getRetailPrices(ctx, http.DefaultClient, retailPricesURL, azcfg.Location)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving retail prices: %w", err)
+	}
+	return instanceTypesFromSkus(skus, prices, azcfg.Location, logger), nil
+}
+
+func listResourceSkus(ctx context.Context, azcfg azureInstanceSetConfig) ([]armcompute.ResourceSKU, error) {
+	credential, env, err := azcfg.credential(nil)
+	if err != nil {
+		return nil, err
+	}
+	client, err := armcompute.NewResourceSKUsClient(azcfg.SubscriptionID, credential, &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{Cloud: cloudConfiguration(env)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return (&resourceSkusClientImpl{client}).listComplete(ctx, "location eq '"+azcfg.Location+"'")
+}
+
+// skuPrices holds the hourly on-demand and spot prices for a VM size.
+// A zero value means the corresponding price is not offered.
+type skuPrices struct {
+	OnDemand float64
+	Spot     float64
+}
+
+type retailPriceItem struct {
+	ArmSkuName    string  `json:"armSkuName"`
+	SkuName       string  `json:"skuName"`
+	ProductName   string  `json:"productName"`
+	RetailPrice   float64 `json:"retailPrice"`
+	UnitOfMeasure string  `json:"unitOfMeasure"`
+	Type          string  `json:"type"`
+}
+
+type retailPricePage struct {
+	Items        []retailPriceItem
+	NextPageLink string
+}
+
+// getRetailPrices returns the hourly Linux VM prices in the given
+// region, keyed by ARM SKU name (e.g., "Standard_D2s_v3").
+func getRetailPrices(ctx context.Context, client *http.Client, baseURL, location string) (map[string]skuPrices, error) {
+	query := url.Values{"$filter": {fmt.Sprintf("serviceName eq 'Virtual Machines' and armRegionName eq '%s' and priceType eq 'Consumption'", location)}}
+	next := baseURL + "?" + query.Encode()
+	prices := map[string]skuPrices{}
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, "GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page retailPricePage
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: %s", next, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: error decoding response: %w", next, err)
+		}
+		for _, item := range page.Items {
+			if item.Type != "Consumption" ||
+				item.UnitOfMeasure != "1 Hour" ||
+				strings.HasSuffix(item.ProductName, " Windows") ||
+				strings.HasSuffix(item.SkuName, " Low Priority") {
+				continue
+			}
+			p := prices[item.ArmSkuName]
+			if strings.HasSuffix(item.SkuName, " Spot") {
+				p.Spot = item.RetailPrice
+			} else {
+				p.OnDemand = item.RetailPrice
+			}
+			prices[item.ArmSkuName] = p
+		}
+		next = page.NextPageLink
+	}
+	return prices, nil
+}
+
+// instanceTypesFromSkus converts the virtual machine SKUs available
+// in the given location to instance types. SKUs without an on-demand
+// price are skipped. A preemptible variant is added for each SKU
+// that has a spot price.
+func instanceTypesFromSkus(skus []armcompute.ResourceSKU, prices map[string]skuPrices, location string, logger logrus.FieldLogger) []arvados.InstanceType {
+	var its []arvados.InstanceType
+	for _, sku := range skus {
+		if sku.Name == nil || sku.ResourceType == nil || *sku.ResourceType != "virtualMachines" {
+			continue
+		}
+		name := *sku.Name
+		if !skuAvailable(sku, location) {
+			logger.Debugf("skipping %s: restricted in location %s", name, location)
+			continue
+		}
+		price, ok := prices[name]
+		if !ok || price.OnDemand == 0 {
+			logger.Debugf("skipping %s: no on-demand price", name)
+			continue
+		}
+		caps := map[string]string{}
+		for _, c := range sku.Capabilities {
+			if c != nil && c.Name != nil && c.Value != nil {
+				caps[*c.Name] = *c.Value
+			}
+		}
+		vcpus, _ := strconv.Atoi(caps["vCPUs"])
+		memGB, _ := strconv.ParseFloat(caps["MemoryGB"], 64)
+		scratchMB, _ := strconv.ParseInt(caps["MaxResourceVolumeMB"], 10, 64)
+		gpus, _ := strconv.Atoi(caps["GPUs"])
+		if vcpus == 0 || memGB == 0 {
+			logger.Debugf("skipping %s: missing vCPUs/MemoryGB capabilities", name)
+			continue
+		}
+		it := arvados.InstanceType{
+			Name:            name,
+			ProviderType:    name,
+			VCPUs:           vcpus,
+			RAM:             arvados.ByteSize(memGB * (1 << 30)),
+			IncludedScratch: arvados.ByteSize(scratchMB << 20),
+			Price:           price.OnDemand,
+		}
+		it.Scratch = it.IncludedScratch
+		// The catalog does not tell us the CUDA driver version or
+		// hardware capability; those have to be filled in by the
+		// operator.
+		it.CUDA.DeviceCount = gpus
+		its = append(its, it)
+		if price.Spot > 0 {
+			it.Name = name + ".preemptible"
+			it.Price = price.Spot
+			it.Preemptible = true
+			its = append(its, it)
+		}
+	}
+	sort.Slice(its, func(i, j int) bool { return its[i].Name < its[j].Name })
+	return its
+}
+
+// skuAvailable returns false if the SKU is restricted (e.g., not
+// offered to this subscription) in the given location.
+func skuAvailable(sku armcompute.ResourceSKU, location string) bool {
+	for _, r := range sku.Restrictions {
+		if r == nil || r.Type == nil || *r.Type != armcompute.ResourceSKURestrictionsTypeLocation {
+			continue
+		}
+		for _, loc := range r.Values {
+			if loc != nil && strings.EqualFold(*loc, location) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&CatalogSuite{})
+
+type CatalogSuite struct{}
+
+func stubSku(name string, caps map[string]string, restrictedIn ...string) armcompute.ResourceSKU {
+	var capabilities []*armcompute.ResourceSKUCapabilities
+	for k, v := range caps {
+		capabilities = append(capabilities, &armcompute.ResourceSKUCapabilities{Name: to.Ptr(k), Value: to.Ptr(v)})
+	}
+	sku := armcompute.ResourceSKU{
+		ResourceType: to.Ptr("virtualMachines"),
+		Name:         to.Ptr(name),
+		Capabilities: capabilities,
+	}
+	if len(restrictedIn) > 0 {
+		var values []*string
+		for i := range restrictedIn {
+			values = append(values, &restrictedIn[i])
+		}
+		sku.Restrictions = []*armcompute.ResourceSKURestrictions{{
+			Type:   to.Ptr(armcompute.ResourceSKURestrictionsTypeLocation),
+			Values: values,
+		}}
+	}
+	return sku
+}
+
+func (*CatalogSuite) TestInstanceTypes(c *check.C) {
+	pages := []retailPricePage{
+		{Items: []retailPriceItem{
+			{ArmSkuName: "Standard_D2s_v3", SkuName: "D2s v3", ProductName: "Virtual Machines DSv3 Series", RetailPrice: 0.096, UnitOfMeasure: "1 Hour", Type: "Consumption"},
+			{ArmSkuName: "Standard_D2s_v3", SkuName: "D2s v3 Spot", ProductName: "Virtual Machines DSv3 Series", RetailPrice: 0.0192, UnitOfMeasure: "1 Hour", Type: "Consumption"},
+			{ArmSkuName: "Standard_D2s_v3", SkuName: "D2s v3", ProductName: "Virtual Machines DSv3 Series Windows", RetailPrice: 0.188, UnitOfMeasure: "1 Hour", Type: "Consumption"},
+		}},
+		{Items: []retailPriceItem{
+			{ArmSkuName: "Standard_NC6s_v3", SkuName: "NC6s v3", ProductName: "Virtual Machines NCSv3 Series", RetailPrice: 3.06, UnitOfMeasure: "1 Hour", Type: "Consumption"},
+			{ArmSkuName: "Standard_NC6s_v3", SkuName: "NC6s v3 Low Priority", ProductName: "Virtual Machines NCSv3 Series", RetailPrice: 0.612, UnitOfMeasure: "1 Hour", Type: "Consumption"},
+			{ArmSkuName: "Standard_E2s_v3", SkuName: "E2s v3", ProductName: "Virtual Machines ESv3 Series", RetailPrice: 0.126, UnitOfMeasure: "1 Hour", Type: "Consumption"},
+		}},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := pages[0]
+		if r.FormValue("page") == "" {
+			c.Check(r.FormValue("$filter"), check.Matches, `.*armRegionName eq 'eastus'.*`)
+			page.NextPageLink = "http://" + r.Host + r.URL.Path + "?page=2"
+		} else {
+			page = pages[1]
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+	defer func(orig string) { retailPricesURL = orig }(retailPricesURL)
+	retailPricesURL = srv.URL
+
+	cat := azureCatalog{listSkus: func(context.Context, azureInstanceSetConfig) ([]armcompute.ResourceSKU, error) {
+		return []armcompute.ResourceSKU{
+			stubSku("Standard_D2s_v3", map[string]string{"vCPUs": "2", "MemoryGB": "8", "MaxResourceVolumeMB": "16384"}),
+			stubSku("Standard_NC6s_v3", map[string]string{"vCPUs": "6", "MemoryGB": "112", "MaxResourceVolumeMB": "344064", "GPUs": "1"}),
+			stubSku("Standard_E2s_v3", map[string]string{"vCPUs": "2", "MemoryGB": "16"}, "eastus"),
+			stubSku("Standard_F2s_v2", map[string]string{"vCPUs": "2", "MemoryGB": "4"}),
+			{ResourceType: to.Ptr("disks"), Name: to.Ptr("Premium_LRS")},
+		}, nil
+	}}
+	its, err := cat.InstanceTypes(context.Background(), json.RawMessage(`{"Location":"eastus"}`), ctxlog.TestLogger(c))
+	c.Assert(err, check.IsNil)
+	c.Check(its, check.DeepEquals, []arvados.InstanceType{
+		{
+			Name:            "Standard_D2s_v3",
+			ProviderType:    "Standard_D2s_v3",
+			VCPUs:           2,
+			RAM:             8 << 30,
+			Scratch:         16 << 30,
+			IncludedScratch: 16 << 30,
+			Price:           0.096,
+		},
+		{
+			Name:            "Standard_D2s_v3.preemptible",
+			ProviderType:    "Standard_D2s_v3",
+			VCPUs:           2,
+			RAM:             8 << 30,
+			Scratch:         16 << 30,
+			IncludedScratch: 16 << 30,
+			Price:           0.0192,
+			Preemptible:     true,
+		},
+		{
+			Name:            "Standard_NC6s_v3",
+			ProviderType:    "Standard_NC6s_v3",
+			VCPUs:           6,
+			RAM:             112 << 30,
+			Scratch:         336 << 30,
+			IncludedScratch: 336 << 30,
+			Price:           3.06,
+			CUDA:            arvados.CUDAFeatures{DeviceCount: 1},
+		},
+	})
+}
+
+func (*CatalogSuite) TestRetailPricesError(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	_, err := getRetailPrices(context.Background(), http.DefaultClient, srv.URL, "eastus")
+	c.Check(err, check.ErrorMatches, `.*503 Service Unavailable`)
+}
@@ -0,0 +1,78 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Suffix of the tag key the dispatcher uses for the secret a node
+// presents to prove its identity (see worker.tagKeyInstanceSecret).
+const tagSuffixInstanceSecret = "InstanceSecret"
+
+// customDataVars are the variables available to CustomDataTemplate.
+type customDataVars struct {
+	// VM name.
+	Name string
+	// Node token: the instance secret assigned by the dispatcher.
+	Token string
+	// Instance tags, as given to Create.
+	Tags cloud.InstanceTags
+	// Dispatcher ID, i.e., the cluster ID.
+	DispatcherID string
+	InstanceType arvados.InstanceType
+	// Init command given to Create.
+	InitCommand string
+	// Default boot script: mounts SharedMount, if configured,
+	// and runs InitCommand.
+	InitScript string
+}
+
+// loadCustomDataTemplate parses CustomDataTemplate, if configured.
+func (az *azureInstanceSet) loadCustomDataTemplate() error {
+	if az.azconfig.CustomDataTemplate == "" {
+		return nil
+	}
+	tmpl, err := template.New("CustomDataTemplate").Option("missingkey=error").Parse(az.azconfig.CustomDataTemplate)
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: CustomDataTemplate: %w", err)
+	}
+	az.customDataTemplate = tmpl
+	return nil
+}
+
+// customData returns the custom data (typically a shell script or
+// cloud-init config) passed to a new VM.
+func (az *azureInstanceSet) customData(name string, instanceType arvados.InstanceType, tags cloud.InstanceTags, initCommand cloud.InitCommand) (string, error) {
+	script := az.initScript(initCommand)
+	if az.customDataTemplate == nil {
+		return script, nil
+	}
+	vars := customDataVars{
+		Name:         name,
+		Tags:         tags,
+		DispatcherID: az.dispatcherID,
+		InstanceType: instanceType,
+		InitCommand:  string(initCommand),
+		InitScript:   script,
+	}
+	for k, v := range tags {
+		if strings.HasSuffix(k, tagSuffixInstanceSecret) {
+			vars.Token = v
+		}
+	}
+	var buf bytes.Buffer
+	err := az.customDataTemplate.Execute(&buf, vars)
+	if err != nil {
+		return "", fmt.Errorf("error rendering CustomDataTemplate: %w", err)
+	}
+	return buf.String(), nil
+}
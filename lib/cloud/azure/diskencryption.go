@@ -0,0 +1,93 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+var diskEncryptionSetIDRegexp = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Compute/diskEncryptionSets/[^/]+$`)
+
+// checkDiskEncryptionConfig returns an error if the
+// DiskEncryptionSetID config cannot be used.
+func (az *azureInstanceSet) checkDiskEncryptionConfig() error {
+	id := az.azconfig.DiskEncryptionSetID
+	if id == "" {
+		return nil
+	}
+	if !diskEncryptionSetIDRegexp.MatchString(id) {
+		return fmt.Errorf("invalid configuration: DiskEncryptionSetID %q is not a disk encryption set resource ID", id)
+	}
+	return nil
+}
+
+// diskEncryptionSet returns the disk encryption set parameters for
+// new managed disks, or nil if DiskEncryptionSetID is not
+// configured.
+func (az *azureInstanceSet) diskEncryptionSet() *armcompute.DiskEncryptionSetParameters {
+	if az.azconfig.DiskEncryptionSetID == "" {
+		return nil
+	}
+	id := az.azconfig.DiskEncryptionSetID
+	return &armcompute.DiskEncryptionSetParameters{ID: &id}
+}
+
+// applyDiskEncryption configures the OS disk and data disks in the
+// given storage profile to use DiskEncryptionSetID. It returns an
+// error if DiskEncryptionSetID is configured and the OS disk is an
+// unmanaged VHD, which cannot use a disk encryption set.
+func (az *azureInstanceSet) applyDiskEncryption(profile *armcompute.StorageProfile) error {
+	des := az.diskEncryptionSet()
+	if des == nil {
+		return nil
+	}
+	if profile.OSDisk != nil {
+		if profile.OSDisk.Vhd != nil {
+			return errors.New("invalid configuration: cannot use DiskEncryptionSetID with unmanaged image URL")
+		}
+		if profile.OSDisk.ManagedDisk == nil {
+			profile.OSDisk.ManagedDisk = &armcompute.ManagedDiskParameters{}
+		}
+		profile.OSDisk.ManagedDisk.DiskEncryptionSet = des
+	}
+	for _, disk := range profile.DataDisks {
+		if disk == nil {
+			continue
+		}
+		if disk.ManagedDisk == nil {
+			disk.ManagedDisk = &armcompute.ManagedDiskParameters{}
+		}
+		disk.ManagedDisk.DiskEncryptionSet = des
+	}
+	return nil
+}
+
+// applyScaleSetDiskEncryption is like applyDiskEncryption, but for a
+// scale set's VM profile.
+func (az *azureInstanceSet) applyScaleSetDiskEncryption(profile *armcompute.VirtualMachineScaleSetStorageProfile) {
+	des := az.diskEncryptionSet()
+	if des == nil {
+		return
+	}
+	if profile.OSDisk != nil {
+		if profile.OSDisk.ManagedDisk == nil {
+			profile.OSDisk.ManagedDisk = &armcompute.VirtualMachineScaleSetManagedDiskParameters{}
+		}
+		profile.OSDisk.ManagedDisk.DiskEncryptionSet = des
+	}
+	for _, disk := range profile.DataDisks {
+		if disk == nil {
+			continue
+		}
+		if disk.ManagedDisk == nil {
+			disk.ManagedDisk = &armcompute.VirtualMachineScaleSetManagedDiskParameters{}
+		}
+		disk.ManagedDisk.DiskEncryptionSet = des
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultEventPollInterval = 5 * time.Second
+	// Maximum number of messages per Get Messages call (the
+	// most Azure allows).
+	eventBatchSize = 32
+	// How long a message we have received stays invisible to
+	// other readers, in case we fail to delete it.
+	eventVisibilityTimeout = time.Minute
+	// Number of events to buffer for a slow consumer before
+	// dropping them.
+	eventBufferSize = 100
+)
+
+// azureEventQueue describes an Azure Storage queue where Event Grid
+// delivers the resource group's events (Microsoft.Resources
+// ResourceWriteSuccess, ResourceDeleteSuccess, and
+// ResourceActionSuccess), so the driver can report changes to VMs
+// within seconds (see cloud.InstanceSetWithEvents).
+//
+// The Event Grid subscription itself is not managed by the driver.
+type azureEventQueue struct {
+	// Storage account in ResourceGroup.
+	StorageAccount string
+	// Queue name. If empty, events are not used.
+	QueueName string
+	// How often to check for new messages. Zero means
+	// defaultEventPollInterval.
+	PollInterval arvados.Duration
+}
+
+func (eq azureEventQueue) enabled() bool {
+	return eq.QueueName != ""
+}
+
+func (eq azureEventQueue) check() error {
+	if eq.enabled() != (eq.StorageAccount != "") {
+		return errors.New("invalid configuration: EventQueue.StorageAccount and EventQueue.QueueName must both be empty or both be set")
+	}
+	return nil
+}
+
+type eventQueueWrapper interface {
+	getMessages(ctx context.Context) ([]*azqueue.DequeuedMessage, error)
+	deleteMessage(ctx context.Context, msg *azqueue.DequeuedMessage) error
+}
+
+type eventQueueImpl struct {
+	queue *azqueue.QueueClient
+}
+
+func (q eventQueueImpl) getMessages(ctx context.Context) ([]*azqueue.DequeuedMessage, error) {
+	resp, err := q.queue.DequeueMessages(ctx, &azqueue.DequeueMessagesOptions{
+		NumberOfMessages:  to.Ptr(int32(eventBatchSize)),
+		VisibilityTimeout: to.Ptr(int32(eventVisibilityTimeout.Seconds())),
+	})
+	if err != nil {
+		return nil, wrapAzureError(err)
+	}
+	return resp.Messages, nil
+}
+
+func (q eventQueueImpl) deleteMessage(ctx context.Context, msg *azqueue.DequeuedMessage) error {
+	if msg.MessageID == nil || msg.PopReceipt == nil {
+		return errors.New("message has no ID or pop receipt")
+	}
+	_, err := q.queue.DeleteMessage(ctx, *msg.MessageID, *msg.PopReceipt, nil)
+	return wrapAzureError(err)
+}
+
+type eventMetrics struct {
+	mEvents *prometheus.CounterVec
+}
+
+func newEventMetrics(reg *prometheus.Registry) *eventMetrics {
+	m := &eventMetrics{
+		mEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "dispatchcloud",
+			Name:      "azure_events_total",
+			Help:      "Number of VM events received from the Event Grid queue, by type, and whether they were delivered to the dispatcher or dropped",
+		}, []string{"type", "result"}),
+	}
+	if reg != nil {
+		reg.MustRegister(m.mEvents)
+	}
+	return m
+}
+
+// Event Grid event, in either the Event Grid or the CloudEvents
+// schema.
+type eventGridEvent struct {
+	Subject   string    `json:"subject"`
+	EventType string    `json:"eventType"`
+	EventTime time.Time `json:"eventTime"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Data      struct {
+		OperationName string `json:"operationName"`
+	} `json:"data"`
+}
+
+// Subject of a VM event: a standalone VM, or a scale set VM. The
+// first submatch is the name of the VM or the scale set, which we
+// check for our namePrefix.
+var vmSubjectRegexp = regexp.MustCompile(`(?i)/providers/Microsoft\.Compute/(?:virtualMachines/([^/]+)|virtualMachineScaleSets/([^/]+)/virtualMachines/[^/]+)$`)
+
+// runEvents receives events from the event queue and sends the ones
+// about our VMs to az.events, until the instance set is stopped.
+// The caller must call az.stopWg.Add(1) first.
+func (az *azureInstanceSet) runEvents() {
+	defer az.stopWg.Done()
+	interval := az.azconfig.EventQueue.PollInterval.Duration()
+	if interval <= 0 {
+		interval = defaultEventPollInterval
+	}
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+	for {
+		az.receiveEvents()
+		select {
+		case <-az.ctx.Done():
+			return
+		case <-tk.C:
+		}
+	}
+}
+
+// receiveEvents gets the available messages from the event queue,
+// sends the resulting events to az.events, and deletes the
+// messages.
+func (az *azureInstanceSet) receiveEvents() {
+	for az.ctx.Err() == nil {
+		msgs, err := az.eventQueue.getMessages(az.ctx)
+		if err != nil {
+			az.logger.WithError(err).Warn("error getting messages from event queue")
+			return
+		}
+		for _, msg := range msgs {
+			if msg == nil {
+				continue
+			}
+			var text string
+			if msg.MessageText != nil {
+				text = *msg.MessageText
+			}
+			for _, ev := range az.parseEventMessage(text) {
+				az.powerStates.forget(string(ev.InstanceID))
+				select {
+				case az.events <- ev:
+					az.eventMetrics.mEvents.WithLabelValues(string(ev.Type), "delivered").Inc()
+				default:
+					az.eventMetrics.mEvents.WithLabelValues(string(ev.Type), "dropped").Inc()
+				}
+			}
+			// Unparseable messages are deleted too, so they
+			// don't keep coming back.
+			if err := az.eventQueue.deleteMessage(az.ctx, msg); err != nil {
+				az.logger.WithError(err).Warn("error deleting message from event queue")
+			}
+		}
+		if len(msgs) < eventBatchSize {
+			return
+		}
+	}
+}
+
+// parseEventMessage returns the events about our VMs in a queue
+// message, which contains one Event Grid event, or an array of
+// them, possibly base64-encoded.
+func (az *azureInstanceSet) parseEventMessage(text string) []cloud.InstanceEvent {
+	buf := []byte(strings.TrimSpace(text))
+	if len(buf) > 0 && buf[0] != '{' && buf[0] != '[' {
+		decoded, err := base64.StdEncoding.DecodeString(string(buf))
+		if err != nil {
+			az.logger.WithError(err).Warnf("cannot decode event queue message %q", text)
+			return nil
+		}
+		buf = bytes.TrimSpace(decoded)
+	}
+	var events []eventGridEvent
+	var err error
+	if len(buf) > 0 && buf[0] == '[' {
+		err = json.Unmarshal(buf, &events)
+	} else {
+		events = make([]eventGridEvent, 1)
+		err = json.Unmarshal(buf, &events[0])
+	}
+	if err != nil {
+		az.logger.WithError(err).Warnf("cannot parse event queue message %q", text)
+		return nil
+	}
+	var ievs []cloud.InstanceEvent
+	for _, ev := range events {
+		if ev, ok := az.instanceEvent(ev); ok {
+			ievs = append(ievs, ev)
+		}
+	}
+	return ievs
+}
+
+// instanceEvent converts an Event Grid event to an InstanceEvent. It
+// returns false if the event is not about one of our VMs, or is not
+// a change we report.
+func (az *azureInstanceSet) instanceEvent(ev eventGridEvent) (cloud.InstanceEvent, bool) {
+	m := vmSubjectRegexp.FindStringSubmatch(ev.Subject)
+	if m == nil || !strings.HasPrefix(m[1]+m[2], az.namePrefix) {
+		return cloud.InstanceEvent{}, false
+	}
+	ievent := cloud.InstanceEvent{
+		InstanceID: cloud.InstanceID(ev.Subject),
+		Time:       ev.EventTime,
+	}
+	eventType := ev.EventType
+	if eventType == "" {
+		eventType, ievent.Time = ev.Type, ev.Time
+	}
+	op := strings.ToLower(ev.Data.OperationName)
+	switch eventType {
+	case "Microsoft.Resources.ResourceWriteSuccess":
+		ievent.Type = cloud.InstanceUpdated
+	case "Microsoft.Resources.ResourceDeleteSuccess":
+		ievent.Type = cloud.InstanceDestroyed
+	case "Microsoft.Resources.ResourceActionSuccess":
+		switch {
+		case strings.HasSuffix(op, "/deallocate/action"), strings.HasSuffix(op, "/poweroff/action"):
+			ievent.Type = cloud.InstanceStopped
+		case strings.HasSuffix(op, "/start/action"), strings.HasSuffix(op, "/restart/action"):
+			ievent.Type = cloud.InstanceStarted
+		default:
+			// E.g., runCommand, which doesn't change
+			// the VM.
+			return cloud.InstanceEvent{}, false
+		}
+	default:
+		return cloud.InstanceEvent{}, false
+	}
+	return ievent, true
+}
+
+// Events implements cloud.InstanceSetWithEvents.
+func (az *azureInstanceSet) Events() <-chan cloud.InstanceEvent {
+	return az.events
+}
@@ -0,0 +1,213 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultGCConcurrency = 4
+	defaultGCInterval    = 5 * time.Minute
+	gcQueueMax           = 1000
+	gcMaxAttempts        = 8
+	gcRetryBaseDelay     = 10 * time.Second
+	gcRetryMaxDelay      = 10 * time.Minute
+)
+
+type gcMetrics struct {
+	mPending *prometheus.GaugeVec
+	mFailed  *prometheus.CounterVec
+	mDropped *prometheus.CounterVec
+}
+
+func newGCMetrics(reg *prometheus.Registry) *gcMetrics {
+	m := &gcMetrics{
+		mPending: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "dispatchcloud",
+			Name:      "azure_gc_pending",
+			Help:      "Number of dangling resources waiting to be deleted (including failed deletions waiting to be retried)",
+		}, []string{"kind"}),
+		mFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "dispatchcloud",
+			Name:      "azure_gc_failures_total",
+			Help:      "Number of failed attempts to delete a dangling resource",
+		}, []string{"kind"}),
+		mDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "dispatchcloud",
+			Name:      "azure_gc_dropped_total",
+			Help:      "Number of dangling resources not deleted because the queue was full or all retries failed",
+		}, []string{"kind"}),
+	}
+	if reg != nil {
+		reg.MustRegister(m.mPending)
+		reg.MustRegister(m.mFailed)
+		reg.MustRegister(m.mDropped)
+	}
+	return m
+}
+
+// azureGCQueue deletes dangling resources of one kind (NICs, blobs,
+// etc.) found by the periodic listings, using a fixed number of
+// worker goroutines.
+//
+// Items are keyed by resource name, so a resource that is found
+// again while it is already queued (or waiting to be retried) is not
+// deleted twice. A failed deletion is retried with exponential
+// backoff, up to gcMaxAttempts times; after that, the resource is
+// dropped until a later listing finds it again. Likewise, if
+// gcQueueMax resources are already pending, new ones are dropped
+// rather than blocking the listing.
+type azureGCQueue struct {
+	kind      string
+	del       func(interface{}) error
+	logger    logrus.FieldLogger
+	baseDelay time.Duration
+	maxDelay  time.Duration
+
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	pending map[string]*gcItem // queued, in progress, or waiting to retry
+	ready   []string
+	closed  bool
+
+	mPending prometheus.Gauge
+	mFailed  prometheus.Counter
+	mDropped prometheus.Counter
+}
+
+type gcItem struct {
+	item     interface{}
+	attempts int
+}
+
+func newAzureGCQueue(kind string, del func(interface{}) error, logger logrus.FieldLogger, m *gcMetrics) *azureGCQueue {
+	q := &azureGCQueue{
+		kind:      kind,
+		del:       del,
+		logger:    logger,
+		baseDelay: gcRetryBaseDelay,
+		maxDelay:  gcRetryMaxDelay,
+		pending:   map[string]*gcItem{},
+		mPending:  m.mPending.WithLabelValues(kind),
+		mFailed:   m.mFailed.WithLabelValues(kind),
+		mDropped:  m.mDropped.WithLabelValues(kind),
+	}
+	q.cond = sync.NewCond(&q.mtx)
+	return q
+}
+
+// start starts the given number of worker goroutines (0 means
+// defaultGCConcurrency).
+func (q *azureGCQueue) start(workers int) {
+	if workers <= 0 {
+		workers = defaultGCConcurrency
+	}
+	for i := 0; i < workers; i++ {
+		go q.runWorker()
+	}
+}
+
+// enqueue adds the named resource to the queue, unless it is already
+// pending.
+func (q *azureGCQueue) enqueue(name string, item interface{}) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.closed || q.pending[name] != nil {
+		return
+	}
+	if len(q.pending) >= gcQueueMax {
+		q.logger.Warnf("not deleting %s %s yet: queue is full", q.kind, name)
+		q.mDropped.Inc()
+		return
+	}
+	q.pending[name] = &gcItem{item: item}
+	q.ready = append(q.ready, name)
+	q.mPending.Set(float64(len(q.pending)))
+	q.cond.Signal()
+}
+
+// close stops the workers. Pending items are discarded.
+func (q *azureGCQueue) close() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *azureGCQueue) runWorker() {
+	for {
+		q.mtx.Lock()
+		for len(q.ready) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mtx.Unlock()
+			return
+		}
+		name := q.ready[0]
+		q.ready = q.ready[1:]
+		it := q.pending[name]
+		q.mtx.Unlock()
+
+		err := q.del(it.item)
+
+		q.mtx.Lock()
+		if err == nil {
+			q.logger.Printf("Deleted %s %s", q.kind, name)
+			delete(q.pending, name)
+		} else if it.attempts++; it.attempts >= gcMaxAttempts {
+			q.logger.WithError(err).Warnf("Error deleting %s %s, giving up after %d attempts", q.kind, name, it.attempts)
+			q.mFailed.Inc()
+			q.mDropped.Inc()
+			delete(q.pending, name)
+		} else {
+			delay := q.baseDelay << uint(it.attempts-1)
+			if delay > q.maxDelay || delay <= 0 {
+				delay = q.maxDelay
+			}
+			q.logger.WithError(err).Warnf("Error deleting %s %s, will retry in %s", q.kind, name, delay)
+			q.mFailed.Inc()
+			time.AfterFunc(delay, func() {
+				q.mtx.Lock()
+				defer q.mtx.Unlock()
+				if !q.closed {
+					q.ready = append(q.ready, name)
+					q.cond.Signal()
+				}
+			})
+		}
+		q.mPending.Set(float64(len(q.pending)))
+		q.mtx.Unlock()
+	}
+}
+
+// setupGCQueues creates (but does not start) the queues used to
+// delete dangling NICs, blobs, disks, and public IPs.
+func (az *azureInstanceSet) setupGCQueues(reg *prometheus.Registry) {
+	m := newGCMetrics(reg)
+	az.nicGC = newAzureGCQueue("NIC", func(item interface{}) error {
+		return az.destroyNic(context.Background(), item.(armnetwork.Interface))
+	}, az.logger, m)
+	az.blobGC = newAzureGCQueue("blob", func(item interface{}) error {
+		return az.destroyBlob(item.(string))
+	}, az.logger, m)
+	az.diskGC = newAzureGCQueue("disk", func(item interface{}) error {
+		return az.destroyDisk(item.(armcompute.Disk))
+	}, az.logger, m)
+	az.publicIPGC = newAzureGCQueue("public IP", func(item interface{}) error {
+		return az.destroyPublicIP(context.Background(), item.(armnetwork.PublicIPAddress))
+	}, az.logger, m)
+}
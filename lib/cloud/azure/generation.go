@@ -0,0 +1,124 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"strconv"
+	"sync"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Tag recording the generation a VM was created with. See
+	// SetGeneration.
+	tagGeneration = "generation"
+
+	// Tag marking a VM as outdated ("true") when SetGeneration is
+	// called with a different generation. The value is "false"
+	// if the VM's generation has since become current again
+	// (e.g., after a rollback).
+	tagOutdated = "outdated"
+)
+
+// azureGenerations tracks the current generation, and the number of
+// VMs in each generation as of the last Instances() call.
+type azureGenerations struct {
+	mtx     sync.Mutex
+	current string
+	mCount  *prometheus.GaugeVec
+}
+
+func newAzureGenerations(reg *prometheus.Registry) *azureGenerations {
+	mCount := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "azure_instances_by_generation",
+		Help:      "Number of VMs created from each generation (image and configuration), as of the last instance list",
+	}, []string{"generation", "outdated"})
+	if reg != nil {
+		reg.MustRegister(mCount)
+	}
+	return &azureGenerations{mCount: mCount}
+}
+
+func (g *azureGenerations) get() string {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.current
+}
+
+func (g *azureGenerations) set(generation string) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.current = generation
+}
+
+// update replaces the per-generation gauges with counts from the
+// given instance list.
+func (g *azureGenerations) update(instances []cloud.Instance) map[string]int {
+	counts := map[string]int{}
+	type key struct {
+		generation string
+		outdated   bool
+	}
+	gauges := map[key]int{}
+	for _, inst := range instances {
+		ai := inst.(*azureInstance)
+		counts[ai.Generation()]++
+		gauges[key{ai.Generation(), ai.Outdated()}]++
+	}
+	g.mCount.Reset()
+	for k, n := range gauges {
+		g.mCount.WithLabelValues(k.generation, strconv.FormatBool(k.outdated)).Set(float64(n))
+	}
+	return counts
+}
+
+// SetGeneration implements cloud.InstanceSetWithGenerations.
+//
+// VMs created after this call are tagged with the given generation.
+// Existing VMs from other generations are tagged as outdated, so the
+// caller can drain and replace them at its own pace. An error
+// tagging one VM does not prevent the others from being tagged; the
+// first such error is returned.
+func (az *azureInstanceSet) SetGeneration(generation string) (map[string]int, error) {
+	az.generations.set(generation)
+	instances, err := az.Instances(nil)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, inst := range instances {
+		ai := inst.(*azureInstance)
+		outdated := ai.Generation() != generation
+		if outdated == ai.Outdated() {
+			continue
+		}
+		err := ai.SetTags(cloud.InstanceTags{tagOutdated: strconv.FormatBool(outdated)})
+		if err != nil {
+			az.logger.WithError(err).Warnf("error tagging VM %s as outdated=%v", *ai.vm.Name, outdated)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return az.generations.update(instances), firstErr
+}
+
+// Generation implements cloud.InstanceWithGeneration.
+func (ai *azureInstance) Generation() string {
+	if gen := ai.vm.Tags[tagGeneration]; gen != nil {
+		return *gen
+	}
+	return ""
+}
+
+// Outdated implements cloud.InstanceWithGeneration.
+func (ai *azureInstance) Outdated() bool {
+	outdated := ai.vm.Tags[tagOutdated]
+	return outdated != nil && *outdated == "true"
+}
@@ -0,0 +1,67 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"errors"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+)
+
+// Stop implements cloud.InstanceWithHibernation. The VM is
+// deallocated, so it stops incurring compute charges, but its OS
+// disk and NIC are kept.
+//
+// If DryRunDeletes is enabled, Stop returns an error without doing
+// anything, so the caller doesn't mistake the VM for a stopped one.
+func (ai *azureInstance) Stop() error {
+	ai.provider.stopWg.Add(1)
+	defer ai.provider.stopWg.Done()
+
+	if err := ai.provider.checkDeletable(*ai.vm.Name, ai.vm.Tags, true); err != nil {
+		return err
+	}
+	if ai.provider.azconfig.DryRunDeletes {
+		ai.provider.logger.Infof("DryRunDeletes is enabled, not stopping VM %s", *ai.vm.Name)
+		return errors.New("not stopping VM: DryRunDeletes is enabled")
+	}
+	err := ai.provider.vmClient.deallocate(ai.provider.ctx, ai.provider.azconfig.ResourceGroup, *ai.vm.Name)
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	ai.provider.powerStates.set(*ai.vm.ID, cloud.PowerStopped)
+	ai.power = cloud.PowerStopped
+	return nil
+}
+
+// Start implements cloud.InstanceWithHibernation.
+func (ai *azureInstance) Start() error {
+	ai.provider.stopWg.Add(1)
+	defer ai.provider.stopWg.Done()
+
+	rg := ai.provider.azconfig.ResourceGroup
+	err := ai.provider.vmClient.start(ai.provider.ctx, rg, *ai.vm.Name)
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	vm, err := ai.provider.vmClient.get(ai.provider.ctx, rg, *ai.vm.Name)
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	ai.vm = vm
+	ai.provider.powerStates.set(*ai.vm.ID, cloud.PowerRunning)
+	ai.power = cloud.PowerRunning
+	// The private address doesn't change, but refresh the NIC
+	// anyway in case a dynamic public IP address was released
+	// while the VM was deallocated.
+	if ai.nic.Name != nil {
+		nic, err := ai.provider.netClient.get(ai.provider.ctx, rg, *ai.nic.Name)
+		if err != nil {
+			return wrapAzureError(err)
+		}
+		ai.nic = nic
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+// How long to cache the list of dedicated hosts in HostGroup before
+// listing them again (to notice hosts being added or removed).
+const hostListTTL = 5 * time.Minute
+
+// Instance tag indicating the dedicated host a VM was placed on.
+const tagDedicatedHost = "dedicated-host"
+
+// Error codes returned by the compute API when a VM doesn't fit on
+// the requested dedicated host.
+var hostCapacityRe = regexp.MustCompile(`(?i)^(AllocationFailed|OverconstrainedAllocationRequest|ZonalAllocationFailed|DedicatedHostCapacity.*|.*InsufficientCapacity)$`)
+
+// azureHostCapacityError is returned by Create when the dedicated
+// host chosen for a new VM doesn't have room for it. It is reported
+// as a quota error, so the dispatcher waits for running instances to
+// shut down before trying again.
+type azureHostCapacityError struct {
+	error
+}
+
+func (*azureHostCapacityError) IsQuotaError() bool { return true }
+
+type dedicatedHostsClientWrapper interface {
+	listByHostGroup(ctx context.Context, resourceGroupName string, hostGroupName string) ([]armcompute.DedicatedHost, error)
+}
+
+type dedicatedHostsClientImpl struct {
+	inner *armcompute.DedicatedHostsClient
+}
+
+func (cl *dedicatedHostsClientImpl) listByHostGroup(ctx context.Context, resourceGroupName string, hostGroupName string) ([]armcompute.DedicatedHost, error) {
+	return listAll[armcompute.DedicatedHost](ctx, cl.inner.NewListByHostGroupPager(resourceGroupName, hostGroupName, nil), func(page armcompute.DedicatedHostsClientListByHostGroupResponse) []*armcompute.DedicatedHost {
+		return page.Value
+	})
+}
+
+// azureHostPicker chooses the dedicated host for each new VM,
+// cycling through the hosts in the configured HostGroup.
+type azureHostPicker struct {
+	mtx    sync.Mutex
+	hosts  []string // resource IDs
+	loaded time.Time
+	next   int
+}
+
+// hostGroupRef returns the resource group and name of the configured
+// HostGroup, which is either the name of a host group in
+// ResourceGroup or a complete resource ID.
+func (az *azureInstanceSet) hostGroupRef() (resourceGroup, name string, err error) {
+	hg := az.azconfig.HostGroup
+	if !strings.HasPrefix(hg, "/subscriptions/") {
+		return az.azconfig.ResourceGroup, hg, nil
+	}
+	// /subscriptions/{sub}/resourceGroups/{rg}/providers/Microsoft.Compute/hostGroups/{name}
+	parts := strings.Split(hg, "/")
+	if len(parts) != 9 || !strings.EqualFold(parts[3], "resourceGroups") || !strings.EqualFold(parts[7], "hostGroups") || parts[4] == "" || parts[8] == "" {
+		return "", "", fmt.Errorf("invalid configuration: HostGroup %q is not a host group resource ID", hg)
+	}
+	return parts[4], parts[8], nil
+}
+
+// checkHostGroupConfig returns an error if the HostGroup config
+// cannot be used.
+func (az *azureInstanceSet) checkHostGroupConfig() error {
+	if az.azconfig.HostGroup == "" {
+		return nil
+	}
+	if az.azconfig.AvailabilitySet.enabled() {
+		return errors.New("invalid configuration: cannot use both HostGroup and AvailabilitySet")
+	}
+	if az.azconfig.ScaleSets {
+		return errors.New("invalid configuration: cannot use both HostGroup and ScaleSets")
+	}
+	if len(az.azconfig.Zones) > 1 {
+		// A host group is in at most one zone.
+		return errors.New("invalid configuration: cannot use HostGroup with more than one zone in Zones")
+	}
+	_, _, err := az.hostGroupRef()
+	return err
+}
+
+// pickHost returns the resource ID of the dedicated host for the next
+// new VM of the given instance type, or "" if VMs are not placed on
+// dedicated hosts.
+func (az *azureInstanceSet) pickHost(instanceType arvados.InstanceType) (string, error) {
+	if az.azconfig.HostGroup == "" {
+		return "", nil
+	}
+	if instanceType.Preemptible {
+		return "", fmt.Errorf("cannot create instance type %q: spot VMs cannot be placed in HostGroup", instanceType.Name)
+	}
+	hp := &az.hostPicker
+	hp.mtx.Lock()
+	defer hp.mtx.Unlock()
+	if len(hp.hosts) == 0 || time.Since(hp.loaded) > hostListTTL {
+		rg, name, err := az.hostGroupRef()
+		if err != nil {
+			return "", err
+		}
+		hosts, err := az.hostsClient.listByHostGroup(az.ctx, rg, name)
+		if err != nil {
+			return "", fmt.Errorf("error listing dedicated hosts in host group %q: %w", name, err)
+		}
+		hp.hosts = hp.hosts[:0]
+		for _, host := range hosts {
+			if host.ID != nil {
+				hp.hosts = append(hp.hosts, *host.ID)
+			}
+		}
+		hp.loaded = time.Now()
+		if len(hp.hosts) == 0 {
+			return "", fmt.Errorf("host group %q has no dedicated hosts", name)
+		}
+	}
+	host := hp.hosts[hp.next%len(hp.hosts)]
+	hp.next++
+	return host, nil
+}
+
+// wrapHostCapacityError returns an azureHostCapacityError if err
+// indicates the VM didn't fit on the given dedicated host, otherwise
+// err.
+func wrapHostCapacityError(err error, host string) error {
+	if code := azureErrorCode(err); code == "" || !hostCapacityRe.MatchString(code) {
+		return err
+	}
+	return &azureHostCapacityError{fmt.Errorf("dedicated host %s is full: %w", host, err)}
+}
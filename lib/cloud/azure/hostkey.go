@@ -0,0 +1,101 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"golang.org/x/crypto/ssh"
+)
+
+// Values for the HostKeyVerification config.
+const (
+	// The dispatcher checks the instance secret written by the
+	// boot script, using its own SSH sessions.
+	hostKeyVerificationSSH = "ssh"
+	// The driver gets the host keys from the VM using Run
+	// Command.
+	hostKeyVerificationRunCommand = "run-command"
+)
+
+// hostKeyScript prints the VM's SSH host public keys. It is run with
+// Run Command, as root.
+const hostKeyScript = `#!/bin/sh
+cat /etc/ssh/ssh_host_*_key.pub
+`
+
+var errHostKeyMismatch = errors.New("SSH host key does not match any of the host keys reported by Run Command")
+
+func (azcfg azureInstanceSetConfig) checkHostKeyVerification() error {
+	switch azcfg.HostKeyVerification {
+	case "", hostKeyVerificationSSH, hostKeyVerificationRunCommand:
+		return nil
+	default:
+		return fmt.Errorf("invalid configuration: unsupported HostKeyVerification %q (supported: %q, %q)", azcfg.HostKeyVerification, hostKeyVerificationSSH, hostKeyVerificationRunCommand)
+	}
+}
+
+// verifyHostKey checks the given key against the host keys of a VM,
+// using the given function to run hostKeyScript on it. If
+// HostKeyVerification is not "run-command", it returns
+// cloud.ErrNotImplemented, so the dispatcher uses its own
+// verification mechanism.
+func (az *azureInstanceSet) verifyHostKey(key ssh.PublicKey, runCommand func(script string) (string, error)) error {
+	if az.azconfig.HostKeyVerification != hostKeyVerificationRunCommand {
+		return cloud.ErrNotImplemented
+	}
+	output, err := runCommand(hostKeyScript)
+	if err != nil {
+		return fmt.Errorf("error getting host keys using Run Command: %w", err)
+	}
+	return matchHostKey(key, output)
+}
+
+// matchHostKey returns nil if the given key is one of the keys in
+// output, which is in authorized_keys format.
+func matchHostKey(key ssh.PublicKey, output string) error {
+	want := key.Marshal()
+	found := false
+	for rest := []byte(output); len(bytes.TrimSpace(rest)) > 0; {
+		var pubkey ssh.PublicKey
+		var err error
+		pubkey, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		found = true
+		if bytes.Equal(pubkey.Marshal(), want) {
+			return nil
+		}
+	}
+	if !found {
+		return fmt.Errorf("no host keys found in Run Command output %q", output)
+	}
+	return errHostKeyMismatch
+}
+
+// runCommandStdout returns the standard output of a Run Command
+// script, which Azure reports in the status message along with the
+// standard error, as "...[stdout]\n{stdout}\n[stderr]\n{stderr}".
+func runCommandStdout(result armcompute.RunCommandResult) string {
+	var msg string
+	for _, status := range result.Value {
+		if status != nil && status.Message != nil {
+			msg += *status.Message
+		}
+	}
+	if _, after, ok := strings.Cut(msg, "[stdout]\n"); ok {
+		msg = after
+	}
+	if before, _, ok := strings.Cut(msg, "\n[stderr]"); ok {
+		msg = before
+	}
+	return msg
+}
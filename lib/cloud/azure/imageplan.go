@@ -0,0 +1,105 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+// azureImagePlan describes the marketplace image and purchase plan
+// for VMs of one instance type, or VMs that use one image.
+type azureImagePlan struct {
+	// Image to use instead of the configured ImageID. Only
+	// applicable to entries for instance types. Empty means use
+	// the configured ImageID.
+	ImageID string
+
+	// Purchase plan of the marketplace image. Publisher,
+	// Product, and Name are required if any plan fields are set.
+	Publisher     string
+	Product       string
+	Name          string
+	PromotionCode string
+}
+
+func (plan azureImagePlan) hasPlan() bool {
+	return plan.Publisher != "" || plan.Product != "" || plan.Name != "" || plan.PromotionCode != ""
+}
+
+// Marketplace image URN, "publisher:offer:sku:version".
+var imageURNRe = regexp.MustCompile(`^([^:/]+):([^:/]+):([^:/]+):([^:/]+)$`)
+
+// checkImagePlansConfig returns an error if the ImagePlans config
+// cannot be used.
+func (az *azureInstanceSet) checkImagePlansConfig() error {
+	for key, plan := range az.azconfig.ImagePlans {
+		if plan.hasPlan() && (plan.Publisher == "" || plan.Product == "" || plan.Name == "") {
+			return fmt.Errorf("invalid configuration: ImagePlans[%q]: Publisher, Product, and Name must all be set", key)
+		}
+		if plan.ImageID != "" && regexp.MustCompile(`^http(s?)://`).MatchString(plan.ImageID) {
+			return fmt.Errorf("invalid configuration: ImagePlans[%q]: cannot use unmanaged image URL %q", key, plan.ImageID)
+		}
+		if !plan.hasPlan() && plan.ImageID == "" {
+			return fmt.Errorf("invalid configuration: ImagePlans[%q]: no ImageID or plan specified", key)
+		}
+	}
+	return nil
+}
+
+// imagePlan returns the image to use for the given instance type, and
+// its purchase plan (nil if the image has none). An ImagePlans entry
+// for the instance type's name takes precedence over an entry for
+// the image.
+func (az *azureInstanceSet) imagePlan(instanceType arvados.InstanceType, imageID cloud.ImageID) (cloud.ImageID, *armcompute.Plan) {
+	plan, ok := az.azconfig.ImagePlans[instanceType.Name]
+	if ok && plan.ImageID != "" {
+		imageID = cloud.ImageID(plan.ImageID)
+	}
+	if !ok || !plan.hasPlan() {
+		plan = az.azconfig.ImagePlans[string(imageID)]
+	}
+	if !plan.hasPlan() {
+		return imageID, nil
+	}
+	cplan := &armcompute.Plan{
+		Publisher: to.Ptr(plan.Publisher),
+		Product:   to.Ptr(plan.Product),
+		Name:      to.Ptr(plan.Name),
+	}
+	if plan.PromotionCode != "" {
+		cplan.PromotionCode = to.Ptr(plan.PromotionCode)
+	}
+	return imageID, cplan
+}
+
+// imageReference returns the image reference for a new VM using the
+// given image, which is either a marketplace image URN
+// ("publisher:offer:sku:version") or a managed/gallery image (see
+// imageResourceID).
+func (az *azureInstanceSet) imageReference(imageID cloud.ImageID) (*armcompute.ImageReference, error) {
+	if m := imageURNRe.FindStringSubmatch(string(imageID)); m != nil {
+		return &armcompute.ImageReference{
+			Publisher: to.Ptr(m[1]),
+			Offer:     to.Ptr(m[2]),
+			SKU:       to.Ptr(m[3]),
+			Version:   to.Ptr(m[4]),
+		}, nil
+	}
+	if strings.Contains(string(imageID), ":") && !strings.HasPrefix(string(imageID), "/subscriptions/") {
+		return nil, fmt.Errorf("invalid image ID %q: expected publisher:offer:sku:version", imageID)
+	}
+	id, err := az.imageResourceID(imageID)
+	if err != nil {
+		return nil, err
+	}
+	return &armcompute.ImageReference{ID: &id}, nil
+}
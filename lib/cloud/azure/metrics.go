@@ -0,0 +1,114 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiMetrics counts Azure API calls and records their latency, by
+// operation (client name and HTTP method, e.g.,
+// "virtualMachines.PUT"), response status (0 for network errors),
+// and whether the response indicated throttling.
+//
+// Each HTTP request is counted separately, so a call that is retried
+// by apiRetryPolicy shows up once per attempt.
+type apiMetrics struct {
+	mCalls    *prometheus.CounterVec
+	mDuration *prometheus.HistogramVec
+}
+
+func newAPIMetrics(reg *prometheus.Registry) *apiMetrics {
+	mCalls := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "azure_api_calls_total",
+		Help:      "Number of Azure API requests, by operation, response status (0 for network errors), and whether the response indicated throttling",
+	}, []string{"operation", "status", "throttled"})
+	mDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "azure_api_call_duration_seconds",
+		Help:      "Latency of Azure API requests, by operation, response status (0 for network errors), and whether the response indicated throttling",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60},
+	}, []string{"operation", "status", "throttled"})
+	if reg != nil {
+		reg.MustRegister(mCalls)
+		reg.MustRegister(mDuration)
+	}
+	return &apiMetrics{
+		mCalls:    mCalls,
+		mDuration: mDuration,
+	}
+}
+
+// pipelinePolicy returns a policy.Policy that instruments requests made by
+// the named ARM client. It must run after the SDK's retry policy, so
+// each attempt is measured separately.
+func (m *apiMetrics) pipelinePolicy(name string) policy.Policy {
+	return policyFunc(func(req *policy.Request) (*http.Response, error) {
+		t0 := time.Now()
+		resp, err := req.Next()
+		m.observe(name, req.Raw(), resp, err, time.Since(t0))
+		return resp, err
+	})
+}
+
+// httpClient returns a copy of client (or http.DefaultClient, if
+// nil) that instruments requests, for use as the transport of the
+// blob and queue storage clients, which don't go through
+// apiPipeline.
+func (m *apiMetrics) httpClient(name string, client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	instrumented := *client
+	instrumented.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		t0 := time.Now()
+		resp, err := transport.RoundTrip(req)
+		m.observe(name, req, resp, err, time.Since(t0))
+		return resp, err
+	})
+	return &instrumented
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (m *apiMetrics) observe(name string, req *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+	status := 0
+	if err == nil && resp != nil {
+		status = resp.StatusCode
+	}
+	labels := prometheus.Labels{
+		"operation": name + "." + req.Method,
+		"status":    strconv.Itoa(status),
+		"throttled": strconv.FormatBool(err == nil && isThrottled(resp)),
+	}
+	m.mCalls.With(labels).Inc()
+	m.mDuration.With(labels).Observe(elapsed.Seconds())
+}
+
+// isThrottled returns true if resp is a throttling response: 429
+// from Resource Manager, or 503 ServerBusy from blob storage.
+func isThrottled(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("X-Ms-Error-Code") == "ServerBusy")
+}
@@ -0,0 +1,127 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"errors"
+	"fmt"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+// Largest OS disk Azure supports, in GiB.
+const maxOSDiskSizeGB = 4095
+
+// azureOSDisk describes the OS disk for VMs of one instance type.
+type azureOSDisk struct {
+	// Managed disk SKU, e.g., "Premium_LRS". If empty, Azure's
+	// default for the VM size is used.
+	SKU string
+
+	// Size of the OS disk in GiB. If zero, the size of the image
+	// is used.
+	SizeGB int
+
+	// Host caching mode: "None", "ReadOnly", or "ReadWrite". If
+	// empty, Azure's default is used.
+	Caching string
+
+	// Enable Write Accelerator (M-series VM sizes only). Requires
+	// SKU "Premium_LRS" and Caching "None" or "ReadOnly".
+	WriteAccelerator bool
+}
+
+// checkOSDisksConfig returns an error if the OSDisks config cannot be
+// used.
+func (az *azureInstanceSet) checkOSDisksConfig() error {
+	for name, disk := range az.azconfig.OSDisks {
+		switch armcompute.StorageAccountTypes(disk.SKU) {
+		case "", armcompute.StorageAccountTypesStandardLRS, armcompute.StorageAccountTypesStandardSSDLRS, armcompute.StorageAccountTypesPremiumLRS:
+		case armcompute.StorageAccountTypesUltraSSDLRS:
+			return fmt.Errorf("invalid configuration: OSDisks[%q]: %s cannot be used for OS disks", name, disk.SKU)
+		default:
+			return fmt.Errorf("invalid configuration: OSDisks[%q]: unsupported SKU %q", name, disk.SKU)
+		}
+		if disk.SizeGB < 0 || disk.SizeGB > maxOSDiskSizeGB {
+			return fmt.Errorf("invalid configuration: OSDisks[%q]: SizeGB %d is out of range (0 to %d)", name, disk.SizeGB, maxOSDiskSizeGB)
+		}
+		switch armcompute.CachingTypes(disk.Caching) {
+		case "", armcompute.CachingTypesNone, armcompute.CachingTypesReadOnly, armcompute.CachingTypesReadWrite:
+		default:
+			return fmt.Errorf("invalid configuration: OSDisks[%q]: unsupported Caching %q (supported: %q, %q, %q)", name, disk.Caching, armcompute.CachingTypesNone, armcompute.CachingTypesReadOnly, armcompute.CachingTypesReadWrite)
+		}
+		if disk.WriteAccelerator {
+			if armcompute.StorageAccountTypes(disk.SKU) != armcompute.StorageAccountTypesPremiumLRS {
+				return fmt.Errorf("invalid configuration: OSDisks[%q]: WriteAccelerator requires SKU %q", name, armcompute.StorageAccountTypesPremiumLRS)
+			}
+			if c := armcompute.CachingTypes(disk.Caching); c != armcompute.CachingTypesNone && c != armcompute.CachingTypesReadOnly {
+				return fmt.Errorf("invalid configuration: OSDisks[%q]: WriteAccelerator requires Caching %q or %q", name, armcompute.CachingTypesNone, armcompute.CachingTypesReadOnly)
+			}
+		}
+	}
+	return nil
+}
+
+// osDisk returns the OS disk config for the given instance type: the
+// OSDisks entry for the type's name if there is one, otherwise the
+// "*" entry, otherwise the zero value (use Azure's defaults).
+func (az *azureInstanceSet) osDisk(instanceType arvados.InstanceType) azureOSDisk {
+	if disk, ok := az.azconfig.OSDisks[instanceType.Name]; ok {
+		return disk
+	}
+	return az.azconfig.OSDisks["*"]
+}
+
+// applyOSDisk sets the OS disk SKU, size, caching mode, and Write
+// Accelerator in the given storage profile. It returns an error if a
+// SKU is configured and the OS disk is an unmanaged VHD, whose
+// performance tier is determined by the storage account instead.
+func (az *azureInstanceSet) applyOSDisk(instanceType arvados.InstanceType, profile *armcompute.StorageProfile) error {
+	disk := az.osDisk(instanceType)
+	if disk.SizeGB > 0 {
+		size := int32(disk.SizeGB)
+		profile.OSDisk.DiskSizeGB = &size
+	}
+	if disk.SKU != "" {
+		if profile.OSDisk.Vhd != nil {
+			return errors.New("invalid configuration: cannot use OSDisks SKU with unmanaged image URL")
+		}
+		if profile.OSDisk.ManagedDisk == nil {
+			profile.OSDisk.ManagedDisk = &armcompute.ManagedDiskParameters{}
+		}
+		profile.OSDisk.ManagedDisk.StorageAccountType = to.Ptr(armcompute.StorageAccountTypes(disk.SKU))
+	}
+	if disk.Caching != "" {
+		profile.OSDisk.Caching = to.Ptr(armcompute.CachingTypes(disk.Caching))
+	}
+	if disk.WriteAccelerator {
+		profile.OSDisk.WriteAcceleratorEnabled = to.Ptr(true)
+	}
+	return nil
+}
+
+// applyScaleSetOSDisk is like applyOSDisk, but for a scale set's VM
+// profile.
+func (az *azureInstanceSet) applyScaleSetOSDisk(instanceType arvados.InstanceType, profile *armcompute.VirtualMachineScaleSetStorageProfile) {
+	disk := az.osDisk(instanceType)
+	if disk.SizeGB > 0 {
+		size := int32(disk.SizeGB)
+		profile.OSDisk.DiskSizeGB = &size
+	}
+	if disk.SKU != "" {
+		if profile.OSDisk.ManagedDisk == nil {
+			profile.OSDisk.ManagedDisk = &armcompute.VirtualMachineScaleSetManagedDiskParameters{}
+		}
+		profile.OSDisk.ManagedDisk.StorageAccountType = to.Ptr(armcompute.StorageAccountTypes(disk.SKU))
+	}
+	if disk.Caching != "" {
+		profile.OSDisk.Caching = to.Ptr(armcompute.CachingTypes(disk.Caching))
+	}
+	if disk.WriteAccelerator {
+		profile.OSDisk.WriteAcceleratorEnabled = to.Ptr(true)
+	}
+}
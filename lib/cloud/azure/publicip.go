@@ -0,0 +1,187 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
+)
+
+type publicIPAddressesClientWrapper interface {
+	createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armnetwork.PublicIPAddress) (armnetwork.PublicIPAddress, error)
+	get(ctx context.Context, resourceGroupName string, name string) (armnetwork.PublicIPAddress, error)
+	delete(ctx context.Context, resourceGroupName string, name string) error
+	listComplete(ctx context.Context, resourceGroupName string) ([]armnetwork.PublicIPAddress, error)
+}
+
+type publicIPAddressesClientImpl struct {
+	inner     *armnetwork.PublicIPAddressesClient
+	opTimeout time.Duration
+}
+
+func (cl *publicIPAddressesClientImpl) createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armnetwork.PublicIPAddress) (armnetwork.PublicIPAddress, error) {
+	poller, err := cl.inner.BeginCreateOrUpdate(ctx, resourceGroupName, name, parameters, nil)
+	if err != nil {
+		return armnetwork.PublicIPAddress{}, wrapAzureError(err)
+	}
+	resp, err := waitForCompletion(ctx, poller, cl.opTimeout)
+	if err != nil {
+		return armnetwork.PublicIPAddress{}, wrapAzureError(err)
+	}
+	return resp.PublicIPAddress, nil
+}
+
+func (cl *publicIPAddressesClientImpl) get(ctx context.Context, resourceGroupName string, name string) (armnetwork.PublicIPAddress, error) {
+	resp, err := cl.inner.Get(ctx, resourceGroupName, name, nil)
+	if err != nil {
+		return armnetwork.PublicIPAddress{}, wrapAzureError(err)
+	}
+	return resp.PublicIPAddress, nil
+}
+
+func (cl *publicIPAddressesClientImpl) delete(ctx context.Context, resourceGroupName string, name string) error {
+	poller, err := cl.inner.BeginDelete(ctx, resourceGroupName, name, nil)
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	_, err = waitForCompletion(ctx, poller, cl.opTimeout)
+	return wrapAzureError(err)
+}
+
+func (cl *publicIPAddressesClientImpl) listComplete(ctx context.Context, resourceGroupName string) ([]armnetwork.PublicIPAddress, error) {
+	return listAll[armnetwork.PublicIPAddress](ctx, cl.inner.NewListPager(resourceGroupName, nil), func(page armnetwork.PublicIPAddressesClientListResponse) []*armnetwork.PublicIPAddress {
+		return page.Value
+	})
+}
+
+// setupPublicIP returns the public IP address resource for the VM
+// with the given name, creating it (in the given location) if needed
+// (it might already exist from an earlier attempt to create the same
+// VM).
+//
+// Standard SKU addresses are statically allocated, so the address
+// is known as soon as the resource is created.
+func (az *azureInstanceSet) setupPublicIP(name, location string, tags map[string]*string, zone string) (armnetwork.PublicIPAddress, error) {
+	pip, err := az.pipClient.get(az.ctx, az.azconfig.ResourceGroup, name+"-ip")
+	if err == nil {
+		az.logger.Infof("reusing public IP %s from earlier attempt to create %s", *pip.Name, name)
+	} else if !isNotFound(err) {
+		return pip, wrapAzureError(err)
+	} else {
+		params := armnetwork.PublicIPAddress{
+			Location: &location,
+			Tags:     tags,
+			SKU:      &armnetwork.PublicIPAddressSKU{Name: to.Ptr(armnetwork.PublicIPAddressSKUNameStandard)},
+			Properties: &armnetwork.PublicIPAddressPropertiesFormat{
+				PublicIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodStatic),
+			},
+		}
+		if zone != "" {
+			params.Zones = []*string{&zone}
+		}
+		pip, err = az.pipClient.createOrUpdate(az.ctx, az.azconfig.ResourceGroup, name+"-ip", params)
+		if err != nil {
+			return pip, wrapAzureError(err)
+		}
+	}
+	az.publicIPsMtx.Lock()
+	defer az.publicIPsMtx.Unlock()
+	if az.publicIPs == nil {
+		az.publicIPs = map[string]string{}
+	}
+	az.publicIPs[strings.ToLower(*pip.ID)] = publicIPAddress(pip)
+	return pip, nil
+}
+
+func (az *azureInstanceSet) cleanupPublicIP(pip armnetwork.PublicIPAddress) {
+	delerr := az.destroyPublicIP(context.Background(), pip)
+	if delerr != nil {
+		az.logger.WithError(delerr).Warnf("Error cleaning up public IP after failed create")
+	}
+}
+
+func (az *azureInstanceSet) destroyPublicIP(ctx context.Context, pip armnetwork.PublicIPAddress) error {
+	if err := az.checkDeletable(*pip.Name, pip.Tags, true); err != nil {
+		return err
+	}
+	if az.dryRun("public IP", *pip.Name) {
+		return nil
+	}
+	return az.pipClient.delete(ctx, az.azconfig.ResourceGroup, *pip.Name)
+}
+
+// managePublicIPs updates the cache of public IP addresses used by
+// azureInstance.Address(). It also garbage collects public IP
+// resources which have "namePrefix", are not associated with a NIC,
+// and have a "created-at" time more than
+// DeleteDanglingResourcesAfter in the past.
+//
+// A public IP can't be deleted while its NIC exists, so after a VM
+// is destroyed, its public IP is deleted some time after its NIC.
+func (az *azureInstanceSet) managePublicIPs() error {
+	az.stopWg.Add(1)
+	defer az.stopWg.Done()
+
+	pips, err := az.pipClient.listComplete(az.ctx, az.azconfig.ResourceGroup)
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	addrs := map[string]string{}
+	timestamp := time.Now()
+	for _, pip := range pips {
+		if pip.Name == nil || !strings.HasPrefix(*pip.Name, az.namePrefix) {
+			continue
+		}
+		if pip.Properties != nil && pip.Properties.IPConfiguration != nil {
+			addrs[strings.ToLower(*pip.ID)] = publicIPAddress(pip)
+			continue
+		}
+		if pip.Tags["created-at"] == nil {
+			continue
+		}
+		createdAt, err := time.Parse(time.RFC3339Nano, *pip.Tags["created-at"])
+		if err == nil && timestamp.Sub(createdAt) > az.azconfig.DeleteDanglingResourcesAfter.Duration() {
+			az.logger.Printf("Will delete %v because it is older than %s", *pip.Name, az.azconfig.DeleteDanglingResourcesAfter)
+			az.publicIPGC.enqueue(*pip.Name, pip)
+		} else {
+			// Might be in the middle of being attached
+			// to a new NIC.
+			addrs[strings.ToLower(*pip.ID)] = publicIPAddress(pip)
+		}
+	}
+	az.publicIPsMtx.Lock()
+	defer az.publicIPsMtx.Unlock()
+	az.publicIPs = addrs
+	return nil
+}
+
+// publicIP returns the public IP address attached to the given NIC,
+// or "" if it has none or the address isn't known.
+func (az *azureInstanceSet) publicIP(nic armnetwork.Interface) string {
+	if iprops := nic.Properties; iprops == nil {
+		return ""
+	} else if ipconfs := iprops.IPConfigurations; len(ipconfs) == 0 || ipconfs[0] == nil {
+		return ""
+	} else if ipconfprops := ipconfs[0].Properties; ipconfprops == nil {
+		return ""
+	} else if pip := ipconfprops.PublicIPAddress; pip == nil || pip.ID == nil {
+		return ""
+	} else {
+		az.publicIPsMtx.Lock()
+		defer az.publicIPsMtx.Unlock()
+		return az.publicIPs[strings.ToLower(*pip.ID)]
+	}
+}
+
+func publicIPAddress(pip armnetwork.PublicIPAddress) string {
+	if pip.Properties == nil || pip.Properties.IPAddress == nil {
+		return ""
+	}
+	return *pip.Properties.IPAddress
+}
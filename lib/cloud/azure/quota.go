@@ -0,0 +1,163 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+type usageClientWrapper interface {
+	listComplete(ctx context.Context, location string) ([]armcompute.Usage, error)
+}
+
+type usageClientImpl struct {
+	inner *armcompute.UsageClient
+}
+
+func (cl *usageClientImpl) listComplete(ctx context.Context, location string) ([]armcompute.Usage, error) {
+	return listAll[armcompute.Usage](ctx, cl.inner.NewListPager(location, nil), func(page armcompute.UsageClientListResponse) []*armcompute.Usage {
+		return page.Value
+	})
+}
+
+type resourceSkusClientWrapper interface {
+	listComplete(ctx context.Context, filter string) ([]armcompute.ResourceSKU, error)
+}
+
+type resourceSkusClientImpl struct {
+	inner *armcompute.ResourceSKUsClient
+}
+
+func (cl *resourceSkusClientImpl) listComplete(ctx context.Context, filter string) ([]armcompute.ResourceSKU, error) {
+	return listAll[armcompute.ResourceSKU](ctx, cl.inner.NewListPager(&armcompute.ResourceSKUsClientListOptions{Filter: &filter}), func(page armcompute.ResourceSKUsClientListResponse) []*armcompute.ResourceSKU {
+		return page.Value
+	})
+}
+
+// Names of the regional vCPU quotas in the compute usage API.
+const (
+	usageRegionalCores    = "cores"
+	usageLowPriorityCores = "lowPriorityCores"
+)
+
+// azureCapacityError is returned by Create when a quota that applies
+// only to some instance types (e.g., the vCPU quota for one VM size
+// family) is exhausted, so the dispatcher can keep creating
+// instances of other types.
+type azureCapacityError struct {
+	error
+}
+
+func (*azureCapacityError) IsCapacityError() bool              { return true }
+func (*azureCapacityError) IsInstanceTypeSpecific() bool       { return true }
+func (*azureCapacityError) IsInstanceQuotaGroupSpecific() bool { return false }
+
+// azureSkuFamilies caches the VM size family (e.g.,
+// "standardDSv3Family") of each VM size, as reported by the Resource
+// SKUs API. The family name matches the name of the family's vCPU
+// quota in the compute usage API.
+type azureSkuFamilies struct {
+	mtx      sync.Mutex
+	families map[string]string // lowercase VM size => family
+}
+
+// skuFamily returns the family of the given VM size, loading the
+// list of SKUs in the configured location if it hasn't been loaded
+// yet.
+func (az *azureInstanceSet) skuFamily(ctx context.Context, providerType string) (string, error) {
+	az.skuFamilies.mtx.Lock()
+	defer az.skuFamilies.mtx.Unlock()
+	if az.skuFamilies.families == nil {
+		skus, err := az.skusClient.listComplete(ctx, "location eq '"+az.azconfig.Location+"'")
+		if err != nil {
+			return "", err
+		}
+		families := map[string]string{}
+		for _, sku := range skus {
+			if sku.ResourceType == nil || *sku.ResourceType != "virtualMachines" || sku.Name == nil || sku.Family == nil {
+				continue
+			}
+			families[strings.ToLower(*sku.Name)] = *sku.Family
+		}
+		az.skuFamilies.families = families
+	}
+	return az.skuFamilies.families[strings.ToLower(providerType)], nil
+}
+
+// probeQuota is called after Create fails with a quota error. It
+// checks the regional and VM size family vCPU usage in the compute
+// usage API, and returns an instance-type-specific capacity error if
+// that explains the failure and other instance types might still fit
+// in the remaining quota. Otherwise it returns qerr.
+func (az *azureInstanceSet) probeQuota(instanceType arvados.InstanceType, qerr error) error {
+	if az.usageClient == nil || az.azconfig.Location == "" {
+		return qerr
+	}
+	family := ""
+	if !instanceType.Preemptible {
+		// Spot VMs only count against the regional
+		// low-priority quota.
+		var err error
+		family, err = az.skuFamily(az.ctx, instanceType.ProviderType)
+		if err != nil {
+			az.logger.WithError(err).Warn("error listing resource SKUs to check quota")
+			return qerr
+		}
+	}
+	usages, err := az.usageClient.listComplete(az.ctx, az.azconfig.Location)
+	if err != nil {
+		az.logger.WithError(err).Warn("error listing compute usage to check quota")
+		return qerr
+	}
+	regionalName := usageRegionalCores
+	if instanceType.Preemptible {
+		regionalName = usageLowPriorityCores
+	}
+	regional, regionalOK := usageRemaining(usages, regionalName)
+	familyRemaining, familyOK := usageRemaining(usages, family)
+	az.logger.WithFields(map[string]interface{}{
+		"InstanceType":      instanceType.Name,
+		"ProviderType":      instanceType.ProviderType,
+		"VCPUs":             instanceType.VCPUs,
+		"Family":            family,
+		"FamilyVCPUsLeft":   familyRemaining,
+		"RegionalVCPUsLeft": regional,
+	}).Info("quota error creating instance")
+	if !regionalOK || regional < 1 {
+		// Nothing else will fit either (or we can't tell).
+		return qerr
+	}
+	if familyOK && familyRemaining < int64(instanceType.VCPUs) {
+		return &azureCapacityError{fmt.Errorf("%s quota has %d vCPUs available, instance type %s needs %d: %w", family, familyRemaining, instanceType.Name, instanceType.VCPUs, qerr)}
+	}
+	if regional < int64(instanceType.VCPUs) {
+		return &azureCapacityError{fmt.Errorf("%s quota has %d vCPUs available, instance type %s needs %d: %w", regionalName, regional, instanceType.Name, instanceType.VCPUs, qerr)}
+	}
+	// The vCPU quotas don't explain the error (it could be a
+	// quota on NICs, public IPs, etc.).
+	return qerr
+}
+
+// usageRemaining returns the unused part of the named quota, and
+// false if the quota is not listed.
+func usageRemaining(usages []armcompute.Usage, name string) (int64, bool) {
+	if name == "" {
+		return 0, false
+	}
+	for _, u := range usages {
+		if u.Name == nil || u.Name.Value == nil || !strings.EqualFold(*u.Name.Value, name) ||
+			u.Limit == nil || u.CurrentValue == nil {
+			continue
+		}
+		return *u.Limit - int64(*u.CurrentValue), true
+	}
+	return 0, false
+}
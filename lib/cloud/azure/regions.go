@@ -0,0 +1,281 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+// Instance tag indicating the location (region) a VM was placed
+// in. If the tags passed to Create already have this tag, and it
+// names one of the configured locations, that location is tried
+// first.
+const tagLocation = "azure-location"
+
+// How long to skip a secondary location for an instance type after
+// creating a VM of that type there failed for lack of capacity.
+const locationExhaustedTTL = 5 * time.Minute
+
+// Error codes returned by the compute API when a region (or a zone
+// in a region) has no capacity for the requested VM size.
+var locationCapacityRe = regexp.MustCompile(`(?i)^(AllocationFailed|OverconstrainedAllocationRequest|ZonalAllocationFailed|SkuNotAvailable|.*InsufficientCapacity)$`)
+
+// Unmanaged (VHD blob) image URL.
+var unmanagedImageRe = regexp.MustCompile(`^http(s?)://`)
+
+// azureLocation is an entry in the Locations config: a secondary
+// region where VMs are created when the primary Location has no
+// capacity, with the network settings and images to use there.
+type azureLocation struct {
+	Location             string
+	Network              string
+	NetworkResourceGroup string
+	Subnets              []string
+	NetworkSecurityGroup string
+	Zones                []string
+
+	// Images to use in this location instead of the image
+	// given to Create (or the instance type's image from
+	// ImagePlans), which is typically a managed image that
+	// only exists in the primary Location. Marketplace images
+	// and shared image gallery images (which can be replicated
+	// to other regions) do not need an entry here.
+	Images map[string]string
+}
+
+// azureRegion is a location where Create can place new VMs: either
+// the primary Location (with Network, Subnet/Subnets,
+// NetworkSecurityGroup, and Zones), or one of the configured
+// Locations.
+type azureRegion struct {
+	location     string
+	networkID    string
+	subnets      []string
+	zones        []string
+	nsgID        string
+	images       map[string]string
+	subnetPicker *azureSubnetPicker
+	primary      bool
+}
+
+// azureRegionPicker tracks which secondary regions recently ran out
+// of capacity for which VM sizes.
+type azureRegionPicker struct {
+	mtx       sync.Mutex
+	exhausted map[string]time.Time // location + "/" + VM size => when to try it again
+}
+
+// primaryRegion returns the region given by the top-level Location
+// and network config.
+func (az *azureInstanceSet) primaryRegion() *azureRegion {
+	return &azureRegion{
+		location:     az.azconfig.Location,
+		networkID:    az.networkID(az.azconfig.NetworkResourceGroup, az.azconfig.Network),
+		subnets:      az.subnets(),
+		zones:        az.azconfig.Zones,
+		nsgID:        az.nsgID,
+		subnetPicker: &az.subnetPicker,
+		primary:      true,
+	}
+}
+
+// checkLocationsConfig returns an error if the Locations config
+// cannot be used.
+func (az *azureInstanceSet) checkLocationsConfig() error {
+	if len(az.azconfig.Locations) == 0 {
+		return nil
+	}
+	if az.azconfig.Location == "" {
+		return errors.New("invalid configuration: Location must be set when Locations is used")
+	}
+	if az.azconfig.ScaleSets {
+		return errors.New("invalid configuration: cannot use both Locations and ScaleSets")
+	}
+	if az.azconfig.AvailabilitySet.enabled() {
+		return errors.New("invalid configuration: cannot use both Locations and AvailabilitySet")
+	}
+	if az.azconfig.HostGroup != "" {
+		return errors.New("invalid configuration: cannot use both Locations and HostGroup")
+	}
+	if az.azconfig.StorageAccount != "" || az.azconfig.BlobContainer != "" {
+		// Unmanaged VHD images and disks live in a storage
+		// account in the primary location.
+		return errors.New("invalid configuration: cannot use both Locations and unmanaged disks (StorageAccount/BlobContainer)")
+	}
+	seen := map[string]bool{strings.ToLower(az.azconfig.Location): true}
+	for i, loc := range az.azconfig.Locations {
+		if loc.Location == "" {
+			return fmt.Errorf("invalid configuration: Locations[%d]: Location must be set", i)
+		}
+		if seen[strings.ToLower(loc.Location)] {
+			return fmt.Errorf("invalid configuration: Locations[%d]: location %q is listed more than once (including the primary Location)", i, loc.Location)
+		}
+		seen[strings.ToLower(loc.Location)] = true
+		if loc.Network == "" {
+			return fmt.Errorf("invalid configuration: Locations[%d] (%s): Network must be set", i, loc.Location)
+		}
+		if len(loc.Subnets) == 0 {
+			return fmt.Errorf("invalid configuration: Locations[%d] (%s): Subnets must be set", i, loc.Location)
+		}
+		for _, subnet := range loc.Subnets {
+			if subnet == "" {
+				return fmt.Errorf("invalid configuration: Locations[%d] (%s): empty string in Subnets", i, loc.Location)
+			}
+		}
+		for _, zone := range loc.Zones {
+			if zone == "" {
+				return fmt.Errorf("invalid configuration: Locations[%d] (%s): empty string in Zones", i, loc.Location)
+			}
+		}
+		for orig, img := range loc.Images {
+			if orig == "" || img == "" {
+				return fmt.Errorf("invalid configuration: Locations[%d] (%s): empty image ID in Images", i, loc.Location)
+			}
+			if unmanagedImageRe.MatchString(orig) || unmanagedImageRe.MatchString(img) {
+				return fmt.Errorf("invalid configuration: Locations[%d] (%s): cannot use unmanaged image URL in Images", i, loc.Location)
+			}
+		}
+	}
+	return nil
+}
+
+// setupRegions sets up the secondary regions given by the Locations
+// config, looking up (or creating) their network security groups.
+func (az *azureInstanceSet) setupRegions() error {
+	az.secondaryRegions = nil
+	for _, loc := range az.azconfig.Locations {
+		region := &azureRegion{
+			location:     loc.Location,
+			networkID:    az.networkID(loc.NetworkResourceGroup, loc.Network),
+			subnets:      loc.Subnets,
+			zones:        loc.Zones,
+			images:       loc.Images,
+			subnetPicker: &azureSubnetPicker{},
+		}
+		if loc.NetworkSecurityGroup != "" {
+			nsgID, err := az.setupSecurityGroupIn(loc.NetworkSecurityGroup, loc.Location)
+			if err != nil {
+				return fmt.Errorf("location %s: %w", loc.Location, err)
+			}
+			region.nsgID = nsgID
+		}
+		az.secondaryRegions = append(az.secondaryRegions, region)
+	}
+	return nil
+}
+
+// regionImage returns the image to use for a new VM of the given
+// instance type in the given region, and its purchase plan (nil if
+// the image has none). It returns an error if the image cannot be
+// used in a secondary region: an unmanaged image URL, or a managed
+// image without an entry in that region's Images.
+func (az *azureInstanceSet) regionImage(region *azureRegion, instanceType arvados.InstanceType, imageID cloud.ImageID) (cloud.ImageID, *armcompute.Plan, error) {
+	imageID, plan := az.imagePlan(instanceType, imageID)
+	if region.primary {
+		return imageID, plan, nil
+	}
+	if img, ok := region.images[string(imageID)]; ok {
+		return cloud.ImageID(img), plan, nil
+	}
+	if unmanagedImageRe.MatchString(string(imageID)) {
+		return "", nil, fmt.Errorf("cannot use unmanaged image URL in location %s", region.location)
+	}
+	if imageURNRe.MatchString(string(imageID)) {
+		return imageID, plan, nil
+	}
+	id, err := az.imageResourceID(imageID)
+	if err != nil {
+		return "", nil, err
+	}
+	if !strings.Contains(strings.ToLower(id), "/galleries/") {
+		return "", nil, fmt.Errorf("managed image %q is not available in location %s: add it to that location's Images, or use a shared image gallery image", imageID, region.location)
+	}
+	return imageID, plan, nil
+}
+
+// pickRegions returns the regions to try, in order, for a new VM of
+// the given instance type: the region named by the tagLocation tag,
+// if any, then the primary region, then the secondary regions in the
+// order they are configured.
+//
+// Secondary regions that recently had no capacity for the instance
+// type are skipped, unless all of them did.
+func (az *azureInstanceSet) pickRegions(instanceType arvados.InstanceType, tags cloud.InstanceTags) []*azureRegion {
+	regions := append([]*azureRegion{az.primaryRegion()}, az.secondaryRegions...)
+	if len(regions) == 1 {
+		return regions
+	}
+	if hint := tags[tagLocation]; hint != "" {
+		for i, region := range regions {
+			if strings.EqualFold(region.location, hint) {
+				regions = append(append([]*azureRegion{region}, regions[:i]...), regions[i+1:]...)
+				break
+			}
+		}
+	}
+	rp := &az.regionPicker
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+	var ok []*azureRegion
+	for _, region := range regions {
+		if t, skip := rp.exhausted[region.location+"/"+instanceType.ProviderType]; !region.primary && skip && time.Now().Before(t) {
+			continue
+		}
+		ok = append(ok, region)
+	}
+	if len(ok) == 0 {
+		return regions
+	}
+	return ok
+}
+
+// regionExhausted checks whether err indicates that the given region
+// has no capacity (or quota, or private IP addresses) for a VM of the
+// given instance type, i.e., Create should try the next region. If
+// so, and the region is a secondary region, it arranges for
+// pickRegions to skip it for that instance type for a while.
+func (az *azureInstanceSet) regionExhausted(region *azureRegion, instanceType arvados.InstanceType, err error) bool {
+	var qerr *azureQuotaError
+	var serr *azureSubnetsExhaustedError
+	if !errors.As(err, &qerr) && !errors.As(err, &serr) && !locationCapacityRe.MatchString(azureErrorCode(err)) {
+		return false
+	}
+	if region.primary {
+		az.logger.WithError(err).Warnf("no capacity for %s in location %s", instanceType.ProviderType, region.location)
+		return true
+	}
+	az.logger.WithError(err).Warnf("no capacity for %s in location %s, skipping it for %v", instanceType.ProviderType, region.location, locationExhaustedTTL)
+	rp := &az.regionPicker
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+	if rp.exhausted == nil {
+		rp.exhausted = map[string]time.Time{}
+	}
+	rp.exhausted[region.location+"/"+instanceType.ProviderType] = time.Now().Add(locationExhaustedTTL)
+	return true
+}
+
+// vmName returns the name to use for a new VM in this region, given
+// the name returned by creationName. VMs in the primary region use
+// that name as is; in other regions, the name is derived from it
+// and the location, so a VM (and NIC) left behind by a failed
+// attempt in one region is not mistaken for a reusable VM in
+// another.
+func (region *azureRegion) vmName(namePrefix, name string) string {
+	if region.primary {
+		return name
+	}
+	return namePrefix + fmt.Sprintf("%x", sha256.Sum256([]byte(name+"\x00"+strings.ToLower(region.location))))[:15]
+}
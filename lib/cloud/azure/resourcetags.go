@@ -0,0 +1,130 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
+)
+
+// Azure limits on resource tags.
+const (
+	maxResourceTags     = 50
+	maxTagNameLength    = 512
+	maxTagValueLength   = 256
+	invalidTagNameChars = "<>%&\\?/"
+)
+
+// The tags passed to Create (which may include attribution tags like
+// a container UUID or workflow name) are applied to the VM's
+// sub-resources as well as the VM itself, so cost reports can be
+// broken down by tag. The NIC and public IP get the tags when they
+// are created; the OS disk is created implicitly with the VM, so it
+// is tagged afterwards. Tagging failures are logged but otherwise
+// ignored, because they don't affect the usability of the VM.
+
+// The ResourceTags config (e.g., cost center or environment) is
+// added to every VM, NIC, public IP, OS disk, and scale set the
+// driver creates. Tags set by the driver or passed to Create take
+// precedence over ResourceTags with the same name.
+
+// checkResourceTagsConfig returns an error if the ResourceTags config
+// cannot be used.
+func (az *azureInstanceSet) checkResourceTagsConfig() error {
+	if len(az.azconfig.ResourceTags) > maxResourceTags {
+		return fmt.Errorf("invalid configuration: ResourceTags has %d tags, Azure allows at most %d", len(az.azconfig.ResourceTags), maxResourceTags)
+	}
+	for k, v := range az.azconfig.ResourceTags {
+		if k == "" || len(k) > maxTagNameLength || strings.ContainsAny(k, invalidTagNameChars) {
+			return fmt.Errorf("invalid configuration: ResourceTags: invalid tag name %q", k)
+		}
+		if len(v) > maxTagValueLength {
+			return fmt.Errorf("invalid configuration: ResourceTags[%q]: value is longer than %d characters", k, maxTagValueLength)
+		}
+	}
+	return nil
+}
+
+// resourceTags returns a new tag map containing the ResourceTags
+// config, to which the caller can add its own tags.
+func (az *azureInstanceSet) resourceTags() map[string]*string {
+	tags := map[string]*string{}
+	for k, v := range az.azconfig.ResourceTags {
+		tags[k] = to.Ptr(v)
+	}
+	return tags
+}
+
+// tagNIC replaces the tags on the given NIC.
+func (az *azureInstanceSet) tagNIC(nic armnetwork.Interface, tags map[string]*string) {
+	if nic.Name == nil {
+		return
+	}
+	err := az.netClient.updateTags(az.ctx, az.azconfig.ResourceGroup, *nic.Name, tags)
+	if err != nil {
+		az.logger.WithError(err).Warnf("error tagging NIC %s", *nic.Name)
+	}
+}
+
+// tagOSDisk replaces the tags on the given VM's OS disk, if it is a
+// managed disk, or the metadata on its vhd blob, if it is an
+// unmanaged disk.
+func (az *azureInstanceSet) tagOSDisk(vm armcompute.VirtualMachine, tags map[string]*string) {
+	if vm.Properties == nil ||
+		vm.Properties.StorageProfile == nil ||
+		vm.Properties.StorageProfile.OSDisk == nil {
+		return
+	}
+	osDisk := vm.Properties.StorageProfile.OSDisk
+	if osDisk.ManagedDisk != nil && osDisk.ManagedDisk.ID != nil {
+		res, err := arm.ParseResourceID(*osDisk.ManagedDisk.ID)
+		if err != nil {
+			az.logger.WithError(err).Warnf("error parsing OS disk ID %q", *osDisk.ManagedDisk.ID)
+			return
+		}
+		err = az.disksClient.updateTags(az.ctx, res.ResourceGroupName, res.Name, tags)
+		if err != nil {
+			az.logger.WithError(err).Warnf("error tagging disk %s", res.Name)
+		}
+	} else if osDisk.Vhd != nil && osDisk.Vhd.URI != nil && az.blobcont != nil {
+		_, name, err := parseBlobURI(*osDisk.Vhd.URI)
+		if err != nil {
+			az.logger.WithError(err).Warnf("error parsing OS disk URI %q", *osDisk.Vhd.URI)
+			return
+		}
+		err = az.blobcont.setMetadata(az.ctx, name, blobMetadata(tags))
+		if err != nil {
+			az.logger.WithError(err).Warnf("error setting metadata on blob %s", name)
+		}
+	}
+}
+
+// blobMetadata converts tags to blob metadata. Metadata names must
+// be valid C# identifiers, so other characters are replaced with
+// "_".
+func blobMetadata(tags map[string]*string) map[string]*string {
+	md := map[string]*string{}
+	for k, v := range tags {
+		if v == nil {
+			continue
+		}
+		k = strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+				return r
+			}
+			return '_'
+		}, k)
+		if k == "" || k[0] >= '0' && k[0] <= '9' {
+			k = "_" + k
+		}
+		md[k] = v
+	}
+	return md
+}
@@ -0,0 +1,139 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultAPIRetryAttempts  = 4
+	defaultAPIRetryBaseDelay = time.Second
+	defaultAPIRetryMaxDelay  = 30 * time.Second
+)
+
+// apiRetryPolicy configures the SDK's retry policy to retry ARM
+// calls that fail with a network error, a throttling response (429),
+// or a transient server error (5xx), with exponential backoff. If
+// the response has a Retry-After header, that delay is used instead
+// -- unless it is longer than maxDelay, in which case the response
+// is returned to the caller right away (wrapAzureError turns it into
+// a cloud.RateLimitError so the dispatcher backs off).
+//
+// Only idempotent methods (GET, HEAD, PUT, DELETE) are retried. ARM
+// PUT requests are create-or-update operations, so they are safe to
+// repeat; POST actions (start, deallocate, run command) are not
+// retried.
+type apiRetryPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	mRetries  *prometheus.CounterVec
+}
+
+func newAPIRetryPolicy(attempts int, baseDelay, maxDelay time.Duration, reg *prometheus.Registry) *apiRetryPolicy {
+	mRetries := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "azure_api_retries_total",
+		Help:      "Number of Azure Resource Manager calls retried after a transient error, by response status (0 for network errors)",
+	}, []string{"status"})
+	if reg != nil {
+		reg.MustRegister(mRetries)
+	}
+	if attempts == 0 {
+		attempts = defaultAPIRetryAttempts
+	}
+	if baseDelay <= 0 {
+		baseDelay = defaultAPIRetryBaseDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultAPIRetryMaxDelay
+	}
+	return &apiRetryPolicy{
+		attempts:  attempts,
+		baseDelay: baseDelay,
+		maxDelay:  maxDelay,
+		mRetries:  mRetries,
+	}
+}
+
+// options returns the SDK retry options.
+func (rp *apiRetryPolicy) options() policy.RetryOptions {
+	return policy.RetryOptions{
+		MaxRetries:    rp.maxRetries(),
+		RetryDelay:    rp.baseDelay,
+		MaxRetryDelay: rp.maxDelay,
+		ShouldRetry:   rp.shouldRetry,
+	}
+}
+
+// maxRetries returns the SDK's MaxRetries value corresponding to
+// the configured number of attempts. In the SDK, 0 means "use the
+// default" and a negative number means "no retries".
+func (rp *apiRetryPolicy) maxRetries() int32 {
+	if rp.attempts <= 1 {
+		return -1
+	}
+	return int32(rp.attempts - 1)
+}
+
+func (rp *apiRetryPolicy) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+type retryStateKey struct{}
+
+// retryState tracks the attempts made for one call, so retries can
+// be counted by the status of the attempt that was retried.
+type retryState struct {
+	attempted bool
+	status    int
+}
+
+// perCallPolicy returns a policy that disables retries for
+// non-idempotent requests, and sets up retry counting. It must run
+// before the SDK's retry policy.
+func (rp *apiRetryPolicy) perCallPolicy() policy.Policy {
+	return policyFunc(func(req *policy.Request) (*http.Response, error) {
+		ctx := context.WithValue(req.Raw().Context(), retryStateKey{}, &retryState{})
+		switch req.Raw().Method {
+		case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		default:
+			ctx = policy.WithRetryOptions(ctx, policy.RetryOptions{MaxRetries: -1})
+		}
+		return req.WithContext(ctx).Next()
+	})
+}
+
+// perAttemptPolicy returns a policy that counts retries. It must run
+// after the SDK's retry policy.
+func (rp *apiRetryPolicy) perAttemptPolicy() policy.Policy {
+	return policyFunc(func(req *policy.Request) (*http.Response, error) {
+		state, _ := req.Raw().Context().Value(retryStateKey{}).(*retryState)
+		if state == nil {
+			return req.Next()
+		}
+		if state.attempted {
+			rp.mRetries.WithLabelValues(strconv.Itoa(state.status)).Inc()
+		}
+		resp, err := req.Next()
+		state.attempted = true
+		state.status = 0
+		if err == nil {
+			state.status = resp.StatusCode
+		}
+		return resp, err
+	})
+}
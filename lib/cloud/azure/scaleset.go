@@ -0,0 +1,710 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
+	"golang.org/x/crypto/ssh"
+)
+
+type scaleSetsClientWrapper interface {
+	createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armcompute.VirtualMachineScaleSet) (armcompute.VirtualMachineScaleSet, error)
+	get(ctx context.Context, resourceGroupName string, name string) (armcompute.VirtualMachineScaleSet, error)
+	list(ctx context.Context, resourceGroupName string) ([]armcompute.VirtualMachineScaleSet, error)
+	setCapacity(ctx context.Context, resourceGroupName string, name string, capacity int64) error
+	deleteInstances(ctx context.Context, resourceGroupName string, name string, instanceIDs []string) error
+	listVMs(ctx context.Context, resourceGroupName string, name string) ([]armcompute.VirtualMachineScaleSetVM, error)
+	updateVM(ctx context.Context, resourceGroupName string, name string, instanceID string, parameters armcompute.VirtualMachineScaleSetVM) (armcompute.VirtualMachineScaleSetVM, error)
+	runCommand(ctx context.Context, resourceGroupName string, name string, instanceID string, script string) (string, error)
+	listNICs(ctx context.Context, resourceGroupName string, name string) ([]armnetwork.Interface, error)
+}
+
+type scaleSetsClientImpl struct {
+	inner     *armcompute.VirtualMachineScaleSetsClient
+	vms       *armcompute.VirtualMachineScaleSetVMsClient
+	nics      *armnetwork.InterfacesClient
+	opTimeout time.Duration
+}
+
+func (cl *scaleSetsClientImpl) createOrUpdate(ctx context.Context, resourceGroupName string, name string, parameters armcompute.VirtualMachineScaleSet) (armcompute.VirtualMachineScaleSet, error) {
+	poller, err := cl.inner.BeginCreateOrUpdate(ctx, resourceGroupName, name, parameters, nil)
+	if err != nil {
+		return armcompute.VirtualMachineScaleSet{}, wrapAzureError(err)
+	}
+	resp, err := waitForCompletion(ctx, poller, cl.opTimeout)
+	if err != nil {
+		return armcompute.VirtualMachineScaleSet{}, wrapAzureError(err)
+	}
+	return resp.VirtualMachineScaleSet, nil
+}
+
+func (cl *scaleSetsClientImpl) get(ctx context.Context, resourceGroupName string, name string) (armcompute.VirtualMachineScaleSet, error) {
+	resp, err := cl.inner.Get(ctx, resourceGroupName, name, nil)
+	if err != nil {
+		return armcompute.VirtualMachineScaleSet{}, wrapAzureError(err)
+	}
+	return resp.VirtualMachineScaleSet, nil
+}
+
+func (cl *scaleSetsClientImpl) list(ctx context.Context, resourceGroupName string) ([]armcompute.VirtualMachineScaleSet, error) {
+	return listAll(ctx, cl.inner.NewListPager(resourceGroupName, nil), func(page armcompute.VirtualMachineScaleSetsClientListResponse) []*armcompute.VirtualMachineScaleSet {
+		return page.Value
+	})
+}
+
+func (cl *scaleSetsClientImpl) setCapacity(ctx context.Context, resourceGroupName string, name string, capacity int64) error {
+	poller, err := cl.inner.BeginUpdate(ctx, resourceGroupName, name, armcompute.VirtualMachineScaleSetUpdate{
+		SKU: &armcompute.SKU{Capacity: &capacity},
+	}, nil)
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	_, err = waitForCompletion(ctx, poller, cl.opTimeout)
+	return wrapAzureError(err)
+}
+
+func (cl *scaleSetsClientImpl) deleteInstances(ctx context.Context, resourceGroupName string, name string, instanceIDs []string) error {
+	var ids []*string
+	for i := range instanceIDs {
+		ids = append(ids, &instanceIDs[i])
+	}
+	poller, err := cl.inner.BeginDeleteInstances(ctx, resourceGroupName, name, armcompute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+		InstanceIDs: ids,
+	}, nil)
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	_, err = waitForCompletion(ctx, poller, cl.opTimeout)
+	return wrapAzureError(err)
+}
+
+func (cl *scaleSetsClientImpl) listVMs(ctx context.Context, resourceGroupName string, name string) ([]armcompute.VirtualMachineScaleSetVM, error) {
+	// Include instance views, so State() can report power
+	// states without a separate call for each VM.
+	opts := &armcompute.VirtualMachineScaleSetVMsClientListOptions{Expand: to.Ptr("instanceView")}
+	return listAll(ctx, cl.vms.NewListPager(resourceGroupName, name, opts), func(page armcompute.VirtualMachineScaleSetVMsClientListResponse) []*armcompute.VirtualMachineScaleSetVM {
+		return page.Value
+	})
+}
+
+func (cl *scaleSetsClientImpl) updateVM(ctx context.Context, resourceGroupName string, name string, instanceID string, parameters armcompute.VirtualMachineScaleSetVM) (armcompute.VirtualMachineScaleSetVM, error) {
+	poller, err := cl.vms.BeginUpdate(ctx, resourceGroupName, name, instanceID, parameters, nil)
+	if err != nil {
+		return armcompute.VirtualMachineScaleSetVM{}, wrapAzureError(err)
+	}
+	resp, err := waitForCompletion(ctx, poller, cl.opTimeout)
+	if err != nil {
+		return armcompute.VirtualMachineScaleSetVM{}, wrapAzureError(err)
+	}
+	return resp.VirtualMachineScaleSetVM, nil
+}
+
+func (cl *scaleSetsClientImpl) runCommand(ctx context.Context, resourceGroupName string, name string, instanceID string, script string) (string, error) {
+	poller, err := cl.vms.BeginRunCommand(ctx, resourceGroupName, name, instanceID, armcompute.RunCommandInput{
+		CommandID: to.Ptr("RunShellScript"),
+		Script:    []*string{&script},
+	}, nil)
+	if err != nil {
+		return "", wrapAzureError(err)
+	}
+	resp, err := waitForCompletion(ctx, poller, cl.opTimeout)
+	if err != nil {
+		return "", wrapAzureError(err)
+	}
+	return runCommandStdout(resp.RunCommandResult), nil
+}
+
+func (cl *scaleSetsClientImpl) listNICs(ctx context.Context, resourceGroupName string, name string) ([]armnetwork.Interface, error) {
+	return listAll(ctx, cl.nics.NewListVirtualMachineScaleSetNetworkInterfacesPager(resourceGroupName, name, nil), func(page armnetwork.InterfacesClientListVirtualMachineScaleSetNetworkInterfacesResponse) []*armnetwork.Interface {
+		return page.Value
+	})
+}
+
+// azureScaleSetInstanceSet is an InstanceSet that creates VMs by
+// scaling out a VM scale set for each combination of VM size,
+// spot/regular priority, image, and public key (see scaleSetKey),
+// instead of creating each VM and NIC individually. Concurrent
+// Create calls for the same scale set are combined into a single
+// scale operation, which greatly reduces the number of ARM API
+// calls needed to start a large number of VMs.
+//
+// Scale set VMs are created without an init command. When a new VM
+// is assigned to a Create call, the init script is run on the VM
+// and the given tags are applied to it. Until then, Instances()
+// does not return it.
+//
+// VMs created individually (e.g., before ScaleSets was enabled) are
+// still returned by Instances(), so they can be drained and
+// destroyed as usual.
+type azureScaleSetInstanceSet struct {
+	*azureInstanceSet
+
+	mtx       sync.Mutex
+	scaleSets map[string]*azureScaleSet
+}
+
+// azureScaleSet tracks Create calls waiting for VMs in one scale
+// set.
+type azureScaleSet struct {
+	name string
+
+	mtx     sync.Mutex
+	pending []*scaleSetRequest
+	growing bool
+	// instance IDs of VMs that have been assigned to Create
+	// calls by this process
+	claimed map[string]bool
+}
+
+type scaleSetRequest struct {
+	tags        cloud.InstanceTags
+	initCommand cloud.InitCommand
+	done        chan scaleSetResult
+}
+
+type scaleSetResult struct {
+	inst *azureScaleSetInstance
+	err  error
+}
+
+// checkScaleSetsConfig returns an error if ScaleSets is enabled
+// along with a config option that is not supported in scale set
+// mode.
+func (az *azureInstanceSet) checkScaleSetsConfig() error {
+	if !az.azconfig.ScaleSets {
+		return nil
+	}
+	if az.azconfig.AvailabilitySet.enabled() {
+		return errors.New("invalid configuration: cannot use both ScaleSets and AvailabilitySet")
+	}
+	if az.azconfig.CustomDataTemplate != "" {
+		return errors.New("invalid configuration: cannot use both ScaleSets and CustomDataTemplate")
+	}
+	if az.azconfig.CreatePublicIP {
+		return errors.New("invalid configuration: cannot use both ScaleSets and CreatePublicIP")
+	}
+	return nil
+}
+
+func newAzureScaleSetInstanceSet(az *azureInstanceSet) *azureScaleSetInstanceSet {
+	return &azureScaleSetInstanceSet{
+		azureInstanceSet: az,
+		scaleSets:        map[string]*azureScaleSet{},
+	}
+}
+
+// scaleSetKey returns a key that identifies the scale set for VMs
+// with the given instance type, image, and public key.
+func scaleSetKey(it arvados.InstanceType, imageID cloud.ImageID, publicKey ssh.PublicKey) string {
+	fingerprint := ""
+	if publicKey != nil {
+		fingerprint = ssh.FingerprintSHA256(publicKey)
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%v\n%s\n%s", it.ProviderType, it.Preemptible, imageID, fingerprint)))
+	return fmt.Sprintf("%x", sum[:16])
+}
+
+// scaleSetName returns the name of the scale set used for VMs with
+// the given instance type, image, and public key.
+func (azss *azureScaleSetInstanceSet) scaleSetName(instanceType arvados.InstanceType, imageID cloud.ImageID, publicKey ssh.PublicKey) string {
+	return azss.namePrefix + "ss-" + scaleSetKey(instanceType, imageID, publicKey)[:15]
+}
+
+// scaleSet returns the azureScaleSet with the given name, or nil if
+// create is false and this process has not used it.
+func (azss *azureScaleSetInstanceSet) scaleSet(name string, create bool) *azureScaleSet {
+	azss.mtx.Lock()
+	defer azss.mtx.Unlock()
+	ss := azss.scaleSets[name]
+	if ss == nil && create {
+		ss = &azureScaleSet{name: name, claimed: map[string]bool{}}
+		azss.scaleSets[name] = ss
+	}
+	return ss
+}
+
+func (azss *azureScaleSetInstanceSet) Create(
+	instanceType arvados.InstanceType,
+	imageID cloud.ImageID,
+	newTags cloud.InstanceTags,
+	initCommand cloud.InitCommand,
+	publicKey ssh.PublicKey) (cloud.Instance, error) {
+
+	azss.stopWg.Add(1)
+	defer azss.stopWg.Done()
+
+	if instanceType.AddedScratch > 0 {
+		return nil, fmt.Errorf("cannot create instance type %q: driver does not implement non-zero AddedScratch (%d)", instanceType.Name, instanceType.AddedScratch)
+	}
+	if regexp.MustCompile(`^http(s?)://`).MatchString(string(imageID)) {
+		return nil, errors.New("Invalid configuration: cannot use unmanaged image URL with ScaleSets")
+	}
+
+	ss := azss.scaleSet(azss.scaleSetName(instanceType, imageID, publicKey), true)
+	req := &scaleSetRequest{
+		tags:        newTags,
+		initCommand: initCommand,
+		done:        make(chan scaleSetResult, 1),
+	}
+	ss.mtx.Lock()
+	ss.pending = append(ss.pending, req)
+	if !ss.growing {
+		ss.growing = true
+		azss.stopWg.Add(1)
+		go azss.grow(ss, instanceType, imageID, publicKey)
+	}
+	ss.mtx.Unlock()
+
+	select {
+	case res := <-req.done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return res.inst, nil
+	case <-azss.ctx.Done():
+		return nil, azss.ctx.Err()
+	}
+}
+
+// grow adds VMs to the given scale set until there are no more
+// pending Create calls. Each iteration adds one VM for each Create
+// call that was pending when the iteration started. The caller must
+// call azss.stopWg.Add(1) first.
+func (azss *azureScaleSetInstanceSet) grow(ss *azureScaleSet, instanceType arvados.InstanceType, imageID cloud.ImageID, publicKey ssh.PublicKey) {
+	defer azss.stopWg.Done()
+	for {
+		ss.mtx.Lock()
+		batch := ss.pending
+		ss.pending = nil
+		if len(batch) == 0 || azss.ctx.Err() != nil {
+			ss.growing = false
+			ss.mtx.Unlock()
+			return
+		}
+		ss.mtx.Unlock()
+
+		vms, err := azss.addVMs(ss, instanceType, imageID, publicKey, len(batch))
+		var nics map[string]armnetwork.Interface
+		if err == nil {
+			nics, err = azss.scaleSetNICs(ss.name)
+		}
+		if err != nil {
+			for _, req := range batch {
+				req.done <- scaleSetResult{err: err}
+			}
+			continue
+		}
+		azss.logger.Infof("added %d VMs to scale set %s", len(vms), ss.name)
+		var wg sync.WaitGroup
+		for i, req := range batch {
+			vm, req := vms[i], req
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				inst, err := azss.claim(ss, vm, nics[strings.ToLower(*vm.ID)], req)
+				req.done <- scaleSetResult{inst: inst, err: err}
+			}()
+		}
+		// Wait for the claims to finish before starting the
+		// next scale operation, so Create calls that arrive
+		// in the meantime are combined into one batch.
+		wg.Wait()
+	}
+}
+
+// addVMs increases the capacity of the given scale set by n (creating
+// the scale set first if needed), and returns the new VMs.
+func (azss *azureScaleSetInstanceSet) addVMs(ss *azureScaleSet, instanceType arvados.InstanceType, imageID cloud.ImageID, publicKey ssh.PublicKey, n int) ([]armcompute.VirtualMachineScaleSetVM, error) {
+	rg := azss.azconfig.ResourceGroup
+	existing := map[string]bool{}
+	set, err := azss.ssClient.get(azss.ctx, rg, ss.name)
+	if isNotFound(err) {
+		params, err := azss.scaleSetParameters(ss.name, instanceType, imageID, publicKey, int64(n))
+		if err != nil {
+			return nil, err
+		}
+		_, err = azss.ssClient.createOrUpdate(azss.ctx, rg, ss.name, params)
+		if err != nil {
+			return nil, wrapAzureError(err)
+		}
+	} else if err != nil {
+		return nil, wrapAzureError(err)
+	} else {
+		vms, err := azss.ssClient.listVMs(azss.ctx, rg, ss.name)
+		if err != nil {
+			return nil, wrapAzureError(err)
+		}
+		for _, vm := range vms {
+			existing[*vm.InstanceID] = true
+		}
+		capacity := int64(n)
+		if set.SKU != nil && set.SKU.Capacity != nil {
+			capacity += *set.SKU.Capacity
+		}
+		err = azss.ssClient.setCapacity(azss.ctx, rg, ss.name, capacity)
+		if err != nil {
+			return nil, wrapAzureError(err)
+		}
+	}
+
+	vms, err := azss.ssClient.listVMs(azss.ctx, rg, ss.name)
+	if err != nil {
+		return nil, wrapAzureError(err)
+	}
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	var added []armcompute.VirtualMachineScaleSetVM
+	for _, vm := range vms {
+		if !existing[*vm.InstanceID] && !ss.claimed[*vm.InstanceID] && vm.Tags["created-at"] == nil {
+			added = append(added, vm)
+		}
+	}
+	if len(added) < n {
+		return nil, fmt.Errorf("scale set %s has %d new VMs after adding %d", ss.name, len(added), n)
+	}
+	sort.Slice(added, func(i, j int) bool { return *added[i].InstanceID < *added[j].InstanceID })
+	added = added[:n]
+	for _, vm := range added {
+		ss.claimed[*vm.InstanceID] = true
+	}
+	return added, nil
+}
+
+// scaleSetParameters returns the parameters for creating a new scale
+// set with the given capacity.
+func (azss *azureScaleSetInstanceSet) scaleSetParameters(name string, instanceType arvados.InstanceType, imageID cloud.ImageID, publicKey ssh.PublicKey, capacity int64) (armcompute.VirtualMachineScaleSet, error) {
+	imageID, plan := azss.imagePlan(instanceType, imageID)
+	imageRef, err := azss.imageReference(imageID)
+	if err != nil {
+		return armcompute.VirtualMachineScaleSet{}, err
+	}
+	// Each new scale set uses the next subnet. An existing
+	// scale set keeps the subnet it was created with.
+	subnets, err := azss.pickSubnets()
+	if err != nil {
+		return armcompute.VirtualMachineScaleSet{}, err
+	}
+	nicConfig := &armcompute.VirtualMachineScaleSetNetworkConfigurationProperties{
+		Primary: to.Ptr(true),
+		IPConfigurations: []*armcompute.VirtualMachineScaleSetIPConfiguration{
+			{
+				Name: to.Ptr("ip1"),
+				Properties: &armcompute.VirtualMachineScaleSetIPConfigurationProperties{
+					Subnet: &armcompute.APIEntityReference{
+						ID: to.Ptr(azss.subnetID(subnets[0])),
+					},
+				},
+			},
+		},
+	}
+	if azss.nsgID != "" {
+		nicConfig.NetworkSecurityGroup = &armcompute.SubResource{ID: to.Ptr(azss.nsgID)}
+	}
+	if azss.acceleratedNetworking(instanceType) {
+		nicConfig.EnableAcceleratedNetworking = to.Ptr(true)
+	}
+
+	customData := base64.StdEncoding.EncodeToString([]byte(azss.initScript("")))
+	profile := &armcompute.VirtualMachineScaleSetVMProfile{
+		OSProfile: &armcompute.VirtualMachineScaleSetOSProfile{
+			ComputerNamePrefix: to.Ptr(name),
+			AdminUsername:      to.Ptr(azss.azconfig.AdminUsername),
+			LinuxConfiguration: &armcompute.LinuxConfiguration{
+				DisablePasswordAuthentication: to.Ptr(true),
+			},
+			CustomData: &customData,
+		},
+		StorageProfile: &armcompute.VirtualMachineScaleSetStorageProfile{
+			ImageReference: imageRef,
+			OSDisk: &armcompute.VirtualMachineScaleSetOSDisk{
+				OSType:       to.Ptr(armcompute.OperatingSystemTypesLinux),
+				CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesFromImage),
+			},
+		},
+		NetworkProfile: &armcompute.VirtualMachineScaleSetNetworkProfile{
+			NetworkInterfaceConfigurations: []*armcompute.VirtualMachineScaleSetNetworkConfiguration{
+				{
+					Name:       to.Ptr(name + "-nic"),
+					Properties: nicConfig,
+				},
+			},
+		},
+	}
+	if publicKey != nil {
+		profile.OSProfile.LinuxConfiguration.SSH = &armcompute.SSHConfiguration{
+			PublicKeys: []*armcompute.SSHPublicKey{
+				{
+					Path:    to.Ptr(azss.azconfig.authorizedKeysPath()),
+					KeyData: to.Ptr(string(ssh.MarshalAuthorizedKey(publicKey))),
+				},
+			},
+		}
+	}
+	if instanceType.Preemptible {
+		// See createVM
+		var maxPrice float64 = -1
+		profile.Priority = to.Ptr(armcompute.VirtualMachinePriorityTypesSpot)
+		profile.EvictionPolicy = to.Ptr(armcompute.VirtualMachineEvictionPolicyTypesDelete)
+		profile.BillingProfile = &armcompute.BillingProfile{MaxPrice: &maxPrice}
+	}
+	azss.applyScaleSetOSDisk(instanceType, profile.StorageProfile)
+	azss.applyScaleSetDiskEncryption(profile.StorageProfile)
+	profile.SecurityProfile = azss.securityProfile()
+
+	tags := azss.resourceTags()
+	tags["created-at"] = to.Ptr(time.Now().Format(time.RFC3339Nano))
+	params := armcompute.VirtualMachineScaleSet{
+		Location: &azss.azconfig.Location,
+		Tags:     tags,
+		Plan:     plan,
+		SKU: &armcompute.SKU{
+			Name:     to.Ptr(instanceType.ProviderType),
+			Tier:     to.Ptr("Standard"),
+			Capacity: &capacity,
+		},
+		Properties: &armcompute.VirtualMachineScaleSetProperties{
+			UpgradePolicy: &armcompute.UpgradePolicy{Mode: to.Ptr(armcompute.UpgradeModeManual)},
+			// Overprovisioned VMs would be assigned to
+			// Create calls and then disappear.
+			Overprovision: to.Ptr(false),
+			// Allow more than 100 VMs.
+			SinglePlacementGroup:  to.Ptr(false),
+			VirtualMachineProfile: profile,
+		},
+	}
+	if zones := azss.azconfig.Zones; len(zones) > 0 {
+		for i := range zones {
+			params.Zones = append(params.Zones, &zones[i])
+		}
+		params.Properties.ZoneBalance = to.Ptr(true)
+	}
+	return params, nil
+}
+
+// claim runs the init script on a new scale set VM and applies the
+// tags given to Create. If either step fails, the VM is deleted.
+func (azss *azureScaleSetInstanceSet) claim(ss *azureScaleSet, vm armcompute.VirtualMachineScaleSetVM, nic armnetwork.Interface, req *scaleSetRequest) (*azureScaleSetInstance, error) {
+	inst := &azureScaleSetInstance{
+		provider: azss,
+		scaleSet: ss.name,
+		vm:       vm,
+		nic:      nic,
+	}
+	tags := cloud.InstanceTags{}
+	for k, v := range azss.azconfig.ResourceTags {
+		tags[k] = v
+	}
+	for k, v := range req.tags {
+		tags[k] = v
+	}
+	tags["created-at"] = time.Now().Format(time.RFC3339Nano)
+	for k, v := range azss.azconfig.SharedMount.tags() {
+		tags[k] = v
+	}
+	_, err := azss.ssClient.runCommand(azss.ctx, azss.azconfig.ResourceGroup, ss.name, *vm.InstanceID, azss.initScript(req.initCommand))
+	if err == nil {
+		err = inst.SetTags(tags)
+	}
+	if err != nil {
+		if delerr := azss.ssClient.deleteInstances(azss.ctx, azss.azconfig.ResourceGroup, ss.name, []string{*vm.InstanceID}); delerr != nil {
+			azss.logger.WithError(delerr).Warnf("error deleting scale set VM %s after failed setup", *vm.Name)
+		}
+		ss.mtx.Lock()
+		delete(ss.claimed, *vm.InstanceID)
+		ss.mtx.Unlock()
+		return nil, fmt.Errorf("error setting up scale set VM %s: %w", *vm.Name, err)
+	}
+	return inst, nil
+}
+
+// scaleSetNICs returns the network interfaces of the VMs in the
+// given scale set, indexed by VM ID.
+func (azss *azureScaleSetInstanceSet) scaleSetNICs(name string) (map[string]armnetwork.Interface, error) {
+	nics, err := azss.ssClient.listNICs(azss.ctx, azss.azconfig.ResourceGroup, name)
+	if err != nil {
+		return nil, wrapAzureError(err)
+	}
+	byVM := map[string]armnetwork.Interface{}
+	for _, nic := range nics {
+		if nic.Properties != nil && nic.Properties.VirtualMachine != nil && nic.Properties.VirtualMachine.ID != nil {
+			byVM[strings.ToLower(*nic.Properties.VirtualMachine.ID)] = nic
+		}
+	}
+	return byVM, nil
+}
+
+func (azss *azureScaleSetInstanceSet) Instances(tags cloud.InstanceTags) ([]cloud.Instance, error) {
+	azss.stopWg.Add(1)
+	defer azss.stopWg.Done()
+
+	instances, err := azss.azureInstanceSet.Instances(tags)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := azss.ssClient.list(azss.ctx, azss.azconfig.ResourceGroup)
+	if err != nil {
+		return nil, wrapAzureError(err)
+	}
+	for _, set := range sets {
+		if set.Name == nil || !strings.HasPrefix(*set.Name, azss.namePrefix) {
+			continue
+		}
+		name := *set.Name
+		vms, err := azss.ssClient.listVMs(azss.ctx, azss.azconfig.ResourceGroup, name)
+		if err != nil {
+			return nil, wrapAzureError(err)
+		}
+		if len(vms) == 0 {
+			continue
+		}
+		nics, err := azss.scaleSetNICs(name)
+		if err != nil {
+			return nil, err
+		}
+		ss := azss.scaleSet(name, false)
+		var orphans []string
+		for _, vm := range vms {
+			if vm.Tags["created-at"] == nil {
+				// Not yet assigned to a Create call.
+				// If this process isn't adding VMs to
+				// the scale set, it was left behind
+				// by an interrupted Create call (or
+				// a previous dispatcher process).
+				if ss == nil || !ss.isBusy(*vm.InstanceID) {
+					orphans = append(orphans, *vm.InstanceID)
+				}
+				continue
+			}
+			if !hasTags(vm.Tags, tags) {
+				continue
+			}
+			instances = append(instances, &azureScaleSetInstance{
+				provider: azss,
+				scaleSet: name,
+				vm:       vm,
+				nic:      nics[strings.ToLower(*vm.ID)],
+			})
+		}
+		if len(orphans) > 0 && !azss.dryRun("scale set VMs", fmt.Sprintf("%s %v", name, orphans)) {
+			azss.logger.Infof("deleting %d unassigned VMs from scale set %s", len(orphans), name)
+			go func(name string, orphans []string) {
+				err := azss.ssClient.deleteInstances(azss.ctx, azss.azconfig.ResourceGroup, name, orphans)
+				if err != nil {
+					azss.logger.WithError(err).Warnf("error deleting unassigned VMs from scale set %s", name)
+				}
+			}(name, orphans)
+		}
+	}
+	return instances, nil
+}
+
+// isBusy returns true if the given VM might be in the process of
+// being assigned to a Create call.
+func (ss *azureScaleSet) isBusy(instanceID string) bool {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return ss.growing || ss.claimed[instanceID]
+}
+
+type azureScaleSetInstance struct {
+	provider *azureScaleSetInstanceSet
+	scaleSet string
+	vm       armcompute.VirtualMachineScaleSetVM
+	nic      armnetwork.Interface
+}
+
+func (ai *azureScaleSetInstance) ID() cloud.InstanceID {
+	return cloud.InstanceID(*ai.vm.ID)
+}
+
+func (ai *azureScaleSetInstance) String() string {
+	return *ai.vm.Name
+}
+
+func (ai *azureScaleSetInstance) ProviderType() string {
+	if ai.vm.SKU == nil || ai.vm.SKU.Name == nil {
+		return ""
+	}
+	return *ai.vm.SKU.Name
+}
+
+func (ai *azureScaleSetInstance) SetTags(newTags cloud.InstanceTags) error {
+	ai.provider.stopWg.Add(1)
+	defer ai.provider.stopWg.Done()
+
+	tags := map[string]*string{}
+	for k, v := range ai.vm.Tags {
+		tags[k] = v
+	}
+	for k, v := range newTags {
+		tags[k] = to.Ptr(v)
+	}
+
+	vm, err := ai.provider.ssClient.updateVM(ai.provider.ctx, ai.provider.azconfig.ResourceGroup, ai.scaleSet, *ai.vm.InstanceID, armcompute.VirtualMachineScaleSetVM{
+		Location: &ai.provider.azconfig.Location,
+		Tags:     tags,
+	})
+	if err != nil {
+		return wrapAzureError(err)
+	}
+	ai.vm = vm
+	return nil
+}
+
+func (ai *azureScaleSetInstance) Tags() cloud.InstanceTags {
+	tags := cloud.InstanceTags{}
+	for k, v := range ai.vm.Tags {
+		tags[k] = *v
+	}
+	return tags
+}
+
+func (ai *azureScaleSetInstance) Destroy() error {
+	ai.provider.stopWg.Add(1)
+	defer ai.provider.stopWg.Done()
+
+	if err := ai.provider.checkDeletable(*ai.vm.Name, ai.vm.Tags, true); err != nil {
+		return err
+	}
+	if ai.provider.dryRun("VM", *ai.vm.Name) {
+		return nil
+	}
+	err := ai.provider.ssClient.deleteInstances(ai.provider.ctx, ai.provider.azconfig.ResourceGroup, ai.scaleSet, []string{*ai.vm.InstanceID})
+	return wrapAzureError(err)
+}
+
+func (ai *azureScaleSetInstance) Address() string {
+	return nicAddress(ai.nic)
+}
+
+func (ai *azureScaleSetInstance) PriceHistory(arvados.InstanceType) []cloud.InstancePrice {
+	return nil
+}
+
+func (ai *azureScaleSetInstance) RemoteUser() string {
+	return ai.provider.azconfig.AdminUsername
+}
+
+func (ai *azureScaleSetInstance) VerifyHostKey(key ssh.PublicKey, _ *ssh.Client) error {
+	azss := ai.provider
+	return azss.verifyHostKey(key, func(script string) (string, error) {
+		return azss.ssClient.runCommand(azss.ctx, azss.azconfig.ResourceGroup, ai.scaleSet, *ai.vm.InstanceID, script)
+	})
+}
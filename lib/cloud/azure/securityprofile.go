@@ -0,0 +1,62 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+// azureSecurityProfile describes the security features (Trusted
+// Launch, secure boot, vTPM) enabled on new VMs.
+type azureSecurityProfile struct {
+	// Security type of new VMs. "TrustedLaunch" is currently the
+	// only supported value, and requires a generation 2 image.
+	// If empty, VMs use standard security and SecureBoot and VTPM
+	// must be false.
+	SecurityType string
+
+	// Enable UEFI secure boot.
+	SecureBoot bool
+
+	// Enable virtual Trusted Platform Module.
+	VTPM bool
+}
+
+func (sp azureSecurityProfile) enabled() bool {
+	return sp.SecurityType != ""
+}
+
+func (sp azureSecurityProfile) check() error {
+	if !sp.enabled() {
+		if sp.SecureBoot || sp.VTPM {
+			return errors.New("invalid configuration: SecurityProfile.SecureBoot and SecurityProfile.VTPM require SecurityProfile.SecurityType TrustedLaunch")
+		}
+		return nil
+	}
+	if sp.SecurityType != string(armcompute.SecurityTypesTrustedLaunch) {
+		return fmt.Errorf("invalid configuration: unsupported SecurityProfile.SecurityType %q (supported: %q)", sp.SecurityType, armcompute.SecurityTypesTrustedLaunch)
+	}
+	return nil
+}
+
+// securityProfile returns the security profile for new VMs and
+// scale sets, or nil if SecurityProfile is not configured.
+func (az *azureInstanceSet) securityProfile() *armcompute.SecurityProfile {
+	sp := az.azconfig.SecurityProfile
+	if !sp.enabled() {
+		return nil
+	}
+	return &armcompute.SecurityProfile{
+		SecurityType: to.Ptr(armcompute.SecurityTypes(sp.SecurityType)),
+		UefiSettings: &armcompute.UefiSettings{
+			SecureBootEnabled: to.Ptr(sp.SecureBoot),
+			VTpmEnabled:       to.Ptr(sp.VTPM),
+		},
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Default mount options for an Azure Files NFS share.
+const defaultSharedMountOptions = "vers=4,minorversion=1,sec=sys"
+
+// azureSharedMount describes an NFS share (typically an Azure Files
+// NFS share) that compute nodes mount at boot, so shared reference
+// data is available on every node without rebuilding the image.
+type azureSharedMount struct {
+	// NFS export, e.g.,
+	// "example.file.core.windows.net:/example/refdata"
+	Source string
+
+	// Absolute path where the share is mounted on the node.
+	MountPoint string
+
+	// Mount options. If empty, defaultSharedMountOptions is used.
+	Options string
+}
+
+func (sm azureSharedMount) enabled() bool {
+	return sm.Source != ""
+}
+
+func (sm azureSharedMount) check() error {
+	if !sm.enabled() {
+		if sm.MountPoint != "" {
+			return errors.New("Invalid configuration: SharedMount.MountPoint is set but SharedMount.Source is empty")
+		}
+		return nil
+	}
+	if !strings.Contains(sm.Source, ":/") {
+		return fmt.Errorf("Invalid configuration: SharedMount.Source %q is not an NFS export (host:/path)", sm.Source)
+	}
+	if !path.IsAbs(sm.MountPoint) || path.Clean(sm.MountPoint) == "/" {
+		return fmt.Errorf("Invalid configuration: SharedMount.MountPoint %q must be an absolute path other than /", sm.MountPoint)
+	}
+	return nil
+}
+
+// initScript returns shell commands that mount the share. A mount
+// failure is reported on stderr but does not prevent the rest of
+// the boot script from running.
+func (sm azureSharedMount) initScript() string {
+	if !sm.enabled() {
+		return ""
+	}
+	opts := sm.Options
+	if opts == "" {
+		opts = defaultSharedMountOptions
+	}
+	return fmt.Sprintf("mkdir -p %s && mount -t nfs -o %s %s %s || echo >&2 'warning: could not mount shared filesystem'\n",
+		shellQuote(sm.MountPoint), shellQuote(opts), shellQuote(sm.Source), shellQuote(sm.MountPoint))
+}
+
+// tags returns instance tags that identify the share mounted on the
+// node.
+func (sm azureSharedMount) tags() map[string]string {
+	if !sm.enabled() {
+		return nil
+	}
+	return map[string]string{
+		"shared-mount-source": sm.Source,
+		"shared-mount-point":  sm.MountPoint,
+	}
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,164 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+// Maximum number of instance views to get in one Instances() call
+// to find out VMs' power states, which are not included in the VM
+// list. VMs beyond the limit are checked in later calls.
+const maxPowerStateRefreshes = 20
+
+// azurePowerStates caches the power state of each VM, keyed by
+// lowercase VM ID, so Instances() only needs to get the instance
+// view of VMs that are new or changing. The zero value is ready to
+// use.
+type azurePowerStates struct {
+	mtx sync.Mutex
+	m   map[string]cloud.PowerState
+}
+
+func (ps *azurePowerStates) get(id string) (cloud.PowerState, bool) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	state, ok := ps.m[strings.ToLower(id)]
+	return state, ok
+}
+
+func (ps *azurePowerStates) set(id string, state cloud.PowerState) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	if ps.m == nil {
+		ps.m = map[string]cloud.PowerState{}
+	}
+	ps.m[strings.ToLower(id)] = state
+}
+
+// forget discards the cached power state of a VM, so it is checked
+// again in the next Instances() call (e.g., because an event said
+// the VM was changed).
+func (ps *azurePowerStates) forget(id string) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	delete(ps.m, strings.ToLower(id))
+}
+
+// retain discards the cached power states of VMs that are not in the
+// given set of lowercase IDs.
+func (ps *azurePowerStates) retain(ids map[string]bool) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	for id := range ps.m {
+		if !ids[id] {
+			delete(ps.m, id)
+		}
+	}
+}
+
+// refreshPowerStates gets the instance views of the given VMs whose
+// power state is unknown or might be changing, and updates the
+// cache.
+func (az *azureInstanceSet) refreshPowerStates(vms []armcompute.VirtualMachine) {
+	seen := make(map[string]bool, len(vms))
+	refreshes := 0
+	for _, vm := range vms {
+		if vm.ID == nil || vm.Name == nil {
+			continue
+		}
+		seen[strings.ToLower(*vm.ID)] = true
+		state, ok := az.powerStates.get(*vm.ID)
+		if ok && (state == cloud.PowerRunning || state == cloud.PowerStopped) &&
+			vm.Properties != nil &&
+			provisioningState(vm.Properties.ProvisioningState) == cloud.ProvisioningSucceeded {
+			continue
+		}
+		if refreshes >= maxPowerStateRefreshes {
+			continue
+		}
+		refreshes++
+		iv, err := az.vmClient.instanceView(az.ctx, az.azconfig.ResourceGroup, *vm.Name)
+		if err != nil {
+			az.logger.WithError(err).Debugf("error getting instance view of VM %s", *vm.Name)
+			continue
+		}
+		az.powerStates.set(*vm.ID, powerState(iv.Statuses))
+	}
+	az.powerStates.retain(seen)
+}
+
+// provisioningState converts an Azure provisioning state, like
+// "Succeeded", to a cloud.ProvisioningState.
+func provisioningState(state *string) cloud.ProvisioningState {
+	if state == nil {
+		return ""
+	}
+	switch strings.ToLower(*state) {
+	case "creating":
+		return cloud.ProvisioningCreating
+	case "updating", "migrating":
+		return cloud.ProvisioningUpdating
+	case "succeeded":
+		return cloud.ProvisioningSucceeded
+	case "failed":
+		return cloud.ProvisioningFailed
+	case "deleting":
+		return cloud.ProvisioningDeleting
+	default:
+		return ""
+	}
+}
+
+// powerState returns the power state given by the "PowerState/..."
+// status in an instance view.
+func powerState(statuses []*armcompute.InstanceViewStatus) cloud.PowerState {
+	for _, status := range statuses {
+		if status == nil || status.Code == nil {
+			continue
+		}
+		code, ok := strings.CutPrefix(strings.ToLower(*status.Code), "powerstate/")
+		if !ok {
+			continue
+		}
+		switch code {
+		case "starting":
+			return cloud.PowerStarting
+		case "running":
+			return cloud.PowerRunning
+		case "stopping", "deallocating":
+			return cloud.PowerStopping
+		case "stopped", "deallocated":
+			return cloud.PowerStopped
+		}
+	}
+	return ""
+}
+
+// State implements cloud.InstanceWithState.
+func (ai *azureInstance) State() cloud.InstanceState {
+	state := cloud.InstanceState{Power: ai.power}
+	if ai.vm.Properties != nil {
+		state.Provisioning = provisioningState(ai.vm.Properties.ProvisioningState)
+	}
+	return state
+}
+
+// State implements cloud.InstanceWithState. Scale set VMs are listed
+// with their instance views, so the power state is always current.
+func (ai *azureScaleSetInstance) State() cloud.InstanceState {
+	var state cloud.InstanceState
+	if props := ai.vm.Properties; props != nil {
+		state.Provisioning = provisioningState(props.ProvisioningState)
+		if props.InstanceView != nil {
+			state.Power = powerState(props.InstanceView.Statuses)
+		}
+	}
+	return state
+}
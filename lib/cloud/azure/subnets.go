@@ -0,0 +1,131 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// How long to skip a subnet after it runs out of private IP
+// addresses.
+const subnetExhaustedTTL = time.Minute
+
+// Error codes returned by the network API when a subnet has no
+// private IP addresses left.
+var subnetExhaustedRe = regexp.MustCompile(`(?i)^(SubnetIsFull|PrivateIPAddressNotAvailable)$`)
+
+// azureSubnetsExhaustedError is returned by Create when all of the
+// configured subnets are out of private IP addresses. It is reported
+// as a quota error, so the dispatcher waits for running instances to
+// shut down (and release their addresses) before trying again.
+type azureSubnetsExhaustedError struct {
+	error
+}
+
+func (*azureSubnetsExhaustedError) IsQuotaError() bool { return true }
+
+// azureSubnetPicker chooses the subnet for each new NIC, cycling
+// through the configured subnets and skipping the ones that recently
+// ran out of addresses.
+type azureSubnetPicker struct {
+	mtx       sync.Mutex
+	next      int
+	exhausted map[string]time.Time // subnet => when to try it again
+}
+
+// subnets returns the configured subnet names: Subnets if it is
+// non-empty, otherwise Subnet.
+func (az *azureInstanceSet) subnets() []string {
+	if len(az.azconfig.Subnets) > 0 {
+		return az.azconfig.Subnets
+	}
+	return []string{az.azconfig.Subnet}
+}
+
+// checkSubnetsConfig returns an error if the Subnet/Subnets config
+// cannot be used.
+func (az *azureInstanceSet) checkSubnetsConfig() error {
+	if len(az.azconfig.Subnets) == 0 {
+		return nil
+	}
+	if az.azconfig.Subnet != "" {
+		return errors.New("invalid configuration: cannot use both Subnet and Subnets")
+	}
+	for _, subnet := range az.azconfig.Subnets {
+		if subnet == "" {
+			return errors.New("invalid configuration: empty string in Subnets")
+		}
+	}
+	return nil
+}
+
+// subnetID returns the resource ID of the named subnet in Network.
+func (az *azureInstanceSet) subnetID(subnet string) string {
+	return az.networkID(az.azconfig.NetworkResourceGroup, az.azconfig.Network) + "/subnets/" + subnet
+}
+
+// networkID returns the resource ID of the named virtual network in
+// networkResourceGroup, or in ResourceGroup if networkResourceGroup
+// is empty.
+func (az *azureInstanceSet) networkID(networkResourceGroup, network string) string {
+	if networkResourceGroup == "" {
+		networkResourceGroup = az.azconfig.ResourceGroup
+	}
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers"+
+		"/Microsoft.Network/virtualnetworks/%s",
+		az.azconfig.SubscriptionID,
+		networkResourceGroup,
+		network)
+}
+
+// pickSubnets returns the subnets to try, in order, for the next new
+// NIC in Network. See (*azureSubnetPicker)pick.
+func (az *azureInstanceSet) pickSubnets() ([]string, error) {
+	return az.subnetPicker.pick(az.subnets())
+}
+
+// pick returns the subnets to try, in order, for the next new NIC:
+// the given subnets, rotated round-robin, except the ones that ran
+// out of addresses in the last subnetExhaustedTTL. It returns an
+// azureSubnetsExhaustedError if all subnets are being skipped.
+func (sp *azureSubnetPicker) pick(subnets []string) ([]string, error) {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	start := sp.next
+	sp.next++
+	var ok []string
+	for i := range subnets {
+		subnet := subnets[(start+i)%len(subnets)]
+		if t, skip := sp.exhausted[subnet]; skip && time.Now().Before(t) {
+			continue
+		}
+		ok = append(ok, subnet)
+	}
+	if len(ok) == 0 {
+		return nil, &azureSubnetsExhaustedError{fmt.Errorf("all subnets are out of private IP addresses (%q)", subnets)}
+	}
+	return ok, nil
+}
+
+// subnetExhausted checks whether err indicates the given subnet has
+// no addresses left, and if so, arranges for sp.pick to skip it for
+// a while.
+func (az *azureInstanceSet) subnetExhausted(sp *azureSubnetPicker, subnet string, err error) bool {
+	if code := azureErrorCode(err); code == "" || !subnetExhaustedRe.MatchString(code) {
+		return false
+	}
+	az.logger.WithError(err).Warnf("subnet %s is out of private IP addresses, skipping it for %v", subnet, subnetExhaustedTTL)
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	if sp.exhausted == nil {
+		sp.exhausted = map[string]time.Time{}
+	}
+	sp.exhausted[subnet] = time.Now().Add(subnetExhaustedTTL)
+	return true
+}
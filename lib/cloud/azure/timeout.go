@@ -0,0 +1,86 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+const (
+	defaultAPIRequestTimeout   = time.Minute
+	defaultAPIOperationTimeout = 20 * time.Minute
+)
+
+// apiTimeouts limits the time spent waiting for ARM calls, so a hung
+// connection or a stuck long-running operation (e.g., a VM that never
+// finishes provisioning) cannot block the caller indefinitely.
+//
+// request limits each HTTP request, including reading the response
+// body. operation limits the time spent polling a long-running
+// operation for completion (see waitForCompletion).
+//
+// Either way, a deadline or cancellation of the caller's context
+// takes effect first if it is sooner.
+type apiTimeouts struct {
+	request   time.Duration
+	operation time.Duration
+}
+
+func newAPITimeouts(request, operation time.Duration) apiTimeouts {
+	if request <= 0 {
+		request = defaultAPIRequestTimeout
+	}
+	if operation <= 0 {
+		operation = defaultAPIOperationTimeout
+	}
+	return apiTimeouts{request: request, operation: operation}
+}
+
+// Do implements policy.Policy. It must run after the SDK's retry
+// policy, so each retry attempt gets its own request timeout.
+func (t apiTimeouts) Do(req *policy.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Raw().Context(), t.request)
+	defer cancel()
+	// The SDK's body download policy runs after this one, so the
+	// response body has been read (or has failed to arrive in
+	// time) by the time Next returns.
+	resp, err := req.WithContext(ctx).Next()
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && req.Raw().Context().Err() == nil {
+		err = fmt.Errorf("%s %s: no response after %s: %w", req.Raw().Method, req.Raw().URL.Path, t.request, err)
+	}
+	return resp, err
+}
+
+// pollFrequency is the interval between polls of a long-running
+// operation's status, if the server doesn't specify one with a
+// Retry-After header. Zero means use the SDK default.
+var pollFrequency time.Duration
+
+// waitForCompletion waits for a long-running ARM operation to
+// finish, and returns its result. It gives up when ctx is done, or
+// -- if ctx has no deadline -- after the given operation timeout.
+func waitForCompletion[T any](ctx context.Context, poller *runtime.Poller[T], timeout time.Duration) (T, error) {
+	_, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	result, err := poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: pollFrequency})
+	if err != nil && errors.Is(err, context.DeadlineExceeded) {
+		if !hasDeadline {
+			return result, fmt.Errorf("operation did not complete within APIOperationTimeout (%s): %w", timeout, err)
+		}
+		return result, fmt.Errorf("operation did not complete before deadline: %w", err)
+	}
+	return result, err
+}
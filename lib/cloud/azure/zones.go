@@ -0,0 +1,51 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package azure
+
+import (
+	"errors"
+	"sync"
+)
+
+// Instance tag indicating the availability zone a VM was placed in.
+const tagAvailabilityZone = "availability-zone"
+
+// azureZonePicker chooses the availability zone for each new VM,
+// cycling through the configured Zones.
+type azureZonePicker struct {
+	mtx  sync.Mutex
+	next int
+}
+
+// checkZonesConfig returns an error if the Zones config cannot be
+// used.
+func (az *azureInstanceSet) checkZonesConfig() error {
+	if len(az.azconfig.Zones) == 0 {
+		return nil
+	}
+	if az.azconfig.AvailabilitySet.enabled() {
+		return errors.New("invalid configuration: cannot use both Zones and AvailabilitySet")
+	}
+	for _, zone := range az.azconfig.Zones {
+		if zone == "" {
+			return errors.New("invalid configuration: empty string in Zones")
+		}
+	}
+	return nil
+}
+
+// pickZone returns the zone, out of the given zones (Zones, or the
+// Zones of one of the configured Locations), for the next new VM, or
+// "" if VMs are not placed in zones.
+func (az *azureInstanceSet) pickZone(zones []string) string {
+	if len(zones) == 0 {
+		return ""
+	}
+	az.zonePicker.mtx.Lock()
+	defer az.zonePicker.mtx.Unlock()
+	zone := zones[az.zonePicker.next%len(zones)]
+	az.zonePicker.next++
+	return zone
+}
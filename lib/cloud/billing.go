@@ -0,0 +1,242 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+// BillingRecord describes one running instance at the time of a
+// billing snapshot.
+type BillingRecord struct {
+	Time         time.Time    `json:"time"`
+	InstanceID   InstanceID   `json:"instance_id"`
+	InstanceType string       `json:"instance_type"` // name in cluster config, or "" if unknown
+	ProviderType string       `json:"provider_type"`
+	Preemptible  bool         `json:"preemptible"`
+	Price        float64      `json:"price"` // hourly
+	Tags         InstanceTags `json:"tags"`
+}
+
+// A BillingSink stores billing snapshots.
+type BillingSink interface {
+	WriteBillingSnapshot(ctx context.Context, snapshot []BillingRecord) error
+}
+
+// Billing export formats.
+const (
+	BillingFormatCSV  = "csv"
+	BillingFormatJSON = "json" // one JSON object per line
+)
+
+var billingCSVHeader = []string{"time", "instance_id", "instance_type", "provider_type", "preemptible", "price", "tags"}
+
+// EncodeBillingSnapshot writes the given records to w in the given
+// format (BillingFormatCSV or BillingFormatJSON). If header is true
+// and the format is CSV, a header row is written first.
+//
+// In CSV format, the tags column is a JSON object.
+func EncodeBillingSnapshot(w io.Writer, format string, snapshot []BillingRecord, header bool) error {
+	switch format {
+	case BillingFormatJSON:
+		enc := json.NewEncoder(w)
+		for _, rec := range snapshot {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	case BillingFormatCSV, "":
+		cw := csv.NewWriter(w)
+		if header {
+			cw.Write(billingCSVHeader)
+		}
+		for _, rec := range snapshot {
+			tags, err := json.Marshal(rec.Tags)
+			if err != nil {
+				return err
+			}
+			cw.Write([]string{
+				rec.Time.UTC().Format(time.RFC3339),
+				string(rec.InstanceID),
+				rec.InstanceType,
+				rec.ProviderType,
+				strconv.FormatBool(rec.Preemptible),
+				strconv.FormatFloat(rec.Price, 'f', -1, 64),
+				string(tags),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unsupported billing export format %q", format)
+	}
+}
+
+// FileBillingSink appends billing snapshots to a local file. In CSV
+// format, a header row is written when the file is empty.
+type FileBillingSink struct {
+	Path   string
+	Format string
+}
+
+func (sink *FileBillingSink) WriteBillingSnapshot(ctx context.Context, snapshot []BillingRecord) error {
+	f, err := os.OpenFile(sink.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// Encode to a buffer first so a failed encoding doesn't
+	// leave a partial snapshot in the file.
+	var buf bytes.Buffer
+	err = EncodeBillingSnapshot(&buf, sink.Format, snapshot, fi.Size() == 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// An ObjectStore stores objects by key, e.g., in an S3 bucket.
+type ObjectStore interface {
+	PutObject(ctx context.Context, key string, data []byte) error
+}
+
+// ObjectStoreBillingSink writes each billing snapshot as a separate
+// object named {Prefix}{time}.{csv|json}, where time is the
+// snapshot time in UTC in the form "20060102T150405Z".
+type ObjectStoreBillingSink struct {
+	Store  ObjectStore
+	Prefix string
+	Format string
+}
+
+func (sink *ObjectStoreBillingSink) WriteBillingSnapshot(ctx context.Context, snapshot []BillingRecord) error {
+	if len(snapshot) == 0 {
+		return nil
+	}
+	format := sink.Format
+	if format == "" {
+		format = BillingFormatCSV
+	}
+	var buf bytes.Buffer
+	err := EncodeBillingSnapshot(&buf, format, snapshot, true)
+	if err != nil {
+		return err
+	}
+	key := sink.Prefix + snapshot[0].Time.UTC().Format("20060102T150405Z") + "." + format
+	return sink.Store.PutObject(ctx, key, buf.Bytes())
+}
+
+// BillingExporter periodically writes a snapshot of the instances in
+// an InstanceSet, with their instance types, prices, and tags, to a
+// BillingSink. It works with any driver.
+type BillingExporter struct {
+	InstanceSet   InstanceSet
+	InstanceTypes arvados.InstanceTypeMap
+	// Only export instances that have these tags (see
+	// InstanceSet.Instances()).
+	Filter InstanceTags
+	// Tag whose value is the name of the instance's type in
+	// InstanceTypes. If empty, or an instance doesn't have the
+	// tag, the instance type is the first one (by name) whose
+	// ProviderType matches the instance's.
+	InstanceTypeTag string
+	Sink            BillingSink
+	Interval        time.Duration
+	Logger          logrus.FieldLogger
+}
+
+// Snapshot returns a billing record for each current instance.
+//
+// An instance's price is the most recent price reported by its
+// PriceHistory method, if any, otherwise the configured price of its
+// instance type.
+func (exp *BillingExporter) Snapshot(now time.Time) ([]BillingRecord, error) {
+	insts, err := exp.InstanceSet.Instances(exp.Filter)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range exp.InstanceTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var snapshot []BillingRecord
+	for _, inst := range insts {
+		tags := inst.Tags()
+		rec := BillingRecord{
+			Time:         now,
+			InstanceID:   inst.ID(),
+			ProviderType: inst.ProviderType(),
+			Tags:         tags,
+		}
+		it, ok := exp.InstanceTypes[tags[exp.InstanceTypeTag]]
+		if !ok || exp.InstanceTypeTag == "" {
+			ok = false
+			for _, name := range names {
+				if exp.InstanceTypes[name].ProviderType == rec.ProviderType {
+					it, ok = exp.InstanceTypes[name], true
+					break
+				}
+			}
+		}
+		if ok {
+			rec.InstanceType = it.Name
+			rec.Preemptible = it.Preemptible
+			rec.Price = it.Price
+			if prices := NormalizePriceHistory(inst.PriceHistory(it)); len(prices) > 0 {
+				rec.Price = prices[0].Price
+			}
+		}
+		snapshot = append(snapshot, rec)
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return strings.Compare(string(snapshot[i].InstanceID), string(snapshot[j].InstanceID)) < 0
+	})
+	return snapshot, nil
+}
+
+// Run writes a snapshot every Interval until ctx is done. Errors are
+// logged, and do not stop the exporter.
+func (exp *BillingExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(exp.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			snapshot, err := exp.Snapshot(now)
+			if err == nil {
+				err = exp.Sink.WriteBillingSnapshot(ctx, snapshot)
+			}
+			if err != nil && exp.Logger != nil {
+				exp.Logger.WithError(err).Warn("error writing billing snapshot")
+			}
+		}
+	}
+}
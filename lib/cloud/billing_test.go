@@ -0,0 +1,138 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	. "gopkg.in/check.v1"
+)
+
+type billingSuite struct{}
+
+var _ = Suite(&billingSuite{})
+
+type billingStubInstance struct {
+	Instance
+	id           InstanceID
+	providerType string
+	tags         InstanceTags
+	prices       []InstancePrice
+}
+
+func (inst *billingStubInstance) ID() InstanceID       { return inst.id }
+func (inst *billingStubInstance) ProviderType() string { return inst.providerType }
+func (inst *billingStubInstance) Tags() InstanceTags   { return inst.tags }
+func (inst *billingStubInstance) PriceHistory(arvados.InstanceType) []InstancePrice {
+	return inst.prices
+}
+
+type billingStubInstanceSet struct {
+	InstanceSet
+	instances []Instance
+}
+
+func (is *billingStubInstanceSet) Instances(InstanceTags) ([]Instance, error) {
+	return is.instances, nil
+}
+
+type billingStubObjectStore map[string][]byte
+
+func (store billingStubObjectStore) PutObject(ctx context.Context, key string, data []byte) error {
+	store[key] = data
+	return nil
+}
+
+func (s *billingSuite) exporter() *BillingExporter {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &BillingExporter{
+		InstanceSet: &billingStubInstanceSet{instances: []Instance{
+			&billingStubInstance{id: "i-2", providerType: "m5.large", tags: InstanceTags{"InstanceType": "m5spot"}, prices: []InstancePrice{{t0, 0.03}, {t0.Add(time.Hour), 0.04}}},
+			&billingStubInstance{id: "i-1", providerType: "m5.large", tags: InstanceTags{"foo": "bar"}},
+			&billingStubInstance{id: "i-3", providerType: "t2.nano"},
+		}},
+		InstanceTypes: arvados.InstanceTypeMap{
+			"m5":     {Name: "m5", ProviderType: "m5.large", Price: 0.1},
+			"m5spot": {Name: "m5spot", ProviderType: "m5.large", Price: 0.05, Preemptible: true},
+		},
+		InstanceTypeTag: "InstanceType",
+	}
+}
+
+func (s *billingSuite) TestSnapshot(c *C) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	snapshot, err := s.exporter().Snapshot(now)
+	c.Assert(err, IsNil)
+	c.Assert(snapshot, HasLen, 3)
+	c.Check(snapshot[0], DeepEquals, BillingRecord{Time: now, InstanceID: "i-1", InstanceType: "m5", ProviderType: "m5.large", Price: 0.1, Tags: InstanceTags{"foo": "bar"}})
+	c.Check(snapshot[1].InstanceType, Equals, "m5spot")
+	c.Check(snapshot[1].Preemptible, Equals, true)
+	c.Check(snapshot[1].Price, Equals, 0.04)
+	c.Check(snapshot[2].InstanceType, Equals, "")
+	c.Check(snapshot[2].Price, Equals, 0.0)
+}
+
+func (s *billingSuite) TestEncode(c *C) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	snapshot, err := s.exporter().Snapshot(now)
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	c.Check(EncodeBillingSnapshot(&buf, BillingFormatCSV, snapshot[:2], true), IsNil)
+	c.Check(buf.String(), Equals, `time,instance_id,instance_type,provider_type,preemptible,price,tags
+2023-01-02T03:04:05Z,i-1,m5,m5.large,false,0.1,"{""foo"":""bar""}"
+2023-01-02T03:04:05Z,i-2,m5spot,m5.large,true,0.04,"{""InstanceType"":""m5spot""}"
+`)
+
+	buf.Reset()
+	c.Check(EncodeBillingSnapshot(&buf, BillingFormatJSON, snapshot[:1], true), IsNil)
+	c.Check(buf.String(), Equals, `{"time":"2023-01-02T03:04:05Z","instance_id":"i-1","instance_type":"m5","provider_type":"m5.large","preemptible":false,"price":0.1,"tags":{"foo":"bar"}}`+"\n")
+
+	c.Check(EncodeBillingSnapshot(&buf, "xml", snapshot, true), ErrorMatches, `unsupported billing export format "xml"`)
+}
+
+func (s *billingSuite) TestFileSink(c *C) {
+	exp := s.exporter()
+	path := filepath.Join(c.MkDir(), "billing.csv")
+	exp.Sink = &FileBillingSink{Path: path, Format: BillingFormatCSV}
+	exp.Interval = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go exp.Run(ctx)
+	var lines []string
+	for ctx.Err() == nil && len(lines) < 7 {
+		time.Sleep(time.Millisecond)
+		buf, _ := os.ReadFile(path)
+		lines = strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	}
+	cancel()
+	c.Assert(len(lines) >= 7, Equals, true)
+	// Header is written only once.
+	c.Check(lines[0], Matches, `time,.*`)
+	c.Check(strings.Count(strings.Join(lines, "\n"), "time,instance_id"), Equals, 1)
+	c.Check(lines[1], Matches, `.*,i-1,m5,.*`)
+	c.Check(lines[4], Matches, `.*,i-1,m5,.*`)
+}
+
+func (s *billingSuite) TestObjectStoreSink(c *C) {
+	store := billingStubObjectStore{}
+	sink := &ObjectStoreBillingSink{Store: store, Prefix: "billing/", Format: BillingFormatJSON}
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.FixedZone("X", 3600))
+	snapshot, err := s.exporter().Snapshot(now)
+	c.Assert(err, IsNil)
+	c.Check(sink.WriteBillingSnapshot(context.Background(), snapshot), IsNil)
+	c.Assert(store["billing/20230102T020405Z.json"], NotNil)
+	c.Check(strings.Count(string(store["billing/20230102T020405Z.json"]), "\n"), Equals, 3)
+
+	// Empty snapshots are not written.
+	c.Check(sink.WriteBillingSnapshot(context.Background(), nil), IsNil)
+	c.Check(store, HasLen, 1)
+}
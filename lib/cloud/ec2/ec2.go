@@ -15,6 +15,7 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
@@ -38,7 +39,16 @@ import (
 )
 
 // Driver is the ec2 implementation of the cloud.Driver interface.
-var Driver = cloud.DriverFunc(newEC2InstanceSet)
+var Driver = ec2Driver{cloud.HTTPClientDriverFunc(newEC2InstanceSet)}
+
+type ec2Driver struct {
+	cloud.HTTPClientDriver
+}
+
+// ConfigSchema implements cloud.SchemaDriver.
+func (ec2Driver) ConfigSchema() *cloud.ConfigSchema {
+	return cloud.ConfigSchemaOf(ec2InstanceSetConfig{})
+}
 
 const (
 	throttleDelayMin = time.Second
@@ -122,7 +132,7 @@ type ec2InstanceSet struct {
 	mInstanceStarts *prometheus.CounterVec
 }
 
-func newEC2InstanceSet(confRaw json.RawMessage, instanceSetID cloud.InstanceSetID, _ cloud.SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (prv cloud.InstanceSet, err error) {
+func newEC2InstanceSet(httpClient *http.Client, confRaw json.RawMessage, instanceSetID cloud.InstanceSetID, _ cloud.SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (prv cloud.InstanceSet, err error) {
 	instanceSet := &ec2InstanceSet{
 		instanceSetID: instanceSetID,
 		logger:        logger,
@@ -150,6 +160,12 @@ func newEC2InstanceSet(confRaw json.RawMessage, instanceSetID cloud.InstanceSetI
 				},
 			}
 			return nil
+		},
+		func(o *config.LoadOptions) error {
+			if httpClient != nil {
+				o.HTTPClient = httpClient
+			}
+			return nil
 		})
 	if err != nil {
 		return nil, err
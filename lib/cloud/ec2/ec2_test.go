@@ -242,11 +242,11 @@ func GetInstanceSet(c *check.C, conf string) (*ec2InstanceSet, cloud.ImageID, ar
 		err := config.LoadFile(&exampleCfg, *live)
 		c.Assert(err, check.IsNil)
 
-		is, err := newEC2InstanceSet(exampleCfg.DriverParameters, "test123", nil, logrus.StandardLogger(), reg)
+		is, err := newEC2InstanceSet(nil, exampleCfg.DriverParameters, "test123", nil, logrus.StandardLogger(), reg)
 		c.Assert(err, check.IsNil)
 		return is.(*ec2InstanceSet), cloud.ImageID(exampleCfg.ImageIDForTestSuite), cluster, reg
 	} else {
-		is, err := newEC2InstanceSet(json.RawMessage(conf), "test123", nil, ctxlog.TestLogger(c), reg)
+		is, err := newEC2InstanceSet(nil, json.RawMessage(conf), "test123", nil, ctxlog.TestLogger(c), reg)
 		c.Assert(err, check.IsNil)
 		is.(*ec2InstanceSet).client = &ec2stub{c: c, reftime: time.Now().UTC()}
 		return is.(*ec2InstanceSet), cloud.ImageID("blob"), cluster, reg
@@ -0,0 +1,740 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package gce
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Driver is the GCE implementation of the cloud.Driver interface.
+var Driver = gceDriver{cloud.HTTPClientDriverFunc(newGCEInstanceSet)}
+
+type gceDriver struct {
+	cloud.HTTPClientDriver
+}
+
+// ConfigSchema implements cloud.SchemaDriver.
+func (gceDriver) ConfigSchema() *cloud.ConfigSchema {
+	return cloud.ConfigSchemaOf(gceInstanceSetConfig{})
+}
+
+const (
+	throttleDelayMin = time.Second
+	throttleDelayMax = time.Minute
+
+	// Prefix of the names of instances created by the driver.
+	instanceNamePrefix = "compute-"
+)
+
+type gceInstanceSetConfig struct {
+	AuthMethod              string
+	CredentialsFile         string
+	Project                 string
+	Zones                   []string
+	Network                 string
+	Subnetwork              string
+	NetworkTags             []string
+	ExternalIP              bool
+	ServiceAccount          string
+	ServiceAccountScopes    []string
+	DiskType                string
+	BootDiskSizeGB          int64
+	AdminUsername           string
+	InstanceTypeQuotaGroups map[string]string
+}
+
+// computeAPI is the subset of the Compute Engine API used by the
+// driver. Tests substitute a stub.
+type computeAPI interface {
+	// Insert starts creating an instance, and returns the
+	// operation.
+	Insert(ctx context.Context, project, zone string, inst *compute.Instance) (*compute.Operation, error)
+	// Wait returns the given zone operation when it is done, or
+	// after about 2 minutes, whichever comes first.
+	Wait(ctx context.Context, project, zone, operation string) (*compute.Operation, error)
+	// List calls fn for each instance in the project (in all
+	// zones) that matches the given filter expression.
+	List(ctx context.Context, project, filter string, fn func(*compute.Instance)) error
+	Get(ctx context.Context, project, zone, name string) (*compute.Instance, error)
+	SetLabels(ctx context.Context, project, zone, name string, req *compute.InstancesSetLabelsRequest) (*compute.Operation, error)
+	Delete(ctx context.Context, project, zone, name string) (*compute.Operation, error)
+}
+
+// computeClient implements computeAPI using the Compute Engine API
+// client.
+type computeClient struct {
+	svc *compute.Service
+}
+
+func (cc computeClient) Insert(ctx context.Context, project, zone string, inst *compute.Instance) (*compute.Operation, error) {
+	return cc.svc.Instances.Insert(project, zone, inst).Context(ctx).Do()
+}
+
+func (cc computeClient) Wait(ctx context.Context, project, zone, operation string) (*compute.Operation, error) {
+	return cc.svc.ZoneOperations.Wait(project, zone, operation).Context(ctx).Do()
+}
+
+func (cc computeClient) List(ctx context.Context, project, filter string, fn func(*compute.Instance)) error {
+	return cc.svc.Instances.AggregatedList(project).Filter(filter).Pages(ctx, func(page *compute.InstanceAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, inst := range scoped.Instances {
+				fn(inst)
+			}
+		}
+		return nil
+	})
+}
+
+func (cc computeClient) Get(ctx context.Context, project, zone, name string) (*compute.Instance, error) {
+	return cc.svc.Instances.Get(project, zone, name).Context(ctx).Do()
+}
+
+func (cc computeClient) SetLabels(ctx context.Context, project, zone, name string, req *compute.InstancesSetLabelsRequest) (*compute.Operation, error) {
+	return cc.svc.Instances.SetLabels(project, zone, name, req).Context(ctx).Do()
+}
+
+func (cc computeClient) Delete(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+	return cc.svc.Instances.Delete(project, zone, name).Context(ctx).Do()
+}
+
+type gceInstanceSet struct {
+	gceconfig              gceInstanceSetConfig
+	project                string
+	instanceSetID          cloud.InstanceSetID
+	logger                 logrus.FieldLogger
+	client                 computeAPI
+	nextZone               int32
+	throttleDelayCreate    atomic.Value
+	throttleDelayInstances atomic.Value
+
+	mInstances      *prometheus.GaugeVec
+	mInstanceStarts *prometheus.CounterVec
+}
+
+func newGCEInstanceSet(httpClient *http.Client, confRaw json.RawMessage, instanceSetID cloud.InstanceSetID, _ cloud.SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (cloud.InstanceSet, error) {
+	instanceSet := &gceInstanceSet{
+		instanceSetID: instanceSetID,
+		logger:        logger,
+	}
+	err := json.Unmarshal(confRaw, &instanceSet.gceconfig)
+	if err != nil {
+		return nil, err
+	}
+	if len(instanceSet.gceconfig.Zones) == 0 {
+		return nil, errors.New("invalid configuration: Zones must not be empty")
+	}
+	for _, zone := range instanceSet.gceconfig.Zones {
+		if zone == "" {
+			return nil, errors.New("invalid configuration: empty string in Zones")
+		}
+	}
+	if instanceSet.gceconfig.DiskType == "" {
+		instanceSet.gceconfig.DiskType = "pd-balanced"
+	}
+
+	ctx := context.Background()
+	if httpClient != nil {
+		// Use the given client to get tokens, too.
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+	}
+	creds, err := instanceSet.gceconfig.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instanceSet.project = instanceSet.gceconfig.Project
+	if instanceSet.project == "" {
+		instanceSet.project = creds.ProjectID
+	}
+	if instanceSet.project == "" {
+		return nil, errors.New("invalid configuration: Project is not set, and cannot be determined from credentials")
+	}
+	var opt option.ClientOption
+	if httpClient != nil {
+		opt = option.WithHTTPClient(&http.Client{
+			Transport: &oauth2.Transport{Source: creds.TokenSource, Base: httpClient.Transport},
+			Timeout:   httpClient.Timeout,
+		})
+	} else {
+		opt = option.WithCredentials(creds)
+	}
+	svc, err := compute.NewService(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	instanceSet.client = computeClient{svc}
+
+	instanceSet.mInstances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "gce_instances",
+		Help:      "Number of instances running",
+	}, []string{"zone"})
+	instanceSet.mInstanceStarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "gce_instance_starts_total",
+		Help:      "Number of attempts to start a new instance",
+	}, []string{"zone", "success"})
+	for _, zone := range instanceSet.gceconfig.Zones {
+		instanceSet.mInstanceStarts.WithLabelValues(zone, "0").Add(0)
+		instanceSet.mInstanceStarts.WithLabelValues(zone, "1").Add(0)
+	}
+	if reg != nil {
+		reg.MustRegister(instanceSet.mInstances)
+		reg.MustRegister(instanceSet.mInstanceStarts)
+	}
+	return instanceSet, nil
+}
+
+// credentials returns the credentials to use for API calls,
+// according to AuthMethod:
+//
+// "service-account": the service account key in CredentialsFile.
+//
+// "workload-identity": the workload identity federation
+// configuration in CredentialsFile, or, if CredentialsFile is
+// empty, the credentials provided by the metadata server (e.g., a
+// GKE workload identity, or the service account attached to the VM
+// the dispatcher runs on).
+//
+// "" (default): CredentialsFile if set, otherwise Application
+// Default Credentials.
+func (cfg gceInstanceSetConfig) credentials(ctx context.Context) (*google.Credentials, error) {
+	var wantType string
+	switch cfg.AuthMethod {
+	case "":
+	case "service-account":
+		if cfg.CredentialsFile == "" {
+			return nil, errors.New("invalid configuration: AuthMethod is \"service-account\" but CredentialsFile is empty")
+		}
+		wantType = "service_account"
+	case "workload-identity":
+		if cfg.CredentialsFile == "" {
+			return google.FindDefaultCredentials(ctx, compute.ComputeScope)
+		}
+		wantType = "external_account"
+	default:
+		return nil, fmt.Errorf("invalid configuration: unsupported AuthMethod %q", cfg.AuthMethod)
+	}
+	if cfg.CredentialsFile == "" {
+		return google.FindDefaultCredentials(ctx, compute.ComputeScope)
+	}
+	buf, err := os.ReadFile(cfg.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var f struct{ Type string }
+	err = json.Unmarshal(buf, &f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.CredentialsFile, err)
+	}
+	if wantType != "" && f.Type != wantType {
+		return nil, fmt.Errorf("%s: credentials type is %q, but AuthMethod %q requires %q", cfg.CredentialsFile, f.Type, cfg.AuthMethod, wantType)
+	}
+	return google.CredentialsFromJSON(ctx, buf, compute.ComputeScope)
+}
+
+func (instanceSet *gceInstanceSet) Create(
+	instanceType arvados.InstanceType,
+	imageID cloud.ImageID,
+	newTags cloud.InstanceTags,
+	initCommand cloud.InitCommand,
+	publicKey ssh.PublicKey) (cloud.Instance, error) {
+
+	labels, err := tagsToLabels(newTags)
+	if err != nil {
+		return nil, err
+	}
+	name, err := newInstanceName()
+	if err != nil {
+		return nil, err
+	}
+	startupScript := "#!/bin/sh\n" + string(initCommand) + "\n"
+	metadata := []*compute.MetadataItems{{
+		Key:   "startup-script",
+		Value: &startupScript,
+	}}
+	if publicKey != nil {
+		sshKeys := instanceSet.gceconfig.AdminUsername + ":" + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+		metadata = append(metadata, &compute.MetadataItems{
+			Key:   "ssh-keys",
+			Value: &sshKeys,
+		})
+	}
+
+	var accessConfigs []*compute.AccessConfig
+	if instanceSet.gceconfig.ExternalIP {
+		accessConfigs = []*compute.AccessConfig{{
+			Name: "External NAT",
+			Type: "ONE_TO_ONE_NAT",
+		}}
+	}
+	var serviceAccounts []*compute.ServiceAccount
+	if sa := instanceSet.gceconfig.ServiceAccount; sa != "" {
+		scopes := instanceSet.gceconfig.ServiceAccountScopes
+		if len(scopes) == 0 {
+			scopes = []string{compute.CloudPlatformScope}
+		}
+		serviceAccounts = []*compute.ServiceAccount{{
+			Email:  sa,
+			Scopes: scopes,
+		}}
+	}
+	var networkTags *compute.Tags
+	if len(instanceSet.gceconfig.NetworkTags) > 0 {
+		networkTags = &compute.Tags{Items: instanceSet.gceconfig.NetworkTags}
+	}
+	scheduling := &compute.Scheduling{
+		AutomaticRestart:  googleapi.Bool(false),
+		OnHostMaintenance: "MIGRATE",
+	}
+	if instanceType.CUDA.DeviceCount > 0 {
+		// Instances with GPUs cannot be live-migrated.
+		scheduling.OnHostMaintenance = "TERMINATE"
+	}
+	if instanceType.Preemptible {
+		scheduling = &compute.Scheduling{
+			AutomaticRestart:          googleapi.Bool(false),
+			OnHostMaintenance:         "TERMINATE",
+			Preemptible:               true,
+			ProvisioningModel:         "SPOT",
+			InstanceTerminationAction: "DELETE",
+		}
+	}
+
+	var errToReturn error
+	var returningCapacityError bool
+	zones := instanceSet.gceconfig.Zones
+	nextZone := int(atomic.AddInt32(&instanceSet.nextZone, 1)) - 1
+	for tryOffset := 0; tryOffset < len(zones); tryOffset++ {
+		zone := zones[(nextZone+tryOffset)%len(zones)]
+		disks := []*compute.AttachedDisk{{
+			Boot:       true,
+			AutoDelete: true,
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				SourceImage: string(imageID),
+				DiskSizeGb:  instanceSet.gceconfig.BootDiskSizeGB,
+				DiskType:    "zones/" + zone + "/diskTypes/" + instanceSet.gceconfig.DiskType,
+				Labels:      labels,
+			},
+		}}
+		if instanceType.AddedScratch > 0 {
+			disks = append(disks, &compute.AttachedDisk{
+				AutoDelete: true,
+				DeviceName: "scratch",
+				InitializeParams: &compute.AttachedDiskInitializeParams{
+					// ceil(added scratch space in GiB)
+					DiskSizeGb: (int64(instanceType.AddedScratch) + 1<<30 - 1) >> 30,
+					DiskType:   "zones/" + zone + "/diskTypes/" + instanceSet.gceconfig.DiskType,
+					Labels:     labels,
+				},
+			})
+		}
+		inst := &compute.Instance{
+			Name:        name,
+			MachineType: "zones/" + zone + "/machineTypes/" + instanceType.ProviderType,
+			Labels:      labels,
+			Disks:       disks,
+			NetworkInterfaces: []*compute.NetworkInterface{{
+				Network:       instanceSet.gceconfig.Network,
+				Subnetwork:    instanceSet.gceconfig.Subnetwork,
+				AccessConfigs: accessConfigs,
+			}},
+			Metadata:        &compute.Metadata{Items: metadata},
+			Scheduling:      scheduling,
+			ServiceAccounts: serviceAccounts,
+			Tags:            networkTags,
+		}
+		err := instanceSet.insert(zone, inst)
+		instanceSet.mInstanceStarts.WithLabelValues(zone, boolLabelValue[err == nil]).Add(1)
+		if err == nil {
+			inst.Zone = zone
+			inst.Status = "PROVISIONING"
+			return &gceInstance{provider: instanceSet, instance: inst}, nil
+		}
+		if instcap, groupcap := isErrorCapacity(err); !returningCapacityError || instcap || groupcap {
+			// Return the last capacity error, if any;
+			// otherwise the last non-capacity error.
+			errToReturn = err
+			returningCapacityError = instcap || groupcap
+		}
+		if !isErrorZoneSpecific(err) {
+			break
+		}
+		instanceSet.logger.WithError(err).WithField("Zone", zone).
+			Warn("instance creation failed, trying next zone")
+	}
+	return nil, wrapError(errToReturn, &instanceSet.throttleDelayCreate)
+}
+
+// insert creates the given instance, and waits for the operation
+// to finish so errors that are only reported asynchronously (like
+// insufficient capacity in the zone) can be handled.
+func (instanceSet *gceInstanceSet) insert(zone string, inst *compute.Instance) error {
+	ctx := context.Background()
+	op, err := instanceSet.client.Insert(ctx, instanceSet.project, zone, inst)
+	for err == nil && op.Status != "DONE" {
+		op, err = instanceSet.client.Wait(ctx, instanceSet.project, zone, op.Name)
+	}
+	if err != nil {
+		return err
+	}
+	return operationError(op)
+}
+
+// newInstanceName returns a random name for a new instance.
+func newInstanceName() (string, error) {
+	var buf [10]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%x", instanceNamePrefix, buf), nil
+}
+
+func (instanceSet *gceInstanceSet) Instances(tags cloud.InstanceTags) ([]cloud.Instance, error) {
+	labels, err := tagsToLabels(tags)
+	if err != nil {
+		return nil, err
+	}
+	var filters []string
+	for k, v := range labels {
+		filters = append(filters, fmt.Sprintf("(labels.%s = %q)", k, v))
+	}
+	sort.Strings(filters)
+	var instances []cloud.Instance
+	zoneInstances := map[string]int{}
+	for _, zone := range instanceSet.gceconfig.Zones {
+		zoneInstances[zone] = 0
+	}
+	err = instanceSet.client.List(context.Background(), instanceSet.project, strings.Join(filters, " AND "), func(inst *compute.Instance) {
+		instances = append(instances, &gceInstance{provider: instanceSet, instance: inst})
+		zoneInstances[path.Base(inst.Zone)]++
+	})
+	err = wrapError(err, &instanceSet.throttleDelayInstances)
+	if err != nil {
+		return nil, err
+	}
+	for zone, count := range zoneInstances {
+		instanceSet.mInstances.WithLabelValues(zone).Set(float64(count))
+	}
+	return instances, nil
+}
+
+func (instanceSet *gceInstanceSet) Stop() {
+}
+
+// InstanceQuotaGroup returns the machine family (e.g., "n2" for
+// "n2-standard-4"), which corresponds to a regional CPU quota like
+// N2_CPUS, or the configured group in InstanceTypeQuotaGroups. The
+// N1, E2, F1, and G1 families share the CPUS quota, so they are in
+// the same group by default.
+func (instanceSet *gceInstanceSet) InstanceQuotaGroup(it arvados.InstanceType) cloud.InstanceQuotaGroup {
+	family := strings.ToLower(it.ProviderType)
+	if i := strings.Index(family, "-"); i > 0 {
+		family = family[:i]
+	}
+	group := family
+	if conf := instanceSet.gceconfig.InstanceTypeQuotaGroups[family]; conf != "" {
+		group = conf
+	} else if family == "n1" || family == "e2" || family == "f1" || family == "g1" {
+		group = "cpus"
+	}
+	if it.Preemptible {
+		// Spot VMs use the separate PREEMPTIBLE_CPUS quota
+		// where it has been granted.
+		group += "-spot"
+	}
+	return cloud.InstanceQuotaGroup(group)
+}
+
+type gceInstance struct {
+	provider *gceInstanceSet
+	mtx      sync.Mutex
+	instance *compute.Instance
+}
+
+func (inst *gceInstance) ID() cloud.InstanceID {
+	return cloud.InstanceID(inst.instance.Name)
+}
+
+func (inst *gceInstance) String() string {
+	return inst.instance.Name
+}
+
+func (inst *gceInstance) ProviderType() string {
+	return path.Base(inst.instance.MachineType)
+}
+
+func (inst *gceInstance) zone() string {
+	return path.Base(inst.instance.Zone)
+}
+
+// SetTags replaces the instance's labels. If the instance's labels
+// have been changed since it was retrieved, its current label
+// fingerprint is retrieved and the update is retried.
+func (inst *gceInstance) SetTags(newTags cloud.InstanceTags) error {
+	labels, err := tagsToLabels(newTags)
+	if err != nil {
+		return err
+	}
+	inst.mtx.Lock()
+	defer inst.mtx.Unlock()
+	ctx := context.Background()
+	project := inst.provider.project
+	for attempt := 0; ; attempt++ {
+		var op *compute.Operation
+		op, err = inst.provider.client.SetLabels(ctx, project, inst.zone(), inst.instance.Name, &compute.InstancesSetLabelsRequest{
+			Labels:           labels,
+			LabelFingerprint: inst.instance.LabelFingerprint,
+		})
+		if err == nil {
+			err = operationError(op)
+		}
+		var gerr *googleapi.Error
+		if attempt > 0 || !errors.As(err, &gerr) || gerr.Code != http.StatusPreconditionFailed {
+			break
+		}
+		current, err := inst.provider.client.Get(ctx, project, inst.zone(), inst.instance.Name)
+		if err != nil {
+			return err
+		}
+		inst.instance.LabelFingerprint = current.LabelFingerprint
+	}
+	if err != nil {
+		return err
+	}
+	inst.instance.Labels = labels
+	return nil
+}
+
+func (inst *gceInstance) Tags() cloud.InstanceTags {
+	inst.mtx.Lock()
+	defer inst.mtx.Unlock()
+	return labelsToTags(inst.instance.Labels)
+}
+
+func (inst *gceInstance) Destroy() error {
+	op, err := inst.provider.client.Delete(context.Background(), inst.provider.project, inst.zone(), inst.instance.Name)
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return operationError(op)
+}
+
+func (inst *gceInstance) Address() string {
+	for _, ni := range inst.instance.NetworkInterfaces {
+		if inst.provider.gceconfig.ExternalIP {
+			for _, ac := range ni.AccessConfigs {
+				if ac.NatIP != "" {
+					return ac.NatIP
+				}
+			}
+		} else if ni.NetworkIP != "" {
+			return ni.NetworkIP
+		}
+	}
+	return ""
+}
+
+func (inst *gceInstance) RemoteUser() string {
+	return inst.provider.gceconfig.AdminUsername
+}
+
+func (inst *gceInstance) VerifyHostKey(ssh.PublicKey, *ssh.Client) error {
+	return cloud.ErrNotImplemented
+}
+
+func (inst *gceInstance) PriceHistory(arvados.InstanceType) []cloud.InstancePrice {
+	return nil
+}
+
+// State implements cloud.InstanceWithState.
+func (inst *gceInstance) State() cloud.InstanceState {
+	switch inst.instance.Status {
+	case "PROVISIONING", "STAGING":
+		return cloud.InstanceState{Provisioning: cloud.ProvisioningCreating, Power: cloud.PowerStarting}
+	case "RUNNING":
+		return cloud.InstanceState{Provisioning: cloud.ProvisioningSucceeded, Power: cloud.PowerRunning}
+	case "STOPPING", "SUSPENDING":
+		return cloud.InstanceState{Provisioning: cloud.ProvisioningSucceeded, Power: cloud.PowerStopping}
+	case "STOPPED", "SUSPENDED", "TERMINATED":
+		return cloud.InstanceState{Provisioning: cloud.ProvisioningSucceeded, Power: cloud.PowerStopped}
+	default:
+		return cloud.InstanceState{}
+	}
+}
+
+// operationErr is the error of a failed operation.
+type operationErr struct {
+	*compute.OperationErrorErrors
+}
+
+func (err operationErr) Error() string {
+	return err.Code + ": " + err.Message
+}
+
+// operationError returns the error reported by a finished
+// operation, or nil if it succeeded.
+func operationError(op *compute.Operation) error {
+	if op == nil || op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+	return operationErr{op.Error.Errors[0]}
+}
+
+type rateLimitError struct {
+	error
+	earliestRetry time.Time
+}
+
+func (err rateLimitError) EarliestRetry() time.Time {
+	return err.earliestRetry
+}
+
+type capacityError struct {
+	error
+	isInstanceQuotaGroupSpecific bool
+	isInstanceTypeSpecific       bool
+}
+
+func (er *capacityError) IsCapacityError() bool {
+	return true
+}
+
+func (er *capacityError) IsInstanceQuotaGroupSpecific() bool {
+	return er.isInstanceQuotaGroupSpecific
+}
+
+func (er *capacityError) IsInstanceTypeSpecific() bool {
+	return er.isInstanceTypeSpecific
+}
+
+type gceQuotaError struct {
+	error
+}
+
+func (er *gceQuotaError) IsQuotaError() bool {
+	return true
+}
+
+// errorCode returns the error code of a failed operation, or the
+// reason given in an API error response.
+func errorCode(err error) string {
+	var operr operationErr
+	if errors.As(err, &operr) {
+		return operr.Code
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && len(gerr.Errors) > 0 {
+		return gerr.Errors[0].Reason
+	}
+	return ""
+}
+
+func isThrottleError(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	code := errorCode(err)
+	return code == "rateLimitExceeded" || code == "userRateLimitExceeded"
+}
+
+// isErrorQuota returns true if the error indicates a project or
+// regional quota has been reached, other than a CPU quota (see
+// isErrorCapacity).
+func isErrorQuota(err error) bool {
+	code := errorCode(err)
+	return (code == "QUOTA_EXCEEDED" || code == "quotaExceeded") && !isCPUQuotaError(err)
+}
+
+func isCPUQuotaError(err error) bool {
+	return strings.Contains(err.Error(), "CPUS")
+}
+
+// isErrorZoneSpecific returns true if the error might be avoided by
+// trying a different zone.
+func isErrorZoneSpecific(err error) bool {
+	switch errorCode(err) {
+	case "ZONE_RESOURCE_POOL_EXHAUSTED",
+		"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS",
+		"RESOURCE_AVAILABILITY_RISK",
+		"UNSUPPORTED_OPERATION":
+		return true
+	}
+	return false
+}
+
+// isErrorCapacity determines whether the given error indicates lack
+// of capacity to run a specific instance type (i.e., retrying with
+// any other instance type might succeed) or an instance quota group
+// (i.e., a machine family's CPU quota has been reached, so retrying
+// with an instance type in a different family might succeed).
+func isErrorCapacity(err error) (instcap bool, groupcap bool) {
+	code := errorCode(err)
+	if (code == "QUOTA_EXCEEDED" || code == "quotaExceeded") && isCPUQuotaError(err) {
+		return false, true
+	}
+	if code == "ZONE_RESOURCE_POOL_EXHAUSTED" ||
+		code == "ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS" {
+		return true, false
+	}
+	return false, false
+}
+
+func wrapError(err error, throttleValue *atomic.Value) error {
+	if isThrottleError(err) {
+		// Back off exponentially until an upstream call
+		// either succeeds or returns a non-throttle error.
+		d, _ := throttleValue.Load().(time.Duration)
+		d = d*3/2 + time.Second
+		if d < throttleDelayMin {
+			d = throttleDelayMin
+		} else if d > throttleDelayMax {
+			d = throttleDelayMax
+		}
+		throttleValue.Store(d)
+		return rateLimitError{error: err, earliestRetry: time.Now().Add(d)}
+	} else if isErrorQuota(err) {
+		return &gceQuotaError{error: err}
+	} else if instcap, groupcap := isErrorCapacity(err); instcap || groupcap {
+		return &capacityError{
+			error:                        err,
+			isInstanceTypeSpecific:       !groupcap,
+			isInstanceQuotaGroupSpecific: groupcap,
+		}
+	}
+	throttleValue.Store(time.Duration(0))
+	return err
+}
+
+var boolLabelValue = map[bool]string{false: "0", true: "1"}
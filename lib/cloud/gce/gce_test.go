@@ -0,0 +1,404 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package gce
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	check "gopkg.in/check.v1"
+)
+
+// Gocheck boilerplate
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type labelSuite struct{}
+
+var _ = check.Suite(&labelSuite{})
+
+func (s *labelSuite) TestEncodeDecode(c *check.C) {
+	for _, trial := range []struct {
+		key      string
+		value    string
+		labelKey string
+		labelVal string
+	}{
+		{"ArvadosInstanceType", "m5.large", "x_arvados_instance_type", "m5__2elarge"},
+		{"foo-bar", "", "foo-bar", ""},
+		{"owner", "Foo_Bar 1", "owner", "_foo__5f_bar__201"},
+		{"9lives", "9", "x9lives", "9"},
+		{"xFoo", "x", "x__78_foo", "x"},
+		{"x", "x", "x__78", "x"},
+		{"xyz", "xyz", "xyz", "xyz"},
+		{"", "", "x", ""},
+	} {
+		c.Logf("trial %+v", trial)
+		labels, err := tagsToLabels(cloud.InstanceTags{trial.key: trial.value})
+		c.Assert(err, check.IsNil)
+		c.Check(labels, check.DeepEquals, map[string]string{trial.labelKey: trial.labelVal})
+		c.Check(labelsToTags(labels), check.DeepEquals, cloud.InstanceTags{trial.key: trial.value})
+	}
+}
+
+func (s *labelSuite) TestTooLong(c *check.C) {
+	long := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklm"
+	_, err := tagsToLabels(cloud.InstanceTags{long: "x"})
+	c.Check(err, check.ErrorMatches, `cannot use tag .* encoded key .* is longer than 63 characters`)
+	_, err = tagsToLabels(cloud.InstanceTags{"x": long})
+	c.Check(err, check.ErrorMatches, `cannot use tag .* encoded value .* is longer than 63 characters`)
+}
+
+// Labels added by other tools are returned as-is.
+func (s *labelSuite) TestForeignLabels(c *check.C) {
+	c.Check(labelsToTags(map[string]string{"env": "prod", "goog-a": "b_1"}), check.DeepEquals,
+		cloud.InstanceTags{"env": "prod", "goog-a": "b_1"})
+}
+
+type gceStub struct {
+	sync.Mutex
+	instances map[string]*compute.Instance // zone/name => instance
+	inserts   []string                     // zones
+	listed    []string                     // filters
+	// {zone => error code}: Insert fails with the given code
+	// if the zone matches.
+	zoneErrors map[string]string
+	// Number of SetLabels calls that fail with a fingerprint
+	// mismatch before succeeding.
+	staleFingerprints int
+}
+
+func (stub *gceStub) Insert(ctx context.Context, project, zone string, inst *compute.Instance) (*compute.Operation, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	stub.inserts = append(stub.inserts, zone)
+	if code := stub.zoneErrors[zone]; code != "" {
+		return &compute.Operation{Name: "op-" + inst.Name, Status: "RUNNING", Zone: zone, Error: &compute.OperationError{
+			Errors: []*compute.OperationErrorErrors{{Code: code, Message: "test error in " + zone}},
+		}}, nil
+	}
+	copy := *inst
+	copy.Zone = "https://www.googleapis.com/compute/v1/projects/" + project + "/zones/" + zone
+	copy.MachineType = "https://www.googleapis.com/compute/v1/projects/" + project + "/" + inst.MachineType
+	copy.Status = "RUNNING"
+	copy.LabelFingerprint = "fp0"
+	copy.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.1.2.3"}}
+	stub.instances[zone+"/"+inst.Name] = &copy
+	return &compute.Operation{Name: "op-" + inst.Name, Status: "RUNNING", Zone: zone}, nil
+}
+
+func (stub *gceStub) Wait(ctx context.Context, project, zone, operation string) (*compute.Operation, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	op := &compute.Operation{Name: operation, Status: "DONE", Zone: zone}
+	if code := stub.zoneErrors[zone]; code != "" {
+		op.Error = &compute.OperationError{
+			Errors: []*compute.OperationErrorErrors{{Code: code, Message: "test error in " + zone}},
+		}
+	}
+	return op, nil
+}
+
+func (stub *gceStub) List(ctx context.Context, project, filter string, fn func(*compute.Instance)) error {
+	stub.Lock()
+	defer stub.Unlock()
+	stub.listed = append(stub.listed, filter)
+	for _, inst := range stub.instances {
+		fn(inst)
+	}
+	return nil
+}
+
+func (stub *gceStub) Get(ctx context.Context, project, zone, name string) (*compute.Instance, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	inst, ok := stub.instances[zone+"/"+name]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	return inst, nil
+}
+
+func (stub *gceStub) SetLabels(ctx context.Context, project, zone, name string, req *compute.InstancesSetLabelsRequest) (*compute.Operation, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	inst, ok := stub.instances[zone+"/"+name]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	if stub.staleFingerprints > 0 {
+		stub.staleFingerprints--
+		inst.LabelFingerprint += "x"
+	}
+	if req.LabelFingerprint != inst.LabelFingerprint {
+		return nil, &googleapi.Error{Code: http.StatusPreconditionFailed}
+	}
+	inst.Labels = req.Labels
+	inst.LabelFingerprint += "+"
+	return &compute.Operation{Status: "DONE"}, nil
+}
+
+func (stub *gceStub) Delete(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	if _, ok := stub.instances[zone+"/"+name]; !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	delete(stub.instances, zone+"/"+name)
+	return &compute.Operation{Status: "DONE"}, nil
+}
+
+type GCEInstanceSetSuite struct {
+	credsFile string
+}
+
+var _ = check.Suite(&GCEInstanceSetSuite{})
+
+func (s *GCEInstanceSetSuite) SetUpTest(c *check.C) {
+	s.credsFile = filepath.Join(c.MkDir(), "creds.json")
+	buf, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "test-project",
+		"client_email": "test@test-project.iam.gserviceaccount.com",
+		"private_key":  "unused",
+		"token_uri":    "https://oauth2.example/token",
+	})
+	c.Assert(os.WriteFile(s.credsFile, buf, 0600), check.IsNil)
+}
+
+func (s *GCEInstanceSetSuite) newInstanceSet(c *check.C, params map[string]interface{}, reg *prometheus.Registry) (*gceInstanceSet, *gceStub) {
+	conf := map[string]interface{}{
+		"CredentialsFile": s.credsFile,
+		"Zones":           []string{"us-central1-a", "us-central1-b"},
+		"AdminUsername":   "crunch",
+	}
+	for k, v := range params {
+		conf[k] = v
+	}
+	buf, _ := json.Marshal(conf)
+	is, err := newGCEInstanceSet(nil, buf, "test123", nil, ctxlog.TestLogger(c), reg)
+	c.Assert(err, check.IsNil)
+	stub := &gceStub{instances: map[string]*compute.Instance{}}
+	is.(*gceInstanceSet).client = stub
+	return is.(*gceInstanceSet), stub
+}
+
+func (s *GCEInstanceSetSuite) TestConfig(c *check.C) {
+	is, _ := s.newInstanceSet(c, nil, nil)
+	c.Check(is.project, check.Equals, "test-project")
+	c.Check(is.gceconfig.DiskType, check.Equals, "pd-balanced")
+	is, _ = s.newInstanceSet(c, map[string]interface{}{"Project": "other-project", "AuthMethod": "service-account"}, nil)
+	c.Check(is.project, check.Equals, "other-project")
+
+	for _, trial := range []struct {
+		conf map[string]interface{}
+		err  string
+	}{
+		{map[string]interface{}{"Zones": []string{}, "CredentialsFile": s.credsFile}, `.*Zones must not be empty`},
+		{map[string]interface{}{"Zones": []string{""}, "CredentialsFile": s.credsFile}, `.*empty string in Zones`},
+		{map[string]interface{}{"Zones": []string{"z"}, "AuthMethod": "service-account"}, `.*CredentialsFile is empty`},
+		{map[string]interface{}{"Zones": []string{"z"}, "AuthMethod": "workload-identity", "CredentialsFile": s.credsFile}, `.*credentials type is "service_account", but AuthMethod "workload-identity" requires "external_account"`},
+		{map[string]interface{}{"Zones": []string{"z"}, "AuthMethod": "magic"}, `.*unsupported AuthMethod "magic"`},
+	} {
+		buf, _ := json.Marshal(trial.conf)
+		_, err := newGCEInstanceSet(nil, buf, "test123", nil, ctxlog.TestLogger(c), nil)
+		c.Check(err, check.ErrorMatches, trial.err)
+	}
+}
+
+func (s *GCEInstanceSetSuite) TestCreate(c *check.C) {
+	reg := prometheus.NewRegistry()
+	is, stub := s.newInstanceSet(c, map[string]interface{}{
+		"Network":        "global/networks/arvados",
+		"ServiceAccount": "compute@test-project.iam.gserviceaccount.com",
+		"NetworkTags":    []string{"compute"},
+	}, reg)
+	pk, _ := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+
+	inst, err := is.Create(arvados.InstanceType{
+		ProviderType: "n2-standard-4",
+		AddedScratch: 3<<30 + 1,
+	}, "projects/debian-cloud/global/images/family/debian-12", cloud.InstanceTags{
+		"ArvadosInstanceType": "n2.4",
+	}, "echo hello", pk)
+	c.Assert(err, check.IsNil)
+	c.Check(inst.Tags(), check.DeepEquals, cloud.InstanceTags{"ArvadosInstanceType": "n2.4"})
+	c.Check(inst.ProviderType(), check.Equals, "n2-standard-4")
+	c.Check(inst.RemoteUser(), check.Equals, "crunch")
+	c.Check(inst.(cloud.InstanceWithState).State().Power, check.Equals, cloud.PowerStarting)
+
+	created := stub.instances["us-central1-a/"+inst.String()]
+	c.Assert(created, check.NotNil)
+	c.Check(created.Name, check.Matches, `compute-[0-9a-f]{20}`)
+	c.Check(created.MachineType, check.Matches, `.*/zones/us-central1-a/machineTypes/n2-standard-4`)
+	c.Check(created.Labels, check.DeepEquals, map[string]string{"x_arvados_instance_type": "n2__2e4"})
+	c.Check(created.Disks, check.HasLen, 2)
+	c.Check(created.Disks[0].InitializeParams.SourceImage, check.Equals, "projects/debian-cloud/global/images/family/debian-12")
+	c.Check(created.Disks[1].InitializeParams.DiskSizeGb, check.Equals, int64(4))
+	c.Check(created.Disks[1].InitializeParams.DiskType, check.Equals, "zones/us-central1-a/diskTypes/pd-balanced")
+	c.Check(created.NetworkInterfaces, check.HasLen, 1)
+	c.Check(created.ServiceAccounts[0].Scopes, check.DeepEquals, []string{compute.CloudPlatformScope})
+	c.Check(created.Tags.Items, check.DeepEquals, []string{"compute"})
+	c.Check(created.Scheduling.Preemptible, check.Equals, false)
+	c.Check(created.Scheduling.OnHostMaintenance, check.Equals, "MIGRATE")
+	metadata := map[string]string{}
+	for _, item := range created.Metadata.Items {
+		metadata[item.Key] = *item.Value
+	}
+	c.Check(metadata["startup-script"], check.Equals, "#!/bin/sh\necho hello\n")
+	c.Check(metadata["ssh-keys"], check.Matches, `crunch:ssh-rsa \S+`)
+
+	// Next instance goes in the next zone.
+	inst, err = is.Create(arvados.InstanceType{
+		ProviderType: "a2-highgpu-1g",
+		Preemptible:  true,
+		CUDA:         arvados.CUDAFeatures{DeviceCount: 1},
+	}, "image", nil, "", nil)
+	c.Assert(err, check.IsNil)
+	created = stub.instances["us-central1-b/"+inst.String()]
+	c.Assert(created, check.NotNil)
+	c.Check(created.Disks, check.HasLen, 1)
+	c.Check(created.Metadata.Items, check.HasLen, 1)
+	c.Check(created.Scheduling.Preemptible, check.Equals, true)
+	c.Check(created.Scheduling.ProvisioningModel, check.Equals, "SPOT")
+	c.Check(created.Scheduling.InstanceTerminationAction, check.Equals, "DELETE")
+	c.Check(created.Scheduling.OnHostMaintenance, check.Equals, "TERMINATE")
+
+	metrics := arvadostest.GatherMetricsAsString(reg)
+	c.Check(metrics, check.Matches, `(?ms).*gce_instance_starts_total{success="1",zone="us-central1-a"} 1\n.*`)
+	c.Check(metrics, check.Matches, `(?ms).*gce_instance_starts_total{success="1",zone="us-central1-b"} 1\n.*`)
+}
+
+func (s *GCEInstanceSetSuite) TestCreateZoneFailover(c *check.C) {
+	is, stub := s.newInstanceSet(c, map[string]interface{}{
+		"Zones": []string{"zone-a", "zone-b", "zone-c"},
+	}, nil)
+	stub.zoneErrors = map[string]string{
+		"zone-a": "ZONE_RESOURCE_POOL_EXHAUSTED",
+		"zone-b": "ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS",
+	}
+	inst, err := is.Create(arvados.InstanceType{ProviderType: "n2-standard-4"}, "image", nil, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(stub.inserts, check.DeepEquals, []string{"zone-a", "zone-b", "zone-c"})
+	c.Check(stub.instances["zone-c/"+inst.String()], check.NotNil)
+
+	// All zones exhausted: return a capacity error.
+	stub.inserts = nil
+	stub.zoneErrors["zone-c"] = "ZONE_RESOURCE_POOL_EXHAUSTED"
+	_, err = is.Create(arvados.InstanceType{ProviderType: "n2-standard-4"}, "image", nil, "", nil)
+	c.Check(stub.inserts, check.HasLen, 3)
+	var capErr cloud.CapacityError
+	c.Assert(errors.As(err, &capErr), check.Equals, true)
+	c.Check(capErr.IsCapacityError(), check.Equals, true)
+	c.Check(capErr.IsInstanceTypeSpecific(), check.Equals, true)
+
+	// Errors that are not zone-specific are returned right away.
+	stub.inserts = nil
+	stub.zoneErrors = map[string]string{"zone-a": "QUOTA_EXCEEDED", "zone-b": "QUOTA_EXCEEDED", "zone-c": "QUOTA_EXCEEDED"}
+	_, err = is.Create(arvados.InstanceType{ProviderType: "n2-standard-4"}, "image", nil, "", nil)
+	c.Check(stub.inserts, check.HasLen, 1)
+	var quotaErr cloud.QuotaError
+	c.Check(errors.As(err, &quotaErr), check.Equals, true)
+}
+
+func (s *GCEInstanceSetSuite) TestInstancesAndTags(c *check.C) {
+	is, stub := s.newInstanceSet(c, nil, nil)
+	tags := cloud.InstanceTags{"ArvadosInstanceSetID": "test123", "ArvadosInstanceType": "tiny"}
+	inst, err := is.Create(arvados.InstanceType{ProviderType: "e2-small"}, "image", tags, "", nil)
+	c.Assert(err, check.IsNil)
+
+	list, err := is.Instances(cloud.InstanceTags{"ArvadosInstanceSetID": "test123"})
+	c.Assert(err, check.IsNil)
+	c.Check(stub.listed, check.DeepEquals, []string{`(labels.x_arvados_instance_set_i_d = "test123")`})
+	c.Assert(list, check.HasLen, 1)
+	c.Check(list[0].ID(), check.Equals, inst.ID())
+	c.Check(list[0].Address(), check.Equals, "10.1.2.3")
+	c.Check(list[0].Tags(), check.DeepEquals, tags)
+	c.Check(list[0].(cloud.InstanceWithState).State(), check.Equals, cloud.InstanceState{
+		Provisioning: cloud.ProvisioningSucceeded,
+		Power:        cloud.PowerRunning,
+	})
+
+	// SetTags retries once with the current label fingerprint.
+	stub.staleFingerprints = 1
+	tags["ArvadosIdleBehavior"] = "hold"
+	err = list[0].SetTags(tags)
+	c.Assert(err, check.IsNil)
+	c.Check(list[0].Tags(), check.DeepEquals, tags)
+	list, err = is.Instances(nil)
+	c.Assert(err, check.IsNil)
+	c.Check(stub.listed[1], check.Equals, "")
+	c.Check(list[0].Tags(), check.DeepEquals, tags)
+
+	stub.staleFingerprints = 2
+	err = list[0].SetTags(cloud.InstanceTags{})
+	c.Check(err, check.ErrorMatches, `.*412.*`)
+
+	c.Check(list[0].Destroy(), check.IsNil)
+	c.Check(stub.instances, check.HasLen, 0)
+	// Destroying an instance that is already gone is not an
+	// error.
+	c.Check(list[0].Destroy(), check.IsNil)
+}
+
+func (s *GCEInstanceSetSuite) TestInstanceQuotaGroup(c *check.C) {
+	is, _ := s.newInstanceSet(c, map[string]interface{}{
+		"InstanceTypeQuotaGroups": map[string]string{"c3": "c3d"},
+	}, nil)
+	for _, trial := range []struct {
+		it    arvados.InstanceType
+		group cloud.InstanceQuotaGroup
+	}{
+		{arvados.InstanceType{ProviderType: "n2-standard-4"}, "n2"},
+		{arvados.InstanceType{ProviderType: "N2D-standard-4"}, "n2d"},
+		{arvados.InstanceType{ProviderType: "e2-small"}, "cpus"},
+		{arvados.InstanceType{ProviderType: "n1-standard-1"}, "cpus"},
+		{arvados.InstanceType{ProviderType: "c3-standard-4"}, "c3d"},
+		{arvados.InstanceType{ProviderType: "n2-standard-4", Preemptible: true}, "n2-spot"},
+	} {
+		c.Check(is.InstanceQuotaGroup(trial.it), check.Equals, trial.group)
+	}
+}
+
+func (s *GCEInstanceSetSuite) TestWrapError(c *check.C) {
+	var throttle atomic.Value
+	err := wrapError(&googleapi.Error{Code: http.StatusTooManyRequests}, &throttle)
+	var rlErr cloud.RateLimitError
+	c.Assert(errors.As(err, &rlErr), check.Equals, true)
+	c.Check(rlErr.EarliestRetry().After(time.Now()), check.Equals, true)
+
+	err = wrapError(operationErr{&compute.OperationErrorErrors{Code: "QUOTA_EXCEEDED", Message: "Quota 'N2_CPUS' exceeded. Limit: 24.0 in region us-central1."}}, &throttle)
+	var capErr cloud.CapacityError
+	c.Assert(errors.As(err, &capErr), check.Equals, true)
+	c.Check(capErr.IsInstanceQuotaGroupSpecific(), check.Equals, true)
+
+	err = wrapError(operationErr{&compute.OperationErrorErrors{Code: "QUOTA_EXCEEDED", Message: "Quota 'IN_USE_ADDRESSES' exceeded."}}, &throttle)
+	var quotaErr cloud.QuotaError
+	c.Check(errors.As(err, &quotaErr), check.Equals, true)
+
+	err = wrapError(&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded", Message: "Quota 'CPUS' exceeded"}}}, &throttle)
+	c.Check(errors.As(err, &capErr), check.Equals, true)
+
+	err = wrapError(errors.New("other"), &throttle)
+	c.Check(err, check.ErrorMatches, "other")
+	c.Check(wrapError(nil, &throttle), check.IsNil)
+}
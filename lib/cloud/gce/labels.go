@@ -0,0 +1,133 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package gce
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+)
+
+// GCE label keys and values can only contain lowercase letters,
+// digits, "_", and "-", and keys must start with a lowercase
+// letter. Instance tags are stored as labels using a reversible
+// encoding:
+//
+//   - lowercase letters, digits, and "-" are unchanged
+//   - an uppercase letter X is encoded as "_x"
+//   - any other byte is encoded as "__" followed by two hex digits
+//
+// If the encoded key does not start with a lowercase letter, it is
+// prefixed with "x". If the original key starts with "x" followed by
+// something that would need the prefix, the "x" is encoded as "__78"
+// so the prefix is unambiguous.
+//
+// For example, the tag "ArvadosInstanceType: m5.large" is stored as
+// the label "x_arvados_instance_type: m5__2elarge".
+
+// Maximum length of a label key or value.
+const labelMaxLength = 63
+
+func encodeLabel(s string) string {
+	var enc strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-':
+			enc.WriteByte(c)
+		case c >= 'A' && c <= 'Z':
+			enc.WriteByte('_')
+			enc.WriteByte(c - 'A' + 'a')
+		default:
+			fmt.Fprintf(&enc, "__%02x", c)
+		}
+	}
+	return enc.String()
+}
+
+func decodeLabel(s string) (string, error) {
+	var dec strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '_' {
+			dec.WriteByte(c)
+			continue
+		}
+		if i+1 < len(s) && s[i+1] >= 'a' && s[i+1] <= 'z' {
+			dec.WriteByte(s[i+1] - 'a' + 'A')
+			i++
+			continue
+		}
+		if i+3 < len(s) && s[i+1] == '_' {
+			b, err := strconv.ParseUint(s[i+2:i+4], 16, 8)
+			if err == nil {
+				dec.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		return "", fmt.Errorf("invalid escape sequence at position %d in %q", i, s)
+	}
+	return dec.String(), nil
+}
+
+func encodeLabelKey(key string) string {
+	enc := encodeLabel(key)
+	if !startsWithLetter(enc) {
+		return "x" + enc
+	}
+	if enc[0] == 'x' && !startsWithLetter(enc[1:]) {
+		return "x__78" + enc[1:]
+	}
+	return enc
+}
+
+func decodeLabelKey(key string) (string, error) {
+	if strings.HasPrefix(key, "x") && !startsWithLetter(key[1:]) {
+		key = key[1:]
+	}
+	return decodeLabel(key)
+}
+
+func startsWithLetter(s string) bool {
+	return s != "" && s[0] >= 'a' && s[0] <= 'z'
+}
+
+// tagsToLabels returns the GCE labels representing the given tags.
+func tagsToLabels(tags cloud.InstanceTags) (map[string]string, error) {
+	labels := make(map[string]string, len(tags))
+	for k, v := range tags {
+		lk, lv := encodeLabelKey(k), encodeLabel(v)
+		if len(lk) > labelMaxLength {
+			return nil, fmt.Errorf("cannot use tag %q as a GCE label: encoded key %q is longer than %d characters", k, lk, labelMaxLength)
+		}
+		if len(lv) > labelMaxLength {
+			return nil, fmt.Errorf("cannot use tag %q as a GCE label: encoded value %q is longer than %d characters", k, lv, labelMaxLength)
+		}
+		labels[lk] = lv
+	}
+	return labels, nil
+}
+
+// labelsToTags returns the tags represented by the given GCE labels.
+// Labels that were not set by this driver are returned unchanged if
+// they cannot be decoded.
+func labelsToTags(labels map[string]string) cloud.InstanceTags {
+	tags := make(cloud.InstanceTags, len(labels))
+	for lk, lv := range labels {
+		k, err := decodeLabelKey(lk)
+		if err != nil {
+			k = lk
+		}
+		v, err := decodeLabel(lv)
+		if err != nil {
+			v = lv
+		}
+		tags[k] = v
+	}
+	return tags
+}
@@ -0,0 +1,95 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+// Package instancetypes implements a command that retrieves the
+// instance types and prices offered by the configured cloud provider
+// and prints them as an InstanceTypes config fragment.
+package instancetypes
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/lib/dispatchcloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/ghodss/yaml"
+)
+
+var Command command
+
+type command struct{}
+
+func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	logger := ctxlog.New(stderr, "text", "info")
+	defer func() {
+		if err != nil {
+			logger.WithError(err).Error("fatal")
+		}
+	}()
+
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configFile := flags.String("config", arvados.DefaultConfigFile, "Site configuration `file`")
+	include := flags.String("include", "", "Only include provider types matching `regexp`")
+	preemptible := flags.Bool("preemptible", false, "Include preemptible (spot) variants")
+	if ok, code := cmd.ParseFlags(flags, prog, args, "", stderr); !ok {
+		return code
+	}
+	includeRe, err := regexp.Compile(*include)
+	if err != nil {
+		return 2
+	}
+
+	loader := config.NewLoader(stdin, logger)
+	loader.Path = *configFile
+	cfg, err := loader.Load()
+	if err != nil {
+		return 1
+	}
+	cluster, err := cfg.GetCluster("")
+	if err != nil {
+		return 1
+	}
+	catalog, ok := dispatchcloud.InstanceTypeCatalogs[cluster.Containers.CloudVMs.Driver]
+	if !ok {
+		err = fmt.Errorf("cloud driver %q does not support listing instance types", cluster.Containers.CloudVMs.Driver)
+		return 1
+	}
+	its, err := catalog.InstanceTypes(context.Background(), cluster.Containers.CloudVMs.DriverParameters, logger)
+	if err != nil {
+		return 1
+	}
+	itmap := arvados.InstanceTypeMap{}
+	for _, it := range its {
+		if !includeRe.MatchString(it.ProviderType) || (it.Preemptible && !*preemptible) {
+			continue
+		}
+		if it.CUDA.DeviceCount > 0 {
+			logger.Warnf("instance type %q has %d GPUs: CUDA.DriverVersion and CUDA.HardwareCapability must be filled in by hand", it.Name, it.CUDA.DeviceCount)
+		}
+		itmap[it.Name] = it
+	}
+	out, err := yaml.Marshal(map[string]interface{}{
+		"Clusters": map[string]interface{}{
+			cluster.ClusterID: map[string]interface{}{
+				"InstanceTypes": itmap,
+			},
+		},
+	})
+	if err != nil {
+		return 1
+	}
+	_, err = stdout.Write(out)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
@@ -5,9 +5,11 @@
 package cloud
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
+	"net/http"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -132,6 +134,169 @@ type Instance interface {
 	Destroy() error
 }
 
+// InstanceWithConsole is an optional interface for instances whose
+// serial console output can be retrieved from the cloud provider.
+// The dispatcher uses it to log diagnostic information when an
+// instance fails to boot.
+type InstanceWithConsole interface {
+	Instance
+
+	// Return the console output captured so far. Return
+	// ErrNotImplemented if console capture is not enabled for
+	// this instance.
+	ConsoleLog() (string, error)
+}
+
+// InstanceWithHibernation is an optional interface for instances
+// that can be stopped and started again without being destroyed.
+// The dispatcher can use it to hibernate idle instances instead of
+// destroying them, which preserves their disks (e.g., local caches)
+// and is typically faster to bring back than a new instance.
+//
+// A stopped instance is still returned by Instances(), with the same
+// ID and tags.
+type InstanceWithHibernation interface {
+	Instance
+
+	// Stop the instance and release its compute resources,
+	// keeping its disks. Return when the instance is stopped.
+	Stop() error
+
+	// Start a stopped instance. Return when the instance is
+	// running. Its Address() may be different afterward.
+	Start() error
+}
+
+// ProvisioningState is the state of the cloud provider's most recent
+// operation on an instance (see InstanceState).
+type ProvisioningState string
+
+const (
+	ProvisioningCreating  ProvisioningState = "creating"
+	ProvisioningUpdating  ProvisioningState = "updating"
+	ProvisioningSucceeded ProvisioningState = "succeeded"
+	ProvisioningFailed    ProvisioningState = "failed"
+	ProvisioningDeleting  ProvisioningState = "deleting"
+)
+
+// PowerState is the power state of an instance (see InstanceState).
+type PowerState string
+
+const (
+	PowerStarting PowerState = "starting"
+	PowerRunning  PowerState = "running"
+	PowerStopping PowerState = "stopping"
+	PowerStopped  PowerState = "stopped"
+)
+
+// InstanceState is the provisioning and power state of an instance,
+// as reported by the cloud provider. An empty field means the state
+// is unknown.
+type InstanceState struct {
+	Provisioning ProvisioningState
+	Power        PowerState
+}
+
+// InstanceWithState is an optional interface for instances whose
+// provisioning and power state is known to the driver. The
+// dispatcher uses it to give up on instances that are stuck (e.g.,
+// failed to provision, or were stopped by someone else) without
+// waiting for a probe timeout.
+type InstanceWithState interface {
+	Instance
+
+	// Return the instance's state as of the Instances() call
+	// that returned it.
+	State() InstanceState
+}
+
+// InstanceSetWithGenerations is an optional interface for instance
+// sets that can record the "generation" (typically derived from the
+// image ID and the parts of the configuration that affect new
+// instances) each instance was created with. After an upgrade, the
+// caller can use it to find instances created from older
+// generations, and drain and replace them gradually instead of all
+// at once.
+type InstanceSetWithGenerations interface {
+	InstanceSet
+
+	// Record the given generation on instances created after
+	// this call, and mark existing instances from other
+	// generations as outdated (see InstanceWithGeneration).
+	// Return the number of existing instances in each
+	// generation ("" for instances whose generation is unknown).
+	SetGeneration(generation string) (map[string]int, error)
+}
+
+// InstanceWithGeneration is implemented by instances returned by an
+// InstanceSetWithGenerations.
+type InstanceWithGeneration interface {
+	Instance
+
+	// Return the generation the instance was created with, or ""
+	// if unknown.
+	Generation() string
+
+	// Return true if the instance was created from an older
+	// generation than the one most recently passed to
+	// SetGeneration, and should be replaced.
+	Outdated() bool
+}
+
+// InstanceEventType is the kind of change reported by an
+// InstanceEvent.
+type InstanceEventType string
+
+const (
+	// The instance was created or modified.
+	InstanceUpdated   InstanceEventType = "updated"
+	InstanceDestroyed InstanceEventType = "destroyed"
+	InstanceStopped   InstanceEventType = "stopped"
+	InstanceStarted   InstanceEventType = "started"
+)
+
+// An InstanceEvent reports a change to an instance, which may have
+// been made by the caller or by someone else (e.g., an instance
+// deleted using the cloud provider's web console, or evicted by the
+// provider).
+type InstanceEvent struct {
+	InstanceID InstanceID
+	Type       InstanceEventType
+	Time       time.Time
+}
+
+// InstanceSetWithEvents is an optional interface for instance sets
+// that can report changes to instances as they happen, so the caller
+// doesn't have to wait until its next Instances() call to notice
+// them.
+type InstanceSetWithEvents interface {
+	InstanceSet
+
+	// Return a channel that receives an event after each
+	// change to an instance, or nil if events are not available
+	// (e.g., not configured). The channel is closed when the
+	// instance set is stopped.
+	//
+	// Events are not guaranteed to arrive in order, or at all
+	// (e.g., they are dropped if the caller doesn't keep up),
+	// so Instances() remains the authoritative source of
+	// instance state.
+	Events() <-chan InstanceEvent
+}
+
+// InstanceSetWithGarbageCollection is an optional interface for
+// instance sets that periodically clean up dangling resources (e.g.,
+// network interfaces and disks left behind by destroyed instances).
+type InstanceSetWithGarbageCollection interface {
+	InstanceSet
+
+	// Look for dangling resources now, instead of waiting for
+	// the next periodic check, and start deleting them. Return
+	// when they have been found (deletions may still be in
+	// progress).
+	GarbageCollect() error
+}
+
 // An InstanceSet manages a set of VM instances created by an elastic
 // cloud provider like AWS, GCE, or Azure.
 //
@@ -238,3 +403,49 @@ type driverFunc func(config json.RawMessage, id InstanceSetID, tags SharedResour
 func (df driverFunc) InstanceSet(config json.RawMessage, id InstanceSetID, tags SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (InstanceSet, error) {
 	return df(config, id, tags, logger, reg)
 }
+
+// An HTTPClientDriver is a Driver whose instance sets can make cloud
+// API calls using a caller-supplied HTTP client, e.g., one that uses
+// the cluster's outbound proxy and CA bundle. A nil client means
+// use the driver's default.
+type HTTPClientDriver interface {
+	Driver
+	InstanceSetWithHTTPClient(client *http.Client, config json.RawMessage, id InstanceSetID, tags SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (InstanceSet, error)
+}
+
+// HTTPClientDriverFunc makes an HTTPClientDriver using the provided
+// function as its InstanceSetWithHTTPClient method. Its InstanceSet
+// method calls fn with a nil client.
+func HTTPClientDriverFunc(fn func(client *http.Client, config json.RawMessage, id InstanceSetID, tags SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (InstanceSet, error)) HTTPClientDriver {
+	return httpClientDriverFunc(fn)
+}
+
+type httpClientDriverFunc func(client *http.Client, config json.RawMessage, id InstanceSetID, tags SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (InstanceSet, error)
+
+func (df httpClientDriverFunc) InstanceSet(config json.RawMessage, id InstanceSetID, tags SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (InstanceSet, error) {
+	return df(nil, config, id, tags, logger, reg)
+}
+
+func (df httpClientDriverFunc) InstanceSetWithHTTPClient(client *http.Client, config json.RawMessage, id InstanceSetID, tags SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (InstanceSet, error) {
+	return df(client, config, id, tags, logger, reg)
+}
+
+// A SchemaDriver is a Driver that can describe the configuration
+// parameters accepted by its InstanceSet method, so configuration
+// tools can check them without creating an InstanceSet.
+type SchemaDriver interface {
+	Driver
+	ConfigSchema() *ConfigSchema
+}
+
+// An InstanceTypeCatalog lists the instance types a cloud provider
+// offers in the region indicated by the driver-dependent
+// configuration parameters, with their current prices.
+//
+// The returned instance types have Name and ProviderType set to the
+// provider's name for the type. Preemptible variants, if available,
+// are returned as separate entries with Preemptible set and a
+// distinct Name.
+type InstanceTypeCatalog interface {
+	InstanceTypes(ctx context.Context, config json.RawMessage, logger logrus.FieldLogger) ([]arvados.InstanceType, error)
+}
@@ -0,0 +1,99 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package loopback
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Docker client program. Tests replace this with a stub.
+var dockerCommand = "docker"
+
+// Label added to each container, identifying the instance set that
+// created it.
+const labelInstanceSetID = "org.arvados.loopback-instance-set-id"
+
+// docker runs a docker client command and returns its stdout.
+func docker(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(dockerCommand, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w (stderr: %q)", dockerCommand, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// containerName returns the name for the container of the instance
+// with the given ID.
+func (is *instanceSet) containerName(id string) string {
+	return fmt.Sprintf("arvados-loopback-%s-%s", is.instanceSetID, id)
+}
+
+// startContainer starts a container from DockerImage for the
+// instance with the given ID, and returns its name. The container
+// idles until it is removed; commands are run in it with "docker
+// exec".
+func (is *instanceSet) startContainer(id string) (string, error) {
+	name := is.containerName(id)
+	_, err := docker("run", "--detach", "--rm",
+		"--name", name,
+		"--hostname", id,
+		"--label", labelInstanceSetID+"="+string(is.instanceSetID),
+		is.config.DockerImage,
+		"tail", "-f", "/dev/null")
+	if err != nil {
+		return "", err
+	}
+	is.logger.Infof("started container %s", name)
+	return name, nil
+}
+
+// removeContainer stops and removes the named container.
+func (is *instanceSet) removeContainer(name string) error {
+	_, err := docker("rm", "--force", name)
+	if err != nil {
+		is.logger.WithError(err).Warnf("error removing container %s", name)
+		return err
+	}
+	is.logger.Infof("removed container %s", name)
+	return nil
+}
+
+// removeStaleContainers removes containers left behind by a previous
+// instance set with the same ID.
+func (is *instanceSet) removeStaleContainers() {
+	out, err := docker("ps", "--all", "--quiet", "--filter", "label="+labelInstanceSetID+"="+string(is.instanceSetID))
+	if err != nil {
+		is.logger.WithError(err).Warn("error listing stale containers")
+		return
+	}
+	for _, name := range strings.Fields(out) {
+		is.removeContainer(name)
+	}
+}
+
+// dockerExecFunc is like sshExecFunc, but runs the command inside
+// the instance's container.
+func (i *instance) dockerExecFunc(env map[string]string, command string, stdin io.Reader, stdout, stderr io.Writer) uint32 {
+	args := []string{"exec", "--interactive"}
+	var keys []string
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--env", k+"="+env[k])
+	}
+	args = append(args, i.container, "sh", "-c", strings.TrimPrefix(command, "sudo "))
+	return runExec(exec.Command(dockerCommand, args...), stdin, stdout, stderr)
+}
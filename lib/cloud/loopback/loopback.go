@@ -10,6 +10,7 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
@@ -27,7 +28,28 @@ import (
 )
 
 // Driver is the loopback implementation of the cloud.Driver interface.
-var Driver = cloud.DriverFunc(newInstanceSet)
+var Driver = loopbackDriver{cloud.DriverFunc(newInstanceSet)}
+
+type loopbackDriver struct {
+	cloud.Driver
+}
+
+// ConfigSchema implements cloud.SchemaDriver.
+func (loopbackDriver) ConfigSchema() *cloud.ConfigSchema {
+	return cloud.ConfigSchemaOf(loopbackConfig{})
+}
+
+type loopbackConfig struct {
+	// Maximum number of instances that can exist at once. Zero
+	// means 1.
+	MaxInstances int
+
+	// If non-empty, each instance is a Docker container started
+	// from this image, and commands sent to the instance run
+	// inside the container (see docker.go). Otherwise, commands
+	// run directly on the dispatch host.
+	DockerImage string
+}
 
 var (
 	errUnimplemented = errors.New("function not implemented by loopback driver")
@@ -41,8 +63,10 @@ func (e quotaError) Error() string      { return string(e) }
 
 type instanceSet struct {
 	instanceSetID cloud.InstanceSetID
+	config        loopbackConfig
 	logger        logrus.FieldLogger
 	instances     []*instance
+	created       int
 	mtx           sync.Mutex
 }
 
@@ -51,24 +75,44 @@ func newInstanceSet(config json.RawMessage, instanceSetID cloud.InstanceSetID, _
 		instanceSetID: instanceSetID,
 		logger:        logger,
 	}
+	if len(config) > 0 {
+		err := json.Unmarshal(config, &is.config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if is.config.MaxInstances < 0 {
+		return nil, fmt.Errorf("invalid MaxInstances %d", is.config.MaxInstances)
+	} else if is.config.MaxInstances == 0 {
+		is.config.MaxInstances = 1
+	}
+	if is.config.DockerImage != "" {
+		// Containers from a previous dispatcher process
+		// can't be reached (their SSH services were
+		// in-process), so clean them up.
+		is.removeStaleContainers()
+	}
 	return is, nil
 }
 
 func (is *instanceSet) Create(it arvados.InstanceType, _ cloud.ImageID, tags cloud.InstanceTags, _ cloud.InitCommand, pubkey ssh.PublicKey) (cloud.Instance, error) {
 	is.mtx.Lock()
 	defer is.mtx.Unlock()
-	if len(is.instances) > 0 {
+	if len(is.instances) >= is.config.MaxInstances {
 		return nil, errQuota
 	}
-	// A crunch-run process running in a previous instance may
-	// have marked the node as broken. In the loopback scenario a
-	// destroy+create cycle doesn't fix whatever was broken -- but
-	// nothing else will either, so the best we can do is remove
-	// the "broken" flag and try again.
-	if err := os.Remove("/var/lock/crunch-run-broken"); err == nil {
-		is.logger.Info("removed /var/lock/crunch-run-broken")
-	} else if !errors.Is(err, os.ErrNotExist) {
-		return nil, err
+	if is.config.DockerImage == "" && len(is.instances) == 0 {
+		// A crunch-run process running in a previous
+		// instance may have marked the node as broken. In
+		// the loopback scenario a destroy+create cycle
+		// doesn't fix whatever was broken -- but nothing
+		// else will either, so the best we can do is remove
+		// the "broken" flag and try again.
+		if err := os.Remove("/var/lock/crunch-run-broken"); err == nil {
+			is.logger.Info("removed /var/lock/crunch-run-broken")
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
 	}
 	u, err := user.Current()
 	if err != nil {
@@ -86,8 +130,17 @@ func (is *instanceSet) Create(it arvados.InstanceType, _ cloud.ImageID, tags clo
 	if err != nil {
 		return nil, err
 	}
+	// With the default MaxInstances (1), the instance ID is the
+	// ProviderType, so it stays the same across destroy+create
+	// cycles.
+	id := it.ProviderType
+	if is.config.MaxInstances > 1 {
+		id = fmt.Sprintf("%s-%d", it.ProviderType, is.created)
+	}
+	is.created++
 	inst := &instance{
 		is:           is,
+		id:           id,
 		instanceType: it,
 		adminUser:    u.Username,
 		tags:         tags,
@@ -99,8 +152,15 @@ func (is *instanceSet) Create(it arvados.InstanceType, _ cloud.ImageID, tags clo
 		},
 	}
 	inst.sshService.Exec = inst.sshExecFunc
+	if is.config.DockerImage != "" {
+		inst.container, err = is.startContainer(id)
+		if err != nil {
+			return nil, err
+		}
+		inst.sshService.Exec = inst.dockerExecFunc
+	}
 	go inst.sshService.Start()
-	is.instances = []*instance{inst}
+	is.instances = append(is.instances, inst)
 	return inst, nil
 }
 
@@ -123,11 +183,16 @@ func (is *instanceSet) Stop() {
 	defer is.mtx.Unlock()
 	for _, inst := range is.instances {
 		inst.sshService.Close()
+		if inst.container != "" {
+			is.removeContainer(inst.container)
+		}
 	}
 }
 
 type instance struct {
 	is           *instanceSet
+	id           string
+	container    string
 	instanceType arvados.InstanceType
 	adminUser    string
 	tags         cloud.InstanceTags
@@ -135,8 +200,8 @@ type instance struct {
 	sshService   test.SSHService
 }
 
-func (i *instance) ID() cloud.InstanceID                                    { return cloud.InstanceID(i.instanceType.ProviderType) }
-func (i *instance) String() string                                          { return i.instanceType.ProviderType }
+func (i *instance) ID() cloud.InstanceID                                    { return cloud.InstanceID(i.id) }
+func (i *instance) String() string                                          { return i.id }
 func (i *instance) ProviderType() string                                    { return i.instanceType.ProviderType }
 func (i *instance) Address() string                                         { return i.sshService.Address() }
 func (i *instance) PriceHistory(arvados.InstanceType) []cloud.InstancePrice { return nil }
@@ -149,7 +214,16 @@ func (i *instance) SetTags(tags cloud.InstanceTags) error {
 func (i *instance) Destroy() error {
 	i.is.mtx.Lock()
 	defer i.is.mtx.Unlock()
-	i.is.instances = i.is.instances[:0]
+	for idx, inst := range i.is.instances {
+		if inst == i {
+			i.is.instances = append(i.is.instances[:idx], i.is.instances[idx+1:]...)
+			break
+		}
+	}
+	i.sshService.Close()
+	if i.container != "" {
+		return i.is.removeContainer(i.container)
+	}
 	return nil
 }
 func (i *instance) VerifyHostKey(pubkey ssh.PublicKey, _ *ssh.Client) error {
@@ -160,12 +234,18 @@ func (i *instance) VerifyHostKey(pubkey ssh.PublicKey, _ *ssh.Client) error {
 }
 func (i *instance) sshExecFunc(env map[string]string, command string, stdin io.Reader, stdout, stderr io.Writer) uint32 {
 	cmd := exec.Command("sh", "-c", strings.TrimPrefix(command, "sudo "))
-	cmd.Stdin = stdin
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
 	for k, v := range env {
 		cmd.Env = append(cmd.Env, k+"="+v)
 	}
+	return runExec(cmd, stdin, stdout, stderr)
+}
+
+// runExec runs cmd with the given stdio, and returns its exit status
+// for the SSH client.
+func runExec(cmd *exec.Cmd, stdin io.Reader, stdout, stderr io.Writer) uint32 {
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	// Prevent child process from using our tty.
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 	err := cmd.Run()
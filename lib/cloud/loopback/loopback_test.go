@@ -8,6 +8,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
+	"os"
 	"testing"
 	"time"
 
@@ -125,3 +126,95 @@ func (*suite) TestCreateListExecDestroy(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(list, check.HasLen, 1)
 }
+
+func (*suite) TestMaxInstances(c *check.C) {
+	logger := ctxlog.TestLogger(c)
+	_, err := Driver.InstanceSet(json.RawMessage(`{"MaxInstances": -1}`), "testInstanceSetID", nil, logger, nil)
+	c.Check(err, check.ErrorMatches, `invalid MaxInstances -1`)
+
+	is, err := Driver.InstanceSet(json.RawMessage(`{"MaxInstances": 2}`), "testInstanceSetID", nil, logger, nil)
+	c.Assert(err, check.IsNil)
+	defer is.Stop()
+	_, pubkey := testKeys(c)
+	it := arvados.InstanceType{Name: "localhost", ProviderType: "localhost"}
+
+	inst1, err := is.Create(it, "testImageID", nil, "", pubkey)
+	c.Assert(err, check.IsNil)
+	inst2, err := is.Create(it, "testImageID", nil, "", pubkey)
+	c.Assert(err, check.IsNil)
+	c.Check(inst1.ID(), check.Equals, cloud.InstanceID("localhost-0"))
+	c.Check(inst2.ID(), check.Equals, cloud.InstanceID("localhost-1"))
+	_, err = is.Create(it, "testImageID", nil, "", pubkey)
+	c.Check(err, check.FitsTypeOf, errQuota)
+
+	// Destroying one instance leaves the other one in place.
+	c.Check(inst1.Destroy(), check.IsNil)
+	list, err := is.Instances(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 1)
+	c.Check(list[0].ID(), check.Equals, inst2.ID())
+	inst3, err := is.Create(it, "testImageID", nil, "", pubkey)
+	c.Assert(err, check.IsNil)
+	c.Check(inst3.ID(), check.Equals, cloud.InstanceID("localhost-2"))
+}
+
+func (*suite) TestDocker(c *check.C) {
+	// Stub docker command: log the arguments, and for "exec",
+	// print them.
+	tmpdir := c.MkDir()
+	stub := tmpdir + "/docker"
+	err := os.WriteFile(stub, []byte(`#!/bin/sh
+echo "$*" >>"$0.log"
+case "$1" in
+run) echo 0123456789ab ;;
+ps) echo stale1 ;;
+exec) echo "$*" ;;
+esac
+`), 0755)
+	c.Assert(err, check.IsNil)
+	defer func(orig string) { dockerCommand = orig }(dockerCommand)
+	dockerCommand = stub
+	dockerLog := func() string {
+		buf, err := os.ReadFile(stub + ".log")
+		c.Assert(err, check.IsNil)
+		return string(buf)
+	}
+
+	logger := ctxlog.TestLogger(c)
+	is, err := Driver.InstanceSet(json.RawMessage(`{"DockerImage": "debian:12"}`), "testInstanceSetID", nil, logger, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(dockerLog(), check.Equals, `ps --all --quiet --filter label=org.arvados.loopback-instance-set-id=testInstanceSetID
+rm --force stale1
+`)
+
+	key, pubkey := testKeys(c)
+	it := arvados.InstanceType{Name: "localhost", ProviderType: "localhost"}
+	inst, err := is.Create(it, "testImageID", nil, "", pubkey)
+	c.Assert(err, check.IsNil)
+	c.Check(dockerLog(), check.Matches, `(?s).*\nrun --detach --rm --name arvados-loopback-testInstanceSetID-localhost --hostname localhost --label org.arvados.loopback-instance-set-id=testInstanceSetID debian:12 tail -f /dev/null\n`)
+
+	for deadline := time.Now().Add(time.Second); inst.Address() == ""; time.Sleep(time.Second / 100) {
+		if deadline.Before(time.Now()) {
+			c.Fatal("timed out")
+		}
+	}
+	exr := sshexecutor.New(inst)
+	exr.SetSigners(key)
+	stdout, _, err := exr.Execute(map[string]string{"B": "2", "A": "1"}, "sudo echo ok", nil)
+	c.Check(err, check.IsNil)
+	c.Check(string(stdout), check.Equals, "exec --interactive --env A=1 --env B=2 arvados-loopback-testInstanceSetID-localhost sh -c echo ok\n")
+
+	c.Check(inst.Destroy(), check.IsNil)
+	c.Check(dockerLog(), check.Matches, `(?s).*\nrm --force arvados-loopback-testInstanceSetID-localhost\n`)
+	is.Stop()
+}
+
+func testKeys(c *check.C) (ssh.Signer, ssh.PublicKey) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, check.IsNil)
+	signer, err := ssh.NewSignerFromKey(rsaKey)
+	c.Assert(err, check.IsNil)
+	pubkey, err := ssh.NewPublicKey(rsaKey.Public())
+	c.Assert(err, check.IsNil)
+	return signer, pubkey
+}
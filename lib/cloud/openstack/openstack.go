@@ -0,0 +1,738 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package openstack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/bootfromvolume"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Driver is the OpenStack implementation of the cloud.Driver
+// interface.
+var Driver = openstackDriver{cloud.HTTPClientDriverFunc(newOpenstackInstanceSet)}
+
+type openstackDriver struct {
+	cloud.HTTPClientDriver
+}
+
+// ConfigSchema implements cloud.SchemaDriver.
+func (openstackDriver) ConfigSchema() *cloud.ConfigSchema {
+	return cloud.ConfigSchemaOf(openstackInstanceSetConfig{})
+}
+
+const (
+	throttleDelayMin = time.Second
+	throttleDelayMax = time.Minute
+
+	defaultGCConcurrency = 4
+	portGCQueueMax       = 1000
+)
+
+type openstackInstanceSetConfig struct {
+	IdentityEndpoint             string
+	Username                     string
+	UserDomainName               string
+	Password                     string
+	ProjectID                    string
+	ProjectName                  string
+	ProjectDomainName            string
+	ApplicationCredentialID      string
+	ApplicationCredentialSecret  string
+	Region                       string
+	Zones                        []string
+	Network                      string
+	SecurityGroups               []string
+	ScratchVolumeType            string
+	AdminUsername                string
+	DeleteDanglingResourcesAfter arvados.Duration
+	DryRunDeletes                bool
+	GCConcurrency                int
+}
+
+// openstackAPI is the subset of the Nova (compute) and Neutron
+// (networking) APIs used by the driver. Tests substitute a stub.
+type openstackAPI interface {
+	CreateServer(ctx context.Context, opts servers.CreateOptsBuilder) (*servers.Server, error)
+	// ListServers returns the servers whose names match the
+	// given regular expression.
+	ListServers(ctx context.Context, nameRegexp string) ([]servers.Server, error)
+	DeleteServer(ctx context.Context, id string) error
+	// ResetMetadata replaces all of the server's metadata.
+	ResetMetadata(ctx context.Context, id string, metadata map[string]string) (map[string]string, error)
+	ListFlavors(ctx context.Context) ([]flavors.Flavor, error)
+	GetKeyPair(ctx context.Context, name string) (*keypairs.KeyPair, error)
+	CreateKeyPair(ctx context.Context, opts keypairs.CreateOpts) (*keypairs.KeyPair, error)
+	CreatePort(ctx context.Context, opts ports.CreateOpts) (*ports.Port, error)
+	ListPorts(ctx context.Context, opts ports.ListOpts) ([]ports.Port, error)
+	DeletePort(ctx context.Context, id string) error
+}
+
+// openstackClient implements openstackAPI using gophercloud. The
+// gophercloud v1 API does not take a context for each call, so ctx
+// is ignored.
+type openstackClient struct {
+	compute *gophercloud.ServiceClient
+	network *gophercloud.ServiceClient
+}
+
+func (cl openstackClient) CreateServer(ctx context.Context, opts servers.CreateOptsBuilder) (*servers.Server, error) {
+	return servers.Create(cl.compute, opts).Extract()
+}
+
+func (cl openstackClient) ListServers(ctx context.Context, nameRegexp string) ([]servers.Server, error) {
+	pages, err := servers.List(cl.compute, servers.ListOpts{Name: nameRegexp}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	return servers.ExtractServers(pages)
+}
+
+func (cl openstackClient) DeleteServer(ctx context.Context, id string) error {
+	return servers.Delete(cl.compute, id).ExtractErr()
+}
+
+func (cl openstackClient) ResetMetadata(ctx context.Context, id string, metadata map[string]string) (map[string]string, error) {
+	return servers.ResetMetadata(cl.compute, id, servers.MetadataOpts(metadata)).Extract()
+}
+
+func (cl openstackClient) ListFlavors(ctx context.Context) ([]flavors.Flavor, error) {
+	pages, err := flavors.ListDetail(cl.compute, flavors.ListOpts{AccessType: flavors.AllAccess}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	return flavors.ExtractFlavors(pages)
+}
+
+func (cl openstackClient) GetKeyPair(ctx context.Context, name string) (*keypairs.KeyPair, error) {
+	return keypairs.Get(cl.compute, name, nil).Extract()
+}
+
+func (cl openstackClient) CreateKeyPair(ctx context.Context, opts keypairs.CreateOpts) (*keypairs.KeyPair, error) {
+	return keypairs.Create(cl.compute, opts).Extract()
+}
+
+func (cl openstackClient) CreatePort(ctx context.Context, opts ports.CreateOpts) (*ports.Port, error) {
+	return ports.Create(cl.network, opts).Extract()
+}
+
+func (cl openstackClient) ListPorts(ctx context.Context, opts ports.ListOpts) ([]ports.Port, error) {
+	pages, err := ports.List(cl.network, opts).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	return ports.ExtractPorts(pages)
+}
+
+func (cl openstackClient) DeletePort(ctx context.Context, id string) error {
+	return ports.Delete(cl.network, id).ExtractErr()
+}
+
+type openstackInstanceSet struct {
+	osconfig               openstackInstanceSetConfig
+	instanceSetID          cloud.InstanceSetID
+	namePrefix             string
+	logger                 logrus.FieldLogger
+	client                 openstackAPI
+	nextZone               int32
+	throttleDelayCreate    atomic.Value
+	throttleDelayInstances atomic.Value
+
+	keysMtx sync.Mutex
+	keys    map[string]string // md5 fingerprint => keypair name
+
+	flavorsMtx sync.Mutex
+	flavors    []flavors.Flavor
+
+	// Dangling ports waiting to be deleted. deletingPorts
+	// prevents a port from being queued twice.
+	portGC        chan ports.Port
+	portGCMtx     sync.Mutex
+	deletingPorts map[string]bool
+	stopOnce      sync.Once
+
+	mInstances      prometheus.Gauge
+	mInstanceStarts *prometheus.CounterVec
+}
+
+func newOpenstackInstanceSet(httpClient *http.Client, confRaw json.RawMessage, instanceSetID cloud.InstanceSetID, _ cloud.SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (cloud.InstanceSet, error) {
+	var osconfig openstackInstanceSetConfig
+	err := json.Unmarshal(confRaw, &osconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := osconfig.newClient(httpClient)
+	if err != nil {
+		return nil, err
+	}
+	return newInstanceSet(osconfig, client, instanceSetID, logger, reg)
+}
+
+// authOptions returns the Keystone authentication options given
+// in the configuration, or, if IdentityEndpoint is empty, in the
+// OS_* environment variables (as used by the openstack command
+// line client).
+func (cfg openstackInstanceSetConfig) authOptions() (gophercloud.AuthOptions, error) {
+	if cfg.IdentityEndpoint == "" {
+		return openstack.AuthOptionsFromEnv()
+	}
+	opts := gophercloud.AuthOptions{
+		IdentityEndpoint: cfg.IdentityEndpoint,
+		AllowReauth:      true,
+	}
+	if cfg.ApplicationCredentialID != "" {
+		if cfg.ApplicationCredentialSecret == "" {
+			return opts, errors.New("invalid configuration: ApplicationCredentialID is set but ApplicationCredentialSecret is empty")
+		}
+		// Application credentials are scoped to the
+		// project they were created in.
+		opts.ApplicationCredentialID = cfg.ApplicationCredentialID
+		opts.ApplicationCredentialSecret = cfg.ApplicationCredentialSecret
+		return opts, nil
+	}
+	if cfg.Username == "" || cfg.Password == "" {
+		return opts, errors.New("invalid configuration: IdentityEndpoint is set but Username/Password and ApplicationCredentialID are empty")
+	}
+	opts.Username = cfg.Username
+	opts.Password = cfg.Password
+	opts.DomainName = cfg.UserDomainName
+	if cfg.ProjectID == "" && cfg.ProjectName == "" {
+		return opts, errors.New("invalid configuration: one of ProjectID or ProjectName must be set")
+	}
+	opts.Scope = &gophercloud.AuthScope{
+		ProjectID:   cfg.ProjectID,
+		ProjectName: cfg.ProjectName,
+	}
+	if cfg.ProjectID == "" {
+		opts.Scope.DomainName = cfg.ProjectDomainName
+		if opts.Scope.DomainName == "" {
+			opts.Scope.DomainName = cfg.UserDomainName
+		}
+	}
+	return opts, nil
+}
+
+// newClient authenticates to Keystone and returns an openstackAPI
+// that uses the compute and network endpoints in the configured
+// region.
+func (cfg openstackInstanceSetConfig) newClient(httpClient *http.Client) (openstackAPI, error) {
+	authOpts, err := cfg.authOptions()
+	if err != nil {
+		return nil, err
+	}
+	provider, err := openstack.NewClient(authOpts.IdentityEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		provider.HTTPClient = *httpClient
+	}
+	provider.UserAgent.Prepend("arvados-dispatch-cloud")
+	err = openstack.Authenticate(provider, authOpts)
+	if err != nil {
+		return nil, fmt.Errorf("error authenticating to %s: %w", authOpts.IdentityEndpoint, err)
+	}
+	eo := gophercloud.EndpointOpts{Region: cfg.Region}
+	computeClient, err := openstack.NewComputeV2(provider, eo)
+	if err != nil {
+		return nil, err
+	}
+	networkClient, err := openstack.NewNetworkV2(provider, eo)
+	if err != nil {
+		return nil, err
+	}
+	return openstackClient{compute: computeClient, network: networkClient}, nil
+}
+
+func newInstanceSet(osconfig openstackInstanceSetConfig, client openstackAPI, instanceSetID cloud.InstanceSetID, logger logrus.FieldLogger, reg *prometheus.Registry) (*openstackInstanceSet, error) {
+	for _, zone := range osconfig.Zones {
+		if zone == "" {
+			return nil, errors.New("invalid configuration: empty string in Zones")
+		}
+	}
+	instanceSet := &openstackInstanceSet{
+		osconfig:      osconfig,
+		instanceSetID: instanceSetID,
+		namePrefix:    fmt.Sprintf("compute-%s-", instanceSetID),
+		logger:        logger,
+		client:        client,
+		keys:          map[string]string{},
+		portGC:        make(chan ports.Port, portGCQueueMax),
+		deletingPorts: map[string]bool{},
+	}
+	instanceSet.mInstances = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "openstack_instances",
+		Help:      "Number of instances running",
+	})
+	instanceSet.mInstanceStarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "openstack_instance_starts_total",
+		Help:      "Number of attempts to start a new instance",
+	}, []string{"success"})
+	instanceSet.mInstanceStarts.WithLabelValues("0").Add(0)
+	instanceSet.mInstanceStarts.WithLabelValues("1").Add(0)
+	if reg != nil {
+		reg.MustRegister(instanceSet.mInstances)
+		reg.MustRegister(instanceSet.mInstanceStarts)
+	}
+	workers := osconfig.GCConcurrency
+	if workers <= 0 {
+		workers = defaultGCConcurrency
+	}
+	for i := 0; i < workers; i++ {
+		go instanceSet.runPortGC(instanceSet.portGC)
+	}
+	return instanceSet, nil
+}
+
+func (instanceSet *openstackInstanceSet) Create(
+	instanceType arvados.InstanceType,
+	imageID cloud.ImageID,
+	newTags cloud.InstanceTags,
+	initCommand cloud.InitCommand,
+	publicKey ssh.PublicKey) (cloud.Instance, error) {
+
+	ctx := context.Background()
+	flavorID, err := instanceSet.flavorID(ctx, instanceType.ProviderType)
+	if err != nil {
+		return nil, wrapError(err, &instanceSet.throttleDelayCreate)
+	}
+	name, err := instanceSet.newInstanceName()
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{}
+	for k, v := range newTags {
+		metadata[k] = v
+	}
+	opts := servers.CreateOpts{
+		Name:           name,
+		ImageRef:       string(imageID),
+		FlavorRef:      flavorID,
+		SecurityGroups: instanceSet.osconfig.SecurityGroups,
+		UserData:       []byte("#!/bin/sh\n" + string(initCommand) + "\n"),
+		Metadata:       metadata,
+	}
+	if zones := instanceSet.osconfig.Zones; len(zones) > 0 {
+		opts.AvailabilityZone = zones[int(atomic.AddInt32(&instanceSet.nextZone, 1)-1)%len(zones)]
+	}
+	var blockDevices []bootfromvolume.BlockDevice
+	if instanceType.AddedScratch > 0 {
+		blockDevices = []bootfromvolume.BlockDevice{{
+			SourceType:          bootfromvolume.SourceImage,
+			UUID:                string(imageID),
+			DestinationType:     bootfromvolume.DestinationLocal,
+			BootIndex:           0,
+			DeleteOnTermination: true,
+		}, {
+			SourceType:      bootfromvolume.SourceBlank,
+			DestinationType: bootfromvolume.DestinationVolume,
+			// ceil(added scratch space in GiB)
+			VolumeSize:          int((instanceType.AddedScratch + 1<<30 - 1) >> 30),
+			VolumeType:          instanceSet.osconfig.ScratchVolumeType,
+			BootIndex:           -1,
+			DeleteOnTermination: true,
+		}}
+	}
+
+	var port *ports.Port
+	if instanceSet.osconfig.Network != "" {
+		// Create the port ourselves so the security groups
+		// apply to it. Nova does not delete it when the
+		// server is deleted; see managePorts.
+		port, err = instanceSet.createPort(ctx, name)
+		if err != nil {
+			instanceSet.mInstanceStarts.WithLabelValues("0").Add(1)
+			return nil, wrapError(err, &instanceSet.throttleDelayCreate)
+		}
+		opts.SecurityGroups = nil
+		opts.Networks = []servers.Network{{Port: port.ID}}
+	}
+
+	var createOpts servers.CreateOptsBuilder = opts
+	if blockDevices != nil {
+		createOpts = bootfromvolume.CreateOptsExt{CreateOptsBuilder: createOpts, BlockDevice: blockDevices}
+	}
+	if publicKey != nil {
+		keyname, err := instanceSet.getKeyName(ctx, publicKey)
+		if err != nil {
+			instanceSet.cleanupPort(port)
+			return nil, wrapError(err, &instanceSet.throttleDelayCreate)
+		}
+		createOpts = keypairs.CreateOptsExt{CreateOptsBuilder: createOpts, KeyName: keyname}
+	}
+
+	server, err := instanceSet.client.CreateServer(ctx, createOpts)
+	instanceSet.mInstanceStarts.WithLabelValues(boolLabelValue[err == nil]).Add(1)
+	if err != nil {
+		instanceSet.cleanupPort(port)
+		return nil, wrapError(err, &instanceSet.throttleDelayCreate)
+	}
+	// The create response only includes the server ID, so fill
+	// in the rest from the request.
+	server.Name = name
+	server.Status = "BUILD"
+	server.Metadata = metadata
+	server.Flavor = map[string]any{"id": flavorID}
+	return &openstackInstance{provider: instanceSet, server: *server}, nil
+}
+
+// newInstanceName returns a random name for a new instance.
+func (instanceSet *openstackInstanceSet) newInstanceName() (string, error) {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%x", instanceSet.namePrefix, buf), nil
+}
+
+// flavorID returns the ID of the flavor with the given name or ID.
+// The list of flavors is retrieved the first time, and again if the
+// requested flavor is not found.
+func (instanceSet *openstackInstanceSet) flavorID(ctx context.Context, providerType string) (string, error) {
+	instanceSet.flavorsMtx.Lock()
+	defer instanceSet.flavorsMtx.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if attempt > 0 || instanceSet.flavors == nil {
+			list, err := instanceSet.client.ListFlavors(ctx)
+			if err != nil {
+				return "", fmt.Errorf("error listing flavors: %w", err)
+			}
+			instanceSet.flavors = list
+		}
+		for _, f := range instanceSet.flavors {
+			if f.Name == providerType || f.ID == providerType {
+				return f.ID, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("flavor %q not found", providerType)
+}
+
+// flavorName returns the name of the flavor with the given ID, if
+// it is known.
+func (instanceSet *openstackInstanceSet) flavorName(id string) (string, bool) {
+	instanceSet.flavorsMtx.Lock()
+	defer instanceSet.flavorsMtx.Unlock()
+	for _, f := range instanceSet.flavors {
+		if f.ID == id {
+			return f.Name, true
+		}
+	}
+	return "", false
+}
+
+// getKeyName returns the name of a Nova keypair with the given
+// public key, importing the key if needed.
+func (instanceSet *openstackInstanceSet) getKeyName(ctx context.Context, publicKey ssh.PublicKey) (string, error) {
+	instanceSet.keysMtx.Lock()
+	defer instanceSet.keysMtx.Unlock()
+	fingerprint := ssh.FingerprintLegacyMD5(publicKey)
+	if keyname, ok := instanceSet.keys[fingerprint]; ok {
+		return keyname, nil
+	}
+	keyname := "arvados-dispatch-keypair-" + strings.Replace(fingerprint, ":", "", -1)
+	kp, err := instanceSet.client.GetKeyPair(ctx, keyname)
+	if responseCodeIs(err, http.StatusNotFound) {
+		kp, err = instanceSet.client.CreateKeyPair(ctx, keypairs.CreateOpts{
+			Name:      keyname,
+			PublicKey: string(ssh.MarshalAuthorizedKey(publicKey)),
+		})
+		if err != nil {
+			return "", fmt.Errorf("could not import keypair: %w", err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("could not look up keypair: %w", err)
+	} else if kp.Fingerprint != "" && kp.Fingerprint != fingerprint {
+		return "", fmt.Errorf("keypair %s exists but has fingerprint %s, expected %s", keyname, kp.Fingerprint, fingerprint)
+	}
+	instanceSet.keys[fingerprint] = keyname
+	return keyname, nil
+}
+
+func (instanceSet *openstackInstanceSet) Instances(tags cloud.InstanceTags) ([]cloud.Instance, error) {
+	ctx := context.Background()
+	list, err := instanceSet.client.ListServers(ctx, "^"+regexp.QuoteMeta(instanceSet.namePrefix))
+	err = wrapError(err, &instanceSet.throttleDelayInstances)
+	if err != nil {
+		return nil, err
+	}
+	var instances []cloud.Instance
+	for _, server := range list {
+		if !strings.HasPrefix(server.Name, instanceSet.namePrefix) {
+			// Nova name filters are unanchored on
+			// some versions.
+			continue
+		}
+		if !hasTags(server.Metadata, tags) {
+			continue
+		}
+		instances = append(instances, &openstackInstance{provider: instanceSet, server: server})
+	}
+	instanceSet.mInstances.Set(float64(len(instances)))
+	if instanceSet.osconfig.Network != "" {
+		err = instanceSet.managePorts(ctx)
+		if err != nil {
+			instanceSet.logger.WithError(err).Warn("error garbage collecting ports")
+		}
+	}
+	return instances, nil
+}
+
+func hasTags(metadata map[string]string, tags cloud.InstanceTags) bool {
+	for k, v := range tags {
+		if mv, ok := metadata[k]; !ok || mv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// GarbageCollect implements cloud.InstanceSetWithGarbageCollection.
+// It looks for dangling ports now, instead of waiting for the next
+// Instances() call, and queues them for deletion.
+func (instanceSet *openstackInstanceSet) GarbageCollect() error {
+	if instanceSet.osconfig.Network == "" {
+		return nil
+	}
+	return instanceSet.managePorts(context.Background())
+}
+
+func (instanceSet *openstackInstanceSet) Stop() {
+	instanceSet.stopOnce.Do(func() {
+		instanceSet.portGCMtx.Lock()
+		defer instanceSet.portGCMtx.Unlock()
+		close(instanceSet.portGC)
+		instanceSet.portGC = nil
+	})
+}
+
+// InstanceQuotaGroup returns "" for all instance types: Nova quotas
+// (cores, RAM, instances) apply to the whole project, not to
+// individual flavors.
+func (instanceSet *openstackInstanceSet) InstanceQuotaGroup(arvados.InstanceType) cloud.InstanceQuotaGroup {
+	return ""
+}
+
+type openstackInstance struct {
+	provider *openstackInstanceSet
+	mtx      sync.Mutex
+	server   servers.Server
+}
+
+func (inst *openstackInstance) ID() cloud.InstanceID {
+	return cloud.InstanceID(inst.server.ID)
+}
+
+func (inst *openstackInstance) String() string {
+	return inst.server.Name
+}
+
+// ProviderType returns the name of the instance's flavor. Depending
+// on the compute API version, the server details include either the
+// flavor name or its ID.
+func (inst *openstackInstance) ProviderType() string {
+	if name, ok := inst.server.Flavor["original_name"].(string); ok {
+		return name
+	}
+	id, _ := inst.server.Flavor["id"].(string)
+	if name, ok := inst.provider.flavorName(id); ok {
+		return name
+	}
+	return id
+}
+
+func (inst *openstackInstance) SetTags(newTags cloud.InstanceTags) error {
+	metadata := map[string]string{}
+	for k, v := range newTags {
+		metadata[k] = v
+	}
+	inst.mtx.Lock()
+	defer inst.mtx.Unlock()
+	metadata, err := inst.provider.client.ResetMetadata(context.Background(), inst.server.ID, metadata)
+	if err != nil {
+		return err
+	}
+	inst.server.Metadata = metadata
+	return nil
+}
+
+func (inst *openstackInstance) Tags() cloud.InstanceTags {
+	inst.mtx.Lock()
+	defer inst.mtx.Unlock()
+	tags := cloud.InstanceTags{}
+	for k, v := range inst.server.Metadata {
+		tags[k] = v
+	}
+	return tags
+}
+
+// Destroy deletes the server. If the driver created a port for it,
+// the port is deleted later by managePorts.
+func (inst *openstackInstance) Destroy() error {
+	err := inst.provider.client.DeleteServer(context.Background(), inst.server.ID)
+	if responseCodeIs(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Address returns the instance's first fixed IPv4 address on
+// Network, or on any network if Network is not configured.
+func (inst *openstackInstance) Address() string {
+	var networks []string
+	for name := range inst.server.Addresses {
+		networks = append(networks, name)
+	}
+	sort.Strings(networks)
+	for _, name := range networks {
+		addrs, _ := inst.server.Addresses[name].([]any)
+		for _, a := range addrs {
+			addr, _ := a.(map[string]any)
+			if addr["OS-EXT-IPS:type"] == "floating" {
+				continue
+			}
+			if version, _ := addr["version"].(float64); version != 4 {
+				continue
+			}
+			if ip, ok := addr["addr"].(string); ok {
+				return ip
+			}
+		}
+	}
+	return inst.server.AccessIPv4
+}
+
+func (inst *openstackInstance) RemoteUser() string {
+	return inst.provider.osconfig.AdminUsername
+}
+
+func (inst *openstackInstance) VerifyHostKey(ssh.PublicKey, *ssh.Client) error {
+	return cloud.ErrNotImplemented
+}
+
+func (inst *openstackInstance) PriceHistory(arvados.InstanceType) []cloud.InstancePrice {
+	return nil
+}
+
+// State implements cloud.InstanceWithState.
+func (inst *openstackInstance) State() cloud.InstanceState {
+	switch inst.server.Status {
+	case "BUILD":
+		return cloud.InstanceState{Provisioning: cloud.ProvisioningCreating, Power: cloud.PowerStarting}
+	case "ACTIVE":
+		return cloud.InstanceState{Provisioning: cloud.ProvisioningSucceeded, Power: cloud.PowerRunning}
+	case "REBOOT", "HARD_REBOOT":
+		return cloud.InstanceState{Provisioning: cloud.ProvisioningSucceeded, Power: cloud.PowerStarting}
+	case "SHUTOFF", "SUSPENDED", "PAUSED", "SHELVED", "SHELVED_OFFLOADED":
+		return cloud.InstanceState{Provisioning: cloud.ProvisioningSucceeded, Power: cloud.PowerStopped}
+	case "ERROR":
+		// E.g., "No valid host was found" when the cloud
+		// doesn't have capacity for the flavor.
+		return cloud.InstanceState{Provisioning: cloud.ProvisioningFailed}
+	case "DELETED", "SOFT_DELETED":
+		return cloud.InstanceState{Provisioning: cloud.ProvisioningDeleting, Power: cloud.PowerStopped}
+	default:
+		return cloud.InstanceState{}
+	}
+}
+
+type rateLimitError struct {
+	error
+	earliestRetry time.Time
+}
+
+func (err rateLimitError) EarliestRetry() time.Time {
+	return err.earliestRetry
+}
+
+type quotaError struct {
+	error
+}
+
+func (er *quotaError) IsQuotaError() bool {
+	return true
+}
+
+// isThrottleError returns true if the error indicates the API rate
+// limit was exceeded. Older Nova versions respond 413 instead of
+// 429.
+func isThrottleError(err error) bool {
+	return responseCodeIs(err, http.StatusTooManyRequests) ||
+		(responseCodeIs(err, http.StatusRequestEntityTooLarge) && !isQuotaMessage(err))
+}
+
+// isErrorQuota returns true if the error indicates the project's
+// quota for instances, cores, RAM, volumes, or ports has been
+// reached.
+func isErrorQuota(err error) bool {
+	return (responseCodeIs(err, http.StatusForbidden) ||
+		responseCodeIs(err, http.StatusConflict) ||
+		responseCodeIs(err, http.StatusRequestEntityTooLarge)) && isQuotaMessage(err)
+}
+
+// responseCodeIs returns true if err is (or wraps) an unexpected
+// HTTP response with the given status code.
+func responseCodeIs(err error, code int) bool {
+	var rerr gophercloud.ErrUnexpectedResponseCode
+	return errors.As(err, &rerr) && rerr.Actual == code
+}
+
+func isQuotaMessage(err error) bool {
+	var rerr gophercloud.ErrUnexpectedResponseCode
+	if !errors.As(err, &rerr) {
+		return false
+	}
+	body := strings.ToLower(string(rerr.Body))
+	return strings.Contains(body, "quota exceeded") || strings.Contains(body, "overquota")
+}
+
+func wrapError(err error, throttleValue *atomic.Value) error {
+	if isThrottleError(err) {
+		// Back off exponentially until an upstream call
+		// either succeeds or returns a non-throttle error.
+		d, _ := throttleValue.Load().(time.Duration)
+		d = d*3/2 + time.Second
+		if d < throttleDelayMin {
+			d = throttleDelayMin
+		} else if d > throttleDelayMax {
+			d = throttleDelayMax
+		}
+		throttleValue.Store(d)
+		return rateLimitError{error: err, earliestRetry: time.Now().Add(d)}
+	} else if isErrorQuota(err) {
+		return &quotaError{error: err}
+	}
+	throttleValue.Store(time.Duration(0))
+	return err
+}
+
+var boolLabelValue = map[bool]string{false: "0", true: "1"}
@@ -0,0 +1,478 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package openstack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+// Gocheck boilerplate
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+func httpError(code int, body string) error {
+	return gophercloud.ErrUnexpectedResponseCode{Actual: code, Body: []byte(body)}
+}
+
+type openstackStub struct {
+	sync.Mutex
+	servers     map[string]*servers.Server // id => server
+	createReqs  []map[string]any
+	keypairs    map[string]keypairs.KeyPair
+	keypairGets int
+	ports       map[string]*ports.Port // id => port
+	deleted     []string               // port IDs
+	createErr   error
+	nextID      int
+}
+
+func (stub *openstackStub) newID(prefix string) string {
+	stub.nextID++
+	return fmt.Sprintf("%s-%04d", prefix, stub.nextID)
+}
+
+func (stub *openstackStub) CreateServer(ctx context.Context, opts servers.CreateOptsBuilder) (*servers.Server, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	req, err := opts.ToServerCreateMap()
+	if err != nil {
+		return nil, err
+	}
+	stub.createReqs = append(stub.createReqs, req)
+	if stub.createErr != nil {
+		return nil, stub.createErr
+	}
+	s := req["server"].(map[string]any)
+	srv := &servers.Server{
+		ID:       stub.newID("server"),
+		Name:     s["name"].(string),
+		Status:   "ACTIVE",
+		Flavor:   map[string]any{"id": s["flavorRef"]},
+		Metadata: map[string]string{},
+		Addresses: map[string]any{
+			"arvados": []any{
+				map[string]any{"addr": "fd00::3", "version": float64(6), "OS-EXT-IPS:type": "fixed"},
+				map[string]any{"addr": "203.0.113.3", "version": float64(4), "OS-EXT-IPS:type": "floating"},
+				map[string]any{"addr": "10.1.2.3", "version": float64(4), "OS-EXT-IPS:type": "fixed"},
+			},
+		},
+	}
+	if md, ok := s["metadata"].(map[string]any); ok {
+		for k, v := range md {
+			srv.Metadata[k] = v.(string)
+		}
+	}
+	if nets, ok := s["networks"].([]map[string]any); ok {
+		for _, net := range nets {
+			if port := stub.ports[net["port"].(string)]; port != nil {
+				port.DeviceID = srv.ID
+			}
+		}
+	}
+	stub.servers[srv.ID] = srv
+	return &servers.Server{ID: srv.ID}, nil
+}
+
+func (stub *openstackStub) ListServers(ctx context.Context, nameRegexp string) ([]servers.Server, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	var list []servers.Server
+	for _, srv := range stub.servers {
+		list = append(list, *srv)
+	}
+	return list, nil
+}
+
+func (stub *openstackStub) DeleteServer(ctx context.Context, id string) error {
+	stub.Lock()
+	defer stub.Unlock()
+	if stub.servers[id] == nil {
+		return httpError(http.StatusNotFound, "")
+	}
+	delete(stub.servers, id)
+	for _, port := range stub.ports {
+		if port.DeviceID == id {
+			port.DeviceID = ""
+		}
+	}
+	return nil
+}
+
+func (stub *openstackStub) ResetMetadata(ctx context.Context, id string, metadata map[string]string) (map[string]string, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	srv := stub.servers[id]
+	if srv == nil {
+		return nil, httpError(http.StatusNotFound, "")
+	}
+	srv.Metadata = metadata
+	return metadata, nil
+}
+
+func (stub *openstackStub) ListFlavors(ctx context.Context) ([]flavors.Flavor, error) {
+	return []flavors.Flavor{
+		{ID: "f1", Name: "m1.small"},
+		{ID: "f2", Name: "m1.large"},
+	}, nil
+}
+
+func (stub *openstackStub) GetKeyPair(ctx context.Context, name string) (*keypairs.KeyPair, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	stub.keypairGets++
+	kp, ok := stub.keypairs[name]
+	if !ok {
+		return nil, httpError(http.StatusNotFound, "")
+	}
+	return &kp, nil
+}
+
+func (stub *openstackStub) CreateKeyPair(ctx context.Context, opts keypairs.CreateOpts) (*keypairs.KeyPair, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	kp := keypairs.KeyPair{Name: opts.Name, PublicKey: opts.PublicKey}
+	stub.keypairs[opts.Name] = kp
+	return &kp, nil
+}
+
+func (stub *openstackStub) CreatePort(ctx context.Context, opts ports.CreateOpts) (*ports.Port, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	port := &ports.Port{
+		ID:        stub.newID("port"),
+		NetworkID: opts.NetworkID,
+		Name:      opts.Name,
+		CreatedAt: time.Now(),
+	}
+	if opts.SecurityGroups != nil {
+		port.SecurityGroups = *opts.SecurityGroups
+	}
+	stub.ports[port.ID] = port
+	copy := *port
+	return &copy, nil
+}
+
+func (stub *openstackStub) ListPorts(ctx context.Context, opts ports.ListOpts) ([]ports.Port, error) {
+	stub.Lock()
+	defer stub.Unlock()
+	var list []ports.Port
+	for _, port := range stub.ports {
+		if port.NetworkID == opts.NetworkID {
+			list = append(list, *port)
+		}
+	}
+	return list, nil
+}
+
+func (stub *openstackStub) DeletePort(ctx context.Context, id string) error {
+	stub.Lock()
+	defer stub.Unlock()
+	if stub.ports[id] == nil {
+		return httpError(http.StatusNotFound, "")
+	}
+	delete(stub.ports, id)
+	stub.deleted = append(stub.deleted, id)
+	return nil
+}
+
+type OpenStackInstanceSetSuite struct{}
+
+var _ = check.Suite(&OpenStackInstanceSetSuite{})
+
+func (s *OpenStackInstanceSetSuite) newInstanceSet(c *check.C, params map[string]interface{}, reg *prometheus.Registry) (*openstackInstanceSet, *openstackStub) {
+	conf := map[string]interface{}{
+		"AdminUsername":                "crunch",
+		"Network":                      "net-1234",
+		"SecurityGroups":               []string{"arvados-compute"},
+		"DeleteDanglingResourcesAfter": "20s",
+	}
+	for k, v := range params {
+		conf[k] = v
+	}
+	buf, _ := json.Marshal(conf)
+	var osconfig openstackInstanceSetConfig
+	c.Assert(json.Unmarshal(buf, &osconfig), check.IsNil)
+	stub := &openstackStub{
+		servers:  map[string]*servers.Server{},
+		keypairs: map[string]keypairs.KeyPair{},
+		ports:    map[string]*ports.Port{},
+	}
+	is, err := newInstanceSet(osconfig, stub, "test123", ctxlog.TestLogger(c), reg)
+	c.Assert(err, check.IsNil)
+	return is, stub
+}
+
+func (s *OpenStackInstanceSetSuite) TestAuthOptions(c *check.C) {
+	opts, err := openstackInstanceSetConfig{
+		IdentityEndpoint:  "https://keystone.example:5000/v3",
+		Username:          "arvados",
+		Password:          "secret",
+		UserDomainName:    "Default",
+		ProjectName:       "arvados",
+		ProjectDomainName: "Projects",
+	}.authOptions()
+	c.Assert(err, check.IsNil)
+	c.Check(opts.Username, check.Equals, "arvados")
+	c.Check(opts.DomainName, check.Equals, "Default")
+	c.Check(*opts.Scope, check.Equals, gophercloud.AuthScope{ProjectName: "arvados", DomainName: "Projects"})
+	c.Check(opts.AllowReauth, check.Equals, true)
+
+	opts, err = openstackInstanceSetConfig{
+		IdentityEndpoint:            "https://keystone.example:5000/v3",
+		ApplicationCredentialID:     "abc",
+		ApplicationCredentialSecret: "def",
+	}.authOptions()
+	c.Assert(err, check.IsNil)
+	c.Check(opts.ApplicationCredentialID, check.Equals, "abc")
+	c.Check(opts.Scope, check.IsNil)
+
+	for _, trial := range []struct {
+		cfg openstackInstanceSetConfig
+		err string
+	}{
+		{openstackInstanceSetConfig{IdentityEndpoint: "https://keystone.example", ApplicationCredentialID: "abc"}, `.*ApplicationCredentialSecret is empty`},
+		{openstackInstanceSetConfig{IdentityEndpoint: "https://keystone.example", Username: "arvados"}, `.*Username/Password and ApplicationCredentialID are empty`},
+		{openstackInstanceSetConfig{IdentityEndpoint: "https://keystone.example", Username: "arvados", Password: "secret"}, `.*one of ProjectID or ProjectName must be set`},
+	} {
+		_, err := trial.cfg.authOptions()
+		c.Check(err, check.ErrorMatches, trial.err)
+	}
+}
+
+func (s *OpenStackInstanceSetSuite) TestCreate(c *check.C) {
+	reg := prometheus.NewRegistry()
+	is, stub := s.newInstanceSet(c, map[string]interface{}{
+		"Zones":             []string{"az1", "az2"},
+		"ScratchVolumeType": "ssd",
+	}, reg)
+	defer is.Stop()
+	pk, _ := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+
+	inst, err := is.Create(arvados.InstanceType{
+		ProviderType: "m1.large",
+		AddedScratch: 3<<30 + 1,
+	}, "image-1234", cloud.InstanceTags{
+		"ArvadosInstanceType": "large",
+	}, "echo hello", pk)
+	c.Assert(err, check.IsNil)
+	c.Check(inst.String(), check.Matches, `compute-test123-[0-9a-f]{16}`)
+	c.Check(inst.Tags(), check.DeepEquals, cloud.InstanceTags{"ArvadosInstanceType": "large"})
+	c.Check(inst.ProviderType(), check.Equals, "m1.large")
+	c.Check(inst.RemoteUser(), check.Equals, "crunch")
+	c.Check(inst.(cloud.InstanceWithState).State().Power, check.Equals, cloud.PowerStarting)
+
+	c.Assert(stub.createReqs, check.HasLen, 1)
+	req := stub.createReqs[0]["server"].(map[string]any)
+	c.Check(req["name"], check.Equals, inst.String())
+	c.Check(req["flavorRef"], check.Equals, "f2")
+	c.Check(req["imageRef"], check.Equals, "image-1234")
+	c.Check(req["availability_zone"], check.Equals, "az1")
+	c.Check(req["key_name"], check.Matches, `arvados-dispatch-keypair-[0-9a-f]{32}`)
+	c.Check(req["user_data"], check.NotNil)
+	c.Check(req["security_groups"], check.IsNil)
+	c.Check(req["metadata"], check.DeepEquals, map[string]any{"ArvadosInstanceType": "large"})
+	bdm := req["block_device_mapping_v2"].([]map[string]any)
+	c.Assert(bdm, check.HasLen, 2)
+	c.Check(bdm[0]["source_type"], check.Equals, "image")
+	c.Check(bdm[1]["volume_size"], check.Equals, float64(4))
+	c.Check(bdm[1]["volume_type"], check.Equals, "ssd")
+
+	// The port is created with the security groups, and
+	// attached to the server.
+	c.Assert(stub.ports, check.HasLen, 1)
+	for _, port := range stub.ports {
+		c.Check(port.Name, check.Equals, inst.String()+"-port")
+		c.Check(port.NetworkID, check.Equals, "net-1234")
+		c.Check(port.SecurityGroups, check.DeepEquals, []string{"arvados-compute"})
+		c.Check(port.DeviceID, check.Equals, string(inst.ID()))
+		c.Check(req["networks"], check.DeepEquals, []map[string]any{{"port": port.ID}})
+	}
+
+	// The keypair is imported once.
+	c.Check(stub.keypairs, check.HasLen, 1)
+	_, err = is.Create(arvados.InstanceType{ProviderType: "f1"}, "image-1234", nil, "", pk)
+	c.Assert(err, check.IsNil)
+	c.Check(stub.keypairs, check.HasLen, 1)
+	c.Check(stub.keypairGets, check.Equals, 1)
+	req = stub.createReqs[1]["server"].(map[string]any)
+	c.Check(req["flavorRef"], check.Equals, "f1")
+	c.Check(req["availability_zone"], check.Equals, "az2")
+	c.Check(req["block_device_mapping_v2"], check.IsNil)
+
+	// Without Network, Nova chooses the network and applies
+	// the security groups.
+	is.osconfig.Network = ""
+	_, err = is.Create(arvados.InstanceType{ProviderType: "m1.small"}, "image-1234", nil, "", nil)
+	c.Assert(err, check.IsNil)
+	req = stub.createReqs[2]["server"].(map[string]any)
+	c.Check(req["networks"], check.IsNil)
+	c.Check(req["key_name"], check.IsNil)
+	c.Check(req["security_groups"], check.DeepEquals, []map[string]any{{"name": "arvados-compute"}})
+	c.Check(stub.ports, check.HasLen, 2)
+
+	_, err = is.Create(arvados.InstanceType{ProviderType: "m9.huge"}, "image-1234", nil, "", nil)
+	c.Check(err, check.ErrorMatches, `flavor "m9.huge" not found`)
+
+	metrics := arvadostest.GatherMetricsAsString(reg)
+	c.Check(metrics, check.Matches, `(?ms).*openstack_instance_starts_total{success="1"} 3\n.*`)
+}
+
+func (s *OpenStackInstanceSetSuite) TestCreateFailureCleansUpPort(c *check.C) {
+	is, stub := s.newInstanceSet(c, nil, nil)
+	defer is.Stop()
+	stub.createErr = httpError(http.StatusForbidden, `{"forbidden": {"code": 403, "message": "Quota exceeded for cores: Requested 8, but already used 90 of 96 cores"}}`)
+	_, err := is.Create(arvados.InstanceType{ProviderType: "m1.small"}, "image-1234", nil, "", nil)
+	var quotaErr cloud.QuotaError
+	c.Check(errors.As(err, &quotaErr), check.Equals, true)
+	c.Check(stub.ports, check.HasLen, 0)
+	c.Check(stub.deleted, check.HasLen, 1)
+}
+
+func (s *OpenStackInstanceSetSuite) TestInstancesAndTags(c *check.C) {
+	reg := prometheus.NewRegistry()
+	is, stub := s.newInstanceSet(c, nil, reg)
+	defer is.Stop()
+	tags := cloud.InstanceTags{"ArvadosInstanceSetID": "test123", "ArvadosInstanceType": "small"}
+	inst, err := is.Create(arvados.InstanceType{ProviderType: "m1.small"}, "image-1234", tags, "", nil)
+	c.Assert(err, check.IsNil)
+	_, err = is.Create(arvados.InstanceType{ProviderType: "m1.small"}, "image-1234", cloud.InstanceTags{"ArvadosInstanceSetID": "other"}, "", nil)
+	c.Assert(err, check.IsNil)
+	// Servers created by someone else are ignored.
+	stub.servers["foreign"] = &servers.Server{ID: "foreign", Name: "web-1", Metadata: map[string]string{"ArvadosInstanceSetID": "test123"}}
+
+	list, err := is.Instances(cloud.InstanceTags{"ArvadosInstanceSetID": "test123"})
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 1)
+	c.Check(list[0].ID(), check.Equals, inst.ID())
+	c.Check(list[0].Address(), check.Equals, "10.1.2.3")
+	c.Check(list[0].ProviderType(), check.Equals, "m1.small")
+	c.Check(list[0].Tags(), check.DeepEquals, tags)
+	c.Check(list[0].(cloud.InstanceWithState).State(), check.Equals, cloud.InstanceState{
+		Provisioning: cloud.ProvisioningSucceeded,
+		Power:        cloud.PowerRunning,
+	})
+	c.Check(arvadostest.GatherMetricsAsString(reg), check.Matches, `(?ms).*openstack_instances 1\n.*`)
+
+	tags["ArvadosIdleBehavior"] = "hold"
+	c.Assert(list[0].SetTags(tags), check.IsNil)
+	c.Check(list[0].Tags(), check.DeepEquals, tags)
+	list, err = is.Instances(nil)
+	c.Assert(err, check.IsNil)
+	c.Check(list, check.HasLen, 2)
+
+	c.Check(inst.Destroy(), check.IsNil)
+	c.Check(stub.servers[string(inst.ID())], check.IsNil)
+	// Destroying an instance that is already gone is not an
+	// error.
+	c.Check(inst.Destroy(), check.IsNil)
+}
+
+func (s *OpenStackInstanceSetSuite) TestPortGC(c *check.C) {
+	is, stub := s.newInstanceSet(c, nil, nil)
+	defer is.Stop()
+	old := time.Now().Add(-time.Minute)
+	for _, port := range []*ports.Port{
+		{ID: "dangling", Name: "compute-test123-0123-port", NetworkID: "net-1234", CreatedAt: old},
+		{ID: "attached", Name: "compute-test123-4567-port", NetworkID: "net-1234", CreatedAt: old, DeviceID: "server-1"},
+		{ID: "new", Name: "compute-test123-89ab-port", NetworkID: "net-1234", CreatedAt: time.Now()},
+		{ID: "notimestamp", Name: "compute-test123-cdef-port", NetworkID: "net-1234"},
+		{ID: "foreign", Name: "web-port", NetworkID: "net-1234", CreatedAt: old},
+		{ID: "otherdispatcher", Name: "compute-test456-0123-port", NetworkID: "net-1234", CreatedAt: old},
+		{ID: "othernetwork", Name: "compute-test123-0123-port", NetworkID: "net-5678", CreatedAt: old},
+	} {
+		stub.ports[port.ID] = port
+	}
+
+	is.osconfig.DryRunDeletes = true
+	c.Assert(is.GarbageCollect(), check.IsNil)
+	s.waitForPortGC(c, is)
+	c.Check(stub.deleted, check.HasLen, 0)
+
+	is.osconfig.DryRunDeletes = false
+	_, err := is.Instances(nil)
+	c.Assert(err, check.IsNil)
+	s.waitForPortGC(c, is)
+	c.Check(stub.deleted, check.DeepEquals, []string{"dangling"})
+	c.Check(stub.ports, check.HasLen, 6)
+
+	// Deleting the server detaches its port, which becomes
+	// dangling.
+	stub.servers["server-1"] = &servers.Server{ID: "server-1", Name: "compute-test123-4567"}
+	inst := &openstackInstance{provider: is, server: *stub.servers["server-1"]}
+	c.Assert(inst.Destroy(), check.IsNil)
+	c.Assert(is.GarbageCollect(), check.IsNil)
+	s.waitForPortGC(c, is)
+	c.Check(stub.deleted, check.DeepEquals, []string{"dangling", "attached"})
+}
+
+func (s *OpenStackInstanceSetSuite) waitForPortGC(c *check.C, is *openstackInstanceSet) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		is.portGCMtx.Lock()
+		n := len(is.portGC) + len(is.deletingPorts)
+		is.portGCMtx.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.Fatal("timed out waiting for port GC")
+		}
+	}
+}
+
+func (s *OpenStackInstanceSetSuite) TestState(c *check.C) {
+	for status, state := range map[string]cloud.InstanceState{
+		"BUILD":   {Provisioning: cloud.ProvisioningCreating, Power: cloud.PowerStarting},
+		"ACTIVE":  {Provisioning: cloud.ProvisioningSucceeded, Power: cloud.PowerRunning},
+		"SHUTOFF": {Provisioning: cloud.ProvisioningSucceeded, Power: cloud.PowerStopped},
+		"ERROR":   {Provisioning: cloud.ProvisioningFailed},
+		"UNKNOWN": {},
+	} {
+		inst := &openstackInstance{server: servers.Server{Status: status}}
+		c.Check(inst.State(), check.Equals, state, check.Commentf("status %s", status))
+	}
+}
+
+func (s *OpenStackInstanceSetSuite) TestWrapError(c *check.C) {
+	var throttle atomic.Value
+	err := wrapError(httpError(http.StatusTooManyRequests, ""), &throttle)
+	var rlErr cloud.RateLimitError
+	c.Assert(errors.As(err, &rlErr), check.Equals, true)
+	c.Check(rlErr.EarliestRetry().After(time.Now()), check.Equals, true)
+
+	err = wrapError(httpError(http.StatusRequestEntityTooLarge, `{"overLimit": {"message": "This request was rate-limited."}}`), &throttle)
+	c.Check(errors.As(err, &rlErr), check.Equals, true)
+
+	var quotaErr cloud.QuotaError
+	err = wrapError(httpError(http.StatusForbidden, `{"forbidden": {"message": "Quota exceeded for instances: Requested 1, but already used 10 of 10 instances"}}`), &throttle)
+	c.Check(errors.As(err, &quotaErr), check.Equals, true)
+	err = wrapError(httpError(http.StatusConflict, `{"NeutronError": {"type": "OverQuota", "message": "Quota exceeded for resources: ['port']."}}`), &throttle)
+	c.Check(errors.As(err, &quotaErr), check.Equals, true)
+
+	err = wrapError(httpError(http.StatusForbidden, `{"forbidden": {"message": "Policy doesn't allow os_compute_api:servers:create to be performed."}}`), &throttle)
+	c.Check(errors.As(err, &quotaErr), check.Equals, false)
+	c.Check(errors.As(err, &rlErr), check.Equals, false)
+}
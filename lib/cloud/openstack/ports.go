@@ -0,0 +1,141 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// createPort creates a Neutron port on Network for the named
+// instance.
+func (instanceSet *openstackInstanceSet) createPort(ctx context.Context, name string) (*ports.Port, error) {
+	opts := ports.CreateOpts{
+		NetworkID:   instanceSet.osconfig.Network,
+		Name:        name + "-port",
+		Description: fmt.Sprintf("created by arvados-dispatch-cloud for %s", name),
+	}
+	if sgs := instanceSet.osconfig.SecurityGroups; len(sgs) > 0 {
+		opts.SecurityGroups = &sgs
+	}
+	port, err := instanceSet.client.CreatePort(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error creating port: %w", err)
+	}
+	return port, nil
+}
+
+// cleanupPort deletes a port that was created for an instance that
+// could not be created. It is a no-op if port is nil.
+func (instanceSet *openstackInstanceSet) cleanupPort(port *ports.Port) {
+	if port == nil {
+		return
+	}
+	err := instanceSet.destroyPort(context.Background(), *port)
+	if err != nil {
+		instanceSet.logger.WithError(err).Warnf("Error cleaning up port after failed create")
+	}
+}
+
+// checkDeletable returns an error if the port does not look like one
+// created by this dispatcher, i.e., its name lacks namePrefix, or
+// it is attached to a device. This guards against deleting
+// unrelated ports if, e.g., Network is shared with other
+// applications.
+func (instanceSet *openstackInstanceSet) checkDeletable(port ports.Port) error {
+	if !strings.HasPrefix(port.Name, instanceSet.namePrefix) {
+		return fmt.Errorf("refusing to delete port %s: name %q does not start with %q", port.ID, port.Name, instanceSet.namePrefix)
+	}
+	if port.DeviceID != "" {
+		return fmt.Errorf("refusing to delete port %s (%s): attached to %s", port.ID, port.Name, port.DeviceID)
+	}
+	return nil
+}
+
+func (instanceSet *openstackInstanceSet) destroyPort(ctx context.Context, port ports.Port) error {
+	if err := instanceSet.checkDeletable(port); err != nil {
+		return err
+	}
+	if instanceSet.osconfig.DryRunDeletes {
+		instanceSet.logger.Infof("DryRunDeletes is enabled, not deleting port %s (%s)", port.ID, port.Name)
+		return nil
+	}
+	err := instanceSet.client.DeletePort(ctx, port.ID)
+	if responseCodeIs(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// managePorts queues dangling ports for deletion. A port is
+// dangling if it was created by this dispatcher (its name starts
+// with namePrefix), it is not attached to a server, and it was
+// created more than DeleteDanglingResourcesAfter ago.
+//
+// Nova leaves such ports behind when a server is deleted, or when
+// server creation fails after the port was created and the cleanup
+// in Create also fails.
+func (instanceSet *openstackInstanceSet) managePorts(ctx context.Context) error {
+	list, err := instanceSet.client.ListPorts(ctx, ports.ListOpts{NetworkID: instanceSet.osconfig.Network})
+	if err != nil {
+		return fmt.Errorf("error listing ports: %w", err)
+	}
+	threshold := time.Now().Add(-instanceSet.osconfig.DeleteDanglingResourcesAfter.Duration())
+	for _, port := range list {
+		if !strings.HasPrefix(port.Name, instanceSet.namePrefix) || port.DeviceID != "" {
+			continue
+		}
+		if port.CreatedAt.IsZero() {
+			// Creation time is unknown (the Neutron
+			// deployment doesn't report timestamps), so
+			// we can't tell whether a server is about to
+			// be attached to it.
+			continue
+		}
+		if port.CreatedAt.After(threshold) {
+			continue
+		}
+		instanceSet.logger.Printf("Will delete port %s (%s) because it is unattached and older than %s", port.ID, port.Name, instanceSet.osconfig.DeleteDanglingResourcesAfter)
+		instanceSet.enqueuePort(port)
+	}
+	return nil
+}
+
+// enqueuePort adds the port to the deletion queue, unless it is
+// already queued or being deleted. If the queue is full, the port
+// is skipped; it will be found again by a later managePorts call.
+func (instanceSet *openstackInstanceSet) enqueuePort(port ports.Port) {
+	instanceSet.portGCMtx.Lock()
+	defer instanceSet.portGCMtx.Unlock()
+	if instanceSet.portGC == nil || instanceSet.deletingPorts[port.ID] {
+		return
+	}
+	select {
+	case instanceSet.portGC <- port:
+		instanceSet.deletingPorts[port.ID] = true
+	default:
+		instanceSet.logger.Warnf("not deleting port %s (%s) yet: queue is full", port.ID, port.Name)
+	}
+}
+
+// runPortGC deletes ports from the queue until Stop is called.
+func (instanceSet *openstackInstanceSet) runPortGC(queue <-chan ports.Port) {
+	for port := range queue {
+		err := instanceSet.destroyPort(context.Background(), port)
+		if err != nil {
+			instanceSet.logger.WithError(err).Warnf("error deleting port %s (%s)", port.ID, port.Name)
+		} else {
+			instanceSet.logger.Printf("Deleted port %s (%s)", port.ID, port.Name)
+		}
+		instanceSet.portGCMtx.Lock()
+		delete(instanceSet.deletingPorts, port.ID)
+		instanceSet.portGCMtx.Unlock()
+	}
+}
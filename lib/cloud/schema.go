@@ -0,0 +1,234 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// A ConfigSchema describes the JSON values accepted by a driver's
+// configuration (or a part of it), using a subset of JSON Schema
+// keywords so it can be consumed by other tools.
+//
+// An object with Properties accepts only the listed keys (matched
+// case-insensitively, like encoding/json). An object with
+// AdditionalProperties accepts any keys, with values matching
+// AdditionalProperties. An empty Type accepts any value.
+type ConfigSchema struct {
+	Type                 string                   `json:"type,omitempty"`
+	Properties           map[string]*ConfigSchema `json:"properties,omitempty"`
+	AdditionalProperties *ConfigSchema            `json:"additionalProperties,omitempty"`
+	Items                *ConfigSchema            `json:"items,omitempty"`
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	durationType        = reflect.TypeOf(arvados.Duration(0))
+)
+
+// ConfigSchemaOf returns a schema describing the JSON values that
+// can be decoded into a value of the same type as v (typically a
+// driver's configuration struct) with encoding/json.
+//
+// Types with custom JSON decoding accept any value, except
+// arvados.Duration, which accepts a string.
+func ConfigSchemaOf(v interface{}) *ConfigSchema {
+	return configSchemaOfType(reflect.TypeOf(v))
+}
+
+func configSchemaOfType(t reflect.Type) *ConfigSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == durationType {
+		return &ConfigSchema{Type: "string"}
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return &ConfigSchema{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &ConfigSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &ConfigSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &ConfigSchema{Type: "number"}
+	case reflect.String:
+		return &ConfigSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// []byte is encoded as a base64 string.
+			return &ConfigSchema{Type: "string"}
+		}
+		return &ConfigSchema{Type: "array", Items: configSchemaOfType(t.Elem())}
+	case reflect.Map:
+		return &ConfigSchema{Type: "object", AdditionalProperties: configSchemaOfType(t.Elem())}
+	case reflect.Struct:
+		schema := &ConfigSchema{Type: "object", Properties: map[string]*ConfigSchema{}}
+		addStructProperties(schema, t)
+		return schema
+	default:
+		return &ConfigSchema{}
+	}
+}
+
+// addStructProperties adds a property to schema for each field of
+// struct type t that encoding/json would decode into, including
+// fields of embedded structs.
+func addStructProperties(schema *ConfigSchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addStructProperties(schema, ft)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = configSchemaOfType(field.Type)
+	}
+}
+
+// Check returns an error describing each key in the given JSON
+// document that is not accepted by the schema, and each value that
+// has the wrong type. A null value is always accepted.
+func (schema *ConfigSchema) Check(data json.RawMessage) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	var problems []string
+	schema.check(v, "", &problems)
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+func (schema *ConfigSchema) check(v interface{}, path string, problems *[]string) {
+	if v == nil || schema.Type == "" {
+		return
+	}
+	label := path
+	if label == "" {
+		label = "top level"
+	}
+	wrongType := func() {
+		*problems = append(*problems, fmt.Sprintf("%s: expected %s, got %s", label, schema.Type, jsonTypeName(v)))
+	}
+	switch schema.Type {
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			wrongType()
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			wrongType()
+		} else if _, err := n.Int64(); err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s: expected integer, got %s", label, n))
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			wrongType()
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			wrongType()
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			wrongType()
+			return
+		}
+		if schema.Items != nil {
+			for i, item := range a {
+				schema.Items.check(item, fmt.Sprintf("%s[%d]", path, i), problems)
+			}
+		}
+	case "object":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			wrongType()
+			return
+		}
+		for key, val := range m {
+			keypath := key
+			if path != "" {
+				keypath = path + "." + key
+			}
+			if schema.Properties != nil {
+				prop := schema.property(key)
+				if prop == nil {
+					*problems = append(*problems, fmt.Sprintf("%s: unknown key", keypath))
+					continue
+				}
+				prop.check(val, keypath, problems)
+			} else if schema.AdditionalProperties != nil {
+				schema.AdditionalProperties.check(val, keypath, problems)
+			}
+		}
+	}
+}
+
+// property returns the schema for the given key, matched the same
+// way encoding/json matches keys to struct fields: an exact match
+// if there is one, otherwise a case-insensitive match.
+func (schema *ConfigSchema) property(key string) *ConfigSchema {
+	if prop, ok := schema.Properties[key]; ok {
+		return prop
+	}
+	for name, prop := range schema.Properties {
+		if strings.EqualFold(name, key) {
+			return prop
+		}
+	}
+	return nil
+}
+
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package cloud
+
+import (
+	"encoding/json"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	. "gopkg.in/check.v1"
+)
+
+type schemaTestEmbedded struct {
+	EmbeddedKey string
+}
+
+type schemaTestConfig struct {
+	schemaTestEmbedded
+	Name    string
+	Count   int
+	Price   float64
+	Enabled bool
+	Timeout arvados.Duration
+	Zones   []string
+	Tags    map[string]string
+	Nested  struct{ Inner int }
+	Renamed string `json:"other_name"`
+	Ignored string `json:"-"`
+	Raw     json.RawMessage
+}
+
+func (s *cloudSuite) TestConfigSchemaOf(c *C) {
+	schema := ConfigSchemaOf(schemaTestConfig{})
+	c.Check(schema.Type, Equals, "object")
+	var keys []string
+	for k := range schema.Properties {
+		keys = append(keys, k)
+	}
+	c.Check(keys, HasLen, 11)
+	c.Check(schema.Properties["EmbeddedKey"].Type, Equals, "string")
+	c.Check(schema.Properties["Count"].Type, Equals, "integer")
+	c.Check(schema.Properties["Price"].Type, Equals, "number")
+	c.Check(schema.Properties["Enabled"].Type, Equals, "boolean")
+	c.Check(schema.Properties["Timeout"].Type, Equals, "string")
+	c.Check(schema.Properties["Zones"].Items.Type, Equals, "string")
+	c.Check(schema.Properties["Tags"].AdditionalProperties.Type, Equals, "string")
+	c.Check(schema.Properties["Nested"].Properties["Inner"].Type, Equals, "integer")
+	c.Check(schema.Properties["other_name"], NotNil)
+	c.Check(schema.Properties["Renamed"], IsNil)
+	c.Check(schema.Properties["Ignored"], IsNil)
+	c.Check(schema.Properties["Raw"].Type, Equals, "")
+
+	// The schema itself is machine-readable.
+	buf, err := json.Marshal(ConfigSchemaOf(struct{ Zones []string }{}))
+	c.Check(err, IsNil)
+	c.Check(string(buf), Equals, `{"type":"object","properties":{"Zones":{"type":"array","items":{"type":"string"}}}}`)
+}
+
+func (s *cloudSuite) TestConfigSchemaCheck(c *C) {
+	schema := ConfigSchemaOf(schemaTestConfig{})
+	for _, trial := range []struct {
+		config string
+		err    string
+	}{
+		{``, ``},
+		{`{}`, ``},
+		{`null`, ``},
+		{`{"Name": "foo", "count": 3, "Price": 1.5, "Enabled": true, "Timeout": "1m", "Zones": ["1", "2"], "Tags": {"a": "b"}, "Nested": {"Inner": 1}, "other_name": "x", "Raw": [1, {}], "EmbeddedKey": "e"}`, ``},
+		{`{"Name": null, "Zones": null}`, ``},
+		{`[]`, `top level: expected object, got array`},
+		{`{"Bogus": 1}`, `Bogus: unknown key`},
+		{`{"Ignored": "x"}`, `Ignored: unknown key`},
+		{`{"Count": "3"}`, `Count: expected integer, got string`},
+		{`{"Count": 1.5}`, `Count: expected integer, got 1.5`},
+		{`{"Price": "cheap"}`, `Price: expected number, got string`},
+		{`{"Enabled": "yes"}`, `Enabled: expected boolean, got string`},
+		{`{"Timeout": 5}`, `Timeout: expected string, got number`},
+		{`{"Zones": "1"}`, `Zones: expected array, got string`},
+		{`{"Zones": ["1", 2]}`, `Zones\[1\]: expected string, got number`},
+		{`{"Tags": {"a": 1}}`, `Tags.a: expected string, got number`},
+		{`{"Nested": {"Inner": 1, "Outer": 2}}`, `Nested.Outer: unknown key`},
+		{`{"Bogus": 1, "Count": true}`, `Bogus: unknown key; Count: expected integer, got boolean`},
+		{`{`, `unexpected EOF`},
+	} {
+		c.Logf("trial: %s", trial.config)
+		err := schema.Check(json.RawMessage(trial.config))
+		if trial.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, trial.err)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"os/exec"
 
+	"git.arvados.org/arvados.git/lib/cloud"
 	"git.arvados.org/arvados.git/lib/cmd"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
@@ -60,9 +61,13 @@ func (dumpCommand) RunCommand(prog string, args []string, stdin io.Reader, stdou
 
 var CheckCommand checkCommand
 
-type checkCommand struct{}
+type checkCommand struct {
+	// Cloud driver configuration schemas to check
+	// DriverParameters against. See Loader.CloudDriverSchemas.
+	CloudDriverSchemas map[string]*cloud.ConfigSchema
+}
 
-func (checkCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+func (command checkCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 	var err error
 	var logbuf = &bytes.Buffer{}
 	defer func() {
@@ -75,8 +80,9 @@ func (checkCommand) RunCommand(prog string, args []string, stdin io.Reader, stdo
 	logger := logrus.New()
 	logger.Out = logbuf
 	loader := &Loader{
-		Stdin:  stdin,
-		Logger: logger,
+		Stdin:              stdin,
+		Logger:             logger,
+		CloudDriverSchemas: command.CloudDriverSchemas,
 	}
 
 	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
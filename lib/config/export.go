@@ -97,12 +97,17 @@ var whitelist = map[string]bool{
 	"Collections.BalanceTimeout":                          false,
 	"Collections.BalanceTrashLimit":                       false,
 	"Collections.BalanceUpdateLimit":                      false,
+	"Collections.BlobAccessTimeFile":                      false,
+	"Collections.BlobAccessTimeResolution":                false,
+	"Collections.BlobProvenanceFile":                      false,
 	"Collections.BlobDeleteConcurrency":                   false,
+	"Collections.BlobDeleteVerifyReplication":             false,
 	"Collections.BlobMissingReport":                       false,
 	"Collections.BlobReplicateConcurrency":                false,
 	"Collections.BlobSigning":                             true,
 	"Collections.BlobSigningKey":                          false,
 	"Collections.BlobSigningTTL":                          true,
+	"Collections.BlobStreamingWrites":                     false,
 	"Collections.BlobTrash":                               false,
 	"Collections.BlobTrashCheckInterval":                  false,
 	"Collections.BlobTrashConcurrency":                    false,
@@ -111,12 +116,17 @@ var whitelist = map[string]bool{
 	"Collections.DefaultReplication":                      true,
 	"Collections.DefaultTrashLifetime":                    true,
 	"Collections.ForwardSlashNameSubstitution":            true,
+	"Collections.KeepproxyCompression":                    false,
 	"Collections.KeepproxyPermission":                     false,
+	"Collections.KeepstoreDrainTimeout":                   false,
 	"Collections.ManagedProperties":                       true,
 	"Collections.ManagedProperties.*":                     true,
 	"Collections.ManagedProperties.*.*":                   true,
 	"Collections.PreserveVersionIfIdle":                   true,
+	"Collections.PreviousBlobSigningKeys":                 false,
 	"Collections.S3FolderObjects":                         true,
+	"Collections.SmallBlockExtraReplicas":                 false,
+	"Collections.SmallBlockSize":                          false,
 	"Collections.TrashSweepInterval":                      false,
 	"Collections.TrustAllContent":                         true,
 	"Collections.WebDAVCache":                             false,
@@ -201,6 +211,7 @@ var whitelist = map[string]bool{
 	"Login.TrustedClients":                                false,
 	"Login.TrustPrivateNetworks":                          false,
 	"ManagementToken":                                     false,
+	"OutboundProxy":                                       false,
 	"PostgreSQL":                                          false,
 	"RemoteClusters":                                      true,
 	"RemoteClusters.*":                                    true,
@@ -212,6 +223,7 @@ var whitelist = map[string]bool{
 	"Services":                                            true,
 	"Services.*":                                          true,
 	"Services.*.ExternalURL":                              true,
+	"Services.*.ExtraListeners":                           false,
 	"Services.*.InternalURLs":                             false,
 	"StorageClasses":                                      true,
 	"StorageClasses.*":                                    true,
@@ -220,7 +232,9 @@ var whitelist = map[string]bool{
 	"SystemLogs":                                          false,
 	"SystemRootToken":                                     false,
 	"TLS":                                                 false,
+	"TLS.CABundle":                                        false,
 	"TLS.Certificate":                                     false,
+	"TLS.HostOverrides":                                   false,
 	"TLS.Insecure":                                        true,
 	"TLS.Key":                                             false,
 	"Users":                                               true,
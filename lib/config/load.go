@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"dario.cat/mergo"
+	"git.arvados.org/arvados.git/lib/cloud"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"github.com/ghodss/yaml"
 	"github.com/prometheus/client_golang/prometheus"
@@ -50,6 +51,12 @@ type Loader struct {
 	KeepproxyPath           string
 	KeepBalancePath         string
 
+	// Configuration schemas of cloud drivers, keyed by driver
+	// name. If the configured Containers.CloudVMs.Driver is
+	// listed here, Load logs a warning for each problem in the
+	// supplied DriverParameters.
+	CloudDriverSchemas map[string]*cloud.ConfigSchema
+
 	configdata []byte
 	// UTC time for configdata: either the modtime of the file we
 	// read configdata from, or the time when we read configdata
@@ -247,6 +254,7 @@ func (ldr *Loader) Load() (*arvados.Config, error) {
 		return nil, fmt.Errorf("loading config data: %s", err)
 	}
 	ldr.logExtraKeys(merged, src, "")
+	suppliedDriverParams := suppliedCloudDriverParameters(src)
 	removeSampleKeys(merged)
 	// We merge the loaded config into the default, overriding any existing keys.
 	// Make sure we do not override a default with a key that has a 'null' value.
@@ -271,6 +279,7 @@ func (ldr *Loader) Load() (*arvados.Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("transcoding config data: %s", err)
 	}
+	ldr.checkCloudDriverParameters(&cfg, suppliedDriverParams)
 
 	var loadFuncs []func(*arvados.Config) error
 	if !ldr.SkipDeprecated {
@@ -329,6 +338,12 @@ func (ldr *Loader) Load() (*arvados.Config, error) {
 				return nil, err
 			}
 		}
+		for i, key := range cc.Collections.PreviousBlobSigningKeys {
+			err = ldr.checkToken(fmt.Sprintf("Clusters.%s.Collections.PreviousBlobSigningKeys[%d]", id, i), key, true, false)
+			if err != nil {
+				return nil, err
+			}
+		}
 		for _, err = range []error{
 			ldr.checkClusterID(fmt.Sprintf("Clusters.%s", id), id, false),
 			ldr.checkClusterID(fmt.Sprintf("Clusters.%s.Login.LoginCluster", id), cc.Login.LoginCluster, true),
@@ -641,6 +656,49 @@ func (ldr *Loader) logExtraKeys(expected, supplied map[string]interface{}, prefi
 	}
 }
 
+// suppliedCloudDriverParameters returns the
+// Containers.CloudVMs.DriverParameters sections of the given config
+// (before merging with defaults), keyed by cluster ID.
+func suppliedCloudDriverParameters(src map[string]interface{}) map[string]interface{} {
+	params := map[string]interface{}{}
+	clusters, _ := src["Clusters"].(map[string]interface{})
+	for id, cc := range clusters {
+		cc, _ := cc.(map[string]interface{})
+		containers, _ := cc["Containers"].(map[string]interface{})
+		cloudVMs, _ := containers["CloudVMs"].(map[string]interface{})
+		if dp, ok := cloudVMs["DriverParameters"]; ok {
+			params[id] = dp
+		}
+	}
+	return params
+}
+
+// checkCloudDriverParameters logs a warning if the supplied
+// DriverParameters do not match the configured driver's schema in
+// ldr.CloudDriverSchemas.
+//
+// Only the supplied parameters are checked, because the defaults
+// include sample parameters for all drivers.
+func (ldr *Loader) checkCloudDriverParameters(cfg *arvados.Config, supplied map[string]interface{}) {
+	if ldr.Logger == nil {
+		return
+	}
+	for id, params := range supplied {
+		driver := cfg.Clusters[id].Containers.CloudVMs.Driver
+		schema := ldr.CloudDriverSchemas[driver]
+		if schema == nil {
+			continue
+		}
+		buf, err := json.Marshal(params)
+		if err == nil {
+			err = schema.Check(buf)
+		}
+		if err != nil {
+			ldr.Logger.Warnf("Clusters.%s.Containers.CloudVMs.DriverParameters does not match %s driver configuration: %s", id, driver, err)
+		}
+	}
+}
+
 func (ldr *Loader) autofillPreemptible(label string, cc *arvados.Cluster) {
 	if factor := cc.Containers.PreemptiblePriceFactor; factor > 0 {
 		for name, it := range cc.InstanceTypes {
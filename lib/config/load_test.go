@@ -18,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"git.arvados.org/arvados.git/lib/cloud"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
@@ -249,6 +250,51 @@ Clusters:
 	c.Check(logs, check.HasLen, 6)
 }
 
+func (s *LoadSuite) TestCloudDriverParametersWarning(c *check.C) {
+	schemas := map[string]*cloud.ConfigSchema{
+		"testdriver": cloud.ConfigSchemaOf(struct {
+			Region string
+			Zones  []string
+		}{}),
+	}
+	for _, trial := range []struct {
+		driver string
+		params string
+		warn   string
+	}{
+		{"testdriver", `{Region: r1, Zones: ["1", "2"]}`, ``},
+		// AccessKeyID is in the sample DriverParameters in
+		// config.default.yml (for a different driver), so
+		// only the schema check catches it.
+		{"testdriver", `{Region: r1, Zones: "1", AccessKeyID: x}`, `.*Clusters.zzzzz.Containers.CloudVMs.DriverParameters does not match testdriver driver configuration: AccessKeyID: unknown key; Zones: expected array, got string.*\n`},
+		// No schema for this driver
+		{"otherdriver", `{AccessKeyID: x}`, ``},
+	} {
+		c.Logf("trial: %+v", trial)
+		var logbuf bytes.Buffer
+		ldr := testLoader(c, `
+Clusters:
+  zzzzz:
+    ManagementToken: aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa
+    SystemRootToken: aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa
+    Collections:
+      BlobSigningKey: aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa
+    Containers:
+      CloudVMs:
+        Driver: `+trial.driver+`
+        DriverParameters: `+trial.params+`
+`, &logbuf)
+		ldr.CloudDriverSchemas = schemas
+		_, err := ldr.Load()
+		c.Assert(err, check.IsNil)
+		if trial.warn == "" {
+			c.Check(logbuf.String(), check.Equals, "")
+		} else {
+			c.Check(logbuf.String(), check.Matches, trial.warn)
+		}
+	}
+}
+
 func (s *LoadSuite) checkSAMPLEKeys(c *check.C, path string, x interface{}) {
 	v := reflect.Indirect(reflect.ValueOf(x))
 	switch v.Kind() {
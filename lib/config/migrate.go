@@ -0,0 +1,69 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package config
+
+import (
+	"fmt"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Migration is the result of migrating deprecated config keys and
+// legacy per-service config files into the unified config.
+type Migration struct {
+	// The unified config, including everything loaded from
+	// deprecated keys and legacy files.
+	Config *arvados.Config
+
+	// For each cluster, the changes contributed by deprecated
+	// keys and legacy files. If this is empty, the deprecated
+	// keys and legacy files can be removed without affecting the
+	// configuration.
+	Changes map[string][]arvados.ConfigChange
+}
+
+// Migrate loads the config twice -- once ignoring deprecated keys
+// and legacy config files, and once with them -- and returns the
+// resulting unified config along with the changes that depend on
+// the deprecated keys and legacy files.
+//
+// The loader's SkipDeprecated and SkipLegacy fields are restored
+// before returning.
+func (ldr *Loader) Migrate() (*Migration, error) {
+	skipDepr, skipLegacy := ldr.SkipDeprecated, ldr.SkipLegacy
+	defer func() {
+		ldr.SkipDeprecated, ldr.SkipLegacy = skipDepr, skipLegacy
+	}()
+
+	ldr.SkipDeprecated, ldr.SkipLegacy = true, true
+	withoutDepr, err := ldr.Load()
+	if err != nil {
+		return nil, err
+	}
+	ldr.SkipDeprecated, ldr.SkipLegacy = false, false
+	withDepr, err := ldr.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	mig := &Migration{
+		Config:  withDepr,
+		Changes: map[string][]arvados.ConfigChange{},
+	}
+	for id := range withDepr.Clusters {
+		before, after := withoutDepr.Clusters[id], withDepr.Clusters[id]
+		changes, err := arvados.DiffClusters(&before, &after)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %w", id, err)
+		}
+		for i := range changes {
+			changes[i].Deprecated = true
+		}
+		if len(changes) > 0 {
+			mig.Changes[id] = changes
+		}
+	}
+	return mig, nil
+}
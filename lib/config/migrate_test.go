@@ -0,0 +1,38 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package config
+
+import (
+	check "gopkg.in/check.v1"
+)
+
+func (s *LoadSuite) TestMigrate(c *check.C) {
+	ldr := testLoader(c, `
+Clusters:
+ z1111:
+  Mail:
+    SupportEmailAddress: "support@example.invalid"
+  Collections:
+    BlobSigningTTL: 24h
+`, nil)
+	ldr.SkipLegacy = true
+	mig, err := ldr.Migrate()
+	c.Assert(err, check.IsNil)
+	c.Check(ldr.SkipDeprecated, check.Equals, false)
+	c.Check(ldr.SkipLegacy, check.Equals, true)
+	c.Check(mig.Config.Clusters["z1111"].Users.SupportEmailAddress, check.Equals, "support@example.invalid")
+	changes := mig.Changes["z1111"]
+	if c.Check(changes, check.HasLen, 1) {
+		c.Check(changes[0].Path, check.Equals, "Users.SupportEmailAddress")
+		c.Check(changes[0].Old, check.Equals, "arvados@example.com")
+		c.Check(changes[0].New, check.Equals, "support@example.invalid")
+		c.Check(changes[0].Deprecated, check.Equals, true)
+	}
+
+	ldr = testLoader(c, `{Clusters: {z1111: {Collections: {BlobSigningTTL: 24h}}}}`, nil)
+	mig, err = ldr.Migrate()
+	c.Assert(err, check.IsNil)
+	c.Check(mig.Changes, check.HasLen, 0)
+}
@@ -1835,6 +1835,7 @@ func NewContainerRunner(dispatcherClient *arvados.Client,
 		if err != nil {
 			return nil, nil, nil, err
 		}
+		kc.Priority = keepclient.PriorityBatch
 		c2 := arvados.NewClientFromEnv()
 		c2.AuthToken = token
 		return cl, kc, c2, nil
@@ -1974,6 +1975,7 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		return 1
 	}
 	kc.Retries = 4
+	kc.Priority = keepclient.PriorityBatch
 
 	cr, err := NewContainerRunner(arvados.NewClientFromEnv(), api, kc, containerUUID)
 	if err != nil {
@@ -180,7 +180,7 @@ func (diag *diagnoser) runtests() {
 		diag.verbosef("reported clock skew = %v", resp.ClockSkew)
 		reported := map[string]bool{}
 		for _, result := range resp.Checks {
-			version := strings.SplitN(result.Metrics.Version, " (go", 2)[0]
+			version := strings.SplitN(result.Version, " (go", 2)[0]
 			if version != "" && !reported[version] {
 				diag.verbosef("arvados version = %s", version)
 				reported[version] = true
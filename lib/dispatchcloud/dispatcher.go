@@ -35,8 +35,9 @@ import (
 )
 
 const (
-	defaultPollInterval     = time.Second
-	defaultStaleLockTimeout = time.Minute
+	defaultPollInterval          = time.Second
+	defaultStaleLockTimeout      = time.Minute
+	defaultBillingExportInterval = 5 * time.Minute
 )
 
 type pool interface {
@@ -45,6 +46,7 @@ type pool interface {
 	Instances() []worker.InstanceView
 	SetIdleBehavior(cloud.InstanceID, worker.IdleBehavior) error
 	KillInstance(id cloud.InstanceID, reason string) error
+	SyncNow()
 	Stop()
 }
 
@@ -151,6 +153,11 @@ func (disp *dispatcher) initialize() {
 	} else {
 		disp.sshKey = key
 	}
+	switch format := disp.Cluster.Containers.CloudVMs.BillingExport.Format; format {
+	case "", cloud.BillingFormatCSV, cloud.BillingFormatJSON:
+	default:
+		disp.logger.Fatalf("unsupported Containers.CloudVMs.BillingExport.Format %q", format)
+	}
 	installPublicKey := disp.sshKey.PublicKey()
 	if !disp.Cluster.Containers.CloudVMs.DeployPublicKey {
 		installPublicKey = nil
@@ -194,6 +201,7 @@ func (disp *dispatcher) initialize() {
 		mux.HandlerFunc("POST", "/arvados/v1/dispatch/instances/drain", disp.apiInstanceDrain)
 		mux.HandlerFunc("POST", "/arvados/v1/dispatch/instances/run", disp.apiInstanceRun)
 		mux.HandlerFunc("POST", "/arvados/v1/dispatch/instances/kill", disp.apiInstanceKill)
+		mux.HandlerFunc("POST", "/arvados/v1/dispatch/gc", disp.apiGarbageCollect)
 		metricsH := promhttp.HandlerFor(disp.Registry, promhttp.HandlerOpts{
 			ErrorLog: disp.logger,
 		})
@@ -217,9 +225,58 @@ func (disp *dispatcher) run() {
 	disp.sched.Start()
 	defer disp.sched.Stop()
 
+	if is, ok := driverInstanceSet(disp.instanceSet).(cloud.InstanceSetWithEvents); ok {
+		if events := is.Events(); events != nil {
+			go disp.watchInstanceEvents(events)
+		}
+	}
+
+	if exp := disp.billingExporter(); exp != nil {
+		ctx, cancel := context.WithCancel(disp.Context)
+		defer cancel()
+		go exp.Run(ctx)
+	}
+
 	<-disp.stop
 }
 
+// watchInstanceEvents tells the pool to sync with the cloud provider
+// whenever the driver reports a change to an instance, until the
+// driver closes the events channel.
+func (disp *dispatcher) watchInstanceEvents(events <-chan cloud.InstanceEvent) {
+	for ev := range events {
+		disp.logger.WithFields(logrus.Fields{
+			"Instance": ev.InstanceID,
+			"Event":    ev.Type,
+			"Time":     ev.Time,
+		}).Debug("instance event")
+		disp.pool.SyncNow()
+	}
+}
+
+// billingExporter returns a BillingExporter for the configured
+// BillingExport, or nil if billing export is not configured.
+func (disp *dispatcher) billingExporter() *cloud.BillingExporter {
+	cfg := disp.Cluster.Containers.CloudVMs.BillingExport
+	if cfg.Path == "" {
+		return nil
+	}
+	interval := cfg.Interval.Duration()
+	if interval <= 0 {
+		interval = defaultBillingExportInterval
+	}
+	prefix := disp.Cluster.Containers.CloudVMs.TagKeyPrefix
+	return &cloud.BillingExporter{
+		InstanceSet:     disp.instanceSet,
+		InstanceTypes:   disp.Cluster.InstanceTypes,
+		Filter:          cloud.InstanceTags{prefix + "InstanceSetID": string(disp.InstanceSetID)},
+		InstanceTypeTag: prefix + "InstanceType",
+		Sink:            &cloud.FileBillingSink{Path: cfg.Path, Format: cfg.Format},
+		Interval:        interval,
+		Logger:          disp.logger,
+	}
+}
+
 // Get a snapshot of the scheduler's queue, no older than
 // schedQueueRefresh.
 //
@@ -313,6 +370,21 @@ func (disp *dispatcher) apiContainerKill(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// Management API: look for dangling cloud resources (NICs, disks,
+// etc.) now and start deleting them, if the driver supports it.
+func (disp *dispatcher) apiGarbageCollect(w http.ResponseWriter, r *http.Request) {
+	is, ok := driverInstanceSet(disp.instanceSet).(cloud.InstanceSetWithGarbageCollection)
+	if !ok {
+		httpserver.Error(w, "cloud driver does not support garbage collection", http.StatusNotImplemented)
+		return
+	}
+	err := is.GarbageCollect()
+	if err != nil {
+		httpserver.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+}
+
 func (disp *dispatcher) apiInstanceIdleBehavior(w http.ResponseWriter, r *http.Request, want worker.IdleBehavior) {
 	id := cloud.InstanceID(r.FormValue("instance_id"))
 	if id == "" {
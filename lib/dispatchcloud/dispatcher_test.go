@@ -5,9 +5,11 @@
 package dispatchcloud
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -15,11 +17,13 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"git.arvados.org/arvados.git/lib/cloud"
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -531,3 +535,73 @@ func (s *DispatcherSuite) TestManagementAPI_Instances(c *check.C) {
 	c.Check(sr.Items[0].ProviderInstanceType, check.Equals, test.InstanceType(1).ProviderType)
 	c.Check(sr.Items[0].ArvadosInstanceType, check.Equals, test.InstanceType(1).Name)
 }
+
+func (s *DispatcherSuite) TestManagementAPI_GarbageCollect(c *check.C) {
+	s.cluster.ManagementToken = "abcdefgh"
+	Drivers["test"] = s.stubDriver
+	s.disp.setupOnce.Do(s.disp.initialize)
+	go s.disp.run()
+	defer s.disp.Close()
+
+	gc := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/arvados/v1/dispatch/gc", nil)
+		req.Header.Set("Authorization", "Bearer abcdefgh")
+		resp := httptest.NewRecorder()
+		s.disp.ServeHTTP(resp, req)
+		return resp
+	}
+	resp := gc()
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(s.stubDriver.InstanceSets()[0].GarbageCollectCalls(), check.Equals, 1)
+
+	s.stubDriver.ErrorGarbageCollect = errors.New("test error")
+	resp = gc()
+	c.Check(resp.Code, check.Equals, http.StatusBadGateway)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*test error.*`)
+	c.Check(s.stubDriver.InstanceSets()[0].GarbageCollectCalls(), check.Equals, 2)
+
+	// Drivers that don't support garbage collection.
+	c.Check(driverInstanceSet(s.disp.instanceSet), check.Equals, cloud.InstanceSet(s.stubDriver.InstanceSets()[0]))
+	disp := &dispatcher{instanceSet: filteringInstanceSet{InstanceSet: noGCInstanceSet{s.disp.instanceSet}}}
+	resp = httptest.NewRecorder()
+	disp.apiGarbageCollect(resp, httptest.NewRequest("POST", "/arvados/v1/dispatch/gc", nil))
+	c.Check(resp.Code, check.Equals, http.StatusNotImplemented)
+}
+
+// noGCInstanceSet hides the wrapped InstanceSet's GarbageCollect
+// method.
+type noGCInstanceSet struct {
+	cloud.InstanceSet
+}
+
+func (s *DispatcherSuite) TestBillingExport(c *check.C) {
+	path := filepath.Join(c.MkDir(), "billing.json")
+	s.cluster.Containers.CloudVMs.BillingExport.Path = path
+	s.cluster.Containers.CloudVMs.BillingExport.Format = "json"
+	s.cluster.Containers.CloudVMs.BillingExport.Interval = arvados.Duration(10 * time.Millisecond)
+	s.cluster.Containers.CloudVMs.TimeoutBooting = arvados.Duration(time.Second)
+	Drivers["test"] = s.stubDriver
+	s.disp.setupOnce.Do(s.disp.initialize)
+	go s.disp.run()
+	defer s.disp.Close()
+
+	s.stubDriver.ErrorRateCreate = 0
+	ch := s.disp.pool.Subscribe()
+	defer s.disp.pool.Unsubscribe(ch)
+	ok := s.disp.pool.Create(test.InstanceType(1))
+	c.Check(ok, check.Equals, true)
+	<-ch
+
+	var rec cloud.BillingRecord
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && rec.InstanceID == ""; time.Sleep(time.Millisecond) {
+		buf, _ := os.ReadFile(path)
+		if i := bytes.IndexByte(buf, '\n'); i > 0 {
+			c.Check(json.Unmarshal(buf[:i], &rec), check.IsNil)
+		}
+	}
+	c.Check(rec.InstanceID, check.Matches, "inst.*")
+	c.Check(rec.InstanceType, check.Equals, test.InstanceType(1).Name)
+	c.Check(rec.ProviderType, check.Equals, test.InstanceType(1).ProviderType)
+	c.Check(rec.Price, check.Equals, 0.123)
+	c.Check(rec.Tags["testtag"], check.Equals, "test value")
+}
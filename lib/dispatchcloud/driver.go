@@ -11,7 +11,9 @@ import (
 	"git.arvados.org/arvados.git/lib/cloud"
 	"git.arvados.org/arvados.git/lib/cloud/azure"
 	"git.arvados.org/arvados.git/lib/cloud/ec2"
+	"git.arvados.org/arvados.git/lib/cloud/gce"
 	"git.arvados.org/arvados.git/lib/cloud/loopback"
+	"git.arvados.org/arvados.git/lib/cloud/openstack"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
@@ -22,9 +24,31 @@ import (
 // Clusters.*.Containers.CloudVMs.Driver configuration values
 // correspond to keys in this map.
 var Drivers = map[string]cloud.Driver{
-	"azure":    azure.Driver,
-	"ec2":      ec2.Driver,
-	"loopback": loopback.Driver,
+	"azure":     azure.Driver,
+	"ec2":       ec2.Driver,
+	"gce":       gce.Driver,
+	"loopback":  loopback.Driver,
+	"openstack": openstack.Driver,
+}
+
+// DriverSchemas returns the configuration schemas of the drivers in
+// Drivers that provide one (see cloud.SchemaDriver), keyed by the
+// same driver names.
+func DriverSchemas() map[string]*cloud.ConfigSchema {
+	schemas := map[string]*cloud.ConfigSchema{}
+	for name, driver := range Drivers {
+		if sd, ok := driver.(cloud.SchemaDriver); ok {
+			schemas[name] = sd.ConfigSchema()
+		}
+	}
+	return schemas
+}
+
+// InstanceTypeCatalogs is a map of cloud drivers that can list the
+// instance types offered by the provider, keyed by the same driver
+// names as Drivers.
+var InstanceTypeCatalogs = map[string]cloud.InstanceTypeCatalog{
+	"azure": azure.Catalog,
 }
 
 func newInstanceSet(cluster *arvados.Cluster, setID cloud.InstanceSetID, logger logrus.FieldLogger, reg *prometheus.Registry) (cloud.InstanceSet, error) {
@@ -33,7 +57,19 @@ func newInstanceSet(cluster *arvados.Cluster, setID cloud.InstanceSetID, logger
 		return nil, fmt.Errorf("unsupported cloud driver %q", cluster.Containers.CloudVMs.Driver)
 	}
 	sharedResourceTags := cloud.SharedResourceTags(cluster.Containers.CloudVMs.ResourceTags)
-	is, err := driver.InstanceSet(cluster.Containers.CloudVMs.DriverParameters, setID, sharedResourceTags, logger, reg)
+	var is cloud.InstanceSet
+	var err error
+	if hcd, ok := driver.(cloud.HTTPClientDriver); ok && !cluster.TransportConfig().IsDefault() {
+		// Use the cluster's outbound proxy and CA
+		// settings for cloud API calls, too. TLS.Insecure
+		// is meant for Arvados services, not the cloud
+		// provider's API.
+		tc := cluster.TransportConfig()
+		tc.Insecure = false
+		is, err = hcd.InstanceSetWithHTTPClient(tc.HTTPClient(), cluster.Containers.CloudVMs.DriverParameters, setID, sharedResourceTags, logger, reg)
+	} else {
+		is, err = driver.InstanceSet(cluster.Containers.CloudVMs.DriverParameters, setID, sharedResourceTags, logger, reg)
+	}
 	is = newInstrumentedInstanceSet(is, reg)
 	if maxops := cluster.Containers.CloudVMs.MaxCloudOpsPerSecond; maxops > 0 {
 		is = rateLimitedInstanceSet{
@@ -52,6 +88,27 @@ func newInstanceSet(cluster *arvados.Cluster, setID cloud.InstanceSetID, logger
 	return is, err
 }
 
+// driverInstanceSet returns the driver's own InstanceSet, which is
+// wrapped by the InstanceSet returned by newInstanceSet. Use this to
+// check whether the driver implements an optional interface, like
+// cloud.InstanceSetWithGarbageCollection.
+func driverInstanceSet(is cloud.InstanceSet) cloud.InstanceSet {
+	for {
+		switch w := is.(type) {
+		case filteringInstanceSet:
+			is = w.InstanceSet
+		case defaultTaggingInstanceSet:
+			is = w.InstanceSet
+		case rateLimitedInstanceSet:
+			is = w.InstanceSet
+		case instrumentedInstanceSet:
+			is = w.InstanceSet
+		default:
+			return is
+		}
+	}
+}
+
 type rateLimitedInstanceSet struct {
 	cloud.InstanceSet
 	ticker *time.Ticker
@@ -87,6 +144,12 @@ func (inst *rateLimitedInstance) SetTags(tags cloud.InstanceTags) error {
 	return inst.Instance.SetTags(tags)
 }
 
+// Unwrap returns the driver's instance, so the caller can check
+// which optional interfaces it implements.
+func (inst *rateLimitedInstance) Unwrap() cloud.Instance {
+	return inst.Instance
+}
+
 // Adds the specified defaultTags to every Create() call.
 type defaultTaggingInstanceSet struct {
 	cloud.InstanceSet
@@ -193,6 +256,12 @@ func (inst instrumentedInstance) SetTags(tags cloud.InstanceTags) error {
 	return err
 }
 
+// Unwrap returns the driver's instance, so the caller can check
+// which optional interfaces it implements.
+func (inst instrumentedInstance) Unwrap() cloud.Instance {
+	return inst.Instance
+}
+
 func boolLabelValue(v bool) string {
 	if v {
 		return "1"
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"git.arvados.org/arvados.git/lib/dispatchcloud/container"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/worker"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"github.com/sirupsen/logrus"
 )
@@ -46,8 +47,10 @@ func (sch *Scheduler) runQueue() {
 	unalloc := sch.pool.Unallocated()
 
 	totalInstances := 0
-	for _, n := range sch.pool.CountWorkers() {
-		totalInstances += n
+	for state, n := range sch.pool.CountWorkers() {
+		if state != worker.StateHibernated {
+			totalInstances += n
+		}
 	}
 
 	unsorted, _ := sch.queue.Entries()
@@ -60,6 +60,9 @@ type StubDriver struct {
 
 	QuotaMaxInstances int
 
+	// Error to return from GarbageCollect.
+	ErrorGarbageCollect error
+
 	// If true, Create and Destroy calls block until Release() is
 	// called.
 	HoldCloudOps bool
@@ -113,6 +116,7 @@ type StubInstanceSet struct {
 	allowCreateCall    time.Time
 	allowInstancesCall time.Time
 	lastInstanceID     int
+	gcCalls            int
 }
 
 func (sis *StubInstanceSet) Create(it arvados.InstanceType, image cloud.ImageID, tags cloud.InstanceTags, initCommand cloud.InitCommand, authKey ssh.PublicKey) (cloud.Instance, error) {
@@ -185,6 +189,23 @@ func (sis *StubInstanceSet) InstanceQuotaGroup(it arvados.InstanceType) cloud.In
 	return cloud.InstanceQuotaGroup(it.ProviderType[:1])
 }
 
+// GarbageCollect implements cloud.InstanceSetWithGarbageCollection.
+// It just counts calls (see GarbageCollectCalls).
+func (sis *StubInstanceSet) GarbageCollect() error {
+	sis.mtx.Lock()
+	defer sis.mtx.Unlock()
+	sis.gcCalls++
+	return sis.driver.ErrorGarbageCollect
+}
+
+// GarbageCollectCalls returns the number of GarbageCollect calls so
+// far.
+func (sis *StubInstanceSet) GarbageCollectCalls() int {
+	sis.mtx.Lock()
+	defer sis.mtx.Unlock()
+	return sis.gcCalls
+}
+
 func (sis *StubInstanceSet) Stop() {
 	sis.mtx.Lock()
 	defer sis.mtx.Unlock()
@@ -256,6 +277,7 @@ type StubVM struct {
 	deadlocked   string
 	stubprocs    sync.WaitGroup
 	destroying   bool
+	stopped      bool
 	sync.Mutex
 }
 
@@ -283,11 +305,19 @@ func (svm *StubVM) Instance() stubInstance {
 	}
 }
 
+// Stopped returns true if the VM has been stopped by
+// (cloud.InstanceWithHibernation)Stop() and not started again.
+func (svm *StubVM) Stopped() bool {
+	svm.Lock()
+	defer svm.Unlock()
+	return svm.stopped
+}
+
 func (svm *StubVM) Exec(env map[string]string, command string, stdin io.Reader, stdout, stderr io.Writer) uint32 {
 	// Ensure we don't start any new stubprocs after Destroy()
 	// has started Wait()ing for stubprocs to end.
 	svm.Lock()
-	if svm.destroying {
+	if svm.destroying || svm.stopped {
 		svm.Unlock()
 		return 1
 	}
@@ -505,6 +535,30 @@ func (si stubInstance) Destroy() error {
 	return nil
 }
 
+// Stop implements cloud.InstanceWithHibernation.
+func (si stubInstance) Stop() error {
+	if si.svm.sis.driver.HoldCloudOps {
+		si.svm.sis.driver.holdCloudOps <- true
+	}
+	si.svm.Lock()
+	defer si.svm.Unlock()
+	si.svm.stopped = true
+	return nil
+}
+
+// Start implements cloud.InstanceWithHibernation.
+func (si stubInstance) Start() error {
+	if si.svm.sis.driver.HoldCloudOps {
+		si.svm.sis.driver.holdCloudOps <- true
+	}
+	si.svm.Lock()
+	defer si.svm.Unlock()
+	si.svm.stopped = false
+	return nil
+}
+
+var _ = cloud.InstanceWithHibernation(stubInstance{}) // assert the interface is satisfied
+
 func (si stubInstance) ProviderType() string {
 	return si.svm.providerType
 }
@@ -31,19 +31,22 @@ const (
 	tagKeyIdleBehavior   = "IdleBehavior"
 	tagKeyInstanceSecret = "InstanceSecret"
 	tagKeyInstanceSetID  = "InstanceSetID"
+	tagKeyHibernated     = "Hibernated"
 )
 
 // An InstanceView shows a worker's current state and recent activity.
 type InstanceView struct {
-	Instance             cloud.InstanceID `json:"instance"`
-	Address              string           `json:"address"`
-	Price                float64          `json:"price"`
-	ArvadosInstanceType  string           `json:"arvados_instance_type"`
-	ProviderInstanceType string           `json:"provider_instance_type"`
-	LastContainerUUID    string           `json:"last_container_uuid"`
-	LastBusy             time.Time        `json:"last_busy"`
-	WorkerState          string           `json:"worker_state"`
-	IdleBehavior         IdleBehavior     `json:"idle_behavior"`
+	Instance             cloud.InstanceID        `json:"instance"`
+	Address              string                  `json:"address"`
+	Price                float64                 `json:"price"`
+	ArvadosInstanceType  string                  `json:"arvados_instance_type"`
+	ProviderInstanceType string                  `json:"provider_instance_type"`
+	LastContainerUUID    string                  `json:"last_container_uuid"`
+	LastBusy             time.Time               `json:"last_busy"`
+	WorkerState          string                  `json:"worker_state"`
+	IdleBehavior         IdleBehavior            `json:"idle_behavior"`
+	ProvisioningState    cloud.ProvisioningState `json:"provisioning_state,omitempty"`
+	PowerState           cloud.PowerState        `json:"power_state,omitempty"`
 }
 
 // An Executor executes shell commands on a remote host.
@@ -116,6 +119,7 @@ func NewPool(logger logrus.FieldLogger, arvClient *arvados.Client, reg *promethe
 		maxProbesPerSecond:             cluster.Containers.CloudVMs.MaxProbesPerSecond,
 		maxConcurrentInstanceCreateOps: cluster.Containers.CloudVMs.MaxConcurrentInstanceCreateOps,
 		maxInstances:                   cluster.Containers.CloudVMs.MaxInstances,
+		maxHibernatedInstances:         cluster.Containers.CloudVMs.MaxHibernatedInstances,
 		probeInterval:                  duration(cluster.Containers.CloudVMs.ProbeInterval, defaultProbeInterval),
 		syncInterval:                   duration(cluster.Containers.CloudVMs.SyncInterval, defaultSyncInterval),
 		timeoutIdle:                    duration(cluster.Containers.CloudVMs.TimeoutIdle, defaultTimeoutIdle),
@@ -131,6 +135,7 @@ func NewPool(logger logrus.FieldLogger, arvClient *arvados.Client, reg *promethe
 		runnerCmdDefault:               cluster.Containers.CrunchRunCommand,
 		runnerArgs:                     append([]string{"--runtime-engine=" + cluster.Containers.RuntimeEngine}, cluster.Containers.CrunchRunArgumentsList...),
 		stop:                           make(chan bool),
+		syncNow:                        make(chan struct{}, 1),
 	}
 	wp.registerMetrics(reg)
 	go func() {
@@ -162,6 +167,7 @@ type Pool struct {
 	maxProbesPerSecond             int
 	maxConcurrentInstanceCreateOps int
 	maxInstances                   int
+	maxHibernatedInstances         int
 	timeoutIdle                    time.Duration
 	timeoutBooting                 time.Duration
 	timeoutProbe                   time.Duration
@@ -186,6 +192,7 @@ type Pool struct {
 	atQuotaErr                 cloud.QuotaError
 	atCapacityUntil            map[interface{}]time.Time
 	stop                       chan bool
+	syncNow                    chan struct{}
 	mtx                        sync.RWMutex
 	setupOnce                  sync.Once
 	runnerData                 []byte
@@ -259,7 +266,7 @@ func (wp *Pool) Unsubscribe(ch <-chan struct{}) {
 
 // Unallocated returns the number of unallocated (creating + booting +
 // idle + unknown) workers for each instance type.  Workers in
-// hold/drain mode are not included.
+// hold/drain mode and hibernated workers are not included.
 func (wp *Pool) Unallocated() map[arvados.InstanceType]int {
 	wp.setupOnce.Do(wp.setup)
 	wp.mtx.RLock()
@@ -281,6 +288,7 @@ func (wp *Pool) Unallocated() map[arvados.InstanceType]int {
 		// StateUnknown.
 		if wkr.state == StateShutdown ||
 			wkr.state == StateRunning ||
+			wkr.state == StateHibernated ||
 			wkr.idleBehavior != IdleBehaviorRun ||
 			len(wkr.running) > 0 {
 			continue
@@ -311,7 +319,8 @@ func (wp *Pool) Unallocated() map[arvados.InstanceType]int {
 
 // Create a new instance with the given type, and add it to the worker
 // pool. The worker is added immediately; instance creation runs in
-// the background.
+// the background. If there is a hibernated instance with the given
+// type, it is started instead of creating a new one.
 //
 // Create returns false if a pre-existing error or a configuration
 // setting prevents it from even attempting to create a new
@@ -329,6 +338,12 @@ func (wp *Pool) Create(it arvados.InstanceType) bool {
 	}
 	wp.mtx.Lock()
 	defer wp.mtx.Unlock()
+	for _, wkr := range wp.workers {
+		if wkr.state == StateHibernated && !wkr.stopping && wkr.instType == it && wkr.idleBehavior == IdleBehaviorRun {
+			wkr.wake()
+			return true
+		}
+	}
 	// The maxConcurrentInstanceCreateOps knob throttles the number of node create
 	// requests in flight. It was added to work around a limitation in Azure's
 	// managed disks, which support no more than 20 concurrent node creation
@@ -434,7 +449,33 @@ func (wp *Pool) AtQuota() bool {
 	defer wp.mtx.Unlock()
 	return wp.atQuotaUntilFewerInstances > 0 ||
 		time.Now().Before(wp.atQuotaUntil) ||
-		(wp.maxInstances > 0 && wp.maxInstances <= len(wp.workers)+len(wp.creating))
+		(wp.maxInstances > 0 && wp.maxInstances <= len(wp.workers)-wp.countHibernated()+len(wp.creating))
+}
+
+// canHibernate returns true if the given idle worker should be
+// stopped, rather than destroyed, so it can be started again when an
+// instance of the same type is needed.
+//
+// Caller must have lock.
+func (wp *Pool) canHibernate(wkr *worker) bool {
+	if wp.maxHibernatedInstances < 1 {
+		return false
+	}
+	if _, ok := wkr.cloudInstance().(cloud.InstanceWithHibernation); !ok {
+		return false
+	}
+	return wp.countHibernated() < wp.maxHibernatedInstances
+}
+
+// Caller must have lock.
+func (wp *Pool) countHibernated() int {
+	n := 0
+	for _, wkr := range wp.workers {
+		if wkr.state == StateHibernated {
+			n++
+		}
+	}
+	return n
 }
 
 // SetIdleBehavior determines how the indicated instance will behave
@@ -495,6 +536,9 @@ func (wp *Pool) updateWorker(inst cloud.Instance, it arvados.InstanceType) (*wor
 	state := StateUnknown
 	if _, ok := wp.creating[secret]; ok {
 		state = StateBooting
+	} else if inst.Tags()[wp.tagKeyPrefix+tagKeyHibernated] == "true" {
+		// Hibernated by a prior dispatch process.
+		state = StateHibernated
 	}
 
 	// If an instance has a valid IdleBehavior tag when it first
@@ -816,6 +860,8 @@ func (wp *Pool) updateMetrics() {
 		switch {
 		case len(wkr.running)+len(wkr.starting) > 0:
 			cat = "inuse"
+		case wkr.state == StateHibernated:
+			cat = "hibernated"
 		case wkr.idleBehavior == IdleBehaviorHold:
 			cat = "hold"
 		case wkr.state == StateBooting:
@@ -830,9 +876,11 @@ func (wp *Pool) updateMetrics() {
 		cpu[cat] += int64(wkr.instType.VCPUs)
 		mem[cat] += int64(wkr.instType.RAM)
 		running += int64(len(wkr.running) + len(wkr.starting))
-		probed = append(probed, wkr.probed)
+		if wkr.state != StateHibernated {
+			probed = append(probed, wkr.probed)
+		}
 	}
-	for _, cat := range []string{"inuse", "hold", "booting", "unknown", "idle"} {
+	for _, cat := range []string{"inuse", "hibernated", "hold", "booting", "unknown", "idle"} {
 		wp.mInstancesPrice.WithLabelValues(cat).Set(price[cat])
 		wp.mVCPUs.WithLabelValues(cat).Set(float64(cpu[cat]))
 		wp.mMemory.WithLabelValues(cat).Set(float64(mem[cat]))
@@ -881,7 +929,7 @@ func (wp *Pool) runProbes() {
 		workers = workers[:0]
 		wp.mtx.Lock()
 		for id, wkr := range wp.workers {
-			if wkr.state == StateShutdown || wkr.shutdownIfIdle() {
+			if wkr.state == StateShutdown || wkr.shutdownIfIdle() || wkr.state == StateHibernated {
 				continue
 			}
 			workers = append(workers, id)
@@ -908,21 +956,35 @@ func (wp *Pool) runProbes() {
 }
 
 func (wp *Pool) runSync() {
-	// sync once immediately, then wait syncInterval, sync again,
-	// etc.
+	// sync once immediately, then wait syncInterval (or until
+	// SyncNow is called), sync again, etc.
 	timer := time.NewTimer(1)
 	for {
 		select {
 		case <-timer.C:
-			err := wp.getInstancesAndSync()
-			if err != nil {
-				wp.logger.WithError(err).Warn("sync failed")
-			}
-			timer.Reset(wp.syncInterval)
+		case <-wp.syncNow:
+			timer.Stop()
 		case <-wp.stop:
 			wp.logger.Debug("worker.Pool stopped")
 			return
 		}
+		err := wp.getInstancesAndSync()
+		if err != nil {
+			wp.logger.WithError(err).Warn("sync failed")
+		}
+		timer.Reset(wp.syncInterval)
+	}
+}
+
+// SyncNow asks the pool to get the list of instances from the
+// InstanceSet as soon as possible, instead of waiting for the next
+// SyncInterval -- e.g., because the driver reported that an instance
+// was created, destroyed, or stopped.
+func (wp *Pool) SyncNow() {
+	select {
+	case wp.syncNow <- struct{}{}:
+	default:
+		// A sync is already pending.
 	}
 }
 
@@ -939,7 +1001,7 @@ func (wp *Pool) Instances() []InstanceView {
 	wp.setupOnce.Do(wp.setup)
 	wp.mtx.Lock()
 	for _, w := range wp.workers {
-		r = append(r, InstanceView{
+		iv := InstanceView{
 			Instance:             w.instance.ID(),
 			Address:              w.instance.Address(),
 			Price:                w.instType.Price,
@@ -949,7 +1011,12 @@ func (wp *Pool) Instances() []InstanceView {
 			LastBusy:             w.busy,
 			WorkerState:          w.state.String(),
 			IdleBehavior:         w.idleBehavior,
-		})
+		}
+		if inst, ok := w.cloudInstance().(cloud.InstanceWithState); ok {
+			state := inst.State()
+			iv.ProvisioningState, iv.PowerState = state.Provisioning, state.Power
+		}
+		r = append(r, iv)
 	}
 	wp.mtx.Unlock()
 	sort.Slice(r, func(i, j int) bool {
@@ -156,6 +156,48 @@ func (suite *PoolSuite) TestResumeAfterRestart(c *check.C) {
 	pool2.Stop()
 }
 
+func (suite *PoolSuite) TestSyncNow(c *check.C) {
+	type1 := test.InstanceType(1)
+	driver := &test.StubDriver{}
+	instanceSetID := cloud.InstanceSetID("test-instance-set-id")
+	is, err := driver.InstanceSet(nil, instanceSetID, nil, suite.logger, nil)
+	c.Assert(err, check.IsNil)
+	defer is.Stop()
+
+	suite.testCluster.Containers.CloudVMs = arvados.CloudVMsConfig{
+		BootProbeCommand:   "true",
+		MaxProbesPerSecond: 1000,
+		ProbeInterval:      arvados.Duration(time.Millisecond * 10),
+		SyncInterval:       arvados.Duration(time.Hour),
+		TagKeyPrefix:       "testprefix:",
+	}
+	suite.testCluster.InstanceTypes = arvados.InstanceTypeMap{type1.Name: type1}
+
+	pool := NewPool(suite.logger, arvados.NewClientFromEnv(), prometheus.NewRegistry(), instanceSetID, is, func(cloud.Instance) Executor { return &stubExecutor{} }, nil, suite.testCluster)
+	defer pool.Stop()
+	notify := pool.Subscribe()
+	defer pool.Unsubscribe(notify)
+	suite.wait(c, pool, notify, func() bool {
+		pool.mtx.RLock()
+		defer pool.mtx.RUnlock()
+		return pool.loaded
+	})
+
+	// An instance created behind the pool's back (as far as
+	// the pool knows, by another dispatcher) only shows up
+	// before the next SyncInterval if we call SyncNow.
+	_, err = is.Create(type1, "", cloud.InstanceTags{
+		"testprefix:" + tagKeyInstanceSetID: string(instanceSetID),
+		"testprefix:" + tagKeyInstanceType:  type1.Name,
+	}, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(pool.Instances(), check.HasLen, 0)
+	pool.SyncNow()
+	suite.wait(c, pool, notify, func() bool {
+		return len(pool.Instances()) == 1
+	})
+}
+
 func (suite *PoolSuite) TestDrain(c *check.C) {
 	driver := test.StubDriver{}
 	instanceSet, err := driver.InstanceSet(nil, "test-instance-set-id", nil, suite.logger, nil)
@@ -210,6 +252,102 @@ func (suite *PoolSuite) TestDrain(c *check.C) {
 	}
 }
 
+func (suite *PoolSuite) TestHibernate(c *check.C) {
+	driver := test.StubDriver{}
+	instanceSet, err := driver.InstanceSet(nil, "test-instance-set-id", nil, suite.logger, nil)
+	c.Assert(err, check.IsNil)
+	defer instanceSet.Stop()
+
+	type1 := test.InstanceType(1)
+	newPool := func() *Pool {
+		return &Pool{
+			logger:      suite.logger,
+			newExecutor: func(cloud.Instance) Executor { return &stubExecutor{} },
+			cluster:     suite.testCluster,
+			instanceSet: &throttledInstanceSet{InstanceSet: instanceSet},
+			instanceTypes: arvados.InstanceTypeMap{
+				type1.Name: type1,
+			},
+			maxInstances:           1,
+			maxHibernatedInstances: 1,
+		}
+	}
+	pool := newPool()
+	notify := pool.Subscribe()
+	defer pool.Unsubscribe(notify)
+
+	pool.Create(type1)
+	suite.wait(c, pool, notify, func() bool {
+		pool.mtx.RLock()
+		defer pool.mtx.RUnlock()
+		return len(pool.workers) == 1
+	})
+	pool.maxInstances = 2
+	pool.Create(type1)
+	suite.wait(c, pool, notify, func() bool {
+		pool.mtx.RLock()
+		defer pool.mtx.RUnlock()
+		return len(pool.workers) == 2
+	})
+	pool.maxInstances = 1
+
+	// Both workers are idle. Only one can be hibernated, so the
+	// other one is shut down.
+	pool.mtx.Lock()
+	for _, wkr := range pool.workers {
+		wkr.state = StateIdle
+		wkr.busy = time.Now().Add(-time.Hour)
+		c.Check(wkr.shutdownIfIdle(), check.Equals, true)
+	}
+	pool.mtx.Unlock()
+	var hibernated cloud.InstanceID
+	suite.wait(c, pool, notify, func() bool {
+		pool.getInstancesAndSync()
+		pool.mtx.RLock()
+		defer pool.mtx.RUnlock()
+		for id, wkr := range pool.workers {
+			if wkr.state == StateHibernated && !wkr.stopping {
+				hibernated = id
+			}
+		}
+		return len(pool.workers) == 1 && hibernated != ""
+	})
+	// Tags are updated asynchronously, so the instance list
+	// might be stale for a while.
+	waitFor := func(ready func() bool) {
+		deadline := time.Now().Add(time.Second)
+		for !ready() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	vms := instanceSet.(*test.StubInstanceSet).StubVMs()
+	c.Assert(vms, check.HasLen, 1)
+	c.Check(vms[0].Instance().ID(), check.Equals, hibernated)
+	c.Check(vms[0].Stopped(), check.Equals, true)
+	c.Check(pool.Unallocated()[type1], check.Equals, 0)
+	c.Check(pool.AtQuota(), check.Equals, false)
+
+	// A new pool (e.g., after restarting the dispatcher) knows
+	// the instance is hibernated.
+	tagKey := pool.tagKeyPrefix + tagKeyHibernated
+	waitFor(func() bool { return vms[0].Instance().Tags()[tagKey] == "true" })
+	c.Check(vms[0].Instance().Tags()[tagKey], check.Equals, "true")
+	pool2 := newPool()
+	c.Check(pool2.getInstancesAndSync(), check.IsNil)
+	c.Assert(pool2.Instances(), check.HasLen, 1)
+	c.Check(pool2.Instances()[0].WorkerState, check.Equals, StateHibernated.String())
+
+	// Create starts the hibernated instance instead of creating
+	// a new one.
+	c.Check(pool.Create(type1), check.Equals, true)
+	c.Check(pool.Unallocated()[type1], check.Equals, 1)
+	c.Check(pool.Instances()[0].WorkerState, check.Equals, StateBooting.String())
+	waitFor(func() bool { return !vms[0].Stopped() && vms[0].Instance().Tags()[tagKey] == "" })
+	c.Check(vms[0].Stopped(), check.Equals, false)
+	c.Check(vms[0].Instance().Tags()[tagKey], check.Equals, "")
+	c.Check(instanceSet.(*test.StubInstanceSet).StubVMs(), check.HasLen, 1)
+}
+
 func (suite *PoolSuite) TestNodeCreateThrottle(c *check.C) {
 	driver := test.StubDriver{HoldCloudOps: true}
 	instanceSet, err := driver.InstanceSet(nil, "test-instance-set-id", nil, suite.logger, nil)
@@ -27,6 +27,10 @@ import (
 const (
 	// TODO: configurable
 	maxPingFailTime = 10 * time.Minute
+
+	// Maximum size of the console output logged when an
+	// instance fails to boot. Earlier output is discarded.
+	maxConsoleLogBytes = 16384
 )
 
 // State indicates whether a worker is available to do work, and (if
@@ -34,19 +38,21 @@ const (
 type State int
 
 const (
-	StateUnknown  State = iota // might be running a container already
-	StateBooting               // instance is booting
-	StateIdle                  // instance booted, no containers are running
-	StateRunning               // instance is running one or more containers
-	StateShutdown              // worker has stopped monitoring the instance
+	StateUnknown    State = iota // might be running a container already
+	StateBooting                 // instance is booting
+	StateIdle                    // instance booted, no containers are running
+	StateRunning                 // instance is running one or more containers
+	StateShutdown                // worker has stopped monitoring the instance
+	StateHibernated              // instance is stopped, and can be started again
 )
 
 var stateString = map[State]string{
-	StateUnknown:  "unknown",
-	StateBooting:  "booting",
-	StateIdle:     "idle",
-	StateRunning:  "running",
-	StateShutdown: "shutdown",
+	StateUnknown:    "unknown",
+	StateBooting:    "booting",
+	StateIdle:       "idle",
+	StateRunning:    "running",
+	StateShutdown:   "shutdown",
+	StateHibernated: "hibernated",
 }
 
 // String implements fmt.Stringer.
@@ -117,6 +123,7 @@ type worker struct {
 	bootOutcomeReported bool
 	timeToReadyReported bool
 	staleRunLockSince   time.Time
+	stopping            bool // hibernating, waiting for Stop() to return
 }
 
 func (wkr *worker) onUnkillable(uuid string) {
@@ -228,6 +235,7 @@ func (wkr *worker) ProbeAndUpdate() {
 // In StateRunning: Call probeRunning.
 // In StateIdle: Call probeRunning.
 // In StateShutdown: Do nothing.
+// In StateHibernated: Do nothing.
 //
 // If both probes succeed, wkr.state changes to
 // StateIdle/StateRunning.
@@ -252,7 +260,7 @@ func (wkr *worker) probeAndUpdate() {
 	)
 
 	switch initialState {
-	case StateShutdown:
+	case StateShutdown, StateHibernated:
 		return
 	case StateIdle, StateRunning:
 		booted = true
@@ -561,6 +569,19 @@ func (wkr *worker) shutdownIfBroken(dur time.Duration) bool {
 		epilogue = " -- `arvados-server cloudtest` might help troubleshoot, see https://doc.arvados.org/main/admin/cloudtest.html"
 		threshold = wkr.wp.timeoutBooting
 	}
+	if reason := wkr.brokenCloudState(); reason != "" {
+		wkr.logger.WithFields(logrus.Fields{
+			"Duration": dur,
+			"Since":    wkr.probed,
+			"State":    wkr.state,
+		}).Warnf("%sinstance unresponsive and %s, shutting down", prologue, reason)
+		if prologue != "" {
+			wkr.shutdownWithConsoleLog()
+		} else {
+			wkr.shutdown()
+		}
+		return true
+	}
 	if dur < threshold {
 		return false
 	}
@@ -569,7 +590,11 @@ func (wkr *worker) shutdownIfBroken(dur time.Duration) bool {
 		"Since":    wkr.probed,
 		"State":    wkr.state,
 	}).Warnf("%sinstance unresponsive, shutting down%s", prologue, epilogue)
-	wkr.shutdown()
+	if prologue != "" {
+		wkr.shutdownWithConsoleLog()
+	} else {
+		wkr.shutdown()
+	}
 	return true
 }
 
@@ -583,7 +608,7 @@ func (wkr *worker) eligibleForShutdown() bool {
 	}
 	draining := wkr.idleBehavior == IdleBehaviorDrain
 	switch wkr.state {
-	case StateBooting:
+	case StateBooting, StateHibernated:
 		return draining
 	case StateIdle:
 		return draining || time.Since(wkr.busy) >= wkr.wp.timeoutIdle
@@ -614,6 +639,13 @@ func (wkr *worker) shutdownIfIdle() bool {
 	if !wkr.eligibleForShutdown() {
 		return false
 	}
+	if wkr.state == StateIdle && wkr.idleBehavior == IdleBehaviorRun && wkr.wp.canHibernate(wkr) {
+		wkr.logger.WithFields(logrus.Fields{
+			"IdleDuration": stats.Duration(time.Since(wkr.busy)),
+		}).Info("hibernate worker")
+		wkr.hibernate()
+		return true
+	}
 	wkr.logger.WithFields(logrus.Fields{
 		"State":        wkr.state,
 		"IdleDuration": stats.Duration(time.Since(wkr.busy)),
@@ -626,12 +658,90 @@ func (wkr *worker) shutdownIfIdle() bool {
 
 // caller must have lock.
 func (wkr *worker) shutdown() {
+	wkr.startShutdown(false)
+}
+
+// hibernate stops the instance, so it can be started again by wake()
+// instead of creating a new instance. If the cloud driver fails to
+// stop it, the instance is destroyed instead.
+//
+// caller must have lock.
+func (wkr *worker) hibernate() {
+	inst := wkr.cloudInstance().(cloud.InstanceWithHibernation)
+	wkr.updated = time.Now()
+	wkr.state = StateHibernated
+	wkr.stopping = true
+	wkr.saveTags()
+	go wkr.wp.notify()
+	go func() {
+		err := inst.Stop()
+		wkr.mtx.Lock()
+		defer wkr.mtx.Unlock()
+		wkr.stopping = false
+		go wkr.wp.notify()
+		if err != nil && wkr.state == StateHibernated {
+			wkr.logger.WithError(err).Warn("hibernate failed, shutting down instead")
+			wkr.shutdown()
+		}
+	}()
+}
+
+// wake starts a hibernated instance. The worker is booting until the
+// next successful boot probe, and is shut down if that doesn't
+// happen within TimeoutBooting.
+//
+// caller must have lock.
+func (wkr *worker) wake() {
+	inst := wkr.cloudInstance().(cloud.InstanceWithHibernation)
+	wkr.logger.Info("starting hibernated instance")
+	now := time.Now()
+	wkr.updated = now
+	wkr.probed = now
+	wkr.busy = now
+	wkr.firstSSHConnection = time.Time{}
+	wkr.bootOutcomeReported = false
+	wkr.timeToReadyReported = false
+	wkr.state = StateBooting
+	wkr.saveTags()
+	go wkr.wp.notify()
+	go func() {
+		err := inst.Start()
+		wkr.mtx.Lock()
+		defer wkr.mtx.Unlock()
+		if err != nil {
+			if wkr.state == StateBooting {
+				wkr.logger.WithError(err).Warn("error starting hibernated instance, shutting down")
+				wkr.reportBootOutcome(BootOutcomeFailed)
+				wkr.shutdown()
+			}
+			return
+		}
+		// The instance's address might have changed.
+		wkr.executor.SetTarget(wkr.instance)
+	}()
+}
+
+// shutdownWithConsoleLog is like shutdown, but if the cloud driver
+// supports it, the instance's console output is logged before the
+// instance is destroyed. This is useful when the instance never
+// booted, because there is no other way to find out why.
+//
+// caller must have lock.
+func (wkr *worker) shutdownWithConsoleLog() {
+	wkr.startShutdown(true)
+}
+
+// caller must have lock.
+func (wkr *worker) startShutdown(logConsole bool) {
 	now := time.Now()
 	wkr.updated = now
 	wkr.destroyed = now
 	wkr.state = StateShutdown
 	go wkr.wp.notify()
 	go func() {
+		if logConsole {
+			wkr.logConsoleOutput()
+		}
 		err := wkr.instance.Destroy()
 		if err != nil {
 			wkr.logger.WithError(err).Warn("shutdown failed")
@@ -640,6 +750,73 @@ func (wkr *worker) shutdown() {
 	}()
 }
 
+// logConsoleOutput logs the last part of the instance's console
+// output, if the cloud driver supports retrieving it.
+//
+// caller must not have lock.
+func (wkr *worker) logConsoleOutput() {
+	inst, ok := wkr.cloudInstance().(cloud.InstanceWithConsole)
+	if !ok {
+		return
+	}
+	out, err := inst.ConsoleLog()
+	if err == cloud.ErrNotImplemented {
+		return
+	} else if err != nil {
+		wkr.logger.WithError(err).Warn("error retrieving console log")
+		return
+	}
+	if len(out) > maxConsoleLogBytes {
+		out = out[len(out)-maxConsoleLogBytes:]
+	}
+	wkr.logger.WithField("ConsoleLog", out).Info("console log from instance that failed to boot")
+}
+
+// cloudInstance returns the instance provided by the cloud driver,
+// without the TagVerifier wrapper added by the pool or the wrappers
+// added by the dispatcher (which have an Unwrap method), so callers
+// can check which optional interfaces the driver implements.
+func (wkr *worker) cloudInstance() cloud.Instance {
+	inst := wkr.instance
+	for {
+		switch w := inst.(type) {
+		case TagVerifier:
+			inst = w.Instance
+		case interface{ Unwrap() cloud.Instance }:
+			inst = w.Unwrap()
+		default:
+			return inst
+		}
+	}
+}
+
+// brokenCloudState returns a reason to give up on the instance
+// without waiting for a probe timeout, based on the state reported
+// by the cloud driver (see cloud.InstanceWithState), or "" if there
+// is no such reason.
+//
+// caller must have lock.
+func (wkr *worker) brokenCloudState() string {
+	inst, ok := wkr.cloudInstance().(cloud.InstanceWithState)
+	if !ok {
+		return ""
+	}
+	state := inst.State()
+	switch wkr.state {
+	case StateUnknown, StateBooting:
+		if state.Provisioning == cloud.ProvisioningFailed {
+			return "cloud provider reports provisioning failed"
+		}
+	case StateIdle, StateRunning:
+		// (A booting instance that was just woken up from
+		// hibernation might still be reported as stopped.)
+		if state.Power == cloud.PowerStopping || state.Power == cloud.PowerStopped {
+			return "cloud provider reports instance is " + string(state.Power)
+		}
+	}
+	return ""
+}
+
 // Save worker tags to cloud provider metadata, if they don't already
 // match. Caller must have lock.
 func (wkr *worker) saveTags() {
@@ -648,10 +825,19 @@ func (wkr *worker) saveTags() {
 	update := cloud.InstanceTags{
 		wkr.wp.tagKeyPrefix + tagKeyInstanceType: wkr.instType.Name,
 		wkr.wp.tagKeyPrefix + tagKeyIdleBehavior: string(wkr.idleBehavior),
+		wkr.wp.tagKeyPrefix + tagKeyHibernated:   "",
+	}
+	if wkr.state == StateHibernated {
+		update[wkr.wp.tagKeyPrefix+tagKeyHibernated] = "true"
 	}
 	save := false
 	for k, v := range update {
-		if tags[k] != v {
+		if v == "" {
+			if _, ok := tags[k]; ok {
+				delete(tags, k)
+				save = true
+			}
+		} else if tags[k] != v {
 			tags[k] = v
 			save = true
 		}
@@ -324,6 +324,118 @@ func (suite *WorkerSuite) TestProbeAndUpdate(c *check.C) {
 	}
 }
 
+type consoleInstance struct {
+	cloud.Instance
+	consoleLog string
+	destroyed  chan struct{}
+}
+
+func (ci *consoleInstance) ConsoleLog() (string, error) {
+	return ci.consoleLog, nil
+}
+
+func (ci *consoleInstance) Destroy() error {
+	defer close(ci.destroyed)
+	return ci.Instance.Destroy()
+}
+
+func (suite *WorkerSuite) TestLogConsoleOnBootFailure(c *check.C) {
+	is, err := (&test.StubDriver{}).InstanceSet(nil, "test-instance-set-id", nil, suite.logger, nil)
+	c.Assert(err, check.IsNil)
+	inst, err := is.Create(arvados.InstanceType{}, "", nil, "echo InitCommand", nil)
+	c.Assert(err, check.IsNil)
+
+	for _, state := range []State{StateBooting, StateIdle} {
+		var logbuf bytes.Buffer
+		logger := logrus.New()
+		logger.Out = &logbuf
+		ci := &consoleInstance{
+			Instance:   inst,
+			consoleLog: strings.Repeat("x", maxConsoleLogBytes) + "kernel panic\n",
+			destroyed:  make(chan struct{}),
+		}
+		wp := &Pool{
+			timeoutBooting: time.Minute,
+			timeoutProbe:   time.Second,
+		}
+		wkr := &worker{
+			logger:   logger,
+			wp:       wp,
+			mtx:      &wp.mtx,
+			state:    state,
+			instance: TagVerifier{Instance: ci},
+		}
+		wp.mtx.Lock()
+		c.Check(wkr.shutdownIfBroken(time.Hour), check.Equals, true)
+		wp.mtx.Unlock()
+		<-ci.destroyed
+		if state == StateBooting {
+			c.Check(logbuf.String(), check.Matches, `(?ms).*console log from instance that failed to boot.*kernel panic.*`)
+			c.Check(strings.Contains(logbuf.String(), strings.Repeat("x", maxConsoleLogBytes)), check.Equals, false)
+		} else {
+			c.Check(logbuf.String(), check.Not(check.Matches), `(?ms).*console log.*`)
+		}
+	}
+}
+
+type stateInstance struct {
+	cloud.Instance
+	state cloud.InstanceState
+}
+
+func (si *stateInstance) State() cloud.InstanceState {
+	return si.state
+}
+
+// unwrapInstance is like the wrappers added by the dispatcher, which
+// hide the driver's optional interfaces unless unwrapped.
+type unwrapInstance struct {
+	cloud.Instance
+}
+
+func (ui unwrapInstance) Unwrap() cloud.Instance {
+	return ui.Instance
+}
+
+func (suite *WorkerSuite) TestShutdownOnCloudState(c *check.C) {
+	is, err := (&test.StubDriver{}).InstanceSet(nil, "test-instance-set-id", nil, suite.logger, nil)
+	c.Assert(err, check.IsNil)
+
+	for _, trial := range []struct {
+		state      State
+		cloudState cloud.InstanceState
+		shutdown   bool
+	}{
+		{StateBooting, cloud.InstanceState{Provisioning: cloud.ProvisioningFailed}, true},
+		{StateBooting, cloud.InstanceState{Provisioning: cloud.ProvisioningCreating}, false},
+		// Might have just been woken from hibernation.
+		{StateBooting, cloud.InstanceState{Provisioning: cloud.ProvisioningSucceeded, Power: cloud.PowerStopped}, false},
+		{StateIdle, cloud.InstanceState{Provisioning: cloud.ProvisioningSucceeded, Power: cloud.PowerStopped}, true},
+		{StateRunning, cloud.InstanceState{Provisioning: cloud.ProvisioningUpdating, Power: cloud.PowerStopping}, true},
+		{StateIdle, cloud.InstanceState{Provisioning: cloud.ProvisioningFailed, Power: cloud.PowerRunning}, false},
+		{StateIdle, cloud.InstanceState{}, false},
+	} {
+		comment := check.Commentf("%+v", trial)
+		inst, err := is.Create(arvados.InstanceType{}, "", nil, "echo InitCommand", nil)
+		c.Assert(err, check.IsNil)
+		wp := &Pool{
+			timeoutBooting: time.Minute,
+			timeoutProbe:   time.Minute,
+		}
+		wkr := &worker{
+			logger:   suite.logger,
+			wp:       wp,
+			mtx:      &wp.mtx,
+			state:    trial.state,
+			instance: TagVerifier{Instance: unwrapInstance{&stateInstance{Instance: inst, state: trial.cloudState}}},
+		}
+		wp.mtx.Lock()
+		c.Check(wkr.shutdownIfBroken(time.Second), check.Equals, trial.shutdown, comment)
+		c.Check(wkr.state == StateShutdown, check.Equals, trial.shutdown, comment)
+		wp.mtx.Unlock()
+	}
+}
+
 type stubResp struct {
 	stdout string
 	stderr string
@@ -0,0 +1,351 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstoreadmin
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/services/keepstore"
+	"github.com/sirupsen/logrus"
+)
+
+type admin struct {
+	ctx     context.Context
+	cluster *arvados.Cluster
+	client  *arvados.Client
+	servers []*arvados.KeepService
+	stdin   io.Reader
+	stdout  io.Writer
+	logger  logrus.FieldLogger
+}
+
+func (a *admin) status(args []string) error {
+	tw := tabwriter.NewWriter(a.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tHEALTH\tVOLUMES\tWRITABLE")
+	failed := 0
+	for _, ks := range a.servers {
+		health, nmounts, nwritable := "OK", "-", "-"
+		if err := a.ping(ks); err != nil {
+			health = err.Error()
+			failed++
+		} else if mounts, err := ks.Mounts(a.client); err != nil {
+			health = err.Error()
+			failed++
+		} else {
+			w := 0
+			for _, m := range mounts {
+				if m.AllowWrite {
+					w++
+				}
+			}
+			nmounts, nwritable = fmt.Sprint(len(mounts)), fmt.Sprint(w)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", ks.URL(), health, nmounts, nwritable)
+	}
+	tw.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d servers failed", failed, len(a.servers))
+	}
+	return nil
+}
+
+// ping checks the server's health endpoint using the cluster's
+// ManagementToken.
+func (a *admin) ping(ks *arvados.KeepService) error {
+	ctx := arvados.ContextWithAuthorization(a.ctx, "Bearer "+a.cluster.ManagementToken)
+	req, err := http.NewRequestWithContext(ctx, "GET", ks.URL()+"/_health/ping", nil)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Health string `json:"health"`
+		Error  string `json:"error"`
+	}
+	err = a.client.DoAndDecode(&resp, req)
+	if err != nil {
+		return err
+	}
+	if resp.Health != "OK" {
+		return fmt.Errorf("health %q: %s", resp.Health, resp.Error)
+	}
+	return nil
+}
+
+func (a *admin) volumes(args []string) error {
+	tw := tabwriter.NewWriter(a.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tVOLUME\tDEVICE\tWRITE\tTRASH\tREPLICATION\tSTORAGE_CLASSES")
+	var errs []string
+	for _, ks := range a.servers {
+		mounts, err := ks.Mounts(a.client)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, m := range mounts {
+			var classes []string
+			for sc := range m.StorageClasses {
+				classes = append(classes, sc)
+			}
+			sort.Strings(classes)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%v\t%d\t%s\n", ks.URL(), m.UUID, m.DeviceID, m.AllowWrite, m.AllowTrash, m.Replication, strings.Join(classes, ","))
+		}
+	}
+	tw.Flush()
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+func (a *admin) trashList(clear bool) error {
+	tl := []keepstore.TrashListItem{}
+	if !clear {
+		if len(a.servers) != 1 {
+			return errors.New("a trash list can only be sent to one server at a time (use -url)")
+		}
+		err := json.NewDecoder(a.stdin).Decode(&tl)
+		if err != nil {
+			return fmt.Errorf("error decoding trash list from stdin: %w", err)
+		}
+	}
+	for _, ks := range a.servers {
+		err := a.put(ks, "trash", tl)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(a.stdout, "%s: sent trash list with %d entries\n", ks.URL(), len(tl))
+	}
+	return nil
+}
+
+func (a *admin) untrash(locators []string) error {
+	failed := 0
+	for _, loc := range locators {
+		n := 0
+		for _, ks := range a.servers {
+			err := ks.Untrash(a.ctx, a.client, loc)
+			if err != nil {
+				a.logger.WithError(err).Debugf("%s: untrash %s failed", ks.URL(), loc)
+				continue
+			}
+			n++
+		}
+		if n == 0 {
+			failed++
+		}
+		fmt.Fprintf(a.stdout, "%s: untrashed on %d of %d servers\n", loc, n, len(a.servers))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d blocks could not be untrashed on any server", failed, len(locators))
+	}
+	return nil
+}
+
+// findMount returns the server that has the given mount, along with
+// all of that server's mounts.
+func (a *admin) findMount(mountUUID string) (*arvados.KeepService, []arvados.KeepMount, error) {
+	for _, ks := range a.servers {
+		mounts, err := ks.Mounts(a.client)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, m := range mounts {
+			if m.UUID == mountUUID {
+				return ks, mounts, nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("volume %s not found", mountUUID)
+}
+
+func (a *admin) drain(mountUUID string, dryrun bool) error {
+	if mountUUID == "" {
+		return errors.New("-mount is required")
+	}
+	ks, mounts, err := a.findMount(mountUUID)
+	if err != nil {
+		return err
+	}
+	var targets []arvados.KeepMount
+	elsewhere := map[arvados.SizedDigest]bool{}
+	for _, m := range mounts {
+		if m.UUID == mountUUID {
+			continue
+		}
+		if m.AllowWrite {
+			targets = append(targets, m)
+		}
+		idx, err := ks.IndexMount(a.ctx, a.client, m.UUID, "")
+		if err != nil {
+			return err
+		}
+		for _, ent := range idx {
+			elsewhere[ent.SizedDigest] = true
+		}
+	}
+	idx, err := ks.IndexMount(a.ctx, a.client, mountUUID, "")
+	if err != nil {
+		return err
+	}
+	var pl []keepstore.PullListItem
+	for _, ent := range idx {
+		if elsewhere[ent.SizedDigest] {
+			continue
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("%s: no other writable volumes to copy blocks to", ks.URL())
+		}
+		pl = append(pl, keepstore.PullListItem{
+			Locator:   string(ent.SizedDigest),
+			Servers:   []string{ks.URL()},
+			MountUUID: targets[len(pl)%len(targets)].UUID,
+		})
+	}
+	if len(pl) == 0 {
+		fmt.Fprintf(a.stdout, "%s: volume %s is drained: all %d blocks are stored on other volumes\n", ks.URL(), mountUUID, len(idx))
+		return nil
+	}
+	if dryrun {
+		fmt.Fprintf(a.stdout, "%s: volume %s has %d of %d blocks to copy\n", ks.URL(), mountUUID, len(pl), len(idx))
+		return nil
+	}
+	err = a.put(ks, "pull", pl)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "%s: volume %s: queued pull requests for %d of %d blocks\n", ks.URL(), mountUUID, len(pl), len(idx))
+	return nil
+}
+
+func (a *admin) scrub(mountUUID string, concurrency int) error {
+	servers := a.servers
+	if mountUUID != "" {
+		ks, _, err := a.findMount(mountUUID)
+		if err != nil {
+			return err
+		}
+		servers = []*arvados.KeepService{ks}
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	bad := 0
+	for _, ks := range servers {
+		var idx []arvados.KeepServiceIndexEntry
+		var err error
+		if mountUUID != "" {
+			idx, err = ks.IndexMount(a.ctx, a.client, mountUUID, "")
+		} else {
+			idx, err = ks.Index(a.ctx, a.client, "")
+		}
+		if err != nil {
+			return err
+		}
+		var mtx sync.Mutex
+		checked, badHere := 0, 0
+		seen := map[arvados.SizedDigest]bool{}
+		pg := a.client.NewParallelGroup(a.ctx, concurrency)
+		for _, ent := range idx {
+			blk := ent.SizedDigest
+			if seen[blk] {
+				continue
+			}
+			seen[blk] = true
+			pg.Go(func(context.Context) error {
+				err := a.checkBlock(ks, blk)
+				mtx.Lock()
+				defer mtx.Unlock()
+				checked++
+				if err != nil {
+					badHere++
+					fmt.Fprintf(a.stdout, "%s: %s: %s\n", ks.URL(), blk, err)
+				}
+				return nil
+			})
+		}
+		err = pg.Wait()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(a.stdout, "%s: checked %d blocks, %d bad\n", ks.URL(), checked, badHere)
+		bad += badHere
+	}
+	if bad > 0 {
+		return fmt.Errorf("found %d bad blocks", bad)
+	}
+	return nil
+}
+
+// checkBlock reads the given block from the server and checks its
+// size and hash.
+func (a *admin) checkBlock(ks *arvados.KeepService, blk arvados.SizedDigest) error {
+	locator := string(blk)
+	if key := a.cluster.Collections.BlobSigningKey; key != "" {
+		ttl := a.cluster.Collections.BlobSigningTTL.Duration()
+		locator = arvados.SignLocator(locator, a.client.AuthToken, time.Now().Add(ttl), ttl, []byte(key))
+	}
+	req, err := http.NewRequestWithContext(a.ctx, "GET", ks.URL()+"/"+locator, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	h := md5.New()
+	n, err := io.Copy(h, resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading block after %d bytes: %w", n, err)
+	}
+	if n != blk.Size() {
+		return fmt.Errorf("size mismatch: read %d bytes, expected %d", n, blk.Size())
+	}
+	if hash := fmt.Sprintf("%x", h.Sum(nil)); hash != locator[:32] {
+		return fmt.Errorf("checksum mismatch: content hash is %s", hash)
+	}
+	return nil
+}
+
+// put sends data as a JSON-encoded request body to the given
+// management endpoint (e.g., "pull" or "trash").
+func (a *admin) put(ks *arvados.KeepService, path string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(a.ctx, "PUT", ks.URL()+"/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respbody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("PUT %s: %s: %s", req.URL, resp.Status, bytes.TrimSpace(respbody))
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+// Package keepstoreadmin implements the "keepstore-admin" command,
+// which uses keepstore's management API to inspect and maintain
+// keepstore servers.
+package keepstoreadmin
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/sirupsen/logrus"
+)
+
+var Command = cmd.Multi(map[string]cmd.Handler{
+	"status": subcommand{
+		description: "Report health and volume counts for each keepstore server.",
+		setup:       func(*flag.FlagSet) runFunc { return (*admin).status },
+	},
+	"volumes": subcommand{
+		description: "List the volumes (mounts) attached to each keepstore server.",
+		setup:       func(*flag.FlagSet) runFunc { return (*admin).volumes },
+	},
+	"trash-list": subcommand{
+		description: `Replace a keepstore server's trash list with the JSON array
+	read from stdin, e.g.,
+
+	[{"locator":"acbd18db4cc2f85cedef654fccc4a4d8+3","block_mtime":1700000000000000000,"mount_uuid":""}]
+
+	Note keep-balance replaces the trash list on each run.`,
+		setup: func(flags *flag.FlagSet) runFunc {
+			clear := flags.Bool("clear", false, "send an empty trash list (cancel pending trash operations) instead of reading stdin")
+			return func(a *admin, args []string) error { return a.trashList(*clear) }
+		},
+	},
+	"untrash": subcommand{
+		args:        "locator [...]",
+		description: "Recover the given blocks from trash on every keepstore server that has them.",
+		setup:       func(*flag.FlagSet) runFunc { return (*admin).untrash },
+	},
+	"drain": subcommand{
+		description: `Queue pull requests that copy every block stored on the given
+	volume to the keepstore server's other writable volumes. Re-run
+	to check progress: the volume is drained when no blocks remain
+	to copy.
+
+	Note keep-balance replaces the pull list on each run, so it
+	should be paused while draining.`,
+		setup: func(flags *flag.FlagSet) runFunc {
+			mount := flags.String("mount", "", "`uuid` of the volume to drain (required)")
+			dryrun := flags.Bool("dry-run", false, "report the number of blocks to copy, but don't queue pull requests")
+			return func(a *admin, args []string) error { return a.drain(*mount, *dryrun) }
+		},
+	},
+	"scrub": subcommand{
+		description: `Read every block stored on the keepstore server(s) and report
+	blocks whose content does not match their hash.`,
+		setup: func(flags *flag.FlagSet) runFunc {
+			mount := flags.String("mount", "", "only check blocks listed on the volume with the given `uuid`")
+			concurrency := flags.Int("concurrency", 4, "number of blocks to read concurrently")
+			return func(a *admin, args []string) error { return a.scrub(*mount, *concurrency) }
+		},
+	},
+})
+
+type runFunc func(a *admin, args []string) error
+
+type subcommand struct {
+	args        string
+	description string
+	// setup adds subcommand-specific flags to the given flag
+	// set and returns the function that runs the subcommand
+	// after the flags are parsed.
+	setup func(*flag.FlagSet) runFunc
+}
+
+func (sc subcommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	logger := ctxlog.New(stderr, "text", "info")
+	loader := config.NewLoader(nil, logger)
+	loader.SkipLegacy = true
+
+	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage:
+	%s [options ...] %s
+
+	%s
+
+	Administrative endpoints are accessed using the cluster's
+	SystemRootToken; health checks use the ManagementToken.
+
+Options:
+`, prog, sc.args, sc.description)
+		flags.PrintDefaults()
+	}
+	loader.SetupFlags(flags)
+	serverURL := flags.String("url", "", "keepstore server `URL` (default: all Services.Keepstore.InternalURLs in the cluster config)")
+	loglevel := flags.String("log-level", "info", "logging level (debug, info, ...)")
+	run := sc.setup(flags)
+	if ok, code := cmd.ParseFlags(flags, prog, args, sc.args, stderr); !ok {
+		return code
+	} else if sc.args != "" && flags.NArg() == 0 {
+		fmt.Fprintf(stderr, "missing required arguments (try -help)\n")
+		return cmd.EXIT_INVALIDARGUMENT
+	}
+	lvl, err := logrus.ParseLevel(*loglevel)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return cmd.EXIT_INVALIDARGUMENT
+	}
+	logger.SetLevel(lvl)
+
+	cfg, err := loader.Load()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	cluster, err := cfg.GetCluster("")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	client, err := arvados.NewClientFromConfig(cluster)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	client.AuthToken = cluster.SystemRootToken
+
+	var urls []string
+	if *serverURL != "" {
+		urls = []string{*serverURL}
+	} else {
+		for u := range cluster.Services.Keepstore.InternalURLs {
+			urls = append(urls, strings.TrimSuffix(u.String(), "/"))
+		}
+		sort.Strings(urls)
+	}
+	if len(urls) == 0 {
+		fmt.Fprintln(stderr, "no keepstore servers configured in Services.Keepstore.InternalURLs (use -url)")
+		return 1
+	}
+	var servers []*arvados.KeepService
+	for _, u := range urls {
+		ks, err := keepServiceFromURL(u)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return cmd.EXIT_INVALIDARGUMENT
+		}
+		servers = append(servers, ks)
+	}
+
+	a := &admin{
+		ctx:     ctxlog.Context(context.Background(), logger),
+		cluster: cluster,
+		client:  client,
+		servers: servers,
+		stdin:   stdin,
+		stdout:  stdout,
+		logger:  logger,
+	}
+	err = run(a, flags.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// keepServiceFromURL returns a KeepService for the keepstore server
+// at the given URL (e.g., "http://keep0.zzzzz.example:25107").
+func keepServiceFromURL(s string) (*arvados.KeepService, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keepstore URL %q: %w", s, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid keepstore URL %q: scheme must be http or https", s)
+	}
+	port := 80
+	if u.Scheme == "https" {
+		port = 443
+	}
+	if p := u.Port(); p != "" {
+		port, err = strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keepstore URL %q: %w", s, err)
+		}
+	}
+	// The server's UUID is not known (and not needed): servers
+	// are identified by URL() in requests, output, and pull
+	// lists.
+	return &arvados.KeepService{
+		ServiceHost:    u.Hostname(),
+		ServicePort:    port,
+		ServiceSSLFlag: u.Scheme == "https",
+		ServiceType:    "disk",
+	}, nil
+}
@@ -0,0 +1,257 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstoreadmin
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/services/keepstore"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&Suite{})
+
+type Suite struct {
+	configFile string
+	stub       *stubKeepstore
+	server     *httptest.Server
+}
+
+const (
+	testRootToken = "systemroottoken1234567890123456789012345"
+	testMgmtToken = "managementtoken1234567890123456789012345"
+)
+
+// stubKeepstore implements the keepstore management endpoints used
+// by keepstore-admin.
+type stubKeepstore struct {
+	c         *check.C
+	mtx       sync.Mutex
+	mounts    []arvados.KeepMount
+	blocks    map[string]map[string][]byte // mount uuid => hash+size => data
+	pullList  []keepstore.PullListItem
+	trashList []keepstore.TrashListItem
+	untrashed []string
+}
+
+func (stub *stubKeepstore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	if req.URL.Path == "/_health/ping" {
+		stub.c.Check(req.Header.Get("Authorization"), check.Equals, "Bearer "+testMgmtToken)
+		w.Write([]byte(`{"health":"OK"}`))
+		return
+	}
+	stub.c.Check(req.Header.Get("Authorization"), check.Equals, "Bearer "+testRootToken)
+	path := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	switch {
+	case req.Method == "GET" && path[0] == "mounts" && len(path) == 1:
+		json.NewEncoder(w).Encode(stub.mounts)
+	case req.Method == "GET" && path[0] == "mounts" && len(path) == 3:
+		for blk := range stub.blocks[path[1]] {
+			fmt.Fprintf(w, "%s 1700000000000000000\n", blk)
+		}
+		w.Write([]byte("\n"))
+	case req.Method == "GET" && path[0] == "index":
+		for _, blks := range stub.blocks {
+			for blk := range blks {
+				fmt.Fprintf(w, "%s 1700000000000000000\n", blk)
+			}
+		}
+		w.Write([]byte("\n"))
+	case req.Method == "GET" && len(path[0]) > 32:
+		parts := strings.SplitN(path[0], "+", 3)
+		stub.c.Check(parts[2], check.Matches, `A[0-9a-f]+@[0-9a-f]+`)
+		for _, blks := range stub.blocks {
+			if data, ok := blks[parts[0]+"+"+parts[1]]; ok {
+				w.Write(data)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case req.Method == "PUT" && path[0] == "pull":
+		stub.c.Check(json.NewDecoder(req.Body).Decode(&stub.pullList), check.IsNil)
+	case req.Method == "PUT" && path[0] == "trash":
+		stub.c.Check(json.NewDecoder(req.Body).Decode(&stub.trashList), check.IsNil)
+	case req.Method == "PUT" && path[0] == "untrash":
+		if strings.HasPrefix(path[1], "acbd18db4cc2f85cedef654fccc4a4d8") {
+			stub.untrashed = append(stub.untrashed, path[1])
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func blk(data string) (string, []byte) {
+	return fmt.Sprintf("%x+%d", md5.Sum([]byte(data)), len(data)), []byte(data)
+}
+
+func (s *Suite) SetUpTest(c *check.C) {
+	s.stub = &stubKeepstore{
+		c: c,
+		mounts: []arvados.KeepMount{
+			{UUID: "zzzzz-nyw5e-000000000000000", DeviceID: "dev0", AllowWrite: true, AllowTrash: true, Replication: 1, StorageClasses: map[string]bool{"default": true}},
+			{UUID: "zzzzz-nyw5e-111111111111111", DeviceID: "dev1", AllowWrite: true, AllowTrash: true, Replication: 1, StorageClasses: map[string]bool{"default": true, "archive": true}},
+			{UUID: "zzzzz-nyw5e-222222222222222", DeviceID: "dev2", AllowWrite: false, Replication: 1},
+		},
+		blocks: map[string]map[string][]byte{},
+	}
+	foo, foodata := blk("foo")
+	bar, bardata := blk("bar")
+	baz, _ := blk("baz")
+	s.stub.blocks["zzzzz-nyw5e-000000000000000"] = map[string][]byte{foo: foodata, bar: bardata, baz: []byte("bad")}
+	s.stub.blocks["zzzzz-nyw5e-111111111111111"] = map[string][]byte{foo: foodata}
+	s.server = httptest.NewServer(s.stub)
+
+	s.configFile = c.MkDir() + "/config.yml"
+	err := ioutil.WriteFile(s.configFile, []byte(`
+Clusters:
+  zzzzz:
+    SystemRootToken: `+testRootToken+`
+    ManagementToken: `+testMgmtToken+`
+    Collections:
+      BlobSigningKey: blobsigningkey12345678901234567890123456789012345
+    Services:
+      Controller:
+        ExternalURL: https://controller.zzzzz.example
+      Keepstore:
+        InternalURLs:
+          "`+s.server.URL+`/": {}
+`), 0600)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *Suite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func (s *Suite) run(c *check.C, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	args = append(args[:1], append([]string{"-config", s.configFile}, args[1:]...)...)
+	code := Command.RunCommand("keepstore-admin", args, strings.NewReader(stdin), &stdout, &stderr)
+	c.Logf("stdout:\n%s", stdout.String())
+	c.Logf("stderr:\n%s", stderr.String())
+	return code, stdout.String(), stderr.String()
+}
+
+func (s *Suite) TestUsage(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	code := Command.RunCommand("keepstore-admin", []string{"drain", "-help"}, os.Stdin, &stdout, &stderr)
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr.String(), check.Matches, `(?ms).*-mount uuid.*`)
+
+	code = Command.RunCommand("keepstore-admin", []string{"untrash"}, os.Stdin, &stdout, &stderr)
+	c.Check(code, check.Equals, 2)
+}
+
+func (s *Suite) TestKeepServiceFromURL(c *check.C) {
+	for _, trial := range []struct {
+		in  string
+		out string
+	}{
+		{"http://keep0.zzzzz.example:25107", "http://keep0.zzzzz.example:25107"},
+		{"http://keep0.zzzzz.example:25107/", "http://keep0.zzzzz.example:25107"},
+		{"https://keep0.zzzzz.example", "https://keep0.zzzzz.example:443"},
+	} {
+		ks, err := keepServiceFromURL(trial.in)
+		c.Assert(err, check.IsNil)
+		c.Check(ks.URL(), check.Equals, trial.out)
+		c.Check(ks.UUID, check.Equals, "")
+	}
+	_, err := keepServiceFromURL("ftp://keep0.zzzzz.example")
+	c.Check(err, check.ErrorMatches, `.*scheme must be http or https`)
+}
+
+func (s *Suite) TestStatus(c *check.C) {
+	code, stdout, _ := s.run(c, "", "status")
+	c.Check(code, check.Equals, 0)
+	c.Check(stdout, check.Matches, `(?ms)SERVER +HEALTH +VOLUMES +WRITABLE\n`+s.server.URL+` +OK +3 +2\n`)
+}
+
+func (s *Suite) TestVolumes(c *check.C) {
+	code, stdout, _ := s.run(c, "", "volumes", "-url", s.server.URL)
+	c.Check(code, check.Equals, 0)
+	c.Check(stdout, check.Matches, `(?ms).* zzzzz-nyw5e-111111111111111 +dev1 +true +true +1 +archive,default\n.*`)
+	c.Check(strings.Count(stdout, "\n"), check.Equals, 4)
+}
+
+func (s *Suite) TestTrashList(c *check.C) {
+	code, _, _ := s.run(c, `[{"locator":"acbd18db4cc2f85cedef654fccc4a4d8+3","block_mtime":1700000000000000000}]`, "trash-list")
+	c.Check(code, check.Equals, 0)
+	c.Check(s.stub.trashList, check.DeepEquals, []keepstore.TrashListItem{{Locator: "acbd18db4cc2f85cedef654fccc4a4d8+3", BlockMtime: 1700000000000000000}})
+
+	code, _, _ = s.run(c, "", "trash-list", "-clear")
+	c.Check(code, check.Equals, 0)
+	c.Check(s.stub.trashList, check.HasLen, 0)
+
+	code, _, stderr := s.run(c, "not json", "trash-list")
+	c.Check(code, check.Equals, 1)
+	c.Check(stderr, check.Matches, `(?ms).*error decoding trash list from stdin: .*\n`)
+}
+
+func (s *Suite) TestUntrash(c *check.C) {
+	code, stdout, _ := s.run(c, "", "untrash", "acbd18db4cc2f85cedef654fccc4a4d8+3")
+	c.Check(code, check.Equals, 0)
+	c.Check(stdout, check.Equals, "acbd18db4cc2f85cedef654fccc4a4d8+3: untrashed on 1 of 1 servers\n")
+	c.Check(s.stub.untrashed, check.DeepEquals, []string{"acbd18db4cc2f85cedef654fccc4a4d8+3"})
+
+	code, _, stderr := s.run(c, "", "untrash", "37b51d194a7513e45b56f6524f2d51f2+3")
+	c.Check(code, check.Equals, 1)
+	c.Check(stderr, check.Matches, `(?ms).*1 of 1 blocks could not be untrashed on any server\n`)
+}
+
+func (s *Suite) TestDrain(c *check.C) {
+	code, _, stderr := s.run(c, "", "drain")
+	c.Check(code, check.Equals, 1)
+	c.Check(stderr, check.Matches, `(?ms).*-mount is required\n`)
+
+	code, stdout, _ := s.run(c, "", "drain", "-mount", "zzzzz-nyw5e-000000000000000", "-dry-run")
+	c.Check(code, check.Equals, 0)
+	c.Check(stdout, check.Matches, `.*volume zzzzz-nyw5e-000000000000000 has 2 of 3 blocks to copy\n`)
+	c.Check(s.stub.pullList, check.IsNil)
+
+	code, stdout, _ = s.run(c, "", "drain", "-mount", "zzzzz-nyw5e-000000000000000")
+	c.Check(code, check.Equals, 0)
+	c.Check(stdout, check.Matches, `.*queued pull requests for 2 of 3 blocks\n`)
+	c.Assert(s.stub.pullList, check.HasLen, 2)
+	for _, item := range s.stub.pullList {
+		c.Check(item.MountUUID, check.Equals, "zzzzz-nyw5e-111111111111111")
+		c.Check(item.Servers, check.DeepEquals, []string{s.server.URL})
+		c.Check(item.Locator, check.Not(check.Equals), "acbd18db4cc2f85cedef654fccc4a4d8+3")
+	}
+
+	code, stdout, _ = s.run(c, "", "drain", "-mount", "zzzzz-nyw5e-111111111111111")
+	c.Check(code, check.Equals, 0)
+	c.Check(stdout, check.Matches, `.*volume zzzzz-nyw5e-111111111111111 is drained: all 1 blocks are stored on other volumes\n`)
+}
+
+func (s *Suite) TestScrub(c *check.C) {
+	code, stdout, stderr := s.run(c, "", "scrub")
+	c.Check(code, check.Equals, 1)
+	c.Check(stdout, check.Matches, `(?ms).*73feffa4b7f6bb68e44cf984c85f6e88\+3: checksum mismatch: content hash is bae60998ffe4923b131e3d6e4c19993e\n.*`)
+	c.Check(stdout, check.Matches, `(?ms).*: checked 3 blocks, 1 bad\n`)
+	c.Check(stderr, check.Matches, `(?ms).*found 1 bad blocks\n`)
+
+	code, stdout, _ = s.run(c, "", "scrub", "-mount", "zzzzz-nyw5e-111111111111111")
+	c.Check(code, check.Equals, 0)
+	c.Check(stdout, check.Matches, `.*: checked 1 blocks, 0 bad\n`)
+}
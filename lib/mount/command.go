@@ -13,6 +13,7 @@ import (
 	// pprof is only imported to register its HTTP handlers
 	_ "net/http/pprof"
 	"os"
+	"strings"
 
 	"git.arvados.org/arvados.git/lib/cmd"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -49,6 +50,7 @@ func (c *mountCommand) RunCommand(prog string, args []string, stdin io.Reader, s
 	ro := flags.Bool("ro", false, "read-only")
 	experimental := flags.Bool("experimental", false, "acknowledge this is an experimental command, and should not be used in production (required)")
 	cacheSizeStr := flags.String("cache-size", "0", "cache size as percent of home filesystem size (\"5%\") or size (\"10GiB\") or 0 for automatic")
+	cacheReadOnlyDirs := flags.String("cache-readonly-dirs", "", "colon-separated list of pre-seeded read-only cache directories to check before the writable cache")
 	logLevel := flags.String("log-level", "info", "logging level (debug, info, ...)")
 	debug := flags.Bool("debug", false, "alias for -log-level=debug")
 	pprof := flags.String("pprof", "", "serve Go profile data at `[addr]:port`")
@@ -89,6 +91,9 @@ func (c *mountCommand) RunCommand(prog string, args []string, stdin io.Reader, s
 		logger.Error(err)
 		return 1
 	}
+	if *cacheReadOnlyDirs != "" {
+		kc.DiskCacheReadOnlyDirs = strings.Split(*cacheReadOnlyDirs, ":")
+	}
 	host := fuse.NewFileSystemHost(&keepFS{
 		Client:     client,
 		KeepClient: kc,
@@ -16,8 +16,11 @@ import (
 	_ "net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"git.arvados.org/arvados.git/lib/cmd"
@@ -46,6 +49,7 @@ type command struct {
 	newHandler NewHandlerFunc
 	svcName    arvados.ServiceName
 	ctx        context.Context // enables tests to shutdown service; no public API yet
+	sigterm    chan os.Signal  // enables tests to simulate SIGTERM
 }
 
 var requestQueueDumpCheckInterval = time.Minute
@@ -168,7 +172,7 @@ func (c *command) RunCommand(prog string, args []string, stdin io.Reader, stdout
 	}
 
 	instrumented := httpserver.Instrument(reg, log,
-		httpserver.HandlerWithDeadline(cluster.API.RequestTimeout.Duration(),
+		applyListenerPolicy(cluster.API.RequestTimeout.Duration(),
 			httpserver.AddRequestIDs(
 				httpserver.Inspect(reg, cluster.ManagementToken,
 					httpserver.LogRequests(
@@ -199,6 +203,27 @@ func (c *command) RunCommand(prog string, args []string, stdin io.Reader, stdout
 		"Service": c.svcName,
 		"Version": cmd.Version.String(),
 	}).Info("listening")
+	extraSrvs, err := startExtraListeners(ctx, cluster, extraListenersFor(cluster.Services.Map()[c.svcName], internalURL), srv.Handler, logger)
+	if err != nil {
+		logger.WithError(err).Errorf("cannot start %s service extra listeners", c.svcName)
+		srv.Close()
+		return 1
+	}
+	for _, extra := range extraSrvs {
+		extra := extra
+		go func() {
+			// Shut down everything if any listener fails
+			if err := extra.Wait(); err != nil {
+				logger.WithError(err).Error("listener failed")
+			}
+			srv.Close()
+		}()
+	}
+	defer func() {
+		for _, extra := range extraSrvs {
+			extra.Close()
+		}
+	}()
 	if _, err := daemon.SdNotify(false, "READY=1"); err != nil {
 		logger.WithError(err).Errorf("error notifying init daemon")
 	}
@@ -213,7 +238,27 @@ func (c *command) RunCommand(prog string, args []string, stdin io.Reader, stdout
 		srv.Close()
 	}()
 	go c.requestQueueDumpCheck(cluster, prog, reg, &srv.Server, logger)
+	var draining sync.WaitGroup
+	stopped := make(chan struct{})
+	if d, ok := handler.(Drainer); ok && d.DrainTimeout() > 0 {
+		sigterm := c.sigterm
+		if sigterm == nil {
+			sigterm = make(chan os.Signal, 1)
+			signal.Notify(sigterm, syscall.SIGTERM)
+			defer signal.Stop(sigterm)
+		}
+		draining.Add(1)
+		go func() {
+			defer draining.Done()
+			drainOnSignal(d, append([]*httpserver.Server{srv}, extraSrvs...), sigterm, stopped, logger)
+		}()
+	}
 	err = srv.Wait()
+	// If we are draining, srv.Wait returns as soon as the
+	// listener is closed, but we don't exit until the in-flight
+	// requests are done.
+	close(stopped)
+	draining.Wait()
 	if err != nil {
 		return 1
 	}
@@ -440,19 +485,7 @@ func getListenAddr(svcs arvados.Services, prog arvados.ServiceName, log logrus.F
 			// intermediate proxy/routing)
 			listenURL = internalURL
 		}
-		listenAddr := listenURL.Host
-		if _, _, err := net.SplitHostPort(listenAddr); err != nil {
-			// url "https://foo.example/" (with no
-			// explicit port name/number) means listen on
-			// the well-known port for the specified
-			// protocol, "foo.example:https".
-			port := listenURL.Scheme
-			if port == "ws" || port == "wss" {
-				port = "http" + port[2:]
-			}
-			listenAddr = net.JoinHostPort(listenAddr, port)
-		}
-		listener, err := net.Listen("tcp", listenAddr)
+		listener, err := net.Listen("tcp", listenAddr(listenURL))
 		if err == nil {
 			listener.Close()
 			return listenURL, internalURL, nil
@@ -472,6 +505,22 @@ func getListenAddr(svcs arvados.Services, prog arvados.ServiceName, log logrus.F
 	return arvados.URL{}, arvados.URL{}, fmt.Errorf("configuration does not enable the %q service on this host", prog)
 }
 
+// listenAddr returns the host:port to listen on for the given URL.
+// A URL like "https://foo.example/" (with no explicit port
+// name/number) means listen on the well-known port for the specified
+// protocol, "foo.example:https".
+func listenAddr(listenURL arvados.URL) string {
+	addr := listenURL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := listenURL.Scheme
+		if port == "ws" || port == "wss" {
+			port = "http" + port[2:]
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+	return addr
+}
+
 type contextKeyURL struct{}
 
 func URLFromContext(ctx context.Context) (arvados.URL, bool) {
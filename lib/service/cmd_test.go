@@ -19,6 +19,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -490,6 +491,88 @@ Clusters:
 	c.Log(stderr.String())
 }
 
+func (*Suite) TestExtraListeners(c *check.C) {
+	port := unusedPort(c)
+	openPort := unusedPort(c)
+	closedPort := unusedPort(c)
+	otherPort := unusedPort(c)
+
+	stdin := bytes.NewBufferString(`
+Clusters:
+ zzzzz:
+  SystemRootToken: abcde
+  Services:
+   Controller:
+    ExternalURL: "http://localhost:` + port + `"
+    InternalURLs:
+     "http://localhost:` + port + `": {}
+    ExtraListeners:
+     "http://127.0.0.1:` + openPort + `": {InternalURL: "http://localhost:` + port + `", AllowNetworks: ["127.0.0.0/8"]}
+     "http://127.0.0.1:` + closedPort + `": {InternalURL: "http://localhost:` + port + `", AllowNetworks: ["192.0.2.0/24"]}
+     "http://127.0.0.1:` + otherPort + `": {InternalURL: "http://localhost:` + otherPort + `"}
+`)
+
+	cmd := Command(arvados.ServiceNameController, func(ctx context.Context, _ *arvados.Cluster, token string, reg *prometheus.Registry) Handler {
+		return &testHandler{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd.(*command).ctx = ctx
+
+	exited := make(chan bool)
+	var stdout, stderr bytes.Buffer
+	go func() {
+		cmd.RunCommand("arvados-controller", []string{"-config", "-"}, stdin, &stdout, &stderr)
+		close(exited)
+	}()
+	defer func() {
+		cancel()
+		<-exited
+		c.Log(stderr.String())
+	}()
+
+	get := func(port string) int {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			resp, err := http.Get("http://127.0.0.1:" + port + "/")
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		c.Errorf("timed out waiting for listener on port %s", port)
+		return 0
+	}
+	c.Check(get(port), check.Equals, http.StatusOK)
+	c.Check(get(openPort), check.Equals, http.StatusOK)
+	c.Check(get(closedPort), check.Equals, http.StatusForbidden)
+
+	// Listeners that belong to a different instance are not
+	// started.
+	_, err := http.Get("http://127.0.0.1:" + otherPort + "/")
+	c.Check(err, check.NotNil)
+}
+
+func (*Suite) TestListenerPolicy(c *check.C) {
+	_, err := newListenerPolicy(arvados.ServiceListener{AllowNetworks: []string{"10.0.0.0"}})
+	c.Check(err, check.ErrorMatches, `invalid AllowNetworks entry "10.0.0.0".*`)
+
+	pol, err := newListenerPolicy(arvados.ServiceListener{AllowNetworks: []string{"10.0.0.0/8", "fd00::/8"}})
+	c.Assert(err, check.IsNil)
+	c.Check(pol.allow("10.1.2.3:1234"), check.Equals, true)
+	c.Check(pol.allow("[fd00::1]:1234"), check.Equals, true)
+	c.Check(pol.allow("192.0.2.1:1234"), check.Equals, false)
+	c.Check(pol.allow("[::1]:1234"), check.Equals, false)
+
+	pol, err = newListenerPolicy(arvados.ServiceListener{})
+	c.Assert(err, check.IsNil)
+	c.Check(pol.allow("192.0.2.1:1234"), check.Equals, true)
+}
+
 type testHandler struct {
 	ctx         context.Context
 	handler     http.Handler
@@ -506,3 +589,124 @@ func (th *testHandler) CheckHealth() error {
 	}
 	return nil
 }
+
+type drainHandler struct {
+	testHandler
+	timeout time.Duration
+	drained chan bool
+}
+
+func (dh *drainHandler) DrainTimeout() time.Duration { return dh.timeout }
+func (dh *drainHandler) Drain(ctx context.Context)   { close(dh.drained) }
+
+func (s *Suite) TestDrainOnSIGTERM(c *check.C) {
+	s.testDrainOnSIGTERM(c, time.Minute)
+}
+
+func (s *Suite) TestDrainTimeout(c *check.C) {
+	s.testDrainOnSIGTERM(c, 200*time.Millisecond)
+}
+
+func (*Suite) testDrainOnSIGTERM(c *check.C, timeout time.Duration) {
+	port := unusedPort(c)
+	stdin := bytes.NewBufferString(`
+Clusters:
+ zzzzz:
+  SystemRootToken: abcde
+  Services:
+   Controller:
+    ExternalURL: "http://localhost:` + port + `"
+    InternalURLs: {"http://localhost:` + port + `": {}}
+`)
+	started := make(chan bool, 1)
+	hold := make(chan bool)
+	defer close(hold)
+	dh := &drainHandler{
+		testHandler: testHandler{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- true
+			<-hold
+			w.Write([]byte("ok"))
+		})},
+		timeout: timeout,
+		drained: make(chan bool),
+	}
+	cmd := Command(arvados.ServiceNameController, func(ctx context.Context, _ *arvados.Cluster, token string, reg *prometheus.Registry) Handler {
+		return dh
+	})
+	sigterm := make(chan os.Signal, 1)
+	cmd.(*command).sigterm = sigterm
+
+	exited := make(chan int, 1)
+	var stdout, stderr bytes.Buffer
+	go func() {
+		exited <- cmd.RunCommand("arvados-controller", []string{"-config", "-"}, stdin, &stdout, &stderr)
+	}()
+	defer func() { c.Log(stderr.String()) }()
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	got := make(chan result, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp, err := client.Get("http://localhost:" + port + "/slow")
+			if err != nil && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			} else if err != nil {
+				got <- result{err: err}
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			got <- result{status: resp.StatusCode, body: string(body), err: err}
+			return
+		}
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for request")
+	}
+
+	sigterm <- syscall.SIGTERM
+	select {
+	case <-dh.drained:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for Drain")
+	}
+	// New connections are refused while the in-flight request
+	// is still in progress.
+	_, err := net.Dial("tcp", "localhost:"+port)
+	c.Check(err, check.NotNil)
+
+	if timeout > time.Second {
+		select {
+		case code := <-exited:
+			c.Fatalf("command exited (%d) before request finished", code)
+		case <-time.After(100 * time.Millisecond):
+		}
+		hold <- true
+		select {
+		case r := <-got:
+			c.Check(r.err, check.IsNil)
+			c.Check(r.status, check.Equals, http.StatusOK)
+			c.Check(r.body, check.Equals, "ok")
+		case <-time.After(5 * time.Second):
+			c.Fatal("timed out waiting for response")
+		}
+	}
+	select {
+	case code := <-exited:
+		c.Check(code, check.Equals, 0)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for command to exit")
+	}
+	c.Check(stderr.String(), check.Matches, `(?ms).*received SIGTERM, draining.*`)
+	if timeout < time.Second {
+		c.Check(stderr.String(), check.Matches, `(?ms).*drain timeout reached with requests still in progress.*`)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/coreos/go-systemd/daemon"
+	"github.com/sirupsen/logrus"
+)
+
+// A Handler can also implement Drainer to shut down gracefully on
+// SIGTERM: instead of exiting right away, the service stops
+// accepting new connections, and waits up to DrainTimeout for
+// in-flight requests to finish before exiting.
+type Drainer interface {
+	// DrainTimeout returns the maximum time to wait for
+	// in-flight requests. If it is zero, SIGTERM is not handled,
+	// and the process exits right away.
+	DrainTimeout() time.Duration
+
+	// Drain is called when the service has stopped accepting
+	// new connections. It should report progress while
+	// in-flight requests finish, then save any state that
+	// should survive a restart. ctx is done when DrainTimeout
+	// has passed.
+	Drain(ctx context.Context)
+}
+
+// drainOnSignal waits for a signal on sigterm, then shuts down the
+// given servers gracefully and calls d.Drain. It returns when
+// draining is finished, or when stopped is closed without a signal
+// having been received.
+func drainOnSignal(d Drainer, srvs []*httpserver.Server, sigterm <-chan os.Signal, stopped <-chan struct{}, logger logrus.FieldLogger) {
+	select {
+	case <-stopped:
+		return
+	case <-sigterm:
+	}
+	timeout := d.DrainTimeout()
+	logger.WithField("Timeout", timeout.String()).Info("received SIGTERM, draining")
+	if _, err := daemon.SdNotify(false, daemon.SdNotifyStopping); err != nil {
+		logger.WithError(err).Errorf("error notifying init daemon")
+	}
+	t0 := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range srvs {
+		srv := srv
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.WithError(err).Warn("drain timeout reached with requests still in progress")
+			}
+		}()
+	}
+	d.Drain(ctx)
+	wg.Wait()
+	logger.WithField("Elapsed", time.Since(t0).String()).Info("drained")
+}
@@ -0,0 +1,142 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/sirupsen/logrus"
+)
+
+type contextKeyListener struct{}
+
+// listenerPolicy holds the per-listener settings that are applied to
+// requests accepted by one of a service's ExtraListeners.
+type listenerPolicy struct {
+	requestTimeout time.Duration
+	allowNetworks  []*net.IPNet
+}
+
+func newListenerPolicy(conf arvados.ServiceListener) (*listenerPolicy, error) {
+	pol := &listenerPolicy{requestTimeout: conf.RequestTimeout.Duration()}
+	for _, cidr := range conf.AllowNetworks {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AllowNetworks entry %q: %w", cidr, err)
+		}
+		pol.allowNetworks = append(pol.allowNetworks, ipnet)
+	}
+	return pol, nil
+}
+
+// allow returns true if the given client address (as in
+// http.Request.RemoteAddr) is permitted by the policy.
+func (pol *listenerPolicy) allow(remoteAddr string) bool {
+	if len(pol.allowNetworks) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range pol.allowNetworks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyListenerPolicy returns a handler that enforces the policy of
+// the listener that accepted each request. Requests accepted by the
+// main listener get defaultTimeout and no address restrictions.
+func applyListenerPolicy(defaultTimeout time.Duration, next http.Handler) http.Handler {
+	withDefault := httpserver.HandlerWithDeadline(defaultTimeout, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pol, ok := r.Context().Value(contextKeyListener{}).(*listenerPolicy)
+		if !ok {
+			withDefault.ServeHTTP(w, r)
+			return
+		}
+		if !pol.allow(r.RemoteAddr) {
+			httpserver.Error(w, "client address not allowed on this listener", http.StatusForbidden)
+			return
+		}
+		timeout := pol.requestTimeout
+		if timeout == 0 {
+			timeout = defaultTimeout
+		}
+		httpserver.HandlerWithDeadline(timeout, next).ServeHTTP(w, r)
+	})
+}
+
+// extraListenersFor returns the given service's ExtraListeners that
+// belong to the instance with the given InternalURL.
+func extraListenersFor(svc arvados.Service, internalURL arvados.URL) map[arvados.URL]arvados.ServiceListener {
+	listeners := map[arvados.URL]arvados.ServiceListener{}
+	for listenURL, conf := range svc.ExtraListeners {
+		if conf.InternalURL.String() == internalURL.String() {
+			listeners[listenURL] = conf
+		}
+	}
+	return listeners
+}
+
+// startExtraListeners starts an http server for each of the given
+// extra listeners, using the same handler as the main listener.
+func startExtraListeners(ctx context.Context, cluster *arvados.Cluster, listeners map[arvados.URL]arvados.ServiceListener, handler http.Handler, logger logrus.FieldLogger) ([]*httpserver.Server, error) {
+	var srvs []*httpserver.Server
+	fail := func(err error) ([]*httpserver.Server, error) {
+		for _, srv := range srvs {
+			srv.Close()
+		}
+		return nil, err
+	}
+	for listenURL, conf := range listeners {
+		pol, err := newListenerPolicy(conf)
+		if err != nil {
+			return fail(fmt.Errorf("ExtraListeners entry %s: %w", listenURL, err))
+		}
+		lctx := context.WithValue(ctx, contextKeyListener{}, pol)
+		srv := &httpserver.Server{
+			Server: http.Server{
+				Handler:     handler,
+				BaseContext: func(net.Listener) context.Context { return lctx },
+			},
+			Addr: listenAddr(listenURL),
+		}
+		if listenURL.Scheme == "https" || listenURL.Scheme == "wss" {
+			tlscluster := *cluster
+			if conf.TLSCertificate != "" || conf.TLSKey != "" {
+				tlscluster.TLS.Certificate = conf.TLSCertificate
+				tlscluster.TLS.Key = conf.TLSKey
+			}
+			srv.TLSConfig, err = makeTLSConfig(&tlscluster, logger)
+			if err != nil {
+				return fail(fmt.Errorf("ExtraListeners entry %s: %w", listenURL, err))
+			}
+		}
+		err = srv.Start()
+		if err != nil {
+			return fail(fmt.Errorf("ExtraListeners entry %s: %w", listenURL, err))
+		}
+		logger.WithFields(logrus.Fields{
+			"URL":    listenURL,
+			"Listen": srv.Addr,
+		}).Info("listening")
+		srvs = append(srvs, srv)
+	}
+	return srvs, nil
+}
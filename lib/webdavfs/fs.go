@@ -45,6 +45,12 @@ type FS struct {
 	// blocks. Avoid this by returning EOF on all reads when
 	// handling a PROPFIND.
 	AlwaysReadEOF bool
+	// If PartialReads is true, reads return the data that is
+	// already available (e.g., in the local disk cache) instead
+	// of waiting for the rest of a block that is still being
+	// fetched. This lets a client start receiving a large
+	// response sooner.
+	PartialReads bool
 }
 
 func (fs *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
@@ -58,6 +64,9 @@ func (fs *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
 func (fs *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (f webdav.File, err error) {
 	writing := flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0
 	f, err = fs.FileSystem.OpenFile(fs.Prefix+name, flag, perm)
+	if pr, ok := f.(partialReader); ok && fs.PartialReads {
+		f = readPartial{File: f, pr: pr}
+	}
 	if !fs.Writing {
 		// webdav module returns 404 on all OpenFile errors,
 		// but returns 405 Method Not Allowed if OpenFile()
@@ -122,6 +131,21 @@ func (readEOF) Read(p []byte) (int, error) {
 	return 0, io.EOF
 }
 
+// partialReader is implemented by arvados.File implementations that
+// support short reads of blocks that are still being fetched.
+type partialReader interface {
+	ReadPartial(p []byte) (int, error)
+}
+
+type readPartial struct {
+	webdav.File
+	pr partialReader
+}
+
+func (rp readPartial) Read(p []byte) (int, error) {
+	return rp.pr.ReadPartial(p)
+}
+
 // NoLockSystem implements webdav.LockSystem by returning success for
 // every possible locking operation, even though it has no side
 // effects such as actually locking anything. This works for a
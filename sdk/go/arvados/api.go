@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -242,6 +243,7 @@ type BlockReadOptions struct {
 	Locator      string
 	WriteTo      io.Writer
 	LocalLocator func(string)
+	SignatureTTL time.Duration // Expiry of LocalLocator signature, if not the server default.
 }
 
 type BlockWriteOptions struct {
@@ -253,6 +255,8 @@ type BlockWriteOptions struct {
 	StorageClasses []string
 	Replicas       int
 	Attempts       int
+	Unsigned       bool          // Return an unsigned locator (trusted callers only).
+	SignatureTTL   time.Duration // Expiry of returned signature, if not the server default.
 }
 
 type BlockWriteResponse struct {
@@ -59,6 +59,22 @@ type Client struct {
 	// Client field is nil: otherwise, it has no effect.
 	Insecure bool
 
+	// Path to a PEM file with CA certificates to trust in
+	// addition to the system's trusted CAs. Like Insecure, this
+	// works only if the Client field is nil.
+	CABundle string `json:",omitempty"`
+
+	// Outbound proxy URL, and comma-separated list of hosts to
+	// access directly (see TransportConfig). If Proxy is empty,
+	// the HTTPS_PROXY/NO_PROXY environment variables are used.
+	// Like Insecure, these work only if the Client field is nil.
+	Proxy   string `json:",omitempty"`
+	NoProxy string `json:",omitempty"`
+
+	// TLS settings for individual hosts. Like Insecure, this
+	// works only if the Client field is nil.
+	TLSHostOverrides map[string]TLSHostOverride `json:",omitempty"`
+
 	// Override keep service discovery with a list of base
 	// URIs. (Currently there are no Client methods for
 	// discovering keep services so this is just a convenience for
@@ -66,6 +82,20 @@ type Client struct {
 	// arvadosclient.ArvadosClient.)
 	KeepServiceURIs []string `json:",omitempty"`
 
+	// Discover keep services by looking up DNS SRV records for
+	// this name (e.g., "_keepproxy._tcp.example.com") instead of
+	// asking the API server. An "http://" or "https://" prefix
+	// specifies the scheme used to contact the services (default
+	// https). Ignored if KeepServiceURIs is set.
+	KeepServiceSRV string `json:",omitempty"`
+
+	// When the API server lists a keepproxy as the accessible
+	// keep service, connect directly to the cluster's keepstore
+	// servers instead: "always", "auto" (only if all of them are
+	// reachable from here), or "never" (default). Ignored if
+	// KeepServiceURIs or KeepServiceSRV is set.
+	KeepProxyBypass string `json:",omitempty"`
+
 	// HTTP headers to add/override in outgoing requests.
 	SendHeader http.Header
 
@@ -114,6 +144,7 @@ type Client struct {
 // Insecure==true and Client==nil.
 var InsecureHTTPClient = &http.Client{
 	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: true}}}
 
@@ -129,7 +160,16 @@ func NewClientFromConfig(cluster *Cluster) (*Client, error) {
 	if ctrlURL.Host == "" {
 		return nil, fmt.Errorf("no host in config Services.Controller.ExternalURL: %v", ctrlURL)
 	}
+	tc := cluster.TransportConfig()
 	var hc *http.Client
+	if !tc.IsDefault() {
+		// Check the config now, so problems like an
+		// unreadable CA bundle are reported at startup
+		// instead of on each request.
+		if _, err := tc.NewTransport(); err != nil {
+			return nil, err
+		}
+	}
 	if srvaddr := os.Getenv("ARVADOS_SERVER_ADDRESS"); srvaddr != "" {
 		// When this client is used to make a request to
 		// https://{ctrlhost}:port/ (any port), it dials the
@@ -148,29 +188,35 @@ func NewClientFromConfig(cluster *Cluster) (*Client, error) {
 		// on the connection source address.
 		divertedHost := (*url.URL)(&cluster.Services.Controller.ExternalURL).Hostname()
 		var dialer net.Dialer
-		hc = &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: cluster.TLS.Insecure},
-				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					host, port, err := net.SplitHostPort(addr)
-					if err == nil && network == "tcp" && host == divertedHost {
-						addr = net.JoinHostPort(srvaddr, port)
-					}
-					return dialer.DialContext(ctx, network, addr)
-				},
-			},
+		tr, err := tc.NewTransport()
+		if err != nil {
+			return nil, err
+		}
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err == nil && network == "tcp" && host == divertedHost {
+				addr = net.JoinHostPort(srvaddr, port)
+			}
+			return dialer.DialContext(ctx, network, addr)
 		}
+		hc = &http.Client{Transport: tr}
 	}
 	return &Client{
-		Client:          hc,
-		Scheme:          ctrlURL.Scheme,
-		APIHost:         ctrlURL.Host,
-		Insecure:        cluster.TLS.Insecure,
-		KeepServiceURIs: parseKeepServiceURIs(os.Getenv("ARVADOS_KEEP_SERVICES")),
-		Timeout:         5 * time.Minute,
-		DiskCacheSize:   cluster.Collections.WebDAVCache.DiskCacheSize,
-		requestLimiter:  &requestLimiter{maxlimit: int64(cluster.API.MaxConcurrentRequests / 4)},
-		Cluster:         cluster,
+		Client:           hc,
+		Scheme:           ctrlURL.Scheme,
+		APIHost:          ctrlURL.Host,
+		Insecure:         cluster.TLS.Insecure,
+		CABundle:         tc.CABundle,
+		Proxy:            tc.Proxy,
+		NoProxy:          tc.NoProxy,
+		TLSHostOverrides: tc.HostOverrides,
+		KeepServiceURIs:  parseKeepServiceURIs(os.Getenv("ARVADOS_KEEP_SERVICES")),
+		KeepServiceSRV:   os.Getenv("ARVADOS_KEEP_SERVICES_SRV"),
+		KeepProxyBypass:  os.Getenv("ARVADOS_KEEP_PROXY_BYPASS"),
+		Timeout:          5 * time.Minute,
+		DiskCacheSize:    cluster.Collections.WebDAVCache.DiskCacheSize,
+		requestLimiter:   &requestLimiter{maxlimit: int64(cluster.API.MaxConcurrentRequests / 4)},
+		Cluster:          cluster,
 	}, nil
 }
 
@@ -236,7 +282,10 @@ func NewClientFromEnv() *Client {
 		APIHost:         vars["ARVADOS_API_HOST"],
 		AuthToken:       vars["ARVADOS_API_TOKEN"],
 		Insecure:        insecure,
+		CABundle:        vars["ARVADOS_CA_BUNDLE"],
 		KeepServiceURIs: parseKeepServiceURIs(vars["ARVADOS_KEEP_SERVICES"]),
+		KeepServiceSRV:  vars["ARVADOS_KEEP_SERVICES_SRV"],
+		KeepProxyBypass: vars["ARVADOS_KEEP_PROXY_BYPASS"],
 		Timeout:         5 * time.Minute,
 		loadedFromEnv:   true,
 	}
@@ -445,13 +494,7 @@ func exponentialBackoff(min, max time.Duration, attemptNum int, resp *http.Respo
 	}
 	var t time.Duration
 	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
-		if s := resp.Header.Get("Retry-After"); s != "" {
-			if sleep, err := strconv.ParseInt(s, 10, 64); err == nil {
-				t = time.Second * time.Duration(sleep)
-			} else if stamp, err := time.Parse(time.RFC1123, s); err == nil {
-				t = stamp.Sub(time.Now())
-			}
-		}
+		t = retryAfter(resp)
 	}
 	if t == 0 {
 		jitter := mathrand.New(mathrand.NewSource(int64(time.Now().Nanosecond()))).Float64()
@@ -466,6 +509,20 @@ func exponentialBackoff(min, max time.Duration, attemptNum int, resp *http.Respo
 	}
 }
 
+// retryAfter returns the delay indicated by resp's Retry-After
+// header, or zero if there is no valid Retry-After header.
+func retryAfter(resp *http.Response) time.Duration {
+	s := resp.Header.Get("Retry-After")
+	if s == "" {
+		return 0
+	} else if sleep, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Second * time.Duration(sleep)
+	} else if stamp, err := time.Parse(time.RFC1123, s); err == nil {
+		return stamp.Sub(time.Now())
+	}
+	return 0
+}
+
 // DoAndDecode performs req and unmarshals the response (which must be
 // JSON) into dst. Use this instead of RequestAndDecode if you need
 // more control of the http.Request object.
@@ -665,6 +722,8 @@ func (c *Client) httpClient() *http.Client {
 	switch {
 	case c.Client != nil:
 		return c.Client
+	case !c.TransportConfig().IsDefault():
+		return c.TransportConfig().HTTPClient()
 	case c.Insecure:
 		return InsecureHTTPClient
 	default:
@@ -672,6 +731,18 @@ func (c *Client) httpClient() *http.Client {
 	}
 }
 
+// TransportConfig returns the proxy and TLS settings used by the
+// Client when its Client field is nil.
+func (c *Client) TransportConfig() TransportConfig {
+	return TransportConfig{
+		Insecure:      c.Insecure,
+		CABundle:      c.CABundle,
+		Proxy:         c.Proxy,
+		NoProxy:       c.NoProxy,
+		HostOverrides: c.TLSHostOverrides,
+	}
+}
+
 func (c *Client) apiURL(path string) string {
 	scheme := c.Scheme
 	if scheme == "" {
@@ -256,11 +256,14 @@ func (*clientSuite) TestLoadConfig(c *check.C) {
 	os.Setenv("ARVADOS_API_HOST", "[::]:3")
 	os.Setenv("ARVADOS_API_HOST_INSECURE", "0")
 	os.Setenv("ARVADOS_KEEP_SERVICES", "http://[::]:12345")
+	os.Setenv("ARVADOS_KEEP_SERVICES_SRV", "_keepproxy._tcp.example")
 	client = NewClientFromEnv()
 	c.Check(client.AuthToken, check.Equals, "token_from_settings_file2")
 	c.Check(client.APIHost, check.Equals, "[::]:3")
 	c.Check(client.Insecure, check.Equals, false)
 	c.Check(client.KeepServiceURIs, check.DeepEquals, []string{"http://[::]:12345"})
+	c.Check(client.KeepServiceSRV, check.Equals, "_keepproxy._tcp.example")
+	os.Unsetenv("ARVADOS_KEEP_SERVICES_SRV")
 
 	// ARVADOS_KEEP_SERVICES environment variable overrides
 	// cluster config, but ARVADOS_API_HOST/TOKEN do not.
@@ -0,0 +1,97 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const emptyCollectionPDH = "d41d8cd98f00b204e9800998ecf8427e+0"
+
+// MoveCollectionPath moves a file or directory from one collection to
+// another (or to a different path in the same collection), using the
+// API server's replace_files feature: the manifests are spliced on
+// the server side, so no file data is downloaded or uploaded.
+//
+// Paths are relative to the collection root, e.g., "dir/file.txt".
+// Parent directories of dstPath are created as needed. If dstPath
+// already exists, it is replaced.
+//
+// Within a single collection, the move is done in one update.
+// Otherwise, the file is first added to the destination collection,
+// then removed from the source collection. If removing it from the
+// source fails, the destination collection is restored to its
+// previous content, so the file does not end up in both collections.
+// Changes made to the destination collection by other clients while
+// the move is in progress would be undone along with it.
+func (c *Client) MoveCollectionPath(ctx context.Context, srcUUID, srcPath, dstUUID, dstPath string) error {
+	srcPath, dstPath = path.Clean("/"+srcPath), path.Clean("/"+dstPath)
+	if srcUUID == dstUUID {
+		if srcPath == dstPath {
+			return nil
+		} else if srcPath == "/" || strings.HasPrefix(dstPath, srcPath+"/") {
+			return fmt.Errorf("cannot move %q into itself (%q)", srcPath, dstPath)
+		}
+		return c.replaceFiles(ctx, srcUUID, map[string]string{
+			dstPath: "current" + srcPath,
+			srcPath: "",
+		})
+	}
+
+	src, err := c.getCollectionPDH(ctx, srcUUID)
+	if err != nil {
+		return err
+	}
+	dst, err := c.getCollectionPDH(ctx, dstUUID)
+	if err != nil {
+		return err
+	}
+	dstOrig := dst.PortableDataHash
+	if dstOrig == emptyCollectionPDH {
+		dstOrig = ""
+	}
+
+	mg := c.NewMutationGroup(ctx)
+	defer mg.Rollback()
+	err = mg.Do(func(ctx context.Context) error {
+		return c.replaceFiles(ctx, dstUUID, map[string]string{dstPath: src.PortableDataHash + srcPath})
+	}, func(ctx context.Context) error {
+		return c.replaceFiles(ctx, dstUUID, map[string]string{"/": dstOrig})
+	})
+	if err != nil {
+		return fmt.Errorf("error adding %q to collection %s: %w", dstPath, dstUUID, err)
+	}
+	err = mg.Do(func(ctx context.Context) error {
+		return c.replaceFiles(ctx, srcUUID, map[string]string{srcPath: ""})
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error removing %q from collection %s: %w", srcPath, srcUUID, err)
+	}
+	mg.Commit()
+	return nil
+}
+
+func (c *Client) getCollectionPDH(ctx context.Context, uuid string) (Collection, error) {
+	var coll Collection
+	err := c.RequestAndDecodeContext(ctx, &coll, "GET", "arvados/v1/collections/"+uuid, nil, map[string]interface{}{
+		"select": []string{"uuid", "portable_data_hash"},
+	})
+	if err != nil {
+		return coll, fmt.Errorf("error getting collection %s: %w", uuid, err)
+	}
+	return coll, nil
+}
+
+// replaceFiles updates a collection using the given replace_files
+// map (see UpdateOptions).
+func (c *Client) replaceFiles(ctx context.Context, uuid string, replace map[string]string) error {
+	return c.RequestAndDecodeContext(ctx, nil, "PATCH", "arvados/v1/collections/"+uuid, nil, map[string]interface{}{
+		"collection":    map[string]interface{}{},
+		"replace_files": replace,
+	})
+}
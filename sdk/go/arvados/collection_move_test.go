@@ -0,0 +1,125 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&collectionMoveSuite{})
+
+type collectionMoveSuite struct {
+	mtx sync.Mutex
+	// PDH of each collection
+	pdh map[string]string
+	// replace_files params of PATCH requests, as
+	// "uuid {json}"
+	updates []string
+	// Fail PATCH requests for this collection
+	failUUID string
+	server   *httptest.Server
+	client   *Client
+}
+
+func (s *collectionMoveSuite) SetUpTest(c *check.C) {
+	s.pdh = map[string]string{
+		"zzzzz-4zz18-srcsrcsrcsrcsrc": "fa7aeb5140e2848d39b416daeef4ffc5+45",
+		"zzzzz-4zz18-dstdstdstdstdst": emptyCollectionPDH,
+	}
+	s.updates = nil
+	s.failUUID = ""
+	s.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		uuid := strings.TrimPrefix(r.URL.Path, "/arvados/v1/collections/")
+		pdh, ok := s.pdh[uuid]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":["not found"]}`))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(Collection{UUID: uuid, PortableDataHash: pdh})
+		case http.MethodPatch:
+			r.ParseForm()
+			s.updates = append(s.updates, uuid+" "+r.Form.Get("replace_files"))
+			if uuid == s.failUUID {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"errors":["rejected"]}`))
+				return
+			}
+			w.Write([]byte(`{"uuid":"` + uuid + `"}`))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	s.client = &Client{
+		APIHost:   strings.TrimPrefix(s.server.URL, "https://"),
+		AuthToken: "zzz",
+		Insecure:  true,
+		Timeout:   2 * time.Second,
+	}
+}
+
+func (s *collectionMoveSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func (s *collectionMoveSuite) TestMove(c *check.C) {
+	err := s.client.MoveCollectionPath(context.Background(), "zzzzz-4zz18-srcsrcsrcsrcsrc", "dir/foo.txt", "zzzzz-4zz18-dstdstdstdstdst", "/newdir/bar.txt")
+	c.Check(err, check.IsNil)
+	c.Check(s.updates, check.DeepEquals, []string{
+		`zzzzz-4zz18-dstdstdstdstdst {"/newdir/bar.txt":"fa7aeb5140e2848d39b416daeef4ffc5+45/dir/foo.txt"}`,
+		`zzzzz-4zz18-srcsrcsrcsrcsrc {"/dir/foo.txt":""}`,
+	})
+}
+
+func (s *collectionMoveSuite) TestMoveWithinCollection(c *check.C) {
+	err := s.client.MoveCollectionPath(context.Background(), "zzzzz-4zz18-srcsrcsrcsrcsrc", "dir", "zzzzz-4zz18-srcsrcsrcsrcsrc", "otherdir/dir")
+	c.Check(err, check.IsNil)
+	c.Check(s.updates, check.DeepEquals, []string{
+		`zzzzz-4zz18-srcsrcsrcsrcsrc {"/dir":"","/otherdir/dir":"current/dir"}`,
+	})
+
+	s.updates = nil
+	err = s.client.MoveCollectionPath(context.Background(), "zzzzz-4zz18-srcsrcsrcsrcsrc", "dir", "zzzzz-4zz18-srcsrcsrcsrcsrc", "dir/subdir")
+	c.Check(err, check.ErrorMatches, `cannot move "/dir" into itself .*`)
+	err = s.client.MoveCollectionPath(context.Background(), "zzzzz-4zz18-srcsrcsrcsrcsrc", "dir/", "zzzzz-4zz18-srcsrcsrcsrcsrc", "/dir")
+	c.Check(err, check.IsNil)
+	c.Check(s.updates, check.HasLen, 0)
+}
+
+// If the file cannot be removed from the source collection, the
+// destination collection is restored.
+func (s *collectionMoveSuite) TestRollback(c *check.C) {
+	s.pdh["zzzzz-4zz18-dstdstdstdstdst"] = "acbd18db4cc2f85cedef654fccc4a4d8+3"
+	s.failUUID = "zzzzz-4zz18-srcsrcsrcsrcsrc"
+	err := s.client.MoveCollectionPath(context.Background(), "zzzzz-4zz18-srcsrcsrcsrcsrc", "foo.txt", "zzzzz-4zz18-dstdstdstdstdst", "foo.txt")
+	c.Check(err, check.ErrorMatches, `error removing "/foo.txt" from collection zzzzz-4zz18-srcsrcsrcsrcsrc: .*rejected.*`)
+	c.Check(s.updates, check.DeepEquals, []string{
+		`zzzzz-4zz18-dstdstdstdstdst {"/foo.txt":"fa7aeb5140e2848d39b416daeef4ffc5+45/foo.txt"}`,
+		`zzzzz-4zz18-srcsrcsrcsrcsrc {"/foo.txt":""}`,
+		`zzzzz-4zz18-dstdstdstdstdst {"/":"acbd18db4cc2f85cedef654fccc4a4d8+3"}`,
+	})
+
+	// Nothing to undo if the first update fails.
+	s.updates = nil
+	s.failUUID = "zzzzz-4zz18-dstdstdstdstdst"
+	err = s.client.MoveCollectionPath(context.Background(), "zzzzz-4zz18-srcsrcsrcsrcsrc", "foo.txt", "zzzzz-4zz18-dstdstdstdstdst", "foo.txt")
+	c.Check(err, check.ErrorMatches, `error adding "/foo.txt" to collection zzzzz-4zz18-dstdstdstdstdst: .*rejected.*`)
+	c.Check(s.updates, check.HasLen, 1)
+
+	err = s.client.MoveCollectionPath(context.Background(), "zzzzz-4zz18-nonexistentxxxx", "foo.txt", "zzzzz-4zz18-dstdstdstdstdst", "foo.txt")
+	c.Check(err, check.ErrorMatches, `error getting collection zzzzz-4zz18-nonexistentxxxx: .*`)
+}
@@ -0,0 +1,173 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"fmt"
+)
+
+// CollectionVersionChangedError is returned by RollbackCollection
+// when the collection's current version is not the one the caller
+// expected, i.e., someone else updated it in the meantime.
+type CollectionVersionChangedError struct {
+	UUID            string
+	ExpectedVersion int
+	CurrentVersion  int
+}
+
+func (e CollectionVersionChangedError) Error() string {
+	return fmt.Sprintf("collection %s: current version is %d, expected %d", e.UUID, e.CurrentVersion, e.ExpectedVersion)
+}
+
+// Fields returned by CollectionVersions. The manifest is omitted to
+// keep responses small; use CollectionVersion to get it.
+var collectionVersionSelect = []string{
+	"uuid", "current_version_uuid", "version", "portable_data_hash",
+	"name", "description", "properties", "preserve_version",
+	"modified_at", "modified_by_user_uuid", "file_count", "file_size_total",
+}
+
+// currentVersionUUID returns the UUID of the current version of the
+// collection with the given UUID, which may be the UUID of the
+// current version or of any past version.
+func (c *Client) currentVersionUUID(ctx context.Context, uuid string) (string, error) {
+	var coll Collection
+	err := c.RequestAndDecodeContext(ctx, &coll, "GET", "arvados/v1/collections/"+uuid, nil, ResourceListParams{
+		Select: []string{"uuid", "current_version_uuid"},
+	})
+	if err != nil {
+		return "", err
+	}
+	if coll.CurrentVersionUUID == "" {
+		return coll.UUID, nil
+	}
+	return coll.CurrentVersionUUID, nil
+}
+
+// CollectionVersions returns all versions of a collection, oldest
+// first. The given UUID can be the UUID of the current version or of
+// any past version. The returned records do not include manifest
+// text.
+func (c *Client) CollectionVersions(ctx context.Context, uuid string) ([]Collection, error) {
+	cvuuid, err := c.currentVersionUUID(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	params := ResourceListParams{
+		Select:             collectionVersionSelect,
+		Filters:            []Filter{{"current_version_uuid", "=", cvuuid}},
+		IncludeOldVersions: true,
+		Order:              "version asc",
+	}
+	var versions []Collection
+	for {
+		var page CollectionList
+		err := c.RequestAndDecodeContext(ctx, &page, "GET", "arvados/v1/collections", nil, params)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, page.Items...)
+		params.Offset += len(page.Items)
+		if len(page.Items) == 0 || params.Offset >= page.ItemsAvailable {
+			return versions, nil
+		}
+	}
+}
+
+// CollectionVersion returns the given version of a collection,
+// including its manifest text. The given UUID can be the UUID of the
+// current version or of any past version.
+func (c *Client) CollectionVersion(ctx context.Context, uuid string, version int) (Collection, error) {
+	cvuuid, err := c.currentVersionUUID(ctx, uuid)
+	if err != nil {
+		return Collection{}, err
+	}
+	var page CollectionList
+	err = c.RequestAndDecodeContext(ctx, &page, "GET", "arvados/v1/collections", nil, ResourceListParams{
+		Filters: []Filter{
+			{"current_version_uuid", "=", cvuuid},
+			{"version", "=", version},
+		},
+		IncludeOldVersions: true,
+	})
+	if err != nil {
+		return Collection{}, err
+	}
+	if len(page.Items) == 0 {
+		return Collection{}, fmt.Errorf("collection %s has no version %d", cvuuid, version)
+	}
+	return page.Items[0], nil
+}
+
+// PinnedFileSystem returns a CollectionFileSystem with the content
+// of this collection record (e.g., a past version returned by
+// CollectionVersion, or a collection retrieved by portable data
+// hash). The filesystem is not tied to the collection's UUID: reads
+// are not affected by later updates to the collection, and Sync
+// does not write changes back to it.
+func (coll Collection) PinnedFileSystem(client apiClient, kc keepClient) (CollectionFileSystem, error) {
+	pinned := Collection{
+		PortableDataHash:   coll.PortableDataHash,
+		ManifestText:       coll.ManifestText,
+		ModifiedAt:         coll.ModifiedAt,
+		ReplicationDesired: coll.ReplicationDesired,
+	}
+	return pinned.FileSystem(client, kc)
+}
+
+// RollbackCollection replaces the content (manifest) of a
+// collection with the content of the given past version, and
+// returns the updated collection.
+//
+// If expectVersion is non-zero and the collection's current version
+// is different, RollbackCollection returns a
+// CollectionVersionChangedError without changing anything.
+//
+// The current content is preserved as a past version before it is
+// replaced, so the rollback itself can be undone. The content is
+// replaced in a single update, so readers see either the old or the
+// new content, never a mix.
+func (c *Client) RollbackCollection(ctx context.Context, uuid string, version int, expectVersion int) (Collection, error) {
+	target, err := c.CollectionVersion(ctx, uuid, version)
+	if err != nil {
+		return Collection{}, err
+	}
+	cvuuid := target.CurrentVersionUUID
+	if cvuuid == "" {
+		cvuuid = target.UUID
+	}
+	var current Collection
+	err = c.RequestAndDecodeContext(ctx, &current, "GET", "arvados/v1/collections/"+cvuuid, nil, ResourceListParams{
+		Select: []string{"uuid", "version", "portable_data_hash", "preserve_version"},
+	})
+	if err != nil {
+		return Collection{}, err
+	}
+	if expectVersion != 0 && current.Version != expectVersion {
+		return Collection{}, CollectionVersionChangedError{UUID: cvuuid, ExpectedVersion: expectVersion, CurrentVersion: current.Version}
+	}
+	if current.PortableDataHash == target.PortableDataHash {
+		// Already has the desired content.
+		return current, nil
+	}
+	if !current.PreserveVersion {
+		err = c.RequestAndDecodeContext(ctx, &current, "PATCH", "arvados/v1/collections/"+cvuuid, nil, map[string]interface{}{
+			"collection": map[string]interface{}{
+				"preserve_version": true,
+			},
+		})
+		if err != nil {
+			return Collection{}, fmt.Errorf("error preserving current version: %w", err)
+		}
+	}
+	var updated Collection
+	err = c.RequestAndDecodeContext(ctx, &updated, "PATCH", "arvados/v1/collections/"+cvuuid, nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"manifest_text": target.ManifestText,
+		},
+	})
+	return updated, err
+}
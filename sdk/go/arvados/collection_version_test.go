@@ -0,0 +1,141 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&collectionVersionSuite{})
+
+type collectionVersionSuite struct{}
+
+// fakeVersionedCollections is a minimal stand-in for the collections
+// API, just enough to exercise the version helpers.
+type fakeVersionedCollections struct {
+	sync.Mutex
+	c        *check.C
+	versions []Collection // versions[i].Version == i+1; last is current
+	updates  []map[string]interface{}
+}
+
+func (f *fakeVersionedCollections) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	r.ParseForm()
+	current := &f.versions[len(f.versions)-1]
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/arvados/v1/collections":
+		var filters []Filter
+		json.Unmarshal([]byte(r.FormValue("filters")), &filters)
+		var items []Collection
+		for _, v := range f.versions {
+			match := true
+			for _, flt := range filters {
+				if flt.Attr == "version" && flt.Operand.(float64) != float64(v.Version) {
+					match = false
+				}
+			}
+			if match {
+				items = append(items, v)
+			}
+		}
+		json.NewEncoder(w).Encode(CollectionList{Items: items, ItemsAvailable: len(items)})
+	case strings.HasPrefix(r.URL.Path, "/arvados/v1/collections/"):
+		uuid := strings.TrimPrefix(r.URL.Path, "/arvados/v1/collections/")
+		if r.Method == "PATCH" {
+			f.c.Check(uuid, check.Equals, current.UUID)
+			var attrs map[string]interface{}
+			json.Unmarshal([]byte(r.FormValue("collection")), &attrs)
+			f.updates = append(f.updates, attrs)
+			if pv, ok := attrs["preserve_version"].(bool); ok {
+				current.PreserveVersion = pv
+			}
+			if mt, ok := attrs["manifest_text"].(string); ok {
+				next := *current
+				next.ManifestText = mt
+				next.PortableDataHash = PortableDataHash(mt)
+				next.Version++
+				next.PreserveVersion = false
+				current.UUID = fmt.Sprintf("zzzzz-4zz18-%015d", current.Version)
+				f.versions = append(f.versions, next)
+				current = &f.versions[len(f.versions)-1]
+			}
+			json.NewEncoder(w).Encode(current)
+			return
+		}
+		for _, v := range f.versions {
+			if v.UUID == uuid {
+				json.NewEncoder(w).Encode(v)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *collectionVersionSuite) TestVersionsAndRollback(c *check.C) {
+	cvuuid := "zzzzz-4zz18-aaaaaaaaaaaaaaa"
+	mt1 := ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo.txt\n"
+	mt2 := ". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar.txt\n"
+	fake := &fakeVersionedCollections{c: c, versions: []Collection{
+		{UUID: "zzzzz-4zz18-bbbbbbbbbbbbbbb", CurrentVersionUUID: cvuuid, Version: 1, ManifestText: mt1, PortableDataHash: PortableDataHash(mt1)},
+		{UUID: cvuuid, CurrentVersionUUID: cvuuid, Version: 2, ManifestText: mt2, PortableDataHash: PortableDataHash(mt2)},
+	}}
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+	client := &Client{
+		APIHost:   strings.TrimPrefix(server.URL, "https://"),
+		AuthToken: "zzz",
+		Insecure:  true,
+		Timeout:   2 * time.Second,
+	}
+	ctx := context.Background()
+
+	versions, err := client.CollectionVersions(ctx, "zzzzz-4zz18-bbbbbbbbbbbbbbb")
+	c.Assert(err, check.IsNil)
+	c.Assert(versions, check.HasLen, 2)
+	c.Check(versions[0].Version, check.Equals, 1)
+	c.Check(versions[1].Version, check.Equals, 2)
+
+	v1, err := client.CollectionVersion(ctx, cvuuid, 1)
+	c.Assert(err, check.IsNil)
+	c.Check(v1.ManifestText, check.Equals, mt1)
+	_, err = client.CollectionVersion(ctx, cvuuid, 9)
+	c.Check(err, check.ErrorMatches, `collection zzzzz-4zz18-aaaaaaaaaaaaaaa has no version 9`)
+
+	fs, err := v1.PinnedFileSystem(client, nil)
+	c.Assert(err, check.IsNil)
+	_, err = fs.Stat("foo.txt")
+	c.Check(err, check.IsNil)
+
+	_, err = client.RollbackCollection(ctx, cvuuid, 1, 7)
+	c.Check(err, check.FitsTypeOf, CollectionVersionChangedError{})
+	c.Check(fake.updates, check.HasLen, 0)
+
+	updated, err := client.RollbackCollection(ctx, cvuuid, 1, 2)
+	c.Assert(err, check.IsNil)
+	c.Check(updated.Version, check.Equals, 3)
+	c.Check(updated.PortableDataHash, check.Equals, PortableDataHash(mt1))
+	c.Assert(fake.updates, check.HasLen, 2)
+	c.Check(fake.updates[0], check.DeepEquals, map[string]interface{}{"preserve_version": true})
+	c.Check(fake.updates[1], check.DeepEquals, map[string]interface{}{"manifest_text": mt1})
+
+	// Rolling back to content that is already current is a no-op.
+	_, err = client.RollbackCollection(ctx, cvuuid, 1, 0)
+	c.Check(err, check.IsNil)
+	c.Check(fake.updates, check.HasLen, 2)
+}
@@ -125,20 +125,29 @@ type Cluster struct {
 		UnloggedAttributes StringSet
 	}
 	Collections struct {
+		BlobAccessTimeFile           string
+		BlobAccessTimeResolution     Duration
+		BlobProvenanceFile           string
 		BlobSigning                  bool
 		BlobSigningKey               string
+		PreviousBlobSigningKeys      []string
 		BlobSigningTTL               Duration
 		BlobTrash                    bool
 		BlobTrashLifetime            Duration
 		BlobTrashCheckInterval       Duration
 		BlobTrashConcurrency         int
 		BlobDeleteConcurrency        int
+		BlobDeleteVerifyReplication  bool
 		BlobReplicateConcurrency     int
+		BlobStreamingWrites          bool
+		KeepstoreDrainTimeout        Duration
 		CollectionVersioning         bool
 		DefaultTrashLifetime         Duration
 		DefaultReplication           int
 		ManagedProperties            ManagedProperties
 		PreserveVersionIfIdle        Duration
+		SmallBlockExtraReplicas      int
+		SmallBlockSize               ByteSize
 		TrashSweepInterval           Duration
 		TrustAllContent              bool
 		ForwardSlashNameSubstitution string
@@ -156,6 +165,7 @@ type Cluster struct {
 		WebDAVCache WebDAVCacheConfig
 
 		KeepproxyPermission       UploadDownloadRolePermissions
+		KeepproxyCompression      []string
 		WebDAVPermission          UploadDownloadRolePermissions
 		WebDAVLogEvents           bool
 		WebDAVLogDownloadInterval Duration
@@ -220,13 +230,19 @@ type Cluster struct {
 		RequestQueueDumpDirectory string
 	}
 	TLS struct {
-		Certificate string
-		Key         string
-		Insecure    bool
-		ACME        struct {
+		Certificate   string
+		Key           string
+		Insecure      bool
+		CABundle      string
+		HostOverrides map[string]TLSHostOverride
+		ACME          struct {
 			Server string
 		}
 	}
+	OutboundProxy struct {
+		URL     string
+		NoProxy string
+	}
 	Users struct {
 		ActivatedUsersAreVisibleToOthers      bool
 		AnonymousUserToken                    string
@@ -316,6 +332,7 @@ type S3VolumeDriverParameters struct {
 	UnsafeDelete       bool
 	PrefixLength       int
         UsePathStyle       bool
+	TrashUsingTags     bool
 }
 
 type AzureVolumeDriverParameters struct {
@@ -333,6 +350,11 @@ type DirectoryVolumeDriverParameters struct {
 	Serialize bool
 }
 
+type MirrorVolumeDriverParameters struct {
+	Driver           string
+	DriverParameters json.RawMessage
+}
+
 type VolumeAccess struct {
 	ReadOnly bool
 }
@@ -357,8 +379,9 @@ type Services struct {
 }
 
 type Service struct {
-	InternalURLs map[URL]ServiceInstance
-	ExternalURL  URL
+	InternalURLs   map[URL]ServiceInstance
+	ExternalURL    URL
+	ExtraListeners map[URL]ServiceListener `json:",omitempty"`
 }
 
 type TestUser struct {
@@ -441,6 +464,24 @@ type ServiceInstance struct {
 	Rendezvous string `json:",omitempty"`
 }
 
+// ServiceListener configures an additional address where a service
+// instance accepts requests, besides its ListenURL/InternalURL.
+type ServiceListener struct {
+	// InternalURL of the service instance (one of the service's
+	// InternalURLs) that accepts requests at this address.
+	InternalURL URL
+	// TLS certificate and key files to use if the listener URL
+	// scheme is https. Default is the cluster-wide TLS config.
+	TLSCertificate string
+	TLSKey         string
+	// Request timeout for this listener. Default is
+	// API.RequestTimeout.
+	RequestTimeout Duration
+	// Client networks (CIDR) allowed to connect. Default is to
+	// allow all.
+	AllowNetworks []string
+}
+
 type PostgreSQL struct {
 	Connection     PostgreSQLConnection
 	ConnectionPool int
@@ -529,6 +570,7 @@ type CloudVMsConfig struct {
 	MaxProbesPerSecond             int
 	MaxConcurrentInstanceCreateOps int
 	MaxInstances                   int
+	MaxHibernatedInstances         int
 	InitialQuotaEstimate           int
 	SupervisorFraction             float64
 	PollInterval                   Duration
@@ -544,6 +586,11 @@ type CloudVMsConfig struct {
 	TimeoutTERM                    Duration
 	ResourceTags                   map[string]string
 	TagKeyPrefix                   string
+	BillingExport                  struct {
+		Path     string
+		Format   string
+		Interval Duration
+	}
 
 	Driver           string
 	DriverParameters json.RawMessage
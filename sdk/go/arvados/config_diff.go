@@ -0,0 +1,159 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigChange describes one difference between two cluster
+// configurations.
+type ConfigChange struct {
+	// Dotted path of the changed entry, e.g.,
+	// "Collections.BlobSigningTTL".
+	Path string
+
+	// Old and new values. Old is nil if the entry was added; New
+	// is nil if the entry was removed.
+	Old interface{} `json:",omitempty"`
+	New interface{} `json:",omitempty"`
+
+	// If non-empty, an explanation of the effect of the change
+	// beyond the change in value (e.g., "keepstore volume moved
+	// to a different server").
+	Note string `json:",omitempty"`
+
+	// True if the change results from deprecated config keys or
+	// legacy config files (see lib/config.Loader.Migrate).
+	Deprecated bool `json:",omitempty"`
+}
+
+func (chg ConfigChange) String() string {
+	s := fmt.Sprintf("%s: %v => %v", chg.Path, chg.Old, chg.New)
+	if chg.Note != "" {
+		s += " (" + chg.Note + ")"
+	}
+	return s
+}
+
+// DiffClusters returns the differences between two cluster
+// configurations, sorted by path.
+//
+// Changes to a volume's AccessViaHosts are reported as a single
+// change listing the old and new hosts.
+func DiffClusters(older, newer *Cluster) ([]ConfigChange, error) {
+	oldvals, err := flattenConfig(older)
+	if err != nil {
+		return nil, err
+	}
+	newvals, err := flattenConfig(newer)
+	if err != nil {
+		return nil, err
+	}
+	var changes []ConfigChange
+	for path, oldval := range oldvals {
+		if newval, ok := newvals[path]; !ok {
+			changes = append(changes, ConfigChange{Path: path, Old: oldval})
+		} else if !reflect.DeepEqual(oldval, newval) {
+			changes = append(changes, ConfigChange{Path: path, Old: oldval, New: newval})
+		}
+	}
+	for path, newval := range newvals {
+		if _, ok := oldvals[path]; !ok {
+			changes = append(changes, ConfigChange{Path: path, New: newval})
+		}
+	}
+	changes = annotateVolumeMoves(changes, older, newer)
+	for i, chg := range changes {
+		if chg.Path == "Collections.BlobSigningKey" && chg.Old != nil && chg.Old != "" {
+			changes[i].Note = "existing signatures will be rejected unless the old key is added to Collections.PreviousBlobSigningKeys"
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// annotateVolumeMoves replaces the individual changes within each
+// volume's AccessViaHosts with a single change that summarizes
+// which hosts the volume was moved from/to.
+func annotateVolumeMoves(changes []ConfigChange, older, newer *Cluster) []ConfigChange {
+	moved := map[string]bool{}
+	var kept []ConfigChange
+	for _, chg := range changes {
+		path := strings.SplitN(chg.Path, ".", 4)
+		if len(path) >= 3 && path[0] == "Volumes" && path[2] == "AccessViaHosts" {
+			if _, ok := older.Volumes[path[1]]; ok {
+				if _, ok := newer.Volumes[path[1]]; ok {
+					moved[path[1]] = true
+					continue
+				}
+			}
+		}
+		kept = append(kept, chg)
+	}
+	for uuid := range moved {
+		oldhosts := volumeHosts(older.Volumes[uuid])
+		newhosts := volumeHosts(newer.Volumes[uuid])
+		note := "keepstore volume access changed"
+		if !reflect.DeepEqual(oldhosts, newhosts) {
+			note = fmt.Sprintf("keepstore volume moved from %s to %s", describeHosts(oldhosts), describeHosts(newhosts))
+		}
+		kept = append(kept, ConfigChange{
+			Path: "Volumes." + uuid + ".AccessViaHosts",
+			Old:  oldhosts,
+			New:  newhosts,
+			Note: note,
+		})
+	}
+	return kept
+}
+
+func volumeHosts(vol Volume) []string {
+	var hosts []string
+	for url := range vol.AccessViaHosts {
+		hosts = append(hosts, url.String())
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func describeHosts(hosts []string) string {
+	if len(hosts) == 0 {
+		return "all keepstore servers"
+	}
+	return strings.Join(hosts, ", ")
+}
+
+// flattenConfig returns a map of dotted paths to leaf values
+// (strings, numbers, bools, and arrays) of the JSON encoding of the
+// given cluster config.
+func flattenConfig(cluster *Cluster) (map[string]interface{}, error) {
+	buf, err := json.Marshal(cluster)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	err = json.Unmarshal(buf, &tree)
+	if err != nil {
+		return nil, err
+	}
+	flat := map[string]interface{}{}
+	var flatten func(prefix string, v interface{})
+	flatten = func(prefix string, v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok {
+			for k, v := range m {
+				flatten(prefix+"."+k, v)
+			}
+			return
+		}
+		flat[strings.TrimPrefix(prefix, ".")] = v
+	}
+	flatten("", tree)
+	return flat, nil
+}
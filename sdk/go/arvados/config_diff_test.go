@@ -0,0 +1,62 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ConfigDiffSuite{})
+
+type ConfigDiffSuite struct{}
+
+func (*ConfigDiffSuite) TestNoChanges(c *check.C) {
+	cluster := &Cluster{ClusterID: "zzzzz"}
+	changes, err := DiffClusters(cluster, cluster)
+	c.Check(err, check.IsNil)
+	c.Check(changes, check.HasLen, 0)
+}
+
+func (*ConfigDiffSuite) TestChanges(c *check.C) {
+	host1 := URL{Scheme: "http", Host: "keep1.example:25107", Path: "/"}
+	host2 := URL{Scheme: "http", Host: "keep2.example:25107", Path: "/"}
+	older := &Cluster{ClusterID: "zzzzz"}
+	older.Collections.BlobSigningKey = "oldkey"
+	older.Collections.BlobSigningTTL = Duration(time.Hour)
+	older.Volumes = map[string]Volume{
+		"zzzzz-nyw5e-000000000000000": {Driver: "Directory", AccessViaHosts: map[URL]VolumeAccess{host1: {}}},
+		"zzzzz-nyw5e-111111111111111": {Driver: "Directory"},
+	}
+	newer := &Cluster{ClusterID: "zzzzz"}
+	newer.Collections.BlobSigningKey = "newkey"
+	newer.Collections.BlobSigningTTL = Duration(2 * time.Hour)
+	newer.Volumes = map[string]Volume{
+		"zzzzz-nyw5e-000000000000000": {Driver: "Directory", AccessViaHosts: map[URL]VolumeAccess{host2: {}}},
+		"zzzzz-nyw5e-222222222222222": {Driver: "Directory"},
+	}
+
+	changes, err := DiffClusters(older, newer)
+	c.Assert(err, check.IsNil)
+	byPath := map[string]ConfigChange{}
+	for _, chg := range changes {
+		c.Logf("%s", chg)
+		byPath[chg.Path] = chg
+	}
+	c.Check(byPath["Collections.BlobSigningKey"].Note, check.Matches, `.*PreviousBlobSigningKeys.*`)
+	c.Check(byPath["Collections.BlobSigningTTL"].Old, check.Equals, "1h")
+	c.Check(byPath["Collections.BlobSigningTTL"].New, check.Equals, "2h")
+	mv := byPath["Volumes.zzzzz-nyw5e-000000000000000.AccessViaHosts"]
+	c.Check(mv.Old, check.DeepEquals, []string{"http://keep1.example:25107/"})
+	c.Check(mv.New, check.DeepEquals, []string{"http://keep2.example:25107/"})
+	c.Check(mv.Note, check.Equals, "keepstore volume moved from http://keep1.example:25107/ to http://keep2.example:25107/")
+	c.Check(byPath["Volumes.zzzzz-nyw5e-111111111111111.Driver"].Old, check.Equals, "Directory")
+	c.Check(byPath["Volumes.zzzzz-nyw5e-111111111111111.Driver"].New, check.IsNil)
+	c.Check(byPath["Volumes.zzzzz-nyw5e-222222222222222.Driver"].New, check.Equals, "Directory")
+	for path := range byPath {
+		c.Check(path, check.Not(check.Matches), `Volumes\.zzzzz-nyw5e-000000000000000\.AccessViaHosts\..*`)
+	}
+}
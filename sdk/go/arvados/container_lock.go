@@ -0,0 +1,179 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ContainerLockConflictError is returned by LockContainer when the
+// container cannot be locked because it is not in the Queued state,
+// e.g., another dispatcher locked it first.
+type ContainerLockConflictError struct {
+	UUID         string
+	State        ContainerState
+	LockedByUUID string
+	Err          error
+}
+
+func (e ContainerLockConflictError) Error() string {
+	if e.LockedByUUID != "" {
+		return fmt.Sprintf("cannot lock container %s: state is %s, locked by %s", e.UUID, e.State, e.LockedByUUID)
+	}
+	return fmt.Sprintf("cannot lock container %s: state is %s", e.UUID, e.State)
+}
+
+func (e ContainerLockConflictError) Unwrap() error {
+	return e.Err
+}
+
+// ErrContainerLeaseLost is returned by ContainerLease methods when
+// the container is no longer locked by the lease holder, e.g.,
+// because it was unlocked by an administrator, or it finished.
+var ErrContainerLeaseLost = errors.New("container lock is no longer held")
+
+// Fields needed to check the lock status of a container.
+var containerLockSelect = []string{"uuid", "state", "locked_by_uuid", "priority"}
+
+// LockContainer locks a Queued container so the caller can run it.
+// The client's token must belong to a user who is allowed to
+// dispatch containers (usually the system user).
+//
+// If the container is not Queued, LockContainer returns a
+// ContainerLockConflictError.
+func (c *Client) LockContainer(ctx context.Context, uuid string) (Container, error) {
+	var ctr Container
+	err := c.RequestAndDecodeContext(ctx, &ctr, EndpointContainerLock.Method, endpointPath(EndpointContainerLock, uuid), nil, nil)
+	if err == nil {
+		return ctr, nil
+	}
+	var te *TransactionError
+	if !errors.As(err, &te) || te.StatusCode != http.StatusUnprocessableEntity {
+		return Container{}, err
+	}
+	// The API server responds 422 if the container is not in
+	// a lockable state. Report the state it is in.
+	cur, geterr := c.getContainerLockStatus(ctx, uuid)
+	if geterr != nil {
+		return Container{}, err
+	}
+	return Container{}, ContainerLockConflictError{
+		UUID:         uuid,
+		State:        cur.State,
+		LockedByUUID: cur.LockedByUUID,
+		Err:          err,
+	}
+}
+
+// UnlockContainer returns a Locked container to the Queued state, so
+// it can be locked again (by this or another dispatcher).
+func (c *Client) UnlockContainer(ctx context.Context, uuid string) (Container, error) {
+	var ctr Container
+	err := c.RequestAndDecodeContext(ctx, &ctr, EndpointContainerUnlock.Method, endpointPath(EndpointContainerUnlock, uuid), nil, nil)
+	return ctr, err
+}
+
+func (c *Client) getContainerLockStatus(ctx context.Context, uuid string) (Container, error) {
+	var ctr Container
+	err := c.RequestAndDecodeContext(ctx, &ctr, EndpointContainerGet.Method, endpointPath(EndpointContainerGet, uuid), nil, ResourceListParams{
+		Select: containerLockSelect,
+	})
+	return ctr, err
+}
+
+// endpointPath returns the request path for the given endpoint and
+// object UUID.
+func endpointPath(ep APIEndpoint, uuid string) string {
+	return strings.Replace(ep.Path, "{uuid}", uuid, 1)
+}
+
+// A ContainerLease tracks a container locked by LockContainerLease.
+//
+// The API server does not expire container locks. Renewing a lease
+// checks that the container is still locked by the lease holder, so
+// a dispatcher can stop working on a container as soon as it loses
+// the lock (e.g., an administrator unlocked or cancelled it).
+type ContainerLease struct {
+	client   *Client
+	uuid     string
+	lockedBy string
+	ctr      Container
+}
+
+// LockContainerLease locks the given container (see LockContainer)
+// and returns a ContainerLease for it.
+func (c *Client) LockContainerLease(ctx context.Context, uuid string) (*ContainerLease, error) {
+	ctr, err := c.LockContainer(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	return &ContainerLease{client: c, uuid: uuid, lockedBy: ctr.LockedByUUID, ctr: ctr}, nil
+}
+
+// Container returns the container record as of the last successful
+// lock or renewal.
+func (l *ContainerLease) Container() Container {
+	return l.ctr
+}
+
+// Renew checks that the container is still locked by the lease
+// holder. It returns ErrContainerLeaseLost if not.
+//
+// A Running container is still considered locked, but a container
+// whose priority is zero (i.e., cancelled) is not.
+func (l *ContainerLease) Renew(ctx context.Context) error {
+	ctr, err := l.client.getContainerLockStatus(ctx, l.uuid)
+	if err != nil {
+		return err
+	}
+	if (ctr.State != ContainerStateLocked && ctr.State != ContainerStateRunning) ||
+		ctr.LockedByUUID != l.lockedBy ||
+		ctr.Priority == 0 {
+		return ErrContainerLeaseLost
+	}
+	l.ctr = ctr
+	return nil
+}
+
+// Release unlocks the container if it is still Locked by the lease
+// holder. A Running container is left alone.
+func (l *ContainerLease) Release(ctx context.Context) error {
+	ctr, err := l.client.getContainerLockStatus(ctx, l.uuid)
+	if err != nil {
+		return err
+	}
+	if ctr.State != ContainerStateLocked || ctr.LockedByUUID != l.lockedBy {
+		return nil
+	}
+	_, err = l.client.UnlockContainer(ctx, l.uuid)
+	return err
+}
+
+// KeepAlive renews the lease at the given interval until ctx is
+// done or a renewal fails. It returns ctx.Err() or the renewal
+// error.
+//
+// Transient API errors are retried by the client; a dispatcher
+// should treat any error returned by KeepAlive (other than ctx.Err())
+// as a lost lease.
+func (l *ContainerLease) KeepAlive(ctx context.Context, interval time.Duration) error {
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tk.C:
+		}
+		if err := l.Renew(ctx); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&containerLockSuite{})
+
+type containerLockSuite struct{}
+
+// fakeContainerLocks is a minimal stand-in for the containers API,
+// just enough to exercise the lock helpers.
+type fakeContainerLocks struct {
+	sync.Mutex
+	ctr   Container
+	token string // uuid of the client's token
+}
+
+func (f *fakeContainerLocks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/arvados/v1/containers/")
+	switch {
+	case r.Method == "GET" && path == f.ctr.UUID:
+	case r.Method == "POST" && path == f.ctr.UUID+"/lock":
+		if f.ctr.State != ContainerStateQueued {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"cannot lock"}})
+			return
+		}
+		f.ctr.State = ContainerStateLocked
+		f.ctr.LockedByUUID = f.token
+	case r.Method == "POST" && path == f.ctr.UUID+"/unlock":
+		if f.ctr.State != ContainerStateLocked {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		f.ctr.State = ContainerStateQueued
+		f.ctr.LockedByUUID = ""
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(f.ctr)
+}
+
+func (f *fakeContainerLocks) set(state ContainerState, lockedBy string, priority int64) {
+	f.Lock()
+	defer f.Unlock()
+	f.ctr.State, f.ctr.LockedByUUID, f.ctr.Priority = state, lockedBy, priority
+}
+
+func (s *containerLockSuite) TestLease(c *check.C) {
+	fake := &fakeContainerLocks{
+		ctr:   Container{UUID: "zzzzz-dz642-aaaaaaaaaaaaaaa", State: ContainerStateQueued, Priority: 1},
+		token: "zzzzz-gj3su-000000000000000",
+	}
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+	client := &Client{
+		APIHost:   strings.TrimPrefix(server.URL, "https://"),
+		AuthToken: "zzz",
+		Insecure:  true,
+		Timeout:   2 * time.Second,
+	}
+	ctx := context.Background()
+	uuid := fake.ctr.UUID
+
+	lease, err := client.LockContainerLease(ctx, uuid)
+	c.Assert(err, check.IsNil)
+	c.Check(lease.Container().State, check.Equals, ContainerStateLocked)
+	c.Check(lease.Renew(ctx), check.IsNil)
+
+	// Second lock attempt reports who holds the lock.
+	_, err = client.LockContainer(ctx, uuid)
+	var conflict ContainerLockConflictError
+	c.Assert(errors.As(err, &conflict), check.Equals, true, check.Commentf("err %v", err))
+	c.Check(conflict.State, check.Equals, ContainerStateLocked)
+	c.Check(conflict.LockedByUUID, check.Equals, fake.token)
+	var te *TransactionError
+	c.Check(errors.As(err, &te), check.Equals, true)
+
+	// Running is still locked.
+	fake.set(ContainerStateRunning, fake.token, 1)
+	c.Check(lease.Renew(ctx), check.IsNil)
+	c.Check(lease.Container().State, check.Equals, ContainerStateRunning)
+	c.Check(lease.Release(ctx), check.IsNil)
+	c.Check(fake.ctr.State, check.Equals, ContainerStateRunning)
+
+	// Cancelled, or locked by someone else: lease is lost.
+	fake.set(ContainerStateLocked, fake.token, 0)
+	c.Check(lease.Renew(ctx), check.Equals, ErrContainerLeaseLost)
+	fake.set(ContainerStateLocked, "zzzzz-gj3su-111111111111111", 1)
+	c.Check(lease.Renew(ctx), check.Equals, ErrContainerLeaseLost)
+	c.Check(lease.Release(ctx), check.IsNil)
+	c.Check(fake.ctr.State, check.Equals, ContainerStateLocked)
+
+	// KeepAlive returns when the lease is lost.
+	fake.set(ContainerStateLocked, fake.token, 1)
+	done := make(chan error)
+	go func() { done <- lease.KeepAlive(ctx, time.Millisecond) }()
+	time.Sleep(10 * time.Millisecond)
+	fake.set(ContainerStateQueued, "", 1)
+	select {
+	case err := <-done:
+		c.Check(err, check.Equals, ErrContainerLeaseLost)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for KeepAlive to return")
+	}
+
+	// Release unlocks a container that is still Locked.
+	lease, err = client.LockContainerLease(ctx, uuid)
+	c.Assert(err, check.IsNil)
+	c.Check(lease.Release(ctx), check.IsNil)
+	c.Check(fake.ctr.State, check.Equals, ContainerStateQueued)
+}
@@ -0,0 +1,284 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A CrunchstatSample is one line of resource usage data from a
+// container's crunchstat log (crunchstat.txt), e.g.:
+//
+//	2024-05-01T12:34:56.789012345Z cpu 1.2000 user 0.3000 sys 4.00 cpus -- interval 10.0000 seconds 0.1000 user 0.0200 sys
+//
+// Category is the first word of the line, e.g., "cpu", "mem",
+// "procmem", "statfs", "blkio:8:0", or "net:eth0". Stats maps each
+// name to the value that precedes it ({"user": 1.2, "sys": 0.3,
+// "cpus": 4}). If the line reports the change since the previous
+// sample, Interval and Delta hold the time and changes ({"user": 0.1,
+// "sys": 0.02}).
+type CrunchstatSample struct {
+	Time     time.Time          `json:"time"`
+	Category string             `json:"category"`
+	Stats    map[string]float64 `json:"stats"`
+	Interval time.Duration      `json:"interval,omitempty"`
+	Delta    map[string]float64 `json:"delta,omitempty"`
+}
+
+// ParseCrunchstatLine parses one line of a crunchstat log. The line
+// may start with a timestamp, as written by crunch-run. It returns
+// false if the line is not a usage sample (e.g., it is a notice or
+// a summary line written at exit).
+func ParseCrunchstatLine(line string) (CrunchstatSample, bool) {
+	var sample CrunchstatSample
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+			sample.Time = t
+			fields = fields[1:]
+		}
+	}
+	if len(fields) == 0 || !isCrunchstatCategory(fields[0]) {
+		return sample, false
+	}
+	sample.Category, fields = fields[0], fields[1:]
+	var delta []string
+	for i, f := range fields {
+		if f == "--" {
+			fields, delta = fields[:i], fields[i+1:]
+			break
+		}
+	}
+	var ok bool
+	if sample.Stats, ok = parseCrunchstatPairs(fields); !ok {
+		return sample, false
+	}
+	if len(delta) > 0 {
+		// "interval {seconds} seconds {value} {name} ..."
+		if len(delta) < 3 || delta[0] != "interval" || delta[2] != "seconds" {
+			return sample, false
+		}
+		seconds, err := strconv.ParseFloat(delta[1], 64)
+		if err != nil {
+			return sample, false
+		}
+		sample.Interval = time.Duration(seconds * float64(time.Second))
+		if sample.Delta, ok = parseCrunchstatPairs(delta[3:]); !ok {
+			return sample, false
+		}
+	}
+	return sample, true
+}
+
+func isCrunchstatCategory(s string) bool {
+	switch s {
+	case "cpu", "mem", "procmem", "statfs":
+		return true
+	}
+	return strings.HasPrefix(s, "blkio:") || strings.HasPrefix(s, "net:")
+}
+
+// parseCrunchstatPairs parses "{value} {name} {value} {name} ...".
+func parseCrunchstatPairs(fields []string) (map[string]float64, bool) {
+	if len(fields)%2 != 0 {
+		return nil, false
+	}
+	stats := make(map[string]float64, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		val, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, false
+		}
+		stats[fields[i+1]] = val
+	}
+	return stats, true
+}
+
+// String returns the sample in crunchstat log format, without a
+// timestamp. Stats are written in the order crunchstat uses for
+// each category, followed by any others in alphabetical order.
+func (sample CrunchstatSample) String() string {
+	var b strings.Builder
+	b.WriteString(sample.Category)
+	writeCrunchstatPairs(&b, sample.Category, sample.Stats)
+	if sample.Interval > 0 {
+		fmt.Fprintf(&b, " -- interval %.4f seconds", sample.Interval.Seconds())
+		writeCrunchstatPairs(&b, sample.Category, sample.Delta)
+	}
+	return b.String()
+}
+
+// Order of stats on each type of crunchstat line.
+var crunchstatStatOrder = map[string][]string{
+	"cpu":    {"user", "sys", "cpus"},
+	"mem":    {"cache", "swap", "pgmajfault", "rss"},
+	"statfs": {"available", "used", "total"},
+	"blkio":  {"write", "read"},
+	"net":    {"tx", "rx"},
+}
+
+func writeCrunchstatPairs(w io.Writer, category string, stats map[string]float64) {
+	order := crunchstatStatOrder[strings.SplitN(category, ":", 2)[0]]
+	done := make(map[string]bool, len(order))
+	for _, name := range order {
+		if val, ok := stats[name]; ok {
+			fmt.Fprintf(w, " %s %s", formatCrunchstatValue(category, name, val), name)
+			done[name] = true
+		}
+	}
+	var rest []string
+	for name := range stats {
+		if !done[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	for _, name := range rest {
+		fmt.Fprintf(w, " %s %s", formatCrunchstatValue(category, name, stats[name]), name)
+	}
+}
+
+func formatCrunchstatValue(category, name string, val float64) string {
+	switch {
+	case category == "cpu" && name == "cpus":
+		return strconv.FormatFloat(val, 'f', 2, 64)
+	case category == "cpu":
+		return strconv.FormatFloat(val, 'f', 4, 64)
+	default:
+		return strconv.FormatInt(int64(val), 10)
+	}
+}
+
+// CrunchstatSummary is the resource usage of a container, as
+// reported in its crunchstat log.
+type CrunchstatSummary struct {
+	// Time of the first and last samples.
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+
+	// CPUs available to the container, and total CPU time used.
+	CPUs       float64 `json:"cpus"`
+	UserCPUSec float64 `json:"user_cpu_seconds"`
+	SysCPUSec  float64 `json:"sys_cpu_seconds"`
+
+	// Highest average number of CPUs in use during any one
+	// sample interval.
+	MaxCPUsUsed float64 `json:"max_cpus_used"`
+
+	// Peak memory usage, and total major page faults.
+	MaxRSS          int64 `json:"max_rss"`
+	MaxCache        int64 `json:"max_cache"`
+	MaxSwap         int64 `json:"max_swap"`
+	MajorPageFaults int64 `json:"major_page_faults"`
+
+	// Total bytes read and written on all block devices, and
+	// received and sent on all network interfaces.
+	DiskReadBytes  int64 `json:"disk_read_bytes"`
+	DiskWriteBytes int64 `json:"disk_write_bytes"`
+	NetworkRXBytes int64 `json:"network_rx_bytes"`
+	NetworkTXBytes int64 `json:"network_tx_bytes"`
+
+	// Peak usage and size of the container's scratch space.
+	MaxScratchUsed int64 `json:"max_scratch_used"`
+	ScratchTotal   int64 `json:"scratch_total"`
+}
+
+// CPUSec returns the total CPU time used, in seconds.
+func (s CrunchstatSummary) CPUSec() float64 {
+	return s.UserCPUSec + s.SysCPUSec
+}
+
+// A CrunchstatSummarizer accumulates CrunchstatSamples into a
+// CrunchstatSummary. The zero value is ready to use.
+type CrunchstatSummarizer struct {
+	summary CrunchstatSummary
+	blkio   map[string]CrunchstatSample // last sample per device
+	net     map[string]CrunchstatSample // last sample per interface
+}
+
+// Add adds a sample to the summary.
+func (cs *CrunchstatSummarizer) Add(sample CrunchstatSample) {
+	s := &cs.summary
+	if !sample.Time.IsZero() {
+		if s.StartTime.IsZero() || sample.Time.Before(s.StartTime) {
+			s.StartTime = sample.Time
+		}
+		if sample.Time.After(s.EndTime) {
+			s.EndTime = sample.Time
+		}
+	}
+	switch {
+	case sample.Category == "cpu":
+		// Counters are cumulative, so the last sample has
+		// the totals.
+		s.CPUs = sample.Stats["cpus"]
+		s.UserCPUSec = sample.Stats["user"]
+		s.SysCPUSec = sample.Stats["sys"]
+		if sample.Interval > 0 {
+			used := (sample.Delta["user"] + sample.Delta["sys"]) / sample.Interval.Seconds()
+			if used > s.MaxCPUsUsed {
+				s.MaxCPUsUsed = used
+			}
+		}
+	case sample.Category == "mem":
+		maxInt64(&s.MaxRSS, sample.Stats["rss"])
+		maxInt64(&s.MaxCache, sample.Stats["cache"])
+		maxInt64(&s.MaxSwap, sample.Stats["swap"])
+		maxInt64(&s.MajorPageFaults, sample.Stats["pgmajfault"])
+	case sample.Category == "statfs":
+		maxInt64(&s.MaxScratchUsed, sample.Stats["used"])
+		maxInt64(&s.ScratchTotal, sample.Stats["total"])
+	case strings.HasPrefix(sample.Category, "blkio:"):
+		if cs.blkio == nil {
+			cs.blkio = map[string]CrunchstatSample{}
+		}
+		cs.blkio[sample.Category] = sample
+	case strings.HasPrefix(sample.Category, "net:"):
+		if cs.net == nil {
+			cs.net = map[string]CrunchstatSample{}
+		}
+		cs.net[sample.Category] = sample
+	}
+}
+
+func maxInt64(dst *int64, val float64) {
+	if int64(val) > *dst {
+		*dst = int64(val)
+	}
+}
+
+// Summary returns the summary of the samples added so far.
+func (cs *CrunchstatSummarizer) Summary() CrunchstatSummary {
+	s := cs.summary
+	for _, sample := range cs.blkio {
+		s.DiskReadBytes += int64(sample.Stats["read"])
+		s.DiskWriteBytes += int64(sample.Stats["write"])
+	}
+	for _, sample := range cs.net {
+		s.NetworkRXBytes += int64(sample.Stats["rx"])
+		s.NetworkTXBytes += int64(sample.Stats["tx"])
+	}
+	return s
+}
+
+// SummarizeCrunchstat reads a crunchstat log and returns a summary
+// of the samples in it. Lines that are not samples are ignored.
+func SummarizeCrunchstat(r io.Reader) (CrunchstatSummary, error) {
+	var cs CrunchstatSummarizer
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		if sample, ok := ParseCrunchstatLine(scanner.Text()); ok {
+			cs.Add(sample)
+		}
+	}
+	return cs.Summary(), scanner.Err()
+}
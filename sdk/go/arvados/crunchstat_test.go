@@ -0,0 +1,120 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&crunchstatSuite{})
+
+type crunchstatSuite struct{}
+
+const testCrunchstatLog = `2024-05-01T12:00:00.000000000Z notice: reading stats from /sys/fs/cgroup
+2024-05-01T12:00:00.000000000Z using /proc/1234/net/dev
+2024-05-01T12:00:00.100000000Z mem 1000 cache 0 swap 0 pgmajfault 5000 rss
+2024-05-01T12:00:00.100000000Z cpu 0.5000 user 0.1000 sys 4.00 cpus
+2024-05-01T12:00:00.100000000Z blkio:8:0 100 write 200 read
+2024-05-01T12:00:00.100000000Z net:eth0 10 tx 20 rx
+2024-05-01T12:00:00.100000000Z statfs 9000 available 1000 used 10000 total
+2024-05-01T12:00:10.100000000Z mem 3000 cache 0 swap 2 pgmajfault 9000 rss
+2024-05-01T12:00:10.100000000Z procmem 8000 python3 1000 bash
+2024-05-01T12:00:10.100000000Z cpu 20.5000 user 2.1000 sys 4.00 cpus -- interval 10.0000 seconds 20.0000 user 2.0000 sys
+2024-05-01T12:00:10.100000000Z blkio:8:0 150 write 1200 read -- interval 10.0000 seconds 50 write 1000 read
+2024-05-01T12:00:10.100000000Z blkio:8:16 7 write 0 read
+2024-05-01T12:00:10.100000000Z net:eth0 110 tx 520 rx -- interval 10.0000 seconds 100 tx 500 rx
+2024-05-01T12:00:10.100000000Z statfs 7000 available 3000 used 10000 total -- interval 10.0000 seconds 2000 used
+2024-05-01T12:00:20.100000000Z mem 2000 cache 0 swap 2 pgmajfault 7000 rss
+2024-05-01T12:00:20.100000000Z cpu 30.5000 user 2.6000 sys 4.00 cpus -- interval 10.0000 seconds 10.0000 user 0.5000 sys
+2024-05-01T12:00:20.100000000Z statfs 8000 available 2000 used 10000 total -- interval 10.0000 seconds -1000 used
+2024-05-01T12:00:20.200000000Z Maximum container memory rss usage was 9000 bytes
+2024-05-01T12:00:20.200000000Z Total CPU usage was 30.500000 user and 2.600000 sys on 4.00 CPUs
+`
+
+func (s *crunchstatSuite) TestParseLine(c *check.C) {
+	sample, ok := ParseCrunchstatLine("2024-05-01T12:00:10.100000000Z cpu 20.5000 user 2.1000 sys 4.00 cpus -- interval 10.0000 seconds 20.0000 user 2.0000 sys")
+	c.Assert(ok, check.Equals, true)
+	c.Check(sample.Time.Equal(time.Date(2024, 5, 1, 12, 0, 10, 100000000, time.UTC)), check.Equals, true)
+	c.Check(sample.Category, check.Equals, "cpu")
+	c.Check(sample.Stats, check.DeepEquals, map[string]float64{"user": 20.5, "sys": 2.1, "cpus": 4})
+	c.Check(sample.Interval, check.Equals, 10*time.Second)
+	c.Check(sample.Delta, check.DeepEquals, map[string]float64{"user": 20, "sys": 2})
+
+	// Timestamp is optional.
+	sample, ok = ParseCrunchstatLine("net:eth0 110 tx 520 rx")
+	c.Assert(ok, check.Equals, true)
+	c.Check(sample.Time.IsZero(), check.Equals, true)
+	c.Check(sample.Category, check.Equals, "net:eth0")
+	c.Check(sample.Stats, check.DeepEquals, map[string]float64{"tx": 110, "rx": 520})
+	c.Check(sample.Delta, check.IsNil)
+
+	for _, line := range []string{
+		"",
+		"2024-05-01T12:00:00.000000000Z",
+		"2024-05-01T12:00:00.000000000Z notice: reading stats from /sys/fs/cgroup",
+		"2024-05-01T12:00:20.200000000Z Maximum container memory rss usage was 9000 bytes",
+		"cpu 1.0 user 2.0",
+		"cpu one user",
+		"cpu 1.0 user -- elapsed 10 seconds",
+		"cpu 1.0 user -- interval 10 seconds 1.0",
+	} {
+		_, ok := ParseCrunchstatLine(line)
+		c.Check(ok, check.Equals, false, check.Commentf("%q", line))
+	}
+}
+
+func (s *crunchstatSuite) TestFormatSample(c *check.C) {
+	for _, line := range []string{
+		"cpu 20.5000 user 2.1000 sys 4.00 cpus -- interval 10.0000 seconds 20.0000 user 2.0000 sys",
+		"mem 3000 cache 0 swap 2 pgmajfault 9000 rss",
+		"blkio:8:0 150 write 1200 read -- interval 10.0000 seconds 50 write 1000 read",
+		"statfs 8000 available 2000 used 10000 total -- interval 10.0000 seconds -1000 used",
+		"procmem 1000 bash 8000 python3",
+	} {
+		sample, ok := ParseCrunchstatLine("2024-05-01T12:00:10.100000000Z " + line)
+		c.Assert(ok, check.Equals, true)
+		c.Check(sample.String(), check.Equals, line)
+	}
+}
+
+func (s *crunchstatSuite) TestSummarize(c *check.C) {
+	summary, err := SummarizeCrunchstat(strings.NewReader(testCrunchstatLog))
+	c.Assert(err, check.IsNil)
+	c.Check(summary, check.DeepEquals, CrunchstatSummary{
+		StartTime:       time.Date(2024, 5, 1, 12, 0, 0, 100000000, time.UTC),
+		EndTime:         time.Date(2024, 5, 1, 12, 0, 20, 100000000, time.UTC),
+		CPUs:            4,
+		UserCPUSec:      30.5,
+		SysCPUSec:       2.6,
+		MaxCPUsUsed:     2.2,
+		MaxRSS:          9000,
+		MaxCache:        3000,
+		MaxSwap:         0,
+		MajorPageFaults: 2,
+		DiskReadBytes:   1200,
+		DiskWriteBytes:  157,
+		NetworkRXBytes:  520,
+		NetworkTXBytes:  110,
+		MaxScratchUsed:  3000,
+		ScratchTotal:    10000,
+	})
+	c.Check(summary.CPUSec(), check.Equals, 33.1)
+
+	buf, err := json.Marshal(summary)
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Matches, `\{"start_time":"2024-05-01T12:00:00.1Z",.*"max_rss":9000,.*"scratch_total":10000\}`)
+
+	// Samples can be added one at a time, e.g., while following
+	// a live log.
+	var cs CrunchstatSummarizer
+	c.Check(cs.Summary(), check.DeepEquals, CrunchstatSummary{})
+	sample, _ := ParseCrunchstatLine("mem 0 cache 0 swap 0 pgmajfault 123 rss")
+	cs.Add(sample)
+	c.Check(cs.Summary().MaxRSS, check.Equals, int64(123))
+}
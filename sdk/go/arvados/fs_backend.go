@@ -22,12 +22,28 @@ type keepBackend struct {
 	apiClient
 }
 
+// readAtPartial calls the keepClient's ReadAtPartial method, if it
+// has one. Otherwise it waits for the entire range like ReadAt.
+func (kb keepBackend) readAtPartial(locator string, p []byte, off int) (int, error) {
+	if pr, ok := kb.keepClient.(partialReader); ok {
+		return pr.ReadAtPartial(locator, p, off)
+	}
+	return kb.keepClient.ReadAt(locator, p, off)
+}
+
 type keepClient interface {
 	ReadAt(locator string, p []byte, off int) (int, error)
 	BlockWrite(context.Context, BlockWriteOptions) (BlockWriteResponse, error)
 	LocalLocator(locator string) (string, error)
 }
 
+// partialReader is implemented by keepClients that can return a
+// short read as soon as some of the requested data is available (see
+// DiskCache.ReadAtPartial).
+type partialReader interface {
+	ReadAtPartial(locator string, p []byte, off int) (int, error)
+}
+
 type apiClient interface {
 	RequestAndDecode(dst interface{}, method, path string, body io.Reader, params interface{}) error
 }
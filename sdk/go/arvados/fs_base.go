@@ -167,12 +167,55 @@ type fsFS struct {
 
 // FS returns an fs.FS interface to the given FileSystem, to enable
 // the use of fs.WalkDir, etc.
+//
+// For compatibility with existing callers, FS also accepts paths
+// that are not valid according to fs.ValidPath, like "/foo" and
+// "". Use IOFS to get an fs.FS that follows the io/fs path
+// conventions.
 func FS(fs FileSystem) fs.FS { return fsFS{fs} }
 func (fs fsFS) Open(path string) (fs.File, error) {
 	f, err := fs.FileSystem.Open(path)
 	return f, err
 }
 
+type ioFS struct {
+	fs FileSystem
+}
+
+// IOFS returns an fs.FS (also implementing fs.StatFS) that conforms
+// to the io/fs conventions, so a collection or site filesystem can be
+// used with packages like archive/zip, html/template, and
+// testing/fstest. Names must be unrooted slash-separated paths
+// ("dir/file.txt", or "." for the top level directory), errors are
+// *fs.PathError, and files implement io.Seeker and
+// fs.ReadDirFile. Files are opened read-only.
+//
+// To serve the filesystem using http.FileServer, use
+// http.FS(IOFS(fs)).
+func IOFS(fs FileSystem) fs.FS { return ioFS{fs} }
+
+func (fsys ioFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := fsys.fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return f, nil
+}
+
+func (fsys ioFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	fi, err := fsys.fs.Stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fi, nil
+}
+
 type inode interface {
 	SetParent(parent inode, name string)
 	Parent() inode
@@ -458,6 +501,16 @@ type fileSystem struct {
 	thr   *throttle
 }
 
+// readAtPartial is like ReadAt, but returns a short read if the
+// backend supports it and only part of the requested range is
+// available yet.
+func (fs *fileSystem) readAtPartial(locator string, p []byte, off int) (int, error) {
+	if kb, ok := fs.fsBackend.(keepBackend); ok {
+		return kb.readAtPartial(locator, p, off)
+	}
+	return fs.ReadAt(locator, p, off)
+}
+
 func (fs *fileSystem) rootnode() inode {
 	return fs.root
 }
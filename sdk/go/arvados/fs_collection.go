@@ -74,6 +74,12 @@ func (c *Collection) FileSystem(client apiClient, kc keepClient) (CollectionFile
 	if modTime.IsZero() {
 		modTime = time.Now()
 	}
+	if kb, ok := kc.(keepBackend); ok {
+		// Use the parent filesystem's keepClient directly,
+		// so optional methods like ReadAtPartial are still
+		// available.
+		kc = kb.keepClient
+	}
 	fs := &collectionFileSystem{
 		uuid:           c.UUID,
 		storageClasses: c.StorageClassesDesired,
@@ -634,6 +640,17 @@ func (fn *filenode) MemorySize() (size int64) {
 // into p. startPtr is assumed not to be up-to-date. Caller must have
 // RLock or Lock.
 func (fn *filenode) Read(p []byte, startPtr filenodePtr) (n int, ptr filenodePtr, err error) {
+	return fn.read(p, startPtr, false)
+}
+
+// readPartial is like Read, but returns a short read instead of
+// waiting for a block that is still being fetched (see
+// (*filehandle)ReadPartial).
+func (fn *filenode) readPartial(p []byte, startPtr filenodePtr) (n int, ptr filenodePtr, err error) {
+	return fn.read(p, startPtr, true)
+}
+
+func (fn *filenode) read(p []byte, startPtr filenodePtr, partial bool) (n int, ptr filenodePtr, err error) {
 	ptr = fn.seek(startPtr)
 	if ptr.off < 0 {
 		err = ErrNegativeOffset
@@ -647,7 +664,11 @@ func (fn *filenode) Read(p []byte, startPtr filenodePtr) (n int, ptr filenodePtr
 		ss.locator = fn.fs.refreshSignature(ss.locator)
 		fn.segments[ptr.segmentIdx] = ss
 	}
-	n, err = fn.segments[ptr.segmentIdx].ReadAt(p, int64(ptr.segmentOff))
+	if ss, ok := fn.segments[ptr.segmentIdx].(storedSegment); ok && partial {
+		n, err = ss.readAtPartial(p, int64(ptr.segmentOff))
+	} else {
+		n, err = fn.segments[ptr.segmentIdx].ReadAt(p, int64(ptr.segmentOff))
+	}
 	if n > 0 {
 		ptr.off += int64(n)
 		ptr.segmentOff += n
@@ -1398,7 +1419,7 @@ func (dn *dirnode) loadManifest(txt string) error {
 		streamparts := 0
 		for i, token := range bytes.Split(stream, []byte{' '}) {
 			if i == 0 {
-				pathparts = strings.Split(manifestUnescape(string(token)), "/")
+				pathparts = strings.Split(ManifestUnescape(string(token)), "/")
 				streamparts = len(pathparts)
 				continue
 			}
@@ -1443,7 +1464,7 @@ func (dn *dirnode) loadManifest(txt string) error {
 					// optimization for a common case
 					pathparts = append(pathparts[:streamparts], string(toks[2]))
 				} else {
-					pathparts = append(pathparts[:streamparts], strings.Split(manifestUnescape(string(toks[2])), "/")...)
+					pathparts = append(pathparts[:streamparts], strings.Split(ManifestUnescape(string(toks[2])), "/")...)
 				}
 				fnode, err = dn.createFileAndParents(pathparts)
 				if err != nil {
@@ -1798,19 +1819,35 @@ func (se storedSegment) Slice(n, size int) segment {
 }
 
 func (se storedSegment) ReadAt(p []byte, off int64) (n int, err error) {
+	return se.read(p, off, se.kc.ReadAt)
+}
+
+// readAtPartial is like ReadAt, but if the backend supports it and
+// only part of the requested range is available yet, it returns
+// early with a short read and a nil error.
+func (se storedSegment) readAtPartial(p []byte, off int64) (n int, err error) {
+	if pr, ok := se.kc.(interface {
+		readAtPartial(string, []byte, int) (int, error)
+	}); ok {
+		return se.read(p, off, pr.readAtPartial)
+	}
+	return se.ReadAt(p, off)
+}
+
+func (se storedSegment) read(p []byte, off int64, readAt func(string, []byte, int) (int, error)) (n int, err error) {
 	if off > int64(se.length) {
 		return 0, io.EOF
 	}
 	maxlen := se.length - int(off)
 	if len(p) > maxlen {
 		p = p[:maxlen]
-		n, err = se.kc.ReadAt(se.locator, p, int(off)+se.offset)
-		if err == nil {
+		n, err = readAt(se.locator, p, int(off)+se.offset)
+		if err == nil && n == len(p) {
 			err = io.EOF
 		}
 		return
 	}
-	return se.kc.ReadAt(se.locator, p, int(off)+se.offset)
+	return readAt(se.locator, p, int(off)+se.offset)
 }
 
 func (se storedSegment) memorySize() int64 {
@@ -1841,7 +1878,10 @@ func manifestUnescapeFunc(seq string) string {
 	return string([]byte{byte(i)})
 }
 
-func manifestUnescape(s string) string {
+// ManifestUnescape returns the stream or file name represented by
+// the given manifest token, e.g., "./foo\040bar" becomes
+// "./foo bar".
+func ManifestUnescape(s string) string {
 	return manifestEscapeSeq.ReplaceAllStringFunc(s, manifestUnescapeFunc)
 }
 
@@ -11,9 +11,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"regexp"
 	"runtime"
@@ -22,6 +24,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	check "gopkg.in/check.v1"
@@ -1736,6 +1739,72 @@ func (s *CollectionFSUnitSuite) testLargeManifest(c *check.C, dirCount, filesPer
 	c.Logf("%s ... test duration %s", time.Now(), time.Now().Sub(t0))
 }
 
+func (s *CollectionFSUnitSuite) TestIOFS(c *check.C) {
+	cfs, err := (&Collection{}).FileSystem(nil, &keepClientStub{})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfs.Mkdir("dir1", 0755), check.IsNil)
+	c.Assert(cfs.Mkdir("dir1/empty", 0755), check.IsNil)
+	for name, data := range map[string]string{
+		"foo":          "foo",
+		"dir1/bar.txt": "bar data",
+	} {
+		f, err := cfs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+		c.Assert(err, check.IsNil)
+		_, err = f.Write([]byte(data))
+		c.Assert(err, check.IsNil)
+		c.Assert(f.Close(), check.IsNil)
+	}
+
+	fsys := IOFS(cfs)
+	c.Check(fstest.TestFS(fsys, "foo", "dir1/bar.txt", "dir1/empty"), check.IsNil)
+
+	for _, name := range []string{"/foo", "", "dir1/../foo", "dir1/"} {
+		_, err = fsys.Open(name)
+		c.Check(errors.Is(err, fs.ErrInvalid), check.Equals, true, check.Commentf("%q", name))
+	}
+	_, err = fsys.Open("missing")
+	c.Check(errors.Is(err, fs.ErrNotExist), check.Equals, true)
+	c.Check(err, check.FitsTypeOf, &fs.PathError{})
+	_, err = fs.Stat(fsys, "dir1/missing")
+	c.Check(errors.Is(err, fs.ErrNotExist), check.Equals, true)
+
+	buf, err := fs.ReadFile(fsys, "dir1/bar.txt")
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "bar data")
+
+	// http.FS supports range requests because our files are
+	// seekable.
+	srv := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer srv.Close()
+	req, err := http.NewRequest("GET", srv.URL+"/dir1/bar.txt", nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Range", "bytes=4-")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	buf, err = io.ReadAll(resp.Body)
+	c.Check(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusPartialContent)
+	c.Check(string(buf), check.Equals, "data")
+	c.Check(resp.Header.Get("Content-Range"), check.Equals, "bytes 4-7/8")
+	fi, err := fs.Stat(fsys, "dir1/bar.txt")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Header.Get("Last-Modified"), check.Equals, fi.ModTime().UTC().Format(http.TimeFormat))
+
+	resp, err = http.Get(srv.URL + "/dir1/")
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	buf, err = io.ReadAll(resp.Body)
+	c.Check(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Check(string(buf), check.Matches, `(?ms).*href="bar.txt".*href="empty/".*`)
+
+	resp, err = http.Get(srv.URL + "/missing")
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
+
 // Gocheck boilerplate
 func Test(t *testing.T) {
 	check.TestingT(t)
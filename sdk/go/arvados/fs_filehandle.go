@@ -29,6 +29,25 @@ func (f *filehandle) Read(p []byte) (n int, err error) {
 	return
 }
 
+// ReadPartial is like Read, but if part of the requested data is
+// available now (e.g., in a DiskCache) and the rest of the block is
+// still being fetched, it returns the available data instead of
+// waiting. Callers that don't expect short reads from a regular
+// file should use Read.
+func (f *filehandle) ReadPartial(p []byte) (n int, err error) {
+	fn, ok := f.inode.(*filenode)
+	if !ok {
+		return f.Read(p)
+	}
+	if !f.readable {
+		return 0, ErrWriteOnlyMode
+	}
+	fn.RLock()
+	defer fn.RUnlock()
+	n, f.ptr, err = fn.readPartial(p, f.ptr)
+	return
+}
+
 func (f *filehandle) Seek(off int64, whence int) (pos int64, err error) {
 	size := f.inode.Size()
 	ptr := f.ptr
@@ -86,17 +105,38 @@ func (ent dirEntry) Info() (fs.FileInfo, error) {
 	return ent, nil
 }
 
-// ReadDir implements fs.ReadDirFile.
+// ReadDir implements fs.ReadDirFile. Unlike Readdir, if count <= 0
+// it returns only the entries that have not already been returned by
+// previous ReadDir calls.
 func (f *filehandle) ReadDir(count int) ([]fs.DirEntry, error) {
-	fis, err := f.Readdir(count)
-	if len(fis) == 0 {
-		return nil, err
+	if count > 0 {
+		fis, err := f.Readdir(count)
+		if len(fis) == 0 {
+			return nil, err
+		}
+		return dirEntries(fis), err
 	}
+	if !f.inode.IsDir() {
+		return nil, ErrInvalidOperation
+	}
+	if f.unreaddirs == nil {
+		var err error
+		f.unreaddirs, err = f.inode.Readdir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	fis := f.unreaddirs
+	f.unreaddirs = f.unreaddirs[len(fis):]
+	return dirEntries(fis), nil
+}
+
+func dirEntries(fis []os.FileInfo) []fs.DirEntry {
 	ents := make([]fs.DirEntry, len(fis))
 	for i, fi := range fis {
 		ents[i] = dirEntry{fi}
 	}
-	return ents, err
+	return ents
 }
 
 func (f *filehandle) Readdir(count int) ([]os.FileInfo, error) {
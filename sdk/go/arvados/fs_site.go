@@ -257,7 +257,7 @@ func (fs *customFileSystem) collectionSingleton(id string) (inode, error) {
 	if err != nil {
 		return nil, err
 	}
-	newfs, err := coll.FileSystem(fs, fs)
+	newfs, err := coll.FileSystem(fs, fs.fsBackend)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,458 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthTimeout = 2 * time.Second
+	maxClockSkew         = time.Minute
+)
+
+// ClusterHealthResponse is the health report for an entire
+// cluster, as returned by HealthAggregator and served by the
+// "GET /_health/all" endpoint.
+type ClusterHealthResponse struct {
+	// "OK" if all needed services are OK, otherwise "ERROR".
+	Health string
+
+	// An entry for each known health check of each known instance
+	// of each needed component: "instance of service S on node N
+	// reports health-check C is OK."
+	Checks map[string]HealthCheckResult
+
+	// An entry for each service type: "service S is OK." This
+	// exposes problems that can't be expressed in Checks, like
+	// "service S is needed, but isn't configured to run
+	// anywhere."
+	Services map[ServiceName]ServiceHealth
+
+	// Difference between min/max timestamps in individual
+	// health-check responses.
+	ClockSkew Duration
+
+	Errors []string
+}
+
+// HealthCheckResult is the outcome of checking a single instance
+// of a service.
+type HealthCheckResult struct {
+	Health         string
+	Error          string                 `json:",omitempty"`
+	HTTPStatusCode int                    `json:",omitempty"`
+	Response       map[string]interface{} `json:",omitempty"`
+	ResponseTime   json.Number
+	ClockTime      time.Time
+	Server         string // "Server" header in http response
+	HealthMetrics
+	respTime time.Duration
+}
+
+// HealthMetrics are the values reported by a service's metrics
+// endpoint that are relevant to cluster health.
+type HealthMetrics struct {
+	ConfigSourceTimestamp time.Time
+	ConfigSourceSHA256    string
+	Version               string
+}
+
+// ServiceHealth summarizes the health of all instances of a
+// service.
+type ServiceHealth struct {
+	Health string // "OK", "ERROR", or "SKIP"
+	N      int
+
+	// Response time of the slowest instance, in seconds.
+	ResponseTime json.Number `json:",omitempty"`
+
+	// Distinct versions reported by the service's instances.
+	Versions []string `json:",omitempty"`
+
+	maxRespTime time.Duration
+}
+
+// HealthAggregator checks the health of all services configured in
+// a cluster.
+type HealthAggregator struct {
+	Cluster *Cluster
+
+	// Version that all services are expected to be running. If
+	// empty, version skew is reported only when services
+	// disagree with one another.
+	ExpectedVersion string
+
+	// Timeout for each health-check request. Default 2s.
+	Timeout time.Duration
+
+	// HTTP client used for health-check requests. If nil, a
+	// client is created using the cluster's TLS settings.
+	HTTPClient *http.Client
+
+	setupOnce sync.Once
+}
+
+func (agg *HealthAggregator) setup() {
+	if agg.HTTPClient == nil {
+		agg.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: agg.Cluster.TLS.Insecure,
+				},
+			},
+		}
+	}
+	if agg.Timeout == 0 {
+		agg.Timeout = defaultHealthTimeout
+	}
+}
+
+// ClusterHealth checks the health of every configured instance of
+// every service, and returns a report.
+func (agg *HealthAggregator) ClusterHealth(ctx context.Context) ClusterHealthResponse {
+	agg.setupOnce.Do(agg.setup)
+	resp := ClusterHealthResponse{
+		Health:   "OK",
+		Checks:   make(map[string]HealthCheckResult),
+		Services: make(map[ServiceName]ServiceHealth),
+	}
+
+	mtx := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for svcName, svc := range agg.Cluster.Services.Map() {
+		// Ensure svc is listed in resp.Services.
+		mtx.Lock()
+		if _, ok := resp.Services[svcName]; !ok {
+			resp.Services[svcName] = ServiceHealth{Health: "MISSING"}
+		}
+		mtx.Unlock()
+
+		checkURLs := map[URL]bool{}
+		for addr := range svc.InternalURLs {
+			checkURLs[addr] = true
+		}
+		if len(checkURLs) == 0 && svc.ExternalURL.Host != "" {
+			checkURLs[svc.ExternalURL] = true
+		}
+		for addr := range checkURLs {
+			wg.Add(1)
+			go func(svcName ServiceName, addr URL) {
+				defer wg.Done()
+				var result HealthCheckResult
+				pingURL, err := agg.pingURL(addr)
+				if err != nil {
+					result = HealthCheckResult{
+						Health: "ERROR",
+						Error:  err.Error(),
+					}
+				} else {
+					result = agg.ping(ctx, pingURL)
+					if result.Health != "SKIP" {
+						m, err := agg.metrics(ctx, pingURL)
+						if err != nil && result.Error == "" {
+							result.Error = "metrics: " + err.Error()
+						}
+						result.HealthMetrics = m
+					}
+				}
+
+				mtx.Lock()
+				defer mtx.Unlock()
+				resp.Checks[fmt.Sprintf("%s+%s", svcName, pingURL)] = result
+				h := resp.Services[svcName]
+				if result.respTime > h.maxRespTime {
+					h.maxRespTime = result.respTime
+					h.ResponseTime = result.ResponseTime
+				}
+				if v := result.HealthMetrics.Version; v != "" && !stringInSlice(v, h.Versions) {
+					h.Versions = append(h.Versions, v)
+					sort.Strings(h.Versions)
+				}
+				if result.Health == "OK" || result.Health == "SKIP" {
+					h.N++
+					if result.Health == "OK" || h.N == 1 {
+						// "" => "SKIP" or "OK"
+						// "SKIP" => "OK"
+						h.Health = result.Health
+					}
+				} else {
+					resp.Health = "ERROR"
+					resp.Errors = append(resp.Errors, fmt.Sprintf("%s: %s: %s", svcName, result.Health, result.Error))
+				}
+				resp.Services[svcName] = h
+			}(svcName, addr)
+		}
+	}
+	wg.Wait()
+
+	// Report ERROR if a needed service didn't fail any checks
+	// merely because it isn't configured to run anywhere.
+	for svcName, sh := range resp.Services {
+		switch svcName {
+		case ServiceNameDispatchCloud,
+			ServiceNameDispatchLSF,
+			ServiceNameDispatchSLURM:
+			// ok to not run any given dispatcher
+		case ServiceNameHealth,
+			ServiceNameWorkbench1,
+			ServiceNameWorkbench2:
+			// typically doesn't have InternalURLs in config
+		default:
+			if sh.Health != "OK" && sh.Health != "SKIP" {
+				resp.Health = "ERROR"
+				resp.Errors = append(resp.Errors, fmt.Sprintf("%s: %s: no InternalURLs configured", svcName, sh.Health))
+				continue
+			}
+		}
+	}
+
+	// Check for clock skew between hosts
+	var maxResponseTime time.Duration
+	var clockMin, clockMax time.Time
+	for _, result := range resp.Checks {
+		if result.ClockTime.IsZero() {
+			continue
+		}
+		if clockMin.IsZero() || result.ClockTime.Before(clockMin) {
+			clockMin = result.ClockTime
+		}
+		if result.ClockTime.After(clockMax) {
+			clockMax = result.ClockTime
+		}
+		if result.respTime > maxResponseTime {
+			maxResponseTime = result.respTime
+		}
+	}
+	skew := clockMax.Sub(clockMin)
+	resp.ClockSkew = Duration(skew)
+	if skew > maxClockSkew+maxResponseTime {
+		msg := fmt.Sprintf("clock skew detected: maximum timestamp spread is %s (exceeds warning threshold of %s)", resp.ClockSkew, Duration(maxClockSkew))
+		resp.Errors = append(resp.Errors, msg)
+		resp.Health = "ERROR"
+	}
+
+	// Check for mismatched config files
+	var newest HealthMetrics
+	for _, result := range resp.Checks {
+		if result.HealthMetrics.ConfigSourceTimestamp.After(newest.ConfigSourceTimestamp) {
+			newest = result.HealthMetrics
+		}
+	}
+	var mismatches []string
+	for target, result := range resp.Checks {
+		if hash := result.HealthMetrics.ConfigSourceSHA256; hash != "" && hash != newest.ConfigSourceSHA256 {
+			mismatches = append(mismatches, target)
+		}
+	}
+	for _, target := range mismatches {
+		msg := fmt.Sprintf("outdated config: %s: config file (sha256 %s) does not match latest version with timestamp %s",
+			strings.TrimSuffix(target, "/_health/ping"),
+			resp.Checks[target].HealthMetrics.ConfigSourceSHA256,
+			newest.ConfigSourceTimestamp.Format(time.RFC3339))
+		resp.Errors = append(resp.Errors, msg)
+		resp.Health = "ERROR"
+	}
+
+	// Check for services running a different version than
+	// expected, or (if no version is expected) running
+	// different versions from one another.
+	if agg.ExpectedVersion != "" {
+		for target, result := range resp.Checks {
+			if result.HealthMetrics.Version != "" && !sameVersion(result.HealthMetrics.Version, agg.ExpectedVersion) {
+				msg := fmt.Sprintf("version mismatch: %s is running %s -- expected %s",
+					strings.TrimSuffix(target, "/_health/ping"),
+					result.HealthMetrics.Version,
+					agg.ExpectedVersion)
+				resp.Errors = append(resp.Errors, msg)
+				resp.Health = "ERROR"
+			}
+		}
+	} else {
+		var versions []string
+		for _, result := range resp.Checks {
+			v := result.HealthMetrics.Version
+			if v == "" {
+				continue
+			}
+			found := false
+			for _, seen := range versions {
+				if sameVersion(v, seen) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				versions = append(versions, v)
+			}
+		}
+		if len(versions) > 1 {
+			sort.Strings(versions)
+			msg := fmt.Sprintf("version mismatch: services are running %d different versions: %s", len(versions), strings.Join(versions, ", "))
+			resp.Errors = append(resp.Errors, msg)
+			resp.Health = "ERROR"
+		}
+	}
+	return resp
+}
+
+func (agg *HealthAggregator) pingURL(svcURL URL) (*url.URL, error) {
+	base := url.URL(svcURL)
+	return base.Parse("/_health/ping")
+}
+
+func (agg *HealthAggregator) ping(ctx context.Context, target *url.URL) (result HealthCheckResult) {
+	t0 := time.Now()
+	defer func() {
+		result.respTime = time.Since(t0)
+		result.ResponseTime = json.Number(fmt.Sprintf("%.6f", result.respTime.Seconds()))
+	}()
+	result.Health = "ERROR"
+
+	ctx, cancel := context.WithTimeout(ctx, agg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+agg.Cluster.ManagementToken)
+
+	// Avoid workbench1's redirect-http-to-https feature
+	req.Header.Set("X-Forwarded-Proto", "https")
+
+	resp, err := agg.HTTPClient.Do(req)
+	if urlerr, ok := err.(*url.Error); ok {
+		if neterr, ok := urlerr.Err.(*net.OpError); ok && isLocalHost(target.Hostname()) {
+			result = HealthCheckResult{
+				Health: "SKIP",
+				Error:  neterr.Error(),
+			}
+			err = nil
+			return
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	result.HTTPStatusCode = resp.StatusCode
+	err = json.NewDecoder(resp.Body).Decode(&result.Response)
+	if err != nil {
+		result.Error = fmt.Sprintf("cannot decode response: %s", err)
+	} else if resp.StatusCode != http.StatusOK {
+		result.Error = fmt.Sprintf("HTTP %d %s", resp.StatusCode, resp.Status)
+	} else if h, _ := result.Response["health"].(string); h != "OK" {
+		if e, ok := result.Response["error"].(string); ok && e != "" {
+			result.Error = e
+			return
+		} else {
+			result.Error = fmt.Sprintf("health=%q in ping response", h)
+			return
+		}
+	}
+	result.Health = "OK"
+	result.ClockTime, _ = time.Parse(time.RFC1123, resp.Header.Get("Date"))
+	result.Server = resp.Header.Get("Server")
+	return
+}
+
+var (
+	reConfigMetric  = regexp.MustCompile(`arvados_config_source_timestamp_seconds{sha256="([0-9a-f]+)"} (\d[\d\.e\+]+)`)
+	reVersionMetric = regexp.MustCompile(`arvados_version_running{version="([^"]+)"} 1`)
+)
+
+func (agg *HealthAggregator) metrics(ctx context.Context, pingURL *url.URL) (result HealthMetrics, err error) {
+	metricsURL, err := pingURL.Parse("/metrics")
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, agg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", metricsURL.String(), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+agg.Cluster.ManagementToken)
+
+	// Avoid workbench1's redirect-http-to-https feature
+	req.Header.Set("X-Forwarded-Proto", "https")
+
+	resp, err := agg.HTTPClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: HTTP %d %s", metricsURL.String(), resp.StatusCode, resp.Status)
+		return
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if m := reConfigMetric.FindSubmatch(scanner.Bytes()); len(m) == 3 && len(m[1]) > 0 {
+			result.ConfigSourceSHA256 = string(m[1])
+			unixtime, _ := strconv.ParseFloat(string(m[2]), 64)
+			result.ConfigSourceTimestamp = time.UnixMicro(int64(unixtime * 1e6))
+		} else if m = reVersionMetric.FindSubmatch(scanner.Bytes()); len(m) == 2 && len(m[1]) > 0 {
+			result.Version = string(m[1])
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("error parsing response from %s: %w", metricsURL.String(), err)
+		return
+	}
+	return
+}
+
+// Test whether host is an easily recognizable loopback address:
+// 0.0.0.0, 127.x.x.x, ::1, or localhost.
+func isLocalHost(host string) bool {
+	ip := net.ParseIP(host)
+	return ip.IsLoopback() || bytes.Equal(ip.To4(), []byte{0, 0, 0, 0}) || strings.EqualFold(host, "localhost")
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	reGoVersion  = regexp.MustCompile(` \(go\d+([\d.])*\)$`)
+	reDevVersion = regexp.MustCompile(`~dev\d+$`)
+)
+
+// Return true if either a==b or the only difference is that one has a
+// " (go1.2.3)" suffix and the other does not.
+//
+// This allows us to recognize a non-Go (rails) service as the same
+// version as a Go service.
+func sameVersion(a, b string) bool {
+	// Strip " (go1.2.3)" suffix
+	a = reGoVersion.ReplaceAllLiteralString(a, "")
+	b = reGoVersion.ReplaceAllLiteralString(b, "")
+	anodev := reDevVersion.ReplaceAllLiteralString(a, "")
+	bnodev := reDevVersion.ReplaceAllLiteralString(b, "")
+	return anodev == bnodev && (a == anodev) == (b == bnodev)
+}
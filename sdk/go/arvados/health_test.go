@@ -0,0 +1,109 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&HealthSuite{})
+
+type HealthSuite struct{}
+
+func (*HealthSuite) TestSameVersion(c *check.C) {
+	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.1~dev20240610194320"), check.Equals, false)
+	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.1~dev20240610194320 (go1.21.10)"), check.Equals, false)
+	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.1~dev20240610194320 (go1.21.9)"), check.Equals, false)
+	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.0~dev20240610194320 (go1.21.9)"), check.Equals, true)
+	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.0~dev20240611211146 (go1.21.10)"), check.Equals, true)
+	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.0~dev20240611211146"), check.Equals, true)
+	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.0"), check.Equals, false)
+	c.Check(sameVersion("2.8.0~dev20240610194320", "2.8.0"), check.Equals, false)
+	c.Check(sameVersion("2.8.0", "2.8.0"), check.Equals, true)
+	c.Check(sameVersion("2.8.0", "2.8.1"), check.Equals, false)
+}
+
+func (*HealthSuite) TestIsLocalHost(c *check.C) {
+	c.Check(isLocalHost("Localhost"), check.Equals, true)
+	c.Check(isLocalHost("localhost"), check.Equals, true)
+	c.Check(isLocalHost("127.0.0.1"), check.Equals, true)
+	c.Check(isLocalHost("127.0.0.127"), check.Equals, true)
+	c.Check(isLocalHost("127.1.2.7"), check.Equals, true)
+	c.Check(isLocalHost("0.0.0.0"), check.Equals, true)
+	c.Check(isLocalHost("::1"), check.Equals, true)
+	c.Check(isLocalHost("1.2.3.4"), check.Equals, false)
+	c.Check(isLocalHost("1::1"), check.Equals, false)
+	c.Check(isLocalHost("example.com"), check.Equals, false)
+	c.Check(isLocalHost("127.0.0"), check.Equals, false)
+	c.Check(isLocalHost(""), check.Equals, false)
+}
+
+type versionHandler string
+
+func (v versionHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/_health/ping":
+		w.Write([]byte(`{"health":"OK"}`))
+	case "/metrics":
+		fmt.Fprintf(w, "arvados_version_running{version=%q} 1\n", string(v))
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (*HealthSuite) TestVersionSkewWithoutExpectedVersion(c *check.C) {
+	srv1 := httptest.NewServer(versionHandler("2.8.0 (go1.21.10)"))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(versionHandler("2.8.0"))
+	defer srv2.Close()
+
+	cluster := &Cluster{}
+	for _, svc := range []*Service{
+		&cluster.Services.Controller,
+		&cluster.Services.Keepstore,
+	} {
+		svc.InternalURLs = map[URL]ServiceInstance{}
+	}
+	addURL := func(svc *Service, s string) {
+		u, err := url.Parse(s)
+		c.Assert(err, check.IsNil)
+		svc.InternalURLs[URL(*u)] = ServiceInstance{}
+	}
+	addURL(&cluster.Services.Controller, srv1.URL+"/")
+	addURL(&cluster.Services.Keepstore, srv2.URL+"/")
+
+	agg := &HealthAggregator{Cluster: cluster}
+	resp := agg.ClusterHealth(context.Background())
+	for _, msg := range resp.Errors {
+		c.Check(msg, check.Not(check.Matches), `version mismatch.*`)
+	}
+	sh := resp.Services[ServiceNameController]
+	c.Check(sh.Health, check.Equals, "OK")
+	c.Check(sh.Versions, check.DeepEquals, []string{"2.8.0 (go1.21.10)"})
+	rt, err := sh.ResponseTime.Float64()
+	c.Check(err, check.IsNil)
+	c.Check(rt > 0, check.Equals, true)
+
+	srv3 := httptest.NewServer(versionHandler("2.7.2"))
+	defer srv3.Close()
+	addURL(&cluster.Services.Keepstore, srv3.URL+"/")
+	resp = (&HealthAggregator{Cluster: cluster}).ClusterHealth(context.Background())
+	c.Check(resp.Health, check.Equals, "ERROR")
+	c.Check(resp.Services[ServiceNameKeepstore].Versions, check.DeepEquals, []string{"2.7.2", "2.8.0"})
+	found := false
+	for _, msg := range resp.Errors {
+		if msg == "version mismatch: services are running 2 different versions: 2.7.2, 2.8.0 (go1.21.10)" ||
+			msg == "version mismatch: services are running 2 different versions: 2.7.2, 2.8.0" {
+			found = true
+		}
+	}
+	c.Check(found, check.Equals, true, check.Commentf("%q", resp.Errors))
+}
@@ -0,0 +1,213 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultIdentityCacheTTL         = time.Minute
+	DefaultIdentityCacheNegativeTTL = 10 * time.Second
+	DefaultIdentityCacheMaxEntries  = 1000
+)
+
+// An IdentityCache resolves API tokens to the records of the users
+// they belong to (via users/current), and caches the results, so
+// services that check the caller's identity on every request
+// (keep-web, keepproxy, etc.) don't make an API call each time.
+//
+// A user record is reused for TTL after it is fetched, unless the
+// user is inactive, in which case it is reused only for NegativeTTL
+// so an activated user doesn't have to wait long to be recognized.
+// A 401 or 403 error (the token is not valid, or its scopes don't
+// allow users/current) is also reused for NegativeTTL. Other errors
+// are not cached.
+//
+// Concurrent lookups of the same token share a single API call.
+//
+// The zero value is ready to use, with default settings. An
+// IdentityCache is safe for concurrent use by multiple goroutines.
+type IdentityCache struct {
+	// Time to reuse a user record. Zero means
+	// DefaultIdentityCacheTTL.
+	TTL time.Duration
+	// Time to reuse an inactive user record or an
+	// authentication error. Zero means
+	// DefaultIdentityCacheNegativeTTL.
+	NegativeTTL time.Duration
+	// Maximum number of tokens to remember. Zero means
+	// DefaultIdentityCacheMaxEntries.
+	MaxEntries int
+
+	mtx     sync.Mutex
+	entries map[identityCacheKey]*identityCacheEntry
+}
+
+type identityCacheKey struct {
+	apiHost string
+	token   string
+}
+
+type identityCacheEntry struct {
+	ready  chan struct{} // closed when user, err, and expire are set
+	user   User
+	err    error
+	expire time.Time
+}
+
+// CurrentUser returns the record of the user who owns the given
+// token, using the given client (whose own AuthToken is ignored) to
+// fetch it if needed.
+func (ic *IdentityCache) CurrentUser(ctx context.Context, client *Client, token string) (User, error) {
+	key := identityCacheKey{apiHost: client.APIHost, token: token}
+	for {
+		ic.mtx.Lock()
+		ent, ok := ic.entries[key]
+		if !ok {
+			ent = &identityCacheEntry{ready: make(chan struct{})}
+			ic.add(key, ent)
+			ic.mtx.Unlock()
+			ic.fetch(ctx, client, token, key, ent)
+			return ent.user, ent.err
+		}
+		ic.mtx.Unlock()
+		select {
+		case <-ent.ready:
+		case <-ctx.Done():
+			return User{}, ctx.Err()
+		}
+		if ent.expire.IsZero() {
+			// The lookup failed with an error that isn't
+			// cached. If it was only because the caller
+			// that started the lookup gave up, try again
+			// with our own context.
+			if ctx.Err() == nil && (errors.Is(ent.err, context.Canceled) || errors.Is(ent.err, context.DeadlineExceeded)) {
+				continue
+			}
+			return ent.user, ent.err
+		}
+		if ent.expire.After(time.Now()) {
+			return ent.user, ent.err
+		}
+		// Expired. Remove the entry (unless another goroutine
+		// has already replaced it) and try again.
+		ic.mtx.Lock()
+		if ic.entries[key] == ent {
+			delete(ic.entries, key)
+		}
+		ic.mtx.Unlock()
+	}
+}
+
+func (ic *IdentityCache) fetch(ctx context.Context, client *Client, token string, key identityCacheKey, ent *identityCacheEntry) {
+	defer close(ent.ready)
+	ctx = ContextWithAuthorization(ctx, "Bearer "+token)
+	ent.err = client.RequestAndDecodeContext(ctx, &ent.user, "GET", "arvados/v1/users/current", nil, nil)
+	var se interface{ HTTPStatus() int }
+	switch {
+	case ent.err == nil && ent.user.IsActive:
+		ent.expire = time.Now().Add(ic.ttl())
+	case ent.err == nil:
+		ent.expire = time.Now().Add(ic.negativeTTL())
+	case errors.As(ent.err, &se) && (se.HTTPStatus() == http.StatusUnauthorized || se.HTTPStatus() == http.StatusForbidden):
+		ent.user = User{}
+		ent.expire = time.Now().Add(ic.negativeTTL())
+	default:
+		// Don't cache other errors. Callers that are already
+		// waiting for this entry get the error, but the next
+		// lookup will try again.
+		ent.user = User{}
+		ic.mtx.Lock()
+		if ic.entries[key] == ent {
+			delete(ic.entries, key)
+		}
+		ic.mtx.Unlock()
+	}
+}
+
+// Invalidate forgets the given token, so the next lookup fetches the
+// user record again. It should be called when a request made with
+// the token fails in a way that suggests the token has been revoked
+// or the user's status has changed.
+func (ic *IdentityCache) Invalidate(token string) {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	for key := range ic.entries {
+		if key.token == token {
+			delete(ic.entries, key)
+		}
+	}
+}
+
+// InvalidateUser forgets all tokens belonging to the user with the
+// given UUID, e.g., after the user is deactivated.
+func (ic *IdentityCache) InvalidateUser(uuid string) {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	for key, ent := range ic.entries {
+		select {
+		case <-ent.ready:
+			if ent.user.UUID == uuid {
+				delete(ic.entries, key)
+			}
+		default:
+			// Lookup still in progress.
+		}
+	}
+}
+
+// add adds an entry, first making room if needed by removing expired
+// entries and then (if that isn't enough) the entries that expire
+// soonest. Caller must have lock.
+func (ic *IdentityCache) add(key identityCacheKey, ent *identityCacheEntry) {
+	if ic.entries == nil {
+		ic.entries = map[identityCacheKey]*identityCacheEntry{}
+	}
+	max := ic.MaxEntries
+	if max <= 0 {
+		max = DefaultIdentityCacheMaxEntries
+	}
+	if len(ic.entries) >= max {
+		now := time.Now()
+		var soonest identityCacheKey
+		var soonestExpire time.Time
+		for k, e := range ic.entries {
+			select {
+			case <-e.ready:
+			default:
+				// Lookup still in progress.
+				continue
+			}
+			if e.expire.Before(now) {
+				delete(ic.entries, k)
+			} else if soonestExpire.IsZero() || e.expire.Before(soonestExpire) {
+				soonest, soonestExpire = k, e.expire
+			}
+		}
+		if len(ic.entries) >= max && !soonestExpire.IsZero() {
+			delete(ic.entries, soonest)
+		}
+	}
+	ic.entries[key] = ent
+}
+
+func (ic *IdentityCache) ttl() time.Duration {
+	if ic.TTL > 0 {
+		return ic.TTL
+	}
+	return DefaultIdentityCacheTTL
+}
+
+func (ic *IdentityCache) negativeTTL() time.Duration {
+	if ic.NegativeTTL > 0 {
+		return ic.NegativeTTL
+	}
+	return DefaultIdentityCacheNegativeTTL
+}
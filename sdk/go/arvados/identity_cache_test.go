@@ -0,0 +1,188 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&identityCacheSuite{})
+
+type identityCacheSuite struct {
+	server *httptest.Server
+	client *Client
+	mtx    sync.Mutex
+	calls  map[string]int
+	// Responses by token: a user record, or an HTTP status.
+	users   map[string]User
+	release chan struct{}
+}
+
+func (s *identityCacheSuite) SetUpTest(c *check.C) {
+	s.calls = map[string]int{}
+	s.users = map[string]User{
+		"activetoken":   {UUID: "zzzzz-tpzed-000000000000001", Username: "active", IsActive: true},
+		"activetoken2":  {UUID: "zzzzz-tpzed-000000000000001", Username: "active", IsActive: true},
+		"inactivetoken": {UUID: "zzzzz-tpzed-000000000000002", Username: "inactive"},
+	}
+	s.release = nil
+	s.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/arvados/v1/users/current")
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		s.mtx.Lock()
+		s.calls[token]++
+		release := s.release
+		s.mtx.Unlock()
+		if release != nil {
+			<-release
+		}
+		switch token {
+		case "badtoken":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":["Not logged in"]}`))
+		case "scopedtoken":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["Token scope not allowed"]}`))
+		case "flakytoken":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errors":["Server error"]}`))
+		default:
+			json.NewEncoder(w).Encode(s.users[token])
+		}
+	}))
+	s.client = &Client{
+		APIHost:   strings.TrimPrefix(s.server.URL, "https://"),
+		AuthToken: "ignoredtoken",
+		Insecure:  true,
+	}
+}
+
+func (s *identityCacheSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func (s *identityCacheSuite) callCount(token string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.calls[token]
+}
+
+func (s *identityCacheSuite) TestCache(c *check.C) {
+	ic := &IdentityCache{TTL: time.Hour, NegativeTTL: time.Hour}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		user, err := ic.CurrentUser(ctx, s.client, "activetoken")
+		c.Check(err, check.IsNil)
+		c.Check(user.Username, check.Equals, "active")
+
+		_, err = ic.CurrentUser(ctx, s.client, "badtoken")
+		c.Check(err, check.ErrorMatches, `.*401.*`)
+
+		_, err = ic.CurrentUser(ctx, s.client, "scopedtoken")
+		c.Check(err, check.ErrorMatches, `.*403.*`)
+
+		// Other errors are not cached.
+		_, err = ic.CurrentUser(ctx, s.client, "flakytoken")
+		c.Check(err, check.ErrorMatches, `.*500.*`)
+	}
+	c.Check(s.callCount("activetoken"), check.Equals, 1)
+	c.Check(s.callCount("badtoken"), check.Equals, 1)
+	c.Check(s.callCount("scopedtoken"), check.Equals, 1)
+	c.Check(s.callCount("flakytoken"), check.Equals, 3)
+	c.Check(s.callCount("ignoredtoken"), check.Equals, 0)
+}
+
+func (s *identityCacheSuite) TestExpiry(c *check.C) {
+	ic := &IdentityCache{TTL: 100 * time.Millisecond, NegativeTTL: time.Millisecond}
+	ctx := context.Background()
+
+	// Inactive users expire after NegativeTTL.
+	for i := 0; i < 2; i++ {
+		user, err := ic.CurrentUser(ctx, s.client, "inactivetoken")
+		c.Check(err, check.IsNil)
+		c.Check(user.IsActive, check.Equals, false)
+		time.Sleep(2 * time.Millisecond)
+	}
+	c.Check(s.callCount("inactivetoken"), check.Equals, 2)
+
+	// Active users expire after TTL.
+	ic.CurrentUser(ctx, s.client, "activetoken")
+	ic.CurrentUser(ctx, s.client, "activetoken")
+	c.Check(s.callCount("activetoken"), check.Equals, 1)
+	time.Sleep(150 * time.Millisecond)
+	ic.CurrentUser(ctx, s.client, "activetoken")
+	c.Check(s.callCount("activetoken"), check.Equals, 2)
+}
+
+func (s *identityCacheSuite) TestInvalidate(c *check.C) {
+	ic := &IdentityCache{}
+	ctx := context.Background()
+	for _, token := range []string{"activetoken", "activetoken2", "inactivetoken"} {
+		_, err := ic.CurrentUser(ctx, s.client, token)
+		c.Check(err, check.IsNil)
+	}
+
+	ic.Invalidate("activetoken")
+	ic.CurrentUser(ctx, s.client, "activetoken")
+	ic.CurrentUser(ctx, s.client, "activetoken2")
+	c.Check(s.callCount("activetoken"), check.Equals, 2)
+	c.Check(s.callCount("activetoken2"), check.Equals, 1)
+
+	// The user is deactivated.
+	s.mtx.Lock()
+	s.users["activetoken"] = User{UUID: "zzzzz-tpzed-000000000000001", Username: "active"}
+	s.mtx.Unlock()
+	ic.InvalidateUser("zzzzz-tpzed-000000000000001")
+	user, err := ic.CurrentUser(ctx, s.client, "activetoken")
+	c.Check(err, check.IsNil)
+	c.Check(user.IsActive, check.Equals, false)
+	ic.CurrentUser(ctx, s.client, "activetoken2")
+	c.Check(s.callCount("activetoken"), check.Equals, 3)
+	c.Check(s.callCount("activetoken2"), check.Equals, 2)
+	c.Check(s.callCount("inactivetoken"), check.Equals, 1)
+}
+
+func (s *identityCacheSuite) TestConcurrentLookups(c *check.C) {
+	ic := &IdentityCache{}
+	s.release = make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := ic.CurrentUser(context.Background(), s.client, "activetoken")
+			c.Check(err, check.IsNil)
+			c.Check(user.Username, check.Equals, "active")
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(s.release)
+	wg.Wait()
+	c.Check(s.callCount("activetoken"), check.Equals, 1)
+}
+
+func (s *identityCacheSuite) TestMaxEntries(c *check.C) {
+	ic := &IdentityCache{MaxEntries: 2}
+	ctx := context.Background()
+	for _, token := range []string{"activetoken", "activetoken2", "inactivetoken"} {
+		_, err := ic.CurrentUser(ctx, s.client, token)
+		c.Check(err, check.IsNil)
+	}
+	c.Check(ic.entries, check.HasLen, 2)
+	// The inactive user's entry expires soonest, so it's the
+	// one removed to make room for the next token.
+	ic.CurrentUser(ctx, s.client, "badtoken")
+	c.Check(ic.entries, check.HasLen, 2)
+	ic.CurrentUser(ctx, s.client, "activetoken2")
+	c.Check(s.callCount("activetoken2"), check.Equals, 1)
+}
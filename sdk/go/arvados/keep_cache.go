@@ -44,6 +44,64 @@ type DiskCache struct {
 	MaxSize ByteSizeOrPercent
 	Logger  logrus.FieldLogger
 
+	// If VerifyCachedReads is true, data read from cache files
+	// that were written by a different process (or before a
+	// crash) is verified against per-extent checksums recorded
+	// when the cache file was filled. Cache files that fail
+	// verification are fetched again from the backend.
+	//
+	// This requires the cache filesystem to support user
+	// extended attributes.
+	VerifyCachedReads bool
+
+	// If MinFreeSpace is non-zero, cache files are deleted as
+	// needed to keep at least this much space (or percentage of
+	// filesystem capacity) available on the cache filesystem,
+	// even if the cache is smaller than MaxSize. This is useful
+	// when the filesystem is shared with other programs.
+	//
+	// If available space drops below half of MinFreeSpace, new
+	// blocks are read from and written to the wrapped
+	// KeepGateway without being added to the cache.
+	MinFreeSpace ByteSizeOrPercent
+
+	// Cache files are deleted when the cache size exceeds
+	// TidyHighWater × MaxSize, until it is below TidyLowWater ×
+	// MaxSize. Leaving a gap between the two avoids frequent
+	// small cleanups when many blocks are being written.
+	//
+	// If TidyHighWater is zero, 1.0 is used. If TidyLowWater is
+	// zero, 95% of TidyHighWater is used.
+	TidyHighWater float64
+	TidyLowWater  float64
+
+	// If TidyHoldDuration is non-zero, a cleanup is not started
+	// until this long after the previous cleanup finished,
+	// unless available space is below MinFreeSpace.
+	TidyHoldDuration time.Duration
+
+	// If TidyInterval is non-zero, cleanups run every
+	// TidyInterval instead of being triggered by reads and
+	// writes (except when available space is below
+	// MinFreeSpace).
+	TidyInterval time.Duration
+
+	// If RecordReuseDistances is true, the cache records a
+	// histogram of block reuse distances, which can be used to
+	// estimate the hit rate that would be achieved with a
+	// different MaxSize (see EstimatedHitRate). The histogram is
+	// saved in the cache directory, accumulating data across
+	// restarts, and estimates are logged periodically.
+	RecordReuseDistances bool
+
+	// ReadOnlyDirs are additional cache directories, such as a
+	// set of popular reference data blocks baked into a compute
+	// node image, that are consulted before Dir and the wrapped
+	// KeepGateway. They use the same layout as Dir, and are
+	// never modified. A file whose size does not match the
+	// requested locator is ignored.
+	ReadOnlyDirs []string
+
 	*sharedCache
 	setupOnce sync.Once
 }
@@ -61,11 +119,28 @@ var (
 // keep-web) uses multiple KeepGateway stacks that use different auth
 // tokens, etc.
 type sharedCache struct {
-	dir     string
-	maxSize ByteSizeOrPercent
+	dir          string
+	maxSize      ByteSizeOrPercent
+	minFreeSpace ByteSizeOrPercent
+	highWater    float64
+	lowWater     float64
+	tidyHold     time.Duration
+	tidyInterval time.Duration
+
+	// Stub for testing. If nil, unix.Statfs is used.
+	statfs func(path string, buf *unix.Statfs_t) error
 
 	tidying        int32 // see tidy()
 	defaultMaxSize int64
+	noXattr        int32 // extended attributes are not supported, see saveExtentSums()
+
+	// Block reuse distances, if RecordReuseDistances is
+	// enabled. See keep_cache_reuse.go.
+	reuse *reuseTracker
+
+	// Cache file access times, if the filesystem doesn't update
+	// them on every read. See keep_cache_atime.go.
+	atimes *accessTracker
 
 	// The "heldopen" fields are used to open cache files for
 	// reading, and leave them open for future/concurrent ReadAt
@@ -82,10 +157,16 @@ type sharedCache struct {
 	writingCond *sync.Cond
 	writingLock sync.Mutex
 
+	// Files found (or not found) in ReadOnlyDirs, keyed by
+	// path. See keep_cache_readonly.go.
+	readonly     map[string]*openFileEnt
+	readonlyLock sync.Mutex
+
 	sizeMeasured    int64 // actual size on disk after last tidy(); zero if not measured yet
 	sizeEstimated   int64 // last measured size, plus files we have written since
 	lastFileCount   int64 // number of files on disk at last count
 	writesSinceTidy int64 // number of files written since last tidy()
+	lastTidy        int64 // time last tidy() finished (unix nanoseconds)
 }
 
 type writeprogress struct {
@@ -101,6 +182,12 @@ type openFileEnt struct {
 	sync.RWMutex
 	f   *os.File
 	err error // if err is non-nil, f should not be used.
+
+	// Extent checksums (see VerifyCachedReads), and which
+	// extents have been verified since f was opened.
+	sums       []uint32
+	verified   []bool
+	verifyLock sync.Mutex
 }
 
 const (
@@ -112,13 +199,45 @@ func (cache *DiskCache) setup() {
 	sharedCachesLock.Lock()
 	defer sharedCachesLock.Unlock()
 	dir := cache.Dir
+	startTimer := false
 	if sharedCaches[dir] == nil {
 		cache.debugf("initializing sharedCache using %s with max size %d", dir, cache.MaxSize)
-		sharedCaches[dir] = &sharedCache{dir: dir, maxSize: cache.MaxSize}
+		highWater, lowWater := cache.TidyHighWater, cache.TidyLowWater
+		if highWater <= 0 {
+			highWater = 1
+		}
+		if lowWater <= 0 {
+			lowWater = highWater * 0.95
+		} else if lowWater > highWater {
+			lowWater = highWater
+		}
+		sharedCaches[dir] = &sharedCache{
+			dir:          dir,
+			maxSize:      cache.MaxSize,
+			minFreeSpace: cache.MinFreeSpace,
+			highWater:    highWater,
+			lowWater:     lowWater,
+			tidyHold:     cache.TidyHoldDuration,
+			tidyInterval: cache.TidyInterval,
+		}
+		startTimer = cache.TidyInterval > 0
+		if cache.RecordReuseDistances {
+			sc := sharedCaches[dir]
+			sc.reuse = newReuseTracker(reuseTrackMax)
+			hist, err := loadReuseHistogram(dir)
+			if err != nil {
+				cache.debugf("ignoring unreadable %s: %s", reuseHistogramFile, err)
+			}
+			sc.reuse.saved = hist
+		}
+		cache.setupAccessTracker(sharedCaches[dir])
 	} else {
 		cache.debugf("using existing sharedCache using %s with max size %d (would have initialized with %d)", dir, sharedCaches[dir].maxSize, cache.MaxSize)
 	}
 	cache.sharedCache = sharedCaches[dir]
+	if startTimer {
+		go cache.runTidyTimer()
+	}
 }
 
 func (cache *DiskCache) cacheFile(locator string) string {
@@ -154,6 +273,52 @@ func (cache *DiskCache) rename(old, new string) error {
 	return os.Rename(old, new)
 }
 
+// freeSpace returns the available space and total capacity of the
+// cache filesystem.
+func (cache *DiskCache) freeSpace() (avail, total int64, err error) {
+	statfs := cache.statfs
+	if statfs == nil {
+		statfs = unix.Statfs
+	}
+	var stat unix.Statfs_t
+	err = statfs(cache.dir, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(stat.Bavail) * stat.Bsize, int64(stat.Blocks) * stat.Bsize, nil
+}
+
+// freeSpaceShortfall returns the number of bytes that need to be
+// freed on the cache filesystem to satisfy MinFreeSpace (zero if
+// MinFreeSpace is satisfied or not configured), and MinFreeSpace
+// in bytes.
+func (cache *DiskCache) freeSpaceShortfall() (shortfall, minfree int64) {
+	if cache.minFreeSpace == 0 {
+		return 0, 0
+	}
+	avail, total, err := cache.freeSpace()
+	if err != nil {
+		cache.debugf("statfs(%s) failed: %s", cache.dir, err)
+		return 0, 0
+	}
+	minfree = int64(cache.minFreeSpace.ByteSize())
+	if minfree == 0 {
+		minfree = total * cache.minFreeSpace.Percent() / 100
+	}
+	if avail >= minfree {
+		return 0, minfree
+	}
+	return minfree - avail, minfree
+}
+
+// spaceCritical returns true if available space on the cache
+// filesystem is below half of MinFreeSpace, in which case new blocks
+// should not be added to the cache.
+func (cache *DiskCache) spaceCritical() bool {
+	shortfall, minfree := cache.freeSpaceShortfall()
+	return shortfall > minfree/2
+}
+
 func (cache *DiskCache) debugf(format string, args ...interface{}) {
 	logger := cache.Logger
 	if logger == nil {
@@ -166,6 +331,11 @@ func (cache *DiskCache) debugf(format string, args ...interface{}) {
 // possible) retains a copy of the written block in the cache.
 func (cache *DiskCache) BlockWrite(ctx context.Context, opts BlockWriteOptions) (BlockWriteResponse, error) {
 	cache.setupOnce.Do(cache.setup)
+	if cache.spaceCritical() {
+		cache.debugf("BlockWrite: not caching, free space on %s is critically low", cache.dir)
+		cache.gotidy()
+		return cache.KeepGateway.BlockWrite(ctx, opts)
+	}
 	unique := fmt.Sprintf("%x.%p%s", os.Getpid(), &opts, tmpFileSuffix)
 	tmpfilename := filepath.Join(cache.dir, "tmp", unique)
 	tmpfile, err := cache.openFile(tmpfilename, os.O_CREATE|os.O_EXCL|os.O_RDWR)
@@ -202,7 +372,8 @@ func (cache *DiskCache) BlockWrite(ctx context.Context, opts BlockWriteOptions)
 		}
 
 		hashcheck := md5.New()
-		n, err := io.Copy(io.MultiWriter(tmpfile, pipewriter, hashcheck), src)
+		extents := &extentHasher{}
+		n, err := io.Copy(io.MultiWriter(tmpfile, pipewriter, hashcheck, extents), src)
 		if err != nil {
 			copyerr <- err
 			cancel()
@@ -228,12 +399,16 @@ func (cache *DiskCache) BlockWrite(ctx context.Context, opts BlockWriteOptions)
 			cancel()
 			return
 		}
+		if cache.VerifyCachedReads {
+			cache.saveExtentSums(tmpfilename, extents.Sums())
+		}
 		cachefilename := cache.cacheFile(hash)
 		err = cache.rename(tmpfilename, cachefilename)
 		if err != nil {
 			cache.debugf("BlockWrite: rename(%s, %s) failed: %s", tmpfilename, cachefilename, err)
 		}
 		atomic.AddInt64(&cache.sizeEstimated, int64(n))
+		cache.recordReuse(fmt.Sprintf("%s+%d", hash, n))
 		cache.gotidy()
 	}()
 
@@ -279,14 +454,84 @@ func (fw funcwriter) Write(p []byte) (int, error) {
 // cache. The remainder of the block may continue to be copied into
 // the cache in the background.
 func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, error) {
+	return cache.readAt(locator, dst, offset, false)
+}
+
+// ReadAtPartial is like ReadAt, except that it returns as soon as
+// any data at the requested offset is available in the cache. If
+// the rest of the block is still being fetched from the wrapped
+// KeepGateway, the returned count may be less than len(dst), with a
+// nil error.
+//
+// This allows a caller like keep-web to start serving a range
+// request with the data that is already cached, instead of waiting
+// for the entire range to arrive.
+func (cache *DiskCache) ReadAtPartial(locator string, dst []byte, offset int) (int, error) {
+	return cache.readAt(locator, dst, offset, true)
+}
+
+// BlockRange is a contiguous range of bytes within a block.
+type BlockRange struct {
+	Offset int
+	Length int
+}
+
+// CachedRanges returns the byte ranges of the indicated block that
+// are currently available in the cache, without fetching anything
+// from the wrapped KeepGateway. The result is nil if no part of the
+// block is cached.
+//
+// The result is advisory: cache entries can be added or evicted at
+// any time.
+func (cache *DiskCache) CachedRanges(locator string) []BlockRange {
+	cache.setupOnce.Do(cache.setup)
+	if size := cache.readOnlySize(locator); size > 0 {
+		return []BlockRange{{Offset: 0, Length: size}}
+	}
+	cachefilename := cache.cacheFile(locator)
+	cache.writingLock.Lock()
+	progress := cache.writing[cachefilename]
+	cache.writingLock.Unlock()
+	if progress != nil {
+		progress.cond.L.Lock()
+		size, done, err := progress.size, progress.done, progress.err
+		progress.cond.L.Unlock()
+		if !done {
+			if size == 0 {
+				return nil
+			}
+			return []BlockRange{{Offset: 0, Length: size}}
+		} else if err != nil {
+			return nil
+		}
+	}
+	fi, err := os.Stat(cachefilename)
+	if err != nil || fi.Size() == 0 {
+		return nil
+	}
+	return []BlockRange{{Offset: 0, Length: int(fi.Size())}}
+}
+
+// readAt implements ReadAt and ReadAtPartial.
+func (cache *DiskCache) readAt(locator string, dst []byte, offset int, partial bool) (int, error) {
 	cache.setupOnce.Do(cache.setup)
+	cache.recordReuse(locator)
+	if n, found, err := cache.readOnlyReadAt(locator, dst, offset); found {
+		return n, err
+	}
 	cachefilename := cache.cacheFile(locator)
-	if n, err := cache.quickReadAt(cachefilename, dst, offset); err == nil {
+	cache.atimes.touch(cachefilename)
+	if n, err := cache.quickReadAt(cachefilename, dst, offset, partial); err == nil {
 		return n, nil
 	}
 
 	cache.writingLock.Lock()
 	progress := cache.writing[cachefilename]
+	if progress == nil && cache.spaceCritical() {
+		cache.writingLock.Unlock()
+		cache.gotidy()
+		return cache.readAtUncached(locator, dst, offset)
+	}
 	if progress == nil {
 		// Nobody else is fetching from backend, so we'll add
 		// a new entry to cache.writing, fetch in a separate
@@ -305,10 +550,16 @@ func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, err
 		go func() {
 			var size int
 			var err error
+			extents := &extentHasher{}
 			defer func() {
 				if err == nil && progress.sharedf != nil {
 					err = progress.sharedf.Sync()
 				}
+				if err == nil && cache.VerifyCachedReads {
+					sums := extents.Sums()
+					cache.saveExtentSums(cachefilename, sums)
+					cache.setHeldopenSums(cachefilename, sums)
+				}
 				progress.cond.L.Lock()
 				progress.err = err
 				progress.done = true
@@ -348,6 +599,7 @@ func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, err
 				WriteTo: funcwriter(func(p []byte) (int, error) {
 					n, err := progress.sharedf.Write(p)
 					if n > 0 {
+						extents.Write(p[:n])
 						progress.cond.L.Lock()
 						progress.size += n
 						progress.cond.L.Unlock()
@@ -367,9 +619,12 @@ func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, err
 	cache.writingLock.Unlock()
 
 	progress.cond.L.Lock()
-	for !progress.done && progress.size < len(dst)+offset {
+	for !progress.done && progress.size < readAtWant(dst, offset, partial) {
 		progress.cond.Wait()
 	}
+	if !progress.done && partial && progress.size < len(dst)+offset {
+		dst = dst[:progress.size-offset]
+	}
 	sharedf := progress.sharedf
 	err := progress.err
 	progress.cond.L.Unlock()
@@ -395,6 +650,48 @@ func (cache *DiskCache) ReadAt(locator string, dst []byte, offset int) (int, err
 	return sharedf.ReadAt(dst, int64(offset))
 }
 
+var errReadAtUncachedDone = errors.New("done")
+
+// readAtUncached reads the requested portion of a block from the
+// wrapped KeepGateway without adding it to the cache.
+func (cache *DiskCache) readAtUncached(locator string, dst []byte, offset int) (int, error) {
+	n, pos := 0, 0
+	_, err := cache.KeepGateway.BlockRead(context.Background(), BlockReadOptions{
+		Locator: locator,
+		WriteTo: funcwriter(func(p []byte) (int, error) {
+			if end := pos + len(p); end > offset {
+				start := 0
+				if offset > pos {
+					start = offset - pos
+				}
+				n += copy(dst[n:], p[start:])
+			}
+			pos += len(p)
+			if n == len(dst) {
+				// Stop reading from the backend.
+				return len(p), errReadAtUncachedDone
+			}
+			return len(p), nil
+		})})
+	if err != nil && !errors.Is(err, errReadAtUncachedDone) {
+		return 0, err
+	}
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readAtWant returns the number of bytes that must be available in
+// a cache file (that is still being written) before a ReadAt call
+// can proceed.
+func readAtWant(dst []byte, offset int, partial bool) int {
+	if partial && len(dst) > 0 {
+		return offset + 1
+	}
+	return offset + len(dst)
+}
+
 var quickReadAtLostRace = errors.New("quickReadAt: lost race")
 
 // Remove the cache entry for the indicated cachefilename if it
@@ -432,7 +729,7 @@ func (cache *DiskCache) deleteHeldopen(cachefilename string, expect *openFileEnt
 // quickReadAt doesn't try especially hard to ensure success in
 // races. In particular, when there are concurrent calls, and one
 // fails, that can cause others to fail too.
-func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int) (int, error) {
+func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int, partial bool) (int, error) {
 	isnew := false
 	cache.heldopenLock.Lock()
 	if cache.heldopenMax == 0 {
@@ -490,6 +787,11 @@ func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int
 			err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
 			if err == nil {
 				heldopen.f = f
+				if cache.VerifyCachedReads {
+					heldopen.verifyLock.Lock()
+					heldopen.sums = loadExtentSums(f)
+					heldopen.verifyLock.Unlock()
+				}
 			} else {
 				f.Close()
 			}
@@ -521,9 +823,12 @@ func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int
 	cache.writingLock.Unlock()
 	if progress != nil {
 		progress.cond.L.Lock()
-		for !progress.done && progress.size < len(dst)+offset {
+		for !progress.done && progress.size < readAtWant(dst, offset, partial) {
 			progress.cond.Wait()
 		}
+		if !progress.done && partial && progress.size < len(dst)+offset {
+			dst = dst[:progress.size-offset]
+		}
 		progress.cond.L.Unlock()
 		// If size<needed && progress.err!=nil here, we'll end
 		// up reporting a less helpful "EOF reading from cache
@@ -533,6 +838,16 @@ func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int
 		// error, it just retries.
 	}
 
+	if cache.VerifyCachedReads && progress == nil && atomic.LoadInt32(&cache.noXattr) == 0 {
+		// The file was not written by a goroutine in this
+		// process, so it might have been torn by a crash.
+		if err := cache.verifyExtents(heldopen, offset, len(dst)); err != nil {
+			cache.debugf("quickReadAt: %s: %s", cachefilename, err)
+			go cache.deleteHeldopen(cachefilename, heldopen)
+			return 0, err
+		}
+	}
+
 	n, err := heldopen.f.ReadAt(dst, int64(offset))
 	if err != nil {
 		// wait for any concurrent users to finish, then
@@ -544,8 +859,15 @@ func (cache *DiskCache) quickReadAt(cachefilename string, dst []byte, offset int
 }
 
 // BlockRead reads an entire block using a 128 KiB buffer.
+//
+// If opts.LocalLocator is not nil, the block is read directly from
+// the wrapped KeepGateway (bypassing the cache) so the backend can
+// supply the local locator.
 func (cache *DiskCache) BlockRead(ctx context.Context, opts BlockReadOptions) (int, error) {
 	cache.setupOnce.Do(cache.setup)
+	if opts.LocalLocator != nil {
+		return cache.KeepGateway.BlockRead(ctx, opts)
+	}
 	i := strings.Index(opts.Locator, "+")
 	if i < 0 || i >= len(opts.Locator) {
 		return 0, errors.New("invalid block locator: no size hint")
@@ -559,6 +881,12 @@ func (cache *DiskCache) BlockRead(ctx context.Context, opts BlockReadOptions) (i
 	if err != nil || blocksize < 0 {
 		return 0, errors.New("invalid block locator: invalid size hint")
 	}
+	if _, err := os.Stat(cache.cacheFile(opts.Locator)); err != nil && cache.readOnlyEnt(opts.Locator) == nil && cache.spaceCritical() {
+		// Read the whole block straight through, rather
+		// than calling readAtUncached for each chunk.
+		cache.gotidy()
+		return cache.KeepGateway.BlockRead(ctx, opts)
+	}
 
 	offset := 0
 	buf := make([]byte, 131072)
@@ -594,13 +922,21 @@ func (cache *DiskCache) gotidy() {
 		atomic.AddInt32(&cache.tidying, -1)
 		return
 	}
+	// Skip if tidy runs on a timer, or the previous tidy
+	// finished less than tidyHold ago -- unless we're short of
+	// free space.
+	if (cache.tidyInterval > 0 || cache.tidyHeld()) && !cache.lowFreeSpace() {
+		atomic.AddInt32(&cache.tidying, -1)
+		return
+	}
 	// Skip if sizeEstimated is based on an actual measurement and
-	// is below maxSize, and we haven't done very many writes
-	// since last tidy (defined as 1% of number of cache files at
-	// last count).
+	// is below the high-water mark, and we haven't done very many
+	// writes since last tidy (defined as 1% of number of cache
+	// files at last count).
 	if cache.sizeMeasured > 0 &&
-		atomic.LoadInt64(&cache.sizeEstimated) < atomic.LoadInt64(&cache.defaultMaxSize) &&
-		writes < cache.lastFileCount/100 {
+		atomic.LoadInt64(&cache.sizeEstimated) < int64(float64(atomic.LoadInt64(&cache.defaultMaxSize))*cache.highWater) &&
+		writes < cache.lastFileCount/100 &&
+		!cache.lowFreeSpace() {
 		atomic.AddInt32(&cache.tidying, -1)
 		return
 	}
@@ -611,8 +947,39 @@ func (cache *DiskCache) gotidy() {
 	}()
 }
 
+// tidyHeld returns true if the last tidy finished less than
+// tidyHold ago.
+func (cache *DiskCache) tidyHeld() bool {
+	return cache.tidyHold > 0 &&
+		time.Since(time.Unix(0, atomic.LoadInt64(&cache.lastTidy))) < cache.tidyHold
+}
+
+// runTidyTimer calls tidy() every tidyInterval, for the life of the
+// program.
+func (cache *DiskCache) runTidyTimer() {
+	ticker := time.NewTicker(cache.tidyInterval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		if atomic.AddInt32(&cache.tidying, 1) == 1 {
+			cache.tidy()
+			atomic.StoreInt64(&cache.writesSinceTidy, 0)
+		}
+		atomic.AddInt32(&cache.tidying, -1)
+	}
+}
+
+// lowFreeSpace returns true if available space on the cache
+// filesystem is below MinFreeSpace.
+func (cache *DiskCache) lowFreeSpace() bool {
+	shortfall, _ := cache.freeSpaceShortfall()
+	return shortfall > 0
+}
+
 // Delete cache files as needed to control disk usage.
 func (cache *DiskCache) tidy() {
+	defer func() {
+		atomic.StoreInt64(&cache.lastTidy, time.Now().UnixNano())
+	}()
 	maxsize := int64(cache.maxSize.ByteSize())
 	if maxsize < 1 {
 		maxsize = atomic.LoadInt64(&cache.defaultMaxSize)
@@ -647,6 +1014,11 @@ func (cache *DiskCache) tidy() {
 	if err != nil {
 		return
 	}
+	defer cache.saveReuseHistogram(maxsize)
+
+	// Make sure the atimes we check below reflect recent reads,
+	// even if the filesystem doesn't update them.
+	cache.atimes.flush()
 
 	type entT struct {
 		path  string
@@ -668,8 +1040,9 @@ func (cache *DiskCache) tidy() {
 		}
 		var atime time.Time
 		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
-			// Access time is available (hopefully the
-			// filesystem is not mounted with noatime)
+			// Access time is available (and either the
+			// filesystem updates it on every read, or
+			// cache.atimes does)
 			atime = time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
 		} else {
 			// If access time isn't available we fall back
@@ -701,24 +1074,33 @@ func (cache *DiskCache) tidy() {
 		return
 	}
 
-	// If we're below MaxSize or there's only one block in the
-	// cache, just update the usage estimate and return.
+	// If we're below the high-water mark and MinFreeSpace is
+	// satisfied, or there's only one block in the cache, just
+	// update the usage estimate and return.
 	//
 	// (We never delete the last block because that would merely
 	// cause the same block to get re-fetched repeatedly from the
 	// backend.)
-	if totalsize <= maxsize || len(ents) == 1 {
+	shortfall, minfree := cache.freeSpaceShortfall()
+	if (totalsize <= int64(float64(maxsize)*cache.highWater) && shortfall == 0) || len(ents) == 1 {
 		atomic.StoreInt64(&cache.sizeMeasured, totalsize)
 		atomic.StoreInt64(&cache.sizeEstimated, totalsize)
 		cache.lastFileCount = int64(len(ents))
 		return
 	}
 
-	// Set a new size target of maxsize minus 5%.  This makes some
-	// room for sizeEstimate to grow before it triggers another
-	// tidy. We don't want to walk/sort an entire large cache
-	// directory each time we write a block.
-	target := maxsize - (maxsize / 20)
+	// Set a new size target at the low-water mark (by default,
+	// maxsize minus 5%).  This makes some room for sizeEstimate
+	// to grow before it triggers another tidy. We don't want to
+	// walk/sort an entire large cache directory each time we
+	// write a block.
+	target := int64(float64(maxsize) * cache.lowWater)
+	if shortfall > 0 {
+		// Likewise, free 5% more than MinFreeSpace requires.
+		if t := totalsize - shortfall - minfree/20; t < target {
+			target = t
+		}
+	}
 
 	// Delete oldest entries until totalsize < target or we're
 	// down to a single cached block.
@@ -0,0 +1,127 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// How often recorded access times are written to the cache files,
+// so other processes using the same cache directory see them, even
+// if this process doesn't do any tidying.
+const atimeFlushInterval = time.Minute
+
+// accessTracker records when cache files were last read, for use
+// on filesystems that don't update a file's atime every time it is
+// read (i.e., mounted with noatime or relatime, which is the
+// default on Linux). Without it, tidy would evict frequently read
+// blocks as if they had not been used since they were first read.
+//
+// The recorded times are written to the cache files' atime fields
+// explicitly, which works regardless of mount options, before each
+// tidy and every atimeFlushInterval.
+type accessTracker struct {
+	mtx       sync.Mutex
+	times     map[string]time.Time // cache file path => last read
+	lastFlush time.Time
+	flushing  bool
+}
+
+// touch records that the given cache file was read just now. It is
+// safe to call on a nil accessTracker.
+func (at *accessTracker) touch(path string) {
+	if at == nil {
+		return
+	}
+	now := time.Now()
+	at.mtx.Lock()
+	defer at.mtx.Unlock()
+	if at.times == nil {
+		at.times = map[string]time.Time{}
+		at.lastFlush = now
+	}
+	at.times[path] = now
+	if !at.flushing && now.Sub(at.lastFlush) > atimeFlushInterval {
+		at.flushing = true
+		go at.flush()
+	}
+}
+
+// flush sets the atime of each recorded file, leaving its mtime
+// unchanged, and forgets the recorded times. Files that have been
+// deleted are skipped. It is safe to call on a nil accessTracker.
+func (at *accessTracker) flush() {
+	if at == nil {
+		return
+	}
+	at.mtx.Lock()
+	times := at.times
+	at.times = nil
+	at.lastFlush = time.Now()
+	at.flushing = false
+	at.mtx.Unlock()
+	for path, t := range times {
+		unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{
+			unix.NsecToTimespec(t.UnixNano()),
+			{Nsec: unix.UTIME_OMIT},
+		}, 0)
+	}
+}
+
+// atimeUpdatedOnRead returns true if the filesystem containing dir
+// updates a file's atime every time the file is read, i.e., it is
+// mounted with strictatime.
+//
+// It checks by reading a file whose atime is later than its mtime
+// and ctime: a relatime mount doesn't update the atime in this case,
+// and a noatime mount never does. The ctime is necessarily the
+// current time, so the atime has to be set in the future.
+func atimeUpdatedOnRead(dir string) bool {
+	f, err := os.CreateTemp(dir, "atime-probe-*"+tmpFileSuffix)
+	if err != nil {
+		return false
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write([]byte{0}); err != nil {
+		return false
+	}
+	now := time.Now()
+	atime := now.Add(time.Hour)
+	if err := os.Chtimes(f.Name(), atime, now.Add(-time.Hour)); err != nil {
+		return false
+	}
+	if _, err := f.ReadAt(make([]byte, 1), 0); err != nil {
+		return false
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return !time.Unix(stat.Atim.Sec, stat.Atim.Nsec).Equal(atime)
+}
+
+// setupAccessTracker enables access time tracking in sc if the
+// cache filesystem doesn't update atimes on every read.
+func (cache *DiskCache) setupAccessTracker(sc *sharedCache) {
+	dir := filepath.Join(sc.dir, "tmp")
+	os.MkdirAll(dir, 0700)
+	if atimeUpdatedOnRead(dir) {
+		cache.debugf("cache filesystem updates atime on every read")
+		return
+	}
+	cache.debugf("cache filesystem does not update atime on every read; tracking access times explicitly")
+	sc.atimes = &accessTracker{}
+}
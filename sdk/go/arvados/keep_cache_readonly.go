@@ -0,0 +1,136 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Files in DiskCache.ReadOnlyDirs use the same layout as the writable
+// cache directory ({dir}/{hash[:3]}/{hash}.keepcacheblock), so a
+// pre-seeded directory can be made by copying a populated cache
+// directory (e.g., into a compute node image). They are never
+// written, tidied, or deleted.
+
+// Maximum number of read-only cache lookups (hits and misses) to
+// remember. When exceeded, all held-open files are closed and
+// forgotten.
+const readOnlyHeldopenMax = 1000
+
+var errReadOnlyMissing = errors.New("block not found in read-only cache dirs")
+
+// readOnlyReadAt reads from the indicated block's file in one of
+// ReadOnlyDirs. If the block is not present in any of them, found is
+// false.
+func (cache *DiskCache) readOnlyReadAt(locator string, dst []byte, offset int) (n int, found bool, err error) {
+	ent := cache.readOnlyEnt(locator)
+	if ent == nil {
+		return 0, false, nil
+	}
+	ent.RLock()
+	defer ent.RUnlock()
+	if ent.f == nil {
+		// Closed by a concurrent cleanup after we found
+		// it. Fall back to the writable cache.
+		return 0, false, nil
+	}
+	n, err = ent.f.ReadAt(dst, int64(offset))
+	return n, true, err
+}
+
+// readOnlySize returns the size of the indicated block's file in one
+// of ReadOnlyDirs, or 0 if none of them has it.
+func (cache *DiskCache) readOnlySize(locator string) int {
+	ent := cache.readOnlyEnt(locator)
+	if ent == nil {
+		return 0
+	}
+	ent.RLock()
+	defer ent.RUnlock()
+	if ent.f == nil {
+		return 0
+	}
+	fi, err := ent.f.Stat()
+	if err != nil {
+		return 0
+	}
+	return int(fi.Size())
+}
+
+// readOnlyEnt returns an open file entry for the indicated block in
+// one of ReadOnlyDirs, or nil if none of them has it.
+func (cache *DiskCache) readOnlyEnt(locator string) *openFileEnt {
+	if len(cache.ReadOnlyDirs) == 0 || len(locator) < 32 {
+		return nil
+	}
+	hash := locator[:32]
+	for _, dir := range cache.ReadOnlyDirs {
+		path := filepath.Join(dir, hash[:3], hash+cacheFileSuffix)
+		cache.readonlyLock.Lock()
+		ent, ok := cache.readonly[path]
+		cache.readonlyLock.Unlock()
+		if !ok {
+			ent = cache.openReadOnly(path, locator)
+			cache.readonlyLock.Lock()
+			if existing, ok := cache.readonly[path]; ok {
+				// Another goroutine got here first.
+				if ent.f != nil {
+					ent.f.Close()
+				}
+				ent = existing
+			} else {
+				if len(cache.readonly) >= readOnlyHeldopenMax {
+					go func(m map[string]*openFileEnt) {
+						for _, ent := range m {
+							ent.Lock()
+							if ent.f != nil {
+								ent.f.Close()
+								ent.f = nil
+							}
+							ent.Unlock()
+						}
+					}(cache.readonly)
+					cache.readonly = nil
+				}
+				if cache.readonly == nil {
+					cache.readonly = map[string]*openFileEnt{}
+				}
+				cache.readonly[path] = ent
+			}
+			cache.readonlyLock.Unlock()
+		}
+		if ent.err == nil {
+			return ent
+		}
+	}
+	return nil
+}
+
+// openReadOnly opens the given file in a read-only cache dir, and
+// checks that its size matches the locator's size hint (if any).
+// The returned entry's err is non-nil if the file cannot be used.
+func (cache *DiskCache) openReadOnly(path, locator string) *openFileEnt {
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			cache.debugf("read-only cache: %s", err)
+		}
+		return &openFileEnt{err: errReadOnlyMissing}
+	}
+	if parts := strings.SplitN(locator, "+", 3); len(parts) > 1 {
+		size, err := strconv.ParseInt(parts[1], 10, 64)
+		fi, staterr := f.Stat()
+		if err == nil && (staterr != nil || fi.Size() != size) {
+			cache.debugf("read-only cache: ignoring %s: size does not match locator %s", path, locator)
+			f.Close()
+			return &openFileEnt{err: errReadOnlyMissing}
+		}
+	}
+	return &openFileEnt{f: f}
+}
@@ -0,0 +1,319 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Reuse histogram, accumulated across processes using the
+	// same cache directory. Its name doesn't end in
+	// cacheFileSuffix or tmpFileSuffix, so tidy() leaves it
+	// alone.
+	reuseHistogramFile = "reuse-histogram.json"
+
+	// Accesses to the same block less than reuseAccessWindow
+	// apart (e.g., BlockRead reading a block in 128 KiB chunks)
+	// count as a single access.
+	reuseAccessWindow = time.Second
+
+	// Number of distinct blocks to track. When more blocks than
+	// this have been accessed, the least recently used ones are
+	// forgotten, and the next access to one of them counts as a
+	// cold miss.
+	reuseTrackMax = 1 << 16
+
+	// Minimum interval between log entries reporting estimated
+	// hit rates.
+	reuseLogInterval = time.Hour
+)
+
+// reuseHistogram counts block accesses by reuse distance: the total
+// size of the distinct blocks accessed since the previous access to
+// the same block, plus the size of the block itself. An access with
+// reuse distance d would be a hit in an LRU cache of size d or
+// larger.
+type reuseHistogram struct {
+	// Accesses to blocks that had not been accessed before (or
+	// not recently enough to still be tracked).
+	Cold int64
+
+	// Buckets[i] counts accesses with reuse distance in
+	// [2^i, 2^(i+1)) bytes.
+	Buckets [64]int64
+}
+
+func (h *reuseHistogram) add(other *reuseHistogram) {
+	h.Cold += other.Cold
+	for i, n := range other.Buckets {
+		h.Buckets[i] += n
+	}
+}
+
+func (h *reuseHistogram) total() int64 {
+	total := h.Cold
+	for _, n := range h.Buckets {
+		total += n
+	}
+	return total
+}
+
+// hitRate returns the fraction of accesses that would have been hits
+// in an LRU cache of the given size. Accesses in a bucket that
+// straddles size are counted as misses, so this is a lower bound.
+func (h *reuseHistogram) hitRate(size int64) float64 {
+	total := h.total()
+	if total == 0 {
+		return 0
+	}
+	var hits int64
+	for i, n := range h.Buckets {
+		if i >= 62 || int64(2)<<i > size {
+			break
+		}
+		hits += n
+	}
+	return float64(hits) / float64(total)
+}
+
+// reuseTracker computes reuse distances using a Fenwick tree of
+// block sizes, indexed by the position of each block's most recent
+// access.
+type reuseTracker struct {
+	sync.Mutex
+	max     int
+	blocks  map[string]*reuseEnt
+	tree    []int64
+	next    int
+	pending reuseHistogram // not yet saved to disk
+	saved   reuseHistogram // as of last save/load
+	lastLog time.Time
+}
+
+type reuseEnt struct {
+	pos  int
+	size int64
+	last time.Time
+}
+
+func newReuseTracker(max int) *reuseTracker {
+	return &reuseTracker{
+		max:    max,
+		blocks: map[string]*reuseEnt{},
+		tree:   make([]int64, max*2+1),
+		next:   1,
+	}
+}
+
+func (r *reuseTracker) update(pos int, delta int64) {
+	for ; pos < len(r.tree); pos += pos & -pos {
+		r.tree[pos] += delta
+	}
+}
+
+// sum returns the total size of blocks whose last access position is
+// in [1, pos].
+func (r *reuseTracker) sum(pos int) int64 {
+	var s int64
+	for ; pos > 0; pos -= pos & -pos {
+		s += r.tree[pos]
+	}
+	return s
+}
+
+// compact forgets all but the r.max most recently accessed blocks,
+// and renumbers the remaining positions from 1.
+func (r *reuseTracker) compact() {
+	ents := make([]*reuseEnt, 0, len(r.blocks))
+	for _, ent := range r.blocks {
+		ents = append(ents, ent)
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].pos > ents[j].pos })
+	if len(ents) > r.max {
+		forget := map[*reuseEnt]bool{}
+		for _, ent := range ents[r.max:] {
+			forget[ent] = true
+		}
+		for hash, ent := range r.blocks {
+			if forget[ent] {
+				delete(r.blocks, hash)
+			}
+		}
+		ents = ents[:r.max]
+	}
+	for i := range r.tree {
+		r.tree[i] = 0
+	}
+	for i, ent := range ents {
+		ent.pos = len(ents) - i
+		r.update(ent.pos, ent.size)
+	}
+	r.next = len(ents) + 1
+}
+
+func (r *reuseTracker) access(hash string, size int64, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	ent := r.blocks[hash]
+	if ent == nil {
+		r.pending.Cold++
+		ent = &reuseEnt{}
+		r.blocks[hash] = ent
+	} else {
+		if now.Sub(ent.last) >= reuseAccessWindow {
+			dist := r.sum(r.next-1) - r.sum(ent.pos) + size
+			if dist < 1 {
+				dist = 1
+			}
+			r.pending.Buckets[bits.Len64(uint64(dist))-1]++
+		}
+		r.update(ent.pos, -ent.size)
+	}
+	if r.next >= len(r.tree) {
+		r.compact()
+	}
+	ent.pos, ent.size, ent.last = r.next, size, now
+	r.update(ent.pos, size)
+	r.next++
+}
+
+func (r *reuseTracker) histogram() reuseHistogram {
+	r.Lock()
+	defer r.Unlock()
+	hist := r.saved
+	hist.add(&r.pending)
+	return hist
+}
+
+// recordReuse records an access to the given block, if
+// RecordReuseDistances is enabled.
+func (cache *DiskCache) recordReuse(locator string) {
+	if cache.reuse == nil {
+		return
+	}
+	hash, size, ok := strings.Cut(locator, "+")
+	if !ok {
+		return
+	}
+	if i := strings.Index(size, "+"); i >= 0 {
+		size = size[:i]
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return
+	}
+	cache.reuse.access(hash, n, time.Now())
+}
+
+// EstimatedHitRate returns the fraction of block accesses that would
+// have been served from the cache if its size had been the given
+// number of bytes, based on the accesses recorded while
+// RecordReuseDistances was enabled (including those recorded by
+// other processes using the same cache directory). It returns false
+// if no accesses have been recorded.
+//
+// The estimate assumes least-recently-used eviction, and is rounded
+// down to the nearest power-of-two reuse distance.
+func (cache *DiskCache) EstimatedHitRate(size int64) (float64, bool) {
+	cache.setupOnce.Do(cache.setup)
+	if cache.reuse == nil {
+		return 0, false
+	}
+	hist := cache.reuse.histogram()
+	if hist.total() == 0 {
+		return 0, false
+	}
+	return hist.hitRate(size), true
+}
+
+func loadReuseHistogram(dir string) (reuseHistogram, error) {
+	var hist reuseHistogram
+	buf, err := os.ReadFile(filepath.Join(dir, reuseHistogramFile))
+	if os.IsNotExist(err) {
+		return hist, nil
+	} else if err != nil {
+		return hist, err
+	}
+	err = json.Unmarshal(buf, &hist)
+	return hist, err
+}
+
+// saveReuseHistogram merges the accesses recorded since the last
+// save into the histogram file, and periodically logs the estimated
+// hit rates at a few multiples of maxsize. The caller must hold the
+// tidy lock.
+func (cache *DiskCache) saveReuseHistogram(maxsize int64) {
+	r := cache.reuse
+	if r == nil {
+		return
+	}
+	r.Lock()
+	pending := r.pending
+	r.pending = reuseHistogram{}
+	r.Unlock()
+
+	hist, err := loadReuseHistogram(cache.dir)
+	if err != nil {
+		cache.debugf("saveReuseHistogram: ignoring unreadable %s: %s", reuseHistogramFile, err)
+		hist = reuseHistogram{}
+	}
+	if pending.total() > 0 {
+		merged := hist
+		merged.add(&pending)
+		err = cache.writeReuseHistogram(&merged)
+		if err != nil {
+			// Try again next time.
+			cache.debugf("saveReuseHistogram: %s", err)
+			r.Lock()
+			r.pending.add(&pending)
+			r.Unlock()
+		} else {
+			hist = merged
+		}
+	}
+
+	r.Lock()
+	r.saved = hist
+	logNow := cache.Logger != nil && maxsize > 0 && hist.total() > 0 && time.Since(r.lastLog) >= reuseLogInterval
+	if logNow {
+		r.lastLog = time.Now()
+	}
+	r.Unlock()
+	if logNow {
+		fields := logrus.Fields{
+			"accesses": hist.total(),
+			"maxsize":  maxsize,
+		}
+		for _, m := range []float64{0.25, 0.5, 1, 2, 4} {
+			fields[fmt.Sprintf("hitrate_%gx", m)] = hist.hitRate(int64(float64(maxsize) * m))
+		}
+		cache.Logger.WithFields(fields).Info("DiskCache: estimated hit rates by cache size")
+	}
+}
+
+func (cache *DiskCache) writeReuseHistogram(hist *reuseHistogram) error {
+	buf, err := json.Marshal(hist)
+	if err != nil {
+		return err
+	}
+	tmpfilename := filepath.Join(cache.dir, "tmp", reuseHistogramFile)
+	err = os.WriteFile(tmpfilename, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfilename, filepath.Join(cache.dir, reuseHistogramFile))
+}
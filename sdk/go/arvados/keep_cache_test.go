@@ -16,9 +16,11 @@ import (
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"golang.org/x/sys/unix"
 	check "gopkg.in/check.v1"
 )
 
@@ -190,6 +192,185 @@ func (s *keepCacheSuite) TestMaxSize(c *check.C) {
 	c.Check(err, check.IsNil)
 }
 
+func (s *keepCacheSuite) TestMinFreeSpace(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway:  backend,
+		MaxSize:      1 << 40,
+		MinFreeSpace: 10000000,
+		Dir:          c.MkDir(),
+		Logger:       ctxlog.TestLogger(c),
+	}
+	cache.setupOnce.Do(cache.setup)
+	var avail uint64 = 1 << 30
+	cache.statfs = func(path string, buf *unix.Statfs_t) error {
+		buf.Bsize = 1
+		buf.Blocks = 1 << 40
+		buf.Bavail = atomic.LoadUint64(&avail)
+		return nil
+	}
+	waitTidy := func() {
+		time.Sleep(time.Millisecond)
+		for atomic.LoadInt32(&cache.tidying) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	ctx := context.Background()
+	var locators []string
+	for i := 0; i < 4; i++ {
+		resp, err := cache.BlockWrite(ctx, BlockWriteOptions{
+			Data: bytes.Repeat([]byte{byte(i)}, 1000000),
+		})
+		c.Assert(err, check.IsNil)
+		locators = append(locators, resp.Locator)
+		waitTidy()
+	}
+	c.Check(atomic.LoadInt64(&cache.sizeMeasured), check.Equals, int64(4000000))
+
+	// Another tenant uses up space: 8 MB available, 2 MB short
+	// of MinFreeSpace. Tidy should delete 2.5 MB worth of
+	// blocks (oldest first) even though we're well below
+	// MaxSize.
+	atomic.StoreUint64(&avail, 8000000)
+	cache.gotidy()
+	waitTidy()
+	c.Check(atomic.LoadInt64(&cache.sizeMeasured), check.Equals, int64(1000000))
+	_, err := os.Stat(cache.cacheFile(locators[3]))
+	c.Check(err, check.IsNil)
+
+	// Below half of MinFreeSpace, new blocks are passed through
+	// without being cached.
+	atomic.StoreUint64(&avail, 4000000)
+	resp, err := cache.BlockWrite(ctx, BlockWriteOptions{
+		Data: []byte("foobar"),
+	})
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(cache.cacheFile(resp.Locator))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	buf := make([]byte, 3)
+	n, err := cache.ReadAt(resp.Locator, buf, 2)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "oba")
+	n, err = cache.ReadAt(resp.Locator, buf, 4)
+	c.Check(err, check.Equals, io.EOF)
+	c.Check(string(buf[:n]), check.Equals, "ar")
+	var out bytes.Buffer
+	_, err = cache.BlockRead(ctx, BlockReadOptions{Locator: resp.Locator, WriteTo: &out})
+	c.Check(err, check.IsNil)
+	c.Check(out.String(), check.Equals, "foobar")
+	_, err = os.Stat(cache.cacheFile(resp.Locator))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	// Blocks that are already cached are still read from the
+	// cache.
+	delete(backend.data, locators[3])
+	n, err = cache.ReadAt(locators[3], buf, 0)
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, 3)
+}
+
+func (s *keepCacheSuite) TestTidyWatermarks(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway:   backend,
+		MaxSize:       10000000,
+		TidyHighWater: 0.9,
+		TidyLowWater:  0.5,
+		Dir:           c.MkDir(),
+		Logger:        ctxlog.TestLogger(c),
+	}
+	ctx := context.Background()
+	waitTidy := func() {
+		time.Sleep(time.Millisecond)
+		for atomic.LoadInt32(&cache.tidying) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 0; i < 9; i++ {
+		_, err := cache.BlockWrite(ctx, BlockWriteOptions{
+			Data: bytes.Repeat([]byte{byte(i)}, 1000000),
+		})
+		c.Assert(err, check.IsNil)
+		waitTidy()
+	}
+	// At the high-water mark, nothing is deleted.
+	c.Check(atomic.LoadInt64(&cache.sizeMeasured), check.Equals, int64(9000000))
+
+	// Above the high-water mark, blocks are deleted until the
+	// cache is at the low-water mark.
+	_, err := cache.BlockWrite(ctx, BlockWriteOptions{
+		Data: bytes.Repeat([]byte{9}, 1000000),
+	})
+	c.Assert(err, check.IsNil)
+	waitTidy()
+	c.Check(atomic.LoadInt64(&cache.sizeMeasured), check.Equals, int64(5000000))
+}
+
+func (s *keepCacheSuite) TestTidyHoldDuration(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway:      backend,
+		MaxSize:          1500000,
+		TidyHoldDuration: time.Hour,
+		Dir:              c.MkDir(),
+		Logger:           ctxlog.TestLogger(c),
+	}
+	ctx := context.Background()
+	waitTidy := func() {
+		time.Sleep(time.Millisecond)
+		for atomic.LoadInt32(&cache.tidying) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		_, err := cache.BlockWrite(ctx, BlockWriteOptions{
+			Data: bytes.Repeat([]byte{byte(i)}, 1000000),
+		})
+		c.Assert(err, check.IsNil)
+		waitTidy()
+	}
+	// Only the first write triggered a tidy, so the cache is
+	// over MaxSize.
+	c.Check(atomic.LoadInt64(&cache.sizeMeasured), check.Equals, int64(1000000))
+	files, err := filepath.Glob(filepath.Join(cache.Dir, "*", "*"+cacheFileSuffix))
+	c.Check(err, check.IsNil)
+	c.Check(files, check.HasLen, 3)
+
+	// After the hold expires, the next write triggers a tidy.
+	atomic.StoreInt64(&cache.lastTidy, time.Now().Add(-2*time.Hour).UnixNano())
+	_, err = cache.BlockWrite(ctx, BlockWriteOptions{
+		Data: bytes.Repeat([]byte{3}, 1000000),
+	})
+	c.Assert(err, check.IsNil)
+	waitTidy()
+	c.Check(atomic.LoadInt64(&cache.sizeMeasured), check.Equals, int64(1000000))
+}
+
+func (s *keepCacheSuite) TestTidyInterval(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway:  backend,
+		MaxSize:      1500000,
+		TidyInterval: 50 * time.Millisecond,
+		Dir:          c.MkDir(),
+		Logger:       ctxlog.TestLogger(c),
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := cache.BlockWrite(ctx, BlockWriteOptions{
+			Data: bytes.Repeat([]byte{byte(i)}, 1000000),
+		})
+		c.Assert(err, check.IsNil)
+	}
+	// Writes don't trigger a tidy, but the timer does.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&cache.sizeMeasured) != 1000000 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(atomic.LoadInt64(&cache.sizeMeasured), check.Equals, int64(1000000))
+}
+
 func (s *keepCacheSuite) TestConcurrentReadersNoRefresh(c *check.C) {
 	s.testConcurrentReaders(c, true, false)
 }
@@ -338,6 +519,428 @@ func (s *keepCacheSuite) TestStreaming(c *check.C) {
 	c.Logf("doneLate = %d", doneLate)
 }
 
+func (s *keepCacheSuite) TestPartialHit(c *check.C) {
+	blksize := 1000000
+	backend := &keepGatewayMemoryBacked{
+		pauseBlockReadUntil: make(chan error),
+		pauseBlockReadAfter: blksize / 4,
+	}
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     ByteSizeOrPercent(blksize * 4),
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+	}
+	resp, err := cache.BlockWrite(context.Background(), BlockWriteOptions{
+		Data: make([]byte, blksize),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(cache.CachedRanges(resp.Locator), check.DeepEquals, []BlockRange{{0, blksize}})
+	os.RemoveAll(filepath.Join(cache.Dir, resp.Locator[:3]))
+	c.Check(cache.CachedRanges(resp.Locator), check.IsNil)
+
+	// The backend returns the first quarter of the block and
+	// then pauses. A partial read spanning the pause point
+	// should return the available data right away.
+	buf := make([]byte, blksize/2)
+	n, err := cache.ReadAtPartial(resp.Locator, buf, blksize/8)
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, blksize/4-blksize/8)
+	c.Check(cache.CachedRanges(resp.Locator), check.DeepEquals, []BlockRange{{0, blksize / 4}})
+
+	// A regular ReadAt waits for the entire range.
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		n, err := cache.ReadAt(resp.Locator, buf, blksize/8)
+		c.Check(err, check.IsNil)
+		c.Check(n, check.Equals, len(buf))
+	}()
+	select {
+	case <-done:
+		c.Error("ReadAt returned before backend was unpaused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(backend.pauseBlockReadUntil)
+	<-done
+	c.Check(cache.CachedRanges(resp.Locator), check.DeepEquals, []BlockRange{{0, blksize}})
+
+	// Once the block is fully cached, a partial read returns
+	// the full range.
+	n, err = cache.ReadAtPartial(resp.Locator, buf, blksize/2)
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, len(buf))
+}
+
+// ReadPartial on a collection file uses partial cache hits, so
+// (e.g.) keep-web can start sending a range of a file before the rest
+// of the block arrives. Read waits for the entire requested range.
+func (s *keepCacheSuite) TestPartialHitCollectionFS(c *check.C) {
+	blksize := 1000000
+	backend := &keepGatewayMemoryBacked{
+		pauseBlockReadUntil: make(chan error),
+		pauseBlockReadAfter: blksize / 4,
+	}
+	cache := DiskCache{
+		KeepGateway: backend,
+		MaxSize:     ByteSizeOrPercent(blksize * 4),
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+	}
+	data := make([]byte, blksize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	resp, err := cache.BlockWrite(context.Background(), BlockWriteOptions{Data: data})
+	c.Assert(err, check.IsNil)
+	os.RemoveAll(filepath.Join(cache.Dir, resp.Locator[:3]))
+
+	coll := Collection{ManifestText: fmt.Sprintf(". %s 0:%d:file.bin\n", resp.Locator, blksize)}
+	fs, err := coll.FileSystem(&StubClient{}, &cache)
+	c.Assert(err, check.IsNil)
+	f, err := fs.Open("file.bin")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	_, err = f.Seek(int64(blksize/8), io.SeekStart)
+	c.Assert(err, check.IsNil)
+	buf := make([]byte, blksize/2)
+	n, err := f.(interface{ ReadPartial([]byte) (int, error) }).ReadPartial(buf)
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, blksize/4-blksize/8)
+	c.Check(buf[:n], check.DeepEquals, data[blksize/8:blksize/4])
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := f.Read(buf)
+		c.Check(err, check.IsNil)
+		c.Check(n, check.Equals, len(buf))
+		c.Check(buf, check.DeepEquals, data[blksize/4:blksize/4+len(buf)])
+	}()
+	select {
+	case <-done:
+		c.Error("Read returned before the requested range was available")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(backend.pauseBlockReadUntil)
+	<-done
+	rest, err := io.ReadAll(f)
+	c.Check(err, check.IsNil)
+	c.Check(rest, check.DeepEquals, data[blksize/4+len(buf):])
+}
+
+func (s *keepCacheSuite) TestReadOnlyDirs(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	data := []byte("reference data")
+	resp, err := backend.BlockWrite(context.Background(), BlockWriteOptions{Data: data})
+	c.Assert(err, check.IsNil)
+	locator := resp.Locator
+	hash := locator[:32]
+
+	// Seed the second read-only dir with the block, and the
+	// first one with a file whose size doesn't match.
+	rodirs := []string{c.MkDir(), c.MkDir()}
+	for i, content := range [][]byte{[]byte("truncated"), data} {
+		c.Assert(os.Mkdir(filepath.Join(rodirs[i], hash[:3]), 0755), check.IsNil)
+		c.Assert(os.WriteFile(filepath.Join(rodirs[i], hash[:3], hash+cacheFileSuffix), content, 0444), check.IsNil)
+	}
+	delete(backend.data, locator)
+
+	cache := DiskCache{
+		KeepGateway:  backend,
+		MaxSize:      40000000,
+		Dir:          c.MkDir(),
+		ReadOnlyDirs: append(rodirs, c.MkDir()),
+		Logger:       ctxlog.TestLogger(c),
+	}
+	buf := make([]byte, 4)
+	n, err := cache.ReadAt(locator, buf, 10)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "data")
+	n, err = cache.ReadAt(locator, buf, 12)
+	c.Check(err, check.Equals, io.EOF)
+	c.Check(string(buf[:n]), check.Equals, "ta")
+	c.Check(cache.CachedRanges(locator), check.DeepEquals, []BlockRange{{0, len(data)}})
+	var out bytes.Buffer
+	n, err = cache.BlockRead(context.Background(), BlockReadOptions{Locator: locator, WriteTo: &out})
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, len(data))
+	c.Check(out.String(), check.Equals, string(data))
+
+	// Nothing was added to the writable cache dir.
+	_, err = os.Stat(cache.cacheFile(locator))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	// Blocks not found in the read-only dirs are fetched from
+	// the backend into the writable cache dir as usual.
+	resp, err = backend.BlockWrite(context.Background(), BlockWriteOptions{Data: []byte("other data")})
+	c.Assert(err, check.IsNil)
+	n, err = cache.ReadAt(resp.Locator, buf, 0)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "othe")
+	_, err = os.Stat(cache.cacheFile(resp.Locator))
+	c.Check(err, check.IsNil)
+}
+
+func (s *keepCacheSuite) TestVerifyCachedReads(c *check.C) {
+	blksize := cacheExtentSize*3 + 1000
+	data := make([]byte, blksize)
+	rand.Read(data)
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway:       backend,
+		MaxSize:           ByteSizeOrPercent(blksize * 4),
+		Dir:               c.MkDir(),
+		Logger:            ctxlog.TestLogger(c),
+		VerifyCachedReads: true,
+	}
+	resp, err := cache.BlockWrite(context.Background(), BlockWriteOptions{Data: data})
+	c.Assert(err, check.IsNil)
+	if cache.noXattr != 0 {
+		c.Skip("filesystem does not support extended attributes")
+	}
+	fnm := cache.cacheFile(resp.Locator)
+
+	// mangle simulates a torn write by changing the cache file
+	// without going through the DiskCache, and returns the data
+	// that a non-verifying cache would read.
+	mangle := func() []byte {
+		f, err := os.OpenFile(fnm, os.O_WRONLY, 0)
+		c.Assert(err, check.IsNil)
+		_, err = f.WriteAt(make([]byte, 10), int64(cacheExtentSize*2+100))
+		c.Assert(err, check.IsNil)
+		c.Assert(f.Close(), check.IsNil)
+		cache.deleteHeldopen(fnm, nil)
+		mangled, err := os.ReadFile(fnm)
+		c.Assert(err, check.IsNil)
+		return mangled
+	}
+
+	buf := make([]byte, 1000)
+	// readFile returns the content of the cache file after
+	// waiting for any re-fetch to finish.
+	readFile := func() []byte {
+		_, err := cache.ReadAt(resp.Locator, make([]byte, 1), blksize-1)
+		c.Assert(err, check.IsNil)
+		for {
+			cache.writingLock.Lock()
+			busy := cache.writing[fnm] != nil
+			cache.writingLock.Unlock()
+			if !busy {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		current, err := os.ReadFile(fnm)
+		c.Assert(err, check.IsNil)
+		return current
+	}
+	for _, trial := range []struct {
+		verify      bool
+		removeXattr bool
+	}{
+		{false, false},
+		{true, false},
+		{true, true},
+	} {
+		c.Logf("%+v", trial)
+		cache.VerifyCachedReads = trial.verify
+		mangled := mangle()
+		if trial.removeXattr {
+			c.Assert(os.Truncate(fnm, cacheExtentSize), check.IsNil)
+			c.Assert(unix.Removexattr(fnm, cacheSumsXattr), check.IsNil)
+			mangled = data[:cacheExtentSize]
+		}
+
+		// Reading a different extent succeeds without
+		// re-fetching, unless the checksums are missing.
+		n, err := cache.ReadAt(resp.Locator, buf, 10)
+		c.Check(err, check.IsNil)
+		c.Check(n, check.Equals, len(buf))
+		c.Check(buf, check.DeepEquals, data[10:10+len(buf)])
+		c.Check(bytes.Equal(readFile(), mangled), check.Equals, !trial.removeXattr)
+
+		n, err = cache.ReadAt(resp.Locator, buf, cacheExtentSize*2)
+		c.Check(err, check.IsNil)
+		c.Check(n, check.Equals, len(buf))
+		if !trial.verify {
+			c.Check(buf, check.DeepEquals, mangled[cacheExtentSize*2:cacheExtentSize*2+len(buf)])
+			continue
+		}
+		// Corrupt data is detected, and the cache file is
+		// re-fetched from the backend.
+		c.Check(buf, check.DeepEquals, data[cacheExtentSize*2:cacheExtentSize*2+len(buf)])
+		c.Check(bytes.Equal(readFile(), data), check.Equals, true)
+	}
+}
+
+func (s *keepCacheSuite) TestAccessTracker(c *check.C) {
+	dir := c.MkDir()
+	c.Logf("atimeUpdatedOnRead(%s) == %v", dir, atimeUpdatedOnRead(dir))
+	ents, err := os.ReadDir(dir)
+	c.Check(err, check.IsNil)
+	c.Check(ents, check.HasLen, 0)
+
+	fnm := filepath.Join(dir, "foo")
+	c.Assert(os.WriteFile(fnm, []byte("foo"), 0600), check.IsNil)
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	c.Assert(os.Chtimes(fnm, t0, t0), check.IsNil)
+	at := &accessTracker{}
+	at.touch(fnm)
+	at.touch(filepath.Join(dir, "deleted"))
+	at.flush()
+	fi, err := os.Stat(fnm)
+	c.Assert(err, check.IsNil)
+	stat := fi.Sys().(*syscall.Stat_t)
+	c.Check(time.Since(time.Unix(stat.Atim.Sec, stat.Atim.Nsec)) < time.Minute, check.Equals, true)
+	c.Check(fi.ModTime().Equal(t0), check.Equals, true)
+	c.Check(at.times, check.HasLen, 0)
+
+	// Methods are no-ops on a nil tracker.
+	at = nil
+	at.touch(fnm)
+	at.flush()
+}
+
+// Blocks that have been read recently are not evicted, even if
+// they were written long ago and the filesystem doesn't update
+// atimes.
+func (s *keepCacheSuite) TestTidyUsesAccessTimes(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	cache := DiskCache{
+		KeepGateway:   backend,
+		MaxSize:       3500000,
+		TidyHighWater: 1,
+		TidyLowWater:  0.95,
+		Dir:           c.MkDir(),
+		Logger:        ctxlog.TestLogger(c),
+	}
+	ctx := context.Background()
+	waitTidy := func() {
+		time.Sleep(time.Millisecond)
+		for atomic.LoadInt32(&cache.tidying) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	var locators []string
+	for i := 0; i < 3; i++ {
+		resp, err := cache.BlockWrite(ctx, BlockWriteOptions{
+			Data: bytes.Repeat([]byte{byte(i)}, 1000000),
+		})
+		c.Assert(err, check.IsNil)
+		locators = append(locators, resp.Locator)
+		waitTidy()
+	}
+	// Force access time tracking on, regardless of the test
+	// filesystem's mount options.
+	cache.atimes = &accessTracker{}
+	t0 := time.Now().Add(-time.Hour)
+	for i, locator := range locators {
+		t := t0.Add(time.Duration(i) * time.Minute)
+		c.Assert(os.Chtimes(cache.cacheFile(locator), t, t), check.IsNil)
+	}
+	// Read the oldest block.
+	_, err := cache.ReadAt(locators[0], make([]byte, 1), 0)
+	c.Assert(err, check.IsNil)
+
+	_, err = cache.BlockWrite(ctx, BlockWriteOptions{
+		Data: bytes.Repeat([]byte{3}, 1000000),
+	})
+	c.Assert(err, check.IsNil)
+	waitTidy()
+	c.Check(atomic.LoadInt64(&cache.sizeMeasured), check.Equals, int64(3000000))
+	_, err = os.Stat(cache.cacheFile(locators[0]))
+	c.Check(err, check.IsNil)
+	_, err = os.Stat(cache.cacheFile(locators[1]))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *keepCacheSuite) TestReuseTracker(c *check.C) {
+	r := newReuseTracker(2)
+	t0 := time.Now()
+	for i, hash := range []string{"a", "b", "c", "a", "a"} {
+		r.access(hash, 100, t0.Add(time.Duration(i)*time.Minute))
+	}
+	// Repeated access within reuseAccessWindow is not counted.
+	r.access("a", 100, t0.Add(4*time.Minute+time.Millisecond))
+	hist := r.histogram()
+	c.Check(hist.Cold, check.Equals, int64(3))
+	c.Check(hist.Buckets[8], check.Equals, int64(1)) // a,b,c,a => 300
+	c.Check(hist.Buckets[6], check.Equals, int64(1)) // a,a => 100
+	c.Check(hist.total(), check.Equals, int64(5))
+	c.Check(hist.hitRate(64), check.Equals, 0.0)
+	c.Check(hist.hitRate(128), check.Equals, 0.2)
+	c.Check(hist.hitRate(511), check.Equals, 0.2)
+	c.Check(hist.hitRate(512), check.Equals, 0.4)
+
+	// Only the 2 most recently used blocks are remembered after
+	// compaction, so "b" is forgotten.
+	r.access("d", 100, t0.Add(10*time.Minute))
+	r.access("b", 100, t0.Add(11*time.Minute))
+	r.access("c", 100, t0.Add(12*time.Minute))
+	hist = r.histogram()
+	c.Check(hist.Cold, check.Equals, int64(5))
+	c.Check(hist.Buckets[8], check.Equals, int64(2)) // c,a,a,d,b,c => 400
+}
+
+func (s *keepCacheSuite) TestRecordReuseDistances(c *check.C) {
+	backend := &keepGatewayMemoryBacked{}
+	dir := c.MkDir()
+	cache := DiskCache{
+		KeepGateway:          backend,
+		MaxSize:              40000000,
+		Dir:                  dir,
+		Logger:               ctxlog.TestLogger(c),
+		RecordReuseDistances: true,
+	}
+	_, ok := cache.EstimatedHitRate(1 << 20)
+	c.Check(ok, check.Equals, false)
+
+	ctx := context.Background()
+	var locators []string
+	for i := 0; i < 2; i++ {
+		resp, err := cache.BlockWrite(ctx, BlockWriteOptions{
+			Data: bytes.Repeat([]byte{byte(i)}, 1000),
+		})
+		c.Assert(err, check.IsNil)
+		locators = append(locators, resp.Locator)
+	}
+	// Pretend the writes happened a while ago, so the next read
+	// counts as a separate access.
+	cache.reuse.Lock()
+	for _, ent := range cache.reuse.blocks {
+		ent.last = ent.last.Add(-time.Minute)
+	}
+	cache.reuse.Unlock()
+	_, err := cache.ReadAt(locators[0], make([]byte, 100), 0)
+	c.Assert(err, check.IsNil)
+
+	rate, ok := cache.EstimatedHitRate(1024)
+	c.Check(ok, check.Equals, true)
+	c.Check(rate, check.Equals, 0.0)
+	rate, _ = cache.EstimatedHitRate(2048)
+	c.Check(rate, check.Equals, 1.0/3)
+
+	// The histogram is saved during tidy, and loaded by the next
+	// process that uses the same cache dir.
+	cache.tidy()
+	_, err = os.Stat(filepath.Join(dir, reuseHistogramFile))
+	c.Check(err, check.IsNil)
+	sharedCachesLock.Lock()
+	delete(sharedCaches, dir)
+	sharedCachesLock.Unlock()
+	cache2 := DiskCache{
+		KeepGateway:          backend,
+		MaxSize:              40000000,
+		Dir:                  dir,
+		Logger:               ctxlog.TestLogger(c),
+		RecordReuseDistances: true,
+	}
+	rate, ok = cache2.EstimatedHitRate(2048)
+	c.Check(ok, check.Equals, true)
+	c.Check(rate, check.Equals, 1.0/3)
+}
+
 var _ = check.Suite(&keepCacheBenchSuite{})
 
 type keepCacheBenchSuite struct {
@@ -0,0 +1,168 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// When DiskCache.VerifyCachedReads is enabled, each cache file is
+// divided into extents of cacheExtentSize bytes, and the CRC-32C
+// checksum of each extent is recorded in an extended attribute on
+// the cache file once the file has been completely written and
+// synced.
+//
+// A cache file left behind by a process that crashed while filling
+// it does not have the extended attribute, and a file whose data
+// was torn by a crash/power loss after the attribute was written
+// does not match it, so in both cases the block is fetched again
+// from the backend instead of returning corrupt data.
+const (
+	cacheExtentSize  = 1 << 18
+	cacheSumsXattr   = "user.arvados.keepcache.extents"
+	cacheMaxExtents  = 1 << 10 // enough for a 256 MiB block
+	crc32Size        = 4
+	cacheSumsMaxSize = cacheMaxExtents * crc32Size
+)
+
+var (
+	errCacheUnverified = errors.New("cache file has no extent checksums")
+	crc32cTable        = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// extentHasher computes the checksum of each cacheExtentSize extent
+// of the data written to it.
+type extentHasher struct {
+	sums []uint32
+	cur  uint32
+	n    int // bytes written to the current extent
+}
+
+func (eh *extentHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > cacheExtentSize-eh.n {
+			chunk = chunk[:cacheExtentSize-eh.n]
+		}
+		eh.cur = crc32.Update(eh.cur, crc32cTable, chunk)
+		eh.n += len(chunk)
+		p = p[len(chunk):]
+		if eh.n == cacheExtentSize {
+			eh.sums = append(eh.sums, eh.cur)
+			eh.cur, eh.n = 0, 0
+		}
+	}
+	return written, nil
+}
+
+// Sums returns the checksums of all extents, including the last
+// (short) extent, if any.
+func (eh *extentHasher) Sums() []uint32 {
+	if eh.n > 0 {
+		return append(eh.sums, eh.cur)
+	}
+	return eh.sums
+}
+
+// saveExtentSums records the given extent checksums in the cache
+// file's extended attributes. If the filesystem does not support
+// extended attributes, verification is disabled for the whole cache
+// directory.
+func (cache *DiskCache) saveExtentSums(path string, sums []uint32) {
+	if len(sums) > cacheMaxExtents {
+		return
+	}
+	buf := make([]byte, len(sums)*crc32Size)
+	for i, sum := range sums {
+		binary.BigEndian.PutUint32(buf[i*crc32Size:], sum)
+	}
+	err := unix.Setxattr(path, cacheSumsXattr, buf, 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		if atomic.CompareAndSwapInt32(&cache.noXattr, 0, 1) && cache.Logger != nil {
+			cache.Logger.Warnf("DiskCache: cannot verify cached reads: filesystem at %s does not support extended attributes", cache.dir)
+		}
+	} else if err != nil {
+		cache.debugf("saveExtentSums: setxattr(%s) failed: %s", path, err)
+	}
+}
+
+// loadExtentSums returns the extent checksums recorded for the given
+// open cache file, or nil if none are recorded.
+func loadExtentSums(f *os.File) []uint32 {
+	buf := make([]byte, cacheSumsMaxSize)
+	n, err := unix.Fgetxattr(int(f.Fd()), cacheSumsXattr, buf)
+	if err != nil || n%crc32Size != 0 {
+		return nil
+	}
+	sums := make([]uint32, n/crc32Size)
+	for i := range sums {
+		sums[i] = binary.BigEndian.Uint32(buf[i*crc32Size:])
+	}
+	return sums
+}
+
+// setHeldopenSums provides the checksums of a cache file that was
+// just filled by this process to quickReadAt, if the file is already
+// held open. The data is known to be good, so it is not verified.
+func (cache *DiskCache) setHeldopenSums(cachefilename string, sums []uint32) {
+	cache.heldopenLock.Lock()
+	heldopen := cache.heldopen[cachefilename]
+	cache.heldopenLock.Unlock()
+	if heldopen == nil {
+		return
+	}
+	heldopen.verifyLock.Lock()
+	defer heldopen.verifyLock.Unlock()
+	heldopen.sums = sums
+	heldopen.verified = make([]bool, len(sums))
+	for i := range heldopen.verified {
+		heldopen.verified[i] = true
+	}
+}
+
+// verifyExtents checks the extents of heldopen's file that overlap
+// the given range against the recorded checksums. Extents that have
+// been verified already (since the file was opened) are not read
+// again.
+func (cache *DiskCache) verifyExtents(heldopen *openFileEnt, offset, length int) error {
+	heldopen.verifyLock.Lock()
+	defer heldopen.verifyLock.Unlock()
+	if heldopen.sums == nil {
+		return errCacheUnverified
+	}
+	if heldopen.verified == nil {
+		heldopen.verified = make([]bool, len(heldopen.sums))
+	}
+	var buf []byte
+	for i := offset / cacheExtentSize; i*cacheExtentSize < offset+length; i++ {
+		if i >= len(heldopen.sums) {
+			return fmt.Errorf("cache file has no checksum for extent %d", i)
+		}
+		if heldopen.verified[i] {
+			continue
+		}
+		if buf == nil {
+			buf = make([]byte, cacheExtentSize)
+		}
+		n, err := heldopen.f.ReadAt(buf, int64(i*cacheExtentSize))
+		if err != nil && (err != io.EOF || n == 0) {
+			return err
+		}
+		if sum := crc32.Checksum(buf[:n], crc32cTable); sum != heldopen.sums[i] {
+			return fmt.Errorf("cache file checksum mismatch in extent %d: %08x != %08x", i, sum, heldopen.sums[i])
+		}
+		heldopen.verified[i] = true
+	}
+	return nil
+}
@@ -53,6 +53,10 @@ type KeepServiceIndexEntry struct {
 	SizedDigest
 	// Time of last write, in nanoseconds since Unix epoch
 	Mtime int64
+	// Approximate time of last read, in nanoseconds since Unix
+	// epoch, or 0 if unknown (e.g., the keep service does not
+	// track access times)
+	Atime int64
 }
 
 // EachKeepService calls f once for every readable
@@ -89,6 +93,12 @@ func (s *KeepService) url(path string) string {
 	return fmt.Sprintf(f, s.ServiceHost, s.ServicePort, path)
 }
 
+// URL returns the base URL of the keep service, e.g.,
+// "http://keep0.zzzzz.example:25107".
+func (s *KeepService) URL() string {
+	return strings.TrimSuffix(s.url(""), "/")
+}
+
 // String implements fmt.Stringer
 func (s *KeepService) String() string {
 	return s.UUID
@@ -146,13 +156,13 @@ func (s *KeepService) Untrash(ctx context.Context, c *Client, blk string) error
 
 // IndexMount returns an unsorted list of blocks at the given mount point.
 func (s *KeepService) IndexMount(ctx context.Context, c *Client, mountUUID string, prefix string) ([]KeepServiceIndexEntry, error) {
-	return s.index(ctx, c, prefix, s.url("mounts/"+mountUUID+"/blocks?prefix="+prefix))
+	return s.index(ctx, c, prefix, s.url("mounts/"+mountUUID+"/blocks?atime=true&prefix="+prefix))
 }
 
 // Index returns an unsorted list of blocks that can be retrieved from
 // this server.
 func (s *KeepService) Index(ctx context.Context, c *Client, prefix string) ([]KeepServiceIndexEntry, error) {
-	return s.index(ctx, c, prefix, s.url("index/"+prefix))
+	return s.index(ctx, c, prefix, s.url("index/"+prefix+"?atime=true"))
 }
 
 func (s *KeepService) index(ctx context.Context, c *Client, prefix, url string) ([]KeepServiceIndexEntry, error) {
@@ -207,8 +217,10 @@ func (s *KeepService) index(ctx context.Context, c *Client, prefix, url string)
 			sawEOF = true
 			continue
 		}
+		// Keepstore only includes the third (atime) field
+		// if it supports it.
 		fields := strings.Split(line, " ")
-		if len(fields) != 2 {
+		if len(fields) != 2 && len(fields) != 3 {
 			return nil, fmt.Errorf("Malformed index line %q: %d fields", line, len(fields))
 		}
 		if !strings.HasPrefix(fields[0], prefix) {
@@ -226,9 +238,17 @@ func (s *KeepService) index(ctx context.Context, c *Client, prefix, url string)
 			// 33658-09-27.)
 			mtime = mtime * 1e9
 		}
+		var atime int64
+		if len(fields) == 3 {
+			atime, err = strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Malformed index line %q: atime: %v", line, err)
+			}
+		}
 		entries = append(entries, KeepServiceIndexEntry{
 			SizedDigest: SizedDigest(fields[0]),
 			Mtime:       mtime,
+			Atime:       atime,
 		})
 		atomic.AddInt64(&progress, 1)
 	}
@@ -6,7 +6,9 @@ package arvados
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"net/http/httptest"
 
 	check "gopkg.in/check.v1"
 )
@@ -26,3 +28,24 @@ func (*KeepServiceSuite) TestIndexTimeout(c *check.C) {
 	_, err := (&KeepService{}).IndexMount(context.Background(), client, "fake", "")
 	c.Check(err, check.ErrorMatches, `.*timeout.*`)
 }
+
+func (*KeepServiceSuite) TestIndexAtime(c *check.C) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query = req.URL.RawQuery
+		w.Write([]byte("acbd18db4cc2f85cedef654fccc4a4d8+3 1700000000000000000 1700000001000000000\n" +
+			"37b51d194a7513e45b56f6524f2d51f2+3 1700000002000000000\n\n"))
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+	ks := &KeepService{ServiceHost: addr.IP.String(), ServicePort: addr.Port}
+	client := &Client{Client: http.DefaultClient, APIHost: "zzzzz.arvadosapi.com", AuthToken: "xyzzy"}
+
+	ents, err := ks.Index(context.Background(), client, "")
+	c.Assert(err, check.IsNil)
+	c.Check(query, check.Equals, "atime=true")
+	c.Check(ents, check.DeepEquals, []KeepServiceIndexEntry{
+		{SizedDigest: "acbd18db4cc2f85cedef654fccc4a4d8+3", Mtime: 1700000000000000000, Atime: 1700000001000000000},
+		{SizedDigest: "37b51d194a7513e45b56f6524f2d51f2+3", Mtime: 1700000002000000000},
+	})
+}
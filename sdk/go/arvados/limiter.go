@@ -39,23 +39,7 @@ func (rl *requestLimiter) Acquire(ctx context.Context) {
 		rl.cond = sync.NewCond(&rl.lock)
 		rl.limit = requestLimiterInitialLimit
 	}
-	// Wait out the quiet period(s) immediately following a 503.
-	for ctx.Err() == nil {
-		delay := rl.quietUntil.Sub(time.Now())
-		if delay < 0 {
-			break
-		}
-		// Wait for the end of the quiet period, which started
-		// when we last received a 503 response.
-		rl.lock.Unlock()
-		timer := time.NewTimer(delay)
-		select {
-		case <-timer.C:
-		case <-ctx.Done():
-			timer.Stop()
-		}
-		rl.lock.Lock()
-	}
+	rl.waitQuietPeriod(ctx)
 	ready := make(chan struct{})
 	go func() {
 		// close ready when a slot is available _or_ we wake
@@ -88,6 +72,46 @@ func (rl *requestLimiter) Acquire(ctx context.Context) {
 	}
 }
 
+// waitQuietPeriod waits out the quiet period(s) immediately following
+// a 503 or 429 response, or until ctx is done. The caller must hold
+// rl.lock.
+func (rl *requestLimiter) waitQuietPeriod(ctx context.Context) {
+	for ctx.Err() == nil {
+		delay := rl.quietUntil.Sub(time.Now())
+		if delay < 0 {
+			break
+		}
+		// Wait for the end of the quiet period, which started
+		// when we last received a 503 or 429 response.
+		rl.lock.Unlock()
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		rl.lock.Lock()
+	}
+}
+
+// Wait waits until the current quiet period (if any) ends or ctx is
+// done, without reserving a request slot.
+func (rl *requestLimiter) Wait(ctx context.Context) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.waitQuietPeriod(ctx)
+}
+
+// Pause extends the current quiet period, if necessary, so no new
+// requests start for the given duration.
+func (rl *requestLimiter) Pause(d time.Duration) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if until := time.Now().Add(d); until.After(rl.quietUntil) {
+		rl.quietUntil = until
+	}
+}
+
 // Release releases a slot that has been reserved with Acquire.
 func (rl *requestLimiter) Release() {
 	rl.lock.Lock()
@@ -99,8 +123,20 @@ func (rl *requestLimiter) Release() {
 // Report uses the return values from (*http.Client)Do() to adjust the
 // outgoing request limit (increase on success, decrease on 503).
 //
+// A 429 response does not change the limit, but starts a quiet
+// period lasting until the time indicated by the Retry-After header,
+// or requestLimiterQuietPeriod if none is given.
+//
 // Return value is true if the response was a 503.
 func (rl *requestLimiter) Report(resp *http.Response, err error) bool {
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		d := retryAfter(resp)
+		if d < requestLimiterQuietPeriod {
+			d = requestLimiterQuietPeriod
+		}
+		rl.Pause(d)
+		return false
+	}
 	rl.lock.Lock()
 	defer rl.lock.Unlock()
 	is503 := false
@@ -108,3 +108,27 @@ func (*limiterSuite) TestReducedLimitAndQuietPeriod(c *C) {
 	// OK to call Report() with nil Response and non-nil error.
 	rl.Report(nil, errors.New("network error"))
 }
+
+func (*limiterSuite) TestQuietPeriodAfter429(c *C) {
+	defer func(orig time.Duration) { requestLimiterQuietPeriod = orig }(requestLimiterQuietPeriod)
+	requestLimiterQuietPeriod = time.Second / 10
+	rl := requestLimiter{}
+	rl.Acquire(context.Background())
+	rl.Report(&http.Response{StatusCode: http.StatusTooManyRequests}, nil)
+	c.Check(rl.limit, Equals, requestLimiterInitialLimit)
+	c.Check(rl.quietUntil.Sub(time.Now()) > requestLimiterQuietPeriod/2, Equals, true)
+	rl.Release()
+
+	// Retry-After header extends the quiet period.
+	rl.Report(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"2"}}}, nil)
+	c.Check(rl.quietUntil.Sub(time.Now()) > time.Second, Equals, true)
+
+	// A shorter pause doesn't shorten the quiet period.
+	rl.Pause(time.Millisecond)
+	c.Check(rl.quietUntil.Sub(time.Now()) > time.Second, Equals, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestLimiterQuietPeriod)
+	defer cancel()
+	rl.Wait(ctx)
+	c.Check(ctx.Err(), Equals, context.DeadlineExceeded)
+}
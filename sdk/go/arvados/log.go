@@ -5,9 +5,22 @@
 package arvados
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
 	"time"
 )
 
+// Event types of log entries recorded by the API server when an
+// object is created, updated, or deleted.
+const (
+	LogEventCreate = "create"
+	LogEventUpdate = "update"
+	LogEventDelete = "delete"
+)
+
 // Log is an arvados#log record
 type Log struct {
 	ID              int64                  `json:"id"`
@@ -16,7 +29,7 @@ type Log struct {
 	ObjectUUID      string                 `json:"object_uuid"`
 	ObjectOwnerUUID string                 `json:"object_owner_uuid"`
 	EventType       string                 `json:"event_type"`
-	EventAt         time.Time              `json:"event"`
+	EventAt         time.Time              `json:"event_at"`
 	Summary         string                 `json:"summary"`
 	Properties      map[string]interface{} `json:"properties"`
 	CreatedAt       time.Time              `json:"created_at"`
@@ -30,3 +43,142 @@ type LogList struct {
 	Offset         int   `json:"offset"`
 	Limit          int   `json:"limit"`
 }
+
+// LogChange is the "properties" field of a create, update, or delete
+// log entry.
+type LogChange struct {
+	OldETag       string                 `json:"old_etag"`
+	OldAttributes map[string]interface{} `json:"old_attributes"`
+	NewAttributes map[string]interface{} `json:"new_attributes"`
+}
+
+// Change returns the properties of a create, update, or delete log
+// entry. It returns an error if the log entry has a different event
+// type.
+func (l Log) Change() (LogChange, error) {
+	var change LogChange
+	switch l.EventType {
+	case LogEventCreate, LogEventUpdate, LogEventDelete:
+	default:
+		return change, fmt.Errorf("log entry %s has event type %q, not create/update/delete", l.UUID, l.EventType)
+	}
+	buf, err := json.Marshal(l.Properties)
+	if err != nil {
+		return change, err
+	}
+	err = json.Unmarshal(buf, &change)
+	return change, err
+}
+
+// ChangedAttributes returns the (sorted) names of attributes whose
+// values differ between OldAttributes and NewAttributes.
+func (c LogChange) ChangedAttributes() []string {
+	var changed []string
+	for k, v := range c.NewAttributes {
+		if old, ok := c.OldAttributes[k]; !ok || !reflect.DeepEqual(old, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range c.OldAttributes {
+		if _, ok := c.NewAttributes[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// LogQuery selects log entries, e.g., the audit trail for an object
+// during a given time interval. Zero-valued fields do not restrict
+// the results.
+type LogQuery struct {
+	ObjectUUID string
+	EventTypes []string
+
+	// Return entries whose event_at is >= Since and < Until.
+	Since time.Time
+	Until time.Time
+
+	// Return entries whose ID is greater than AfterID, e.g., to
+	// resume after the last entry seen previously.
+	AfterID int64
+
+	// Number of entries to retrieve per API call. If zero, the
+	// API server's default is used.
+	PageSize int
+}
+
+// Filters returns the API filters for the query.
+func (q LogQuery) Filters() []Filter {
+	var filters []Filter
+	if q.ObjectUUID != "" {
+		filters = append(filters, Filter{"object_uuid", "=", q.ObjectUUID})
+	}
+	if len(q.EventTypes) > 0 {
+		filters = append(filters, Filter{"event_type", "in", q.EventTypes})
+	}
+	if !q.Since.IsZero() {
+		filters = append(filters, Filter{"event_at", ">=", q.Since.UTC().Format(time.RFC3339Nano)})
+	}
+	if !q.Until.IsZero() {
+		filters = append(filters, Filter{"event_at", "<", q.Until.UTC().Format(time.RFC3339Nano)})
+	}
+	if q.AfterID > 0 {
+		filters = append(filters, Filter{"id", ">", q.AfterID})
+	}
+	return filters
+}
+
+// ListOptions returns the options for retrieving the first page of
+// results, in ID order, using the API interface (see LogList).
+func (q LogQuery) ListOptions() ListOptions {
+	opts := ListOptions{
+		Filters: q.Filters(),
+		Order:   []string{"id asc"},
+		Count:   "none",
+		Limit:   -1,
+	}
+	if q.PageSize > 0 {
+		opts.Limit = int64(q.PageSize)
+	}
+	return opts
+}
+
+// ResourceListParams returns the parameters for retrieving the first
+// page of results, in ID order, using a Client.
+func (q LogQuery) ResourceListParams() ResourceListParams {
+	params := ResourceListParams{
+		Filters: q.Filters(),
+		Order:   "id asc",
+		Count:   "none",
+	}
+	if q.PageSize > 0 {
+		params.Limit = &q.PageSize
+	}
+	return params
+}
+
+// EachLog calls f once for each log entry selected by q, in ID
+// order. Results are retrieved one page at a time, using the ID of
+// the last entry on each page (rather than an offset) to retrieve
+// the next page, so entries added during iteration are not skipped
+// or repeated. EachLog stops if f returns an error.
+func (c *Client) EachLog(ctx context.Context, q LogQuery, f func(Log) error) error {
+	for {
+		var page LogList
+		err := c.RequestAndDecodeContext(ctx, &page, "GET", "arvados/v1/logs", nil, q.ResourceListParams())
+		if err != nil {
+			return err
+		}
+		if len(page.Items) == 0 {
+			return nil
+		}
+		for _, item := range page.Items {
+			err = f(item)
+			if err != nil {
+				return err
+			}
+		}
+		q.AfterID = page.Items[len(page.Items)-1].ID
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&logSuite{})
+
+type logSuite struct{}
+
+func (s *logSuite) TestLogChange(c *check.C) {
+	var logent Log
+	err := json.Unmarshal([]byte(`{
+		"uuid": "zzzzz-57u5n-000000000000000",
+		"event_type": "update",
+		"event_at": "2024-01-02T03:04:05.000000006Z",
+		"properties": {
+			"old_etag": "abc",
+			"old_attributes": {"name": "foo", "owner_uuid": "zzzzz-tpzed-000000000000000", "description": "x"},
+			"new_attributes": {"name": "bar", "owner_uuid": "zzzzz-tpzed-000000000000000", "trash_at": null}
+		}
+	}`), &logent)
+	c.Assert(err, check.IsNil)
+	c.Check(logent.EventAt.Equal(time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)), check.Equals, true)
+	change, err := logent.Change()
+	c.Assert(err, check.IsNil)
+	c.Check(change.OldETag, check.Equals, "abc")
+	c.Check(change.NewAttributes["name"], check.Equals, "bar")
+	c.Check(change.ChangedAttributes(), check.DeepEquals, []string{"description", "name", "trash_at"})
+
+	logent.EventType = "stderr"
+	_, err = logent.Change()
+	c.Check(err, check.ErrorMatches, `.*event type "stderr".*`)
+}
+
+func (s *logSuite) TestLogQueryFilters(c *check.C) {
+	c.Check(LogQuery{}.Filters(), check.HasLen, 0)
+	t1 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("x", 3600))
+	t2 := t1.Add(time.Hour)
+	q := LogQuery{
+		ObjectUUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+		EventTypes: []string{LogEventCreate, LogEventUpdate},
+		Since:      t1,
+		Until:      t2,
+		AfterID:    123,
+	}
+	c.Check(q.Filters(), check.DeepEquals, []Filter{
+		{"object_uuid", "=", "zzzzz-4zz18-aaaaaaaaaaaaaaa"},
+		{"event_type", "in", []string{"create", "update"}},
+		{"event_at", ">=", "2024-01-02T02:04:05Z"},
+		{"event_at", "<", "2024-01-02T03:04:05Z"},
+		{"id", ">", int64(123)},
+	})
+	opts := q.ListOptions()
+	c.Check(opts.Order, check.DeepEquals, []string{"id asc"})
+	c.Check(opts.Limit, check.Equals, int64(-1))
+	q.PageSize = 10
+	c.Check(q.ListOptions().Limit, check.Equals, int64(10))
+	c.Check(*q.ResourceListParams().Limit, check.Equals, 10)
+}
+
+func (s *logSuite) TestEachLog(c *check.C) {
+	var queries []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/arvados/v1/logs")
+		r.ParseForm()
+		queries = append(queries, r.Form.Get("filters"))
+		var filters []Filter
+		c.Check(json.Unmarshal([]byte(r.Form.Get("filters")), &filters), check.IsNil)
+		after := int64(0)
+		for _, f := range filters {
+			if f.Attr == "id" {
+				after = int64(f.Operand.(float64))
+			}
+		}
+		limit, _ := strconv.Atoi(r.Form.Get("limit"))
+		var page LogList
+		// The fake has 5 entries with IDs 11..15.
+		for id := after + 1; id <= 15 && len(page.Items) < limit; id++ {
+			if id < 11 {
+				id = 11
+			}
+			page.Items = append(page.Items, Log{ID: id, EventType: "update"})
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+	client := &Client{
+		APIHost:   strings.TrimPrefix(server.URL, "https://"),
+		AuthToken: "zzz",
+		Insecure:  true,
+		Timeout:   2 * time.Second,
+	}
+
+	var ids []int64
+	err := client.EachLog(context.Background(), LogQuery{ObjectUUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa", PageSize: 2}, func(l Log) error {
+		ids = append(ids, l.ID)
+		return nil
+	})
+	c.Check(err, check.IsNil)
+	c.Check(ids, check.DeepEquals, []int64{11, 12, 13, 14, 15})
+	c.Check(queries, check.HasLen, 4)
+	var filters []Filter
+	c.Check(json.Unmarshal([]byte(queries[0]), &filters), check.IsNil)
+	c.Check(filters, check.DeepEquals, []Filter{{"object_uuid", "=", "zzzzz-4zz18-aaaaaaaaaaaaaaa"}})
+	c.Check(json.Unmarshal([]byte(queries[1]), &filters), check.IsNil)
+	c.Check(filters, check.DeepEquals, []Filter{{"object_uuid", "=", "zzzzz-4zz18-aaaaaaaaaaaaaaa"}, {"id", ">", float64(12)}})
+
+	// Iteration stops at the first error returned by f.
+	ids = nil
+	errStop := errors.New("stop")
+	err = client.EachLog(context.Background(), LogQuery{PageSize: 2, AfterID: 12}, func(l Log) error {
+		ids = append(ids, l.ID)
+		return errStop
+	})
+	c.Check(err, check.Equals, errStop)
+	c.Check(ids, check.DeepEquals, []int64{13})
+}
@@ -0,0 +1,200 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// mutationGroupMaxAttempts is the number of times a MutationGroup
+// step is attempted before giving up on 429 and 503 errors.
+var mutationGroupMaxAttempts = 10
+
+// A MutationGroup runs a sequence of dependent API mutations (e.g.,
+// create a collection, then a container request that uses it, then
+// some links) and undoes the earlier steps if a later step fails, so
+// a half-finished sequence doesn't leave orphaned objects behind.
+//
+// Each step is retried after a pause if it fails with a 429 (Too Many
+// Requests) or 503 error, in cooperation with the Client's
+// rate-limit feedback (see ParallelGroup). Any other error is
+// permanent: the undo funcs of the steps that have already
+// succeeded are called in reverse order, and the step's error is
+// returned.
+//
+// Example:
+//
+//	mg := client.NewMutationGroup(ctx)
+//	defer mg.Rollback()
+//	var coll Collection
+//	err := mg.Create(&coll, "arvados/v1/collections", map[string]interface{}{
+//		"collection": map[string]interface{}{"name": "input"},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	var cr ContainerRequest
+//	err = mg.Create(&cr, "arvados/v1/container_requests", map[string]interface{}{
+//		"container_request": map[string]interface{}{"mounts": ...coll.PortableDataHash...},
+//	})
+//	if err != nil {
+//		return err // collection has already been deleted
+//	}
+//	mg.Commit()
+type MutationGroup struct {
+	client    *Client
+	ctx       context.Context
+	undo      []mutationUndo
+	err       error
+	committed bool
+}
+
+type mutationUndo struct {
+	name string
+	f    func(context.Context) error
+}
+
+// NewMutationGroup returns a new MutationGroup. Steps are called with
+// ctx. Undo funcs are called with a context that is not canceled when
+// ctx is, because a canceled ctx is a common reason for a step to
+// fail.
+func (c *Client) NewMutationGroup(ctx context.Context) *MutationGroup {
+	return &MutationGroup{
+		client: c,
+		ctx:    ctx,
+	}
+}
+
+// Do calls do, retrying as needed. If it succeeds, undo (if not nil)
+// is remembered so it can be called if a later step fails or
+// Rollback is called.
+//
+// If do fails, the earlier steps are undone and the error is
+// returned. If any undo func also fails, the returned error
+// mentions that, too.
+//
+// If an earlier step has failed, or Commit or Rollback has been
+// called, Do returns an error without calling do.
+func (mg *MutationGroup) Do(do, undo func(context.Context) error) error {
+	return mg.do("", do, undo)
+}
+
+// Create creates an object by sending a POST request with the given
+// body to the given path (e.g., "arvados/v1/collections"), and
+// decodes the response into dst (which may be nil). If a later step
+// fails, the new object is deleted.
+func (mg *MutationGroup) Create(dst interface{}, path string, body map[string]interface{}) error {
+	var uuid string
+	return mg.do(path, func(ctx context.Context) error {
+		var resp json.RawMessage
+		err := mg.client.RequestAndDecodeContext(ctx, &resp, "POST", path, nil, body)
+		if err != nil {
+			return err
+		}
+		var created struct {
+			UUID string `json:"uuid"`
+		}
+		if err := json.Unmarshal(resp, &created); err != nil {
+			return err
+		} else if created.UUID == "" {
+			return fmt.Errorf("%s: response has no uuid", path)
+		}
+		uuid = created.UUID
+		if dst != nil {
+			return json.Unmarshal(resp, dst)
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		return mg.client.RequestAndDecodeContext(ctx, nil, "DELETE", strings.TrimSuffix(path, "/")+"/"+uuid, nil, nil)
+	})
+}
+
+func (mg *MutationGroup) do(name string, do, undo func(context.Context) error) error {
+	if mg.err != nil {
+		return mg.err
+	} else if mg.committed {
+		return errors.New("MutationGroup: already committed")
+	}
+	err := mg.call(mg.ctx, do)
+	if err != nil {
+		if rberr := mg.rollback(); rberr != nil {
+			err = fmt.Errorf("%w (rollback failed: %s)", err, rberr)
+		}
+		mg.err = err
+		return err
+	}
+	if undo != nil {
+		mg.undo = append(mg.undo, mutationUndo{name: name, f: undo})
+	}
+	return nil
+}
+
+// Commit discards the undo funcs of all steps so far, so Rollback
+// has no effect. No more steps can be added after Commit.
+func (mg *MutationGroup) Commit() {
+	mg.undo = nil
+	mg.committed = true
+}
+
+// Rollback calls the undo funcs of all steps so far, in reverse
+// order, unless Commit has been called. It is safe to call Rollback
+// more than once, so it is convenient to defer it right after
+// NewMutationGroup.
+//
+// Rollback returns an error if any undo func fails. All undo funcs
+// are called regardless.
+func (mg *MutationGroup) Rollback() error {
+	if mg.committed {
+		return nil
+	}
+	err := mg.rollback()
+	if mg.err == nil {
+		mg.err = errors.New("MutationGroup: rolled back")
+	}
+	return err
+}
+
+func (mg *MutationGroup) rollback() error {
+	ctx := context.WithoutCancel(mg.ctx)
+	var errs []string
+	for i := len(mg.undo) - 1; i >= 0; i-- {
+		err := mg.call(ctx, mg.undo[i].f)
+		if err != nil {
+			if name := mg.undo[i].name; name != "" {
+				err = fmt.Errorf("%s: %w", name, err)
+			}
+			errs = append(errs, err.Error())
+		}
+	}
+	mg.undo = nil
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// call calls f, retrying after a pause when f fails with a 429 or
+// 503 error.
+func (mg *MutationGroup) call(ctx context.Context, f func(context.Context) error) error {
+	limiter := mg.client.getRequestLimiter()
+	for attempt := 1; ; attempt++ {
+		err := f(ctx)
+		var se interface{ HTTPStatus() int }
+		if attempt >= mutationGroupMaxAttempts || !errors.As(err, &se) ||
+			(se.HTTPStatus() != http.StatusTooManyRequests && se.HTTPStatus() != http.StatusServiceUnavailable) {
+			return err
+		}
+		limiter.Pause(requestLimiterQuietPeriod)
+		limiter.Wait(ctx)
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&mutationSuite{})
+
+type mutationSuite struct {
+	origLimiterQuietPeriod time.Duration
+}
+
+func (s *mutationSuite) SetUpTest(c *check.C) {
+	s.origLimiterQuietPeriod = requestLimiterQuietPeriod
+	requestLimiterQuietPeriod = time.Millisecond
+}
+
+func (s *mutationSuite) TearDownTest(c *check.C) {
+	requestLimiterQuietPeriod = s.origLimiterQuietPeriod
+}
+
+// step returns do and undo funcs that append to *log.
+func (s *mutationSuite) step(log *[]string, name string, err error) (do, undo func(context.Context) error) {
+	return func(context.Context) error {
+			*log = append(*log, "do "+name)
+			return err
+		}, func(ctx context.Context) error {
+			*log = append(*log, "undo "+name)
+			return ctx.Err()
+		}
+}
+
+func (s *mutationSuite) TestCommit(c *check.C) {
+	client := &Client{requestLimiter: &requestLimiter{}}
+	mg := client.NewMutationGroup(context.Background())
+	var log []string
+	c.Check(mg.Do(s.step(&log, "a", nil)), check.IsNil)
+	c.Check(mg.Do(s.step(&log, "b", nil)), check.IsNil)
+	mg.Commit()
+	c.Check(mg.Rollback(), check.IsNil)
+	c.Check(log, check.DeepEquals, []string{"do a", "do b"})
+	c.Check(mg.Do(s.step(&log, "c", nil)), check.ErrorMatches, `.*already committed`)
+	c.Check(log, check.HasLen, 2)
+}
+
+func (s *mutationSuite) TestRollbackOnError(c *check.C) {
+	client := &Client{requestLimiter: &requestLimiter{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	mg := client.NewMutationGroup(ctx)
+	var log []string
+	errFailed := errors.New("failed")
+	c.Check(mg.Do(s.step(&log, "a", nil)), check.IsNil)
+	doB, _ := s.step(&log, "b", nil)
+	c.Check(mg.Do(doB, nil), check.IsNil)
+	c.Check(mg.Do(s.step(&log, "c", nil)), check.IsNil)
+	// Undo funcs must still work after the caller's context is
+	// canceled.
+	cancel()
+	err := mg.Do(s.step(&log, "d", errFailed))
+	c.Check(errors.Is(err, errFailed), check.Equals, true)
+	c.Check(log, check.DeepEquals, []string{"do a", "do b", "do c", "do d", "undo c", "undo a"})
+
+	// Subsequent steps are not attempted, and rollback is not
+	// repeated.
+	c.Check(mg.Do(s.step(&log, "e", nil)), check.Equals, err)
+	c.Check(mg.Rollback(), check.IsNil)
+	c.Check(log, check.HasLen, 6)
+}
+
+func (s *mutationSuite) TestRollbackError(c *check.C) {
+	client := &Client{requestLimiter: &requestLimiter{}}
+	mg := client.NewMutationGroup(context.Background())
+	var log []string
+	c.Check(mg.Do(s.step(&log, "a", nil)), check.IsNil)
+	c.Check(mg.Do(func(context.Context) error { return nil }, func(context.Context) error {
+		log = append(log, "undo b")
+		return errors.New("undo b failed")
+	}), check.IsNil)
+	err := mg.Do(s.step(&log, "c", errors.New("c failed")))
+	c.Check(err, check.ErrorMatches, `c failed \(rollback failed: undo b failed\)`)
+	c.Check(log, check.DeepEquals, []string{"do a", "do c", "undo b", "undo a"})
+}
+
+func (s *mutationSuite) TestExplicitRollback(c *check.C) {
+	client := &Client{requestLimiter: &requestLimiter{}}
+	mg := client.NewMutationGroup(context.Background())
+	var log []string
+	c.Check(mg.Do(s.step(&log, "a", nil)), check.IsNil)
+	c.Check(mg.Do(s.step(&log, "b", nil)), check.IsNil)
+	c.Check(mg.Rollback(), check.IsNil)
+	c.Check(mg.Rollback(), check.IsNil)
+	c.Check(log, check.DeepEquals, []string{"do a", "do b", "undo b", "undo a"})
+	c.Check(mg.Do(s.step(&log, "c", nil)), check.ErrorMatches, `.*rolled back`)
+}
+
+func (s *mutationSuite) TestRetry(c *check.C) {
+	defer func(orig int) { mutationGroupMaxAttempts = orig }(mutationGroupMaxAttempts)
+	mutationGroupMaxAttempts = 3
+	client := &Client{requestLimiter: &requestLimiter{}}
+	mg := client.NewMutationGroup(context.Background())
+	attempts := 0
+	c.Check(mg.Do(func(context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return &TransactionError{StatusCode: http.StatusServiceUnavailable}
+		}
+		return nil
+	}, nil), check.IsNil)
+	c.Check(attempts, check.Equals, 3)
+
+	attempts = 0
+	err := mg.Do(func(context.Context) error {
+		attempts++
+		return &TransactionError{StatusCode: http.StatusTooManyRequests}
+	}, nil)
+	c.Check(err, check.FitsTypeOf, &TransactionError{})
+	c.Check(attempts, check.Equals, 3)
+
+	// Other errors are not retried.
+	mg = client.NewMutationGroup(context.Background())
+	attempts = 0
+	err = mg.Do(func(context.Context) error {
+		attempts++
+		return &TransactionError{StatusCode: http.StatusUnprocessableEntity}
+	}, nil)
+	c.Check(err, check.FitsTypeOf, &TransactionError{})
+	c.Check(attempts, check.Equals, 1)
+}
+
+func (s *mutationSuite) TestCreate(c *check.C) {
+	var mtx sync.Mutex
+	var reqs []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		reqs = append(reqs, r.Method+" "+r.URL.Path)
+		mtx.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/arvados/v1/collections":
+			w.Write([]byte(`{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa","name":"foo"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/arvados/v1/links":
+			w.Write([]byte(`{"uuid":"zzzzz-o0j2j-aaaaaaaaaaaaaaa"}`))
+		case r.Method == http.MethodDelete:
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"errors":["rejected"]}`))
+		}
+	}))
+	defer server.Close()
+	client := &Client{
+		APIHost:   strings.TrimPrefix(server.URL, "https://"),
+		AuthToken: "zzz",
+		Insecure:  true,
+		Timeout:   2 * time.Second,
+	}
+	mg := client.NewMutationGroup(context.Background())
+	var coll Collection
+	c.Check(mg.Create(&coll, "arvados/v1/collections", map[string]interface{}{"collection": map[string]interface{}{"name": "foo"}}), check.IsNil)
+	c.Check(coll.UUID, check.Equals, "zzzzz-4zz18-aaaaaaaaaaaaaaa")
+	c.Check(coll.Name, check.Equals, "foo")
+	c.Check(mg.Create(nil, "arvados/v1/links", nil), check.IsNil)
+	err := mg.Create(nil, "arvados/v1/container_requests", nil)
+	c.Check(err, check.ErrorMatches, `.*rejected.*`)
+	c.Check(reqs, check.DeepEquals, []string{
+		"POST /arvados/v1/collections",
+		"POST /arvados/v1/links",
+		"POST /arvados/v1/container_requests",
+		"DELETE /arvados/v1/links/zzzzz-o0j2j-aaaaaaaaaaaaaaa",
+		"DELETE /arvados/v1/collections/zzzzz-4zz18-aaaaaaaaaaaaaaa",
+	})
+}
@@ -0,0 +1,390 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// Link class and names used by LinkOutputProvenance.
+const (
+	ProvenanceLinkClass      = "provenance"
+	ProvenanceLinkOutput     = "output"
+	ProvenanceLinkOutputDiff = "output_diff"
+)
+
+// Maximum number of paths of each kind (added, removed, changed)
+// listed in the properties of an output_diff link.
+const maxProvenanceLinkPaths = 1000
+
+// CollectionFileChange is a file that was added, removed, or changed
+// between two collections.
+type CollectionFileChange struct {
+	// Path relative to the collection root, e.g.,
+	// "dir/file.txt".
+	Path string
+	// Size of the file in the old and new collections. OldSize
+	// is -1 if the file was added, NewSize is -1 if it was
+	// removed.
+	OldSize int64
+	NewSize int64
+}
+
+// CollectionFileDiff is the file-level difference between two
+// collections, as returned by DiffManifestFiles.
+type CollectionFileDiff struct {
+	Added     []CollectionFileChange
+	Removed   []CollectionFileChange
+	Changed   []CollectionFileChange
+	Unchanged int
+}
+
+// Identical returns true if there are no added, removed, or changed
+// files.
+func (d CollectionFileDiff) Identical() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// A FileSegment is a range of a file's data stored in a Keep block.
+type FileSegment struct {
+	// Block hash and size, without hints, e.g.,
+	// "acbd18db4cc2f85cedef654fccc4a4d8+3".
+	Locator string
+	// Position of the data in the block.
+	Offset int
+	Length int
+}
+
+// FileSegments returns the data segments of each file in the given
+// manifest, keyed by path relative to the collection root.
+//
+// Segment lists are normalized: locator hints are removed, empty
+// segments are dropped, and adjacent segments of the same block are
+// merged. Two files have equal segment lists if and only if they
+// refer to the same data in the same blocks, regardless of how their
+// manifests were written or which other files share those blocks.
+func FileSegments(manifestText string) (map[string][]FileSegment, error) {
+	cfs, err := (&Collection{ManifestText: manifestText}).FileSystem(nil, manifestOnlyKeepClient{})
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]FileSegment{}
+	err = fs.WalkDir(IOFS(cfs), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		snap, err := Snapshot(cfs, p)
+		if err != nil {
+			return err
+		}
+		fn, ok := snap.inode.(*filenode)
+		if !ok {
+			return fmt.Errorf("%s: unexpected inode type %T", p, snap.inode)
+		}
+		segs := []FileSegment{}
+		for _, seg := range fn.segments {
+			stored, ok := seg.(storedSegment)
+			if !ok {
+				return fmt.Errorf("%s: unexpected segment type %T", p, seg)
+			}
+			if stored.length == 0 {
+				continue
+			}
+			loc := fmt.Sprintf("%s+%d", stripAllHints(stored.locator), stored.size)
+			if n := len(segs); n > 0 && segs[n-1].Locator == loc && segs[n-1].Offset+segs[n-1].Length == stored.offset {
+				segs[n-1].Length += stored.length
+				continue
+			}
+			segs = append(segs, FileSegment{Locator: loc, Offset: stored.offset, Length: stored.length})
+		}
+		files[p] = segs
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// manifestOnlyKeepClient is a keepClient for collection filesystems
+// that are only used to inspect manifests, without reading or
+// writing file data. Locators are used as is.
+type manifestOnlyKeepClient struct{}
+
+var errManifestOnly = errors.New("file data is not available (manifest-only filesystem)")
+
+func (manifestOnlyKeepClient) ReadAt(string, []byte, int) (int, error) { return 0, errManifestOnly }
+func (manifestOnlyKeepClient) BlockWrite(context.Context, BlockWriteOptions) (BlockWriteResponse, error) {
+	return BlockWriteResponse{}, errManifestOnly
+}
+func (manifestOnlyKeepClient) LocalLocator(locator string) (string, error) { return locator, nil }
+
+// segmentsSize returns the total length of the given segments.
+func segmentsSize(segs []FileSegment) int64 {
+	var size int64
+	for _, seg := range segs {
+		size += int64(seg.Length)
+	}
+	return size
+}
+
+func segmentsEqual(a, b []FileSegment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// DiffManifestFiles compares the files in two collections by path
+// and content. Directories, including empty ones, are not compared.
+// Each list in the returned diff is sorted by path.
+//
+// Files with equal segment lists (see FileSegments) are unchanged,
+// and files of different sizes are changed. If kc is not nil, other
+// files are compared by reading their data, so a file is not
+// reported as changed just because it is stored in different blocks,
+// e.g., packed together with a different set of small files. If kc
+// is nil, such files are reported as changed.
+func DiffManifestFiles(oldManifest, newManifest string, kc KeepGateway) (CollectionFileDiff, error) {
+	var diff CollectionFileDiff
+	oldFiles, err := FileSegments(oldManifest)
+	if err != nil {
+		return diff, fmt.Errorf("error reading old manifest: %w", err)
+	}
+	newFiles, err := FileSegments(newManifest)
+	if err != nil {
+		return diff, fmt.Errorf("error reading new manifest: %w", err)
+	}
+	var oldfs, newfs CollectionFileSystem
+	for p, oldSegs := range oldFiles {
+		newSegs, ok := newFiles[p]
+		if !ok {
+			diff.Removed = append(diff.Removed, CollectionFileChange{Path: p, OldSize: segmentsSize(oldSegs), NewSize: -1})
+			continue
+		}
+		oldSize, newSize := segmentsSize(oldSegs), segmentsSize(newSegs)
+		same := segmentsEqual(oldSegs, newSegs)
+		if !same && oldSize == newSize && kc != nil {
+			if oldfs == nil {
+				oldfs, err = (&Collection{ManifestText: oldManifest}).FileSystem(nil, kc)
+				if err != nil {
+					return diff, err
+				}
+				newfs, err = (&Collection{ManifestText: newManifest}).FileSystem(nil, kc)
+				if err != nil {
+					return diff, err
+				}
+			}
+			same, err = sameFileContent(oldfs, newfs, p)
+			if err != nil {
+				return diff, err
+			}
+		}
+		if same {
+			diff.Unchanged++
+		} else {
+			diff.Changed = append(diff.Changed, CollectionFileChange{Path: p, OldSize: oldSize, NewSize: newSize})
+		}
+	}
+	for p, newSegs := range newFiles {
+		if _, ok := oldFiles[p]; !ok {
+			diff.Added = append(diff.Added, CollectionFileChange{Path: p, OldSize: -1, NewSize: segmentsSize(newSegs)})
+		}
+	}
+	for _, list := range [][]CollectionFileChange{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	return diff, nil
+}
+
+// sameFileContent returns true if the file at the given path has
+// the same content in both filesystems.
+func sameFileContent(oldfs, newfs FileSystem, path string) (bool, error) {
+	var sums [2][md5.Size]byte
+	for i, cfs := range []FileSystem{oldfs, newfs} {
+		f, err := cfs.Open(path)
+		if err != nil {
+			return false, err
+		}
+		h := md5.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return false, fmt.Errorf("error reading %s: %w", path, err)
+		}
+		copy(sums[i][:], h.Sum(nil))
+	}
+	return sums[0] == sums[1], nil
+}
+
+// OutputDiff is the difference between the output collections of
+// two container requests, as returned by DiffContainerRequestOutputs.
+type OutputDiff struct {
+	CollectionFileDiff
+	Old OutputRef
+	New OutputRef
+}
+
+// OutputRef identifies a container request and its output
+// collection.
+type OutputRef struct {
+	ContainerRequestUUID string
+	OutputUUID           string
+	OutputPDH            string
+}
+
+// DiffContainerRequestOutputs compares the output collections of two
+// container requests at the file level (see DiffManifestFiles), e.g.,
+// to check whether re-running a workflow step reproduced the
+// original results. If kc is not nil, it is used to compare the
+// content of files that are stored in different blocks.
+//
+// It returns an error if either container request has no output
+// collection (e.g., it has not finished).
+func (c *Client) DiffContainerRequestOutputs(ctx context.Context, oldUUID, newUUID string, kc KeepGateway) (*OutputDiff, error) {
+	oldRef, oldManifest, err := c.containerRequestOutput(ctx, oldUUID)
+	if err != nil {
+		return nil, err
+	}
+	newRef, newManifest, err := c.containerRequestOutput(ctx, newUUID)
+	if err != nil {
+		return nil, err
+	}
+	diff := &OutputDiff{Old: oldRef, New: newRef}
+	if oldRef.OutputPDH == newRef.OutputPDH {
+		// Same content, no need to look at the files
+		// individually, except to count them.
+		files, err := FileSegments(oldManifest)
+		if err != nil {
+			return nil, err
+		}
+		diff.Unchanged = len(files)
+		return diff, nil
+	}
+	diff.CollectionFileDiff, err = DiffManifestFiles(oldManifest, newManifest, kc)
+	if err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// containerRequestOutput returns the output collection of the given
+// container request, and its manifest text.
+func (c *Client) containerRequestOutput(ctx context.Context, uuid string) (OutputRef, string, error) {
+	ref := OutputRef{ContainerRequestUUID: uuid}
+	var cr ContainerRequest
+	err := c.RequestAndDecodeContext(ctx, &cr, "GET", "arvados/v1/container_requests/"+uuid, nil, map[string]interface{}{
+		"select": []string{"uuid", "output_uuid"},
+	})
+	if err != nil {
+		return ref, "", fmt.Errorf("error getting container request %s: %w", uuid, err)
+	}
+	if cr.OutputUUID == "" {
+		return ref, "", fmt.Errorf("container request %s has no output collection", uuid)
+	}
+	var coll Collection
+	err = c.RequestAndDecodeContext(ctx, &coll, "GET", "arvados/v1/collections/"+cr.OutputUUID, nil, map[string]interface{}{
+		"select": []string{"uuid", "portable_data_hash", "manifest_text"},
+	})
+	if err != nil {
+		return ref, "", fmt.Errorf("error getting output collection %s of container request %s: %w", cr.OutputUUID, uuid, err)
+	}
+	ref.OutputUUID = coll.UUID
+	ref.OutputPDH = coll.PortableDataHash
+	return ref, coll.ManifestText, nil
+}
+
+// LinkOutputProvenance records the result of
+// DiffContainerRequestOutputs as links owned by ownerUUID (or the
+// current user, if ownerUUID is empty):
+//
+//   - for each container request, an "output" link from the
+//     container request (tail) to its output collection (head),
+//     with the output's portable_data_hash in its properties, so the
+//     record survives later changes to the collection
+//
+//   - an "output_diff" link from the new container request (tail) to
+//     the old one (head), with the output PDHs, whether they are
+//     identical, the number of unchanged files, and the added,
+//     removed, and changed paths (up to 1000 of each, with a
+//     "truncated" property set if any list was cut short)
+//
+// All links have link_class "provenance". If any link cannot be
+// created, the ones already created are deleted.
+func (c *Client) LinkOutputProvenance(ctx context.Context, diff *OutputDiff, ownerUUID string) ([]Link, error) {
+	truncated := false
+	paths := func(list []CollectionFileChange) []string {
+		ret := []string{}
+		for _, change := range list {
+			if len(ret) >= maxProvenanceLinkPaths {
+				truncated = true
+				break
+			}
+			ret = append(ret, change.Path)
+		}
+		return ret
+	}
+	added, removed, changed := paths(diff.Added), paths(diff.Removed), paths(diff.Changed)
+	attrs := []map[string]interface{}{
+		{
+			"tail_uuid": diff.Old.ContainerRequestUUID,
+			"head_uuid": diff.Old.OutputUUID,
+			"name":      ProvenanceLinkOutput,
+			"properties": map[string]interface{}{
+				"portable_data_hash": diff.Old.OutputPDH,
+			},
+		},
+		{
+			"tail_uuid": diff.New.ContainerRequestUUID,
+			"head_uuid": diff.New.OutputUUID,
+			"name":      ProvenanceLinkOutput,
+			"properties": map[string]interface{}{
+				"portable_data_hash": diff.New.OutputPDH,
+			},
+		},
+		{
+			"tail_uuid": diff.New.ContainerRequestUUID,
+			"head_uuid": diff.Old.ContainerRequestUUID,
+			"name":      ProvenanceLinkOutputDiff,
+			"properties": map[string]interface{}{
+				"old_output_pdh": diff.Old.OutputPDH,
+				"new_output_pdh": diff.New.OutputPDH,
+				"identical":      diff.Identical(),
+				"unchanged":      diff.Unchanged,
+				"added":          added,
+				"removed":        removed,
+				"changed":        changed,
+				"truncated":      truncated,
+			},
+		},
+	}
+
+	mg := c.NewMutationGroup(ctx)
+	defer mg.Rollback()
+	links := make([]Link, len(attrs))
+	for i, link := range attrs {
+		link["link_class"] = ProvenanceLinkClass
+		if ownerUUID != "" {
+			link["owner_uuid"] = ownerUUID
+		}
+		err := mg.Create(&links[i], "arvados/v1/links", map[string]interface{}{"link": link})
+		if err != nil {
+			return nil, fmt.Errorf("error creating %s link: %w", link["name"], err)
+		}
+	}
+	mg.Commit()
+	return links, nil
+}
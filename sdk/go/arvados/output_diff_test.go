@@ -0,0 +1,303 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&outputDiffSuite{})
+
+const (
+	outputDiffFoo = "acbd18db4cc2f85cedef654fccc4a4d8+3"
+	outputDiffBar = "37b51d194a7513e45b56f6524f2d51f2+3"
+)
+
+type outputDiffSuite struct {
+	mtx sync.Mutex
+	// Output collection of each container request
+	crOutput map[string]string
+	// Manifest text of each collection
+	manifest map[string]string
+	// Links created, and UUIDs of links deleted
+	created []map[string]interface{}
+	deleted []string
+	// Fail the Nth link creation request (1-based)
+	failCreate int
+	server     *httptest.Server
+	client     *Client
+}
+
+func (s *outputDiffSuite) SetUpTest(c *check.C) {
+	s.crOutput = map[string]string{
+		"zzzzz-xvhdp-oldoldoldoldold": "zzzzz-4zz18-oldoldoldoldold",
+		"zzzzz-xvhdp-newnewnewnewnew": "zzzzz-4zz18-newnewnewnewnew",
+		"zzzzz-xvhdp-runningrunningr": "",
+	}
+	s.manifest = map[string]string{
+		"zzzzz-4zz18-oldoldoldoldold": ". " + outputDiffFoo + " " + outputDiffBar + " 0:3:same.txt 3:3:changed.txt 0:3:removed.txt\n" +
+			"./dir " + outputDiffFoo + " 0:3:sub.txt\n",
+		"zzzzz-4zz18-newnewnewnewnew": ". " + outputDiffFoo + " " + outputDiffBar + " 0:3:same.txt 0:3:changed.txt 3:3:added.txt\n" +
+			"./dir " + outputDiffFoo + " 0:3:sub.txt\n",
+	}
+	s.created = nil
+	s.deleted = nil
+	s.failCreate = 0
+	s.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		switch {
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/arvados/v1/container_requests/"):
+			uuid := strings.TrimPrefix(r.URL.Path, "/arvados/v1/container_requests/")
+			output, ok := s.crOutput[uuid]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors":["not found"]}`))
+				return
+			}
+			json.NewEncoder(w).Encode(ContainerRequest{UUID: uuid, OutputUUID: output})
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/arvados/v1/collections/"):
+			uuid := strings.TrimPrefix(r.URL.Path, "/arvados/v1/collections/")
+			mt := s.manifest[uuid]
+			json.NewEncoder(w).Encode(Collection{UUID: uuid, ManifestText: mt, PortableDataHash: PortableDataHash(mt)})
+		case r.Method == http.MethodPost && r.URL.Path == "/arvados/v1/links":
+			r.ParseForm()
+			var link map[string]interface{}
+			json.Unmarshal([]byte(r.Form.Get("link")), &link)
+			s.created = append(s.created, link)
+			if len(s.created) == s.failCreate {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"errors":["rejected"]}`))
+				return
+			}
+			link["uuid"] = fmt.Sprintf("zzzzz-o0j2j-%015d", len(s.created))
+			json.NewEncoder(w).Encode(link)
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/arvados/v1/links/"):
+			s.deleted = append(s.deleted, strings.TrimPrefix(r.URL.Path, "/arvados/v1/links/"))
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	s.client = &Client{
+		APIHost:   strings.TrimPrefix(s.server.URL, "https://"),
+		AuthToken: "zzz",
+		Insecure:  true,
+		Timeout:   2 * time.Second,
+	}
+}
+
+func (s *outputDiffSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func (s *outputDiffSuite) TestFileSegments(c *check.C) {
+	files, err := FileSegments(s.manifest["zzzzz-4zz18-oldoldoldoldold"])
+	c.Assert(err, check.IsNil)
+	c.Check(files, check.HasLen, 4)
+	c.Check(files["same.txt"], check.DeepEquals, []FileSegment{{outputDiffFoo, 0, 3}})
+	c.Check(files["changed.txt"], check.DeepEquals, []FileSegment{{outputDiffBar, 0, 3}})
+	c.Check(files["dir/sub.txt"], check.DeepEquals, []FileSegment{{outputDiffFoo, 0, 3}})
+
+	// Hints are removed, empty segments are dropped, and
+	// adjacent segments are merged.
+	files, err = FileSegments(". " + outputDiffFoo + "+Afakesig@12345678 " + outputDiffBar + " 0:2:a 2:0:a 2:4:a 3:0:empty\n")
+	c.Assert(err, check.IsNil)
+	c.Check(files["a"], check.DeepEquals, []FileSegment{{outputDiffFoo, 0, 3}, {outputDiffBar, 0, 3}})
+	c.Check(files["empty"], check.HasLen, 0)
+
+	files, err = FileSegments("")
+	c.Assert(err, check.IsNil)
+	c.Check(files, check.HasLen, 0)
+
+	_, err = FileSegments(". bogus 0:3:foo\n")
+	c.Check(err, check.NotNil)
+}
+
+func (s *outputDiffSuite) TestDiffManifestFiles(c *check.C) {
+	diff, err := DiffManifestFiles(s.manifest["zzzzz-4zz18-oldoldoldoldold"], s.manifest["zzzzz-4zz18-newnewnewnewnew"], nil)
+	c.Assert(err, check.IsNil)
+	c.Check(diff.Identical(), check.Equals, false)
+	c.Check(diff.Unchanged, check.Equals, 2)
+	c.Check(diff.Added, check.DeepEquals, []CollectionFileChange{
+		{Path: "added.txt", OldSize: -1, NewSize: 3},
+	})
+	c.Check(diff.Removed, check.DeepEquals, []CollectionFileChange{
+		{Path: "removed.txt", OldSize: 3, NewSize: -1},
+	})
+	c.Check(diff.Changed, check.DeepEquals, []CollectionFileChange{
+		{Path: "changed.txt", OldSize: 3, NewSize: 3},
+	})
+
+	// The same files in a different manifest order are
+	// identical.
+	diff, err = DiffManifestFiles(
+		". "+outputDiffFoo+" 0:3:a 0:3:b\n",
+		". "+outputDiffFoo+" 0:3:b 0:3:a\n", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(diff.Identical(), check.Equals, true)
+	c.Check(diff.Unchanged, check.Equals, 2)
+}
+
+// Small files packed into a shared block are stored in a different
+// block if any of them changes. The others are unchanged if their
+// content is the same.
+func (s *outputDiffSuite) TestDiffManifestFilesPacked(c *check.C) {
+	kc := outputDiffKeepStub{}
+	oldBlock := kc.add("foobarbaz")
+	newBlock := kc.add("FOObarbaz")
+	oldManifest := ". " + oldBlock + " 0:3:foo 3:3:bar 6:3:baz\n"
+	newManifest := ". " + newBlock + " 0:3:foo 3:3:bar 6:3:baz\n"
+
+	// Without a keep client, files in different blocks are
+	// assumed to differ.
+	diff, err := DiffManifestFiles(oldManifest, newManifest, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(diff.Changed, check.HasLen, 3)
+
+	diff, err = DiffManifestFiles(oldManifest, newManifest, kc)
+	c.Assert(err, check.IsNil)
+	c.Check(diff.Unchanged, check.Equals, 2)
+	c.Check(diff.Changed, check.DeepEquals, []CollectionFileChange{
+		{Path: "foo", OldSize: 3, NewSize: 3},
+	})
+
+	// A file stored in a different block (and at a different
+	// offset) with the same content is unchanged.
+	diff, err = DiffManifestFiles(oldManifest, ". "+kc.add("bar")+" 0:3:bar\n", kc)
+	c.Assert(err, check.IsNil)
+	c.Check(diff.Unchanged, check.Equals, 1)
+	c.Check(diff.Changed, check.HasLen, 0)
+	c.Check(diff.Removed, check.HasLen, 2)
+}
+
+// outputDiffKeepStub serves blocks from memory.
+type outputDiffKeepStub map[string][]byte
+
+func (kc outputDiffKeepStub) add(data string) string {
+	locator := fmt.Sprintf("%x+%d", md5.Sum([]byte(data)), len(data))
+	kc[locator] = []byte(data)
+	return locator
+}
+
+func (kc outputDiffKeepStub) ReadAt(locator string, p []byte, off int) (int, error) {
+	buf, ok := kc[locator]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	if off >= len(buf) {
+		return 0, io.EOF
+	}
+	return copy(p, buf[off:]), nil
+}
+
+func (kc outputDiffKeepStub) BlockRead(context.Context, BlockReadOptions) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (kc outputDiffKeepStub) BlockWrite(context.Context, BlockWriteOptions) (BlockWriteResponse, error) {
+	return BlockWriteResponse{}, errors.New("not implemented")
+}
+
+func (kc outputDiffKeepStub) LocalLocator(locator string) (string, error) {
+	return locator, nil
+}
+
+func (s *outputDiffSuite) TestDiffContainerRequestOutputs(c *check.C) {
+	ctx := context.Background()
+	diff, err := s.client.DiffContainerRequestOutputs(ctx, "zzzzz-xvhdp-oldoldoldoldold", "zzzzz-xvhdp-newnewnewnewnew", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(diff.Old, check.Equals, OutputRef{
+		ContainerRequestUUID: "zzzzz-xvhdp-oldoldoldoldold",
+		OutputUUID:           "zzzzz-4zz18-oldoldoldoldold",
+		OutputPDH:            PortableDataHash(s.manifest["zzzzz-4zz18-oldoldoldoldold"]),
+	})
+	c.Check(diff.New.OutputUUID, check.Equals, "zzzzz-4zz18-newnewnewnewnew")
+	c.Check(diff.Added, check.HasLen, 1)
+	c.Check(diff.Removed, check.HasLen, 1)
+	c.Check(diff.Changed, check.HasLen, 1)
+	c.Check(diff.Unchanged, check.Equals, 2)
+
+	// Same output
+	diff, err = s.client.DiffContainerRequestOutputs(ctx, "zzzzz-xvhdp-oldoldoldoldold", "zzzzz-xvhdp-oldoldoldoldold", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(diff.Identical(), check.Equals, true)
+	c.Check(diff.Unchanged, check.Equals, 4)
+
+	_, err = s.client.DiffContainerRequestOutputs(ctx, "zzzzz-xvhdp-oldoldoldoldold", "zzzzz-xvhdp-runningrunningr", nil)
+	c.Check(err, check.ErrorMatches, `container request zzzzz-xvhdp-runningrunningr has no output collection`)
+	_, err = s.client.DiffContainerRequestOutputs(ctx, "zzzzz-xvhdp-missingmissingm", "zzzzz-xvhdp-oldoldoldoldold", nil)
+	c.Check(err, check.ErrorMatches, `error getting container request zzzzz-xvhdp-missingmissingm: .*`)
+}
+
+func (s *outputDiffSuite) TestLinkOutputProvenance(c *check.C) {
+	ctx := context.Background()
+	diff, err := s.client.DiffContainerRequestOutputs(ctx, "zzzzz-xvhdp-oldoldoldoldold", "zzzzz-xvhdp-newnewnewnewnew", nil)
+	c.Assert(err, check.IsNil)
+	links, err := s.client.LinkOutputProvenance(ctx, diff, "zzzzz-j7d0g-projectprojectp")
+	c.Assert(err, check.IsNil)
+	c.Assert(links, check.HasLen, 3)
+	c.Check(s.deleted, check.HasLen, 0)
+
+	for _, link := range links {
+		c.Check(link.UUID, check.Not(check.Equals), "")
+		c.Check(link.LinkClass, check.Equals, ProvenanceLinkClass)
+		c.Check(link.OwnerUUID, check.Equals, "zzzzz-j7d0g-projectprojectp")
+	}
+	c.Check(links[0].Name, check.Equals, ProvenanceLinkOutput)
+	c.Check(links[0].TailUUID, check.Equals, "zzzzz-xvhdp-oldoldoldoldold")
+	c.Check(links[0].HeadUUID, check.Equals, "zzzzz-4zz18-oldoldoldoldold")
+	c.Check(links[0].Properties["portable_data_hash"], check.Equals, diff.Old.OutputPDH)
+	c.Check(links[1].TailUUID, check.Equals, "zzzzz-xvhdp-newnewnewnewnew")
+	c.Check(links[1].HeadUUID, check.Equals, "zzzzz-4zz18-newnewnewnewnew")
+	c.Check(links[2].Name, check.Equals, ProvenanceLinkOutputDiff)
+	c.Check(links[2].TailUUID, check.Equals, "zzzzz-xvhdp-newnewnewnewnew")
+	c.Check(links[2].HeadUUID, check.Equals, "zzzzz-xvhdp-oldoldoldoldold")
+	c.Check(links[2].Properties, check.DeepEquals, map[string]interface{}{
+		"old_output_pdh": diff.Old.OutputPDH,
+		"new_output_pdh": diff.New.OutputPDH,
+		"identical":      false,
+		"unchanged":      float64(2),
+		"added":          []interface{}{"added.txt"},
+		"removed":        []interface{}{"removed.txt"},
+		"changed":        []interface{}{"changed.txt"},
+		"truncated":      false,
+	})
+
+	// Long path lists are truncated.
+	diff.Added = nil
+	for i := 0; i < maxProvenanceLinkPaths+1; i++ {
+		diff.Added = append(diff.Added, CollectionFileChange{Path: fmt.Sprintf("f%d", i)})
+	}
+	links, err = s.client.LinkOutputProvenance(ctx, diff, "")
+	c.Assert(err, check.IsNil)
+	c.Check(links[2].Properties["added"], check.HasLen, maxProvenanceLinkPaths)
+	c.Check(links[2].Properties["truncated"], check.Equals, true)
+	_, ok := s.created[len(s.created)-1]["owner_uuid"]
+	c.Check(ok, check.Equals, false)
+}
+
+func (s *outputDiffSuite) TestLinkOutputProvenanceRollback(c *check.C) {
+	ctx := context.Background()
+	diff, err := s.client.DiffContainerRequestOutputs(ctx, "zzzzz-xvhdp-oldoldoldoldold", "zzzzz-xvhdp-newnewnewnewnew", nil)
+	c.Assert(err, check.IsNil)
+	s.failCreate = 3
+	_, err = s.client.LinkOutputProvenance(ctx, diff, "")
+	c.Check(err, check.ErrorMatches, `error creating output_diff link: .*rejected.*`)
+	c.Check(s.deleted, check.DeepEquals, []string{"zzzzz-o0j2j-000000000000002", "zzzzz-o0j2j-000000000000001"})
+}
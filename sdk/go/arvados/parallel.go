@@ -0,0 +1,144 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// parallelGroupMaxAttempts is the number of times a ParallelGroup
+// func is called before giving up on 429 errors.
+var parallelGroupMaxAttempts = 10
+
+// A ParallelGroup runs funcs concurrently, like errgroup.Group, with
+// a limit on the number of funcs running at once. It cooperates with
+// the rate-limit feedback of the Client that created it: when any
+// request made by the Client receives a 429 (Too Many Requests) or
+// 503 response, no new funcs start until the resulting quiet period
+// is over.
+//
+// If a func returns an error with HTTPStatus() == 429 (such as a
+// TransactionError), the quiet period is extended for all workers
+// and the func is called again after the pause.
+//
+// Example:
+//
+//	pg := client.NewParallelGroup(ctx, 8)
+//	for _, uuid := range uuids {
+//		uuid := uuid
+//		pg.Go(func(ctx context.Context) error {
+//			return client.RequestAndDecodeContext(ctx, nil, "DELETE", "arvados/v1/collections/"+uuid, nil, nil)
+//		})
+//	}
+//	err := pg.Wait()
+type ParallelGroup struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	limiter *requestLimiter
+	slots   chan struct{}
+	wg      sync.WaitGroup
+	err     error
+	mtx     sync.Mutex
+}
+
+// NewParallelGroup returns a new ParallelGroup that runs at most n
+// funcs at once. If n < 1, the number of concurrent funcs is limited
+// only by the Client's own request limiter.
+//
+// The group's context is canceled when ctx is canceled, when a func
+// returns an error, or when Wait returns.
+func (c *Client) NewParallelGroup(ctx context.Context, n int) *ParallelGroup {
+	ctx, cancel := context.WithCancel(ctx)
+	pg := &ParallelGroup{
+		ctx:     ctx,
+		cancel:  cancel,
+		limiter: c.getRequestLimiter(),
+	}
+	if n > 0 {
+		pg.slots = make(chan struct{}, n)
+	}
+	return pg
+}
+
+// Context returns the context passed to funcs.
+func (pg *ParallelGroup) Context() context.Context {
+	return pg.ctx
+}
+
+// Go calls f in a new goroutine, waiting first (if necessary) for a
+// free slot and for the end of any quiet period. If f returns an
+// error, the group's context is canceled.
+//
+// If the group's context is already done, Go returns without calling
+// f.
+func (pg *ParallelGroup) Go(f func(context.Context) error) {
+	if pg.slots != nil {
+		select {
+		case pg.slots <- struct{}{}:
+		case <-pg.ctx.Done():
+			return
+		}
+	}
+	pg.limiter.Wait(pg.ctx)
+	if pg.ctx.Err() != nil {
+		pg.release()
+		return
+	}
+	pg.wg.Add(1)
+	go func() {
+		defer pg.wg.Done()
+		defer pg.release()
+		err := pg.call(f)
+		if err != nil {
+			pg.mtx.Lock()
+			if pg.err == nil {
+				pg.err = err
+			}
+			pg.mtx.Unlock()
+			pg.cancel()
+		}
+	}()
+}
+
+// call calls f, retrying after a pause when f fails with a 429
+// error.
+func (pg *ParallelGroup) call(f func(context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := f(pg.ctx)
+		var se interface{ HTTPStatus() int }
+		if attempt >= parallelGroupMaxAttempts || !errors.As(err, &se) || se.HTTPStatus() != http.StatusTooManyRequests {
+			return err
+		}
+		pg.limiter.Pause(requestLimiterQuietPeriod)
+		pg.limiter.Wait(pg.ctx)
+		if pg.ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+func (pg *ParallelGroup) release() {
+	if pg.slots != nil {
+		<-pg.slots
+	}
+}
+
+// Wait waits for all funcs started by Go to return, and returns the
+// first non-nil error. If ctx (the context passed to
+// NewParallelGroup) was canceled before any func returned an error,
+// Wait returns its Err().
+func (pg *ParallelGroup) Wait() error {
+	pg.wg.Wait()
+	pg.mtx.Lock()
+	defer pg.mtx.Unlock()
+	defer pg.cancel()
+	if pg.err != nil {
+		return pg.err
+	}
+	return pg.ctx.Err()
+}
@@ -0,0 +1,149 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&parallelSuite{})
+
+type parallelSuite struct {
+	origLimiterQuietPeriod time.Duration
+}
+
+func (s *parallelSuite) SetUpTest(c *check.C) {
+	s.origLimiterQuietPeriod = requestLimiterQuietPeriod
+	requestLimiterQuietPeriod = time.Second / 10
+}
+
+func (s *parallelSuite) TearDownTest(c *check.C) {
+	requestLimiterQuietPeriod = s.origLimiterQuietPeriod
+}
+
+func (s *parallelSuite) TestLimit(c *check.C) {
+	client := &Client{requestLimiter: &requestLimiter{}}
+	pg := client.NewParallelGroup(context.Background(), 3)
+	var mtx sync.Mutex
+	running, maxRunning, done := 0, 0, 0
+	for i := 0; i < 20; i++ {
+		pg.Go(func(context.Context) error {
+			mtx.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mtx.Unlock()
+			time.Sleep(time.Millisecond)
+			mtx.Lock()
+			running--
+			done++
+			mtx.Unlock()
+			return nil
+		})
+	}
+	c.Check(pg.Wait(), check.IsNil)
+	c.Check(done, check.Equals, 20)
+	c.Check(maxRunning, check.Equals, 3)
+}
+
+func (s *parallelSuite) TestError(c *check.C) {
+	client := &Client{requestLimiter: &requestLimiter{}}
+	pg := client.NewParallelGroup(context.Background(), 2)
+	errFailed := errors.New("failed")
+	var mtx sync.Mutex
+	started := 0
+	for i := 0; i < 10; i++ {
+		i := i
+		pg.Go(func(ctx context.Context) error {
+			mtx.Lock()
+			started++
+			mtx.Unlock()
+			if i == 1 {
+				return errFailed
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}
+	c.Check(pg.Wait(), check.Equals, errFailed)
+	c.Check(started, check.Equals, 2)
+	c.Check(pg.Context().Err(), check.Equals, context.Canceled)
+}
+
+func (s *parallelSuite) TestParentCanceled(c *check.C) {
+	client := &Client{requestLimiter: &requestLimiter{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	pg := client.NewParallelGroup(ctx, 0)
+	pg.Go(func(ctx context.Context) error {
+		cancel()
+		return nil
+	})
+	c.Check(pg.Wait(), check.Equals, context.Canceled)
+	called := false
+	pg.Go(func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	c.Check(called, check.Equals, false)
+}
+
+func (s *parallelSuite) TestPauseOn429(c *check.C) {
+	client := &Client{requestLimiter: &requestLimiter{}}
+	pg := client.NewParallelGroup(context.Background(), 4)
+	t0 := time.Now()
+	var mtx sync.Mutex
+	attempts := 0
+	var startTimes []time.Duration
+	pg.Go(func(ctx context.Context) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		attempts++
+		if attempts < 3 {
+			return &TransactionError{StatusCode: http.StatusTooManyRequests}
+		}
+		return nil
+	})
+	// Give the first func time to fail, then check that new funcs
+	// don't start until the pause is over.
+	time.Sleep(requestLimiterQuietPeriod / 10)
+	for i := 0; i < 4; i++ {
+		pg.Go(func(ctx context.Context) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			startTimes = append(startTimes, time.Since(t0))
+			return nil
+		})
+	}
+	c.Check(pg.Wait(), check.IsNil)
+	c.Check(attempts, check.Equals, 3)
+	c.Assert(startTimes, check.HasLen, 4)
+	for _, t := range startTimes {
+		c.Check(t >= requestLimiterQuietPeriod, check.Equals, true, check.Commentf("%v", t))
+	}
+	c.Check(time.Since(t0) >= 2*requestLimiterQuietPeriod, check.Equals, true)
+}
+
+func (s *parallelSuite) TestGiveUpOn429(c *check.C) {
+	defer func(orig int) { parallelGroupMaxAttempts = orig }(parallelGroupMaxAttempts)
+	parallelGroupMaxAttempts = 2
+	requestLimiterQuietPeriod = time.Millisecond
+	client := &Client{requestLimiter: &requestLimiter{}}
+	pg := client.NewParallelGroup(context.Background(), 1)
+	attempts := 0
+	pg.Go(func(ctx context.Context) error {
+		attempts++
+		return &TransactionError{StatusCode: http.StatusTooManyRequests}
+	})
+	err := pg.Wait()
+	c.Check(err, check.FitsTypeOf, &TransactionError{})
+	c.Check(attempts, check.Equals, 2)
+}
@@ -0,0 +1,287 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// A PropertyFilter restricts results by the value of one key in a
+// resource's properties. Use the Property* functions to construct
+// common filters.
+type PropertyFilter struct {
+	Key      string
+	Operator string
+	Operand  interface{}
+}
+
+// PropertyExists matches resources that have the given property key,
+// with any value.
+func PropertyExists(key string) PropertyFilter {
+	return PropertyFilter{key, "exists", true}
+}
+
+// PropertyNotExists matches resources that do not have the given
+// property key.
+func PropertyNotExists(key string) PropertyFilter {
+	return PropertyFilter{key, "exists", false}
+}
+
+// PropertyEquals matches resources whose value for the given key is
+// equal to value.
+func PropertyEquals(key string, value interface{}) PropertyFilter {
+	return PropertyFilter{key, "=", value}
+}
+
+// PropertyIn matches resources whose value for the given key is
+// equal to one of the given values.
+func PropertyIn(key string, values ...interface{}) PropertyFilter {
+	return PropertyFilter{key, "in", values}
+}
+
+// PropertyContains matches resources whose value for the given key
+// is equal to value, or is an array with value as an element.
+func PropertyContains(key string, value interface{}) PropertyFilter {
+	return PropertyFilter{key, "contains", value}
+}
+
+// PropertyRange matches resources whose value for the given key is
+// >= min and < max. Either bound can be nil. The bounds should be
+// numbers or strings, depending on the type of the stored values.
+func PropertyRange(key string, min, max interface{}) []PropertyFilter {
+	var filters []PropertyFilter
+	if min != nil {
+		filters = append(filters, PropertyFilter{key, ">=", min})
+	}
+	if max != nil {
+		filters = append(filters, PropertyFilter{key, "<", max})
+	}
+	return filters
+}
+
+// Validate returns an error if the API server would reject the
+// filter.
+func (f PropertyFilter) Validate() error {
+	if f.Key == "" {
+		return errors.New("empty property key in filter")
+	}
+	switch f.Operator {
+	case "exists":
+		if _, ok := f.Operand.(bool); !ok {
+			return fmt.Errorf("invalid operand %#v for property %q: %q operator requires true or false", f.Operand, f.Key, f.Operator)
+		}
+	case "=", "!=":
+	case "in", "not in":
+		if f.Operand == nil || reflect.TypeOf(f.Operand).Kind() != reflect.Slice {
+			return fmt.Errorf("invalid operand %#v for property %q: %q operator requires an array", f.Operand, f.Key, f.Operator)
+		}
+	case "<", "<=", ">", ">=":
+		if _, isBool := f.Operand.(bool); isBool || f.Operand == nil || !isPropertyScalar(f.Operand) {
+			return fmt.Errorf("invalid operand %#v for property %q: %q operator requires a number or string", f.Operand, f.Key, f.Operator)
+		}
+	case "like", "ilike":
+		if _, ok := f.Operand.(string); !ok {
+			return fmt.Errorf("invalid operand %#v for property %q: %q operator requires a string", f.Operand, f.Key, f.Operator)
+		}
+	case "contains":
+		if !isPropertyScalar(f.Operand) {
+			return fmt.Errorf("invalid operand %#v for property %q: %q operator requires a scalar value", f.Operand, f.Key, f.Operator)
+		}
+	default:
+		return fmt.Errorf("invalid operator %q for property %q", f.Operator, f.Key)
+	}
+	return nil
+}
+
+func isPropertyScalar(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	_, ok := v.(json.Number)
+	return ok
+}
+
+// Indexed returns true if the API server can use the index on the
+// properties column to find matching rows, i.e., the filter is
+// translated to a JSONB containment or key-existence test. Other
+// filters (!=, ranges, like, not in, and "not exists") are evaluated
+// row by row, so a query that has no indexed filters (and no other
+// selective filters) reads the entire table.
+func (f PropertyFilter) Indexed() bool {
+	switch f.Operator {
+	case "=", "in", "contains":
+		return true
+	case "exists":
+		return f.Operand == true
+	default:
+		return false
+	}
+}
+
+// Filter returns the API filter for the given JSONB attribute (e.g.,
+// "properties").
+func (f PropertyFilter) Filter(attr string) Filter {
+	return Filter{attr + "." + f.Key, f.Operator, f.Operand}
+}
+
+// PropertyQuery selects resources (e.g., collections or groups) by
+// their properties.
+type PropertyQuery struct {
+	// JSONB attribute to filter on. If empty, "properties" is
+	// used.
+	Attr string
+
+	Properties []PropertyFilter
+
+	// Additional filters on other attributes, e.g., to restrict
+	// the results to a project.
+	OtherFilters []Filter
+
+	// Attributes to return. If empty, the API server's default
+	// is used. "uuid" is added if needed for pagination.
+	Select []string
+
+	// Return resources whose UUID is greater than AfterUUID,
+	// e.g., to resume after the last resource seen previously.
+	AfterUUID string
+
+	// Number of resources to retrieve per API call. If zero, the
+	// API server's default is used.
+	PageSize int
+}
+
+// Validate returns an error if any of the property filters is
+// invalid, or there are none.
+func (q PropertyQuery) Validate() error {
+	if len(q.Properties) == 0 {
+		return errors.New("property query has no property filters")
+	}
+	for _, f := range q.Properties {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Indexed returns true if at least one of the property filters can
+// use the properties index (see PropertyFilter.Indexed). Callers can
+// use this to warn about, or refuse to run, queries that are likely
+// to be slow on a large site.
+func (q PropertyQuery) Indexed() bool {
+	for _, f := range q.Properties {
+		if f.Indexed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Filters returns the API filters for the query.
+func (q PropertyQuery) Filters() ([]Filter, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	attr := q.Attr
+	if attr == "" {
+		attr = "properties"
+	}
+	var filters []Filter
+	for _, f := range q.Properties {
+		filters = append(filters, f.Filter(attr))
+	}
+	filters = append(filters, q.OtherFilters...)
+	if q.AfterUUID != "" {
+		filters = append(filters, Filter{"uuid", ">", q.AfterUUID})
+	}
+	return filters, nil
+}
+
+// ResourceListParams returns the parameters for retrieving the first
+// page of results, in UUID order, using a Client.
+//
+// Results are ordered by UUID (which has a unique index) and item
+// counting is disabled, so each page can be retrieved without
+// sorting or counting all of the matching rows.
+func (q PropertyQuery) ResourceListParams() (ResourceListParams, error) {
+	filters, err := q.Filters()
+	if err != nil {
+		return ResourceListParams{}, err
+	}
+	params := ResourceListParams{
+		Filters: filters,
+		Order:   "uuid asc",
+		Count:   "none",
+	}
+	if len(q.Select) > 0 {
+		params.Select = append([]string(nil), q.Select...)
+		hasUUID := false
+		for _, attr := range params.Select {
+			hasUUID = hasUUID || attr == "uuid"
+		}
+		if !hasUUID {
+			params.Select = append(params.Select, "uuid")
+		}
+	}
+	if q.PageSize > 0 {
+		params.Limit = &q.PageSize
+	}
+	return params, nil
+}
+
+// EachPropertyMatch calls f once for each resource selected by q, in
+// UUID order, using the given list API path (e.g.,
+// "arvados/v1/collections"). Each item is passed to f as JSON, to be
+// decoded into the appropriate type (e.g., Collection).
+//
+// Results are retrieved one page at a time, using the UUID of the
+// last item on each page (rather than an offset) to retrieve the
+// next page. EachPropertyMatch stops if f returns an error.
+func (c *Client) EachPropertyMatch(ctx context.Context, path string, q PropertyQuery, f func(json.RawMessage) error) error {
+	for {
+		params, err := q.ResourceListParams()
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		err = c.RequestAndDecodeContext(ctx, &page, "GET", path, nil, params)
+		if err != nil {
+			return err
+		}
+		if len(page.Items) == 0 {
+			return nil
+		}
+		for _, item := range page.Items {
+			err = f(item)
+			if err != nil {
+				return err
+			}
+		}
+		var last struct {
+			UUID string `json:"uuid"`
+		}
+		err = json.Unmarshal(page.Items[len(page.Items)-1], &last)
+		if err != nil {
+			return err
+		}
+		if last.UUID == "" || last.UUID <= q.AfterUUID {
+			return fmt.Errorf("cannot paginate %s: last item on page has UUID %q", path, last.UUID)
+		}
+		q.AfterUUID = last.UUID
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&propertiesSuite{})
+
+type propertiesSuite struct{}
+
+func (s *propertiesSuite) TestPropertyQueryFilters(c *check.C) {
+	q := PropertyQuery{
+		Properties: append([]PropertyFilter{
+			PropertyExists("sample_id"),
+			PropertyEquals("status", "approved"),
+			PropertyIn("assay", "wgs", "wes"),
+			PropertyContains("tags", "tumor"),
+		}, PropertyRange("read_length", 100, 250)...),
+		OtherFilters: []Filter{{"owner_uuid", "=", "zzzzz-j7d0g-aaaaaaaaaaaaaaa"}},
+		AfterUUID:    "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+	}
+	filters, err := q.Filters()
+	c.Assert(err, check.IsNil)
+	c.Check(filters, check.DeepEquals, []Filter{
+		{"properties.sample_id", "exists", true},
+		{"properties.status", "=", "approved"},
+		{"properties.assay", "in", []interface{}{"wgs", "wes"}},
+		{"properties.tags", "contains", "tumor"},
+		{"properties.read_length", ">=", 100},
+		{"properties.read_length", "<", 250},
+		{"owner_uuid", "=", "zzzzz-j7d0g-aaaaaaaaaaaaaaa"},
+		{"uuid", ">", "zzzzz-4zz18-aaaaaaaaaaaaaaa"},
+	})
+	c.Check(q.Indexed(), check.Equals, true)
+
+	q.PageSize = 10
+	q.Select = []string{"name", "properties"}
+	params, err := q.ResourceListParams()
+	c.Assert(err, check.IsNil)
+	c.Check(params.Order, check.Equals, "uuid asc")
+	c.Check(params.Count, check.Equals, "none")
+	c.Check(*params.Limit, check.Equals, 10)
+	c.Check(params.Select, check.DeepEquals, []string{"name", "properties", "uuid"})
+	c.Check(q.Select, check.HasLen, 2)
+
+	q = PropertyQuery{Attr: "output_properties", Properties: PropertyRange("score", nil, 0.5)}
+	filters, err = q.Filters()
+	c.Assert(err, check.IsNil)
+	c.Check(filters, check.DeepEquals, []Filter{{"output_properties.score", "<", 0.5}})
+	c.Check(q.Indexed(), check.Equals, false)
+	q.Properties = append(q.Properties, PropertyNotExists("deprecated"))
+	c.Check(q.Indexed(), check.Equals, false)
+}
+
+func (s *propertiesSuite) TestPropertyFilterValidate(c *check.C) {
+	for _, trial := range []struct {
+		f   PropertyFilter
+		err string
+	}{
+		{PropertyEquals("k", map[string]interface{}{"a": 1}), ""},
+		{PropertyFilter{"k", "!=", nil}, ""},
+		{PropertyFilter{"k", "not in", []string{"a"}}, ""},
+		{PropertyFilter{"k", "like", "abc%"}, ""},
+		{PropertyFilter{"k", "<=", json.Number("3")}, ""},
+		{PropertyEquals("", "v"), `empty property key.*`},
+		{PropertyFilter{"k", "exists", "yes"}, `.*requires true or false`},
+		{PropertyFilter{"k", "in", "a"}, `.*requires an array`},
+		{PropertyFilter{"k", ">", true}, `.*requires a number or string`},
+		{PropertyFilter{"k", ">", nil}, `.*requires a number or string`},
+		{PropertyFilter{"k", ">", []int{1}}, `.*requires a number or string`},
+		{PropertyFilter{"k", "ilike", 3}, `.*requires a string`},
+		{PropertyContains("k", []string{"a"}), `.*requires a scalar value`},
+		{PropertyFilter{"k", "@@", "a"}, `invalid operator "@@".*`},
+	} {
+		c.Logf("%#v", trial.f)
+		err := trial.f.Validate()
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err)
+		}
+	}
+	_, err := PropertyQuery{}.Filters()
+	c.Check(err, check.ErrorMatches, `.*no property filters`)
+	_, err = PropertyQuery{Properties: []PropertyFilter{{"k", "in", nil}}}.ResourceListParams()
+	c.Check(err, check.ErrorMatches, `.*requires an array`)
+}
+
+func (s *propertiesSuite) TestEachPropertyMatch(c *check.C) {
+	var queries []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/arvados/v1/collections")
+		r.ParseForm()
+		queries = append(queries, r.Form.Get("filters"))
+		c.Check(r.Form.Get("order"), check.Equals, "uuid asc")
+		var filters []Filter
+		c.Check(json.Unmarshal([]byte(r.Form.Get("filters")), &filters), check.IsNil)
+		after := ""
+		for _, f := range filters {
+			if f.Attr == "uuid" {
+				after = f.Operand.(string)
+			}
+		}
+		limit, _ := strconv.Atoi(r.Form.Get("limit"))
+		var page CollectionList
+		// The fake has 5 matching collections.
+		for i := 1; i <= 5 && len(page.Items) < limit; i++ {
+			uuid := fmt.Sprintf("zzzzz-4zz18-%015d", i)
+			if uuid > after {
+				page.Items = append(page.Items, Collection{UUID: uuid, Name: fmt.Sprintf("coll%d", i)})
+			}
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+	client := &Client{
+		APIHost:   strings.TrimPrefix(server.URL, "https://"),
+		AuthToken: "zzz",
+		Insecure:  true,
+		Timeout:   2 * time.Second,
+	}
+
+	var names []string
+	q := PropertyQuery{Properties: []PropertyFilter{PropertyEquals("status", "approved")}, PageSize: 2}
+	err := client.EachPropertyMatch(context.Background(), "arvados/v1/collections", q, func(item json.RawMessage) error {
+		var coll Collection
+		err := json.Unmarshal(item, &coll)
+		names = append(names, coll.Name)
+		return err
+	})
+	c.Check(err, check.IsNil)
+	c.Check(names, check.DeepEquals, []string{"coll1", "coll2", "coll3", "coll4", "coll5"})
+	c.Check(queries, check.HasLen, 4)
+	var filters []Filter
+	c.Check(json.Unmarshal([]byte(queries[0]), &filters), check.IsNil)
+	c.Check(filters, check.DeepEquals, []Filter{{"properties.status", "=", "approved"}})
+	c.Check(json.Unmarshal([]byte(queries[1]), &filters), check.IsNil)
+	c.Check(filters, check.DeepEquals, []Filter{{"properties.status", "=", "approved"}, {"uuid", ">", "zzzzz-4zz18-000000000000002"}})
+
+	// Invalid queries are rejected before sending any requests.
+	queries = nil
+	err = client.EachPropertyMatch(context.Background(), "arvados/v1/collections", PropertyQuery{}, nil)
+	c.Check(err, check.NotNil)
+	c.Check(queries, check.HasLen, 0)
+}
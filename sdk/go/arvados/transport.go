@@ -0,0 +1,250 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// TLSHostOverride specifies TLS verification settings for a single
+// server host, replacing the default settings in TransportConfig.
+type TLSHostOverride struct {
+	// Accept unverified certificates from this host.
+	Insecure bool
+	// Path to a PEM file with CA certificates to trust (in
+	// addition to the system's trusted CAs) when verifying
+	// this host's certificate. If empty, the default CABundle
+	// is used.
+	CABundle string
+}
+
+// TransportConfig specifies how outbound HTTP connections are made:
+// which proxy to use, and how to verify TLS server certificates.
+//
+// The zero value uses the system's trusted CAs and the proxy
+// specified by the HTTPS_PROXY, HTTP_PROXY, and NO_PROXY environment
+// variables, like http.DefaultTransport.
+type TransportConfig struct {
+	// Accept unverified certificates.
+	Insecure bool `json:",omitempty"`
+	// Path to a PEM file with CA certificates to trust in
+	// addition to the system's trusted CAs.
+	CABundle string `json:",omitempty"`
+	// Proxy URL to use for all requests, except requests to
+	// hosts listed in NoProxy. If empty, the proxy (if any)
+	// is taken from the environment.
+	Proxy string `json:",omitempty"`
+	// Comma-separated list of hosts, domains, and CIDR ranges
+	// that should be accessed directly, with the same syntax
+	// as the NO_PROXY environment variable. Ignored if Proxy
+	// is empty (the NO_PROXY environment variable applies
+	// instead).
+	NoProxy string `json:",omitempty"`
+	// TLS settings for individual hosts, keyed by host name
+	// (without port). Hosts addressed by IP address cannot be
+	// overridden.
+	HostOverrides map[string]TLSHostOverride `json:",omitempty"`
+}
+
+// IsDefault returns true if tc has no settings other than (possibly)
+// Insecure, i.e., a transport with a plain tls.Config is
+// sufficient.
+func (tc TransportConfig) IsDefault() bool {
+	return tc.CABundle == "" && tc.Proxy == "" && len(tc.HostOverrides) == 0
+}
+
+// TLSConfig returns a tls.Config that verifies server certificates
+// according to tc.
+func (tc TransportConfig) TLSConfig() (*tls.Config, error) {
+	roots, err := loadCABundle(tc.CABundle)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		InsecureSkipVerify: tc.Insecure,
+		RootCAs:            roots,
+	}
+	if len(tc.HostOverrides) == 0 {
+		return cfg, nil
+	}
+	overrides := map[string]TLSHostOverride{}
+	hostRoots := map[string]*x509.CertPool{}
+	for host, override := range tc.HostOverrides {
+		host = strings.ToLower(host)
+		overrides[host] = override
+		hostRoots[host] = roots
+		if override.CABundle != "" {
+			hostRoots[host], err = loadCABundle(override.CABundle)
+			if err != nil {
+				return nil, fmt.Errorf("host %q: %w", host, err)
+			}
+		}
+	}
+	// Per-host settings can't be expressed in a single
+	// tls.Config, so we skip the standard verification step
+	// and do our own in VerifyConnection.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		insecure, pool := tc.Insecure, roots
+		host := strings.ToLower(cs.ServerName)
+		if override, ok := overrides[host]; ok {
+			insecure, pool = override.Insecure, hostRoots[host]
+		}
+		if insecure {
+			return nil
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("tls: server did not provide a certificate")
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         pool,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	return cfg, nil
+}
+
+// NewTransport returns a new http.Transport with the same defaults as
+// http.DefaultTransport, and the proxy and TLS settings specified by
+// tc.
+func (tc TransportConfig) NewTransport() (*http.Transport, error) {
+	tlsConfig, err := tc.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	tr.Proxy = http.ProxyFromEnvironment
+	if tc.Proxy != "" {
+		if _, err := url.Parse(tc.Proxy); err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %w", tc.Proxy, err)
+		}
+		proxyFunc := (&httpproxy.Config{
+			HTTPProxy:  tc.Proxy,
+			HTTPSProxy: tc.Proxy,
+			NoProxy:    tc.NoProxy,
+		}).ProxyFunc()
+		tr.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+	return tr, nil
+}
+
+// loadCABundle returns a pool containing the system's trusted CAs
+// plus the certificates in the given PEM file. If path is empty, it
+// returns nil, which tls.Config interprets as "system CAs".
+func loadCABundle(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("error loading CA bundle: no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// TransportConfigKey is a comparable representation of a
+// TransportConfig, suitable for use as a map key.
+type TransportConfigKey struct {
+	Insecure      bool
+	CABundle      string
+	Proxy         string
+	NoProxy       string
+	HostOverrides string
+}
+
+// Key returns a TransportConfigKey that is equal to another
+// TransportConfig's key if and only if both configs are the same.
+func (tc TransportConfig) Key() TransportConfigKey {
+	hosts := make([]string, 0, len(tc.HostOverrides))
+	for host := range tc.HostOverrides {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var overrides strings.Builder
+	for _, host := range hosts {
+		override := tc.HostOverrides[host]
+		fmt.Fprintf(&overrides, "%q %v %q\n", host, override.Insecure, override.CABundle)
+	}
+	return TransportConfigKey{
+		Insecure:      tc.Insecure,
+		CABundle:      tc.CABundle,
+		Proxy:         tc.Proxy,
+		NoProxy:       tc.NoProxy,
+		HostOverrides: overrides.String(),
+	}
+}
+
+var (
+	transportClients    = map[TransportConfigKey]*http.Client{}
+	transportClientsMtx sync.Mutex
+)
+
+// HTTPClient returns an http.Client that uses a transport built by
+// NewTransport. Clients are cached and shared, so connections can be
+// reused across callers that use the same TransportConfig.
+//
+// If tc is unusable (e.g., CABundle is unreadable) the returned
+// client fails every request with the same error.
+func (tc TransportConfig) HTTPClient() *http.Client {
+	key := tc.Key()
+	transportClientsMtx.Lock()
+	defer transportClientsMtx.Unlock()
+	if hc, ok := transportClients[key]; ok {
+		return hc
+	}
+	var hc *http.Client
+	if tr, err := tc.NewTransport(); err != nil {
+		hc = &http.Client{Transport: failingTransport{err}}
+	} else {
+		hc = &http.Client{Transport: tr}
+	}
+	transportClients[key] = hc
+	return hc
+}
+
+type failingTransport struct{ err error }
+
+func (et failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, et.err
+}
+
+// TransportConfig returns the outbound proxy and TLS settings from
+// the cluster config.
+func (cluster *Cluster) TransportConfig() TransportConfig {
+	return TransportConfig{
+		Insecure:      cluster.TLS.Insecure,
+		CABundle:      cluster.TLS.CABundle,
+		Proxy:         cluster.OutboundProxy.URL,
+		NoProxy:       cluster.OutboundProxy.NoProxy,
+		HostOverrides: cluster.TLS.HostOverrides,
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&transportSuite{})
+
+type transportSuite struct {
+	server   *httptest.Server
+	caBundle string
+}
+
+func (s *transportSuite) SetUpTest(c *check.C) {
+	s.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	s.caBundle = filepath.Join(c.MkDir(), "ca.pem")
+	err := os.WriteFile(s.caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw}), 0644)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *transportSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+// get makes a request to the test server using the given config,
+// addressing it by a host name ("example.com", which is valid for
+// the httptest server's certificate).
+func (s *transportSuite) get(c *check.C, tc TransportConfig) error {
+	tr, err := tc.NewTransport()
+	c.Assert(err, check.IsNil)
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, s.server.Listener.Addr().String())
+	}
+	resp, err := (&http.Client{Transport: tr}).Get("https://example.com/")
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func (s *transportSuite) TestCABundle(c *check.C) {
+	c.Check(s.get(c, TransportConfig{}), check.ErrorMatches, `.*certificate.*`)
+	c.Check(s.get(c, TransportConfig{Insecure: true}), check.IsNil)
+	c.Check(s.get(c, TransportConfig{CABundle: s.caBundle}), check.IsNil)
+}
+
+func (s *transportSuite) TestBadCABundle(c *check.C) {
+	_, err := TransportConfig{CABundle: "/nonexistent"}.NewTransport()
+	c.Check(err, check.ErrorMatches, `error reading CA bundle: .*`)
+
+	empty := filepath.Join(c.MkDir(), "empty.pem")
+	c.Assert(os.WriteFile(empty, []byte("bogus\n"), 0644), check.IsNil)
+	_, err = TransportConfig{CABundle: empty}.NewTransport()
+	c.Check(err, check.ErrorMatches, `error loading CA bundle: no certificates found in .*`)
+
+	_, err = TransportConfig{HostOverrides: map[string]TLSHostOverride{"example.com": {CABundle: empty}}}.NewTransport()
+	c.Check(err, check.ErrorMatches, `host "example.com": error loading CA bundle: .*`)
+
+	// Requests made with a cached client fail with the same
+	// error instead of silently ignoring the bundle.
+	_, err = TransportConfig{CABundle: "/nonexistent"}.HTTPClient().Get(s.server.URL)
+	c.Check(err, check.ErrorMatches, `.*error reading CA bundle: .*`)
+}
+
+func (s *transportSuite) TestHostOverrides(c *check.C) {
+	host := "Example.COM"
+	c.Check(s.get(c, TransportConfig{HostOverrides: map[string]TLSHostOverride{
+		host: {CABundle: s.caBundle},
+	}}), check.IsNil)
+	c.Check(s.get(c, TransportConfig{HostOverrides: map[string]TLSHostOverride{
+		host: {Insecure: true},
+	}}), check.IsNil)
+	// Override for a different host doesn't help.
+	c.Check(s.get(c, TransportConfig{HostOverrides: map[string]TLSHostOverride{
+		"example.net": {Insecure: true},
+	}}), check.ErrorMatches, `.*certificate.*`)
+	// Override without Insecure/CABundle enables verification
+	// for that host, even if Insecure is set globally.
+	c.Check(s.get(c, TransportConfig{Insecure: true, HostOverrides: map[string]TLSHostOverride{
+		host: {},
+	}}), check.ErrorMatches, `.*certificate.*`)
+	// Override without CABundle uses the default CABundle.
+	c.Check(s.get(c, TransportConfig{CABundle: s.caBundle, HostOverrides: map[string]TLSHostOverride{
+		host:          {},
+		"example.net": {Insecure: true},
+	}}), check.IsNil)
+}
+
+func (s *transportSuite) TestProxy(c *check.C) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer proxy.Close()
+
+	tr, err := TransportConfig{Proxy: proxy.URL, NoProxy: "direct.example"}.NewTransport()
+	c.Assert(err, check.IsNil)
+	hc := &http.Client{Transport: tr}
+	resp, err := hc.Get("http://arvados.example/foo")
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, check.Equals, http.StatusTeapot)
+	c.Check(proxied, check.DeepEquals, []string{"http://arvados.example/foo"})
+
+	_, err = hc.Get("http://direct.example/foo")
+	c.Check(err, check.NotNil)
+	c.Check(proxied, check.HasLen, 1)
+}
+
+func (s *transportSuite) TestProxyFromEnvironment(c *check.C) {
+	envProxy := reflect.ValueOf(http.ProxyFromEnvironment).Pointer()
+	for _, tc := range []TransportConfig{
+		{},
+		{CABundle: s.caBundle},
+		{HostOverrides: map[string]TLSHostOverride{"example.net": {Insecure: true}}},
+	} {
+		tr, err := tc.NewTransport()
+		c.Assert(err, check.IsNil)
+		c.Assert(tr.Proxy, check.NotNil)
+		c.Check(reflect.ValueOf(tr.Proxy).Pointer(), check.Equals, envProxy)
+	}
+	c.Check(reflect.ValueOf(InsecureHTTPClient.Transport.(*http.Transport).Proxy).Pointer(), check.Equals, envProxy)
+}
+
+func (s *transportSuite) TestKey(c *check.C) {
+	tc1 := TransportConfig{Proxy: "http://proxy.example", HostOverrides: map[string]TLSHostOverride{
+		"a.example": {Insecure: true},
+		"b.example": {CABundle: "/ca.pem"},
+	}}
+	tc2 := TransportConfig{Proxy: "http://proxy.example", HostOverrides: map[string]TLSHostOverride{
+		"b.example": {CABundle: "/ca.pem"},
+		"a.example": {Insecure: true},
+	}}
+	c.Check(tc1.Key(), check.Equals, tc2.Key())
+	c.Check(tc1.HTTPClient(), check.Equals, tc2.HTTPClient())
+
+	tc2.HostOverrides["a.example"] = TLSHostOverride{}
+	c.Check(tc1.Key(), check.Not(check.Equals), tc2.Key())
+	tc2.HostOverrides["a.example"] = TLSHostOverride{Insecure: true}
+	tc2.NoProxy = "direct.example"
+	c.Check(tc1.Key(), check.Not(check.Equals), tc2.Key())
+}
+
+func (s *transportSuite) TestClient(c *check.C) {
+	client := &Client{
+		APIHost:  s.server.Listener.Addr().String(),
+		CABundle: s.caBundle,
+	}
+	var resp map[string]interface{}
+	c.Check(client.RequestAndDecode(&resp, "GET", "arvados/v1/ping", nil, nil), check.IsNil)
+
+	client.CABundle = ""
+	c.Check(client.RequestAndDecode(&resp, "GET", "arvados/v1/ping", nil, nil), check.ErrorMatches, `.*certificate.*`)
+}
+
+func (s *transportSuite) TestClusterConfig(c *check.C) {
+	var cluster Cluster
+	cluster.TLS.CABundle = s.caBundle
+	cluster.OutboundProxy.URL = "http://proxy.example:3128"
+	cluster.OutboundProxy.NoProxy = ".example.com"
+	c.Check(cluster.TransportConfig(), check.DeepEquals, TransportConfig{
+		CABundle: s.caBundle,
+		Proxy:    "http://proxy.example:3128",
+		NoProxy:  ".example.com",
+	})
+
+	cluster.Services.Controller.ExternalURL = URL{Scheme: "https", Host: s.server.Listener.Addr().String()}
+	client, err := NewClientFromConfig(&cluster)
+	c.Assert(err, check.IsNil)
+	c.Check(client.TransportConfig().CABundle, check.Equals, s.caBundle)
+
+	cluster.TLS.CABundle = "/nonexistent"
+	_, err = NewClientFromConfig(&cluster)
+	c.Check(err, check.ErrorMatches, `error reading CA bundle: .*`)
+}
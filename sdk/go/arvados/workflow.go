@@ -4,7 +4,15 @@
 
 package arvados
 
-import "time"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
 
 // Workflow is an arvados#workflow resource.
 type Workflow struct {
@@ -24,3 +32,216 @@ type WorkflowList struct {
 	Offset         int        `json:"offset"`
 	Limit          int        `json:"limit"`
 }
+
+const (
+	workflowRunnerDir       = "/var/spool/cwl"
+	workflowRunnerDocument  = "/var/lib/cwl/workflow.json"
+	workflowRunnerInputFile = "/var/lib/cwl/cwl.input.json"
+)
+
+// WorkflowSubmitOptions control how NewWorkflowContainerRequest
+// builds the container request that runs a workflow.
+type WorkflowSubmitOptions struct {
+	// Name of the container request. Defaults to the workflow
+	// name.
+	Name string
+	// Project to own the container request and its output.
+	OwnerUUID string
+	// Docker image that provides arvados-cwl-runner, e.g.,
+	// "arvados/jobs:2.7.0". Required.
+	RunnerImage string
+	// Resources for the runner container. Defaults are 1 VCPU
+	// and 1 GiB RAM.
+	RunnerVCPUs int
+	RunnerRAM   ByteSize
+	// Container request priority. Defaults to 500.
+	Priority int
+	// Name of the output collection. Defaults to "Output from
+	// <name>".
+	OutputName string
+	// Allow the runner and its steps to reuse past containers.
+	UseExisting bool
+	// Additional arvados-cwl-runner arguments, e.g.,
+	// "--project-uuid=...".
+	ExtraArgs []string
+	// If true, the container request is created in the
+	// Uncommitted state instead of being submitted right away.
+	Uncommitted bool
+}
+
+// RegisterWorkflow calls arvados.v1.workflows.create and returns the
+// new Workflow record.
+func (c *Client) RegisterWorkflow(ctx context.Context, wf Workflow) (Workflow, error) {
+	var resp Workflow
+	err := c.RequestAndDecodeContext(ctx, &resp, "POST", "arvados/v1/workflows", nil, map[string]interface{}{
+		"workflow": map[string]interface{}{
+			"owner_uuid":  wf.OwnerUUID,
+			"name":        wf.Name,
+			"description": wf.Description,
+			"definition":  wf.Definition,
+		},
+	})
+	return resp, err
+}
+
+// NewWorkflowContainerRequest returns a container request that runs
+// arvados-cwl-runner on the given workflow and inputs, the same way
+// "arvados-cwl-runner --submit" does for a registered workflow. The
+// workflow definition may be JSON or YAML.
+//
+// The returned container request has not been created yet; see
+// SubmitWorkflow.
+func NewWorkflowContainerRequest(wf Workflow, inputs map[string]interface{}, opts WorkflowSubmitOptions) (ContainerRequest, error) {
+	if opts.RunnerImage == "" {
+		return ContainerRequest{}, errors.New("RunnerImage must be specified")
+	}
+	docJSON, err := yaml.YAMLToJSON([]byte(wf.Definition))
+	if err != nil {
+		return ContainerRequest{}, fmt.Errorf("error parsing workflow definition: %w", err)
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal(docJSON, &doc)
+	if err != nil || doc == nil {
+		return ContainerRequest{}, fmt.Errorf("workflow definition is not an object: %v", err)
+	}
+	if inputs == nil {
+		inputs = map[string]interface{}{}
+	}
+	name := opts.Name
+	if name == "" {
+		name = wf.Name
+	}
+	outputName := opts.OutputName
+	if outputName == "" {
+		outputName = "Output from " + name
+	}
+	vcpus := opts.RunnerVCPUs
+	if vcpus == 0 {
+		vcpus = 1
+	}
+	ram := opts.RunnerRAM
+	if ram == 0 {
+		ram = 1 << 30
+	}
+	priority := opts.Priority
+	if priority == 0 {
+		priority = 500
+	}
+	state := ContainerRequestStateCommitted
+	if opts.Uncommitted {
+		state = ContainerRequestStateUncomitted
+	}
+
+	command := []string{
+		"arvados-cwl-runner",
+		"--local",
+		"--api=containers",
+		"--no-log-timestamps",
+		"--disable-validate",
+		"--disable-color",
+		"--output-name=" + outputName,
+	}
+	if opts.UseExisting {
+		command = append(command, "--enable-reuse")
+	} else {
+		command = append(command, "--disable-reuse")
+	}
+	command = append(command, opts.ExtraArgs...)
+	command = append(command, workflowRunnerDocument+"#main", workflowRunnerInputFile)
+
+	properties := map[string]interface{}{}
+	if wf.UUID != "" {
+		properties["template_uuid"] = wf.UUID
+	}
+	return ContainerRequest{
+		OwnerUUID:   opts.OwnerUUID,
+		Name:        name,
+		Description: wf.Description,
+		Properties:  properties,
+		State:       state,
+		Mounts: map[string]Mount{
+			workflowRunnerDocument:  {Kind: "json", Content: doc},
+			workflowRunnerInputFile: {Kind: "json", Content: inputs},
+			workflowRunnerDir:       {Kind: "collection", Writable: true},
+			"stdout":                {Kind: "file", Path: workflowRunnerDir + "/cwl.output.json"},
+		},
+		RuntimeConstraints: RuntimeConstraints{
+			API:   true,
+			VCPUs: vcpus,
+			RAM:   int64(ram),
+		},
+		ContainerImage: opts.RunnerImage,
+		Cwd:            workflowRunnerDir,
+		Command:        command,
+		OutputPath:     workflowRunnerDir,
+		OutputName:     outputName,
+		Priority:       priority,
+		UseExisting:    opts.UseExisting,
+	}, nil
+}
+
+// SubmitWorkflow builds a container request using
+// NewWorkflowContainerRequest and creates it.
+func (c *Client) SubmitWorkflow(ctx context.Context, wf Workflow, inputs map[string]interface{}, opts WorkflowSubmitOptions) (ContainerRequest, error) {
+	cr, err := NewWorkflowContainerRequest(wf, inputs, opts)
+	if err != nil {
+		return cr, err
+	}
+	attrs := map[string]interface{}{
+		"name":                cr.Name,
+		"description":         cr.Description,
+		"properties":          cr.Properties,
+		"state":               cr.State,
+		"mounts":              cr.Mounts,
+		"runtime_constraints": cr.RuntimeConstraints,
+		"container_image":     cr.ContainerImage,
+		"cwd":                 cr.Cwd,
+		"command":             cr.Command,
+		"output_path":         cr.OutputPath,
+		"output_name":         cr.OutputName,
+		"priority":            cr.Priority,
+		"use_existing":        cr.UseExisting,
+	}
+	if cr.OwnerUUID != "" {
+		attrs["owner_uuid"] = cr.OwnerUUID
+	}
+	var resp ContainerRequest
+	err = c.RequestAndDecodeContext(ctx, &resp, "POST", "arvados/v1/container_requests", nil, map[string]interface{}{
+		"container_request": attrs,
+	})
+	return resp, err
+}
+
+// WorkflowChildren returns the container requests submitted by the
+// runner container of the given workflow container request (i.e.,
+// the workflow steps started so far). It returns an empty list if
+// the runner container has not been assigned yet.
+func (c *Client) WorkflowChildren(ctx context.Context, crUUID string) ([]ContainerRequest, error) {
+	var cr ContainerRequest
+	err := c.RequestAndDecodeContext(ctx, &cr, "GET", "arvados/v1/container_requests/"+crUUID, nil, ResourceListParams{
+		Select: []string{"uuid", "container_uuid"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cr.ContainerUUID == "" {
+		return nil, nil
+	}
+	var children []ContainerRequest
+	params := ResourceListParams{
+		Filters: []Filter{{"requesting_container_uuid", "=", cr.ContainerUUID}},
+		Order:   "created_at",
+	}
+	for {
+		var page ContainerRequestList
+		err := c.RequestAndDecodeContext(ctx, &page, "GET", "arvados/v1/container_requests", nil, params)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, page.Items...)
+		params.Offset += len(page.Items)
+		if len(page.Items) == 0 || params.Offset >= page.ItemsAvailable {
+			return children, nil
+		}
+	}
+}
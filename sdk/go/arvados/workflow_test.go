@@ -0,0 +1,88 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&workflowSuite{})
+
+type workflowSuite struct{}
+
+func (*workflowSuite) TestNewWorkflowContainerRequest(c *check.C) {
+	wf := Workflow{
+		UUID: "zzzzz-7fd4e-012340123401234",
+		Name: "hello",
+		Definition: `
+cwlVersion: v1.2
+$graph:
+  - id: "#main"
+    class: Workflow
+`,
+	}
+	_, err := NewWorkflowContainerRequest(wf, nil, WorkflowSubmitOptions{})
+	c.Check(err, check.ErrorMatches, `RunnerImage must be specified`)
+
+	cr, err := NewWorkflowContainerRequest(wf, map[string]interface{}{"x": 1}, WorkflowSubmitOptions{
+		RunnerImage: "arvados/jobs:latest",
+		UseExisting: true,
+		ExtraArgs:   []string{"--debug"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(cr.Name, check.Equals, "hello")
+	c.Check(cr.OutputName, check.Equals, "Output from hello")
+	c.Check(cr.State, check.Equals, ContainerRequestStateCommitted)
+	c.Check(cr.Priority, check.Equals, 500)
+	c.Check(cr.RuntimeConstraints, check.DeepEquals, RuntimeConstraints{API: true, VCPUs: 1, RAM: 1 << 30})
+	c.Check(cr.Properties["template_uuid"], check.Equals, wf.UUID)
+	c.Check(cr.Command[len(cr.Command)-4:], check.DeepEquals, []string{"--enable-reuse", "--debug", "/var/lib/cwl/workflow.json#main", "/var/lib/cwl/cwl.input.json"})
+	c.Check(cr.Mounts["/var/lib/cwl/cwl.input.json"].Content, check.DeepEquals, map[string]interface{}{"x": 1})
+	doc, _ := cr.Mounts["/var/lib/cwl/workflow.json"].Content.(map[string]interface{})
+	c.Check(doc["cwlVersion"], check.Equals, "v1.2")
+	c.Check(cr.Mounts["/var/spool/cwl"], check.DeepEquals, Mount{Kind: "collection", Writable: true})
+
+	wf.Definition = `[1, 2]`
+	_, err = NewWorkflowContainerRequest(wf, nil, WorkflowSubmitOptions{RunnerImage: "arvados/jobs:latest"})
+	c.Check(err, check.ErrorMatches, `workflow definition is not an object.*`)
+}
+
+func (*workflowSuite) TestSubmitAndTrack(c *check.C) {
+	stub := &stubTransport{
+		Responses: map[string]string{
+			"/arvados/v1/container_requests":                             `{"uuid":"zzzzz-xvhdp-012340123401234","items":[{"uuid":"zzzzz-xvhdp-aaaaaaaaaaaaaaa"}],"items_available":1}`,
+			"/arvados/v1/container_requests/zzzzz-xvhdp-012340123401234": `{"uuid":"zzzzz-xvhdp-012340123401234","container_uuid":"zzzzz-dz642-012340123401234"}`,
+		},
+	}
+	client := &Client{
+		Client:    &http.Client{Transport: stub},
+		APIHost:   "zzzzz.arvadosapi.com",
+		AuthToken: "xyzzy",
+	}
+	cr, err := client.SubmitWorkflow(context.Background(), Workflow{Name: "hello", Definition: `{"cwlVersion":"v1.2"}`}, nil, WorkflowSubmitOptions{RunnerImage: "arvados/jobs:latest"})
+	c.Assert(err, check.IsNil)
+	c.Check(cr.UUID, check.Equals, "zzzzz-xvhdp-012340123401234")
+	c.Assert(stub.Requests, check.HasLen, 1)
+	body, err := ioutil.ReadAll(stub.Requests[0].Body)
+	c.Assert(err, check.IsNil)
+	form, err := url.ParseQuery(string(body))
+	c.Assert(err, check.IsNil)
+	var attrs map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(form.Get("container_request")), &attrs), check.IsNil)
+	c.Check(attrs["container_image"], check.Equals, "arvados/jobs:latest")
+	c.Check(attrs["state"], check.Equals, "Committed")
+
+	children, err := client.WorkflowChildren(context.Background(), cr.UUID)
+	c.Assert(err, check.IsNil)
+	c.Assert(children, check.HasLen, 1)
+	c.Check(children[0].UUID, check.Equals, "zzzzz-xvhdp-aaaaaaaaaaaaaaa")
+	c.Check(stub.Requests[2].URL.Query().Get("filters"), check.Equals, `[["requesting_container_uuid","=","zzzzz-dz642-012340123401234"]]`)
+}
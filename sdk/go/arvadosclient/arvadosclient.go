@@ -97,6 +97,11 @@ type ArvadosClient struct {
 	// Whether to require a valid SSL certificate or not
 	ApiInsecure bool
 
+	// Outbound proxy and TLS settings (CA bundle, per-host
+	// overrides) used by the default HTTP clients. ApiInsecure
+	// takes precedence over TransportConfig.Insecure.
+	TransportConfig arvados.TransportConfig
+
 	// Client object shared by client requests.  Supports HTTP KeepAlive.
 	Client *http.Client
 
@@ -106,6 +111,17 @@ type ArvadosClient struct {
 	// available services.
 	KeepServiceURIs []string
 
+	// DNS name whose SRV records list the available Keep
+	// services (see arvados.Client.KeepServiceSRV). If this is
+	// non-empty and KeepServiceURIs is nil, Keep clients use DNS
+	// instead of the API server to discover services.
+	KeepServiceSRV string
+
+	// Use keepstore servers directly instead of a keepproxy
+	// listed by the API server (see
+	// arvados.Client.KeepProxyBypass).
+	KeepProxyBypass string
+
 	// Maximum disk cache size in bytes or percent of total
 	// filesystem size. If zero, use default, currently 10% of
 	// filesystem size.
@@ -146,10 +162,13 @@ func MakeTLSConfig(insecure bool) *tls.Config {
 func New(c *arvados.Client) (*ArvadosClient, error) {
 	hc := c.Client
 	if hc == nil {
+		tr, err := c.TransportConfig().NewTransport()
+		if err != nil {
+			return nil, err
+		}
 		hc = &http.Client{
-			Timeout: 5 * time.Minute,
-			Transport: &http.Transport{
-				TLSClientConfig: MakeTLSConfig(c.Insecure)},
+			Timeout:   5 * time.Minute,
+			Transport: tr,
 		}
 	}
 	ac := &ArvadosClient{
@@ -157,9 +176,12 @@ func New(c *arvados.Client) (*ArvadosClient, error) {
 		ApiServer:         c.APIHost,
 		ApiToken:          c.AuthToken,
 		ApiInsecure:       c.Insecure,
+		TransportConfig:   c.TransportConfig(),
 		Client:            hc,
 		Retries:           2,
 		KeepServiceURIs:   c.KeepServiceURIs,
+		KeepServiceSRV:    c.KeepServiceSRV,
+		KeepProxyBypass:   c.KeepProxyBypass,
 		DiskCacheSize:     c.DiskCacheSize,
 		Logger:            c.Logger,
 		lastClosedIdlesAt: time.Now(),
@@ -171,7 +193,9 @@ func New(c *arvados.Client) (*ArvadosClient, error) {
 
 // MakeArvadosClient creates a new ArvadosClient using the standard
 // environment variables ARVADOS_API_HOST, ARVADOS_API_TOKEN,
-// ARVADOS_API_HOST_INSECURE, and ARVADOS_KEEP_SERVICES.
+// ARVADOS_API_HOST_INSECURE, ARVADOS_CA_BUNDLE,
+// ARVADOS_KEEP_SERVICES, ARVADOS_KEEP_SERVICES_SRV, and
+// ARVADOS_KEEP_PROXY_BYPASS.
 func MakeArvadosClient() (*ArvadosClient, error) {
 	return New(arvados.NewClientFromEnv())
 }
@@ -232,11 +256,15 @@ func (c *ArvadosClient) CallRaw(method string, resourceType string, uuid string,
 		req.Header.Add("X-Request-Id", c.RequestID)
 	}
 	client := arvados.Client{
-		Client:    c.Client,
-		APIHost:   c.ApiServer,
-		AuthToken: c.ApiToken,
-		Insecure:  c.ApiInsecure,
-		Timeout:   30 * RetryDelay * time.Duration(c.Retries),
+		Client:           c.Client,
+		APIHost:          c.ApiServer,
+		AuthToken:        c.ApiToken,
+		Insecure:         c.ApiInsecure,
+		CABundle:         c.TransportConfig.CABundle,
+		Proxy:            c.TransportConfig.Proxy,
+		NoProxy:          c.TransportConfig.NoProxy,
+		TLSHostOverrides: c.TransportConfig.HostOverrides,
+		Timeout:          30 * RetryDelay * time.Duration(c.Retries),
 	}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -385,6 +413,11 @@ func (c *ArvadosClient) httpClient() *http.Client {
 	if c.Client != nil {
 		return c.Client
 	}
+	if !c.TransportConfig.IsDefault() {
+		tc := c.TransportConfig
+		tc.Insecure = c.ApiInsecure
+		return tc.HTTPClient()
+	}
 	cl := &defaultSecureHTTPClient
 	if c.ApiInsecure {
 		cl = &defaultInsecureHTTPClient
@@ -0,0 +1,206 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvadostest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+var ErrKeepGatewayStubNotFound = errors.New("block not found")
+
+// KeepGatewayStub is an in-memory arvados.KeepGateway with
+// configurable latency, failures, and corrupt responses. It is meant
+// for testing error handling in programs that wrap a KeepGateway,
+// e.g., with arvados.DiskCache:
+//
+//	backend := &arvadostest.KeepGatewayStub{
+//		Error: arvadostest.FailFirst(2, errors.New("503 Service Unavailable")),
+//	}
+//	cache := &arvados.DiskCache{KeepGateway: backend, ...}
+//
+// The zero value is an empty, well-behaved backend. Fields may be
+// changed between calls, but not while calls are in progress.
+type KeepGatewayStub struct {
+	// Time to wait before handling each call. BlockRead and
+	// BlockWrite return early if their context is cancelled.
+	Latency time.Duration
+
+	// If non-nil, Error is called before handling each call,
+	// with the method name ("ReadAt", "BlockRead", "BlockWrite",
+	// or "LocalLocator") and the locator (for BlockWrite, the
+	// hash supplied by the caller, which may be empty). If it
+	// returns a non-nil error, the call fails with that error.
+	Error func(method, locator string) error
+
+	// If non-nil, Corrupt is called before returning data from
+	// ReadAt or BlockRead. If it returns true, the returned data
+	// has its first byte altered.
+	Corrupt func(locator string) bool
+
+	mtx   sync.Mutex
+	data  map[string][]byte
+	calls map[string]int
+}
+
+// FailFirst returns a function, suitable for KeepGatewayStub.Error,
+// that fails the first n calls with err and lets the rest succeed.
+func FailFirst(n int, err error) func(method, locator string) error {
+	var mtx sync.Mutex
+	return func(string, string) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if n <= 0 {
+			return nil
+		}
+		n--
+		return err
+	}
+}
+
+// Put stores data without going through BlockWrite (so it is not
+// subject to Latency, Error, or call counting), and returns its
+// locator.
+func (kgs *KeepGatewayStub) Put(data []byte) string {
+	locator := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+	kgs.mtx.Lock()
+	defer kgs.mtx.Unlock()
+	if kgs.data == nil {
+		kgs.data = map[string][]byte{}
+	}
+	kgs.data[locator[:32]] = append([]byte(nil), data...)
+	return locator
+}
+
+// Delete removes the given block, so subsequent reads fail with
+// ErrKeepGatewayStubNotFound.
+func (kgs *KeepGatewayStub) Delete(locator string) {
+	kgs.mtx.Lock()
+	defer kgs.mtx.Unlock()
+	delete(kgs.data, hashPart(locator))
+}
+
+// Calls returns the number of calls to the given method so far,
+// including failed calls.
+func (kgs *KeepGatewayStub) Calls(method string) int {
+	kgs.mtx.Lock()
+	defer kgs.mtx.Unlock()
+	return kgs.calls[method]
+}
+
+// ReadAt implements arvados.KeepGateway.
+func (kgs *KeepGatewayStub) ReadAt(locator string, dst []byte, offset int) (int, error) {
+	data, err := kgs.read(context.Background(), "ReadAt", locator)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if len(data) > offset {
+		n = copy(dst, data[offset:])
+	}
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// BlockRead implements arvados.KeepGateway.
+func (kgs *KeepGatewayStub) BlockRead(ctx context.Context, opts arvados.BlockReadOptions) (int, error) {
+	data, err := kgs.read(ctx, "BlockRead", opts.Locator)
+	if err != nil {
+		return 0, err
+	}
+	if opts.LocalLocator != nil {
+		opts.LocalLocator(opts.Locator)
+	}
+	return opts.WriteTo.Write(data)
+}
+
+// BlockWrite implements arvados.KeepGateway.
+func (kgs *KeepGatewayStub) BlockWrite(ctx context.Context, opts arvados.BlockWriteOptions) (arvados.BlockWriteResponse, error) {
+	if err := kgs.begin(ctx, "BlockWrite", opts.Hash); err != nil {
+		return arvados.BlockWriteResponse{}, err
+	}
+	data := opts.Data
+	if data == nil {
+		buf := bytes.NewBuffer(nil)
+		_, err := io.Copy(buf, opts.Reader)
+		if err != nil {
+			return arvados.BlockWriteResponse{}, err
+		}
+		data = buf.Bytes()
+	}
+	if hash := fmt.Sprintf("%x", md5.Sum(data)); opts.Hash != "" && !strings.HasPrefix(opts.Hash, hash) {
+		return arvados.BlockWriteResponse{}, fmt.Errorf("block hash %s did not match provided hash %s", hash, opts.Hash)
+	}
+	return arvados.BlockWriteResponse{Locator: kgs.Put(data), Replicas: 1}, nil
+}
+
+// LocalLocator implements arvados.KeepGateway.
+func (kgs *KeepGatewayStub) LocalLocator(locator string) (string, error) {
+	if err := kgs.begin(context.Background(), "LocalLocator", locator); err != nil {
+		return "", err
+	}
+	return locator, nil
+}
+
+// begin counts the call, waits for Latency, and returns the injected
+// error, if any.
+func (kgs *KeepGatewayStub) begin(ctx context.Context, method, locator string) error {
+	kgs.mtx.Lock()
+	if kgs.calls == nil {
+		kgs.calls = map[string]int{}
+	}
+	kgs.calls[method]++
+	latency, errfunc := kgs.Latency, kgs.Error
+	kgs.mtx.Unlock()
+	if latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(latency):
+		}
+	}
+	if errfunc != nil {
+		return errfunc(method, locator)
+	}
+	return nil
+}
+
+// read returns a copy of the stored data for the given locator,
+// corrupted if requested by kgs.Corrupt.
+func (kgs *KeepGatewayStub) read(ctx context.Context, method, locator string) ([]byte, error) {
+	if err := kgs.begin(ctx, method, locator); err != nil {
+		return nil, err
+	}
+	kgs.mtx.Lock()
+	data, ok := kgs.data[hashPart(locator)]
+	corrupt := kgs.Corrupt
+	kgs.mtx.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeepGatewayStubNotFound, locator)
+	}
+	data = append([]byte(nil), data...)
+	if corrupt != nil && len(data) > 0 && corrupt(locator) {
+		data[0] ^= 0xff
+	}
+	return data, nil
+}
+
+func hashPart(locator string) string {
+	if len(locator) > 32 {
+		return locator[:32]
+	}
+	return locator
+}
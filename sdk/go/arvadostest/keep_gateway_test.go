@@ -0,0 +1,102 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvadostest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+// Gocheck boilerplate
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&keepGatewayStubSuite{})
+
+// Test that *KeepGatewayStub implements arvados.KeepGateway
+var _ arvados.KeepGateway = &KeepGatewayStub{}
+
+type keepGatewayStubSuite struct{}
+
+func (s *keepGatewayStubSuite) newCache(c *check.C, backend arvados.KeepGateway) *arvados.DiskCache {
+	return &arvados.DiskCache{
+		KeepGateway: backend,
+		MaxSize:     40000000,
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+	}
+}
+
+func (s *keepGatewayStubSuite) TestReadWrite(c *check.C) {
+	backend := &KeepGatewayStub{}
+	cache := s.newCache(c, backend)
+	resp, err := cache.BlockWrite(context.Background(), arvados.BlockWriteOptions{Data: []byte("foo")})
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Locator, check.Equals, "acbd18db4cc2f85cedef654fccc4a4d8+3")
+	c.Check(backend.Calls("BlockWrite"), check.Equals, 1)
+
+	backend.Delete(resp.Locator)
+	buf := make([]byte, 3)
+	_, err = backend.ReadAt(resp.Locator, buf, 0)
+	c.Check(errors.Is(err, ErrKeepGatewayStubNotFound), check.Equals, true)
+
+	locator := backend.Put([]byte("bar"))
+	var out bytes.Buffer
+	n, err := cache.BlockRead(context.Background(), arvados.BlockReadOptions{Locator: locator, WriteTo: &out})
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, 3)
+	c.Check(out.String(), check.Equals, "bar")
+}
+
+func (s *keepGatewayStubSuite) TestError(c *check.C) {
+	errUnavailable := errors.New("503 Service Unavailable")
+	backend := &KeepGatewayStub{Error: FailFirst(1, errUnavailable)}
+	locator := backend.Put([]byte("foo"))
+	cache := s.newCache(c, backend)
+
+	buf := make([]byte, 3)
+	_, err := cache.ReadAt(locator, buf, 0)
+	c.Check(errors.Is(err, errUnavailable), check.Equals, true, check.Commentf("err %v", err))
+	n, err := cache.ReadAt(locator, buf, 0)
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, 3)
+	c.Check(string(buf), check.Equals, "foo")
+	c.Check(backend.Calls("BlockRead")+backend.Calls("ReadAt"), check.Equals, 2)
+}
+
+func (s *keepGatewayStubSuite) TestCorrupt(c *check.C) {
+	backend := &KeepGatewayStub{Corrupt: func(string) bool { return true }}
+	locator := backend.Put([]byte("foo"))
+	buf := make([]byte, 3)
+	n, err := backend.ReadAt(locator, buf, 0)
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, 3)
+	c.Check(string(buf), check.Not(check.Equals), "foo")
+
+	_, err = backend.BlockWrite(context.Background(), arvados.BlockWriteOptions{
+		Hash: "37b51d194a7513e45b56f6524f2d51f2",
+		Data: []byte("foo"),
+	})
+	c.Check(err, check.ErrorMatches, `block hash .* did not match provided hash .*`)
+}
+
+func (s *keepGatewayStubSuite) TestLatency(c *check.C) {
+	backend := &KeepGatewayStub{Latency: time.Minute}
+	locator := backend.Put([]byte("foo"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	_, err := backend.BlockRead(ctx, arvados.BlockReadOptions{Locator: locator, WriteTo: &bytes.Buffer{}})
+	c.Check(err, check.Equals, context.DeadlineExceeded)
+	c.Check(time.Since(t0) < time.Second, check.Equals, true)
+}
@@ -57,19 +57,6 @@ func (s *AggregatorSuite) SetUpTest(c *check.C) {
 	s.resp = httptest.NewRecorder()
 }
 
-func (s *AggregatorSuite) TestSameVersion(c *check.C) {
-	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.1~dev20240610194320"), check.Equals, false)
-	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.1~dev20240610194320 (go1.21.10)"), check.Equals, false)
-	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.1~dev20240610194320 (go1.21.9)"), check.Equals, false)
-	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.0~dev20240610194320 (go1.21.9)"), check.Equals, true)
-	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.0~dev20240611211146 (go1.21.10)"), check.Equals, true)
-	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.0~dev20240611211146"), check.Equals, true)
-	c.Check(sameVersion("2.8.0~dev20240610194320 (go1.21.10)", "2.8.0"), check.Equals, false)
-	c.Check(sameVersion("2.8.0~dev20240610194320", "2.8.0"), check.Equals, false)
-	c.Check(sameVersion("2.8.0", "2.8.0"), check.Equals, true)
-	c.Check(sameVersion("2.8.0", "2.8.1"), check.Equals, false)
-}
-
 func (s *AggregatorSuite) TestNoAuth(c *check.C) {
 	s.req.Header.Del("Authorization")
 	s.handler.ServeHTTP(s.resp, s.req)
@@ -162,21 +149,6 @@ func (s *AggregatorSuite) TestUnreachableLoopbackPort(c *check.C) {
 	s.checkUnhealthy(c)
 }
 
-func (s *AggregatorSuite) TestIsLocalHost(c *check.C) {
-	c.Check(isLocalHost("Localhost"), check.Equals, true)
-	c.Check(isLocalHost("localhost"), check.Equals, true)
-	c.Check(isLocalHost("127.0.0.1"), check.Equals, true)
-	c.Check(isLocalHost("127.0.0.127"), check.Equals, true)
-	c.Check(isLocalHost("127.1.2.7"), check.Equals, true)
-	c.Check(isLocalHost("0.0.0.0"), check.Equals, true)
-	c.Check(isLocalHost("::1"), check.Equals, true)
-	c.Check(isLocalHost("1.2.3.4"), check.Equals, false)
-	c.Check(isLocalHost("1::1"), check.Equals, false)
-	c.Check(isLocalHost("example.com"), check.Equals, false)
-	c.Check(isLocalHost("127.0.0"), check.Equals, false)
-	c.Check(isLocalHost(""), check.Equals, false)
-}
-
 func (s *AggregatorSuite) TestConfigMismatch(c *check.C) {
 	// time1/hash1: current config
 	time1 := time.Now().Add(time.Second - time.Minute - time.Hour)
@@ -5,6 +5,7 @@
 package httpserver
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"sync"
@@ -67,6 +68,15 @@ func (srv *Server) Close() error {
 	return srv.Wait()
 }
 
+// Shutdown stops accepting new connections, and returns when all
+// active connections have finished their current requests (see
+// (*http.Server)Shutdown), or ctx is done. In the latter case, the
+// remaining connections are left open.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.wantDown = true
+	return srv.Server.Shutdown(ctx)
+}
+
 // Wait returns when the server has shut down.
 func (srv *Server) Wait() error {
 	if srv.cond == nil {
@@ -0,0 +1,112 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedBodyReader decompresses a gzip- or zstd-encoded
+// response body, and records the number of bytes saved (decompressed
+// size minus wire size) when it is closed.
+type compressedBodyReader struct {
+	dec     io.ReadCloser
+	wire    *countingReader
+	body    io.ReadCloser
+	kc      *KeepClient
+	n       int64
+	counted bool
+}
+
+func (cbr *compressedBodyReader) Read(p []byte) (int, error) {
+	n, err := cbr.dec.Read(p)
+	cbr.n += int64(n)
+	if err == io.EOF {
+		cbr.count()
+	}
+	return n, err
+}
+
+func (cbr *compressedBodyReader) Close() error {
+	cbr.count()
+	err := cbr.dec.Close()
+	if err2 := cbr.body.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (cbr *compressedBodyReader) count() {
+	if cbr.counted {
+		return
+	}
+	cbr.counted = true
+	if saved := cbr.n - cbr.wire.n; saved > 0 {
+		atomic.AddInt64(&cbr.kc.compressionBytesSaved, saved)
+	}
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// setAcceptEncoding sets the Accept-Encoding header on a block
+// request. Unless compression is disabled, we advertise zstd and
+// gzip explicitly (rather than letting the Go http transport
+// advertise gzip) so we can decode the response ourselves and
+// account for the bytes saved.
+func (kc *KeepClient) setAcceptEncoding(req *http.Request) {
+	if req.Header.Get("Accept-Encoding") != "" {
+		return
+	}
+	if kc.DisableCompression {
+		req.Header.Set("Accept-Encoding", "identity")
+	} else {
+		req.Header.Set("Accept-Encoding", "zstd, gzip")
+	}
+}
+
+// decodeResponseBody returns a reader that yields the decoded
+// response body, according to the response's Content-Encoding.
+func (kc *KeepClient) decodeResponseBody(resp *http.Response) (io.ReadCloser, error) {
+	wire := &countingReader{Reader: resp.Body}
+	var dec io.ReadCloser
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		gz, err := gzip.NewReader(wire)
+		if err != nil {
+			return nil, err
+		}
+		dec = gz
+	case "zstd":
+		zr, err := zstd.NewReader(wire, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		dec = zr.IOReadCloser()
+	default:
+		return resp.Body, nil
+	}
+	return &compressedBodyReader{dec: dec, wire: wire, body: resp.Body, kc: kc}, nil
+}
+
+// CompressionBytesSaved returns the total number of bytes this
+// client has avoided transferring by accepting compressed
+// responses.
+func (kc *KeepClient) CompressionBytesSaved() int64 {
+	return atomic.LoadInt64(&kc.compressionBytesSaved)
+}
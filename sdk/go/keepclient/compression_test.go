@@ -0,0 +1,90 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"github.com/klauspost/compress/zstd"
+	. "gopkg.in/check.v1"
+)
+
+type compressedGetHandler struct {
+	c              *C
+	data           []byte
+	encoding       string
+	acceptEncoding chan string
+}
+
+func (h compressedGetHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.acceptEncoding <- req.Header.Get("Accept-Encoding")
+	if !strings.Contains(req.Header.Get("Accept-Encoding"), h.encoding) {
+		resp.Header().Set("Content-Length", fmt.Sprintf("%d", len(h.data)))
+		resp.Write(h.data)
+		return
+	}
+	var buf bytes.Buffer
+	var zw io.WriteCloser
+	if h.encoding == "zstd" {
+		zw, _ = zstd.NewWriter(&buf)
+	} else {
+		zw = gzip.NewWriter(&buf)
+	}
+	zw.Write(h.data)
+	zw.Close()
+	resp.Header().Set("Content-Encoding", h.encoding)
+	resp.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
+	resp.Write(buf.Bytes())
+}
+
+func (s *StandaloneSuite) TestGetCompressed(c *C) {
+	data := bytes.Repeat([]byte("compressible "), 10000)
+	locator := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+
+	for _, trial := range []struct {
+		encoding string
+		disable  bool
+	}{
+		{"gzip", false},
+		{"zstd", false},
+		{"gzip", true},
+	} {
+		c.Logf("encoding %s, DisableCompression == %v", trial.encoding, trial.disable)
+		st := compressedGetHandler{c, data, trial.encoding, make(chan string, 1)}
+		ks := RunFakeKeepServer(st)
+		defer ks.listener.Close()
+
+		arv, err := arvadosclient.MakeArvadosClient()
+		c.Check(err, IsNil)
+		kc, _ := MakeKeepClient(arv)
+		kc.DiskCacheSize = DiskCacheDisabled
+		kc.DisableCompression = trial.disable
+		kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+		r, n, _, err := kc.Get(locator)
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, int64(len(data)))
+		content, err := ioutil.ReadAll(r)
+		c.Check(err, IsNil)
+		c.Check(content, DeepEquals, data)
+		c.Check(r.Close(), IsNil)
+
+		if trial.disable {
+			c.Check(<-st.acceptEncoding, Equals, "identity")
+			c.Check(kc.CompressionBytesSaved(), Equals, int64(0))
+		} else {
+			c.Check(<-st.acceptEncoding, Equals, "zstd, gzip")
+			c.Check(kc.CompressionBytesSaved() > int64(len(data)/2), Equals, true)
+		}
+	}
+}
@@ -63,10 +63,20 @@ type cachedSvcList struct {
 	arv    *arvadosclient.ArvadosClient
 	latest chan svcList
 	clear  chan struct{}
+
+	// Remove a stale service root from the current list, and
+	// fetch a new list.
+	purge chan string
+
+	// Retrieve the current services list.
+	fetch func() (svcList, error)
+
+	// Interval between successful fetches.
+	okDelay time.Duration
 }
 
-// Check for new services list every few minutes. Send the latest list
-// to the "latest" channel as needed.
+// Check for new services list every few minutes (or okDelay, if
+// set). Send the latest list to the "latest" channel as needed.
 func (ent *cachedSvcList) poll() {
 	wakeup := make(chan struct{})
 
@@ -83,12 +93,22 @@ func (ent *cachedSvcList) poll() {
 				// results on the "latest" channel.
 				current = <-replace
 			case current = <-replace:
+			case root := <-ent.purge:
+				current = current.without(root)
+				select {
+				case wakeup <- struct{}{}:
+				default:
+					// Already fetching.
+				}
 			case ent.latest <- current:
 			}
 		}
 	}()
 
-	okDelay := 5 * time.Minute
+	okDelay := ent.okDelay
+	if okDelay == 0 {
+		okDelay = 5 * time.Minute
+	}
 	errDelay := 3 * time.Second
 	timer := time.NewTimer(okDelay)
 	for {
@@ -100,8 +120,7 @@ func (ent *cachedSvcList) poll() {
 				<-timer.C
 			}
 		}
-		var next svcList
-		err := ent.arv.Call("GET", "keep_services", "", "accessible", nil, &next)
+		next, err := ent.fetch()
 		if err != nil {
 			if ent.arv.Logger != nil {
 				ent.arv.Logger.WithError(err).Warnf("error retrieving services list (retrying in %v)", errDelay)
@@ -121,7 +140,10 @@ func (ent *cachedSvcList) poll() {
 //
 // If a list of services is provided in the arvadosclient (e.g., from
 // an environment variable or local config), that list is used
-// instead.
+// instead. If an SRV record name is provided, services are
+// discovered via DNS (see discoverServicesSRV). If the API server
+// lists a keepproxy, it may be bypassed in favor of the keepstore
+// servers (see bypassProxy).
 //
 // If an API call is made, the result is cached for 5 minutes or until
 // ClearCache() is called, and during this interval it is reused by
@@ -143,6 +165,10 @@ func (kc *KeepClient) discoverServices() error {
 		return nil
 	}
 
+	if kc.Arvados.KeepServiceSRV != "" {
+		return kc.discoverServicesSRV()
+	}
+
 	if kc.Arvados.Cluster != nil && os.Getenv("ARVADOS_USE_KEEP_ACCESSIBLE_API") == "" {
 		kc.disableDiscovery = true
 		roots := make(map[string]string)
@@ -179,17 +205,38 @@ func (kc *KeepClient) discoverServices() error {
 		return fmt.Errorf("Arvados client is not configured (target API host is not set). Maybe env var ARVADOS_API_HOST should be set first?")
 	}
 
+	bypass, err := kc.proxyBypassMode()
+	if err != nil {
+		return err
+	}
+	arv := *kc.Arvados
+	return kc.loadCachedServices(kc.svcListCacheKey(), func() cachedSvcList {
+		return cachedSvcList{
+			arv: &arv,
+			fetch: func() (sl svcList, err error) {
+				err = arv.Call("GET", "keep_services", "", "accessible", nil, &sl)
+				if err != nil {
+					return
+				}
+				return bypassProxy(&arv, bypass, sl), nil
+			},
+		}
+	})
+}
+
+// loadCachedServices loads the latest services list from the
+// discovery cache entry with the given key, using newEnt to create
+// and start polling a new entry if needed.
+func (kc *KeepClient) loadCachedServices(key string, newEnt func() cachedSvcList) error {
 	svcListCacheMtx.Lock()
-	cacheEnt, ok := svcListCache[kc.Arvados.ApiServer]
+	cacheEnt, ok := svcListCache[key]
 	if !ok {
-		arv := *kc.Arvados
-		cacheEnt = cachedSvcList{
-			latest: make(chan svcList),
-			clear:  make(chan struct{}),
-			arv:    &arv,
-		}
+		cacheEnt = newEnt()
+		cacheEnt.latest = make(chan svcList)
+		cacheEnt.clear = make(chan struct{})
+		cacheEnt.purge = make(chan string)
 		go cacheEnt.poll()
-		svcListCache[kc.Arvados.ApiServer] = cacheEnt
+		svcListCache[key] = cacheEnt
 	}
 	svcListCacheMtx.Unlock()
 
@@ -201,9 +248,22 @@ func (kc *KeepClient) discoverServices() error {
 	}
 }
 
+// svcListCacheKey returns the discovery cache key used by kc.
+func (kc *KeepClient) svcListCacheKey() string {
+	if kc.Arvados.KeepServiceSRV != "" {
+		return srvCacheKeyPrefix + kc.Arvados.KeepServiceSRV
+	}
+	if mode, err := kc.proxyBypassMode(); err == nil && mode != ProxyBypassNever {
+		// Clients that bypass the proxy get a different
+		// services list than clients that don't.
+		return kc.Arvados.ApiServer + " bypass=" + mode
+	}
+	return kc.Arvados.ApiServer
+}
+
 func (kc *KeepClient) RefreshServiceDiscovery() {
 	svcListCacheMtx.Lock()
-	ent, ok := svcListCache[kc.Arvados.ApiServer]
+	ent, ok := svcListCache[kc.svcListCacheKey()]
 	svcListCacheMtx.Unlock()
 	if !ok || kc.Arvados.KeepServiceURIs != nil || kc.disableDiscovery {
 		return
@@ -235,11 +295,7 @@ func (kc *KeepClient) loadKeepServers(list svcList) error {
 	kc.replicasPerService = 1
 
 	for _, service := range list.Items {
-		scheme := "http"
-		if service.SSL {
-			scheme = "https"
-		}
-		url := fmt.Sprintf("%s://%s:%d", scheme, service.Hostname, service.Port)
+		url := service.url()
 
 		// Skip duplicates
 		if listed[url] {
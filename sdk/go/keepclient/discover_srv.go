@@ -0,0 +1,87 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const srvCacheKeyPrefix = "srv:"
+
+// How often to re-resolve SRV records. The Go resolver does not
+// expose record TTLs, so this stands in for a typical SRV TTL.
+var srvRefreshInterval = time.Minute
+
+// lookupSRV is net.DefaultResolver.LookupSRV, except in tests.
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// discoverServicesSRV gets the list of available keep services
+// from the DNS SRV records named by kc.Arvados.KeepServiceSRV.
+//
+// The result is cached and refreshed periodically, and shared by
+// other KeepClients that use the same SRV name, as with services
+// discovered via the API server.
+func (kc *KeepClient) discoverServicesSRV() error {
+	scheme, name := parseSRVName(kc.Arvados.KeepServiceSRV)
+	arv := *kc.Arvados
+	return kc.loadCachedServices(srvCacheKeyPrefix+kc.Arvados.KeepServiceSRV, func() cachedSvcList {
+		return cachedSvcList{
+			arv:     &arv,
+			okDelay: srvRefreshInterval,
+			fetch: func() (svcList, error) {
+				return fetchSRVServices(scheme, name)
+			},
+		}
+	})
+}
+
+// parseSRVName splits an optional "http://" or "https://" prefix
+// from an SRV record name.
+func parseSRVName(s string) (scheme, name string) {
+	if strings.HasPrefix(s, "http://") {
+		return "http", strings.TrimPrefix(s, "http://")
+	}
+	return "https", strings.TrimPrefix(s, "https://")
+}
+
+// fetchSRVServices resolves the given SRV record name and returns
+// the targets with the best (lowest) priority as a services list.
+//
+// Services found this way are assumed to be proxies, and are
+// assigned a UUID derived from the target host and port, so the
+// rendezvous order of a given set of targets is stable.
+func fetchSRVServices(scheme, name string) (svcList, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, addrs, err := lookupSRV(ctx, "", "", name)
+	if err != nil {
+		return svcList{}, fmt.Errorf("SRV lookup %s: %w", name, err)
+	}
+	var sl svcList
+	for _, addr := range addrs {
+		if addr.Priority != addrs[0].Priority {
+			// addrs is sorted by priority, so the
+			// remaining records are backups.
+			break
+		}
+		host := strings.TrimSuffix(addr.Target, ".")
+		sl.Items = append(sl.Items, keepService{
+			Uuid:     fmt.Sprintf("00000-bi6l4-%x", md5.Sum([]byte(fmt.Sprintf("%s:%d", host, addr.Port))))[:27],
+			Hostname: host,
+			Port:     int(addr.Port),
+			SSL:      scheme == "https",
+			SvcType:  "proxy",
+		})
+	}
+	if len(sl.Items) == 0 {
+		return sl, fmt.Errorf("SRV lookup %s: no records found", name)
+	}
+	return sl, nil
+}
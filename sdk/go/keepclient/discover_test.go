@@ -6,10 +6,18 @@ package keepclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -148,3 +156,186 @@ Clusters:
 		fmt.Sprintf("zzzzz-bi6l4-%x", md5.Sum([]byte("http://0.0.0.0:54321/")))[:27]: "http://0.0.0.0:54321",
 	})
 }
+
+func (s *StandaloneSuite) TestDiscoverSRV(c *check.C) {
+	defer func(orig func(context.Context, string, string, string) (string, []*net.SRV, error)) {
+		lookupSRV = orig
+	}(lookupSRV)
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		c.Check(name, check.Equals, "_keepproxy._tcp.example.test")
+		return name, []*net.SRV{
+			{Target: "keep0.example.test.", Port: 25107, Priority: 10},
+			{Target: "keep1.example.test.", Port: 25107, Priority: 10},
+			{Target: "backup.example.test.", Port: 25107, Priority: 20},
+		}, nil
+	}
+
+	sl, err := fetchSRVServices(parseSRVName("http://_keepproxy._tcp.example.test"))
+	c.Assert(err, check.IsNil)
+	c.Check(sl.Items, check.HasLen, 2)
+
+	arv := &arvadosclient.ArvadosClient{KeepServiceSRV: "http://_keepproxy._tcp.example.test"}
+	kc := &KeepClient{Arvados: arv}
+	// See TestPurgeStaleRoot.
+	defer func() {
+		svcListCacheMtx.Lock()
+		delete(svcListCache, kc.svcListCacheKey())
+		svcListCacheMtx.Unlock()
+	}()
+	err = kc.discoverServices()
+	c.Assert(err, check.IsNil)
+	var urls []string
+	for _, url := range kc.LocalRoots() {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	c.Check(urls, check.DeepEquals, []string{"http://keep0.example.test:25107", "http://keep1.example.test:25107"})
+	c.Check(kc.foundNonDiskSvc, check.Equals, true)
+	for uuid := range kc.LocalRoots() {
+		c.Check(uuid, check.Matches, `00000-bi6l4-[0-9a-f]{15}`)
+	}
+
+	scheme, name := parseSRVName("_keepproxy._tcp.example.test")
+	c.Check(scheme, check.Equals, "https")
+	c.Check(name, check.Equals, "_keepproxy._tcp.example.test")
+}
+
+func (s *StandaloneSuite) TestPurgeStaleRoot(c *check.C) {
+	defer func(orig func(context.Context, string, string, string) (string, []*net.SRV, error)) {
+		lookupSRV = orig
+	}(lookupSRV)
+
+	live := httptest.NewServer(http.NotFoundHandler())
+	defer live.Close()
+	livePort := live.Listener.Addr().(*net.TCPAddr).Port
+	// A port with nothing listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	deadPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	var mtx sync.Mutex
+	lookups := 0
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		lookups++
+		srvs := []*net.SRV{{Target: "127.0.0.1.", Port: uint16(livePort), Priority: 10}}
+		if lookups == 1 {
+			srvs = append(srvs, &net.SRV{Target: "127.0.0.1.", Port: uint16(deadPort), Priority: 10})
+		}
+		return name, srvs, nil
+	}
+
+	arv := &arvadosclient.ArvadosClient{KeepServiceSRV: "http://_keepproxy._tcp.stale-root.example.test"}
+	kc := &KeepClient{Arvados: arv}
+	// Once lookupSRV is restored, this cache entry's fetches
+	// fail forever, so RefreshServiceDiscovery (in SetUpTest)
+	// would wait for it indefinitely.
+	defer func() {
+		svcListCacheMtx.Lock()
+		delete(svcListCache, kc.svcListCacheKey())
+		svcListCacheMtx.Unlock()
+	}()
+	c.Assert(kc.discoverServices(), check.IsNil)
+	c.Check(kc.LocalRoots(), check.HasLen, 2)
+
+	data := []byte(fmt.Sprintf("TestPurgeStaleRoot %d", time.Now().UnixNano()))
+	locator := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+	// Each Get fails on both servers (404 and connection
+	// refused). The unreachable server is dropped after
+	// staleRootThreshold attempts.
+	for i := 0; i < staleRootThreshold; i++ {
+		_, _, _, err = kc.Get(locator)
+		c.Check(err, check.NotNil)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(kc.LocalRoots()) != 1 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(kc.LocalRoots(), check.HasLen, 1)
+	for _, root := range kc.LocalRoots() {
+		c.Check(root, check.Equals, fmt.Sprintf("http://127.0.0.1:%d", livePort))
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		mtx.Lock()
+		n := lookups
+		mtx.Unlock()
+		if n > 1 {
+			break
+		}
+	}
+	mtx.Lock()
+	c.Check(lookups > 1, check.Equals, true)
+	mtx.Unlock()
+}
+
+func (s *StandaloneSuite) TestIsDialError(c *check.C) {
+	c.Check(isDialError(nil), check.Equals, false)
+	c.Check(isDialError(&net.DNSError{Err: "no such host", Name: "keep0.example"}), check.Equals, true)
+	c.Check(isDialError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}), check.Equals, true)
+	c.Check(isDialError(&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}), check.Equals, false)
+	c.Check(isDialError(fmt.Errorf("Get: %w", context.Canceled)), check.Equals, false)
+}
+
+func (s *StandaloneSuite) TestProxyBypass(c *check.C) {
+	live := httptest.NewServer(http.NotFoundHandler())
+	defer live.Close()
+	liveAddr := live.Listener.Addr().(*net.TCPAddr)
+	// A port with nothing listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	deadPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	proxy := keepService{Uuid: "zzzzz-bi6l4-proxyproxyproxy", Hostname: "keep.example.test", Port: 443, SSL: true, SvcType: "proxy"}
+	liveDisk := keepService{Uuid: "zzzzz-bi6l4-000000000000001", Hostname: "127.0.0.1", Port: liveAddr.Port, SvcType: "disk"}
+	deadDisk := keepService{Uuid: "zzzzz-bi6l4-000000000000002", Hostname: "127.0.0.1", Port: deadPort, SvcType: "disk"}
+
+	for _, trial := range []struct {
+		bypass string
+		disks  []keepService
+		expect []keepService
+	}{
+		{"", []keepService{liveDisk}, []keepService{proxy}},
+		{"never", []keepService{liveDisk}, []keepService{proxy}},
+		{"always", []keepService{liveDisk, deadDisk}, []keepService{liveDisk, deadDisk}},
+		{"always", nil, []keepService{proxy}},
+		{"auto", []keepService{liveDisk}, []keepService{liveDisk}},
+		{"auto", []keepService{liveDisk, deadDisk}, []keepService{proxy}},
+	} {
+		comment := check.Commentf("bypass %q, disks %v", trial.bypass, trial.disks)
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/arvados/v1/keep_services/accessible":
+				json.NewEncoder(w).Encode(svcList{Items: []keepService{proxy}})
+			case "/arvados/v1/keep_services":
+				c.Check(req.FormValue("filters"), check.Equals, `[["service_type","=","disk"]]`)
+				json.NewEncoder(w).Encode(svcList{Items: trial.disks})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		arv := &arvadosclient.ArvadosClient{
+			Scheme:          "http",
+			ApiServer:       api.Listener.Addr().String(),
+			ApiToken:        "abc123",
+			Client:          http.DefaultClient,
+			KeepProxyBypass: trial.bypass,
+		}
+		kc := &KeepClient{Arvados: arv}
+		c.Check(kc.discoverServices(), check.IsNil, comment)
+		expect := map[string]string{}
+		for _, svc := range trial.expect {
+			expect[svc.Uuid] = svc.url()
+		}
+		c.Check(kc.LocalRoots(), check.DeepEquals, expect, comment)
+		c.Check(kc.foundNonDiskSvc, check.Equals, trial.expect[0].SvcType == "proxy", comment)
+		api.Close()
+		svcListCacheMtx.Lock()
+		delete(svcListCache, kc.svcListCacheKey())
+		svcListCacheMtx.Unlock()
+	}
+
+	kc := &KeepClient{Arvados: &arvadosclient.ArvadosClient{ApiServer: "zzzzz.example.test", KeepProxyBypass: "sometimes"}}
+	c.Check(kc.discoverServices(), check.ErrorMatches, `invalid KeepProxyBypass value "sometimes".*`)
+}
@@ -0,0 +1,147 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrEgressQuotaExceeded is returned (possibly wrapped) when a block
+// cannot be read because the daily EgressQuota for every server that
+// has it has been used up.
+var ErrEgressQuotaExceeded = errors.New("daily egress quota exceeded")
+
+// EgressQuota limits the number of bytes a KeepClient (and its
+// clones) reads from each destination per day, where a destination
+// is a remote cluster ID for blocks with a remote hint (+R), or
+// otherwise the URL of the Keep service (e.g., a keepproxy) that
+// serves the block.
+//
+// Usage is counted in bytes received on the wire, and resets at
+// midnight UTC. A read already in progress when the limit is reached
+// is allowed to finish, so the limit can be exceeded by up to one
+// block per concurrent read.
+//
+// The zero value imposes no limits but still counts bytes, which can
+// be inspected with Used.
+type EgressQuota struct {
+	// Maximum bytes per destination per day. Zero means no
+	// limit.
+	DailyLimit int64
+
+	// Per-destination limits that override DailyLimit.
+	Limits map[string]int64
+
+	// Fractions of the limit (e.g., 0.5, 0.9, 1.0) at which
+	// OnThreshold is called. Each threshold is reported at most
+	// once per destination per day.
+	Thresholds []float64
+
+	// If not nil, called (in its own goroutine) when a
+	// destination's usage crosses one of the Thresholds.
+	OnThreshold func(dest string, used, limit int64, threshold float64)
+
+	mtx     sync.Mutex
+	day     string
+	used    map[string]int64
+	crossed map[string]int // dest => number of Thresholds crossed
+	now     func() time.Time
+}
+
+// Used returns the number of bytes read from the given destination
+// so far today.
+func (eq *EgressQuota) Used(dest string) int64 {
+	eq.mtx.Lock()
+	defer eq.mtx.Unlock()
+	eq.rollover()
+	return eq.used[dest]
+}
+
+func (eq *EgressQuota) limit(dest string) int64 {
+	if n, ok := eq.Limits[dest]; ok {
+		return n
+	}
+	return eq.DailyLimit
+}
+
+// rollover resets the counters if the day has changed. Caller must
+// have eq.mtx locked.
+func (eq *EgressQuota) rollover() {
+	now := time.Now
+	if eq.now != nil {
+		now = eq.now
+	}
+	day := now().UTC().Format("2006-01-02")
+	if day != eq.day || eq.used == nil {
+		eq.day = day
+		eq.used = map[string]int64{}
+		eq.crossed = map[string]int{}
+	}
+}
+
+// allow returns ErrEgressQuotaExceeded if the given destination's
+// quota is used up.
+func (eq *EgressQuota) allow(dest string) error {
+	eq.mtx.Lock()
+	defer eq.mtx.Unlock()
+	eq.rollover()
+	if limit := eq.limit(dest); limit > 0 && eq.used[dest] >= limit {
+		return ErrEgressQuotaExceeded
+	}
+	return nil
+}
+
+// add records n bytes read from the given destination, and calls
+// OnThreshold for any thresholds crossed.
+func (eq *EgressQuota) add(dest string, n int64) {
+	if n <= 0 {
+		return
+	}
+	eq.mtx.Lock()
+	defer eq.mtx.Unlock()
+	eq.rollover()
+	eq.used[dest] += n
+	limit := eq.limit(dest)
+	if limit <= 0 || eq.OnThreshold == nil {
+		return
+	}
+	thresholds := append([]float64(nil), eq.Thresholds...)
+	sort.Float64s(thresholds)
+	used := eq.used[dest]
+	for i := eq.crossed[dest]; i < len(thresholds) && float64(used) >= thresholds[i]*float64(limit); i++ {
+		eq.crossed[dest] = i + 1
+		go eq.OnThreshold(dest, used, limit, thresholds[i])
+	}
+}
+
+var remoteHintRe = regexp.MustCompile(`\+R([0-9a-z]{5})`)
+
+// egressDestination returns the destination that a read of the
+// given locator from the given service root counts against.
+func egressDestination(root, locator string) string {
+	if m := remoteHintRe.FindStringSubmatch(locator); m != nil {
+		return m[1]
+	}
+	return root
+}
+
+// egressCountingReader counts bytes read from a response body
+// against an EgressQuota.
+type egressCountingReader struct {
+	io.ReadCloser
+	eq   *EgressQuota
+	dest string
+}
+
+func (ecr egressCountingReader) Read(p []byte) (int, error) {
+	n, err := ecr.ReadCloser.Read(p)
+	ecr.eq.add(ecr.dest, int64(n))
+	return n, err
+}
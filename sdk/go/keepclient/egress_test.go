@@ -0,0 +1,101 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+type egressGetHandler struct {
+	data []byte
+}
+
+func (h egressGetHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Length", fmt.Sprintf("%d", len(h.data)))
+	resp.Write(h.data)
+}
+
+func (s *StandaloneSuite) TestEgressQuota(c *C) {
+	data := bytes.Repeat([]byte("x"), 1000)
+	locator := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+	ks := RunFakeKeepServer(egressGetHandler{data})
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	kc.DiskCacheSize = DiskCacheDisabled
+	kc.DisableCompression = true
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var mtx sync.Mutex
+	var crossed []string
+	notified := make(chan struct{}, 10)
+	kc.EgressQuota = &EgressQuota{
+		DailyLimit: 2500,
+		Thresholds: []float64{1, 0.5},
+		OnThreshold: func(dest string, used, limit int64, threshold float64) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			c.Check(float64(used) >= threshold*float64(limit), Equals, true)
+			crossed = append(crossed, fmt.Sprintf("%s %d %v", dest, limit, threshold))
+			notified <- struct{}{}
+		},
+		now: func() time.Time { return now },
+	}
+
+	get := func(kc *KeepClient, locator string) error {
+		r, _, _, err := kc.Get(locator)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = ioutil.ReadAll(r)
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		c.Check(get(kc, locator), IsNil)
+	}
+	c.Check(kc.EgressQuota.Used(ks.url), Equals, int64(3000))
+	<-notified
+	<-notified
+	mtx.Lock()
+	sort.Strings(crossed)
+	c.Check(crossed, DeepEquals, []string{
+		ks.url + " 2500 0.5",
+		ks.url + " 2500 1",
+	})
+	mtx.Unlock()
+
+	// Quota is shared by clones.
+	err = get(kc.Clone(), locator)
+	c.Check(errors.Is(err, ErrEgressQuotaExceeded), Equals, true, Commentf("%v", err))
+
+	// Remote blocks count against the remote cluster.
+	remote := locator + "+Rzzzzz-abcdef0123456789abcdef0123456789abcdef01@12345678"
+	c.Check(get(kc, remote), IsNil)
+	c.Check(kc.EgressQuota.Used("zzzzz"), Equals, int64(1000))
+	kc.EgressQuota.Limits = map[string]int64{"zzzzz": 500}
+	err = get(kc, remote)
+	c.Check(errors.Is(err, ErrEgressQuotaExceeded), Equals, true, Commentf("%v", err))
+
+	// Usage resets the next day.
+	now = now.Add(24 * time.Hour)
+	c.Check(get(kc, locator), IsNil)
+	c.Check(kc.EgressQuota.Used(ks.url), Equals, int64(1000))
+	c.Check(kc.EgressQuota.Used("zzzzz"), Equals, int64(0))
+}
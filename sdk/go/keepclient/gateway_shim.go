@@ -28,7 +28,7 @@ type keepViaHTTP struct {
 }
 
 func (kvh *keepViaHTTP) ReadAt(locator string, dst []byte, offset int) (int, error) {
-	rdr, _, _, _, err := kvh.getOrHead("GET", locator, nil)
+	rdr, _, _, _, err := kvh.getOrHead(context.Background(), "GET", locator, nil)
 	if err != nil {
 		return 0, err
 	}
@@ -41,11 +41,30 @@ func (kvh *keepViaHTTP) ReadAt(locator string, dst []byte, offset int) (int, err
 	return int(n), err
 }
 
+// BlockRead copies a block to opts.WriteTo. If opts.LocalLocator is
+// not nil, the Keep service is asked to sign the locator with a
+// local signature (see LocalLocator), and opts.LocalLocator is called
+// with the result before any data is written.
 func (kvh *keepViaHTTP) BlockRead(ctx context.Context, opts arvados.BlockReadOptions) (int, error) {
-	rdr, _, _, _, err := kvh.getOrHead("GET", opts.Locator, nil)
+	var header http.Header
+	if opts.LocalLocator != nil {
+		header = http.Header{XKeepSignature: []string{localSignatureHeader(opts.SignatureTTL)}}
+	}
+	rdr, _, url, hdr, err := kvh.getOrHead(ctx, "GET", opts.Locator, header)
 	if err != nil {
 		return 0, err
 	}
+	if opts.LocalLocator != nil {
+		loc := hdr.Get(XKeepLocator)
+		if hdr == nil {
+			// Empty block, not fetched from a server.
+			loc = opts.Locator
+		} else if loc == "" {
+			rdr.Close()
+			return 0, fmt.Errorf("missing X-Keep-Locator header in GET response from %s", url)
+		}
+		opts.LocalLocator(loc)
+	}
 	n, err := io.Copy(opts.WriteTo, rdr)
 	errClose := rdr.Close()
 	if err == nil {
@@ -65,14 +84,37 @@ func (kvh *keepViaHTTP) LocalLocator(locator string) (string, error) {
 		// disabled.
 		return locator, nil
 	}
-	sighdr := fmt.Sprintf("local, time=%s", time.Now().UTC().Format(time.RFC3339))
-	_, _, url, hdr, err := kvh.KeepClient.getOrHead("HEAD", locator, http.Header{"X-Keep-Signature": []string{sighdr}})
+	_, _, url, hdr, err := kvh.KeepClient.getOrHead(context.Background(), "HEAD", locator, http.Header{XKeepSignature: []string{localSignatureHeader(0)}})
 	if err != nil {
 		return "", err
 	}
-	loc := hdr.Get("X-Keep-Locator")
+	loc := hdr.Get(XKeepLocator)
 	if loc == "" {
 		return "", fmt.Errorf("missing X-Keep-Locator header in HEAD response from %s", url)
 	}
 	return loc, nil
 }
+
+// localSignatureHeader returns an X-Keep-Signature header value
+// requesting a locally signed locator in the X-Keep-Locator response
+// header. If ttl is non-zero, the signature expires after ttl
+// instead of the server's default BlobSigningTTL.
+func localSignatureHeader(ttl time.Duration) string {
+	hdr := fmt.Sprintf("local, time=%s", time.Now().UTC().Format(time.RFC3339))
+	if ttl > 0 {
+		hdr += fmt.Sprintf(", ttl=%d", int64(ttl.Seconds()))
+	}
+	return hdr
+}
+
+// writeSignatureHeader returns an X-Keep-Signature header value
+// requesting an unsigned locator, or a signature that expires after
+// ttl, in a PUT response. It returns "" if neither is requested.
+func writeSignatureHeader(unsigned bool, ttl time.Duration) string {
+	if unsigned {
+		return "none"
+	} else if ttl > 0 {
+		return fmt.Sprintf("ttl=%d", int64(ttl.Seconds()))
+	}
+	return ""
+}
@@ -102,8 +102,48 @@ const (
 	XKeepStorageClassesConfirmed = "X-Keep-Storage-Classes-Confirmed"
 	XKeepSignature               = "X-Keep-Signature"
 	XKeepLocator                 = "X-Keep-Locator"
+	XKeepPriority                = "X-Keep-Priority"
 )
 
+// Values for the X-Keep-Priority header (see KeepClient.Priority).
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// A WriteStrategy determines how many uploads BlockWrite runs
+// concurrently when writing the replicas of a block (see
+// KeepClient.WriteStrategy).
+type WriteStrategy string
+
+const (
+	// Start as many uploads as are needed to write the remaining
+	// replicas, assuming each server stores as many replicas as
+	// its service type suggests. When that is unknown (e.g., a
+	// proxy or a non-disk service), write to one server at a
+	// time.
+	WriteStrategyDefault WriteStrategy = ""
+	// Write to one server at a time.
+	WriteStrategySequential WriteStrategy = "sequential"
+	// Write to as many servers at once as there are replicas
+	// remaining to write.
+	WriteStrategyParallel WriteStrategy = "parallel"
+	// Start by writing to one server, and add another whenever
+	// AdaptiveWriteDelay passes without any upload finishing, up
+	// to the number of replicas remaining to write.
+	WriteStrategyAdaptive WriteStrategy = "adaptive"
+)
+
+// DefaultAdaptiveWriteDelay is the default for
+// KeepClient.AdaptiveWriteDelay.
+var DefaultAdaptiveWriteDelay = time.Second
+
+// A TokenProvider returns the API token to send with a request to a
+// Keep service. It is called for each request, so implementations
+// that obtain tokens from an external source should cache them until
+// they are about to expire.
+type TokenProvider func(ctx context.Context) (string, error)
+
 type HTTPClient interface {
 	Do(*http.Request) (*http.Response, error)
 }
@@ -135,6 +175,54 @@ type KeepClient struct {
 	StorageClasses        []string
 	DefaultStorageClasses []string                  // Set by cluster's exported config
 	DiskCacheSize         arvados.ByteSizeOrPercent // See also DiskCacheDisabled
+	DiskCacheMinFreeSpace arvados.ByteSizeOrPercent // See arvados.DiskCache
+	DiskCacheReadOnlyDirs []string                  // See arvados.DiskCache.ReadOnlyDirs
+
+	// Scheduling class sent to Keep services with each block
+	// request (PriorityInteractive or PriorityBatch). If empty,
+	// no priority header is sent, and servers assume
+	// interactive.
+	Priority string
+
+	// If non-nil, TokenProvider is called to get the token for
+	// each request, instead of using Arvados.ApiToken. This lets
+	// long-running clients switch to a refreshed token without
+	// creating a new KeepClient.
+	TokenProvider TokenProvider
+
+	// If non-zero, blocks at least this many bytes long are read
+	// by fetching the first and second halves from two different
+	// servers concurrently. The assembled block is checked
+	// against its hash; if either request fails, the block is
+	// read from one server at a time as usual. Servers must
+	// support Range requests.
+	//
+	// Keepstore reads only the requested range from S3 and
+	// directory-backed volumes. Other volume types read the
+	// whole block to serve each range, so on those this doubles
+	// the backend read traffic for affected blocks. The default
+	// (zero) disables parallel reads.
+	ParallelGetMinSize int64
+
+	// How many uploads to run concurrently when writing the
+	// replicas of a block. Higher concurrency finishes sooner
+	// when servers are slow, at the risk of writing more
+	// replicas than needed when some servers store more than
+	// one.
+	WriteStrategy WriteStrategy
+
+	// With WriteStrategyAdaptive, how long to wait for an upload
+	// to finish before starting another one. If zero,
+	// DefaultAdaptiveWriteDelay is used.
+	AdaptiveWriteDelay time.Duration
+
+	// If non-nil, ReadServices and WriteServices override the
+	// services, retries, and timeouts used to read and write
+	// blocks, respectively. Otherwise, reads use LocalRoots,
+	// writes use WritableLocalRoots, and both use Retries and
+	// RetryDelay.
+	ReadServices  *ServiceSet
+	WriteServices *ServiceSet
 
 	// set to 1 if all writable services are of disk type, otherwise 0
 	replicasPerService int
@@ -145,6 +233,35 @@ type KeepClient struct {
 	// Disable automatic discovery of keep services
 	disableDiscovery bool
 
+	// Don't ask servers (typically keepproxy) to compress
+	// block data in responses. This saves CPU time at the
+	// expense of transferring more bytes.
+	DisableCompression bool
+
+	// Bytes saved by compressed responses (see
+	// CompressionBytesSaved)
+	compressionBytesSaved int64
+
+	// Maximum total size of in-memory buffers used by concurrent
+	// uploads of streamed blocks (BlockWrite with a Reader). When
+	// an upload would exceed this budget, its data is spooled to
+	// a temporary file in SpoolDir instead. Zero means no limit
+	// (never spool).
+	SpoolMemoryBudget int64
+
+	// Directory for spool files. If empty, the "tmp" directory
+	// inside the disk cache directory is used.
+	SpoolDir string
+
+	// Total size of in-memory upload buffers currently reserved
+	// against SpoolMemoryBudget.
+	bufferMemoryInUse int64
+
+	// If not nil, limits the number of bytes read per day from
+	// each remote cluster or Keep service. Clones share the same
+	// EgressQuota.
+	EgressQuota *EgressQuota
+
 	gatewayStack arvados.KeepGateway
 }
 
@@ -164,9 +281,22 @@ func (kc *KeepClient) Clone() *KeepClient {
 		StorageClasses:        kc.StorageClasses,
 		DefaultStorageClasses: kc.DefaultStorageClasses,
 		DiskCacheSize:         kc.DiskCacheSize,
+		DiskCacheMinFreeSpace: kc.DiskCacheMinFreeSpace,
+		DiskCacheReadOnlyDirs: kc.DiskCacheReadOnlyDirs,
+		Priority:              kc.Priority,
+		TokenProvider:         kc.TokenProvider,
+		ParallelGetMinSize:    kc.ParallelGetMinSize,
+		WriteStrategy:         kc.WriteStrategy,
+		AdaptiveWriteDelay:    kc.AdaptiveWriteDelay,
+		ReadServices:          kc.ReadServices,
+		WriteServices:         kc.WriteServices,
 		replicasPerService:    kc.replicasPerService,
 		foundNonDiskSvc:       kc.foundNonDiskSvc,
 		disableDiscovery:      kc.disableDiscovery,
+		DisableCompression:    kc.DisableCompression,
+		SpoolMemoryBudget:     kc.SpoolMemoryBudget,
+		SpoolDir:              kc.SpoolDir,
+		EgressQuota:           kc.EgressQuota,
 	}
 }
 
@@ -270,7 +400,41 @@ func (kc *KeepClient) PutR(r io.Reader) (locator string, replicas int, err error
 	return kc.PutB(buffer)
 }
 
-func (kc *KeepClient) getOrHead(method string, locator string, header http.Header) (io.ReadCloser, int64, string, http.Header, error) {
+// setBlockRequestHeaders copies the given header to req, and adds
+// the Authorization, X-Request-Id, and X-Keep-Priority headers if
+// they are not already present.
+func (kc *KeepClient) setBlockRequestHeaders(req *http.Request, header http.Header, reqid string) error {
+	for k, v := range header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	if req.Header.Get("Authorization") == "" {
+		token, err := kc.apiToken(req.Context())
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if req.Header.Get("X-Request-Id") == "" {
+		req.Header.Set("X-Request-Id", reqid)
+	}
+	if kc.Priority != "" && req.Header.Get(XKeepPriority) == "" {
+		req.Header.Set(XKeepPriority, kc.Priority)
+	}
+	return nil
+}
+
+func (kc *KeepClient) getOrHead(ctx context.Context, method string, locator string, header http.Header) (io.ReadCloser, int64, string, http.Header, error) {
+	return kc.getOrHeadInto(ctx, method, locator, header, nil)
+}
+
+// prefilledReader is returned by getOrHeadInto when the block data
+// has already been written to the caller-provided buffer.
+type prefilledReader struct{ io.ReadCloser }
+
+// getOrHeadInto is like getOrHead, but if dst is not nil, a parallel
+// GET (see ParallelGetMinSize) writes the data directly into dst
+// instead of a new buffer, and returns a prefilledReader.
+func (kc *KeepClient) getOrHeadInto(ctx context.Context, method string, locator string, header http.Header, dst []byte) (io.ReadCloser, int64, string, http.Header, error) {
 	if strings.HasPrefix(locator, "d41d8cd98f00b204e9800998ecf8427e+0") {
 		return ioutil.NopCloser(bytes.NewReader(nil)), 0, "", nil, nil
 	}
@@ -288,16 +452,49 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 
 	var errs []string
 
-	delay := delayCalculator{InitialMaxDelay: kc.RetryDelay}
-	triesRemaining := 1 + kc.Retries
+	ss := kc.readServices()
+	delay := delayCalculator{InitialMaxDelay: ss.RetryDelay}
+	triesRemaining := 1 + ss.Retries
 
-	serversToTry := kc.getSortedRoots(locator)
+	serversToTry := kc.getSortedRoots(locator, ss.Roots)
+
+	if method == "GET" && kc.EgressQuota != nil {
+		var allowed []string
+		for _, host := range serversToTry {
+			if err := kc.EgressQuota.allow(egressDestination(host, locator)); err != nil {
+				errs = append(errs, fmt.Sprintf("%s/%s: %v", host, locator, err))
+			} else {
+				allowed = append(allowed, host)
+			}
+		}
+		if len(allowed) == 0 && len(serversToTry) > 0 {
+			return nil, 0, "", nil, fmt.Errorf("GET %s failed: %w: %v", locator, ErrEgressQuotaExceeded, errs)
+		}
+		serversToTry = allowed
+	}
 
 	numServers := len(serversToTry)
 	count404 := 0
 
 	var retryList []string
 
+	if method == "GET" && kc.ParallelGetMinSize > 0 && expectLength >= kc.ParallelGetMinSize && numServers >= 2 {
+		prefill := int64(len(dst)) == expectLength
+		buf := dst
+		if !prefill {
+			buf = make([]byte, expectLength)
+		}
+		url, respHeader, err := kc.getParallelRanges(ctx, locator, buf, serversToTry[:2], header, reqid, ss.Timeout)
+		if err == nil && prefill {
+			return prefilledReader{http.NoBody}, expectLength, url, respHeader, nil
+		} else if err == nil {
+			return ioutil.NopCloser(bytes.NewReader(buf)), expectLength, url, respHeader, nil
+		}
+		// Fall back to reading the whole block from one
+		// server at a time.
+		errs = append(errs, err.Error())
+	}
+
 	for triesRemaining > 0 {
 		triesRemaining--
 		retryList = nil
@@ -305,28 +502,32 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 		for _, host := range serversToTry {
 			url := host + "/" + locator
 
-			req, err := http.NewRequest(method, url, nil)
+			reqctx, cancel := ss.requestContext(ctx)
+			req, err := http.NewRequestWithContext(reqctx, method, url, nil)
 			if err != nil {
+				cancel()
 				errs = append(errs, fmt.Sprintf("%s: %v", url, err))
 				continue
 			}
-			for k, v := range header {
-				req.Header[k] = append([]string(nil), v...)
-			}
-			if req.Header.Get("Authorization") == "" {
-				req.Header.Set("Authorization", "Bearer "+kc.Arvados.ApiToken)
-			}
-			if req.Header.Get("X-Request-Id") == "" {
-				req.Header.Set("X-Request-Id", reqid)
+			err = kc.setBlockRequestHeaders(req, header, reqid)
+			if err != nil {
+				cancel()
+				return nil, 0, "", nil, err
 			}
+			kc.setAcceptEncoding(req)
 			resp, err := kc.httpClient().Do(req)
+			kc.noteRequestResult(host, err)
 			if err != nil {
+				cancel()
 				// Probably a network error, may be transient,
 				// can try again.
 				errs = append(errs, fmt.Sprintf("%s: %v", url, err))
 				retryList = append(retryList, host)
 				continue
 			}
+			// From here on, closing resp.Body releases the
+			// request context.
+			resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
 			if resp.StatusCode != http.StatusOK {
 				var respbody []byte
 				respbody, _ = ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 4096})
@@ -346,6 +547,11 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 				}
 				continue
 			}
+			if enc := resp.Header.Get("Content-Encoding"); enc == "gzip" || enc == "zstd" {
+				// Content-Length (if any) is the
+				// compressed size, not the block size.
+				resp.ContentLength = -1
+			}
 			if expectLength < 0 {
 				if resp.ContentLength < 0 {
 					resp.Body.Close()
@@ -358,8 +564,16 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 			}
 			// Success
 			if method == "GET" {
+				if kc.EgressQuota != nil {
+					resp.Body = egressCountingReader{ReadCloser: resp.Body, eq: kc.EgressQuota, dest: egressDestination(host, locator)}
+				}
+				body, err := kc.decodeResponseBody(resp)
+				if err != nil {
+					resp.Body.Close()
+					return nil, 0, "", nil, fmt.Errorf("error reading %q: %w", locator, err)
+				}
 				return HashCheckingReader{
-					Reader: resp.Body,
+					Reader: body,
 					Hash:   md5.New(),
 					Check:  locator[0:32],
 				}, expectLength, url, resp.Header, nil
@@ -397,6 +611,18 @@ func makedirs(dir, subdir string) {
 	}
 }
 
+// cacheDir returns the directory used for the disk cache, creating
+// it if needed.
+func cacheDir() string {
+	if os.Geteuid() == 0 {
+		makedirs("/", rootCacheDir)
+		return rootCacheDir
+	}
+	home := "/" + os.Getenv("HOME")
+	makedirs(home, userCacheDir)
+	return filepath.Join(home, userCacheDir)
+}
+
 // upstreamGateway creates/returns the KeepGateway stack used to read
 // and write data: a disk-backed cache on top of an http backend.
 func (kc *KeepClient) upstreamGateway() arvados.KeepGateway {
@@ -405,24 +631,18 @@ func (kc *KeepClient) upstreamGateway() arvados.KeepGateway {
 	if kc.gatewayStack != nil {
 		return kc.gatewayStack
 	}
-	var cachedir string
-	if os.Geteuid() == 0 {
-		cachedir = rootCacheDir
-		makedirs("/", cachedir)
-	} else {
-		home := "/" + os.Getenv("HOME")
-		makedirs(home, userCacheDir)
-		cachedir = filepath.Join(home, userCacheDir)
-	}
+	cachedir := cacheDir()
 	backend := &keepViaHTTP{kc}
 	if kc.DiskCacheSize == DiskCacheDisabled {
 		kc.gatewayStack = backend
 	} else {
 		kc.gatewayStack = &arvados.DiskCache{
-			Dir:         cachedir,
-			MaxSize:     kc.DiskCacheSize,
-			KeepGateway: backend,
-			Logger:      kc.Arvados.Logger,
+			Dir:          cachedir,
+			MaxSize:      kc.DiskCacheSize,
+			MinFreeSpace: kc.DiskCacheMinFreeSpace,
+			ReadOnlyDirs: kc.DiskCacheReadOnlyDirs,
+			KeepGateway:  backend,
+			Logger:       kc.Arvados.Logger,
 		}
 	}
 	return kc.gatewayStack
@@ -490,6 +710,55 @@ func (kc *KeepClient) Get(locator string) (io.ReadCloser, int64, string, error)
 	}, int64(loc.Size), "", err
 }
 
+// GetInto retrieves the specified block into buf, which must be at
+// least as long as the block, and returns the block size. The
+// locator must have a size hint.
+//
+// Unlike Get, GetInto does not use a pipe, goroutine, or
+// intermediate buffer: if the whole block is in the local cache, it
+// is read directly into buf, otherwise the response body from the
+// Keep service is. Blocks fetched from the network are not added to
+// the local cache. This is intended for high-throughput callers
+// (like keepproxy and keep-web) that manage their own buffer pools.
+//
+// If the block checksum does not match, GetInto returns a
+// BadChecksum error, and the contents of buf are undefined.
+func (kc *KeepClient) GetInto(locator string, buf []byte) (int, error) {
+	loc, err := MakeLocator(locator)
+	if err != nil {
+		return 0, err
+	}
+	if loc.Size < 0 {
+		return 0, fmt.Errorf("error reading %q: GetInto requires a size hint", locator)
+	}
+	if len(buf) < loc.Size {
+		return 0, fmt.Errorf("error reading %q: %w (block size %d, buffer size %d)", locator, io.ErrShortBuffer, loc.Size, len(buf))
+	}
+	if loc.Size == 0 {
+		return 0, nil
+	}
+	dst := buf[:loc.Size]
+	if kc.DiskCacheSize != DiskCacheDisabled {
+		if rngs := kc.CachedRanges(locator); len(rngs) == 1 && rngs[0].Offset == 0 && rngs[0].Length >= loc.Size {
+			return kc.ReadAt(locator, dst, 0)
+		}
+	}
+	rdr, _, _, _, err := kc.getOrHeadInto(context.Background(), "GET", locator, nil, dst)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := rdr.(prefilledReader); ok {
+		return loc.Size, nil
+	}
+	n, err := io.ReadFull(rdr, dst)
+	// Close reads any remaining data and verifies the checksum.
+	errClose := rdr.Close()
+	if err == nil {
+		err = errClose
+	}
+	return n, err
+}
+
 // BlockRead retrieves a block from the cache if it's present, otherwise
 // from the network.
 func (kc *KeepClient) BlockRead(ctx context.Context, opts arvados.BlockReadOptions) (int, error) {
@@ -502,6 +771,31 @@ func (kc *KeepClient) ReadAt(locator string, p []byte, off int) (int, error) {
 	return kc.upstreamGateway().ReadAt(locator, p, off)
 }
 
+// ReadAtPartial is like ReadAt, but returns a short read (instead of
+// waiting for the rest of the requested range) if only part of the
+// requested range is available in the local cache while the rest of
+// the block is being fetched.
+func (kc *KeepClient) ReadAtPartial(locator string, p []byte, off int) (int, error) {
+	if pr, ok := kc.upstreamGateway().(interface {
+		ReadAtPartial(string, []byte, int) (int, error)
+	}); ok {
+		return pr.ReadAtPartial(locator, p, off)
+	}
+	return kc.ReadAt(locator, p, off)
+}
+
+// CachedRanges returns the byte ranges of the given block that are
+// available in the local cache, or nil if the cache is disabled or
+// has no data for the block.
+func (kc *KeepClient) CachedRanges(locator string) []arvados.BlockRange {
+	if cr, ok := kc.upstreamGateway().(interface {
+		CachedRanges(string) []arvados.BlockRange
+	}); ok {
+		return cr.CachedRanges(locator)
+	}
+	return nil
+}
+
 // BlockWrite writes a full block to upstream servers and saves a copy
 // in the local cache.
 func (kc *KeepClient) BlockWrite(ctx context.Context, req arvados.BlockWriteOptions) (arvados.BlockWriteResponse, error) {
@@ -516,7 +810,7 @@ func (kc *KeepClient) BlockWrite(ctx context.Context, req arvados.BlockWriteOpti
 // Returns the data size (content length) reported by the Keep service
 // and the URI reporting the data size.
 func (kc *KeepClient) Ask(locator string) (int64, string, error) {
-	_, size, url, _, err := kc.getOrHead("HEAD", locator, nil)
+	_, size, url, _, err := kc.getOrHead(context.Background(), "HEAD", locator, nil)
 	return size, url, err
 }
 
@@ -543,7 +837,11 @@ func (kc *KeepClient) GetIndex(keepServiceUUID, prefix string) (io.Reader, error
 		return nil, err
 	}
 
-	req.Header.Add("Authorization", "Bearer "+kc.Arvados.ApiToken)
+	token, err := kc.apiToken(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
 	req.Header.Set("X-Request-Id", kc.getRequestID())
 	resp, err := kc.httpClient().Do(req)
 	if err != nil {
@@ -621,8 +919,9 @@ func (kc *KeepClient) setServiceRoots(locals, writables, gateways map[string]str
 
 // getSortedRoots returns a list of base URIs of Keep services, in the
 // order they should be attempted in order to retrieve content for the
-// given locator.
-func (kc *KeepClient) getSortedRoots(locator string) []string {
+// given locator. Services indicated by hints in the locator are
+// tried first, followed by the given roots.
+func (kc *KeepClient) getSortedRoots(locator string, roots map[string]string) []string {
 	var found []string
 	for _, hint := range strings.Split(locator, "+") {
 		if len(hint) < 7 || hint[0:2] != "K@" {
@@ -642,8 +941,9 @@ func (kc *KeepClient) getSortedRoots(locator string) []string {
 			// else this hint is no use to us; carry on.
 		}
 	}
-	// After trying all usable service hints, fall back to local roots.
-	found = append(found, NewRootSorter(kc.LocalRoots(), locator[0:32]).GetSortedRoots()...)
+	// After trying all usable service hints, fall back to the
+	// given (usually local) roots.
+	found = append(found, NewRootSorter(roots, locator[0:32]).GetSortedRoots()...)
 	return found
 }
 
@@ -663,9 +963,19 @@ var (
 		// (insecure) TLS reqs
 		true: {},
 	}
+	// customClient holds the http.Client objects used with
+	// non-default proxy/TLS settings (see
+	// arvados.TransportConfig), keyed by settings and timeout
+	// behavior.
+	customClient     = map[customClientKey]HTTPClient{}
 	defaultClientMtx sync.Mutex
 )
 
+type customClientKey struct {
+	transportConfig arvados.TransportConfigKey
+	nonDiskSvc      bool
+}
+
 // httpClient returns the HTTPClient field if it's not nil, otherwise
 // whichever of the four global http.Client objects is suitable for
 // the current environment (i.e., TLS verification on/off, keep
@@ -674,9 +984,17 @@ func (kc *KeepClient) httpClient() HTTPClient {
 	if kc.HTTPClient != nil {
 		return kc.HTTPClient
 	}
+	tc := kc.Arvados.TransportConfig
+	tc.Insecure = kc.Arvados.ApiInsecure
+	custom := !tc.IsDefault()
+	customKey := customClientKey{tc.Key(), kc.foundNonDiskSvc}
 	defaultClientMtx.Lock()
 	defer defaultClientMtx.Unlock()
-	if c, ok := defaultClient[kc.Arvados.ApiInsecure][kc.foundNonDiskSvc]; ok {
+	if custom {
+		if c, ok := customClient[customKey]; ok {
+			return c
+		}
+	} else if c, ok := defaultClient[kc.Arvados.ApiInsecure][kc.foundNonDiskSvc]; ok {
 		return c
 	}
 
@@ -696,33 +1014,60 @@ func (kc *KeepClient) httpClient() HTTPClient {
 		keepAlive = DefaultKeepAlive
 	}
 
+	// It's not safe to copy *http.DefaultTransport because it
+	// has a mutex (which might be locked) protecting a private
+	// map (which might not be nil). So we build our own, using
+	// the Go 1.12 default values, ignoring any changes the
+	// application has made to http.DefaultTransport.
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: keepAlive,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   tlsTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       arvadosclient.MakeTLSConfig(kc.Arvados.ApiInsecure),
+	}
+	if custom {
+		ct, err := tc.NewTransport()
+		if err != nil {
+			// The returned client fails all requests
+			// with err.
+			return tc.HTTPClient()
+		}
+		transport.Proxy = ct.Proxy
+		transport.TLSClientConfig = ct.TLSClientConfig
+	}
 	c := &http.Client{
-		Timeout: requestTimeout,
-		// It's not safe to copy *http.DefaultTransport
-		// because it has a mutex (which might be locked)
-		// protecting a private map (which might not be nil).
-		// So we build our own, using the Go 1.12 default
-		// values, ignoring any changes the application has
-		// made to http.DefaultTransport.
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   connectTimeout,
-				KeepAlive: keepAlive,
-				DualStack: true,
-			}).DialContext,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   tlsTimeout,
-			ExpectContinueTimeout: 1 * time.Second,
-			TLSClientConfig:       arvadosclient.MakeTLSConfig(kc.Arvados.ApiInsecure),
-		},
-	}
-	defaultClient[kc.Arvados.ApiInsecure][kc.foundNonDiskSvc] = c
+		Timeout:   requestTimeout,
+		Transport: transport,
+	}
+	if custom {
+		customClient[customKey] = c
+	} else {
+		defaultClient[kc.Arvados.ApiInsecure][kc.foundNonDiskSvc] = c
+	}
 	return c
 }
 
 var reqIDGen = httpserver.IDGenerator{Prefix: "req-"}
 
+// apiToken returns the token to send with a request: the one from
+// TokenProvider if set, otherwise Arvados.ApiToken.
+func (kc *KeepClient) apiToken(ctx context.Context) (string, error) {
+	if kc.TokenProvider == nil {
+		return kc.Arvados.ApiToken, nil
+	}
+	token, err := kc.TokenProvider(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error getting API token: %w", err)
+	}
+	return token, nil
+}
+
 func (kc *KeepClient) getRequestID() string {
 	if kc.RequestID != "" {
 		return kc.RequestID
@@ -8,12 +8,15 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -200,7 +203,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServer(c *C) {
 
 	UploadToStubHelper(c, st,
 		func(kc *KeepClient, url string, reader io.ReadCloser, writer io.WriteCloser, uploadStatusChan chan uploadStatus) {
-			go kc.uploadToKeepServer(url, st.expectPath, nil, reader, uploadStatusChan, len("foo"), kc.getRequestID())
+			go kc.uploadToKeepServer(context.Background(), url, st.expectPath, nil, "", reader, uploadStatusChan, len("foo"), kc.getRequestID(), ServiceSet{})
 
 			writer.Write([]byte("foo"))
 			writer.Close()
@@ -224,7 +227,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServerBufferReader(c *C) {
 
 	UploadToStubHelper(c, st,
 		func(kc *KeepClient, url string, _ io.ReadCloser, _ io.WriteCloser, uploadStatusChan chan uploadStatus) {
-			go kc.uploadToKeepServer(url, st.expectPath, nil, bytes.NewBuffer([]byte("foo")), uploadStatusChan, 3, kc.getRequestID())
+			go kc.uploadToKeepServer(context.Background(), url, st.expectPath, nil, "", bytes.NewBuffer([]byte("foo")), uploadStatusChan, 3, kc.getRequestID(), ServiceSet{})
 
 			<-st.handled
 
@@ -256,7 +259,7 @@ func (s *StandaloneSuite) TestUploadWithStorageClasses(c *C) {
 
 		UploadToStubHelper(c, st,
 			func(kc *KeepClient, url string, reader io.ReadCloser, writer io.WriteCloser, uploadStatusChan chan uploadStatus) {
-				go kc.uploadToKeepServer(url, st.expectPath, nil, reader, uploadStatusChan, len("foo"), kc.getRequestID())
+				go kc.uploadToKeepServer(context.Background(), url, st.expectPath, nil, "", reader, uploadStatusChan, len("foo"), kc.getRequestID(), ServiceSet{})
 
 				writer.Write([]byte("foo"))
 				writer.Close()
@@ -323,12 +326,14 @@ func (s *StandaloneSuite) TestPutWithoutStorageClassesClusterSupport(c *C) {
 		}
 		kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
 
-		_, err := kc.BlockWrite(context.Background(), arvados.BlockWriteOptions{
+		resp, err := kc.BlockWrite(context.Background(), arvados.BlockWriteOptions{
 			Data:           []byte("foo"),
 			StorageClasses: trial.putClasses,
 		})
 		if trial.success {
 			c.Check(err, IsNil)
+			// Servers don't report storage classes.
+			c.Check(resp.StorageClasses, IsNil)
 		} else {
 			c.Check(err, NotNil)
 		}
@@ -396,12 +401,13 @@ func (s *StandaloneSuite) TestPutWithStorageClasses(c *C) {
 		}
 		kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
 
-		_, err := kc.BlockWrite(context.Background(), arvados.BlockWriteOptions{
+		resp, err := kc.BlockWrite(context.Background(), arvados.BlockWriteOptions{
 			Data:           []byte("foo"),
 			StorageClasses: trial.putClasses,
 		})
 		if trial.success {
 			c.Check(err, IsNil)
+			c.Check(resp.StorageClasses["class1"] >= 2, Equals, true, Commentf("resp.StorageClasses == %v", resp.StorageClasses))
 		} else {
 			c.Check(err, NotNil)
 		}
@@ -462,7 +468,7 @@ func (s *StandaloneSuite) TestFailedUploadToStubKeepServer(c *C) {
 		func(kc *KeepClient, url string, reader io.ReadCloser,
 			writer io.WriteCloser, uploadStatusChan chan uploadStatus) {
 
-			go kc.uploadToKeepServer(url, hash, nil, reader, uploadStatusChan, 3, kc.getRequestID())
+			go kc.uploadToKeepServer(context.Background(), url, hash, nil, "", reader, uploadStatusChan, 3, kc.getRequestID(), ServiceSet{})
 
 			writer.Write([]byte("foo"))
 			writer.Close()
@@ -734,6 +740,402 @@ func (s *StandaloneSuite) TestGet(c *C) {
 	c.Check(r.Close(), IsNil)
 }
 
+func (s *StandaloneSuite) TestBlockReadLocalLocator(c *C) {
+	hash := fmt.Sprintf("%x+3", md5.Sum([]byte("foo")))
+	remote := hash + "+Rzzzzz-abcdef"
+	local := hash + "+Aabcdef@12345678"
+	ks := RunFakeKeepServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, Equals, "/"+remote)
+		if strings.HasPrefix(req.Header.Get("X-Keep-Signature"), "local, ") {
+			w.Header().Set("X-Keep-Locator", local)
+		}
+		w.Write([]byte("foo"))
+	}))
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	arv.ApiToken = "abc123"
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+	var buf bytes.Buffer
+	var gotLocal string
+	n, err := kc.BlockRead(context.Background(), arvados.BlockReadOptions{
+		Locator: remote,
+		WriteTo: &buf,
+		LocalLocator: func(loc string) {
+			c.Check(buf.Len(), Equals, 0)
+			gotLocal = loc
+		},
+	})
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 3)
+	c.Check(buf.String(), Equals, "foo")
+	c.Check(gotLocal, Equals, local)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = kc.BlockRead(ctx, arvados.BlockReadOptions{
+		Locator:      remote,
+		WriteTo:      &buf,
+		LocalLocator: func(string) { c.Error("unexpected LocalLocator call") },
+	})
+	c.Check(err, ErrorMatches, `.*context canceled.*`)
+}
+
+func (s *StandaloneSuite) TestSignatureOptions(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	var gotHeader string
+	ks := RunFakeKeepServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotHeader = req.Header.Get("X-Keep-Signature")
+		if req.Method == "PUT" {
+			io.Copy(ioutil.Discard, req.Body)
+			w.Write([]byte(hash + "+3\n"))
+			return
+		}
+		w.Header().Set("X-Keep-Locator", hash+"+3+Aabcdef@12345678")
+		w.Write([]byte("foo"))
+	}))
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	arv.ApiToken = "abc123"
+	kc.Want_replicas = 1
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, map[string]string{"x": ks.url}, nil)
+
+	for _, trial := range []struct {
+		opts   arvados.BlockWriteOptions
+		expect string
+	}{
+		{arvados.BlockWriteOptions{}, ""},
+		{arvados.BlockWriteOptions{Unsigned: true}, "none"},
+		{arvados.BlockWriteOptions{SignatureTTL: time.Hour}, "ttl=3600"},
+	} {
+		opts := trial.opts
+		opts.Data = []byte("foo")
+		_, err := kc.BlockWrite(context.Background(), opts)
+		c.Check(err, IsNil)
+		c.Check(gotHeader, Equals, trial.expect)
+	}
+
+	_, err = kc.BlockRead(context.Background(), arvados.BlockReadOptions{
+		Locator:      hash + "+3+Rzzzzz-abcdef",
+		WriteTo:      ioutil.Discard,
+		LocalLocator: func(string) {},
+		SignatureTTL: 2 * time.Hour,
+	})
+	c.Check(err, IsNil)
+	c.Check(gotHeader, Matches, `local, time=\S+, ttl=7200`)
+}
+
+func (s *StandaloneSuite) TestGetWithTokenProvider(c *C) {
+	hash := fmt.Sprintf("%x+3", md5.Sum([]byte("foo")))
+
+	st := StubGetHandler{
+		c,
+		hash,
+		"refreshed-token",
+		http.StatusOK,
+		[]byte("foo")}
+
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	arv.ApiToken = "stale-token"
+	kc.DiskCacheSize = DiskCacheDisabled
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+	kc.TokenProvider = func(context.Context) (string, error) {
+		return "", errors.New("token source unavailable")
+	}
+	_, _, _, err = kc.Get(hash)
+	c.Check(err, ErrorMatches, `.*error getting API token: token source unavailable`)
+
+	calls := 0
+	kc.TokenProvider = func(context.Context) (string, error) {
+		calls++
+		return "refreshed-token", nil
+	}
+	r, n, _, err := kc.Get(hash)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, int64(3))
+	c.Check(r.Close(), IsNil)
+	c.Check(calls, Equals, 1)
+}
+
+func (s *StandaloneSuite) TestGetParallelRanges(c *C) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	hash := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+
+	var mtx sync.Mutex
+	var ranges []string
+	// Each server honors Range requests; "bad" servers corrupt
+	// the data in range responses, "norange" servers ignore the
+	// Range header.
+	newServer := func(mode string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mtx.Lock()
+			ranges = append(ranges, req.Header.Get("Range"))
+			mtx.Unlock()
+			c.Check(req.Header.Get("Authorization"), Equals, "Bearer abc123")
+			if mode == "norange" {
+				req.Header.Del("Range")
+			}
+			body := data
+			if mode == "bad" && req.Header.Get("Range") != "" {
+				body = make([]byte, len(data))
+			}
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(body))
+		}))
+	}
+
+	for _, modes := range [][]string{
+		{"ok", "ok"},
+		{"ok", "norange"},
+		{"ok", "bad"},
+	} {
+		c.Logf("=== %v", modes)
+		roots := map[string]string{}
+		for i, mode := range modes {
+			srv := newServer(mode)
+			defer srv.Close()
+			roots[fmt.Sprintf("zzzzz-bi6l4-%015d", i)] = srv.URL
+		}
+		arv, err := arvadosclient.MakeArvadosClient()
+		c.Assert(err, IsNil)
+		arv.ApiToken = "abc123"
+		kc, _ := MakeKeepClient(arv)
+		kc.DiskCacheSize = DiskCacheDisabled
+		kc.ParallelGetMinSize = 1000
+		kc.SetServiceRoots(roots, nil, nil)
+		ranges = nil
+
+		r, n, _, err := kc.Get(hash)
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, int64(len(data)))
+		buf, err := ioutil.ReadAll(r)
+		c.Check(err, IsNil)
+		c.Check(bytes.Equal(buf, data), Equals, true)
+
+		sort.Strings(ranges)
+		if modes[1] == "ok" {
+			c.Check(ranges, DeepEquals, []string{"bytes=0-49999", "bytes=50000-99999"})
+		} else {
+			// After a failed parallel read, the whole
+			// block is read from a single server.
+			c.Check(ranges, HasLen, 3)
+			c.Check(ranges[0], Equals, "")
+		}
+
+		// GetInto assembles the parallel ranges directly
+		// in the caller's buffer.
+		buf = make([]byte, len(data)+1)
+		n2, err := kc.GetInto(hash, buf)
+		c.Check(err, IsNil)
+		c.Check(n2, Equals, len(data))
+		c.Check(bytes.Equal(buf[:n2], data), Equals, true)
+	}
+}
+
+func (s *StandaloneSuite) TestGetInto(c *C) {
+	data := []byte("foobar")
+	hash := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+	var reqs int64
+	body := data
+	ks := RunFakeKeepServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&reqs, 1)
+		c.Check(req.Header.Get("Authorization"), Equals, "Bearer abc123")
+		if req.URL.Path != "/"+hash {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	}))
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, IsNil)
+	arv.ApiToken = "abc123"
+	kc, _ := MakeKeepClient(arv)
+	kc.DiskCacheSize = DiskCacheDisabled
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+	buf := make([]byte, 10)
+	n, err := kc.GetInto(hash, buf)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "foobar")
+
+	_, err = kc.GetInto(hash, buf[:5])
+	c.Check(errors.Is(err, io.ErrShortBuffer), Equals, true)
+	_, err = kc.GetInto(hash[:32], buf)
+	c.Check(err, ErrorMatches, `.*requires a size hint`)
+	n, err = kc.GetInto("d41d8cd98f00b204e9800998ecf8427e+0", buf)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 0)
+	_, err = kc.GetInto(fmt.Sprintf("%x+3", md5.Sum([]byte("baz"))), buf)
+	c.Check(errors.Is(err, BlockNotFound), Equals, true)
+
+	body = []byte("fooBAR")
+	_, err = kc.GetInto(hash, buf)
+	c.Check(err, Equals, BadChecksum)
+	body = data
+
+	// If the whole block is in the disk cache, no request is
+	// needed.
+	kc.DiskCacheSize = 0
+	_, err = kc.ReadAt(hash, buf[:1], 0)
+	c.Assert(err, IsNil)
+	atomic.StoreInt64(&reqs, 0)
+	buf = make([]byte, 10)
+	n, err = kc.GetInto(hash, buf)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "foobar")
+	c.Check(atomic.LoadInt64(&reqs), Equals, int64(0))
+}
+
+func (s *StandaloneSuite) benchmarkGet(c *C, get func(kc *KeepClient, locator string, buf []byte)) {
+	data := make([]byte, 1<<24)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	hash := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+	ks := RunFakeKeepServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		w.Write(data)
+	}))
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, IsNil)
+	arv.ApiToken = "abc123"
+	kc, _ := MakeKeepClient(arv)
+	kc.DiskCacheSize = DiskCacheDisabled
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+	buf := make([]byte, len(data))
+	c.SetBytes(int64(len(data)))
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		get(kc, hash, buf)
+	}
+}
+
+func (s *StandaloneSuite) BenchmarkGet(c *C) {
+	s.benchmarkGet(c, func(kc *KeepClient, locator string, buf []byte) {
+		rdr, _, _, err := kc.Get(locator)
+		c.Assert(err, IsNil)
+		_, err = io.ReadFull(rdr, buf)
+		c.Assert(err, IsNil)
+		c.Assert(rdr.Close(), IsNil)
+	})
+}
+
+func (s *StandaloneSuite) BenchmarkGetInto(c *C) {
+	s.benchmarkGet(c, func(kc *KeepClient, locator string, buf []byte) {
+		_, err := kc.GetInto(locator, buf)
+		c.Assert(err, IsNil)
+	})
+}
+
+func (s *StandaloneSuite) TestServiceSets(c *C) {
+	data := []byte("foo")
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+
+	var mtx sync.Mutex
+	reqs := map[string][]string{}
+	fail := map[string]int{}
+	delay := map[string]time.Duration{}
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mtx.Lock()
+			reqs[name] = append(reqs[name], req.Method)
+			failNow := fail[name] > 0
+			fail[name]--
+			d := delay[name]
+			mtx.Unlock()
+			time.Sleep(d)
+			if failNow {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if req.Method == "PUT" {
+				w.Header().Set(XKeepReplicasStored, "1")
+				fmt.Fprintf(w, "%s+%d", hash, len(data))
+				return
+			}
+			w.Write(data)
+		}))
+	}
+	discovered := newServer("discovered")
+	defer discovered.Close()
+	reader := newServer("reader")
+	defer reader.Close()
+	writer := newServer("writer")
+	defer writer.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	kc.DiskCacheSize = DiskCacheDisabled
+	kc.Want_replicas = 1
+	kc.Retries = 0
+	kc.RetryDelay = time.Millisecond
+	kc.SetServiceRoots(
+		map[string]string{"zzzzz-bi6l4-000000000000000": discovered.URL},
+		map[string]string{"zzzzz-bi6l4-000000000000000": discovered.URL},
+		nil)
+	kc.ReadServices = &ServiceSet{
+		Roots:      map[string]string{"zzzzz-bi6l4-111111111111111": reader.URL},
+		Retries:    2,
+		RetryDelay: time.Millisecond,
+		Timeout:    time.Second / 2,
+	}
+	kc.WriteServices = &ServiceSet{
+		Roots:      map[string]string{"zzzzz-bi6l4-222222222222222": writer.URL},
+		Retries:    1,
+		RetryDelay: time.Millisecond,
+	}
+
+	// Writes go to the write services, retrying according to
+	// WriteServices.Retries.
+	fail["writer"] = 1
+	_, replicas, err := kc.PutB(data)
+	c.Check(err, IsNil)
+	c.Check(replicas, Equals, 1)
+	c.Check(reqs["writer"], DeepEquals, []string{"PUT", "PUT"})
+
+	// Reads go to the read services, retrying according to
+	// ReadServices.Retries.
+	fail["reader"] = 2
+	rdr, _, _, err := kc.Get(hash)
+	c.Assert(err, IsNil)
+	buf, err := ioutil.ReadAll(rdr)
+	c.Check(err, IsNil)
+	c.Check(buf, DeepEquals, data)
+	c.Check(reqs["reader"], DeepEquals, []string{"GET", "GET", "GET"})
+	c.Check(reqs["discovered"], HasLen, 0)
+
+	// ReadServices.Timeout applies to each request.
+	delay["reader"] = time.Second
+	kc.ReadServices.Retries = 0
+	_, _, _, err = kc.Get(hash)
+	c.Check(err, ErrorMatches, `(?ms).*context deadline exceeded.*`)
+
+	// Nil Roots means use the discovered services.
+	kc.ReadServices = &ServiceSet{}
+	_, _, _, err = kc.Get(hash)
+	c.Check(err, IsNil)
+	c.Check(reqs["discovered"], DeepEquals, []string{"GET"})
+}
+
 func (s *StandaloneSuite) TestGet404(c *C) {
 	hash := fmt.Sprintf("%x+3", md5.Sum([]byte("foo")))
 
@@ -1571,6 +1973,75 @@ func (s *StandaloneSuite) TestPutBRetry(c *C) {
 	}
 }
 
+// slowPutHandler stores one replica per request after a delay, and
+// records the largest number of requests in progress at once.
+type slowPutHandler struct {
+	delay       time.Duration
+	mtx         sync.Mutex
+	inflight    int
+	maxInflight int
+}
+
+func (h *slowPutHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	io.Copy(ioutil.Discard, req.Body)
+	h.mtx.Lock()
+	h.inflight++
+	if h.maxInflight < h.inflight {
+		h.maxInflight = h.inflight
+	}
+	h.mtx.Unlock()
+	time.Sleep(h.delay)
+	h.mtx.Lock()
+	h.inflight--
+	h.mtx.Unlock()
+	resp.Header().Set("X-Keep-Replicas-Stored", "1")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write([]byte(Md5String("foo") + "+3"))
+}
+
+func (s *StandaloneSuite) TestPutWriteStrategy(c *C) {
+	for _, trial := range []struct {
+		strategy           WriteStrategy
+		replicasPerService int
+		delay              time.Duration
+		adaptiveDelay      time.Duration
+		expectMaxInflight  int
+	}{
+		{WriteStrategyDefault, 0, 10 * time.Millisecond, 0, 1},
+		{WriteStrategyDefault, 1, 50 * time.Millisecond, 0, 3},
+		{WriteStrategySequential, 1, 10 * time.Millisecond, 0, 1},
+		{WriteStrategyParallel, 0, 50 * time.Millisecond, 0, 3},
+		// Fast servers: no need to add uploads.
+		{WriteStrategyAdaptive, 0, 10 * time.Millisecond, time.Second, 1},
+		// Slow servers: add uploads until all replicas are
+		// in progress.
+		{WriteStrategyAdaptive, 0, 200 * time.Millisecond, 10 * time.Millisecond, 3},
+	} {
+		c.Logf("=== %+v", trial)
+		st := &slowPutHandler{delay: trial.delay}
+		arv, _ := arvadosclient.MakeArvadosClient()
+		arv.ApiToken = "abc123"
+		kc, _ := MakeKeepClient(arv)
+		kc.Want_replicas = 3
+		kc.WriteStrategy = trial.strategy
+		kc.AdaptiveWriteDelay = trial.adaptiveDelay
+		roots := make(map[string]string)
+		for i, k := range RunSomeFakeKeepServers(st, 5) {
+			roots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+			defer k.listener.Close()
+		}
+		kc.SetServiceRoots(roots, roots, nil)
+		kc.replicasPerService = trial.replicasPerService
+
+		_, replicas, err := kc.PutB([]byte("foo"))
+		c.Check(err, IsNil)
+		c.Check(replicas, Equals, 3)
+		st.mtx.Lock()
+		c.Check(st.maxInflight, Equals, trial.expectMaxInflight)
+		st.mtx.Unlock()
+	}
+}
+
 func (s *ServerRequiredSuite) TestMakeKeepClientWithNonDiskTypeService(c *C) {
 	arv, err := arvadosclient.MakeArvadosClient()
 	c.Assert(err, IsNil)
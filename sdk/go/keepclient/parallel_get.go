@@ -0,0 +1,96 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// getParallelRanges fetches the first half of the block from
+// servers[0] and the second half from servers[1] concurrently into
+// buf (whose length is the block size), and checks the assembled
+// data against the locator hash. The returned url and header are
+// those of the first server's response. If timeout is non-zero, it
+// limits the time taken by both requests.
+func (kc *KeepClient) getParallelRanges(ctx context.Context, locator string, buf []byte, servers []string, header http.Header, reqid string, timeout time.Duration) (string, http.Header, error) {
+	ctx, cancel := ServiceSet{Timeout: timeout}.requestContext(ctx)
+	defer cancel()
+
+	size := int64(len(buf))
+	mid := size / 2
+	type result struct {
+		url    string
+		header http.Header
+		err    error
+	}
+	results := make([]chan result, 2)
+	for i, r := range [][2]int64{{0, mid}, {mid, size}} {
+		i, start, end := i, r[0], r[1]
+		results[i] = make(chan result, 1)
+		go func() {
+			url := servers[i] + "/" + locator
+			hdr, err := kc.getRange(ctx, url, egressDestination(servers[i], locator), header, reqid, buf[start:end], start, size)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", url, err)
+				cancel()
+			}
+			results[i] <- result{url, hdr, err}
+		}()
+	}
+	first, second := <-results[0], <-results[1]
+	if first.err != nil {
+		return "", nil, first.err
+	}
+	if second.err != nil {
+		return "", nil, second.err
+	}
+	if fmt.Sprintf("%x", md5.Sum(buf)) != locator[0:32] {
+		return "", nil, fmt.Errorf("%s, %s: %w", first.url, second.url, BadChecksum)
+	}
+	return first.url, first.header, nil
+}
+
+// getRange reads len(dst) bytes of the block at url, starting at
+// offset start, into dst. size is the total size of the block. dest
+// is the destination to count against kc.EgressQuota.
+func (kc *KeepClient) getRange(ctx context.Context, url, dest string, header http.Header, reqid string, dst []byte, start, size int64) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = kc.setBlockRequestHeaders(req, header, reqid)
+	if err != nil {
+		return nil, err
+	}
+	end := start + int64(len(dst)) - 1
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := kc.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		respbody, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 4096})
+		return nil, fmt.Errorf("HTTP %d %q in response to range request", resp.StatusCode, bytes.TrimSpace(respbody))
+	}
+	if cr, expect := resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/%d", start, end, size); cr != expect {
+		return nil, fmt.Errorf("unexpected Content-Range %q, expected %q", cr, expect)
+	}
+	if kc.EgressQuota != nil {
+		resp.Body = egressCountingReader{ReadCloser: resp.Body, eq: kc.EgressQuota, dest: dest}
+	}
+	_, err = io.ReadFull(resp.Body, dst)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Header, nil
+}
@@ -0,0 +1,258 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// DefaultPrefetchParallel is the number of concurrent block fetches
+// used by Prefetch if the caller doesn't specify one.
+const DefaultPrefetchParallel = 4
+
+// PrefetchRange is a range of bytes within a block that is needed to
+// read part of a file.
+type PrefetchRange struct {
+	Locator string
+	Offset  int
+	Length  int
+}
+
+// PlanFileRange returns the block ranges that must be read to get
+// length bytes of the named file in the given manifest, starting at
+// offset. If length is negative, the range extends to the end of the
+// file.
+//
+// The manifest is scanned one stream at a time, and only the blocks
+// of streams containing the file are parsed, so planning a small
+// range of one file in a large manifest doesn't use much memory.
+// Adjacent ranges of the same block are merged.
+//
+// If the file does not exist, the returned error wraps
+// os.ErrNotExist. If offset is beyond the end of the file, the plan
+// is empty.
+func PlanFileRange(manifest, filename string, offset, length int64) ([]PrefetchRange, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid offset %d", offset)
+	}
+	target := path.Clean("./" + strings.TrimPrefix(filename, "/"))
+	if target != "." {
+		target = "./" + target
+	}
+	end := int64(-1)
+	if length >= 0 {
+		end = offset + length
+	}
+
+	type block struct {
+		locator string
+		start   int64 // offset of the block within the stream
+		size    int64
+	}
+	var plan []PrefetchRange
+	var blocks []block
+	found := false
+	// Offset within the file of the next segment
+	var fileOff int64
+	for lineno := 1; manifest != ""; lineno++ {
+		line := manifest
+		if i := strings.IndexByte(manifest, '\n'); i >= 0 {
+			line, manifest = manifest[:i], manifest[i+1:]
+		} else {
+			manifest = ""
+		}
+		if line == "" {
+			continue
+		}
+		var stream string
+		if i := strings.IndexByte(line, ' '); i < 0 {
+			return nil, fmt.Errorf("line %d: invalid stream", lineno)
+		} else {
+			stream, line = arvados.ManifestUnescape(line[:i]), line[i+1:]
+		}
+		if target != stream && !strings.HasPrefix(target, stream+"/") {
+			continue
+		}
+		blocks = blocks[:0]
+		var streamSize int64
+		for line != "" {
+			var token string
+			if i := strings.IndexByte(line, ' '); i >= 0 {
+				token, line = line[:i], line[i+1:]
+			} else {
+				token, line = line, ""
+			}
+			if len(blocks) == 0 || !strings.Contains(token, ":") {
+				if len(token) < 34 || token[32] != '+' {
+					return nil, fmt.Errorf("line %d: invalid locator %q", lineno, token)
+				}
+				sizestr := token[33:]
+				if i := strings.IndexByte(sizestr, '+'); i >= 0 {
+					sizestr = sizestr[:i]
+				}
+				size, err := strconv.ParseInt(sizestr, 10, 64)
+				if err != nil || size < 0 {
+					return nil, fmt.Errorf("line %d: invalid locator %q", lineno, token)
+				}
+				blocks = append(blocks, block{locator: token, start: streamSize, size: size})
+				streamSize += size
+				continue
+			}
+			toks := strings.SplitN(token, ":", 3)
+			if len(toks) != 3 {
+				return nil, fmt.Errorf("line %d: invalid file token %q", lineno, token)
+			}
+			if stream+"/"+arvados.ManifestUnescape(toks[2]) != target {
+				continue
+			}
+			pos, err := strconv.ParseInt(toks[0], 10, 64)
+			if err != nil || pos < 0 {
+				return nil, fmt.Errorf("line %d: invalid file position in %q", lineno, token)
+			}
+			flen, err := strconv.ParseInt(toks[1], 10, 64)
+			if err != nil || flen < 0 || pos+flen > streamSize {
+				return nil, fmt.Errorf("line %d: invalid file length in %q", lineno, token)
+			}
+			found = true
+			// Part of the wanted range in this segment, as
+			// offsets within the file
+			lo, hi := offset, fileOff+flen
+			if lo < fileOff {
+				lo = fileOff
+			}
+			if end >= 0 && hi > end {
+				hi = end
+			}
+			fileOff += flen
+			if lo >= hi {
+				continue
+			}
+			// ...and as offsets within the stream
+			lo, hi = pos+lo-(fileOff-flen), pos+hi-(fileOff-flen)
+			bi := sort.Search(len(blocks), func(i int) bool { return blocks[i].start+blocks[i].size > lo })
+			for ; bi < len(blocks) && blocks[bi].start < hi; bi++ {
+				b := blocks[bi]
+				rlo, rhi := lo-b.start, hi-b.start
+				if rlo < 0 {
+					rlo = 0
+				}
+				if rhi > b.size {
+					rhi = b.size
+				}
+				if n := len(plan); n > 0 && plan[n-1].Locator == b.locator && int64(plan[n-1].Offset+plan[n-1].Length) == rlo {
+					plan[n-1].Length += int(rhi - rlo)
+				} else {
+					plan = append(plan, PrefetchRange{Locator: b.locator, Offset: int(rlo), Length: int(rhi - rlo)})
+				}
+			}
+		}
+		if end >= 0 && fileOff >= end {
+			// Later segments of the file are not
+			// needed.
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%q: %w", filename, os.ErrNotExist)
+	}
+	return plan, nil
+}
+
+// Prefetch reads the given block ranges through gw using up to
+// parallel concurrent requests (DefaultPrefetchParallel if parallel
+// is zero), so that subsequent reads are served from its cache. gw
+// is normally an arvados.DiskCache or a KeepClient with its disk
+// cache enabled. Ranges that gw reports as already cached (see
+// arvados.DiskCache.CachedRanges) are skipped.
+//
+// Prefetch returns when all of the ranges have been read, the first
+// error occurs, or ctx is done.
+func Prefetch(ctx context.Context, gw arvados.KeepGateway, ranges []PrefetchRange, parallel int) error {
+	if parallel <= 0 {
+		parallel = DefaultPrefetchParallel
+	}
+	cr, _ := gw.(interface {
+		CachedRanges(string) []arvados.BlockRange
+	})
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	throttle := make(chan struct{}, parallel)
+	for _, r := range ranges {
+		if r.Length <= 0 || (cr != nil && rangeCached(cr.CachedRanges(r.Locator), r)) {
+			continue
+		}
+		select {
+		case throttle <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(r PrefetchRange) {
+			defer wg.Done()
+			defer func() { <-throttle }()
+			// The cache fetches the whole block, and
+			// returns when the requested byte -- the last
+			// one we need -- is available.
+			var buf [1]byte
+			_, err := gw.ReadAt(r.Locator, buf[:], r.Offset+r.Length-1)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("prefetch %s: %w", r.Locator, err)
+					cancel()
+				})
+			}
+		}(r)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// rangeCached returns true if r is entirely within one of the given
+// cached ranges.
+func rangeCached(cached []arvados.BlockRange, r PrefetchRange) bool {
+	for _, c := range cached {
+		if c.Offset <= r.Offset && c.Offset+c.Length >= r.Offset+r.Length {
+			return true
+		}
+	}
+	return false
+}
+
+// PrefetchFileRange fetches the blocks needed to read length bytes
+// (or, if length is negative, the rest) of the named file in the
+// given manifest, starting at offset, into kc's disk cache. It
+// returns immediately if the disk cache is disabled.
+//
+// This allows a caller that is about to read part of a file -- e.g.,
+// a range request, or staging input files for a container -- to
+// fetch the blocks in parallel, instead of one at a time as the
+// reader reaches them.
+func (kc *KeepClient) PrefetchFileRange(ctx context.Context, manifest, filename string, offset, length int64, parallel int) error {
+	if kc.DiskCacheSize == DiskCacheDisabled {
+		return nil
+	}
+	plan, err := PlanFileRange(manifest, filename, offset, length)
+	if err != nil {
+		return err
+	}
+	return Prefetch(ctx, kc, plan, parallel)
+}
@@ -0,0 +1,171 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&prefetchSuite{})
+
+type prefetchSuite struct{}
+
+const (
+	pfBlockA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa+10"
+	pfBlockB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb+10+Afakesig@12345678"
+	pfBlockC = "cccccccccccccccccccccccccccccccc+5"
+)
+
+var prefetchManifest = ". " + pfBlockA + " " + pfBlockB + " 0:3:foo 3:12:bar 15:5:baz\\040waz 0:0:empty\n" +
+	"./dir " + pfBlockC + " 0:5:sub/file 1:2:bar\n" +
+	"./dir/sub " + pfBlockA + " 0:4:file\n"
+
+func (s *prefetchSuite) TestPlanFileRange(c *check.C) {
+	for _, trial := range []struct {
+		filename string
+		offset   int64
+		length   int64
+		expect   []PrefetchRange
+	}{
+		{"foo", 0, -1, []PrefetchRange{{pfBlockA, 0, 3}}},
+		{"./foo", 1, 1, []PrefetchRange{{pfBlockA, 1, 1}}},
+		{"/bar", 0, -1, []PrefetchRange{{pfBlockA, 3, 7}, {pfBlockB, 0, 5}}},
+		{"bar", 7, 2, []PrefetchRange{{pfBlockB, 0, 2}}},
+		{"bar", 6, 100, []PrefetchRange{{pfBlockA, 9, 1}, {pfBlockB, 0, 5}}},
+		{"bar", 12, -1, nil},
+		{"baz waz", 2, -1, []PrefetchRange{{pfBlockB, 7, 3}}},
+		{"empty", 0, -1, nil},
+		{"dir/bar", 0, -1, []PrefetchRange{{pfBlockC, 1, 2}}},
+		// Segments from two streams, and a file token
+		// with a "/" in the name
+		{"dir/sub/file", 0, -1, []PrefetchRange{{pfBlockC, 0, 5}, {pfBlockA, 0, 4}}},
+		{"dir/sub/file", 4, 2, []PrefetchRange{{pfBlockC, 4, 1}, {pfBlockA, 0, 1}}},
+		// Later streams aren't needed once the range is
+		// complete
+		{"dir/sub/file", 0, 3, []PrefetchRange{{pfBlockC, 0, 3}}},
+	} {
+		c.Logf("trial %+v", trial)
+		plan, err := PlanFileRange(prefetchManifest, trial.filename, trial.offset, trial.length)
+		c.Check(err, check.IsNil)
+		c.Check(plan, check.DeepEquals, trial.expect)
+	}
+}
+
+// Adjacent segments of the same block are merged.
+func (s *prefetchSuite) TestPlanMergesRanges(c *check.C) {
+	plan, err := PlanFileRange(". "+pfBlockA+" 0:4:foo 4:6:foo 2:2:foo\n", "foo", 0, -1)
+	c.Check(err, check.IsNil)
+	c.Check(plan, check.DeepEquals, []PrefetchRange{{pfBlockA, 0, 10}, {pfBlockA, 2, 2}})
+}
+
+func (s *prefetchSuite) TestPlanErrors(c *check.C) {
+	_, err := PlanFileRange(prefetchManifest, "nonexistent", 0, -1)
+	c.Check(errors.Is(err, os.ErrNotExist), check.Equals, true)
+	_, err = PlanFileRange(prefetchManifest, "dir", 0, -1)
+	c.Check(errors.Is(err, os.ErrNotExist), check.Equals, true)
+	_, err = PlanFileRange(prefetchManifest, "foo", -1, -1)
+	c.Check(err, check.ErrorMatches, `invalid offset -1`)
+	_, err = PlanFileRange(". "+pfBlockA+" 0:20:foo\n", "foo", 0, -1)
+	c.Check(err, check.ErrorMatches, `line 1: invalid file length .*`)
+	_, err = PlanFileRange(". 0:0:foo\n", "foo", 0, -1)
+	c.Check(err, check.ErrorMatches, `line 1: invalid locator .*`)
+	_, err = PlanFileRange(".\n", "foo", 0, -1)
+	c.Check(err, check.ErrorMatches, `line 1: invalid stream`)
+}
+
+type prefetchGateway struct {
+	arvados.KeepGateway
+	mtx      sync.Mutex
+	cached   map[string]int
+	reads    []string
+	active   int
+	maxSeen  int
+	fail     string
+	interval time.Duration
+}
+
+func (gw *prefetchGateway) ReadAt(locator string, dst []byte, offset int) (int, error) {
+	gw.mtx.Lock()
+	gw.active++
+	if gw.active > gw.maxSeen {
+		gw.maxSeen = gw.active
+	}
+	gw.reads = append(gw.reads, locator)
+	gw.mtx.Unlock()
+	time.Sleep(gw.interval)
+	gw.mtx.Lock()
+	defer gw.mtx.Unlock()
+	gw.active--
+	if locator == gw.fail {
+		return 0, errors.New("test error")
+	}
+	return len(dst), nil
+}
+
+func (gw *prefetchGateway) CachedRanges(locator string) []arvados.BlockRange {
+	gw.mtx.Lock()
+	defer gw.mtx.Unlock()
+	if size, ok := gw.cached[locator]; ok {
+		return []arvados.BlockRange{{Offset: 0, Length: size}}
+	}
+	return nil
+}
+
+func (s *prefetchSuite) TestPrefetch(c *check.C) {
+	gw := &prefetchGateway{
+		cached:   map[string]int{"cached+10": 10, "partial+10": 5},
+		interval: 10 * time.Millisecond,
+	}
+	var ranges []PrefetchRange
+	var expect []string
+	for _, loc := range []string{"a+10", "b+10", "c+10", "d+10", "e+10", "f+10"} {
+		ranges = append(ranges, PrefetchRange{loc, 0, 10})
+		expect = append(expect, loc)
+	}
+	ranges = append(ranges,
+		PrefetchRange{"cached+10", 2, 8},
+		PrefetchRange{"partial+10", 2, 2},
+		PrefetchRange{"partial+10", 2, 8},
+		PrefetchRange{"empty+0", 0, 0})
+	expect = append(expect, "partial+10")
+	err := Prefetch(context.Background(), gw, ranges, 3)
+	c.Check(err, check.IsNil)
+	sort.Strings(gw.reads)
+	sort.Strings(expect)
+	c.Check(gw.reads, check.DeepEquals, expect)
+	c.Check(gw.maxSeen, check.Equals, 3)
+}
+
+func (s *prefetchSuite) TestPrefetchError(c *check.C) {
+	gw := &prefetchGateway{fail: "b+10", interval: 10 * time.Millisecond}
+	var ranges []PrefetchRange
+	for _, loc := range []string{"a+10", "b+10", "c+10", "d+10", "e+10", "f+10"} {
+		ranges = append(ranges, PrefetchRange{loc, 0, 10})
+	}
+	err := Prefetch(context.Background(), gw, ranges, 1)
+	c.Check(err, check.ErrorMatches, `prefetch b\+10: test error`)
+	c.Check(gw.reads, check.DeepEquals, []string{"a+10", "b+10"})
+
+	gw = &prefetchGateway{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Prefetch(ctx, gw, ranges, 1)
+	c.Check(err, check.Equals, context.Canceled)
+	c.Check(gw.reads, check.HasLen, 0)
+}
+
+func (s *prefetchSuite) TestPrefetchFileRangeCacheDisabled(c *check.C) {
+	kc := &KeepClient{DiskCacheSize: DiskCacheDisabled}
+	err := kc.PrefetchFileRange(context.Background(), prefetchManifest, "nonexistent", 0, -1, 0)
+	c.Check(err, check.IsNil)
+}
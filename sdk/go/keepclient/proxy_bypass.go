@@ -0,0 +1,111 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+)
+
+// Values of arvadosclient.ArvadosClient.KeepProxyBypass.
+const (
+	ProxyBypassNever  = "never"
+	ProxyBypassAuto   = "auto"
+	ProxyBypassAlways = "always"
+)
+
+// How long to wait for each keepstore server to accept a connection
+// when deciding whether to bypass the proxy in "auto" mode.
+var proxyBypassProbeTimeout = 2 * time.Second
+
+// proxyBypassMode returns kc's proxy bypass mode, or an error if it
+// is not a valid mode.
+func (kc *KeepClient) proxyBypassMode() (string, error) {
+	switch mode := kc.Arvados.KeepProxyBypass; mode {
+	case "":
+		return ProxyBypassNever, nil
+	case ProxyBypassNever, ProxyBypassAuto, ProxyBypassAlways:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid KeepProxyBypass value %q (must be %q, %q, or %q)", mode, ProxyBypassAuto, ProxyBypassAlways, ProxyBypassNever)
+	}
+}
+
+// bypassProxy returns the keepstore servers to use instead of the
+// proxy services in sl, or sl itself if the proxy should be used.
+//
+// In "always" mode, the keepstore servers are used if the API server
+// lists any. In "auto" mode, they are used only if every one of them
+// accepts a TCP connection, which normally means the client is
+// running inside the cluster network.
+func bypassProxy(arv *arvadosclient.ArvadosClient, mode string, sl svcList) svcList {
+	if mode == ProxyBypassNever {
+		return sl
+	}
+	proxy := false
+	for _, svc := range sl.Items {
+		if svc.SvcType == "proxy" {
+			proxy = true
+		}
+	}
+	if !proxy {
+		return sl
+	}
+	var disks svcList
+	err := arv.Call("GET", "keep_services", "", "", arvadosclient.Dict{
+		"filters": [][]string{{"service_type", "=", "disk"}},
+		"limit":   1000,
+	}, &disks)
+	if err != nil {
+		proxyBypassLogf(arv, "error listing keepstore servers, using keepproxy: %s", err)
+		return sl
+	}
+	if len(disks.Items) == 0 {
+		return sl
+	}
+	if mode == ProxyBypassAuto {
+		if err := probeServices(disks); err != nil {
+			proxyBypassLogf(arv, "keepstore servers are not reachable, using keepproxy: %s", err)
+			return sl
+		}
+	}
+	return disks
+}
+
+// probeServices returns an error if any of the listed services does
+// not accept a TCP connection within proxyBypassProbeTimeout.
+func probeServices(sl svcList) error {
+	errs := make(chan error, len(sl.Items))
+	var wg sync.WaitGroup
+	for _, svc := range sl.Items {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", addr, proxyBypassProbeTimeout)
+			if err != nil {
+				errs <- err
+				return
+			}
+			conn.Close()
+		}(net.JoinHostPort(svc.Hostname, strconv.Itoa(svc.Port)))
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func proxyBypassLogf(arv *arvadosclient.ArvadosClient, format string, args ...interface{}) {
+	if arv.Logger != nil {
+		arv.Logger.Infof(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
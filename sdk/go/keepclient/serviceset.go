@@ -0,0 +1,107 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// A ServiceSet specifies the Keep services used for one kind of
+// operation (reading or writing blocks), and how failed requests to
+// those services are retried.
+//
+// Example: in a hybrid cluster, write only to the on-prem keepstore
+// servers, and read from a keepproxy in the cloud region with a
+// longer timeout:
+//
+//	kc.WriteServices = &keepclient.ServiceSet{
+//		Roots:   map[string]string{"zzzzz-bi6l4-000000000000000": "http://keep0.zzzzz.example:25107"},
+//		Retries: 2,
+//	}
+//	kc.ReadServices = &keepclient.ServiceSet{
+//		Roots:   map[string]string{"zzzzz-bi6l4-111111111111111": "https://keep.zzzzz.example"},
+//		Retries: 4,
+//		Timeout: 5 * time.Minute,
+//	}
+type ServiceSet struct {
+	// Map of service UUIDs to base URIs. If nil, the services
+	// found by service discovery are used (LocalRoots for reads,
+	// WritableLocalRoots for writes).
+	Roots map[string]string
+
+	// Number of times to retry a request after a transient
+	// failure.
+	Retries int
+
+	// Initial maximum delay for automatic retry. If zero,
+	// DefaultRetryDelay is used (see KeepClient.RetryDelay).
+	RetryDelay time.Duration
+
+	// Time limit for each request, including reading the
+	// response body. If zero, only the HTTP client's own
+	// timeouts apply.
+	Timeout time.Duration
+}
+
+// readServices returns the ServiceSet to use when reading blocks:
+// ReadServices if set, otherwise the discovered local services with
+// the client-wide retry settings.
+func (kc *KeepClient) readServices() ServiceSet {
+	if kc.ReadServices != nil {
+		ss := *kc.ReadServices
+		if ss.Roots == nil {
+			ss.Roots = kc.LocalRoots()
+		}
+		return ss
+	}
+	return ServiceSet{
+		Roots:      kc.LocalRoots(),
+		Retries:    kc.Retries,
+		RetryDelay: kc.RetryDelay,
+	}
+}
+
+// writeServices returns the ServiceSet to use when writing blocks:
+// WriteServices if set, otherwise the discovered writable local
+// services with the client-wide retry settings.
+func (kc *KeepClient) writeServices() ServiceSet {
+	if kc.WriteServices != nil {
+		ss := *kc.WriteServices
+		if ss.Roots == nil {
+			ss.Roots = kc.WritableLocalRoots()
+		}
+		return ss
+	}
+	return ServiceSet{
+		Roots:      kc.WritableLocalRoots(),
+		Retries:    kc.Retries,
+		RetryDelay: kc.RetryDelay,
+	}
+}
+
+// requestContext returns a child of ctx for a single request to a
+// Keep service, with the ServiceSet's timeout applied. The caller
+// must call the returned CancelFunc when the request is finished.
+func (ss ServiceSet) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ss.Timeout > 0 {
+		return context.WithTimeout(ctx, ss.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// cancelOnClose calls a CancelFunc when its wrapped ReadCloser is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (coc cancelOnClose) Close() error {
+	err := coc.ReadCloser.Close()
+	coc.cancel()
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// reserveBufferMemory accounts for size bytes of in-memory upload
+// buffer against SpoolMemoryBudget, and returns true if the budget
+// allows it. If it returns true, the caller must eventually call
+// releaseBufferMemory(size).
+func (kc *KeepClient) reserveBufferMemory(size int64) bool {
+	if kc.SpoolMemoryBudget <= 0 {
+		return true
+	}
+	if atomic.AddInt64(&kc.bufferMemoryInUse, size) > kc.SpoolMemoryBudget {
+		atomic.AddInt64(&kc.bufferMemoryInUse, -size)
+		return false
+	}
+	return true
+}
+
+// uploadBufferSize returns the amount of memory to reserve for
+// buffering a streamed block of the given size (0 if unknown).
+func uploadBufferSize(dataSize int) int64 {
+	if dataSize == 0 {
+		return BLOCKSIZE
+	}
+	return int64(dataSize)
+}
+
+func (kc *KeepClient) releaseBufferMemory(size int64) {
+	if kc.SpoolMemoryBudget > 0 {
+		atomic.AddInt64(&kc.bufferMemoryInUse, -size)
+	}
+}
+
+// spoolDir returns the directory where block data is spooled when
+// the memory budget is exhausted.
+func (kc *KeepClient) spoolDir() string {
+	if kc.SpoolDir != "" {
+		return kc.SpoolDir
+	}
+	dir := filepath.Join(cacheDir(), "tmp")
+	os.Mkdir(dir, 0700)
+	return dir
+}
+
+// spoolBlock copies block data from r to a temporary file, and
+// returns the file and the number of bytes written. If h is not
+// nil, the data is also written to h.
+//
+// The file is unlinked as soon as it is created, so a spool file
+// never outlives the process that created it, even if the process
+// crashes. The caller must close the returned file when finished
+// with it.
+func (kc *KeepClient) spoolBlock(r io.Reader, h hash.Hash) (*os.File, int64, error) {
+	f, err := os.CreateTemp(kc.spoolDir(), fmt.Sprintf("spool-%x-*.tmp", os.Getpid()))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating spool file: %w", err)
+	}
+	os.Remove(f.Name())
+	var w io.Writer = f
+	if h != nil {
+		w = io.MultiWriter(f, h)
+	}
+	n, err := io.Copy(w, io.LimitReader(r, BLOCKSIZE+1))
+	if err == nil && n > BLOCKSIZE {
+		err = ErrOversizeBlock
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, n, nil
+}
@@ -0,0 +1,86 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StandaloneSuite) TestPutSpooled(c *C) {
+	st := &StubPutHandler{
+		c:                  c,
+		expectPath:         "acbd18db4cc2f85cedef654fccc4a4d8",
+		expectAPIToken:     "abc123",
+		expectBody:         "foo",
+		expectStorageClass: "*",
+		handled:            make(chan string, 10),
+	}
+	ks := RunSomeFakeKeepServers(st, 3)
+	localRoots := make(map[string]string)
+	for i, k := range ks {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	arv.ApiToken = "abc123"
+	kc, _ := MakeKeepClient(arv)
+	kc.Want_replicas = 2
+	kc.DiskCacheSize = DiskCacheDisabled
+	kc.SetServiceRoots(localRoots, localRoots, nil)
+	kc.SpoolDir = c.MkDir()
+
+	for _, trial := range []struct {
+		budget int64
+		hash   string
+	}{
+		{0, ""},
+		{1 << 20, "acbd18db4cc2f85cedef654fccc4a4d8"},
+		{2, ""},
+		{2, "acbd18db4cc2f85cedef654fccc4a4d8"},
+	} {
+		c.Logf("%+v", trial)
+		kc.SpoolMemoryBudget = trial.budget
+		resp, err := kc.BlockWrite(context.Background(), arvados.BlockWriteOptions{
+			Reader:   strings.NewReader("foo"),
+			DataSize: 3,
+			Hash:     trial.hash,
+		})
+		c.Check(err, IsNil)
+		c.Check(resp.Replicas, Equals, 2)
+	}
+
+	// Spool files are unlinked as soon as they are created.
+	ents, err := os.ReadDir(kc.SpoolDir)
+	c.Check(err, IsNil)
+	c.Check(ents, HasLen, 0)
+
+	// Wrong hash is detected while spooling.
+	kc.SpoolMemoryBudget = 2
+	_, err = kc.BlockWrite(context.Background(), arvados.BlockWriteOptions{
+		Reader:   strings.NewReader("bar"),
+		DataSize: 3,
+		Hash:     "acbd18db4cc2f85cedef654fccc4a4d8",
+	})
+	c.Check(err, Equals, BadChecksum)
+}
+
+func (s *StandaloneSuite) TestBufferMemoryBudget(c *C) {
+	kc := &KeepClient{SpoolMemoryBudget: 100}
+	c.Check(kc.reserveBufferMemory(60), Equals, true)
+	c.Check(kc.reserveBufferMemory(60), Equals, false)
+	c.Check(kc.reserveBufferMemory(40), Equals, true)
+	kc.releaseBufferMemory(60)
+	c.Check(kc.reserveBufferMemory(60), Equals, true)
+	c.Check(uploadBufferSize(0), Equals, int64(BLOCKSIZE))
+	c.Check(uploadBufferSize(3), Equals, int64(3))
+}
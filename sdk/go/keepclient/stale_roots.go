@@ -0,0 +1,87 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// Number of consecutive DNS or connection failures after which a
+// discovered service root is considered stale: it is removed from
+// the cached services list, and the list is fetched again.
+var staleRootThreshold = 3
+
+var (
+	dialFailures    = map[string]int{} // service root => consecutive failures
+	dialFailuresMtx sync.Mutex
+)
+
+// isDialError returns true if err indicates the service could not
+// be reached at all (DNS lookup or connection failure), as opposed
+// to a failure after connecting.
+func isDialError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		// Caller gave up, which says nothing about the
+		// service.
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// noteRequestResult updates the failure count for the given service
+// root, given the error (possibly nil) returned by the HTTP client
+// for a request to it. When the count reaches staleRootThreshold,
+// the root is purged from the services discovery cache.
+//
+// Roots that were not found by service discovery (e.g., from
+// ARVADOS_KEEP_SERVICES or the cluster config) are never purged.
+func (kc *KeepClient) noteRequestResult(root string, err error) {
+	dialFailuresMtx.Lock()
+	if !isDialError(err) {
+		delete(dialFailures, root)
+		dialFailuresMtx.Unlock()
+		return
+	}
+	dialFailures[root]++
+	stale := dialFailures[root] >= staleRootThreshold
+	if stale {
+		delete(dialFailures, root)
+	}
+	dialFailuresMtx.Unlock()
+	if stale {
+		kc.purgeStaleRoot(root)
+	}
+}
+
+// purgeStaleRoot removes root from the services discovery cache
+// entry used by kc, and triggers a new discovery.
+func (kc *KeepClient) purgeStaleRoot(root string) {
+	if kc.disableDiscovery || kc.Arvados.KeepServiceURIs != nil {
+		return
+	}
+	svcListCacheMtx.Lock()
+	ent, ok := svcListCache[kc.svcListCacheKey()]
+	svcListCacheMtx.Unlock()
+	if !ok {
+		return
+	}
+	if kc.Arvados.Logger != nil {
+		kc.Arvados.Logger.Warnf("keep service %s is unreachable, refreshing services list", root)
+	} else {
+		log.Printf("WARNING: keep service %s is unreachable, refreshing services list", root)
+	}
+	// Don't block the caller if the cache entry is waiting for
+	// a fetch in progress.
+	go func() { ent.purge <- root }()
+}
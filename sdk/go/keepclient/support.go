@@ -10,6 +10,7 @@ import (
 	"crypto/md5"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -31,6 +32,15 @@ type keepService struct {
 	ReadOnly bool   `json:"read_only"`
 }
 
+// url returns the service root URL for the service.
+func (svc keepService) url() string {
+	scheme := "http"
+	if svc.SSL {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, svc.Hostname, svc.Port)
+}
+
 // Md5String returns md5 hash for the bytes in the given string
 func Md5String(s string) string {
 	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
@@ -40,6 +50,18 @@ type svcList struct {
 	Items []keepService `json:"items"`
 }
 
+// without returns a copy of the list with the services whose root
+// URL is root removed.
+func (sl svcList) without(root string) svcList {
+	var out svcList
+	for _, svc := range sl.Items {
+		if svc.url() != root {
+			out.Items = append(out.Items, svc)
+		}
+	}
+	return out
+}
+
 type uploadStatus struct {
 	err            error
 	url            string
@@ -49,13 +71,15 @@ type uploadStatus struct {
 	response       string
 }
 
-func (kc *KeepClient) uploadToKeepServer(host string, hash string, classesTodo []string, body io.Reader,
-	uploadStatusChan chan<- uploadStatus, expectedLength int, reqid string) {
+func (kc *KeepClient) uploadToKeepServer(ctx context.Context, host string, hash string, classesTodo []string, signature string, body io.Reader,
+	uploadStatusChan chan<- uploadStatus, expectedLength int, reqid string, ss ServiceSet) {
 
 	var req *http.Request
 	var err error
 	var url = fmt.Sprintf("%s/%s", host, hash)
-	if req, err = http.NewRequest("PUT", url, nil); err != nil {
+	ctx, cancel := ss.requestContext(ctx)
+	defer cancel()
+	if req, err = http.NewRequestWithContext(ctx, "PUT", url, nil); err != nil {
 		kc.debugf("[%s] Error creating request: PUT %s error: %s", reqid, url, err)
 		uploadStatusChan <- uploadStatus{err, url, 0, 0, nil, ""}
 		return
@@ -70,16 +94,30 @@ func (kc *KeepClient) uploadToKeepServer(host string, hash string, classesTodo [
 		// to be empty, so don't set req.Body.
 	}
 
+	token, err := kc.apiToken(req.Context())
+	if err != nil {
+		kc.debugf("[%s] Error getting token: PUT %s error: %s", reqid, url, err)
+		uploadStatusChan <- uploadStatus{err, url, 0, 0, nil, ""}
+		return
+	}
 	req.Header.Add("X-Request-Id", reqid)
-	req.Header.Add("Authorization", "Bearer "+kc.Arvados.ApiToken)
+	req.Header.Add("Authorization", "Bearer "+token)
 	req.Header.Add("Content-Type", "application/octet-stream")
 	req.Header.Add(XKeepDesiredReplicas, fmt.Sprint(kc.Want_replicas))
+	if kc.Priority != "" {
+		req.Header.Add(XKeepPriority, kc.Priority)
+	}
 	if len(classesTodo) > 0 {
 		req.Header.Add(XKeepStorageClasses, strings.Join(classesTodo, ", "))
 	}
+	if signature != "" {
+		req.Header.Add(XKeepSignature, signature)
+	}
 
 	var resp *http.Response
-	if resp, err = kc.httpClient().Do(req); err != nil {
+	resp, err = kc.httpClient().Do(req)
+	kc.noteRequestResult(host, err)
+	if err != nil {
 		kc.debugf("[%s] Upload failed: %s error: %s", reqid, url, err)
 		uploadStatusChan <- uploadStatus{err, url, 0, 0, nil, err.Error()}
 		return
@@ -118,6 +156,30 @@ func (kc *KeepClient) uploadToKeepServer(host string, hash string, classesTodo [
 func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWriteOptions) (arvados.BlockWriteResponse, error) {
 	var resp arvados.BlockWriteResponse
 	var getReader func() io.Reader
+	// If non-nil, release is called after the last upload
+	// finishes reading from getReader().
+	var release func()
+	// The number of active writers
+	active := 0
+	// Used to communicate status from the upload goroutines
+	uploadStatusChan := make(chan uploadStatus)
+	defer func() {
+		// Wait for any abandoned uploads (e.g., we started
+		// two uploads and the first replied with replicas=2)
+		// to finish before closing the status channel and
+		// releasing the data buffer.
+		go func() {
+			for active > 0 {
+				<-uploadStatusChan
+				active--
+			}
+			close(uploadStatusChan)
+			if release != nil {
+				release()
+			}
+		}()
+	}()
+
 	if req.Data == nil && req.Reader == nil {
 		return resp, errors.New("invalid BlockWriteOptions: Data and Reader are both nil")
 	}
@@ -127,6 +189,13 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 	if req.DataSize > BLOCKSIZE || len(req.Data) > BLOCKSIZE {
 		return resp, ErrOversizeBlock
 	}
+	token, err := kc.apiToken(ctx)
+	if err != nil {
+		return resp, err
+	}
+	if err := kc.checkWritableToken(token); err != nil {
+		return resp, err
+	}
 	if req.Data != nil {
 		if req.DataSize > len(req.Data) {
 			return resp, errors.New("invalid BlockWriteOptions: DataSize > len(Data)")
@@ -135,7 +204,8 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 			req.DataSize = len(req.Data)
 		}
 		getReader = func() io.Reader { return bytes.NewReader(req.Data[:req.DataSize]) }
-	} else {
+	} else if bufsize := uploadBufferSize(req.DataSize); kc.reserveBufferMemory(bufsize) {
+		release = func() { kc.releaseBufferMemory(bufsize) }
 		buf := asyncbuf.NewBuffer(make([]byte, 0, req.DataSize))
 		reader := req.Reader
 		if req.Hash != "" {
@@ -146,6 +216,26 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 			buf.CloseWithError(err)
 		}()
 		getReader = buf.NewReader
+	} else {
+		// Memory budget exhausted: spool the data to disk,
+		// and have each upload read it back from there.
+		reader := req.Reader
+		var h hash.Hash
+		if req.Hash != "" {
+			reader = HashCheckingReader{req.Reader, md5.New(), req.Hash}
+		} else {
+			h = md5.New()
+		}
+		f, n, err := kc.spoolBlock(reader, h)
+		if err != nil {
+			return resp, err
+		}
+		release = func() { f.Close() }
+		if h != nil {
+			req.Hash = fmt.Sprintf("%x", h.Sum(nil))
+		}
+		req.DataSize = int(n)
+		getReader = func() io.Reader { return io.NewSectionReader(f, 0, n) }
 	}
 	if req.Hash == "" {
 		m := md5.New()
@@ -168,33 +258,17 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 	if req.RequestID == "" {
 		req.RequestID = kc.getRequestID()
 	}
+	ss := kc.writeServices()
 	if req.Attempts == 0 {
-		req.Attempts = 1 + kc.Retries
+		req.Attempts = 1 + ss.Retries
 	}
 
 	// Calculate the ordering for uploading to servers
-	sv := NewRootSorter(kc.WritableLocalRoots(), req.Hash).GetSortedRoots()
+	sv := NewRootSorter(ss.Roots, req.Hash).GetSortedRoots()
 
 	// The next server to try contacting
 	nextServer := 0
 
-	// The number of active writers
-	active := 0
-
-	// Used to communicate status from the upload goroutines
-	uploadStatusChan := make(chan uploadStatus)
-	defer func() {
-		// Wait for any abandoned uploads (e.g., we started
-		// two uploads and the first replied with replicas=2)
-		// to finish before closing the status channel.
-		go func() {
-			for active > 0 {
-				<-uploadStatusChan
-			}
-			close(uploadStatusChan)
-		}()
-	}()
-
 	replicasTodo := map[string]int{}
 	for _, c := range req.StorageClasses {
 		replicasTodo[c] = req.Replicas
@@ -206,12 +280,17 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 		replicasPerThread = req.Replicas
 	}
 
-	delay := delayCalculator{InitialMaxDelay: kc.RetryDelay}
+	// With WriteStrategyAdaptive, the number of uploads allowed
+	// so far (see writeConcurrency).
+	adaptiveLimit := 1
+
+	delay := delayCalculator{InitialMaxDelay: ss.RetryDelay}
 	retriesRemaining := req.Attempts
 	var retryServers []string
 
 	lastError := make(map[string]string)
 	trackingClasses := len(replicasTodo) > 0
+	classesReported := true
 
 	for retriesRemaining > 0 {
 		retriesRemaining--
@@ -238,11 +317,12 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 				// replicasTodo, we're done.
 				break
 			}
-			for active*replicasPerThread < maxConcurrency {
+			limit := kc.writeConcurrency(maxConcurrency, replicasPerThread, adaptiveLimit)
+			for active < limit {
 				// Start some upload requests
 				if nextServer < len(sv) {
 					kc.debugf("[%s] Begin upload %s to %s", req.RequestID, req.Hash, sv[nextServer])
-					go kc.uploadToKeepServer(sv[nextServer], req.Hash, classesTodo, getReader(), uploadStatusChan, req.DataSize, req.RequestID)
+					go kc.uploadToKeepServer(ctx, sv[nextServer], req.Hash, classesTodo, writeSignatureHeader(req.Unsigned, req.SignatureTTL), getReader(), uploadStatusChan, req.DataSize, req.RequestID, ss)
 					nextServer++
 					active++
 				} else {
@@ -264,7 +344,22 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 			}
 
 			// Wait for something to happen.
-			status := <-uploadStatusChan
+			var status uploadStatus
+			if kc.WriteStrategy == WriteStrategyAdaptive && active < maxConcurrency && nextServer < len(sv) {
+				// If no upload finishes soon, start
+				// another one.
+				timer := time.NewTimer(kc.adaptiveWriteDelay())
+				select {
+				case status = <-uploadStatusChan:
+					timer.Stop()
+				case <-timer.C:
+					kc.debugf("[%s] No response after %s, adding an upload", req.RequestID, kc.adaptiveWriteDelay())
+					adaptiveLimit++
+					continue
+				}
+			} else {
+				status = <-uploadStatusChan
+			}
 			active--
 
 			if status.statusCode == http.StatusOK {
@@ -277,8 +372,13 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 					// are satisfied; just rely on
 					// total # replicas.
 					trackingClasses = false
+					classesReported = false
 				}
 				for className, replicas := range status.classesStored {
+					if resp.StorageClasses == nil {
+						resp.StorageClasses = map[string]int{}
+					}
+					resp.StorageClasses[className] += replicas
 					if replicasTodo[className] > replicas {
 						replicasTodo[className] -= replicas
 					} else {
@@ -308,9 +408,44 @@ func (kc *KeepClient) httpBlockWrite(ctx context.Context, req arvados.BlockWrite
 		}
 	}
 
+	if !classesReported {
+		// Counts are incomplete if any server didn't report
+		// storage classes.
+		resp.StorageClasses = nil
+	}
 	return resp, nil
 }
 
+// writeConcurrency returns the maximum number of concurrent uploads
+// when maxConcurrency replicas remain to be written, according to
+// kc.WriteStrategy. replicasPerThread is the number of replicas each
+// server is expected to store, and adaptiveLimit is the number of
+// uploads the adaptive strategy has allowed so far.
+func (kc *KeepClient) writeConcurrency(maxConcurrency, replicasPerThread, adaptiveLimit int) int {
+	switch kc.WriteStrategy {
+	case WriteStrategySequential:
+		return 1
+	case WriteStrategyParallel:
+		return maxConcurrency
+	case WriteStrategyAdaptive:
+		if adaptiveLimit < maxConcurrency {
+			return adaptiveLimit
+		}
+		return maxConcurrency
+	default:
+		// Enough uploads to write the remaining replicas if
+		// each server stores replicasPerThread.
+		return (maxConcurrency + replicasPerThread - 1) / replicasPerThread
+	}
+}
+
+func (kc *KeepClient) adaptiveWriteDelay() time.Duration {
+	if kc.AdaptiveWriteDelay > 0 {
+		return kc.AdaptiveWriteDelay
+	}
+	return DefaultAdaptiveWriteDelay
+}
+
 func parseStorageClassesConfirmedHeader(hdr string) (map[string]int, error) {
 	if hdr == "" {
 		return nil, nil
@@ -0,0 +1,127 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+const (
+	// How long to remember whether a token can write.
+	tokenCheckTTL = time.Hour
+
+	// How long to wait before asking again after the API server
+	// could not tell us.
+	tokenCheckErrorTTL = time.Minute
+
+	// Maximum number of tokens to remember.
+	tokenCheckMaxEntries = 1000
+)
+
+// ReadOnlyTokenError is returned by block write methods when the API
+// token is known to be unable to write data, i.e., it belongs to the
+// anonymous user, or its scopes only allow GET and HEAD requests. It
+// is returned before any data is sent to Keep services.
+type ReadOnlyTokenError struct {
+	// The token's owner (e.g., "zzzzz-tpzed-anonymouspublic").
+	OwnerUUID string
+	// The token's scopes.
+	Scopes []string
+	// True if the token belongs to the anonymous user.
+	Anonymous bool
+}
+
+func (e *ReadOnlyTokenError) Error() string {
+	if e.Anonymous {
+		return "cannot write to Keep using the anonymous user token"
+	}
+	return fmt.Sprintf("cannot write to Keep using a read-only token (owner %s, scopes %q)", e.OwnerUUID, e.Scopes)
+}
+
+// Temporary implements Error. Retrying with the same token will not
+// help.
+func (*ReadOnlyTokenError) Temporary() bool { return false }
+
+func (*ReadOnlyTokenError) HTTPStatus() int { return http.StatusForbidden }
+
+type tokenCheckResult struct {
+	err     error // nil, or a *ReadOnlyTokenError
+	expires time.Time
+}
+
+var (
+	tokenChecks    = map[string]tokenCheckResult{}
+	tokenChecksMtx sync.Mutex
+)
+
+// checkWritableToken returns a *ReadOnlyTokenError if the API server
+// reports that the given token cannot be used to write data.
+//
+// If the API server cannot be reached, or does not recognize the
+// token, the write is allowed to proceed: in that case, the Keep
+// services are the authority on whether the token is acceptable.
+//
+// Results are cached (across all KeepClients) so the API server is
+// consulted at most once per token per tokenCheckTTL.
+func (kc *KeepClient) checkWritableToken(token string) error {
+	key := kc.Arvados.ApiServer + "\x00" + token
+	now := time.Now()
+	tokenChecksMtx.Lock()
+	cached, ok := tokenChecks[key]
+	tokenChecksMtx.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.err
+	}
+
+	arv := *kc.Arvados
+	arv.ApiToken = token
+	var auth arvados.APIClientAuthorization
+	err := arv.Call("GET", "api_client_authorizations", "", "current", nil, &auth)
+	result := tokenCheckResult{expires: now.Add(tokenCheckTTL)}
+	if err != nil {
+		kc.debugf("could not check whether token can write: %s", err)
+		result.expires = now.Add(tokenCheckErrorTTL)
+	} else if strings.HasSuffix(auth.OwnerUUID, "-tpzed-anonymouspublic") {
+		result.err = &ReadOnlyTokenError{OwnerUUID: auth.OwnerUUID, Scopes: auth.Scopes, Anonymous: true}
+	} else if readOnlyScopes(auth.Scopes) {
+		result.err = &ReadOnlyTokenError{OwnerUUID: auth.OwnerUUID, Scopes: auth.Scopes}
+	}
+
+	tokenChecksMtx.Lock()
+	defer tokenChecksMtx.Unlock()
+	if len(tokenChecks) >= tokenCheckMaxEntries {
+		for k, r := range tokenChecks {
+			if now.After(r.expires) {
+				delete(tokenChecks, k)
+			}
+		}
+		if len(tokenChecks) >= tokenCheckMaxEntries {
+			tokenChecks = map[string]tokenCheckResult{}
+		}
+	}
+	tokenChecks[key] = result
+	return result.err
+}
+
+// readOnlyScopes returns true if the given token scopes only permit
+// GET and HEAD requests. An empty list is treated as unrestricted,
+// for compatibility with older API servers.
+func readOnlyScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		if scope == "all" || !(strings.HasPrefix(scope, "GET ") || strings.HasPrefix(scope, "HEAD ")) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StandaloneSuite) TestReadOnlyToken(c *C) {
+	auths := map[string]arvados.APIClientAuthorization{
+		"anon-token":       {OwnerUUID: "zzzzz-tpzed-anonymouspublic", Scopes: []string{"GET /"}},
+		"readonly-token":   {OwnerUUID: "zzzzz-tpzed-xurymjxw79nv3jz", Scopes: []string{"GET /arvados/v1/collections", "HEAD /"}},
+		"writable-token":   {OwnerUUID: "zzzzz-tpzed-xurymjxw79nv3jz", Scopes: []string{"all"}},
+		"legacy-token":     {OwnerUUID: "zzzzz-tpzed-xurymjxw79nv3jz"},
+		"restricted-token": {OwnerUUID: "zzzzz-tpzed-xurymjxw79nv3jz", Scopes: []string{"GET /", "POST /arvados/v1/collections"}},
+	}
+	var apiCalls int64
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/arvados/v1/api_client_authorizations/current" {
+			http.NotFound(w, req)
+			return
+		}
+		atomic.AddInt64(&apiCalls, 1)
+		auth, ok := auths[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(auth)
+	}))
+	defer api.Close()
+
+	var puts int64
+	ks := RunFakeKeepServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&puts, 1)
+		fmt.Fprintf(w, "%x+3", md5.Sum([]byte("foo")))
+	}))
+	defer ks.listener.Close()
+
+	arv := &arvadosclient.ArvadosClient{
+		Scheme:      "https",
+		ApiServer:   strings.TrimPrefix(api.URL, "https://"),
+		ApiInsecure: true,
+		Retries:     2,
+	}
+	kc := New(arv)
+	kc.Want_replicas = 1
+	kc.DiskCacheSize = DiskCacheDisabled
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, map[string]string{"x": ks.url}, nil)
+
+	for _, trial := range []struct {
+		token     string
+		anonymous bool
+		readOnly  bool
+	}{
+		{"anon-token", true, true},
+		{"readonly-token", false, true},
+		{"writable-token", false, false},
+		{"legacy-token", false, false},
+		{"restricted-token", false, false},
+		{"unknown-token", false, false},
+	} {
+		c.Logf("trial: %+v", trial)
+		arv.ApiToken = trial.token
+		atomic.StoreInt64(&puts, 0)
+		_, _, err := kc.PutB([]byte("foo"))
+		if !trial.readOnly {
+			c.Check(err, IsNil)
+			c.Check(atomic.LoadInt64(&puts), Equals, int64(1))
+			continue
+		}
+		c.Check(atomic.LoadInt64(&puts), Equals, int64(0))
+		rote, ok := err.(*ReadOnlyTokenError)
+		if c.Check(ok, Equals, true, Commentf("err %T %v", err, err)) {
+			c.Check(rote.Anonymous, Equals, trial.anonymous)
+			c.Check(rote.Temporary(), Equals, false)
+			c.Check(rote.HTTPStatus(), Equals, http.StatusForbidden)
+		}
+	}
+
+	// Results are cached, including for the token the API server
+	// did not recognize.
+	calls := atomic.LoadInt64(&apiCalls)
+	c.Check(calls, Equals, int64(6))
+	for _, token := range []string{"anon-token", "writable-token", "unknown-token"} {
+		arv.ApiToken = token
+		kc.PutB([]byte("foo"))
+	}
+	c.Check(atomic.LoadInt64(&apiCalls), Equals, calls)
+
+	// The token from TokenProvider is checked, not
+	// Arvados.ApiToken.
+	arv.ApiToken = "writable-token"
+	kc.TokenProvider = func(ctx context.Context) (string, error) { return "readonly-token", nil }
+	_, _, err := kc.PutB([]byte("foo"))
+	c.Check(err, FitsTypeOf, &ReadOnlyTokenError{})
+}
@@ -105,11 +105,20 @@ class Blob
     end
     blob_signature_ttl = Rails.configuration.Collections.BlobSigningTTL.to_i.to_s(16)
 
-    my_signature =
-      generate_signature((opts[:key] or Rails.configuration.Collections.BlobSigningKey),
-                         blob_hash, opts[:api_token], timestamp, blob_signature_ttl)
-
-    if my_signature != given_signature
+    # Unless the caller specifies a key, accept signatures made with
+    # the current key or any of the previous keys, so locators
+    # signed before a key rotation remain valid until they expire.
+    keys = if opts[:key]
+             [opts[:key]]
+           else
+             [Rails.configuration.Collections.BlobSigningKey] +
+               (Rails.configuration.Collections.PreviousBlobSigningKeys || []).reject(&:blank?)
+           end
+
+    valid = keys.any? do |key|
+      generate_signature(key, blob_hash, opts[:api_token], timestamp, blob_signature_ttl) == given_signature
+    end
+    if !valid
       raise Blob::InvalidSignatureError.new 'Signature is invalid.'
     end
 
@@ -123,6 +123,25 @@ class BlobTest < ActiveSupport::TestCase
     end
   end
 
+  test 'signed with previous key' do
+    oldkey = @@key + 'old'
+    signed = Blob.sign_locator @@blob_locator, api_token: @@api_token, key: oldkey
+    Rails.configuration.Collections.BlobSigningKey = @@key
+    Rails.configuration.Collections.PreviousBlobSigningKeys = []
+    assert_raise Blob::InvalidSignatureError do
+      Blob.verify_signature!(signed, api_token: @@api_token)
+    end
+    Rails.configuration.Collections.PreviousBlobSigningKeys = ['otherkey', oldkey]
+    assert_equal true, Blob.verify_signature!(signed, api_token: @@api_token)
+    # A key given by the caller overrides the configured keys.
+    assert_raise Blob::InvalidSignatureError do
+      Blob.verify_signature!(signed, api_token: @@api_token, key: @@key)
+    end
+    # New signatures use the current key.
+    resigned = Blob.sign_locator @@blob_locator, api_token: @@api_token
+    assert_equal true, Blob.verify_signature!(resigned, api_token: @@api_token, key: @@key)
+  end
+
   test 'signature changes when ttl changes' do
     signed = Blob.sign_locator @@known_locator, {
       api_token: @@known_token,
@@ -50,6 +50,13 @@ type Balancer struct {
 	ChunkPrefix    string
 	LostBlocksFile string
 
+	// Blocks smaller than SmallBlockSize need
+	// SmallBlockExtraReplicas more replicas than the collections
+	// referencing them ask for (see
+	// Collections.SmallBlockExtraReplicas).
+	SmallBlockSize          int
+	SmallBlockExtraReplicas int
+
 	*BlockStateMap
 	KeepServices       map[string]*KeepService
 	DefaultReplication int
@@ -529,6 +536,23 @@ func (bal *Balancer) addCollection(coll arvados.Collection) error {
 	if bal.LostBlocksFile != "" {
 		pdh = coll.PortableDataHash
 	}
+	if bal.SmallBlockExtraReplicas > 0 && repl > 0 {
+		// Split out the small blocks, which get extra
+		// replicas.
+		var small []arvados.SizedDigest
+		large := blkids[:0:0]
+		for _, blkid := range blkids {
+			if blkid.Size() < int64(bal.SmallBlockSize) {
+				small = append(small, blkid)
+			} else {
+				large = append(large, blkid)
+			}
+		}
+		if len(small) > 0 {
+			bal.BlockStateMap.IncreaseDesired(pdh, coll.StorageClassesDesired, repl+bal.SmallBlockExtraReplicas, small)
+			blkids = large
+		}
+	}
 	bal.BlockStateMap.IncreaseDesired(pdh, coll.StorageClassesDesired, repl, blkids)
 	return nil
 }
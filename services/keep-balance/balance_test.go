@@ -746,6 +746,38 @@ func (bal *balancerSuite) TestChangeStorageClasses(c *check.C) {
 		current: slots{0, 1}})
 }
 
+func (bal *balancerSuite) TestSmallBlockExtraReplicas(c *check.C) {
+	bal.BlockStateMap = NewBlockStateMap()
+	bal.DefaultReplication = 2
+	bal.SmallBlockSize = 1024
+	bal.SmallBlockExtraReplicas = 1
+	defer func() {
+		bal.SmallBlockSize = 0
+		bal.SmallBlockExtraReplicas = 0
+	}()
+	small := arvados.SizedDigest("acbd18db4cc2f85cedef654fccc4a4d8+3")
+	large := arvados.SizedDigest("37b51d194a7513e45b56f6524f2d51f2+1024")
+	err := bal.addCollection(arvados.Collection{
+		UUID:         "zzzzz-4zz18-111111111111111",
+		ManifestText: ". " + string(small) + " " + string(large) + " 0:1027:file\n",
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(bal.BlockStateMap.get(small).Desired, check.DeepEquals, map[string]int{"default": 3})
+	c.Check(bal.BlockStateMap.get(large).Desired, check.DeepEquals, map[string]int{"default": 2})
+
+	// Collections with replication_desired=0 don't get extra
+	// replicas.
+	zero := 0
+	bal.BlockStateMap = NewBlockStateMap()
+	err = bal.addCollection(arvados.Collection{
+		UUID:               "zzzzz-4zz18-222222222222222",
+		ManifestText:       ". " + string(small) + " 0:3:file\n",
+		ReplicationDesired: &zero,
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(bal.BlockStateMap.get(small).Desired, check.DeepEquals, map[string]int{"default": 0})
+}
+
 // Clear all servers' changesets, balance a single block, and verify
 // the appropriate changes for that block have been added to the
 // changesets.
@@ -823,7 +855,7 @@ func (bal *balancerSuite) replList(knownBlockID int, order slots) (repls []Repli
 		n := nextMnt[srv]
 		nextMnt[srv] = (n + 1) % len(srv.mounts)
 
-		repls = append(repls, Replica{srv.mounts[n], mtime})
+		repls = append(repls, Replica{KeepMount: srv.mounts[n], Mtime: mtime})
 		mtime++
 	}
 	return
@@ -16,6 +16,7 @@ import (
 type Replica struct {
 	*KeepMount
 	Mtime int64
+	Atime int64 // approximate time of last read, or 0 if unknown
 }
 
 // BlockState indicates the desired storage class and number of
@@ -116,6 +117,7 @@ func (bsm *BlockStateMap) AddReplicas(mnt *KeepMount, idx []arvados.KeepServiceI
 		bsm.get(ent.SizedDigest).addReplica(Replica{
 			KeepMount: mnt,
 			Mtime:     ent.Mtime,
+			Atime:     ent.Atime,
 		})
 	}
 }
@@ -86,6 +86,9 @@ func (srv *Server) runOnce(ctx context.Context) (*Balancer, error) {
 		Metrics:        srv.Metrics,
 		LostBlocksFile: srv.Cluster.Collections.BlobMissingReport,
 		ChunkPrefix:    srv.RunOptions.ChunkPrefix,
+
+		SmallBlockSize:          int(srv.Cluster.Collections.SmallBlockSize),
+		SmallBlockExtraReplicas: srv.Cluster.Collections.SmallBlockExtraReplicas,
 	}
 	var err error
 	srv.RunOptions, err = bal.Run(ctx, srv.ArvClient, srv.Cluster, srv.RunOptions)
@@ -5,6 +5,7 @@
 package keepweb
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"sort"
@@ -29,6 +30,11 @@ type cache struct {
 	setupOnce sync.Once
 	mtx       sync.Mutex
 
+	// User records are shared by all sessions, so a session
+	// that is pruned and recreated doesn't need to fetch its
+	// user record again.
+	identities arvados.IdentityCache
+
 	chPruneSessions chan struct{}
 }
 
@@ -135,6 +141,7 @@ func (sess *cachedSession) Release() {
 func (c *cache) setup() {
 	var err error
 	c.sessions = map[string]*cachedSession{}
+	c.identities.TTL = c.cluster.Collections.WebDAVCache.TTL.Duration()
 	if err != nil {
 		panic(err)
 	}
@@ -191,6 +198,7 @@ func (c *cache) checkout(token string) (*cachedSession, error) {
 		}
 		kc := keepclient.New(arvadosclient)
 		kc.DiskCacheSize = c.cluster.Collections.WebDAVCache.DiskCacheSize
+		kc.Priority = keepclient.PriorityInteractive
 		sess = &cachedSession{
 			cache:         c,
 			client:        client,
@@ -224,7 +232,7 @@ func (c *cache) GetSession(token string) (arvados.CustomFileSystem, *cachedSessi
 		// using the new fs).
 		sess.inuse.Lock()
 		if !sess.userLoaded || refresh {
-			err := sess.client.RequestAndDecode(&sess.user, "GET", "arvados/v1/users/current", nil, nil)
+			user, err := c.identities.CurrentUser(context.TODO(), sess.client, token)
 			if he := errorWithHTTPStatus(nil); errors.As(err, &he) && he.HTTPStatus() == http.StatusForbidden {
 				// token is OK, but "get user id" api is out
 				// of scope -- use existing/expired info if
@@ -233,6 +241,8 @@ func (c *cache) GetSession(token string) (arvados.CustomFileSystem, *cachedSessi
 				sess.inuse.Unlock()
 				sess.mtx.RUnlock()
 				return nil, nil, nil, err
+			} else {
+				sess.user = user
 			}
 			sess.userLoaded = true
 		}
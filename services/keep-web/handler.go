@@ -30,6 +30,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/auth"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
 	"github.com/gotd/contrib/http_range"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/webdav"
@@ -800,6 +801,9 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	}
 	if r.Method == http.MethodGet {
 		applyContentDispositionHdr(w, r, basename, attachment)
+		if r.Header.Get("Range") != "" {
+			h.prefetchRange(r, session.keepclient, sessionFS, fstarget)
+		}
 	}
 	wh := &webdav.Handler{
 		Prefix: webdavPrefix,
@@ -808,6 +812,7 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 			Prefix:        fsprefix,
 			Writing:       writeMethod[r.Method],
 			AlwaysReadEOF: r.Method == "PROPFIND",
+			PartialReads:  true,
 		},
 		LockSystem: webdavfs.NoLockSystem,
 		Logger: func(r *http.Request, err error) {
@@ -1317,6 +1322,33 @@ func (h *handler) logUploadOrDownload(
 	}
 }
 
+// prefetchRange starts fetching the blocks needed to serve a
+// single-range request for a collection file into the disk cache, so
+// they are fetched in parallel rather than one at a time as the
+// webdav handler reaches them. It returns without waiting for the
+// blocks, and the prefetch stops when the request is done.
+func (h *handler) prefetchRange(r *http.Request, kc *keepclient.KeepClient, fs arvados.CustomFileSystem, path string) {
+	coll, filepath := h.determineCollection(fs, path)
+	if coll == nil || filepath == "" {
+		return
+	}
+	fi, err := fs.Stat(path)
+	if err != nil || fi.IsDir() {
+		return
+	}
+	ranges, err := http_range.ParseRange(r.Header.Get("Range"), fi.Size())
+	if err != nil || len(ranges) != 1 {
+		return
+	}
+	ctx := r.Context()
+	go func() {
+		err := kc.PrefetchFileRange(ctx, coll.ManifestText, filepath, ranges[0].Start, ranges[0].Length, 0)
+		if err != nil && ctx.Err() == nil {
+			ctxlog.FromContext(ctx).WithError(err).Debug("prefetch failed")
+		}
+	}()
+}
+
 func (h *handler) determineCollection(fs arvados.CustomFileSystem, path string) (*arvados.Collection, string) {
 	target := strings.TrimSuffix(path, "/")
 	for cut := len(target); cut >= 0; cut = strings.LastIndexByte(target, '/') {
@@ -5,13 +5,22 @@
 package keepweb
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"time"
 
+	"git.arvados.org/arvados.git/lib/webdavfs"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"golang.org/x/net/webdav"
 	check "gopkg.in/check.v1"
 )
 
@@ -92,3 +101,90 @@ func (s *IntegrationSuite) TestRanges(c *check.C) {
 		}
 	}
 }
+
+// pausingKeepGateway is a KeepGatewayStub whose BlockRead sends the
+// first pauseAfter bytes of the block, then waits for unpause to be
+// closed before sending the rest.
+type pausingKeepGateway struct {
+	*arvadostest.KeepGatewayStub
+	pauseAfter int
+	unpause    chan struct{}
+}
+
+func (kg *pausingKeepGateway) BlockRead(ctx context.Context, opts arvados.BlockReadOptions) (int, error) {
+	buf := bytes.NewBuffer(nil)
+	_, err := kg.KeepGatewayStub.BlockRead(ctx, arvados.BlockReadOptions{Locator: opts.Locator, WriteTo: buf})
+	if err != nil {
+		return 0, err
+	}
+	n, err := opts.WriteTo.Write(buf.Next(kg.pauseAfter))
+	if err != nil {
+		return n, err
+	}
+	select {
+	case <-kg.unpause:
+	case <-ctx.Done():
+		return n, ctx.Err()
+	}
+	n2, err := opts.WriteTo.Write(buf.Bytes())
+	return n + n2, err
+}
+
+// A range request starts returning data as soon as the requested
+// part of the block is in the disk cache, without waiting for the
+// rest of the block.
+func (s *UnitSuite) TestRangeRequestPartialCacheHit(c *check.C) {
+	blksize := 1000000
+	data := make([]byte, blksize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	backend := &pausingKeepGateway{
+		KeepGatewayStub: &arvadostest.KeepGatewayStub{},
+		pauseAfter:      blksize / 4,
+		unpause:         make(chan struct{}),
+	}
+	var unpauseOnce sync.Once
+	unpause := func() { unpauseOnce.Do(func() { close(backend.unpause) }) }
+	defer unpause()
+	locator := backend.Put(data)
+	cache := &arvados.DiskCache{
+		KeepGateway: backend,
+		MaxSize:     arvados.ByteSizeOrPercent(blksize * 4),
+		Dir:         c.MkDir(),
+		Logger:      ctxlog.TestLogger(c),
+	}
+	coll := arvados.Collection{ManifestText: fmt.Sprintf(". %s 0:%d:testdata.bin\n", locator, blksize)}
+	collfs, err := coll.FileSystem(&arvados.StubClient{}, cache)
+	c.Assert(err, check.IsNil)
+	srv := httptest.NewServer(&webdav.Handler{
+		FileSystem: &webdavfs.FS{FileSystem: collfs, PartialReads: true},
+		LockSystem: webdavfs.NoLockSystem,
+	})
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/testdata.bin", nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", blksize/8, blksize/2-1))
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	c.Check(resp.StatusCode, check.Equals, http.StatusPartialContent)
+
+	// The first part of the range is available before the
+	// backend finishes sending the block.
+	timer := time.AfterFunc(10*time.Second, func() {
+		c.Error("timed out waiting for first part of range")
+		unpause()
+	})
+	buf := make([]byte, blksize/4-blksize/8)
+	_, err = io.ReadFull(resp.Body, buf)
+	timer.Stop()
+	c.Check(err, check.IsNil)
+	c.Check(buf, check.DeepEquals, data[blksize/8:blksize/4])
+
+	unpause()
+	rest, err := io.ReadAll(resp.Body)
+	c.Check(err, check.IsNil)
+	c.Check(rest, check.DeepEquals, data[blksize/4:blksize/2])
+}
@@ -0,0 +1,118 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepproxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Size of the sample used to decide whether a block is worth
+// compressing.
+const compressionSampleSize = 1 << 16
+
+// Only compress if the sample shrinks to this fraction of its
+// original size or less.
+const compressionMaxRatio = 0.9
+
+// Content encodings keepproxy can use for block data, in the order
+// they are listed in the default config.
+var supportedEncodings = map[string]bool{"zstd": true, "gzip": true}
+
+// checkEncodings returns an error if the configured list of
+// encodings includes an unsupported encoding.
+func checkEncodings(encodings []string) error {
+	for _, enc := range encodings {
+		if !supportedEncodings[enc] {
+			return fmt.Errorf("unsupported encoding %q in Collections.KeepproxyCompression (supported: zstd, gzip)", enc)
+		}
+	}
+	return nil
+}
+
+// chooseEncoding returns the first of the given encodings that is
+// included in the request's Accept-Encoding header with a non-zero
+// qvalue, or "" if there is none.
+func chooseEncoding(req *http.Request, encodings []string) string {
+	accepted := map[string]bool{}
+	for _, hdr := range req.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(hdr, ",") {
+			params := strings.Split(enc, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			accepted[name] = true
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+						accepted[name] = false
+					}
+				}
+			}
+		}
+	}
+	for _, enc := range encodings {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
+
+// compressible peeks at the beginning of the data available from
+// bufr and reports whether compressing it is likely to be
+// worthwhile.
+func compressible(bufr *bufio.Reader) bool {
+	sample, _ := bufr.Peek(compressionSampleSize)
+	if len(sample) == 0 {
+		return false
+	}
+	cw := &countingWriter{}
+	zw, _ := gzip.NewWriterLevel(cw, gzip.BestSpeed)
+	zw.Write(sample)
+	zw.Close()
+	return float64(cw.n) <= float64(len(sample))*compressionMaxRatio
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// writeCompressed copies data from r to resp using the given
+// encoding ("zstd" or "gzip"), and returns the number of
+// uncompressed and compressed bytes written.
+func writeCompressed(resp http.ResponseWriter, r io.Reader, encoding string) (int64, int64, error) {
+	resp.Header().Del("Content-Length")
+	resp.Header().Set("Content-Encoding", encoding)
+	resp.Header().Add("Vary", "Accept-Encoding")
+	cw := &countingWriter{}
+	var zw io.WriteCloser
+	switch encoding {
+	case "zstd":
+		enc, err := zstd.NewWriter(io.MultiWriter(resp, cw), zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return 0, 0, err
+		}
+		zw = enc
+	default:
+		zw, _ = gzip.NewWriterLevel(io.MultiWriter(resp, cw), gzip.BestSpeed)
+	}
+	n, err := io.Copy(zw, r)
+	if err2 := zw.Close(); err == nil {
+		err = err2
+	}
+	return n, cw.n, err
+}
@@ -0,0 +1,91 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/klauspost/compress/zstd"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&compressionSuite{})
+
+type compressionSuite struct{}
+
+func (s *compressionSuite) TestChooseEncoding(c *C) {
+	for _, trial := range []struct {
+		hdr       string
+		encodings []string
+		expect    string
+	}{
+		{"", []string{"zstd", "gzip"}, ""},
+		{"identity", []string{"zstd", "gzip"}, ""},
+		{"gzip", []string{"zstd", "gzip"}, "gzip"},
+		{"deflate, gzip", []string{"zstd", "gzip"}, "gzip"},
+		{"gzip;q=0.5", []string{"zstd", "gzip"}, "gzip"},
+		{"gzip;q=0, identity", []string{"zstd", "gzip"}, ""},
+		{"br;q=1.0, gzip; q=0", []string{"zstd", "gzip"}, ""},
+		{"gzip, zstd", []string{"zstd", "gzip"}, "zstd"},
+		{"zstd, gzip", []string{"gzip", "zstd"}, "gzip"},
+		{"zstd;q=0, gzip", []string{"zstd", "gzip"}, "gzip"},
+		{"zstd, gzip", []string{"zstd"}, "zstd"},
+		{"zstd, gzip", nil, ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if trial.hdr != "" {
+			req.Header.Set("Accept-Encoding", trial.hdr)
+		}
+		c.Check(chooseEncoding(req, trial.encodings), Equals, trial.expect, Commentf("%q %q", trial.hdr, trial.encodings))
+	}
+}
+
+func (s *compressionSuite) TestCheckEncodings(c *C) {
+	c.Check(checkEncodings(nil), IsNil)
+	c.Check(checkEncodings([]string{"zstd", "gzip"}), IsNil)
+	c.Check(checkEncodings([]string{"gzip", "br"}), ErrorMatches, `unsupported encoding "br".*`)
+}
+
+func (s *compressionSuite) TestCompressible(c *C) {
+	random := make([]byte, 100000)
+	rand.Read(random)
+	c.Check(compressible(bufio.NewReaderSize(bytes.NewReader(random), compressionSampleSize)), Equals, false)
+	c.Check(compressible(bufio.NewReaderSize(bytes.NewReader(nil), compressionSampleSize)), Equals, false)
+	text := bytes.Repeat([]byte("foo bar baz\n"), 10000)
+	c.Check(compressible(bufio.NewReaderSize(bytes.NewReader(text), compressionSampleSize)), Equals, true)
+}
+
+func (s *compressionSuite) TestWriteCompressed(c *C) {
+	text := bytes.Repeat([]byte("foo bar baz\n"), 10000)
+	for _, encoding := range []string{"gzip", "zstd"} {
+		c.Logf("=== %s", encoding)
+		resp := httptest.NewRecorder()
+		resp.Header().Set("Content-Length", "120000")
+		n, wire, err := writeCompressed(resp, bytes.NewReader(text), encoding)
+		c.Check(err, IsNil)
+		c.Check(n, Equals, int64(len(text)))
+		c.Check(wire, Equals, int64(resp.Body.Len()))
+		c.Check(resp.Result().Header.Get("Content-Length"), Equals, "")
+		c.Check(resp.Result().Header.Get("Content-Encoding"), Equals, encoding)
+		var zr io.Reader
+		if encoding == "zstd" {
+			zr, err = zstd.NewReader(resp.Body)
+		} else {
+			zr, err = gzip.NewReader(resp.Body)
+		}
+		c.Assert(err, IsNil)
+		buf, err := ioutil.ReadAll(zr)
+		c.Check(err, IsNil)
+		c.Check(buf, DeepEquals, text)
+		c.Check(resp.Code, Equals, http.StatusOK)
+	}
+}
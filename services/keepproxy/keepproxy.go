@@ -5,6 +5,7 @@
 package keepproxy
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
@@ -133,12 +134,13 @@ func (h *proxyHandler) checkAuthorizationHeader(req *http.Request) (pass bool, t
 	arv := *h.KeepClient.Arvados
 	arv.ApiToken = tok
 	arv.RequestID = req.Header.Get("X-Request-Id")
-	user = &arvados.User{}
-	userCurrentError := arv.Call("GET", "users", "", "current", nil, user)
+	ctx := arvados.ContextWithRequestID(req.Context(), arv.RequestID)
+	currentUser, userCurrentError := h.identities.CurrentUser(ctx, h.apiClient, tok)
+	user = &currentUser
 	err = userCurrentError
 	if err != nil && op == "read" {
-		apiError, ok := err.(arvadosclient.APIServerError)
-		if ok && apiError.HttpStatusCode == http.StatusForbidden {
+		var se interface{ HTTPStatus() int }
+		if errors.As(err, &se) && se.HTTPStatus() == http.StatusForbidden {
 			// If it was a scoped "sharing" token it will
 			// return 403 instead of 401 for the current
 			// user check.  If it is a download operation
@@ -196,6 +198,11 @@ type proxyHandler struct {
 	timeout   time.Duration
 	transport *http.Transport
 	cluster   *arvados.Cluster
+
+	// Used to look up the users that own the tokens in
+	// incoming requests.
+	apiClient  *arvados.Client
+	identities arvados.IdentityCache
 }
 
 func newHandler(ctx context.Context, kc *keepclient.KeepClient, timeout time.Duration, cluster *arvados.Cluster) (service.Handler, error) {
@@ -224,6 +231,21 @@ func newHandler(ctx context.Context, kc *keepclient.KeepClient, timeout time.Dur
 		return nil, fmt.Errorf("Error from lru.New2Q: %v", err)
 	}
 
+	if err := checkEncodings(cluster.Collections.KeepproxyCompression); err != nil {
+		return nil, err
+	}
+
+	apiClient := &arvados.Client{
+		Client:           kc.Arvados.Client,
+		APIHost:          kc.Arvados.ApiServer,
+		Insecure:         kc.Arvados.ApiInsecure,
+		CABundle:         kc.Arvados.TransportConfig.CABundle,
+		Proxy:            kc.Arvados.TransportConfig.Proxy,
+		NoProxy:          kc.Arvados.TransportConfig.NoProxy,
+		TLSHostOverrides: kc.Arvados.TransportConfig.HostOverrides,
+		Timeout:          timeout,
+	}
+
 	h := &proxyHandler{
 		Handler:    rest,
 		KeepClient: kc,
@@ -233,7 +255,8 @@ func newHandler(ctx context.Context, kc *keepclient.KeepClient, timeout time.Dur
 			tokens:     cacheQ,
 			expireTime: 300,
 		},
-		cluster: cluster,
+		cluster:   cluster,
+		apiClient: apiClient,
 	}
 
 	rest.HandleFunc(`/{locator:[0-9a-f]{32}\+.*}`, h.Get).Methods("GET", "HEAD")
@@ -367,7 +390,17 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 		case "HEAD":
 			responseLength = 0
 		case "GET":
-			responseLength, err = io.Copy(resp, reader)
+			bufr := bufio.NewReaderSize(reader, compressionSampleSize)
+			if encoding := chooseEncoding(req, h.cluster.Collections.KeepproxyCompression); encoding != "" && compressible(bufr) {
+				var wireLength int64
+				responseLength, wireLength, err = writeCompressed(resp, bufr, encoding)
+				httpserver.SetResponseLogFields(req.Context(), logrus.Fields{
+					"contentEncoding": encoding,
+					"wireLength":      wireLength,
+				})
+			} else {
+				responseLength, err = io.Copy(resp, bufr)
+			}
 			if err == nil && expectLength > -1 && responseLength != expectLength {
 				err = errContentLengthMismatch
 			}
@@ -402,11 +435,12 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 	var status = http.StatusInternalServerError
 	var wroteReplicas int
 	var locatorOut string = "-"
+	var opts arvados.BlockWriteOptions
 
 	defer func() {
 		httpserver.SetResponseLogFields(req.Context(), logrus.Fields{
 			"expectLength":  expectLength,
-			"wantReplicas":  kc.Want_replicas,
+			"wantReplicas":  opts.Replicas,
 			"wroteReplicas": wroteReplicas,
 			"locator":       strings.SplitN(locatorOut, "+A", 2)[0],
 			"err":           err,
@@ -420,11 +454,9 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 
 	// Check if the client specified storage classes
 	if req.Header.Get(keepclient.XKeepStorageClasses) != "" {
-		var scl []string
 		for _, sc := range strings.Split(req.Header.Get(keepclient.XKeepStorageClasses), ",") {
-			scl = append(scl, strings.Trim(sc, " "))
+			opts.StorageClasses = append(opts.StorageClasses, strings.Trim(sc, " "))
 		}
-		kc.SetStorageClasses(scl)
 	}
 
 	_, err = fmt.Sscanf(req.Header.Get("Content-Length"), "%d", &expectLength)
@@ -469,7 +501,7 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 		var r int
 		_, err := fmt.Sscanf(desiredReplicas, "%d", &r)
 		if err == nil {
-			kc.Want_replicas = r
+			opts.Replicas = r
 		}
 	}
 
@@ -481,10 +513,14 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 			status = http.StatusInternalServerError
 			return
 		}
-		locatorOut, wroteReplicas, err = kc.PutB(bytes)
+		opts.Data = bytes
 	} else {
-		locatorOut, wroteReplicas, err = kc.PutHR(locatorIn, req.Body, expectLength)
+		opts.Hash = locatorIn
+		opts.Reader = req.Body
+		opts.DataSize = int(expectLength)
 	}
+	wrote, err := kc.BlockWrite(req.Context(), opts)
+	locatorOut, wroteReplicas = wrote.Locator, wrote.Replicas
 
 	// Tell the client how many successful PUTs we accomplished
 	resp.Header().Set(keepclient.XKeepReplicasStored, fmt.Sprintf("%d", wroteReplicas))
@@ -492,21 +528,21 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 	switch err.(type) {
 	case nil:
 		status = http.StatusOK
-		if len(kc.StorageClasses) > 0 {
+		if len(opts.StorageClasses) > 0 {
 			// A successful PUT request with storage classes means that all
 			// storage classes were fulfilled, so the client will get a
 			// confirmation via the X-Storage-Classes-Confirmed header.
-			hdr := ""
-			isFirst := true
-			for _, sc := range kc.StorageClasses {
-				if isFirst {
-					hdr = fmt.Sprintf("%s=%d", sc, wroteReplicas)
-					isFirst = false
-				} else {
-					hdr += fmt.Sprintf(", %s=%d", sc, wroteReplicas)
+			var confirmed []string
+			for _, sc := range opts.StorageClasses {
+				n, ok := wrote.StorageClasses[sc]
+				if !ok {
+					// Backend servers didn't
+					// report storage classes.
+					n = wroteReplicas
 				}
+				confirmed = append(confirmed, fmt.Sprintf("%s=%d", sc, n))
 			}
-			resp.Header().Set(keepclient.XKeepStorageClassesConfirmed, hdr)
+			resp.Header().Set(keepclient.XKeepStorageClassesConfirmed, strings.Join(confirmed, ", "))
 		}
 		_, err = io.WriteString(resp, locatorOut)
 	case keepclient.OversizeBlockError:
@@ -581,6 +617,9 @@ func (h *proxyHandler) Index(resp http.ResponseWriter, req *http.Request) {
 func (h *proxyHandler) makeKeepClient(req *http.Request) *keepclient.KeepClient {
 	kc := h.KeepClient.Clone()
 	kc.RequestID = req.Header.Get("X-Request-Id")
+	if prio := req.Header.Get(keepclient.XKeepPriority); prio != "" {
+		kc.Priority = prio
+	}
 	kc.HTTPClient = &proxyClient{
 		client: &http.Client{
 			Timeout:   h.timeout,
@@ -0,0 +1,209 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+// accessTimes tracks the approximate time each block was last read
+// (see Collections.BlobAccessTimeResolution).
+//
+// A nil *accessTimes is valid, and tracks nothing.
+type accessTimes struct {
+	resolution time.Duration
+	file       string
+	logger     logrus.FieldLogger
+
+	mtx   sync.Mutex
+	times map[[16]byte]int64 // md5 => unix nanoseconds
+	dirty bool
+}
+
+// newAccessTimes returns nil if access time tracking is disabled.
+// Otherwise, it loads previously saved access times, if any, and
+// starts a goroutine that saves them periodically and when ctx is
+// done.
+func newAccessTimes(ctx context.Context, cluster *arvados.Cluster, logger logrus.FieldLogger) *accessTimes {
+	resolution := cluster.Collections.BlobAccessTimeResolution.Duration()
+	if resolution <= 0 {
+		return nil
+	}
+	at := &accessTimes{
+		resolution: resolution,
+		file:       cluster.Collections.BlobAccessTimeFile,
+		logger:     logger,
+		times:      map[[16]byte]int64{},
+	}
+	if at.file == "" {
+		return at
+	}
+	if err := at.load(); err != nil && !os.IsNotExist(err) {
+		logger.WithError(err).Warnf("error loading block access times from %s", at.file)
+	}
+	go func() {
+		ticker := time.NewTicker(resolution)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				at.saveIfDirty()
+				return
+			case <-ticker.C:
+				at.saveIfDirty()
+			}
+		}
+	}()
+	return at
+}
+
+// touch records that the given block was read just now.
+func (at *accessTimes) touch(hash string) {
+	if at == nil {
+		return
+	}
+	var key [16]byte
+	if _, err := hex.Decode(key[:], []byte(hash)); err != nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	at.mtx.Lock()
+	defer at.mtx.Unlock()
+	if now-at.times[key] < int64(at.resolution) {
+		return
+	}
+	at.times[key] = now
+	at.dirty = true
+}
+
+// get returns the time the given block was last read, in
+// nanoseconds since the Unix epoch, or 0 if unknown.
+func (at *accessTimes) get(hash string) int64 {
+	if at == nil {
+		return 0
+	}
+	var key [16]byte
+	if _, err := hex.Decode(key[:], []byte(hash)); err != nil {
+		return 0
+	}
+	at.mtx.Lock()
+	defer at.mtx.Unlock()
+	return at.times[key]
+}
+
+// load reads access times from at.file. Each line is
+// "{hash} {timestamp}", in the same format as an index response.
+func (at *accessTimes) load() error {
+	f, err := os.Open(at.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	at.mtx.Lock()
+	defer at.mtx.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var key [16]byte
+		line := scanner.Bytes()
+		if len(line) < 34 || line[32] != ' ' {
+			return fmt.Errorf("malformed line %q", line)
+		}
+		if _, err := hex.Decode(key[:], line[:32]); err != nil {
+			return fmt.Errorf("malformed line %q: %w", line, err)
+		}
+		t, err := strconv.ParseInt(string(line[33:]), 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed line %q: %w", line, err)
+		}
+		if t > at.times[key] {
+			at.times[key] = t
+		}
+	}
+	return scanner.Err()
+}
+
+func (at *accessTimes) saveIfDirty() {
+	at.mtx.Lock()
+	dirty := at.dirty
+	at.mtx.Unlock()
+	if !dirty {
+		return
+	}
+	if err := at.save(); err != nil {
+		at.logger.WithError(err).Warnf("error saving block access times to %s", at.file)
+	}
+}
+
+// save writes all access times to a temporary file, then renames it
+// to at.file, so a crash never leaves a partially written file.
+func (at *accessTimes) save() error {
+	f, err := os.CreateTemp(filepath.Dir(at.file), "."+filepath.Base(at.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	buf := bufio.NewWriter(f)
+	at.mtx.Lock()
+	for key, t := range at.times {
+		fmt.Fprintf(buf, "%x %d\n", key, t)
+	}
+	at.dirty = false
+	at.mtx.Unlock()
+	if err = buf.Flush(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), at.file)
+}
+
+// atimeIndexWriter appends each block's access time (or 0 if
+// unknown) to the index lines written through it, so
+// "{hash}+{size} {mtime}\n" becomes "{hash}+{size} {mtime}
+// {atime}\n".
+type atimeIndexWriter struct {
+	writeTo io.Writer
+	at      *accessTimes
+	partial []byte
+}
+
+func (w *atimeIndexWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	var out bytes.Buffer
+	for {
+		eol := bytes.IndexByte(w.partial, '\n')
+		if eol < 0 {
+			break
+		}
+		line := w.partial[:eol]
+		out.Write(line)
+		if len(line) >= 32 {
+			fmt.Fprintf(&out, " %d", w.at.get(string(line[:32])))
+		}
+		out.WriteByte('\n')
+		w.partial = w.partial[eol+1:]
+	}
+	if out.Len() > 0 {
+		if _, err := w.writeTo.Write(out.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
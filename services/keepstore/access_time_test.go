@@ -0,0 +1,82 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&accessTimeSuite{})
+
+type accessTimeSuite struct {
+	cluster *arvados.Cluster
+}
+
+func (s *accessTimeSuite) SetUpTest(c *C) {
+	s.cluster = testCluster(c)
+	s.cluster.Collections.BlobAccessTimeResolution = arvados.Duration(time.Hour)
+	s.cluster.Collections.BlobAccessTimeFile = c.MkDir() + "/atime"
+}
+
+func (s *accessTimeSuite) TestDisabled(c *C) {
+	s.cluster.Collections.BlobAccessTimeResolution = 0
+	at := newAccessTimes(context.Background(), s.cluster, ctxlog.TestLogger(c))
+	c.Check(at, IsNil)
+	at.touch(fooHash)
+	c.Check(at.get(fooHash), Equals, int64(0))
+}
+
+func (s *accessTimeSuite) TestSaveAndLoad(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	at := newAccessTimes(ctx, s.cluster, ctxlog.TestLogger(c))
+	at.touch(fooHash)
+	at.touch("not a hash")
+	atime := at.get(fooHash)
+	c.Check(atime, Not(Equals), int64(0))
+	c.Check(at.get(barHash), Equals, int64(0))
+
+	// Access times are saved when ctx is cancelled.
+	cancel()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, err := os.Stat(s.cluster.Collections.BlobAccessTimeFile); err == nil {
+			break
+		}
+	}
+	buf, err := os.ReadFile(s.cluster.Collections.BlobAccessTimeFile)
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, fmt.Sprintf("%s %d\n", fooHash, atime))
+
+	at = newAccessTimes(context.Background(), s.cluster, ctxlog.TestLogger(c))
+	c.Check(at.get(fooHash), Equals, atime)
+}
+
+func (s *accessTimeSuite) TestIndexWriter(c *C) {
+	at := newAccessTimes(context.Background(), s.cluster, ctxlog.TestLogger(c))
+	at.times[[16]byte{0xac, 0xbd}] = 12345
+	var out bytes.Buffer
+	w := &atimeIndexWriter{writeTo: &out, at: at}
+	// Lines may be split across writes.
+	for _, chunk := range []string{
+		"acbd0000000000000000000000000000+3 100",
+		"0\n37b51d194a7513e45b56f6524f2d51f2+3 2000\nacbd",
+		"0000000000000000000000000000+3 3000\n",
+	} {
+		n, err := w.Write([]byte(chunk))
+		c.Check(err, IsNil)
+		c.Check(n, Equals, len(chunk))
+	}
+	c.Check(out.String(), Equals, ""+
+		"acbd0000000000000000000000000000+3 1000 12345\n"+
+		"37b51d194a7513e45b56f6524f2d51f2+3 2000 0\n"+
+		"acbd0000000000000000000000000000+3 3000 12345\n")
+}
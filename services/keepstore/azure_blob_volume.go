@@ -40,6 +40,7 @@ func newAzureBlobVolume(params newVolumeParams) (volume, error) {
 		logger:            params.Logger,
 		metrics:           params.MetricsVecs,
 		bufferPool:        params.BufferPool,
+		deleteVerifier:    params.DeleteVerifier,
 	}
 	err := json.Unmarshal(params.ConfigVolume.DriverParameters, &v)
 	if err != nil {
@@ -107,13 +108,14 @@ type azureBlobVolume struct {
 	WriteRaceInterval    arvados.Duration
 	WriteRacePollTime    arvados.Duration
 
-	cluster    *arvados.Cluster
-	volume     arvados.Volume
-	logger     logrus.FieldLogger
-	metrics    *volumeMetricsVecs
-	bufferPool *bufferPool
-	azClient   storage.Client
-	container  *azureContainer
+	cluster        *arvados.Cluster
+	volume         arvados.Volume
+	logger         logrus.FieldLogger
+	metrics        *volumeMetricsVecs
+	bufferPool     *bufferPool
+	deleteVerifier *deleteVerifier
+	azClient       storage.Client
+	container      *azureContainer
 }
 
 // singleSender is a single-attempt storage.Sender.
@@ -345,6 +347,39 @@ func (v *azureBlobVolume) BlockWrite(ctx context.Context, hash string, data []by
 	}
 }
 
+// BlockWriteStream writes a block while its data is being received.
+// If r returns an error, the request is aborted before the blob is
+// created.
+func (v *azureBlobVolume) BlockWriteStream(ctx context.Context, hash string, size int, r io.Reader) error {
+	// As in BlockWrite, send the data through a pipe so we can
+	// take it away from CreateBlockBlobFromReader if ctx is
+	// canceled.
+	bufr, bufw := io.Pipe()
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		_, err := io.Copy(bufw, r)
+		bufw.CloseWithError(err)
+	}()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- v.container.CreateBlockBlobFromReader(hash, size, bufr, nil)
+		bufr.CloseWithError(errStreamAborted)
+	}()
+	select {
+	case <-ctx.Done():
+		ctxlog.FromContext(ctx).Debugf("%s: taking CreateBlockBlobFromReader's input away: %s", v, ctx.Err())
+		bufw.CloseWithError(ctx.Err())
+		// Wait for the copy goroutine to finish its current
+		// read, so we don't read from r after returning.
+		<-copied
+		return ctx.Err()
+	case err := <-errChan:
+		<-copied
+		return err
+	}
+}
+
 // BlockTouch updates the last-modified property of a block blob.
 func (v *azureBlobVolume) BlockTouch(hash string) error {
 	trashed, metadata, err := v.checkTrashed(hash)
@@ -535,6 +570,10 @@ func (v *azureBlobVolume) EmptyTrash() {
 			return
 		}
 
+		if !v.deleteVerifier.okToDelete(b.Name) {
+			return
+		}
+
 		err = v.container.DeleteBlob(b.Name, &storage.DeleteBlobOptions{
 			IfMatch: b.Properties.Etag,
 		})
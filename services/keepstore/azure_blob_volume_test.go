@@ -13,6 +13,7 @@ import (
 	"encoding/xml"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
@@ -24,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"testing/iotest"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -680,6 +682,29 @@ func (s *stubbedAzureBlobSuite) TestStats(c *check.C) {
 	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
 }
 
+func (s *stubbedAzureBlobSuite) TestBlockWriteStream(c *check.C) {
+	v := s.newTestableAzureBlobVolume(c, newVolumeParams{
+		Cluster:      testCluster(c),
+		ConfigVolume: arvados.Volume{Replication: 3},
+		MetricsVecs:  newVolumeMetricsVecs(prometheus.NewRegistry()),
+		BufferPool:   newBufferPool(ctxlog.TestLogger(c), 8, prometheus.NewRegistry()),
+	})
+	defer v.Teardown()
+
+	// If the reader fails, the blob is not created.
+	err := v.BlockWriteStream(context.Background(), fooHash, 3, io.MultiReader(strings.NewReader("fo"), iotest.ErrReader(errStreamAborted)))
+	c.Check(err, check.NotNil)
+	err = v.BlockRead(context.Background(), fooHash, brdiscard)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	err = v.BlockWriteStream(context.Background(), fooHash, 3, strings.NewReader("foo"))
+	c.Check(err, check.IsNil)
+	buf := &brbuffer{}
+	err = v.BlockRead(context.Background(), fooHash, buf)
+	c.Check(err, check.IsNil)
+	c.Check(buf.String(), check.Equals, "foo")
+}
+
 func (v *testableAzureBlobVolume) BlockWriteRaw(locator string, data []byte) {
 	v.azHandler.BlockWriteRaw(v.ContainerName, locator, data)
 }
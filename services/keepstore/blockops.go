@@ -0,0 +1,93 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type blockOp string
+
+const (
+	blockOpPull  blockOp = "pull"
+	blockOpTrash blockOp = "trash"
+)
+
+// blockOps tracks the pull and trash operations in progress for each
+// block, so that a pull and a trash for the same block can't
+// interleave. Otherwise, a trash worker could check the mtime of an
+// existing replica, a pull worker could write a new replica (which
+// the trash list didn't account for), and then the trash worker would
+// trash it, briefly leaving the block with fewer replicas than
+// keep-balance expects.
+//
+// Conflicting operations are rejected rather than queued: the
+// rejected operation will be requested again by keep-balance if it
+// is still needed after the other one finishes.
+type blockOps struct {
+	mtx        sync.Mutex
+	inprogress map[string]blockOpState // hash => operations in progress
+	conflicts  *prometheus.CounterVec
+}
+
+type blockOpState struct {
+	op blockOp
+	n  int
+}
+
+func newBlockOps(reg *prometheus.Registry) *blockOps {
+	conflicts := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "block_operation_conflicts_total",
+			Help:      "Number of pull/trash requests skipped because a conflicting operation on the same block was in progress, by skipped operation",
+		},
+		[]string{"operation"},
+	)
+	if reg != nil {
+		reg.MustRegister(conflicts)
+	}
+	return &blockOps{
+		inprogress: map[string]blockOpState{},
+		conflicts:  conflicts,
+	}
+}
+
+// start records that the given operation is starting on the block
+// with the given hash.
+//
+// If a different operation is already in progress on the same block,
+// start returns false and the caller should skip the operation.
+// Otherwise, it returns true and the caller must call done(hash)
+// when the operation is finished. Multiple operations of the same
+// kind are allowed to run at the same time.
+func (bo *blockOps) start(hash string, op blockOp) bool {
+	bo.mtx.Lock()
+	defer bo.mtx.Unlock()
+	st, ok := bo.inprogress[hash]
+	if ok && st.op != op {
+		bo.conflicts.WithLabelValues(string(op)).Inc()
+		return false
+	}
+	bo.inprogress[hash] = blockOpState{op: op, n: st.n + 1}
+	return true
+}
+
+// done records that an operation started by start(hash, ...) has
+// finished.
+func (bo *blockOps) done(hash string) {
+	bo.mtx.Lock()
+	defer bo.mtx.Unlock()
+	st := bo.inprogress[hash]
+	if st.n <= 1 {
+		delete(bo.inprogress, hash)
+	} else {
+		st.n--
+		bo.inprogress[hash] = st
+	}
+}
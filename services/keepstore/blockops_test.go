@@ -0,0 +1,39 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&blockOpsSuite{})
+
+type blockOpsSuite struct{}
+
+func (s *blockOpsSuite) TestConflicts(c *C) {
+	bo := newBlockOps(prometheus.NewRegistry())
+
+	// Operations of the same kind can run concurrently.
+	c.Check(bo.start(fooHash, blockOpPull), Equals, true)
+	c.Check(bo.start(fooHash, blockOpPull), Equals, true)
+	// Operations on different blocks don't conflict.
+	c.Check(bo.start(barHash, blockOpTrash), Equals, true)
+
+	c.Check(bo.start(fooHash, blockOpTrash), Equals, false)
+	bo.done(fooHash)
+	c.Check(bo.start(fooHash, blockOpTrash), Equals, false)
+	bo.done(fooHash)
+	c.Check(bo.start(fooHash, blockOpTrash), Equals, true)
+	c.Check(bo.start(fooHash, blockOpPull), Equals, false)
+	c.Check(bo.start(barHash, blockOpPull), Equals, false)
+	bo.done(fooHash)
+	bo.done(barHash)
+	c.Check(bo.inprogress, HasLen, 0)
+
+	c.Check(testutil.ToFloat64(bo.conflicts.WithLabelValues("trash")), Equals, float64(2))
+	c.Check(testutil.ToFloat64(bo.conflicts.WithLabelValues("pull")), Equals, float64(2))
+}
@@ -0,0 +1,146 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"io"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var errStreamAborted = errors.New("streaming write aborted")
+
+// A blockStream sends block data to a streamingVolume while the data
+// is being received from the client (see
+// Collections.BlobStreamingWrites).
+type blockStream struct {
+	mnt    *mount
+	hash   string
+	logger logrus.FieldLogger
+	hcw    io.Writer
+	pw     *io.PipeWriter
+	errc   chan error
+	failed error
+}
+
+// streamingMount returns the mount that a new block should be
+// streamed to while it is being received, or nil if the block should
+// be buffered first.
+//
+// Streaming is only used if it is enabled in the cluster config, the
+// client specified the hash and size of the block, and the first
+// mount the block would be written to supports streaming and does
+// not already have the block.
+func (ks *keepstore) streamingMount(opts arvados.BlockWriteOptions) *mount {
+	if !ks.cluster.Collections.BlobStreamingWrites || len(opts.Hash) < 32 || opts.DataSize <= 0 {
+		return nil
+	}
+	hash := opts.Hash[:32]
+	result := newPutProgress(opts.StorageClasses)
+	for _, mnt := range ks.rendezvous(hash, ks.mountsW) {
+		if !result.Want(mnt) {
+			continue
+		}
+		if _, ok := mnt.volume.(streamingVolume); !ok {
+			return nil
+		}
+		if _, err := mnt.Mtime(hash); err == nil {
+			// Use the buffered path, which checks for
+			// hash collisions before touching the
+			// existing block.
+			return nil
+		}
+		return mnt
+	}
+	return nil
+}
+
+// startBlockStream starts writing a block of the given size to mnt,
+// which must be a streamingVolume. Data written to the returned
+// blockStream is passed through to the volume, except that the last
+// part is withheld if the data does not match the hash.
+//
+// The caller must call finish.
+func (ks *keepstore) startBlockStream(ctx context.Context, mnt *mount, hash string, size int) *blockStream {
+	pr, pw := io.Pipe()
+	bs := &blockStream{
+		mnt:    mnt,
+		hash:   hash,
+		logger: ks.logger.WithField("mount", mnt.UUID),
+		hcw:    newHashCheckWriter(pw, md5.New(), int64(size), hash),
+		pw:     pw,
+		errc:   make(chan error, 1),
+	}
+	go func() {
+		err := mnt.volume.(streamingVolume).BlockWriteStream(ctx, hash, size, pr)
+		// Unblock Write if the volume stopped reading early.
+		pr.CloseWithError(errStreamAborted)
+		bs.errc <- err
+	}()
+	return bs
+}
+
+// Write sends p to the volume. If the volume write has already
+// failed, or the data does not match the hash, Write discards p
+// without returning an error, so the caller can still receive the
+// rest of the block and store it using the buffered path.
+func (bs *blockStream) Write(p []byte) (int, error) {
+	if bs.failed == nil {
+		_, bs.failed = bs.hcw.Write(p)
+		if bs.failed != nil {
+			bs.logger.WithError(bs.failed).Debug("streaming write failed")
+		}
+	}
+	return len(p), nil
+}
+
+// finish ends the stream and waits for the volume write to finish.
+// If ok is false (the caller found a problem with the data, such as
+// a size or hash mismatch), the volume write is aborted.
+//
+// finish returns true if the block was stored.
+func (bs *blockStream) finish(ok bool) bool {
+	if ok && bs.failed == nil {
+		bs.pw.Close()
+	} else {
+		bs.pw.CloseWithError(errStreamAborted)
+	}
+	err := <-bs.errc
+	if err != nil {
+		bs.logger.WithError(err).Debug("streaming write failed")
+		return false
+	}
+	if !ok || bs.failed != nil {
+		// The volume should have aborted the write when it
+		// got a read error. Make sure the data isn't used.
+		bs.logger.Warn("streaming write was not aborted, trashing stored block")
+		if err := bs.mnt.BlockTrash(bs.hash); err != nil {
+			bs.logger.WithError(err).Error("error trashing block after aborted streaming write")
+		}
+		return false
+	}
+	return true
+}
+
+func newBlockWriteLatencyMetric(reg *prometheus.Registry) *prometheus.SummaryVec {
+	latency := prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "block_write_duration_seconds",
+			Help:      "Time taken to receive and store new blocks, by write path (buffered or streaming)",
+		},
+		[]string{"path"},
+	)
+	if reg != nil {
+		reg.MustRegister(latency)
+	}
+	return latency
+}
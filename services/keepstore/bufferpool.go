@@ -18,8 +18,20 @@ var bufferPoolBlockSize = BlockSize // modified by tests
 
 type bufferPool struct {
 	log logrus.FieldLogger
-	// limiter has a "true" placeholder for each in-use buffer.
-	limiter chan bool
+	// mtx protects inuse; cond is signaled when a buffer is
+	// returned.
+	mtx  sync.Mutex
+	cond *sync.Cond
+	// inuse is the number of buffers currently in use.
+	inuse int
+	// max is the maximum number of buffers in use.
+	max int
+	// reserved is the number of buffers that can only be used
+	// by interactive requests.
+	reserved int
+	// waitTime is the time spent waiting for a buffer, by
+	// request priority.
+	waitTime *prometheus.SummaryVec
 	// allocated is the number of bytes currently allocated to buffers.
 	allocated uint64
 	// Pool has unused buffers.
@@ -27,13 +39,23 @@ type bufferPool struct {
 }
 
 func newBufferPool(log logrus.FieldLogger, count int, reg *prometheus.Registry) *bufferPool {
-	p := bufferPool{log: log}
+	p := bufferPool{log: log, max: count, reserved: count / 4}
+	p.cond = sync.NewCond(&p.mtx)
+	p.waitTime = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "bufferpool_wait_seconds",
+			Help:      "Time spent waiting for a buffer, by request priority",
+		},
+		[]string{"priority"},
+	)
 	p.Pool.New = func() interface{} {
 		atomic.AddUint64(&p.allocated, uint64(bufferPoolBlockSize))
 		return make([]byte, bufferPoolBlockSize)
 	}
-	p.limiter = make(chan bool, count)
 	if reg != nil {
+		reg.MustRegister(p.waitTime)
 		reg.MustRegister(prometheus.NewGaugeFunc(
 			prometheus.GaugeOpts{
 				Namespace: "arvados",
@@ -67,10 +89,15 @@ func newBufferPool(log logrus.FieldLogger, count int, reg *prometheus.Registry)
 
 // GetContext gets a buffer from the pool -- but gives up and returns
 // ctx.Err() if ctx ends before a buffer is available.
+//
+// Requests with batch priority (see priorityFromContext) wait until
+// fewer than max-reserved buffers are in use, so the last reserved
+// buffers are only used by interactive requests.
 func (p *bufferPool) GetContext(ctx context.Context) ([]byte, error) {
+	prio := priorityFromContext(ctx)
 	bufReady := make(chan []byte)
 	go func() {
-		bufReady <- p.Get()
+		bufReady <- p.get(prio)
 	}()
 	select {
 	case buf := <-bufReady:
@@ -86,15 +113,29 @@ func (p *bufferPool) GetContext(ctx context.Context) ([]byte, error) {
 	}
 }
 
+// Get gets a buffer from the pool, waiting if necessary. The
+// request is assumed to have interactive priority.
 func (p *bufferPool) Get() []byte {
-	select {
-	case p.limiter <- true:
-	default:
-		t0 := time.Now()
-		p.log.Printf("reached max buffers (%d), waiting", cap(p.limiter))
-		p.limiter <- true
+	return p.get(priorityInteractive)
+}
+
+func (p *bufferPool) get(prio requestPriority) []byte {
+	limit := p.max
+	if prio == priorityBatch {
+		limit -= p.reserved
+	}
+	t0 := time.Now()
+	p.mtx.Lock()
+	if p.inuse >= limit {
+		p.log.Printf("reached max buffers (%d) for %s requests, waiting", limit, prio)
+		for p.inuse >= limit {
+			p.cond.Wait()
+		}
 		p.log.Printf("waited %v for a buffer", time.Since(t0))
 	}
+	p.inuse++
+	p.mtx.Unlock()
+	p.waitTime.WithLabelValues(prio.String()).Observe(time.Since(t0).Seconds())
 	buf := p.Pool.Get().([]byte)
 	if len(buf) < bufferPoolBlockSize {
 		p.log.Fatalf("bufferPoolBlockSize=%d but cap(buf)=%d", bufferPoolBlockSize, len(buf))
@@ -104,7 +145,10 @@ func (p *bufferPool) Get() []byte {
 
 func (p *bufferPool) Put(buf []byte) {
 	p.Pool.Put(buf[:cap(buf)])
-	<-p.limiter
+	p.mtx.Lock()
+	p.inuse--
+	p.mtx.Unlock()
+	p.cond.Broadcast()
 }
 
 // Alloc returns the number of bytes allocated to buffers.
@@ -114,10 +158,12 @@ func (p *bufferPool) Alloc() uint64 {
 
 // Cap returns the maximum number of buffers allowed.
 func (p *bufferPool) Cap() int {
-	return cap(p.limiter)
+	return p.max
 }
 
 // Len returns the number of buffers in use right now.
 func (p *bufferPool) Len() int {
-	return len(p.limiter)
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.inuse
 }
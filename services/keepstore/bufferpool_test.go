@@ -5,6 +5,9 @@
 package keepstore
 
 import (
+	"context"
+	"strings"
+	"sync"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
@@ -90,3 +93,88 @@ func (s *BufferPoolSuite) TestBufferPoolReuse(c *C) {
 	}
 	c.Check(reuses > allocs*95/100, Equals, true)
 }
+
+func (s *BufferPoolSuite) TestBufferPoolBatchReserve(c *C) {
+	bufs := newBufferPool(ctxlog.TestLogger(c), 4, prometheus.NewRegistry())
+	batchctx := contextWithPriority(context.Background(), priorityBatch)
+	for i := 0; i < 3; i++ {
+		_, err := bufs.GetContext(batchctx)
+		c.Assert(err, IsNil)
+	}
+
+	// The last buffer is reserved for interactive requests.
+	ctx, cancel := context.WithTimeout(batchctx, 10*time.Millisecond)
+	defer cancel()
+	_, err := bufs.GetContext(ctx)
+	c.Check(err, Equals, context.DeadlineExceeded)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	buf, err := bufs.GetContext(ctx)
+	c.Check(err, IsNil)
+	c.Check(bufs.Len(), Equals, 4)
+
+	// Returning a buffer doesn't make room for a batch request
+	// until the reserved buffer is also returned.
+	bufs.Put(buf)
+	c.Check(bufs.Len(), Equals, 3)
+	ctx, cancel = context.WithTimeout(batchctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = bufs.GetContext(ctx)
+	c.Check(err, Equals, context.DeadlineExceeded)
+}
+
+func (s *BufferPoolSuite) TestPriorityLock(c *C) {
+	var l priorityLock
+	batchctx := contextWithPriority(context.Background(), priorityBatch)
+	c.Assert(l.LockContext(batchctx), IsNil)
+
+	// Waiting requests get the lock in priority order, then
+	// arrival order.
+	var mtx sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for i, name := range []string{"batch1", "interactive1", "batch2", "interactive2"} {
+		name := name
+		ctx := context.Background()
+		if strings.HasPrefix(name, "batch") {
+			ctx = batchctx
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(l.LockContext(ctx), IsNil)
+			mtx.Lock()
+			order = append(order, name)
+			mtx.Unlock()
+			l.Unlock()
+		}()
+		// Wait for the goroutine to join the queue.
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			l.mtx.Lock()
+			n := len(l.waiting[0]) + len(l.waiting[1])
+			l.mtx.Unlock()
+			if n == i+1 {
+				break
+			}
+		}
+	}
+
+	// A waiting request that gives up leaves the queue.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Check(l.LockContext(ctx), Equals, context.DeadlineExceeded)
+
+	l.Unlock()
+	wg.Wait()
+	c.Check(order, DeepEquals, []string{"interactive1", "interactive2", "batch1", "batch2"})
+	c.Check(l.locked, Equals, false)
+}
+
+func (s *BufferPoolSuite) TestParsePriority(c *C) {
+	c.Check(parsePriority(""), Equals, priorityInteractive)
+	c.Check(parsePriority("interactive"), Equals, priorityInteractive)
+	c.Check(parsePriority("bogus"), Equals, priorityInteractive)
+	c.Check(parsePriority("batch"), Equals, priorityBatch)
+	c.Check(parsePriority(" Batch"), Equals, priorityBatch)
+}
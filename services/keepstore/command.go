@@ -22,10 +22,15 @@ func newHandlerOrErrorHandler(ctx context.Context, cluster *arvados.Cluster, tok
 	if !ok {
 		return service.ErrorHandler(ctx, cluster, errors.New("BUG: no URL from service.URLFromContext"))
 	}
+	// Background workers are stopped when we start draining
+	// (see router.Drain).
+	ctx, cancel := context.WithCancel(ctx)
 	ks, err := newKeepstore(ctx, cluster, token, reg, serviceURL)
 	if err != nil {
+		cancel()
 		return service.ErrorHandler(ctx, cluster, err)
 	}
+	ks.stopWorkers = cancel
 	puller := newPuller(ctx, ks, reg)
 	trasher := newTrasher(ctx, ks, reg)
 	_ = newTrashEmptier(ctx, ks, reg)
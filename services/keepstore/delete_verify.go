@@ -0,0 +1,122 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Maximum time to spend checking one block on one peer server,
+// including retries.
+var deleteVerifyTimeout = time.Minute
+
+// A deleteVerifier checks, before a volume permanently deletes a
+// trashed block, that the block is either still sufficiently
+// replicated on other servers or not stored on any other server at
+// all (see Collections.BlobDeleteVerifyReplication).
+//
+// A nil *deleteVerifier allows all deletions.
+type deleteVerifier struct {
+	keepstore *keepstore
+	client    *arvados.Client
+	peers     []string // base URLs of other keepstore servers
+}
+
+// newDeleteVerifier returns a deleteVerifier for ks, or nil if the
+// check is disabled by config.
+func newDeleteVerifier(ks *keepstore) (*deleteVerifier, error) {
+	if !ks.cluster.Collections.BlobDeleteVerifyReplication ||
+		ks.cluster.Collections.BlobTrashLifetime <= 0 {
+		return nil, nil
+	}
+	client, err := arvados.NewClientFromConfig(ks.cluster)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up client for BlobDeleteVerifyReplication: %w", err)
+	}
+	client.AuthToken = "keepstore-token-used-for-verifying-replication"
+	client.Timeout = deleteVerifyTimeout
+	dv := &deleteVerifier{keepstore: ks, client: client}
+	for url := range ks.cluster.Services.Keepstore.InternalURLs {
+		if url != ks.serviceURL {
+			dv.peers = append(dv.peers, strings.TrimSuffix(url.String(), "/"))
+		}
+	}
+	return dv, nil
+}
+
+// okToDelete returns true if the given block can be permanently
+// deleted from a volume on this server: at least DefaultReplication
+// peer servers have a copy, or none do. If deletion is not safe, or
+// any peer cannot be checked, it logs the reason and returns false.
+func (dv *deleteVerifier) okToDelete(hash string) bool {
+	if dv == nil {
+		return true
+	}
+	want := dv.keepstore.cluster.Collections.DefaultReplication
+	signed := dv.keepstore.signLocator(dv.client.AuthToken, hash)
+	var (
+		mtx   sync.Mutex
+		found []string
+		errs  []string
+		wg    sync.WaitGroup
+	)
+	for _, peer := range dv.peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			ok, err := dv.head(peer, signed)
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", peer, err))
+			} else if ok {
+				found = append(found, peer)
+			}
+		}(peer)
+	}
+	wg.Wait()
+	logger := dv.keepstore.logger.WithField("hash", hash)
+	switch {
+	case len(errs) > 0:
+		logger.Warnf("not deleting trashed block: cannot verify replication: %s", strings.Join(errs, "; "))
+		return false
+	case len(found) > 0 && len(found) < want:
+		logger.Warnf("not deleting trashed block: only %d other servers have it (%s), DefaultReplication is %d", len(found), strings.Join(found, ", "), want)
+		return false
+	default:
+		return true
+	}
+}
+
+// head returns true if the given peer server has the block, false if
+// it responds 404, or an error.
+func (dv *deleteVerifier) head(peer, locator string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), deleteVerifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, peer+"/"+locator, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := dv.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("HEAD returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	. "gopkg.in/check.v1"
+)
+
+func (s *keepstoreSuite) TestDeleteVerifier(c *C) {
+	s.cluster.Collections.BlobSigningKey = arvadostest.BlobSigningKey
+	ks, cancel := testKeepstore(c, s.cluster, nil)
+	c.Check(ks.deleteVerifier, IsNil)
+	c.Check(ks.deleteVerifier.okToDelete("acbd18db4cc2f85cedef654fccc4a4d8"), Equals, true)
+	cancel()
+
+	// Each peer responds with the status given for the
+	// requested hash, or 404.
+	var mtx sync.Mutex
+	status := map[string][]int{}
+	var peers []*httptest.Server
+	for i := 0; i < 3; i++ {
+		i := i
+		peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			c.Check(req.Method, Equals, http.MethodHead)
+			c.Check(req.Header.Get("Authorization"), Not(Equals), "")
+			c.Check(req.URL.Path, Matches, `/[0-9a-f]{32}\+A[0-9a-f]+@[0-9a-f]+`)
+			mtx.Lock()
+			defer mtx.Unlock()
+			if codes := status[req.URL.Path[1:33]]; codes != nil {
+				w.WriteHeader(codes[i])
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer peer.Close()
+		peers = append(peers, peer)
+	}
+
+	s.cluster.Collections.BlobDeleteVerifyReplication = true
+	s.cluster.Collections.BlobTrashLifetime = arvados.Duration(time.Hour)
+	s.cluster.Collections.DefaultReplication = 2
+	s.cluster.Services.Controller.ExternalURL = arvados.URL{Scheme: "https", Host: "zzzzz.example.com", Path: "/"}
+	s.cluster.Services.Keepstore.InternalURLs = map[arvados.URL]arvados.ServiceInstance{testServiceURL: {}}
+	for _, peer := range peers {
+		s.cluster.Services.Keepstore.InternalURLs[arvados.URL{Scheme: "http", Host: strings.TrimPrefix(peer.URL, "http://"), Path: "/"}] = arvados.ServiceInstance{}
+	}
+	ks, cancel = testKeepstore(c, s.cluster, nil)
+	defer cancel()
+	dv := ks.deleteVerifier
+	c.Assert(dv, NotNil)
+	c.Check(dv.peers, HasLen, 3)
+	dv.client.Timeout = 0 // don't retry 5xx
+
+	for _, trial := range []struct {
+		codes  []int
+		expect bool
+	}{
+		{nil, true},                   // not stored anywhere else
+		{[]int{200, 200, 404}, true},  // enough replicas elsewhere
+		{[]int{200, 200, 200}, true},  // enough replicas elsewhere
+		{[]int{404, 200, 404}, false}, // under-replicated
+		{[]int{200, 200, 503}, false}, // cannot check
+		{[]int{404, 404, 503}, false}, // cannot check
+	} {
+		hash := "acbd18db4cc2f85cedef654fccc4a4d8"
+		mtx.Lock()
+		status[hash] = trial.codes
+		mtx.Unlock()
+		c.Check(dv.okToDelete(hash), Equals, trial.expect, Commentf("%v", trial.codes))
+	}
+}
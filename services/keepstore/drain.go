@@ -0,0 +1,141 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// How often to check whether in-flight transfers have
+	// finished while draining.
+	drainPollInterval = time.Second / 10
+	// How often to log the number of in-flight transfers while
+	// draining.
+	drainReportInterval = 5 * time.Second
+)
+
+func newDrainMetrics(reg *prometheus.Registry, ks *keepstore) prometheus.Gauge {
+	draining := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "keepstore",
+		Name:      "draining",
+		Help:      "1 if keepstore is waiting for in-flight transfers to finish before shutting down",
+	})
+	if reg != nil {
+		reg.MustRegister(draining)
+		reg.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: "arvados",
+				Subsystem: "keepstore",
+				Name:      "inflight_transfers",
+				Help:      "Number of block reads and writes in progress",
+			},
+			func() float64 {
+				return float64(ks.transfers.Load())
+			},
+		))
+	}
+	return draining
+}
+
+// countTransfer wraps a block read/write handler, so the request is
+// counted in keepstore.transfers while it is in progress.
+func (rtr *router) countTransfer(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rtr.keepstore.transfers.Add(1)
+		defer rtr.keepstore.transfers.Add(-1)
+		h(w, req)
+	}
+}
+
+// DrainTimeout implements service.Drainer.
+func (rtr *router) DrainTimeout() time.Duration {
+	return rtr.keepstore.cluster.Collections.KeepstoreDrainTimeout.Duration()
+}
+
+// Drain implements service.Drainer. It stops the pull and trash
+// workers, waits for in-flight block reads and writes to finish (or
+// ctx to be done), then saves state that should survive a restart.
+func (rtr *router) Drain(ctx context.Context) {
+	ks := rtr.keepstore
+	ks.draining.Set(1)
+	if ks.stopWorkers != nil {
+		ks.stopWorkers()
+	}
+	var pulls, trashes int
+	if rtr.puller != nil {
+		rtr.puller.cond.L.Lock()
+		pulls = len(rtr.puller.todo)
+		rtr.puller.todo = nil
+		rtr.puller.cond.L.Unlock()
+	}
+	if rtr.trasher != nil {
+		rtr.trasher.cond.L.Lock()
+		trashes = len(rtr.trasher.todo)
+		rtr.trasher.todo = nil
+		rtr.trasher.cond.L.Unlock()
+	}
+	if pulls > 0 || trashes > 0 {
+		ks.logger.Infof("draining: discarded %d queued pull requests and %d queued trash requests", pulls, trashes)
+	}
+
+	inprogress := func() (transfers, ops int64) {
+		transfers = ks.transfers.Load()
+		if rtr.puller != nil {
+			ops += rtr.puller.inprogress.Load()
+		}
+		if rtr.trasher != nil {
+			ops += rtr.trasher.inprogress.Load()
+		}
+		return
+	}
+	poll := time.NewTicker(drainPollInterval)
+	defer poll.Stop()
+	report := time.NewTicker(drainReportInterval)
+	defer report.Stop()
+wait:
+	for {
+		transfers, ops := inprogress()
+		if transfers == 0 && ops == 0 {
+			break
+		}
+		select {
+		case <-poll.C:
+		case <-report.C:
+			ks.logger.Infof("draining: %d transfers and %d pull/trash operations in progress", transfers, ops)
+		case <-ctx.Done():
+			ks.logger.Warnf("draining: timed out with %d transfers and %d pull/trash operations still in progress", transfers, ops)
+			break wait
+		}
+	}
+	ks.flush(ctx)
+}
+
+// flush moves blocks in unix volume journals to their own files,
+// and saves block access times. The journals are skipped if ctx is
+// done: they are still on disk, and get compacted after restart.
+func (ks *keepstore) flush(ctx context.Context) {
+	for _, mnt := range ks.mountsW {
+		v, ok := mnt.volume.(*unixVolume)
+		if !ok || v.journal == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			ks.logger.Infof("not compacting journal on %s because drain timeout was reached", mnt.UUID)
+			continue
+		}
+		if err := v.journal.compact(ctx); err != nil {
+			ks.logger.WithError(err).Warnf("error compacting journal on %s", mnt.UUID)
+		}
+	}
+	if ks.accessTimes != nil && ks.accessTimes.file != "" {
+		ks.accessTimes.saveIfDirty()
+	}
+}
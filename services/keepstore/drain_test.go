@@ -0,0 +1,168 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/service"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"github.com/prometheus/client_golang/prometheus"
+	. "gopkg.in/check.v1"
+)
+
+var _ service.Drainer = (*router)(nil)
+
+var _ = Suite(&drainSuite{})
+
+type drainSuite struct {
+	cluster *arvados.Cluster
+	root    string
+}
+
+func (s *drainSuite) SetUpTest(c *C) {
+	s.root = c.MkDir()
+	s.cluster = testCluster(c)
+	s.cluster.Collections.KeepstoreDrainTimeout = arvados.Duration(time.Minute)
+	s.cluster.Collections.BlobAccessTimeResolution = arvados.Duration(time.Millisecond)
+	s.cluster.Collections.BlobAccessTimeFile = filepath.Join(c.MkDir(), "atime")
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "stub"},
+		"zzzzz-nyw5e-111111111111111": {Replication: 1, Driver: "Directory", DriverParameters: json.RawMessage(`{"Root":"` + s.root + `","JournalMaxBlockSize":1024}`)},
+	}
+}
+
+// startRead starts a GET request for fooHash, which is stored on
+// the stub volume, and returns when the volume read has started.
+// The read finishes when unblock is closed.
+func (s *drainSuite) startRead(c *C, rtr *router, unblock chan struct{}) <-chan *httptest.ResponseRecorder {
+	started := make(chan struct{})
+	for _, mnt := range rtr.keepstore.mountsW {
+		if sv, ok := mnt.volume.(*stubVolume); ok {
+			c.Assert(sv.BlockWrite(context.Background(), fooHash, []byte("foo")), IsNil)
+			sv.blockRead = func(ctx context.Context, hash string, w io.WriterAt) error {
+				close(started)
+				<-unblock
+				return nil
+			}
+		}
+	}
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req := httptest.NewRequest("GET", "/"+rtr.keepstore.signLocator(arvadostest.ActiveTokenV2, fooHash+"+3"), nil)
+		req.Header.Set("Authorization", "Bearer "+arvadostest.ActiveTokenV2)
+		resp := httptest.NewRecorder()
+		rtr.ServeHTTP(resp, req)
+		done <- resp
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for read to start")
+	}
+	return done
+}
+
+func (s *drainSuite) gauge(c *C, reg *prometheus.Registry, name string) float64 {
+	mfs, err := reg.Gather()
+	c.Assert(err, IsNil)
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	c.Errorf("metric %s not found", name)
+	return -1
+}
+
+func (s *drainSuite) TestDrain(c *C) {
+	reg := prometheus.NewRegistry()
+	rtr, cancel := testRouter(c, s.cluster, reg)
+	defer cancel()
+	ctx, stopWorkers := context.WithCancel(context.Background())
+	rtr.keepstore.stopWorkers = stopWorkers
+	c.Check(rtr.DrainTimeout(), Equals, time.Minute)
+
+	// A block in the unix volume's journal, which should be
+	// moved to its own file after draining.
+	var uv *unixVolume
+	for _, mnt := range rtr.keepstore.mountsW {
+		if v, ok := mnt.volume.(*unixVolume); ok {
+			uv = v
+		}
+	}
+	c.Assert(uv, NotNil)
+	c.Assert(uv.BlockWrite(context.Background(), barHash, []byte("bar")), IsNil)
+	_, err := os.Stat(uv.blockPath(barHash))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	unblock := make(chan struct{})
+	done := s.startRead(c, rtr, unblock)
+	c.Check(rtr.keepstore.transfers.Load(), Equals, int64(1))
+
+	drained := make(chan struct{})
+	go func() {
+		rtr.Drain(context.Background())
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		c.Fatal("Drain returned before transfer finished")
+	case <-time.After(200 * time.Millisecond):
+	}
+	c.Check(ctx.Err(), NotNil)
+	c.Check(s.gauge(c, reg, "arvados_keepstore_draining"), Equals, 1.0)
+	c.Check(s.gauge(c, reg, "arvados_keepstore_inflight_transfers"), Equals, 1.0)
+
+	close(unblock)
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for Drain")
+	}
+	c.Check((<-done).Code, Equals, http.StatusOK)
+	c.Check(rtr.keepstore.transfers.Load(), Equals, int64(0))
+
+	_, err = os.Stat(uv.blockPath(barHash))
+	c.Check(err, IsNil)
+	atimes, err := os.ReadFile(s.cluster.Collections.BlobAccessTimeFile)
+	c.Check(err, IsNil)
+	c.Check(string(atimes), Matches, `(?ms)`+fooHash+` \d+\n`)
+}
+
+func (s *drainSuite) TestDrainTimeout(c *C) {
+	rtr, cancel := testRouter(c, s.cluster, nil)
+	defer cancel()
+
+	var uv *unixVolume
+	for _, mnt := range rtr.keepstore.mountsW {
+		if v, ok := mnt.volume.(*unixVolume); ok {
+			uv = v
+		}
+	}
+	c.Assert(uv.BlockWrite(context.Background(), barHash, []byte("bar")), IsNil)
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	s.startRead(c, rtr, unblock)
+
+	ctx, cancelDrain := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelDrain()
+	t0 := time.Now()
+	rtr.Drain(ctx)
+	c.Check(time.Since(t0) < 5*time.Second, Equals, true)
+	c.Check(rtr.keepstore.transfers.Load(), Equals, int64(1))
+	// The journal is left for compaction after restart.
+	_, err := os.Stat(uv.blockPath(barHash))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
@@ -57,6 +57,10 @@ type indexOptions struct {
 	MountUUID string
 	Prefix    string
 	WriteTo   io.Writer
+
+	// Append each block's last access time (see accessTimes)
+	// to its index line.
+	IncludeAtime bool
 }
 
 type mount struct {
@@ -74,8 +78,42 @@ type keepstore struct {
 	mountsW    []*mount
 	bufferPool *bufferPool
 
+	// request latency by priority class (see priorityHandler)
+	requestLatency *prometheus.SummaryVec
+
+	// block write latency by write path (see BlockWrite)
+	blockWriteLatency *prometheus.SummaryVec
+
+	// signature checks by validating key (see
+	// checkLocatorSignature)
+	signatureChecks *prometheus.CounterVec
+
 	iostats map[volume]*ioStats
 
+	// approximate last read time of each block, or nil if not
+	// tracked
+	accessTimes *accessTimes
+
+	// who wrote each block, or nil if not recorded
+	provenance *blockProvenance
+
+	// pull/trash operations in progress, by block hash
+	blockOps *blockOps
+
+	// checks trashed blocks before they are deleted, or nil if
+	// not enabled
+	deleteVerifier *deleteVerifier
+
+	// block reads and writes in progress
+	transfers atomic.Int64
+
+	// 1 while draining before shutdown (see router.Drain)
+	draining prometheus.Gauge
+
+	// stops pull/trash workers and other background tasks, or
+	// nil if not applicable (e.g., in tests)
+	stopWorkers context.CancelFunc
+
 	remoteClients    map[string]*keepclient.KeepClient
 	remoteClientsMtx sync.Mutex
 }
@@ -100,14 +138,31 @@ func newKeepstore(ctx context.Context, cluster *arvados.Cluster, token string, r
 	bufferPool := newBufferPool(logger, cluster.API.MaxKeepBlobBuffers, reg)
 
 	ks := &keepstore{
-		cluster:       cluster,
-		logger:        logger,
-		serviceURL:    serviceURL,
-		bufferPool:    bufferPool,
-		remoteClients: make(map[string]*keepclient.KeepClient),
+		cluster:           cluster,
+		logger:            logger,
+		serviceURL:        serviceURL,
+		bufferPool:        bufferPool,
+		requestLatency:    newRequestLatencyMetric(reg),
+		blockWriteLatency: newBlockWriteLatencyMetric(reg),
+		signatureChecks:   newSignatureCheckMetric(reg),
+		remoteClients:     make(map[string]*keepclient.KeepClient),
+		accessTimes:       newAccessTimes(ctx, cluster, logger),
+		blockOps:          newBlockOps(reg),
+	}
+	ks.draining = newDrainMetrics(reg, ks)
+
+	var err error
+	ks.deleteVerifier, err = newDeleteVerifier(ks)
+	if err != nil {
+		return nil, err
 	}
 
-	err := ks.setupMounts(newVolumeMetricsVecs(reg))
+	ks.provenance, err = newBlockProvenance(cluster, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ks.setupMounts(ctx, newVolumeMetricsVecs(reg))
 	if err != nil {
 		return nil, err
 	}
@@ -115,7 +170,7 @@ func newKeepstore(ctx context.Context, cluster *arvados.Cluster, token string, r
 	return ks, nil
 }
 
-func (ks *keepstore) setupMounts(metrics *volumeMetricsVecs) error {
+func (ks *keepstore) setupMounts(ctx context.Context, metrics *volumeMetricsVecs) error {
 	ks.mounts = make(map[string]*mount)
 	if len(ks.cluster.Volumes) == 0 {
 		return errors.New("no volumes configured")
@@ -130,12 +185,14 @@ func (ks *keepstore) setupMounts(metrics *volumeMetricsVecs) error {
 			return fmt.Errorf("volume %s: invalid driver %q", uuid, cfgvol.Driver)
 		}
 		vol, err := dri(newVolumeParams{
-			UUID:         uuid,
-			Cluster:      ks.cluster,
-			ConfigVolume: cfgvol,
-			Logger:       ks.logger,
-			MetricsVecs:  metrics,
-			BufferPool:   ks.bufferPool,
+			UUID:           uuid,
+			Cluster:        ks.cluster,
+			ConfigVolume:   cfgvol,
+			Logger:         ks.logger,
+			MetricsVecs:    metrics,
+			BufferPool:     ks.bufferPool,
+			DeleteVerifier: ks.deleteVerifier,
+			Context:        ctx,
 		})
 		if err != nil {
 			return fmt.Errorf("error initializing volume %s: %s", uuid, err)
@@ -155,14 +212,15 @@ func (ks *keepstore) setupMounts(metrics *volumeMetricsVecs) error {
 				pri = p
 			}
 		}
+		_, mirror := vol.(*mirrorVolume)
 		mnt := &mount{
 			volume:   vol,
 			priority: pri,
 			KeepMount: arvados.KeepMount{
 				UUID:           uuid,
 				DeviceID:       vol.DeviceID(),
-				AllowWrite:     !va.ReadOnly && !cfgvol.ReadOnly,
-				AllowTrash:     !va.ReadOnly && (!cfgvol.ReadOnly || cfgvol.AllowTrashWhenReadOnly),
+				AllowWrite:     !va.ReadOnly && !cfgvol.ReadOnly && !mirror,
+				AllowTrash:     !va.ReadOnly && (!cfgvol.ReadOnly || cfgvol.AllowTrashWhenReadOnly) && !mirror,
 				Replication:    repl,
 				StorageClasses: sc,
 			},
@@ -202,24 +260,81 @@ func (ks *keepstore) checkLocatorSignature(ctx context.Context, locator string)
 	if token == "" {
 		return errNoTokenProvided
 	}
-	err := arvados.VerifySignature(locator, token, ks.cluster.Collections.BlobSigningTTL.Duration(), []byte(ks.cluster.Collections.BlobSigningKey))
+	ttl := ks.cluster.Collections.BlobSigningTTL.Duration()
+	err := arvados.VerifySignature(locator, token, ttl, []byte(ks.cluster.Collections.BlobSigningKey))
+	key := "current"
+	for _, prevkey := range ks.cluster.Collections.PreviousBlobSigningKeys {
+		if err != arvados.ErrSignatureInvalid {
+			break
+		}
+		// Accept signatures made before the current key was
+		// rotated in.
+		err = arvados.VerifySignature(locator, token, ttl, []byte(prevkey))
+		key = "previous"
+	}
 	if err == arvados.ErrSignatureExpired {
 		return errExpiredSignature
 	} else if err != nil {
+		ks.signatureChecks.WithLabelValues("none").Inc()
 		return errInvalidSignature
 	}
+	ks.signatureChecks.WithLabelValues(key).Inc()
 	return nil
 }
 
+func newSignatureCheckMetric(reg *prometheus.Registry) *prometheus.CounterVec {
+	checks := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "signature_checks_total",
+			Help:      "Number of locator signature checks, by the key (current, previous, or none) that validated the signature",
+		},
+		[]string{"key"},
+	)
+	if reg != nil {
+		reg.MustRegister(checks)
+	}
+	return checks
+}
+
 // signLocator signs the locator for the given token, if possible.
 // Note this signs if the BlobSigningKey config is available, even if
 // the BlobSigning config is false.
 func (ks *keepstore) signLocator(token, locator string) string {
+	return ks.signLocatorTTL(token, locator, 0)
+}
+
+// signLocatorTTL is like signLocator, but the signature expires
+// after the given TTL instead of the configured BlobSigningTTL. A
+// TTL longer than BlobSigningTTL is only honored for the system root
+// token (e.g., a controller re-signing locators on behalf of users);
+// otherwise, and if ttl is zero, BlobSigningTTL is used.
+func (ks *keepstore) signLocatorTTL(token, locator string, ttl time.Duration) string {
 	if token == "" || len(ks.cluster.Collections.BlobSigningKey) == 0 {
 		return locator
 	}
-	ttl := ks.cluster.Collections.BlobSigningTTL.Duration()
-	return arvados.SignLocator(locator, token, time.Now().Add(ttl), ttl, []byte(ks.cluster.Collections.BlobSigningKey))
+	defaultTTL := ks.cluster.Collections.BlobSigningTTL.Duration()
+	if ttl <= 0 || (ttl > defaultTTL && !ks.isSystemRootToken(token)) {
+		ttl = defaultTTL
+	}
+	return arvados.SignLocator(locator, token, time.Now().Add(ttl), defaultTTL, []byte(ks.cluster.Collections.BlobSigningKey))
+}
+
+// writeResponseLocator returns the locator to send to the caller
+// after a successful BlockWrite. The locator is signed unless the
+// caller is a trusted internal service (using the system root
+// token) that asked for an unsigned locator.
+func (ks *keepstore) writeResponseLocator(ctx context.Context, locator string, opts arvados.BlockWriteOptions) string {
+	token := ctxToken(ctx)
+	if opts.Unsigned && ks.isSystemRootToken(token) {
+		return locator
+	}
+	return ks.signLocatorTTL(token, locator, opts.SignatureTTL)
+}
+
+func (ks *keepstore) isSystemRootToken(token string) bool {
+	return token != "" && token == ks.cluster.SystemRootToken
 }
 
 func (ks *keepstore) BlockRead(ctx context.Context, opts arvados.BlockReadOptions) (n int, err error) {
@@ -237,6 +352,11 @@ func (ks *keepstore) BlockRead(ctx context.Context, opts arvados.BlockReadOption
 	if err := ks.checkLocatorSignature(ctx, opts.Locator); err != nil {
 		return 0, err
 	}
+	defer func() {
+		if err == nil {
+			ks.accessTimes.touch(li.hash)
+		}
+	}()
 	hashcheck := md5.New()
 	if li.size > 0 {
 		out = newHashCheckWriter(out, hashcheck, int64(li.size), li.hash)
@@ -315,6 +435,114 @@ func (ks *keepstore) BlockRead(ctx context.Context, opts arvados.BlockReadOption
 	return 0, errToCaller
 }
 
+// BlockReadRange writes length bytes of the indicated block, starting
+// at offset, to opts.WriteTo.
+//
+// If the block is stored on a volume that supports range reads (see
+// rangeReadingVolume), only the requested range is read from the
+// backend, and -- since the rest of the block is not read -- the data
+// is not checked against the block hash. The caller is responsible
+// for verifying the data after assembling the block. Otherwise, the
+// whole block is read and verified, and the rest of the block is
+// discarded.
+func (ks *keepstore) BlockReadRange(ctx context.Context, opts arvados.BlockReadOptions, offset, length int64) (int, error) {
+	li, err := getLocatorInfo(opts.Locator)
+	if err != nil {
+		return 0, err
+	}
+	if li.size == 0 || offset < 0 || length < 1 || offset+length > int64(li.size) {
+		return 0, httpserver.ErrorWithStatus(errors.New("requested range not satisfiable"), http.StatusRequestedRangeNotSatisfiable)
+	}
+	if !li.remote || li.signed {
+		if err := ks.checkLocatorSignature(ctx, opts.Locator); err != nil {
+			return 0, err
+		}
+		n, err := ks.blockReadVolumeRange(ctx, li.hash, offset, length, opts.WriteTo)
+		if n > 0 || (err != nil && !os.IsNotExist(err)) {
+			return n, err
+		}
+	}
+	// None of the volumes that support range reads has the
+	// block. Read the whole block the usual way, and discard the
+	// data outside the range.
+	rw := &rangeFilter{w: opts.WriteTo, start: offset, end: offset + length}
+	opts.WriteTo = rw
+	_, err = ks.BlockRead(ctx, opts)
+	return rw.wrote, err
+}
+
+// blockReadVolumeRange tries to read the given range of a block from
+// each volume that supports range reads, in rendezvous order. It
+// returns os.ErrNotExist if none of them has the block.
+func (ks *keepstore) blockReadVolumeRange(ctx context.Context, hash string, offset, length int64, w io.Writer) (int, error) {
+	var errToCaller error = os.ErrNotExist
+	for _, mnt := range ks.rendezvous(hash, ks.mountsR) {
+		rrv, ok := mnt.volume.(rangeReadingVolume)
+		if !ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		buf, err := ks.bufferPool.GetContext(ctx)
+		if err != nil {
+			return 0, err
+		}
+		streamer := newStreamWriterAt(w, 65536, buf)
+		err = rrv.BlockReadRange(ctx, hash, offset, length, streamer)
+		if err == nil && streamer.WroteAt() != int(length) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			err = streamer.Close()
+		} else {
+			streamer.Close()
+		}
+		ks.bufferPool.Put(buf)
+		if streamer.Wrote() > 0 || err == nil {
+			// Too late to try another volume.
+			if err == nil {
+				ks.accessTimes.touch(hash)
+			}
+			return streamer.Wrote(), err
+		}
+		if !os.IsNotExist(err) {
+			errToCaller = err
+		}
+	}
+	return 0, errToCaller
+}
+
+// rangeFilter writes bytes start..end-1 of the data written to it to
+// w, and discards the rest.
+type rangeFilter struct {
+	w          io.Writer
+	start, end int64
+	pos        int64
+	wrote      int
+}
+
+func (rf *rangeFilter) Write(p []byte) (int, error) {
+	n := len(p)
+	lo, hi := rf.start-rf.pos, rf.end-rf.pos
+	rf.pos += int64(n)
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > int64(n) {
+		hi = int64(n)
+	}
+	if lo >= hi {
+		return n, nil
+	}
+	wrote, err := rf.w.Write(p[lo:hi])
+	rf.wrote += wrote
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
 func (ks *keepstore) blockReadRemote(ctx context.Context, opts arvados.BlockReadOptions) (int, error) {
 	token := ctxToken(ctx)
 	if token == "" {
@@ -385,8 +613,9 @@ func (ks *keepstore) blockReadRemote(ctx context.Context, opts arvados.BlockRead
 		return 0, err
 	}
 	resp, err := ks.BlockWrite(ctx, arvados.BlockWriteOptions{
-		Hash: locator,
-		Data: writebuf.Bytes(),
+		Hash:         locator,
+		Data:         writebuf.Bytes(),
+		SignatureTTL: opts.SignatureTTL,
 	})
 	if err != nil {
 		return 0, err
@@ -439,6 +668,10 @@ func (ks *keepstore) remoteClient(remoteID string, remoteCluster arvados.RemoteC
 func (ks *keepstore) BlockWrite(ctx context.Context, opts arvados.BlockWriteOptions) (arvados.BlockWriteResponse, error) {
 	var resp arvados.BlockWriteResponse
 	var hash string
+	// If non-nil, streamed is the mount where the block was
+	// stored while it was being received.
+	var streamed *mount
+	t0 := time.Now()
 	if opts.Data == nil {
 		buf, err := ks.bufferPool.GetContext(ctx)
 		if err != nil {
@@ -447,8 +680,21 @@ func (ks *keepstore) BlockWrite(ctx context.Context, opts arvados.BlockWriteOpti
 		defer ks.bufferPool.Put(buf)
 		w := bytes.NewBuffer(buf[:0])
 		h := md5.New()
+		dst := io.MultiWriter(w, h)
+		var stream *blockStream
+		if mnt := ks.streamingMount(opts); mnt != nil {
+			stream = ks.startBlockStream(ctx, mnt, opts.Hash[:32], opts.DataSize)
+			dst = io.MultiWriter(w, h, stream)
+			// Abort the streaming write if we return
+			// early because of a problem with the data.
+			defer func() {
+				if stream != nil {
+					stream.finish(false)
+				}
+			}()
+		}
 		limitedReader := &io.LimitedReader{R: opts.Reader, N: BlockSize}
-		n, err := io.Copy(io.MultiWriter(w, h), limitedReader)
+		n, err := io.Copy(dst, limitedReader)
 		if err != nil {
 			return resp, err
 		}
@@ -467,6 +713,12 @@ func (ks *keepstore) BlockWrite(ctx context.Context, opts arvados.BlockWriteOpti
 			return resp, httpserver.ErrorWithStatus(fmt.Errorf("content length %d did not match specified data size %d", n, opts.DataSize), http.StatusBadRequest)
 		}
 		hash = fmt.Sprintf("%x", h.Sum(nil))
+		if stream != nil && strings.HasPrefix(opts.Hash, hash) {
+			if stream.finish(true) {
+				streamed = stream.mnt
+			}
+			stream = nil
+		}
 	} else {
 		hash = fmt.Sprintf("%x", md5.Sum(opts.Data))
 	}
@@ -479,6 +731,10 @@ func (ks *keepstore) BlockWrite(ctx context.Context, opts arvados.BlockWriteOpti
 		if !result.Want(mnt) {
 			continue
 		}
+		if mnt == streamed {
+			result.Add(mnt)
+			continue
+		}
 		cmp := &checkEqual{Expect: opts.Data}
 		if err := mnt.BlockRead(ctx, hash, cmp); err == nil {
 			if !cmp.Equal() {
@@ -544,9 +800,17 @@ nextmnt:
 	if ctx.Err() != nil {
 		return resp, ctx.Err()
 	}
+	if result.Done() && ks.cluster.Collections.SmallBlockExtraReplicas > 0 && len(opts.Data) < int(ks.cluster.Collections.SmallBlockSize) {
+		ks.writeExtraReplicas(ctx, hash, opts.Data, rvzmounts, &result)
+	}
 	if result.Done() || result.totalReplication > 0 {
+		path := "buffered"
+		if streamed != nil {
+			path = "streaming"
+		}
+		ks.blockWriteLatency.WithLabelValues(path).Observe(time.Since(t0).Seconds())
 		resp = arvados.BlockWriteResponse{
-			Locator:        ks.signLocator(ctxToken(ctx), fmt.Sprintf("%s+%d", hash, len(opts.Data))),
+			Locator:        ks.writeResponseLocator(ctx, fmt.Sprintf("%s+%d", hash, len(opts.Data)), opts),
 			Replicas:       result.totalReplication,
 			StorageClasses: result.classDone,
 		}
@@ -558,6 +822,32 @@ nextmnt:
 	return resp, errVolumeUnavailable
 }
 
+// writeExtraReplicas writes a small block to additional mounts, in
+// rendezvous order, until it has Collections.SmallBlockExtraReplicas
+// more replicas than the requested storage classes needed. Only
+// mounts that offer one of the requested storage classes (or any
+// mount, if none were requested) are used.
+//
+// Errors are logged and otherwise ignored: the extra replicas are a
+// bonus, and the write has already succeeded.
+func (ks *keepstore) writeExtraReplicas(ctx context.Context, hash string, data []byte, rvzmounts []*mount, result *putProgress) {
+	want := result.totalReplication + ks.cluster.Collections.SmallBlockExtraReplicas
+	for _, mnt := range rvzmounts {
+		if result.totalReplication >= want || ctx.Err() != nil {
+			return
+		}
+		if result.mountUsed[mnt] || !result.offers(mnt) {
+			continue
+		}
+		logger := ks.logger.WithField("mount", mnt.UUID)
+		if err := mnt.BlockWrite(ctx, hash, data); err != nil {
+			logger.WithError(err).Debug("extra replica write failed")
+			continue
+		}
+		result.Add(mnt)
+	}
+}
+
 // rendezvous sorts the given mounts by descending priority, then by
 // rendezvous order for the given locator.
 func (*keepstore) rendezvous(locator string, mnts []*mount) []*mount {
@@ -692,8 +982,12 @@ func (ks *keepstore) Index(ctx context.Context, opts indexOptions) error {
 		}
 		mounts = []*mount{mnt}
 	}
+	writeTo := opts.WriteTo
+	if opts.IncludeAtime {
+		writeTo = &atimeIndexWriter{writeTo: writeTo, at: ks.accessTimes}
+	}
 	for _, mnt := range mounts {
-		err := mnt.Index(ctx, opts.Prefix, opts.WriteTo)
+		err := mnt.Index(ctx, opts.Prefix, writeTo)
 		if err != nil {
 			return err
 		}
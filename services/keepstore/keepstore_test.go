@@ -25,6 +25,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/auth"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	. "gopkg.in/check.v1"
 )
 
@@ -156,6 +157,51 @@ func (s *keepstoreSuite) TestBlockReadWrite_SigningDisabled(c *C) {
 	}
 }
 
+func (s *keepstoreSuite) TestBlockRead_PreviousSigningKey(c *C) {
+	oldKey := "oldkeyoldkeyoldkeyoldkeyoldkeyoldkeyoldkeyoldkey"
+	s.cluster.Collections.BlobSigningKey = arvadostest.BlobSigningKey
+	s.cluster.Collections.PreviousBlobSigningKeys = []string{"otherkeyotherkeyotherkeyotherkeyotherkey", oldKey}
+	ks, cancel := testKeepstore(c, s.cluster, nil)
+	defer cancel()
+
+	ctx := authContext(arvadostest.ActiveTokenV2)
+	resp, err := ks.BlockWrite(ctx, arvados.BlockWriteOptions{
+		Hash: fooHash,
+		Data: []byte("foo"),
+	})
+	c.Assert(err, IsNil)
+
+	ttl := s.cluster.Collections.BlobSigningTTL.Duration()
+	locOldKey := arvados.SignLocator(fooHash+"+3", arvadostest.ActiveTokenV2, time.Now().Add(ttl), ttl, []byte(oldKey))
+	locBadKey := arvados.SignLocator(fooHash+"+3", arvadostest.ActiveTokenV2, time.Now().Add(ttl), ttl, []byte("badkeybadkeybadkeybadkeybadkey"))
+	locExpired := arvados.SignLocator(fooHash+"+3", arvadostest.ActiveTokenV2, time.Now().Add(-time.Minute), ttl, []byte(oldKey))
+
+	for _, trial := range []struct {
+		locator string
+		expect  string
+	}{
+		{resp.Locator, ""},
+		{locOldKey, ""},
+		{locBadKey, "invalid signature"},
+		{locExpired, "expired signature"},
+	} {
+		buf := bytes.NewBuffer(nil)
+		_, err := ks.BlockRead(ctx, arvados.BlockReadOptions{
+			Locator: trial.locator,
+			WriteTo: buf,
+		})
+		if trial.expect == "" {
+			c.Check(err, IsNil)
+			c.Check(buf.String(), Equals, "foo")
+		} else {
+			c.Check(err, ErrorMatches, trial.expect)
+		}
+	}
+	c.Check(testutil.ToFloat64(ks.signatureChecks.WithLabelValues("current")), Equals, float64(1))
+	c.Check(testutil.ToFloat64(ks.signatureChecks.WithLabelValues("previous")), Equals, float64(1))
+	c.Check(testutil.ToFloat64(ks.signatureChecks.WithLabelValues("none")), Equals, float64(1))
+}
+
 func (s *keepstoreSuite) TestBlockRead_OrderedByStorageClassPriority(c *C) {
 	s.cluster.Volumes = map[string]arvados.Volume{
 		"zzzzz-nyw5e-111111111111111": {
@@ -496,6 +542,94 @@ func (s *keepstoreSuite) TestBufferPoolLeak(c *C) {
 	}
 }
 
+func (s *keepstoreSuite) TestBlockWrite_Streaming(c *C) {
+	s.cluster.Collections.BlobStreamingWrites = true
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "stub-streaming"},
+		"zzzzz-nyw5e-111111111111111": {Replication: 1, Driver: "stub-streaming"},
+	}
+	reg := prometheus.NewRegistry()
+	ks, cancel := testKeepstore(c, s.cluster, reg)
+	defer cancel()
+	ctx := authContext(arvadostest.ActiveTokenV2)
+	vols := map[string]*streamingStubVolume{}
+	for uuid, mnt := range ks.mounts {
+		vols[uuid] = mnt.volume.(*streamingStubVolume)
+	}
+	first := ks.rendezvous(fooHash, ks.mountsW)[0]
+	stored := func(hash string) (n int) {
+		for _, vol := range vols {
+			if _, err := vol.Mtime(hash); err == nil {
+				n++
+			}
+		}
+		return
+	}
+
+	// Data that doesn't match the hash is rejected, and the
+	// streaming write is aborted.
+	_, err := ks.BlockWrite(ctx, arvados.BlockWriteOptions{
+		Hash:     fooHash,
+		Reader:   strings.NewReader("bar"),
+		DataSize: 3,
+		Replicas: 1,
+	})
+	c.Check(err, ErrorMatches, `content hash .* did not match specified locator .*`)
+	c.Check(vols[first.UUID].stubLog.String(), Matches, `(?ms).*writestream acb\n.*`)
+	c.Check(vols[first.UUID].streamErr, Equals, errStreamAborted)
+	c.Check(stored(fooHash), Equals, 0)
+
+	// Matching data is stored on the first volume while it is
+	// being received, without using the buffered write path.
+	resp, err := ks.BlockWrite(ctx, arvados.BlockWriteOptions{
+		Hash:     fooHash,
+		Reader:   strings.NewReader("foo"),
+		DataSize: 3,
+		Replicas: 1,
+	})
+	c.Check(err, IsNil)
+	c.Check(resp.Replicas, Equals, 1)
+	c.Check(stored(fooHash), Equals, 1)
+	_, err = first.Mtime(fooHash)
+	c.Check(err, IsNil)
+	for _, vol := range vols {
+		c.Check(vol.stubLog.String(), Not(Matches), `(?ms).* write acb\n.*`)
+	}
+	c.Check(testutil.CollectAndCount(ks.blockWriteLatency, "arvados_keepstore_block_write_duration_seconds"), Equals, 1)
+
+	// If the streaming write fails, the block is written using
+	// the buffered path.
+	for _, vol := range vols {
+		vol.blockWriteStream = func(context.Context, string, int) error { return errors.New("stub error") }
+	}
+	resp, err = ks.BlockWrite(ctx, arvados.BlockWriteOptions{
+		Hash:     barHash,
+		Reader:   strings.NewReader("bar"),
+		DataSize: 3,
+		Replicas: 1,
+	})
+	c.Check(err, IsNil)
+	c.Check(resp.Replicas, Equals, 1)
+	c.Check(stored(barHash), Equals, 1)
+	c.Check(ks.rendezvous(barHash, ks.mountsW)[0].volume.(*streamingStubVolume).stubLog.String(), Matches, `(?ms).*writestream 37b\n.* write 37b\n.*`)
+	c.Check(testutil.CollectAndCount(ks.blockWriteLatency, "arvados_keepstore_block_write_duration_seconds"), Equals, 2)
+
+	// Without a size, the block is buffered.
+	for _, vol := range vols {
+		vol.stubLog.Reset()
+	}
+	bazHash := fmt.Sprintf("%x", md5.Sum([]byte("baz")))
+	_, err = ks.BlockWrite(ctx, arvados.BlockWriteOptions{
+		Hash:     bazHash,
+		Reader:   strings.NewReader("baz"),
+		Replicas: 1,
+	})
+	c.Check(err, IsNil)
+	for _, vol := range vols {
+		c.Check(vol.stubLog.String(), Not(Matches), `(?ms).*writestream.*`)
+	}
+}
+
 func (s *keepstoreSuite) TestPutStorageClasses(c *C) {
 	s.cluster.Volumes = map[string]arvados.Volume{
 		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "stub"}, // "default" is implicit
@@ -616,6 +750,53 @@ func (s *keepstoreSuite) TestBlockWrite_SkipReadOnly(c *C) {
 	c.Check(ks.mounts["zzzzz-nyw5e-222222222222222"].volume.(*stubVolume).stubLog.String(), HasLen, 0)
 }
 
+func (s *keepstoreSuite) TestBlockWrite_SmallBlockExtraReplicas(c *C) {
+	s.cluster.Collections.SmallBlockExtraReplicas = 2
+	s.cluster.Collections.SmallBlockSize = 1024
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "stub", StorageClasses: map[string]bool{"class1": true}},
+		"zzzzz-nyw5e-111111111111111": {Replication: 1, Driver: "stub", StorageClasses: map[string]bool{"class1": true}},
+		"zzzzz-nyw5e-222222222222222": {Replication: 1, Driver: "stub", StorageClasses: map[string]bool{"class2": true}},
+	}
+	s.cluster.StorageClasses = map[string]arvados.StorageClassConfig{
+		"class1": {},
+		"class2": {},
+	}
+	ks, cancel := testKeepstore(c, s.cluster, nil)
+	defer cancel()
+	ctx := authContext(arvadostest.ActiveTokenV2)
+	stored := func(hash string) (n int) {
+		for _, mnt := range ks.mounts {
+			if _, err := mnt.Mtime(hash); err == nil {
+				n++
+			}
+		}
+		return
+	}
+
+	// Small block is written to all 3 volumes.
+	resp, err := ks.BlockWrite(ctx, arvados.BlockWriteOptions{Data: []byte("foo")})
+	c.Assert(err, IsNil)
+	c.Check(resp.Replicas, Equals, 3)
+	c.Check(stored(fooHash), Equals, 3)
+
+	// Extra replicas are only written to volumes with the
+	// requested storage class.
+	resp, err = ks.BlockWrite(ctx, arvados.BlockWriteOptions{Data: []byte("bar"), StorageClasses: []string{"class1"}})
+	c.Assert(err, IsNil)
+	c.Check(resp.Replicas, Equals, 2)
+	c.Check(resp.StorageClasses, DeepEquals, map[string]int{"class1": 2})
+	c.Check(stored(barHash), Equals, 2)
+
+	// Block that is not small gets no extra replicas.
+	data := make([]byte, 1024)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	resp, err = ks.BlockWrite(ctx, arvados.BlockWriteOptions{Data: data})
+	c.Assert(err, IsNil)
+	c.Check(resp.Replicas, Equals, 1)
+	c.Check(stored(hash), Equals, 1)
+}
+
 func (s *keepstoreSuite) TestGetLocatorInfo(c *C) {
 	for _, trial := range []struct {
 		locator string
@@ -690,6 +871,54 @@ func init() {
 	}
 }
 
+func init() {
+	driver["stub-streaming"] = func(params newVolumeParams) (volume, error) {
+		v, err := driver["stub"](params)
+		if err != nil {
+			return nil, err
+		}
+		return &streamingStubVolume{stubVolume: v.(*stubVolume)}, nil
+	}
+}
+
+// streamingStubVolume is a stubVolume that implements
+// streamingVolume.
+type streamingStubVolume struct {
+	*stubVolume
+
+	// If non-nil, blockWriteStream is called before reading any
+	// data. If it returns an error, that error is returned to
+	// the caller.
+	blockWriteStream func(ctx context.Context, hash string, size int) error
+
+	// Error returned by the last read in BlockWriteStream.
+	streamErr error
+}
+
+func (v *streamingStubVolume) BlockWriteStream(ctx context.Context, hash string, size int, r io.Reader) error {
+	v.log("writestream", hash)
+	if v.blockWriteStream != nil {
+		if err := v.blockWriteStream(ctx, hash, size); err != nil {
+			return err
+		}
+	}
+	data, err := io.ReadAll(r)
+	v.streamErr = err
+	if err != nil {
+		return err
+	}
+	if len(data) != size {
+		return fmt.Errorf("stub: read %d bytes, expected %d", len(data), size)
+	}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.data[hash] = stubData{
+		mtime: time.Now(),
+		data:  data,
+	}
+	return nil
+}
+
 type stubLog struct {
 	sync.Mutex
 	bytes.Buffer
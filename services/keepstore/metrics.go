@@ -12,6 +12,10 @@ type volumeMetricsVecs struct {
 	ioBytes     *prometheus.CounterVec
 	errCounters *prometheus.CounterVec
 	opsCounters *prometheus.CounterVec
+	trashTags   *prometheus.GaugeVec
+
+	fsyncSeconds  *prometheus.HistogramVec
+	unsyncedBytes *prometheus.GaugeVec
 }
 
 func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
@@ -46,6 +50,37 @@ func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
 		[]string{"device_id", "direction"},
 	)
 	reg.MustRegister(m.ioBytes)
+	m.trashTags = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_tagged_trash_blocks",
+			Help:      "Number of blocks found in each tag-based trash state during the last trash sweep",
+		},
+		[]string{"device_id", "state"},
+	)
+	reg.MustRegister(m.trashTags)
+	m.fsyncSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_fsync_seconds",
+			Help:      "Time taken to fsync block files, directories, or (with FsyncPolicy=batch) the whole filesystem",
+			Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.fsyncSeconds)
+	m.unsyncedBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_unsynced_bytes",
+			Help:      "Bytes written to the volume and not yet synced (with FsyncPolicy=batch)",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.unsyncedBytes)
 
 	return m
 }
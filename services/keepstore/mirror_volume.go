@@ -0,0 +1,95 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+func init() {
+	driver["Mirror"] = newMirrorVolume
+}
+
+var errMirrorReadOnly = errors.New("mirror volume is read-only")
+
+// mirrorVolume serves blocks from a read-only replica of another
+// cluster's storage (e.g., the target of a cross-region bucket
+// replication rule), using the configured inner driver to access
+// it. Reads, mtime lookups, and index requests are passed through;
+// anything that would modify the replica is rejected.
+//
+// This lets a disaster-recovery cluster serve existing data right
+// away. If the mirror volume's storage classes are not the ones
+// collections ask for, keep-balance copies blocks from it to the
+// cluster's own volumes in the usual way.
+type mirrorVolume struct {
+	inner volume
+}
+
+func newMirrorVolume(params newVolumeParams) (volume, error) {
+	var mp arvados.MirrorVolumeDriverParameters
+	err := json.Unmarshal(params.ConfigVolume.DriverParameters, &mp)
+	if err != nil {
+		return nil, err
+	}
+	if mp.Driver == "Mirror" {
+		return nil, errors.New("mirror volume cannot use Mirror driver")
+	}
+	dri, ok := driver[mp.Driver]
+	if !ok {
+		return nil, fmt.Errorf("invalid mirror driver %q", mp.Driver)
+	}
+	params.ConfigVolume.Driver = mp.Driver
+	params.ConfigVolume.DriverParameters = mp.DriverParameters
+	params.ConfigVolume.ReadOnly = true
+	inner, err := dri(params)
+	if err != nil {
+		return nil, err
+	}
+	return &mirrorVolume{inner: inner}, nil
+}
+
+func (v *mirrorVolume) DeviceID() string {
+	return v.inner.DeviceID()
+}
+
+func (v *mirrorVolume) BlockRead(ctx context.Context, hash string, writeTo io.WriterAt) error {
+	return v.inner.BlockRead(ctx, hash, writeTo)
+}
+
+func (v *mirrorVolume) Mtime(hash string) (time.Time, error) {
+	return v.inner.Mtime(hash)
+}
+
+func (v *mirrorVolume) Index(ctx context.Context, prefix string, writeTo io.Writer) error {
+	return v.inner.Index(ctx, prefix, writeTo)
+}
+
+func (v *mirrorVolume) BlockWrite(context.Context, string, []byte) error {
+	return errMirrorReadOnly
+}
+
+func (v *mirrorVolume) BlockTouch(string) error {
+	return errMirrorReadOnly
+}
+
+func (v *mirrorVolume) BlockTrash(string) error {
+	return errMirrorReadOnly
+}
+
+func (v *mirrorVolume) BlockUntrash(string) error {
+	return errMirrorReadOnly
+}
+
+// EmptyTrash does nothing. Trash in the replica is managed by the
+// cluster that owns it.
+func (v *mirrorVolume) EmptyTrash() {}
@@ -0,0 +1,94 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"github.com/prometheus/client_golang/prometheus"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&mirrorVolumeSuite{})
+
+type mirrorVolumeSuite struct {
+	cluster *arvados.Cluster
+}
+
+func (s *mirrorVolumeSuite) SetUpTest(c *C) {
+	s.cluster = testCluster(c)
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "stub"},
+		"zzzzz-nyw5e-111111111111111": {Replication: 1, Driver: "Mirror", DriverParameters: json.RawMessage(`{"Driver":"stub"}`)},
+	}
+}
+
+func (s *mirrorVolumeSuite) TestReadOnly(c *C) {
+	ks, cancel := testKeepstore(c, s.cluster, nil)
+	defer cancel()
+	ctx := authContext(arvadostest.ActiveTokenV2)
+
+	mnt := ks.mounts["zzzzz-nyw5e-111111111111111"]
+	c.Check(mnt.AllowWrite, Equals, false)
+	c.Check(mnt.AllowTrash, Equals, false)
+	c.Assert(ks.mountsW, HasLen, 1)
+	c.Check(ks.mountsW[0].UUID, Equals, "zzzzz-nyw5e-000000000000000")
+
+	// Blocks in the replica can be read and listed.
+	inner := mnt.volume.(*mirrorVolume).inner.(*stubVolume)
+	c.Assert(inner.BlockWrite(ctx, fooHash, []byte("foo")), IsNil)
+	buf := bytes.NewBuffer(nil)
+	_, err := ks.BlockRead(ctx, arvados.BlockReadOptions{
+		Locator: ks.signLocator(arvadostest.ActiveTokenV2, fooHash+"+3"),
+		WriteTo: buf,
+	})
+	c.Check(err, IsNil)
+	c.Check(buf.String(), Equals, "foo")
+	idx := bytes.NewBuffer(nil)
+	c.Check(mnt.Index(context.Background(), "", idx), IsNil)
+	c.Check(idx.String(), Matches, fooHash+`\+3 \d+\n`)
+	_, err = mnt.Mtime(fooHash)
+	c.Check(err, IsNil)
+
+	// Modifications are rejected.
+	c.Check(mnt.BlockWrite(ctx, barHash, []byte("bar")), Equals, errMirrorReadOnly)
+	c.Check(mnt.BlockTouch(fooHash), Equals, errMirrorReadOnly)
+	c.Check(mnt.BlockTrash(fooHash), Equals, errMirrorReadOnly)
+	c.Check(mnt.BlockUntrash(fooHash), Equals, errMirrorReadOnly)
+	mnt.EmptyTrash()
+	c.Check(inner.BlockRead(ctx, fooHash, brdiscard), IsNil)
+
+	// New blocks are written to the cluster's own volume.
+	_, err = ks.BlockWrite(ctx, arvados.BlockWriteOptions{Hash: barHash, Data: []byte("bar")})
+	c.Check(err, IsNil)
+	c.Check(inner.BlockRead(ctx, barHash, brdiscard), Equals, os.ErrNotExist)
+	c.Check(ks.mountsW[0].BlockRead(ctx, barHash, brdiscard), IsNil)
+
+	// Trash requests don't affect the replica.
+	c.Check(ks.BlockTrash(ctx, fooHash+"+3"), Equals, os.ErrNotExist)
+	c.Check(inner.BlockRead(ctx, fooHash, brdiscard), IsNil)
+}
+
+func (s *mirrorVolumeSuite) TestConfigErrors(c *C) {
+	for _, params := range []string{
+		`{}`,
+		`{"Driver":"Mirror","DriverParameters":{"Driver":"stub"}}`,
+		`{"Driver":"bogus"}`,
+	} {
+		c.Logf("params: %s", params)
+		_, err := newMirrorVolume(newVolumeParams{
+			UUID:         "zzzzz-nyw5e-111111111111111",
+			Cluster:      s.cluster,
+			ConfigVolume: arvados.Volume{Driver: "Mirror", DriverParameters: json.RawMessage(params)},
+			MetricsVecs:  newVolumeMetricsVecs(prometheus.NewRegistry()),
+		})
+		c.Check(err, NotNil)
+	}
+}
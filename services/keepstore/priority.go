@@ -0,0 +1,155 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// requestPriority is the scheduling class of a request, as
+// indicated by the client's X-Keep-Priority header.
+//
+// Batch requests (e.g., bulk container I/O) are not allowed to use
+// the last few buffers in the buffer pool, so interactive requests
+// (e.g., keep-web downloads) can still make progress when the pool
+// is busy with batch traffic. On volumes that serialize I/O,
+// interactive requests also get the volume lock ahead of waiting
+// batch requests (see priorityLock).
+type requestPriority int
+
+const (
+	priorityInteractive requestPriority = iota
+	priorityBatch
+)
+
+func (p requestPriority) String() string {
+	if p == priorityBatch {
+		return keepclient.PriorityBatch
+	}
+	return keepclient.PriorityInteractive
+}
+
+// parsePriority returns the priority indicated by the given header
+// value. Anything other than "batch" is treated as interactive.
+func parsePriority(hdr string) requestPriority {
+	if strings.EqualFold(strings.TrimSpace(hdr), keepclient.PriorityBatch) {
+		return priorityBatch
+	}
+	return priorityInteractive
+}
+
+type priorityContextKey struct{}
+
+func contextWithPriority(ctx context.Context, p requestPriority) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, p)
+}
+
+func priorityFromContext(ctx context.Context) requestPriority {
+	p, _ := ctx.Value(priorityContextKey{}).(requestPriority)
+	return p
+}
+
+// priorityHandler attaches the request priority to the request
+// context, and records request latency by priority class.
+func priorityHandler(next http.Handler, latency *prometheus.SummaryVec) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		prio := parsePriority(req.Header.Get(keepclient.XKeepPriority))
+		t0 := time.Now()
+		next.ServeHTTP(w, req.WithContext(contextWithPriority(req.Context(), prio)))
+		if latency != nil {
+			latency.WithLabelValues(prio.String(), req.Method).Observe(time.Since(t0).Seconds())
+		}
+	})
+}
+
+func newRequestLatencyMetric(reg *prometheus.Registry) *prometheus.SummaryVec {
+	latency := prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "request_duration_by_priority_seconds",
+			Help:      "Request latency, by priority class and method",
+		},
+		[]string{"priority", "method"},
+	)
+	if reg != nil {
+		reg.MustRegister(latency)
+	}
+	return latency
+}
+
+// priorityLock is a mutex that, when contended, is handed to waiting
+// interactive requests before waiting batch requests. It is used to
+// schedule I/O on volumes that serialize access (see
+// unixVolume.Serialize).
+type priorityLock struct {
+	mtx     sync.Mutex
+	locked  bool
+	waiting [2][]chan struct{} // by requestPriority
+}
+
+// Lock acquires the lock with interactive priority.
+func (l *priorityLock) Lock() {
+	l.LockContext(context.Background())
+}
+
+// LockContext acquires the lock, waiting behind other requests of
+// the same or higher priority (see priorityFromContext). If ctx is
+// done first, it returns ctx.Err() without acquiring the lock.
+func (l *priorityLock) LockContext(ctx context.Context) error {
+	prio := priorityFromContext(ctx)
+	l.mtx.Lock()
+	if !l.locked {
+		l.locked = true
+		l.mtx.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	l.waiting[prio] = append(l.waiting[prio], ready)
+	l.mtx.Unlock()
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	l.mtx.Lock()
+	for i, ch := range l.waiting[prio] {
+		if ch == ready {
+			l.waiting[prio] = append(l.waiting[prio][:i], l.waiting[prio][i+1:]...)
+			l.mtx.Unlock()
+			return ctx.Err()
+		}
+	}
+	l.mtx.Unlock()
+	// Unlock handed us the lock after ctx was done. Pass it
+	// on.
+	l.Unlock()
+	return ctx.Err()
+}
+
+// Unlock releases the lock, or hands it to the next waiting
+// request.
+func (l *priorityLock) Unlock() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if !l.locked {
+		panic("unlock of unlocked priorityLock")
+	}
+	for prio, waiting := range l.waiting {
+		if len(waiting) > 0 {
+			close(waiting[0])
+			l.waiting[prio] = waiting[1:]
+			return
+		}
+	}
+	l.locked = false
+}
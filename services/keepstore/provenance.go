@@ -0,0 +1,145 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+// blockProvenance records who wrote each block, and when (see
+// Collections.BlobProvenanceFile), so unexpected data can be traced
+// back to the token and client that wrote it.
+//
+// Tokens are not recorded. A v2 token's UUID is recorded as is, and
+// its secret part (or an entire v1 token) is recorded as an HMAC
+// keyed with the blob signing key, so a record can be matched to a
+// known token without revealing the token itself.
+//
+// A nil *blockProvenance is valid, and records nothing.
+type blockProvenance struct {
+	file   string
+	key    []byte
+	logger logrus.FieldLogger
+
+	mtx sync.Mutex
+	f   *os.File
+}
+
+type provenanceRecord struct {
+	Hash         string    `json:"hash"`
+	Time         time.Time `json:"time"`
+	TokenUUID    string    `json:"token_uuid,omitempty"`
+	TokenHMAC    string    `json:"token_hmac,omitempty"`
+	RemoteAddr   string    `json:"remote_addr"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	RequestID    string    `json:"request_id,omitempty"`
+}
+
+// newBlockProvenance returns nil if provenance recording is
+// disabled. Otherwise, it opens the provenance file for appending.
+func newBlockProvenance(cluster *arvados.Cluster, logger logrus.FieldLogger) (*blockProvenance, error) {
+	file := cluster.Collections.BlobProvenanceFile
+	if file == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening Collections.BlobProvenanceFile: %w", err)
+	}
+	key := cluster.Collections.BlobSigningKey
+	if key == "" {
+		key = cluster.SystemRootToken
+	}
+	return &blockProvenance{
+		file:   file,
+		key:    []byte(key),
+		logger: logger,
+		f:      f,
+	}, nil
+}
+
+// record appends a record of a successful write request for the
+// given block.
+func (bp *blockProvenance) record(hash string, req *http.Request) {
+	if bp == nil {
+		return
+	}
+	rec := provenanceRecord{
+		Hash:         hash,
+		Time:         time.Now().UTC(),
+		RemoteAddr:   req.RemoteAddr,
+		ForwardedFor: req.Header.Get("X-Forwarded-For"),
+		UserAgent:    req.Header.Get("User-Agent"),
+		RequestID:    req.Header.Get("X-Request-Id"),
+	}
+	if token := ctxToken(req.Context()); token != "" {
+		rec.TokenUUID, rec.TokenHMAC = bp.hashToken(token)
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		bp.logger.WithError(err).Warn("error encoding block provenance record")
+		return
+	}
+	buf = append(buf, '\n')
+	bp.mtx.Lock()
+	defer bp.mtx.Unlock()
+	if _, err := bp.f.Write(buf); err != nil {
+		bp.logger.WithError(err).Warnf("error writing block provenance record to %s", bp.file)
+	}
+}
+
+// hashToken returns the UUID of the given token (if it is a v2
+// token) and the HMAC of its secret part.
+func (bp *blockProvenance) hashToken(token string) (uuid, tokenHMAC string) {
+	secret := token
+	if parts := strings.Split(token, "/"); len(parts) == 3 && parts[0] == "v2" {
+		uuid, secret = parts[1], parts[2]
+	}
+	mac := hmac.New(sha256.New, bp.key)
+	mac.Write([]byte(secret))
+	return uuid, fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// lookup returns the recorded writes of the given block, oldest
+// first.
+func (bp *blockProvenance) lookup(hash string) ([]provenanceRecord, error) {
+	if bp == nil {
+		return nil, nil
+	}
+	f, err := os.Open(bp.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	match := []byte(`{"hash":"` + hash + `"`)
+	recs := []provenanceRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, match) {
+			continue
+		}
+		var rec provenanceRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("malformed line %q: %w", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scanner.Err()
+}
@@ -0,0 +1,89 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&provenanceSuite{})
+
+type provenanceSuite struct {
+	cluster *arvados.Cluster
+}
+
+func (s *provenanceSuite) SetUpTest(c *C) {
+	s.cluster = testCluster(c)
+	s.cluster.Collections.BlobProvenanceFile = c.MkDir() + "/provenance"
+}
+
+func (s *provenanceSuite) TestDisabled(c *C) {
+	s.cluster.Collections.BlobProvenanceFile = ""
+	bp, err := newBlockProvenance(s.cluster, ctxlog.TestLogger(c))
+	c.Check(err, IsNil)
+	c.Check(bp, IsNil)
+	bp.record(fooHash, httptest.NewRequest("PUT", "/"+fooHash, nil))
+	recs, err := bp.lookup(fooHash)
+	c.Check(err, IsNil)
+	c.Check(recs, HasLen, 0)
+}
+
+func (s *provenanceSuite) TestRecordAndLookup(c *C) {
+	bp, err := newBlockProvenance(s.cluster, ctxlog.TestLogger(c))
+	c.Assert(err, IsNil)
+	for i, token := range []string{arvadostest.ActiveTokenV2, "v1token", ""} {
+		req := httptest.NewRequest("PUT", "/"+fooHash, nil)
+		req.Header.Set("User-Agent", "test-agent")
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		req.Header.Set("X-Request-Id", fmt.Sprintf("req-%d", i))
+		if token != "" {
+			req = req.WithContext(auth.NewContext(req.Context(), auth.NewCredentials(token)))
+		}
+		bp.record(fooHash, req)
+	}
+	bp.record(barHash, httptest.NewRequest("PUT", "/"+barHash, nil))
+
+	recs, err := bp.lookup(fooHash)
+	c.Assert(err, IsNil)
+	c.Assert(recs, HasLen, 3)
+	c.Check(recs[0].Hash, Equals, fooHash)
+	c.Check(recs[0].TokenUUID, Equals, arvadostest.ActiveTokenUUID)
+	c.Check(recs[0].TokenHMAC, HasLen, 64)
+	c.Check(recs[0].RemoteAddr, Equals, "192.0.2.1:1234")
+	c.Check(recs[0].ForwardedFor, Equals, "192.0.2.1")
+	c.Check(recs[0].UserAgent, Equals, "test-agent")
+	c.Check(recs[0].RequestID, Equals, "req-0")
+	c.Check(recs[1].TokenUUID, Equals, "")
+	c.Check(recs[1].TokenHMAC, HasLen, 64)
+	c.Check(recs[1].TokenHMAC, Not(Equals), recs[0].TokenHMAC)
+	c.Check(recs[2].TokenUUID, Equals, "")
+	c.Check(recs[2].TokenHMAC, Equals, "")
+	c.Check(recs[0].Time.After(recs[2].Time), Equals, false)
+
+	// The same token always gets the same HMAC, so an
+	// administrator can check whether a given token was used.
+	uuid, tokenHMAC := bp.hashToken(arvadostest.ActiveTokenV2)
+	c.Check(uuid, Equals, arvadostest.ActiveTokenUUID)
+	c.Check(tokenHMAC, Equals, recs[0].TokenHMAC)
+
+	// Tokens are not stored.
+	buf, err := os.ReadFile(s.cluster.Collections.BlobProvenanceFile)
+	c.Assert(err, IsNil)
+	c.Check(strings.Contains(string(buf), arvadostest.ActiveToken), Equals, false)
+	c.Check(strings.Contains(string(buf), "v1token"), Equals, false)
+
+	recs, err = bp.lookup(barHash)
+	c.Check(err, IsNil)
+	c.Check(recs, HasLen, 1)
+}
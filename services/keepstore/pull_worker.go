@@ -108,6 +108,7 @@ func (p *puller) runWorker(ctx context.Context) {
 			p.cond.Wait()
 		}
 		if ctx.Err() != nil {
+			p.cond.L.Unlock()
 			return
 		}
 		item := p.todo[0]
@@ -126,6 +127,12 @@ func (p *puller) runWorker(ctx context.Context) {
 				return
 			}
 
+			if !p.keepstore.blockOps.start(li.hash, blockOpPull) {
+				logger.Info("skipping pull request because a trash operation on the same block is in progress")
+				return
+			}
+			defer p.keepstore.blockOps.done(li.hash)
+
 			var dst *mount
 			if item.MountUUID != "" {
 				dst = p.keepstore.mounts[item.MountUUID]
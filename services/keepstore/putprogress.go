@@ -64,6 +64,20 @@ func (pr *putProgress) Want(mnt *mount) bool {
 	return false
 }
 
+// offers returns true if mnt offers one of the needed storage
+// classes, or if no storage classes were specified.
+func (pr *putProgress) offers(mnt *mount) bool {
+	if len(pr.classNeeded) == 0 {
+		return true
+	}
+	for class := range mnt.StorageClasses {
+		if pr.classNeeded[class] {
+			return true
+		}
+	}
+	return false
+}
+
 func (pr *putProgress) Copy() *putProgress {
 	cp := putProgress{
 		classNeeded:      pr.classNeeded,
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"git.arvados.org/arvados.git/lib/service"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -49,15 +50,16 @@ func newRouter(keepstore *keepstore, puller *puller, trasher *trasher) service.H
 	r.SkipClean(true)
 	locatorPath := `/{locator:[0-9a-f]{32}.*}`
 	get := r.Methods(http.MethodGet, http.MethodHead).Subrouter()
-	get.HandleFunc(locatorPath, rtr.handleBlockRead)
-	get.HandleFunc("/"+locatorPath, rtr.handleBlockRead) // for compatibility -- see TestBlockRead_DoubleSlash
+	get.HandleFunc(locatorPath, rtr.countTransfer(rtr.handleBlockRead))
+	get.HandleFunc("/"+locatorPath, rtr.countTransfer(rtr.handleBlockRead)) // for compatibility -- see TestBlockRead_DoubleSlash
 	get.HandleFunc(`/index`, adminonly(rtr.handleIndex))
 	get.HandleFunc(`/index/{prefix:[0-9a-f]{0,32}}`, adminonly(rtr.handleIndex))
 	get.HandleFunc(`/mounts`, adminonly(rtr.handleMounts))
 	get.HandleFunc(`/mounts/{uuid}/blocks`, adminonly(rtr.handleIndex))
 	get.HandleFunc(`/mounts/{uuid}/blocks/{prefix:[0-9a-f]{0,32}}`, adminonly(rtr.handleIndex))
+	get.HandleFunc(`/provenance/{hash:[0-9a-f]{32}}`, adminonly(rtr.handleProvenance))
 	put := r.Methods(http.MethodPut).Subrouter()
-	put.HandleFunc(locatorPath, rtr.handleBlockWrite)
+	put.HandleFunc(locatorPath, rtr.countTransfer(rtr.handleBlockWrite))
 	put.HandleFunc(`/pull`, adminonly(rtr.handlePullList))
 	put.HandleFunc(`/trash`, adminonly(rtr.handleTrashList))
 	put.HandleFunc(`/untrash`+locatorPath, adminonly(rtr.handleUntrash))
@@ -69,7 +71,7 @@ func newRouter(keepstore *keepstore, puller *puller, trasher *trasher) service.H
 	options.NewRoute().PathPrefix(`/`).HandlerFunc(rtr.handleOptions)
 	r.NotFoundHandler = http.HandlerFunc(rtr.handleBadRequest)
 	r.MethodNotAllowedHandler = http.HandlerFunc(rtr.handleBadRequest)
-	rtr.Handler = corsHandler(auth.LoadToken(r))
+	rtr.Handler = corsHandler(auth.LoadToken(priorityHandler(r, keepstore.requestLatency)))
 	return rtr
 }
 
@@ -87,12 +89,13 @@ func (rtr *router) handleBlockRead(w http.ResponseWriter, req *http.Request) {
 	// been added or changed.
 	w.Header().Add("Vary", keepclient.XKeepSignature)
 	var localLocator func(string)
-	if strings.SplitN(req.Header.Get(keepclient.XKeepSignature), ",", 2)[0] == "local" {
+	sigopts := parseSignatureHeader(req.Header.Get(keepclient.XKeepSignature))
+	if sigopts.local {
 		localLocator = func(locator string) {
 			w.Header().Set(keepclient.XKeepLocator, locator)
 		}
 	}
-	out := w
+	var out io.Writer = w
 	if req.Method == http.MethodHead {
 		out = discardWrite{ResponseWriter: w}
 	} else if li, err := getLocatorInfo(mux.Vars(req)["locator"]); err != nil {
@@ -103,11 +106,31 @@ func (rtr *router) handleBlockRead(w http.ResponseWriter, req *http.Request) {
 		// because we can't report md5 mismatches.
 		rtr.handleError(w, req, errMethodNotAllowed)
 		return
+	} else if start, end, ok := parseByteRange(req.Header.Get("Range")); ok && li.size > 0 {
+		if end < 0 || end >= int64(li.size) {
+			end = int64(li.size) - 1
+		}
+		if start > end {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", li.size))
+			rtr.handleError(w, req, httpserver.ErrorWithStatus(errors.New("requested range not satisfiable"), http.StatusRequestedRangeNotSatisfiable))
+			return
+		}
+		n, err := rtr.keepstore.BlockReadRange(req.Context(), arvados.BlockReadOptions{
+			Locator:      mux.Vars(req)["locator"],
+			WriteTo:      &rangeWriter{ResponseWriter: w, start: start, end: end, size: li.size},
+			LocalLocator: localLocator,
+			SignatureTTL: sigopts.ttl,
+		}, start, end-start+1)
+		if err != nil && n == 0 {
+			rtr.handleError(w, req, err)
+		}
+		return
 	}
 	n, err := rtr.keepstore.BlockRead(req.Context(), arvados.BlockReadOptions{
 		Locator:      mux.Vars(req)["locator"],
 		WriteTo:      out,
 		LocalLocator: localLocator,
+		SignatureTTL: sigopts.ttl,
 	})
 	if err != nil && (n == 0 || req.Method == http.MethodHead) {
 		rtr.handleError(w, req, err)
@@ -118,6 +141,7 @@ func (rtr *router) handleBlockRead(w http.ResponseWriter, req *http.Request) {
 func (rtr *router) handleBlockWrite(w http.ResponseWriter, req *http.Request) {
 	dataSize, _ := strconv.Atoi(req.Header.Get("Content-Length"))
 	replicas, _ := strconv.Atoi(req.Header.Get(keepclient.XKeepDesiredReplicas))
+	sigopts := parseSignatureHeader(req.Header.Get(keepclient.XKeepSignature))
 	resp, err := rtr.keepstore.BlockWrite(req.Context(), arvados.BlockWriteOptions{
 		Hash:           mux.Vars(req)["locator"],
 		Reader:         req.Body,
@@ -125,11 +149,14 @@ func (rtr *router) handleBlockWrite(w http.ResponseWriter, req *http.Request) {
 		RequestID:      req.Header.Get("X-Request-Id"),
 		StorageClasses: trimSplit(req.Header.Get(keepclient.XKeepStorageClasses), ","),
 		Replicas:       replicas,
+		Unsigned:       sigopts.none,
+		SignatureTTL:   sigopts.ttl,
 	})
 	if err != nil {
 		rtr.handleError(w, req, err)
 		return
 	}
+	rtr.keepstore.provenance.record(resp.Locator[:32], req)
 	w.Header().Set(keepclient.XKeepReplicasStored, fmt.Sprintf("%d", resp.Replicas))
 	scc := ""
 	for k, n := range resp.StorageClasses {
@@ -159,6 +186,19 @@ func (rtr *router) handleMounts(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(rtr.keepstore.Mounts())
 }
 
+func (rtr *router) handleProvenance(w http.ResponseWriter, req *http.Request) {
+	if rtr.keepstore.provenance == nil {
+		rtr.handleError(w, req, httpserver.ErrorWithStatus(errors.New("block provenance is not being recorded (see Collections.BlobProvenanceFile)"), http.StatusNotImplemented))
+		return
+	}
+	recs, err := rtr.keepstore.provenance.lookup(mux.Vars(req)["hash"])
+	if err != nil {
+		rtr.handleError(w, req, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": recs})
+}
+
 func (rtr *router) handleIndex(w http.ResponseWriter, req *http.Request) {
 	prefix := req.FormValue("prefix")
 	if prefix == "" {
@@ -169,6 +209,8 @@ func (rtr *router) handleIndex(w http.ResponseWriter, req *http.Request) {
 		MountUUID: mux.Vars(req)["uuid"],
 		Prefix:    prefix,
 		WriteTo:   cw,
+
+		IncludeAtime: req.FormValue("atime") == "true",
 	})
 	if err != nil && cw.n.Load() == 0 {
 		// Nothing was written, so it's not too late to report
@@ -264,6 +306,39 @@ func trimSplit(s, sep string) []string {
 	return r
 }
 
+// signatureOptions are the options requested in an X-Keep-Signature
+// request header.
+type signatureOptions struct {
+	// "local": return a locally signed locator in the
+	// X-Keep-Locator response header (GET/HEAD).
+	local bool
+	// "none": return an unsigned locator (PUT).
+	none bool
+	// "ttl=N": signature expires after N seconds.
+	ttl time.Duration
+}
+
+// parseSignatureHeader parses an X-Keep-Signature header value like
+// "local, time=2006-01-02T15:04:05Z, ttl=3600". Unrecognized options
+// are ignored.
+func parseSignatureHeader(hdr string) signatureOptions {
+	var opts signatureOptions
+	for _, part := range trimSplit(hdr, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "local":
+			opts.local = true
+		case "none":
+			opts.none = true
+		case "ttl":
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+				opts.ttl = time.Duration(n) * time.Second
+			}
+		}
+	}
+	return opts
+}
+
 // setSizeOnWrite sets the Content-Length header to the given size on
 // first write.
 type setSizeOnWrite struct {
@@ -280,6 +355,53 @@ func (ss *setSizeOnWrite) Write(p []byte) (int, error) {
 	return ss.ResponseWriter.Write(p)
 }
 
+// parseByteRange parses a Range header of the form "bytes=start-end"
+// or "bytes=start-". It returns ok=false if the header is empty,
+// malformed, or specifies multiple ranges, in which case the whole
+// block should be sent. If the end is not given, end is -1.
+func parseByteRange(hdr string) (start, end int64, ok bool) {
+	spec := strings.TrimPrefix(hdr, "bytes=")
+	if spec == hdr || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	dash := strings.Index(spec, "-")
+	if dash < 1 {
+		// Suffix ranges ("bytes=-N") are not supported.
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if spec[dash+1:] == "" {
+		return start, -1, true
+	}
+	end, err = strconv.ParseInt(spec[dash+1:], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// rangeWriter sends the given range of a block of the given size as
+// a 206 Partial Content response.
+type rangeWriter struct {
+	http.ResponseWriter
+	start, end int64
+	size       int
+	wrote      bool
+}
+
+func (rw *rangeWriter) Write(p []byte) (int, error) {
+	if !rw.wrote {
+		rw.Header().Set("Content-Length", fmt.Sprintf("%d", rw.end-rw.start+1))
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rw.start, rw.end, rw.size))
+		rw.ResponseWriter.WriteHeader(http.StatusPartialContent)
+		rw.wrote = true
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
 type discardWrite struct {
 	http.ResponseWriter
 }
@@ -298,7 +420,7 @@ func corsHandler(h http.Handler) http.Handler {
 var corsHeaders = map[string]string{
 	"Access-Control-Allow-Methods":  "GET, HEAD, PUT, OPTIONS",
 	"Access-Control-Allow-Origin":   "*",
-	"Access-Control-Allow-Headers":  "Authorization, Content-Length, Content-Type, " + keepclient.XKeepDesiredReplicas + ", " + keepclient.XKeepSignature + ", " + keepclient.XKeepStorageClasses,
+	"Access-Control-Allow-Headers":  "Authorization, Content-Length, Content-Type, " + keepclient.XKeepDesiredReplicas + ", " + keepclient.XKeepPriority + ", " + keepclient.XKeepSignature + ", " + keepclient.XKeepStorageClasses,
 	"Access-Control-Expose-Headers": keepclient.XKeepLocator + ", " + keepclient.XKeepReplicasStored + ", " + keepclient.XKeepStorageClassesConfirmed,
 	"Access-Control-Max-Age":        "86486400",
 }
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +16,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -212,6 +214,99 @@ func (s *routerSuite) TestBlockRead_ChecksumMismatch(c *C) {
 	}
 }
 
+func (s *routerSuite) TestBlockRead_Range(c *C) {
+	router, cancel := testRouter(c, s.cluster, nil)
+	defer cancel()
+
+	data := make([]byte, 200_000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	err := router.keepstore.mountsW[0].BlockWrite(context.Background(), hash, data)
+	c.Assert(err, IsNil)
+	locSigned := router.keepstore.signLocator(arvadostest.ActiveTokenV2, fmt.Sprintf("%s+%d", hash, len(data)))
+
+	for _, trial := range []struct {
+		rangeHdr     string
+		expectCode   int
+		expectStart  int
+		expectEnd    int
+		contentRange string
+	}{
+		{"bytes=0-99", http.StatusPartialContent, 0, 100, "bytes 0-99/200000"},
+		{"bytes=100000-199999", http.StatusPartialContent, 100000, 200000, "bytes 100000-199999/200000"},
+		{"bytes=65530-65545", http.StatusPartialContent, 65530, 65546, "bytes 65530-65545/200000"},
+		{"bytes=150000-", http.StatusPartialContent, 150000, 200000, "bytes 150000-199999/200000"},
+		{"bytes=150000-999999", http.StatusPartialContent, 150000, 200000, "bytes 150000-199999/200000"},
+		{"bytes=-100", http.StatusOK, 0, 200000, ""},
+		{"bytes=0-1,5-6", http.StatusOK, 0, 200000, ""},
+		{"bytes=200000-", http.StatusRequestedRangeNotSatisfiable, 0, 0, "bytes */200000"},
+	} {
+		c.Logf("=== Range: %s", trial.rangeHdr)
+		resp := call(router, "GET", "http://example/"+locSigned, arvadostest.ActiveTokenV2, nil, http.Header{"Range": {trial.rangeHdr}})
+		c.Check(resp.Code, Equals, trial.expectCode)
+		c.Check(resp.Header().Get("Content-Range"), Equals, trial.contentRange)
+		if trial.expectCode == http.StatusRequestedRangeNotSatisfiable {
+			continue
+		}
+		c.Check(resp.Result().ContentLength, Equals, int64(trial.expectEnd-trial.expectStart))
+		c.Check(bytes.Equal(resp.Body.Bytes(), data[trial.expectStart:trial.expectEnd]), Equals, true)
+	}
+}
+
+// rangeStubVolume is a stubVolume that supports range reads.
+type rangeStubVolume struct {
+	*stubVolume
+}
+
+func (v rangeStubVolume) BlockReadRange(ctx context.Context, hash string, offset, length int64, writeTo io.WriterAt) error {
+	v.log("readrange", hash)
+	v.mtx.Lock()
+	ent, ok := v.data[hash]
+	v.mtx.Unlock()
+	if !ok || !ent.trash.IsZero() {
+		return os.ErrNotExist
+	}
+	if offset+length > int64(len(ent.data)) {
+		return io.ErrUnexpectedEOF
+	}
+	_, err := writeTo.WriteAt(ent.data[offset:offset+length], 0)
+	return err
+}
+
+func (s *routerSuite) TestBlockRead_RangeFromVolume(c *C) {
+	router, cancel := testRouter(c, s.cluster, nil)
+	defer cancel()
+
+	data := make([]byte, 200_000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	stubLog := &stubLog{}
+	for _, mnt := range router.keepstore.mounts {
+		mnt.volume.(*stubVolume).stubLog = stubLog
+		mnt.volume = rangeStubVolume{mnt.volume.(*stubVolume)}
+	}
+	err := router.keepstore.mountsW[1].BlockWrite(context.Background(), hash, data)
+	c.Assert(err, IsNil)
+	locSigned := router.keepstore.signLocator(arvadostest.ActiveTokenV2, fmt.Sprintf("%s+%d", hash, len(data)))
+
+	// Only the requested range is read from the volume.
+	resp := call(router, "GET", "http://example/"+locSigned, arvadostest.ActiveTokenV2, nil, http.Header{"Range": {"bytes=100000-100099"}})
+	c.Check(resp.Code, Equals, http.StatusPartialContent)
+	c.Check(resp.Header().Get("Content-Range"), Equals, "bytes 100000-100099/200000")
+	c.Check(resp.Body.Bytes(), DeepEquals, data[100000:100100])
+	c.Check(stubLog.String(), Not(Matches), `(?ms).* read `+hash[:3]+`\n.*`)
+	c.Check(stubLog.String(), Matches, `(?ms).* readrange `+hash[:3]+`\n.*`)
+
+	// A full read is still checked against the hash.
+	resp = call(router, "GET", "http://example/"+locSigned, arvadostest.ActiveTokenV2, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.Len(), Equals, len(data))
+}
+
 func (s *routerSuite) TestBlockWrite(c *C) {
 	router, cancel := testRouter(c, s.cluster, nil)
 	defer cancel()
@@ -253,6 +348,60 @@ func (s *routerSuite) TestBlockWrite_Headers(c *C) {
 	c.Check(confirmed, DeepEquals, []string{"testclass1=1", "testclass2=1"})
 }
 
+func (s *routerSuite) TestBlockWrite_SignatureOptions(c *C) {
+	router, cancel := testRouter(c, s.cluster, nil)
+	defer cancel()
+	defaultTTL := s.cluster.Collections.BlobSigningTTL.Duration()
+
+	// expiry returns the signature expiry time of the locator in
+	// a PUT response.
+	expiry := func(resp *httptest.ResponseRecorder) time.Time {
+		c.Assert(resp.Code, Equals, http.StatusOK)
+		locator := strings.TrimSpace(resp.Body.String())
+		i := strings.Index(locator, "@")
+		c.Assert(i > 0, Equals, true, Commentf("locator %q", locator))
+		unix, err := strconv.ParseInt(locator[i+1:], 16, 64)
+		c.Assert(err, IsNil)
+		return time.Unix(unix, 0)
+	}
+	checkTTL := func(t time.Time, ttl time.Duration) {
+		c.Check(t.After(time.Now().Add(ttl-time.Minute)), Equals, true, Commentf("expiry %v, ttl %v", t, ttl))
+		c.Check(t.Before(time.Now().Add(ttl+time.Minute)), Equals, true, Commentf("expiry %v, ttl %v", t, ttl))
+	}
+
+	for _, trial := range []struct {
+		token  string
+		header string
+		ttl    time.Duration
+	}{
+		{arvadostest.ActiveTokenV2, "", defaultTTL},
+		{arvadostest.ActiveTokenV2, "ttl=3600", time.Hour},
+		{arvadostest.ActiveTokenV2, "ttl=bogus", defaultTTL},
+		// Longer than the default TTL is only allowed for
+		// the system root token.
+		{arvadostest.ActiveTokenV2, fmt.Sprintf("ttl=%d", int64((defaultTTL * 2).Seconds())), defaultTTL},
+		{arvadostest.SystemRootToken, fmt.Sprintf("ttl=%d", int64((defaultTTL * 2).Seconds())), defaultTTL * 2},
+		// Unsigned is only allowed for the system root token.
+		{arvadostest.ActiveTokenV2, "none", defaultTTL},
+	} {
+		c.Logf("trial: %+v", trial)
+		resp := call(router, "PUT", "http://example/"+fooHash, trial.token, []byte("foo"), http.Header{"X-Keep-Signature": {trial.header}})
+		checkTTL(expiry(resp), trial.ttl)
+	}
+
+	resp := call(router, "PUT", "http://example/"+fooHash, arvadostest.SystemRootToken, []byte("foo"), http.Header{"X-Keep-Signature": {"none"}})
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(strings.TrimSpace(resp.Body.String()), Equals, fooHash+"+3")
+}
+
+func (s *routerSuite) TestParseSignatureHeader(c *C) {
+	c.Check(parseSignatureHeader(""), Equals, signatureOptions{})
+	c.Check(parseSignatureHeader("local, time=2006-01-02T15:04:05Z"), Equals, signatureOptions{local: true})
+	c.Check(parseSignatureHeader("local, time=2006-01-02T15:04:05Z, ttl=60"), Equals, signatureOptions{local: true, ttl: time.Minute})
+	c.Check(parseSignatureHeader(" none "), Equals, signatureOptions{none: true})
+	c.Check(parseSignatureHeader("ttl=-1, bogus"), Equals, signatureOptions{})
+}
+
 func sortCommaSeparated(s string) string {
 	slice := strings.Split(s, ", ")
 	sort.Strings(slice)
@@ -519,6 +668,90 @@ func (s *routerSuite) TestIndex(c *C) {
 	}
 }
 
+func (s *routerSuite) TestIndexAtime(c *C) {
+	s.cluster.Collections.BlobAccessTimeResolution = arvados.Duration(time.Hour)
+	router, cancel := testRouter(c, s.cluster, nil)
+	defer cancel()
+
+	t0 := time.Now().Add(-time.Hour)
+	vol0 := router.keepstore.mounts["zzzzz-nyw5e-000000000000000"].volume.(*stubVolume)
+	for _, hash := range []string{fooHash, barHash} {
+		c.Assert(vol0.BlockWrite(context.Background(), hash, []byte("foo")), IsNil)
+		c.Assert(vol0.blockTouchWithTime(hash, t0), IsNil)
+	}
+
+	// Without the atime param, the index format is unchanged.
+	resp := call(router, "GET", "http://example/index/acb", s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, fmt.Sprintf("%s+3 %d\n\n", fooHash, t0.UnixNano()))
+
+	// Blocks that haven't been read have atime 0.
+	resp = call(router, "GET", "http://example/index/acb?atime=true", s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, fmt.Sprintf("%s+3 %d 0\n\n", fooHash, t0.UnixNano()))
+
+	t1 := time.Now()
+	resp = call(router, "GET", "http://example/"+router.keepstore.signLocator(arvadostest.ActiveTokenV2, fooHash+"+3"), arvadostest.ActiveTokenV2, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	t2 := time.Now()
+
+	for _, path := range []string{
+		"/index/acb?atime=true",
+		"/mounts/zzzzz-nyw5e-000000000000000/blocks?prefix=acb&atime=true",
+	} {
+		c.Logf("=== %s", path)
+		resp = call(router, "GET", "http://example"+path, s.cluster.SystemRootToken, nil, nil)
+		c.Check(resp.Code, Equals, http.StatusOK)
+		var atime int64
+		_, err := fmt.Sscanf(resp.Body.String(), fooHash+"+3 %d %d\n\n", new(int64), &atime)
+		c.Check(err, IsNil)
+		c.Check(atime >= t1.UnixNano() && atime <= t2.UnixNano(), Equals, true, Commentf("atime %d", atime))
+	}
+
+	// Reading the block again within BlobAccessTimeResolution
+	// doesn't change the recorded atime.
+	atime := router.keepstore.accessTimes.get(fooHash)
+	resp = call(router, "GET", "http://example/"+router.keepstore.signLocator(arvadostest.ActiveTokenV2, fooHash+"+3"), arvadostest.ActiveTokenV2, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(router.keepstore.accessTimes.get(fooHash), Equals, atime)
+}
+
+func (s *routerSuite) TestProvenance(c *C) {
+	router, cancel := testRouter(c, s.cluster, nil)
+	resp := call(router, "GET", "http://example/provenance/"+fooHash, s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusNotImplemented)
+	cancel()
+
+	s.cluster.Collections.BlobProvenanceFile = c.MkDir() + "/provenance"
+	router, cancel = testRouter(c, s.cluster, nil)
+	defer cancel()
+
+	resp = call(router, "GET", "http://example/provenance/"+fooHash, s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, `{"items":[]}`+"\n")
+
+	resp = call(router, "PUT", "http://example/"+fooHash, arvadostest.ActiveTokenV2, []byte("foo"), http.Header{"User-Agent": {"test-agent"}})
+	c.Check(resp.Code, Equals, http.StatusOK)
+	// Failed writes are not recorded.
+	resp = call(router, "PUT", "http://example/"+fooHash, arvadostest.ActiveTokenV2, []byte("bar"), nil)
+	c.Check(resp.Code, Equals, http.StatusBadRequest)
+
+	// Only the admin can retrieve provenance records.
+	resp = call(router, "GET", "http://example/provenance/"+fooHash, arvadostest.ActiveTokenV2, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusForbidden)
+
+	resp = call(router, "GET", "http://example/provenance/"+fooHash, s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	var got struct {
+		Items []provenanceRecord
+	}
+	c.Check(json.Unmarshal(resp.Body.Bytes(), &got), IsNil)
+	c.Assert(got.Items, HasLen, 1)
+	c.Check(got.Items[0].Hash, Equals, fooHash)
+	c.Check(got.Items[0].TokenUUID, Equals, arvadostest.ActiveTokenUUID)
+	c.Check(got.Items[0].UserAgent, Equals, "test-agent")
+}
+
 // Check that the context passed to a volume method gets cancelled
 // when the http client hangs up.
 func (s *routerSuite) TestCancelOnDisconnect(c *C) {
@@ -579,6 +812,6 @@ func call(handler http.Handler, method, path, tok string, body []byte, hdr http.
 func checkCORSHeaders(c *C, h http.Header) {
 	c.Check(h.Get("Access-Control-Allow-Methods"), Equals, "GET, HEAD, PUT, OPTIONS")
 	c.Check(h.Get("Access-Control-Allow-Origin"), Equals, "*")
-	c.Check(h.Get("Access-Control-Allow-Headers"), Equals, "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas, X-Keep-Signature, X-Keep-Storage-Classes")
+	c.Check(h.Get("Access-Control-Allow-Headers"), Equals, "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas, X-Keep-Priority, X-Keep-Signature, X-Keep-Storage-Classes")
 	c.Check(h.Get("Access-Control-Expose-Headers"), Equals, "X-Keep-Locator, X-Keep-Replicas-Stored, X-Keep-Storage-Classes-Confirmed")
 }
@@ -64,14 +64,19 @@ var (
 type s3Volume struct {
 	arvados.S3VolumeDriverParameters
 
-	cluster    *arvados.Cluster
-	volume     arvados.Volume
-	logger     logrus.FieldLogger
-	metrics    *volumeMetricsVecs
-	bufferPool *bufferPool
-	bucket     *s3Bucket
-	region     string
-	startOnce  sync.Once
+	cluster        *arvados.Cluster
+	volume         arvados.Volume
+	logger         logrus.FieldLogger
+	metrics        *volumeMetricsVecs
+	bufferPool     *bufferPool
+	deleteVerifier *deleteVerifier
+	bucket         *s3Bucket
+	region         string
+	startOnce      sync.Once
+
+	// Number of blocks in each tag-based trash state, as of the
+	// last EmptyTrash (see TrashUsingTags).
+	trashTagStates *prometheus.GaugeVec
 
 	overrideEndpoint *aws.Endpoint
 	//usePathStyle     bool // used by test suite
@@ -107,10 +112,11 @@ func (v *s3Volume) key(loc string) string {
 
 func news3Volume(params newVolumeParams) (volume, error) {
 	v := &s3Volume{
-		cluster:    params.Cluster,
-		volume:     params.ConfigVolume,
-		metrics:    params.MetricsVecs,
-		bufferPool: params.BufferPool,
+		cluster:        params.Cluster,
+		volume:         params.ConfigVolume,
+		metrics:        params.MetricsVecs,
+		bufferPool:     params.BufferPool,
+		deleteVerifier: params.DeleteVerifier,
 	}
 	err := json.Unmarshal(params.ConfigVolume.DriverParameters, v)
 	if err != nil {
@@ -143,13 +149,16 @@ func (v *s3Volume) translateError(err error) error {
 // (If something goes wrong during the copy, the error will be
 // embedded in the 200 OK response)
 func (v *s3Volume) safeCopy(dst, src string) error {
-	input := &s3.CopyObjectInput{
+	return v.copyObject(&s3.CopyObjectInput{
 		Bucket:      aws.String(v.bucket.bucket),
 		ContentType: aws.String("application/octet-stream"),
 		CopySource:  aws.String(v.bucket.bucket + "/" + src),
 		Key:         aws.String(dst),
-	}
+	})
+}
 
+func (v *s3Volume) copyObject(input *s3.CopyObjectInput) error {
+	dst, src := *input.Key, strings.TrimPrefix(*input.CopySource, v.bucket.bucket+"/")
 	resp, err := v.bucket.svc.CopyObject(context.Background(), input)
 
 	err = v.translateError(err)
@@ -274,6 +283,7 @@ func (v *s3Volume) check(ec2metadataHostname string) error {
 	// Set up prometheus metrics
 	lbls := prometheus.Labels{"device_id": v.DeviceID()}
 	v.bucket.stats.opsCounters, v.bucket.stats.errCounters, v.bucket.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
+	v.trashTagStates = v.metrics.trashTags.MustCurryWith(lbls)
 
 	return nil
 }
@@ -341,6 +351,9 @@ func (v *s3Volume) EmptyTrash() {
 		if startT.Sub(trashT) < v.cluster.Collections.BlobTrashLifetime.Duration() {
 			return
 		}
+		if !v.deleteVerifier.okToDelete(loc) {
+			return
+		}
 		err = v.bucket.Del(*trash.Key)
 		if err != nil {
 			v.logger.WithError(err).Errorf("EmptyTrash: error deleting %q", *trash.Key)
@@ -393,6 +406,10 @@ func (v *s3Volume) EmptyTrash() {
 		v.logger.WithError(err).Error("EmptyTrash: lister failed")
 	}
 	v.logger.Infof("EmptyTrash: stats for %v: Deleted %v bytes in %v blocks. Remaining in trash: %v bytes in %v blocks.", v.DeviceID(), bytesDeleted, blocksDeleted, bytesInTrash-bytesDeleted, blocksInTrash-blocksDeleted)
+
+	if v.TrashUsingTags {
+		v.emptyTaggedTrash(startT)
+	}
 }
 
 // fixRace(X) is called when "recent/X" exists but "X" doesn't
@@ -454,9 +471,31 @@ func (v *s3Volume) head(key string) (result *s3.HeadObjectOutput, err error) {
 // BlockRead reads a Keep block that has been stored as a block blob
 // in the S3 bucket.
 func (v *s3Volume) BlockRead(ctx context.Context, hash string, w io.WriterAt) error {
+	return v.blockRead(ctx, hash, "", w)
+}
+
+// BlockReadRange reads part of a Keep block using a single ranged
+// GET request.
+func (v *s3Volume) BlockReadRange(ctx context.Context, hash string, offset, length int64, w io.WriterAt) error {
+	if offset < 0 || length < 1 {
+		return fmt.Errorf("invalid range: offset %d length %d", offset, length)
+	}
+	cw := &countingWriterAt{WriterAt: w}
+	err := v.blockRead(ctx, hash, fmt.Sprintf("bytes=%d-%d", offset, offset+length-1), cw)
+	if err == nil && cw.max != length {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// blockRead reads the given byte range (an HTTP Range header value)
+// of a block, or the whole block if rng is empty.
+func (v *s3Volume) blockRead(ctx context.Context, hash string, rng string, w io.WriterAt) error {
 	key := v.key(hash)
-	err := v.readWorker(ctx, key, w)
-	if err != nil {
+	err := v.readWorker(ctx, key, rng, w)
+	if errors.Is(err, errS3TagTrashed) {
+		return os.ErrNotExist
+	} else if err != nil {
 		err = v.translateError(err)
 		if !os.IsNotExist(err) {
 			return err
@@ -474,7 +513,7 @@ func (v *s3Volume) BlockRead(ctx context.Context, hash string, w io.WriterAt) er
 			return err
 		}
 
-		err = v.readWorker(ctx, key, w)
+		err = v.readWorker(ctx, key, rng, w)
 		if err != nil {
 			v.logger.Warnf("reading %s after successful fixRace: %s", hash, err)
 			err = v.translateError(err)
@@ -484,15 +523,23 @@ func (v *s3Volume) BlockRead(ctx context.Context, hash string, w io.WriterAt) er
 	return nil
 }
 
-func (v *s3Volume) readWorker(ctx context.Context, key string, dst io.WriterAt) error {
-	downloader := manager.NewDownloader(v.bucket.svc, func(u *manager.Downloader) {
+func (v *s3Volume) readWorker(ctx context.Context, key string, rng string, dst io.WriterAt) error {
+	var client manager.DownloadAPIClient = v.bucket.svc
+	if v.TrashUsingTags {
+		client = &s3TagCheckingClient{DownloadAPIClient: v.bucket.svc, volume: v, key: key}
+	}
+	downloader := manager.NewDownloader(client, func(u *manager.Downloader) {
 		u.PartSize = s3downloaderPartSize
 		u.Concurrency = s3downloaderReadConcurrency
 	})
-	count, err := downloader.Download(ctx, dst, &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(v.bucket.bucket),
 		Key:    aws.String(key),
-	})
+	}
+	if rng != "" {
+		input.Range = aws.String(rng)
+	}
+	count, err := downloader.Download(ctx, dst, input)
 	v.bucket.stats.TickOps("get")
 	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.GetOps)
 	v.bucket.stats.TickErr(err)
@@ -500,6 +547,23 @@ func (v *s3Volume) readWorker(ctx context.Context, key string, dst io.WriterAt)
 	return v.translateError(err)
 }
 
+// countingWriterAt records the end of the furthest write.
+type countingWriterAt struct {
+	io.WriterAt
+	mtx sync.Mutex
+	max int64
+}
+
+func (cw *countingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := cw.WriterAt.WriteAt(p, off)
+	cw.mtx.Lock()
+	if end := off + int64(n); end > cw.max {
+		cw.max = end
+	}
+	cw.mtx.Unlock()
+	return n, err
+}
+
 func (v *s3Volume) writeObject(ctx context.Context, key string, r io.Reader) error {
 	if r == nil {
 		// r == nil leads to a memory violation in func readFillBuf in
@@ -550,12 +614,31 @@ func (v *s3Volume) BlockWrite(ctx context.Context, hash string, data []byte) err
 	// sdk to avoid memory allocation there. See #17339 for more information.
 	rdr := bytes.NewReader(data)
 	r := newCountingReaderAtSeeker(rdr, v.bucket.stats.TickOutBytes)
+	return v.writeBlock(ctx, hash, r)
+}
+
+// BlockWriteStream writes a block while its data is being received.
+// If r returns an error, the upload is aborted before the object is
+// created.
+func (v *s3Volume) BlockWriteStream(ctx context.Context, hash string, size int, r io.Reader) error {
+	return v.writeBlock(ctx, hash, newCountingReader(r, v.bucket.stats.TickOutBytes))
+}
+
+// writeBlock writes the block data from r, along with the
+// corresponding "recent/" marker.
+func (v *s3Volume) writeBlock(ctx context.Context, hash string, r io.Reader) error {
 	key := v.key(hash)
 	err := v.writeObject(ctx, key, r)
 	if err != nil {
 		return err
 	}
-	return v.writeObject(ctx, "recent/"+key, nil)
+	err = v.writeObject(ctx, "recent/"+key, nil)
+	if err != nil || !v.TrashUsingTags {
+		return err
+	}
+	// Writing the data replaced the trashed (tagged) object, if
+	// any, so the trash marker no longer applies.
+	return v.translateError(v.bucket.Del(s3TrashMarkerPrefix + key))
 }
 
 type s3awsLister struct {
@@ -664,6 +747,19 @@ func (v *s3Volume) Index(ctx context.Context, prefix string, writer io.Writer) e
 		PageSize: v.IndexPageSize,
 		Stats:    &v.bucket.stats,
 	}
+	// With TrashUsingTags, trashed blocks are still present in
+	// dataL, so we also merge the trash markers.
+	markerL := s3awsLister{
+		Logger:   v.logger,
+		Bucket:   v.bucket,
+		Prefix:   s3TrashMarkerPrefix + prefix,
+		PageSize: v.IndexPageSize,
+		Stats:    &v.bucket.stats,
+	}
+	var marker *types.Object
+	if v.TrashUsingTags {
+		marker = markerL.First()
+	}
 	for data, recent := dataL.First(), recentL.First(); data != nil && dataL.Error() == nil; data = dataL.Next() {
 		if ctx.Err() != nil {
 			return ctx.Err()
@@ -705,6 +801,26 @@ func (v *s3Volume) Index(ctx context.Context, prefix string, writer io.Writer) e
 		if err := recentL.Error(); err != nil {
 			return err
 		}
+
+		// Skip the block if it has a trash marker that is not
+		// superseded by a subsequent write/touch.
+		trashed := false
+		for marker != nil && markerL.Error() == nil {
+			if cmp := strings.Compare((*marker.Key)[len(s3TrashMarkerPrefix):], *data.Key); cmp < 0 {
+				marker = markerL.Next()
+				continue
+			} else if cmp == 0 {
+				trashed = !v.trashRaced(*marker.LastModified, *stamp.LastModified)
+				marker = markerL.Next()
+			}
+			break
+		}
+		if err := markerL.Error(); err != nil {
+			return err
+		}
+		if trashed {
+			continue
+		}
 		// We truncate sub-second precision here. Otherwise
 		// timestamps will never match the RFC1123-formatted
 		// Last-Modified values parsed by Mtime().
@@ -716,9 +832,10 @@ func (v *s3Volume) Index(ctx context.Context, prefix string, writer io.Writer) e
 // Mtime returns the stored timestamp for the given locator.
 func (v *s3Volume) Mtime(loc string) (time.Time, error) {
 	key := v.key(loc)
-	_, err := v.head(key)
-	if err != nil {
+	if trashed, err := v.headCheckTrash(key); err != nil {
 		return s3AWSZeroTime, v.translateError(err)
+	} else if trashed {
+		return s3AWSZeroTime, os.ErrNotExist
 	}
 	resp, err := v.head("recent/" + key)
 	err = v.translateError(err)
@@ -750,13 +867,15 @@ func (v *s3Volume) InternalStats() interface{} {
 // BlockTouch sets the timestamp for the given locator to the current time.
 func (v *s3Volume) BlockTouch(hash string) error {
 	key := v.key(hash)
-	_, err := v.head(key)
+	trashed, err := v.headCheckTrash(key)
 	err = v.translateError(err)
 	if os.IsNotExist(err) && v.fixRace(key) {
 		// The data object got trashed in a race, but fixRace
 		// rescued it.
 	} else if err != nil {
 		return err
+	} else if trashed {
+		return os.ErrNotExist
 	}
 	err = v.writeObject(context.Background(), "recent/"+key, nil)
 	return v.translateError(err)
@@ -816,6 +935,9 @@ func (v *s3Volume) BlockTrash(loc string) error {
 		}
 		return v.translateError(v.bucket.Del(key))
 	}
+	if v.TrashUsingTags {
+		return v.trashWithTag(key)
+	}
 	err := v.checkRaceWindow(key)
 	if err != nil {
 		return err
@@ -830,6 +952,13 @@ func (v *s3Volume) BlockTrash(loc string) error {
 // BlockUntrash moves block from trash back into store
 func (v *s3Volume) BlockUntrash(hash string) error {
 	key := v.key(hash)
+	if v.TrashUsingTags {
+		if ok, err := v.untrashTagged(key); ok || err != nil {
+			return err
+		}
+		// No trash marker; the block might have been
+		// trashed before TrashUsingTags was enabled.
+	}
 	err := v.safeCopy(key, "trash/"+key)
 	if err != nil {
 		return err
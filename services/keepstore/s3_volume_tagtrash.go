@@ -0,0 +1,299 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// With TrashUsingTags, a trashed block X stays where it is, and
+// trash state is recorded in two places:
+//
+// "trashed/X" is an empty marker object. Its timestamp is the time
+// X was trashed. It is the authoritative record of trash state, and
+// lets Index and EmptyTrash find trashed blocks without fetching
+// the tags of every object.
+//
+// X itself is tagged with s3TrashTagKey. GET responses report
+// whether an object has tags, so reading or touching an untrashed
+// block doesn't need an extra request to look for a trash marker.
+// The tag also lets bucket lifecycle rules find trashed blocks, but
+// note S3 computes the age of an object from its creation time, not
+// from when it was tagged.
+const (
+	s3TrashMarkerPrefix = "trashed/"
+	s3TrashTagKey       = "arvados-trash"
+)
+
+// errS3TagTrashed is returned by a GetObject request (see
+// s3TagCheckingClient) for a block that has been trashed.
+var errS3TagTrashed = errors.New("block has been trashed")
+
+// trashRaced returns true if a block whose recent/X marker has the
+// given timestamp could not have been legitimately trashed at
+// trashT, i.e., it was written or touched after (or too soon
+// before) being trashed.
+func (v *s3Volume) trashRaced(trashT, recentT time.Time) bool {
+	return trashT.Sub(recentT) < v.cluster.Collections.BlobSigningTTL.Duration()
+}
+
+// isTagTrashed returns true if the block stored at key has been
+// trashed. If the trash marker is superseded by a subsequent
+// write/touch, isTagTrashed untrashes the block and returns false.
+//
+// Callers only need to check this if the data object has tags.
+func (v *s3Volume) isTagTrashed(key string) (bool, error) {
+	marker, err := v.head(s3TrashMarkerPrefix + key)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	recent, err := v.head("recent/" + key)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !v.trashRaced(*marker.LastModified, *recent.LastModified) {
+		return true, nil
+	}
+	v.logger.Infof("%q: trashed at %s but touched at %s, untrashing to recover from race between Put/Touch and Trash", key, marker.LastModified, recent.LastModified)
+	if _, err := v.untrashTagged(key); err != nil {
+		v.logger.WithError(err).Warnf("untrash %q failed", key)
+	}
+	return false, nil
+}
+
+// setTrashTag adds or removes the trash tag on the object at key.
+func (v *s3Volume) setTrashTag(key string, trashed bool) error {
+	var err error
+	if trashed {
+		_, err = v.bucket.svc.PutObjectTagging(context.Background(), &s3.PutObjectTaggingInput{
+			Bucket: aws.String(v.bucket.bucket),
+			Key:    aws.String(key),
+			Tagging: &types.Tagging{TagSet: []types.Tag{{
+				Key:   aws.String(s3TrashTagKey),
+				Value: aws.String("true"),
+			}}},
+		})
+		v.bucket.stats.TickOps("put_tagging")
+	} else {
+		_, err = v.bucket.svc.DeleteObjectTagging(context.Background(), &s3.DeleteObjectTaggingInput{
+			Bucket: aws.String(v.bucket.bucket),
+			Key:    aws.String(key),
+		})
+		v.bucket.stats.TickOps("delete_tagging")
+	}
+	v.bucket.stats.Tick(&v.bucket.stats.Ops)
+	v.bucket.stats.TickErr(err)
+	return v.translateError(err)
+}
+
+// headCheckTrash checks whether the block stored at key exists and
+// (with TrashUsingTags) whether it has been trashed.
+//
+// With TrashUsingTags, it uses a one-byte GET request instead of
+// HEAD, because a GET response indicates whether the object has
+// tags, and the trash marker only needs to be checked if it does.
+func (v *s3Volume) headCheckTrash(key string) (trashed bool, err error) {
+	if !v.TrashUsingTags {
+		_, err = v.head(key)
+		return false, err
+	}
+	resp, err := v.bucket.svc.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(v.bucket.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String("bytes=0-0"),
+	})
+	v.bucket.stats.TickOps("get")
+	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.GetOps)
+	var aerr smithy.APIError
+	if errors.As(err, &aerr) && aerr.ErrorCode() == "InvalidRange" {
+		// The object exists but is empty, so we can't tell
+		// whether it has tags.
+		return v.isTagTrashed(key)
+	}
+	v.bucket.stats.TickErr(err)
+	if err != nil {
+		return false, v.translateError(err)
+	}
+	resp.Body.Close()
+	if resp.TagCount == nil || *resp.TagCount == 0 {
+		return false, nil
+	}
+	return v.isTagTrashed(key)
+}
+
+// s3TagCheckingClient wraps the GetObject method of an S3 client.
+// If a response indicates the object has tags, it checks whether
+// the block has been trashed, and if so, returns errS3TagTrashed
+// instead of the response, so the caller doesn't receive any data.
+type s3TagCheckingClient struct {
+	manager.DownloadAPIClient
+	volume  *s3Volume
+	key     string
+	once    sync.Once
+	trashed bool
+	err     error
+}
+
+func (c *s3TagCheckingClient) GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	resp, err := c.DownloadAPIClient.GetObject(ctx, input, optFns...)
+	if err != nil || resp.TagCount == nil || *resp.TagCount == 0 {
+		return resp, err
+	}
+	c.once.Do(func() { c.trashed, c.err = c.volume.isTagTrashed(c.key) })
+	if c.err != nil {
+		resp.Body.Close()
+		return nil, c.err
+	} else if c.trashed {
+		resp.Body.Close()
+		return nil, errS3TagTrashed
+	}
+	return resp, nil
+}
+
+// trashWithTag trashes the block stored at key by writing a trash
+// marker and tagging the data object.
+func (v *s3Volume) trashWithTag(key string) error {
+	err := v.writeObject(context.Background(), s3TrashMarkerPrefix+key, nil)
+	if err != nil {
+		return err
+	}
+	return v.setTrashTag(key, true)
+}
+
+// untrashTagged untrashes a block that was trashed by trashWithTag.
+// It returns false if there is no trash marker for the block.
+func (v *s3Volume) untrashTagged(key string) (bool, error) {
+	_, err := v.head(s3TrashMarkerPrefix + key)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	_, err = v.head(key)
+	if os.IsNotExist(err) {
+		// The data object has already been deleted, e.g., by
+		// a bucket lifecycle rule.
+		v.bucket.Del(s3TrashMarkerPrefix + key)
+		return true, os.ErrNotExist
+	} else if err != nil {
+		return true, err
+	}
+	err = v.setTrashTag(key, false)
+	if err != nil {
+		return true, err
+	}
+	err = v.writeObject(context.Background(), "recent/"+key, nil)
+	if err != nil {
+		return true, err
+	}
+	return true, v.translateError(v.bucket.Del(s3TrashMarkerPrefix + key))
+}
+
+// emptyTaggedTrash deletes blocks whose trash markers are older than
+// BlobTrashLifetime, and cleans up markers that have been superseded
+// by subsequent writes or by bucket lifecycle rules.
+//
+// Note the data object is deleted in place, so (unlike the
+// "trash/X" scheme) a Put of the same block that races with
+// emptyTaggedTrash can be lost. This window is much shorter than
+// BlobSigningTTL, which is what protects recently written blocks
+// from being trashed in the first place.
+func (v *s3Volume) emptyTaggedTrash(startT time.Time) {
+	var inTrash, deleted, expired, untrashed int64
+
+	emptyOneKey := func(marker *types.Object) {
+		key := strings.TrimPrefix(*marker.Key, s3TrashMarkerPrefix)
+		loc, isblk := v.isKeepBlock(key)
+		if !isblk {
+			return
+		}
+		trashT := *marker.LastModified
+		recent, err := v.head("recent/" + key)
+		if err == nil && v.trashRaced(trashT, *recent.LastModified) {
+			v.logger.Infof("EmptyTrash: %q was touched at %s after being trashed at %s, untrashing", key, recent.LastModified, trashT)
+			if _, err := v.untrashTagged(key); err != nil {
+				v.logger.WithError(err).Errorf("EmptyTrash: untrash %q failed", key)
+				return
+			}
+			atomic.AddInt64(&untrashed, 1)
+			return
+		} else if err != nil && !os.IsNotExist(err) {
+			v.logger.WithError(err).Warnf("EmptyTrash: HEAD %q failed", "recent/"+key)
+			return
+		}
+		if startT.Sub(trashT) < v.cluster.Collections.BlobTrashLifetime.Duration() || !v.deleteVerifier.okToDelete(loc) {
+			atomic.AddInt64(&inTrash, 1)
+			return
+		}
+		_, err = v.head(key)
+		if os.IsNotExist(err) {
+			atomic.AddInt64(&expired, 1)
+		} else if err != nil {
+			v.logger.WithError(err).Warnf("EmptyTrash: HEAD %q failed", key)
+			return
+		} else if err = v.bucket.Del(key); err != nil {
+			v.logger.WithError(err).Errorf("EmptyTrash: error deleting %q", key)
+			return
+		} else {
+			atomic.AddInt64(&deleted, 1)
+		}
+		for _, k := range []string{"recent/" + key, *marker.Key} {
+			if err := v.bucket.Del(k); err != nil {
+				v.logger.WithError(err).Warnf("EmptyTrash: error deleting %q", k)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	todo := make(chan *types.Object, v.cluster.Collections.BlobDeleteConcurrency)
+	for i := 0; i < v.cluster.Collections.BlobDeleteConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for marker := range todo {
+				emptyOneKey(marker)
+			}
+		}()
+	}
+
+	markerL := s3awsLister{
+		Logger:   v.logger,
+		Bucket:   v.bucket,
+		Prefix:   s3TrashMarkerPrefix,
+		PageSize: v.IndexPageSize,
+		Stats:    &v.bucket.stats,
+	}
+	for marker := markerL.First(); marker != nil; marker = markerL.Next() {
+		todo <- marker
+	}
+	close(todo)
+	wg.Wait()
+
+	if err := markerL.Error(); err != nil {
+		v.logger.WithError(err).Error("EmptyTrash: tagged trash lister failed")
+		return
+	}
+	v.trashTagStates.WithLabelValues("trashed").Set(float64(inTrash))
+	v.trashTagStates.WithLabelValues("deleted").Set(float64(deleted))
+	v.trashTagStates.WithLabelValues("expired").Set(float64(expired))
+	v.trashTagStates.WithLabelValues("untrashed").Set(float64(untrashed))
+	v.logger.Infof("EmptyTrash: tagged trash stats for %v: Deleted %v blocks, %v already expired by lifecycle rules, %v untrashed. Remaining in trash: %v blocks.", v.DeviceID(), deleted, expired, untrashed, inTrash)
+}
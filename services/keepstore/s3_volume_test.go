@@ -15,7 +15,9 @@ import (
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"testing/iotest"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -28,6 +30,7 @@ import (
 	"github.com/johannesboyne/gofakes3"
 	"github.com/johannesboyne/gofakes3/backend/s3mem"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 	check "gopkg.in/check.v1"
 )
@@ -53,6 +56,7 @@ var srv httptest.Server
 
 type stubbedS3Suite struct {
 	s3server    *httptest.Server
+	s3tagging   *s3TaggingStub
 	s3fakeClock *s3fakeClock
 	metadata    *httptest.Server
 	cluster     *arvados.Cluster
@@ -98,6 +102,104 @@ func (s *stubbedS3Suite) TestGenericWithPrefix(c *check.C) {
 	})
 }
 
+func (s *stubbedS3Suite) TestGenericTrashUsingTags(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, params newVolumeParams) TestableVolume {
+		v := s.newTestableVolume(c, params, -2*time.Second)
+		v.TrashUsingTags = true
+		return v
+	})
+}
+
+func (s *stubbedS3Suite) TestTrashUsingTags(c *check.C) {
+	reg := prometheus.NewRegistry()
+	s.cluster.Collections.BlobTrashLifetime.Set("1h")
+	v := s.newTestableVolume(c, newVolumeParams{
+		Cluster:      s.cluster,
+		ConfigVolume: arvados.Volume{Replication: 2},
+		MetricsVecs:  newVolumeMetricsVecs(reg),
+		BufferPool:   newBufferPool(ctxlog.TestLogger(c), 8, prometheus.NewRegistry()),
+	}, 0)
+	v.TrashUsingTags = true
+	key := v.key(TestHash)
+	exists := func(key string) bool {
+		_, err := v.head(key)
+		return err == nil
+	}
+
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	v.TouchWithDate(TestHash, time.Now().Add(-2*s.cluster.Collections.BlobSigningTTL.Duration()))
+
+	// Reading, touching, and checking the mtime of a block
+	// without tags don't look for a trash marker.
+	c.Check(v.BlockRead(context.Background(), TestHash, &brbuffer{}), check.IsNil)
+	_, err := v.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+	c.Check(s.s3tagging.markerCheckCount(), check.Equals, 0)
+
+	c.Assert(v.BlockTrash(TestHash), check.IsNil)
+
+	// The data stays in place, instead of being copied to the
+	// trash/ prefix.
+	c.Check(exists(key), check.Equals, true)
+	c.Check(exists("trash/"+key), check.Equals, false)
+	c.Check(exists(s3TrashMarkerPrefix+key), check.Equals, true)
+	c.Check(s.s3tagging.isTagged(v.Bucket, key), check.Equals, true)
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.Equals, os.ErrNotExist)
+	c.Check(buf.Len(), check.Equals, 0)
+	_, err = v.Mtime(TestHash)
+	c.Check(err, check.Equals, os.ErrNotExist)
+	c.Check(v.BlockTouch(TestHash), check.Equals, os.ErrNotExist)
+
+	// Untrash removes the tag and the marker.
+	c.Assert(v.BlockUntrash(TestHash), check.IsNil)
+	c.Check(s.s3tagging.isTagged(v.Bucket, key), check.Equals, false)
+	c.Check(exists(s3TrashMarkerPrefix+key), check.Equals, false)
+	c.Check(v.BlockRead(context.Background(), TestHash, &brbuffer{}), check.IsNil)
+	v.TouchWithDate(TestHash, time.Now().Add(-2*s.cluster.Collections.BlobSigningTTL.Duration()))
+	c.Assert(v.BlockTrash(TestHash), check.IsNil)
+
+	v.EmptyTrash()
+	c.Check(exists(key), check.Equals, true)
+	c.Check(testutil.ToFloat64(v.trashTagStates.WithLabelValues("trashed")), check.Equals, float64(1))
+
+	// After BlobTrashLifetime, EmptyTrash deletes the data and
+	// the markers.
+	s.cluster.Collections.BlobTrashLifetime.Set("1ns")
+	v.EmptyTrash()
+	c.Check(exists(key), check.Equals, false)
+	c.Check(exists("recent/"+key), check.Equals, false)
+	c.Check(exists(s3TrashMarkerPrefix+key), check.Equals, false)
+	c.Check(testutil.ToFloat64(v.trashTagStates.WithLabelValues("trashed")), check.Equals, float64(0))
+	c.Check(testutil.ToFloat64(v.trashTagStates.WithLabelValues("deleted")), check.Equals, float64(1))
+
+	// If a lifecycle rule deleted the data first, EmptyTrash
+	// just cleans up the markers.
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	v.TouchWithDate(TestHash, time.Now().Add(-2*s.cluster.Collections.BlobSigningTTL.Duration()))
+	c.Assert(v.BlockTrash(TestHash), check.IsNil)
+	c.Assert(v.bucket.Del(key), check.IsNil)
+	c.Check(v.BlockUntrash(TestHash), check.Equals, os.ErrNotExist)
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	v.TouchWithDate(TestHash, time.Now().Add(-2*s.cluster.Collections.BlobSigningTTL.Duration()))
+	c.Assert(v.BlockTrash(TestHash), check.IsNil)
+	c.Assert(v.bucket.Del(key), check.IsNil)
+	v.EmptyTrash()
+	c.Check(exists(s3TrashMarkerPrefix+key), check.Equals, false)
+	c.Check(testutil.ToFloat64(v.trashTagStates.WithLabelValues("expired")), check.Equals, float64(1))
+
+	// A trash marker that is newer than recent/X by less than
+	// BlobSigningTTL indicates a race between Touch and Trash,
+	// which is resolved by untrashing.
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	c.Assert(v.writeObject(context.Background(), s3TrashMarkerPrefix+key, nil), check.IsNil)
+	c.Assert(v.setTrashTag(key, true), check.IsNil)
+	buf = &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock))
+	c.Check(exists(s3TrashMarkerPrefix+key), check.Equals, false)
+}
+
 func (s *stubbedS3Suite) TestIndex(c *check.C) {
 	v := s.newTestableVolume(c, newVolumeParams{
 		Cluster:      s.cluster,
@@ -264,6 +366,50 @@ func (s *stubbedS3Suite) TestStats(c *check.C) {
 	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
 }
 
+func (s *stubbedS3Suite) TestBlockWriteStream(c *check.C) {
+	v := s.newTestableVolume(c, newVolumeParams{
+		Cluster:      s.cluster,
+		ConfigVolume: arvados.Volume{Replication: 2},
+		MetricsVecs:  newVolumeMetricsVecs(prometheus.NewRegistry()),
+		BufferPool:   newBufferPool(ctxlog.TestLogger(c), 8, prometheus.NewRegistry()),
+	}, 5*time.Minute)
+
+	// If the reader fails, the object is not created.
+	err := v.BlockWriteStream(context.Background(), fooHash, 3, io.MultiReader(strings.NewReader("fo"), iotest.ErrReader(errStreamAborted)))
+	c.Check(err, check.NotNil)
+	err = v.BlockRead(context.Background(), fooHash, brdiscard)
+	c.Check(err, check.Equals, os.ErrNotExist)
+
+	err = v.BlockWriteStream(context.Background(), fooHash, 3, strings.NewReader("foo"))
+	c.Check(err, check.IsNil)
+	buf := &brbuffer{}
+	err = v.BlockRead(context.Background(), fooHash, buf)
+	c.Check(err, check.IsNil)
+	c.Check(buf.String(), check.Equals, "foo")
+}
+
+func (s *stubbedS3Suite) TestBlockReadRange(c *check.C) {
+	v := s.newTestableVolume(c, newVolumeParams{
+		Cluster:      s.cluster,
+		ConfigVolume: arvados.Volume{Replication: 2},
+		MetricsVecs:  newVolumeMetricsVecs(prometheus.NewRegistry()),
+		BufferPool:   newBufferPool(ctxlog.TestLogger(c), 8, prometheus.NewRegistry()),
+	}, 5*time.Minute)
+	err := v.BlockWrite(context.Background(), TestHash, TestBlock)
+	c.Assert(err, check.IsNil)
+
+	buf := &brbuffer{}
+	err = v.BlockReadRange(context.Background(), TestHash, 4, 5, buf)
+	c.Check(err, check.IsNil)
+	c.Check(buf.String(), check.Equals, "quick")
+
+	err = v.BlockReadRange(context.Background(), TestHash, 40, 10, &brbuffer{})
+	c.Check(err, check.NotNil)
+
+	err = v.BlockReadRange(context.Background(), TestHash2, 0, 1, &brbuffer{})
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
 type s3AWSBlockingHandler struct {
 	requested chan *http.Request
 	unblock   chan struct{}
@@ -566,6 +712,55 @@ type testableS3Volume struct {
 	s3fakeClock *s3fakeClock
 }
 
+// s3TaggingStub adds the parts of object tagging used by
+// TrashUsingTags, which gofakes3 doesn't support, to an S3 stub
+// server: PUT and DELETE ?tagging requests, and the
+// x-amz-tagging-count header in GET responses. It also counts HEAD
+// requests for trash markers.
+type s3TaggingStub struct {
+	http.Handler
+	mtx          sync.Mutex
+	tagged       map[string]bool
+	markerChecks int
+}
+
+func (stub *s3TaggingStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stub.mtx.Lock()
+	if r.Method == "HEAD" && strings.Contains(r.URL.Path, "/"+s3TrashMarkerPrefix) {
+		stub.markerChecks++
+	}
+	if _, ok := r.URL.Query()["tagging"]; ok {
+		if r.Method == "PUT" {
+			stub.tagged[r.URL.Path] = true
+		} else if r.Method == "DELETE" {
+			delete(stub.tagged, r.URL.Path)
+		}
+		stub.mtx.Unlock()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method == "PUT" || r.Method == "DELETE" {
+		// Writing or deleting an object removes its tags.
+		delete(stub.tagged, r.URL.Path)
+	} else if r.Method == "GET" && stub.tagged[r.URL.Path] {
+		w.Header().Set("x-amz-tagging-count", "1")
+	}
+	stub.mtx.Unlock()
+	stub.Handler.ServeHTTP(w, r)
+}
+
+func (stub *s3TaggingStub) isTagged(bucket, key string) bool {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	return stub.tagged["/"+bucket+"/"+key]
+}
+
+func (stub *s3TaggingStub) markerCheckCount() int {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	return stub.markerChecks
+}
+
 type gofakes3logger struct {
 	logrus.FieldLogger
 }
@@ -596,7 +791,8 @@ func (s *stubbedS3Suite) newTestableVolume(c *check.C, params newVolumeParams, r
 			gofakes3.WithTimeSource(s.s3fakeClock),
 			gofakes3.WithLogger(gofakes3logger{FieldLogger: logger}),
 			gofakes3.WithTimeSkewLimit(0))
-		s.s3server = httptest.NewServer(faker.Server())
+		s.s3tagging = &s3TaggingStub{Handler: faker.Server(), tagged: map[string]bool{}}
+		s.s3server = httptest.NewServer(s.s3tagging)
 	}
 	endpoint := s.s3server.URL
 	bucketName := fmt.Sprintf("testbucket%d", testBucketSerial.Add(1))
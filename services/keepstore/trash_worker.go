@@ -136,6 +136,12 @@ func (t *trasher) runWorker(ctx context.Context, mntsAllowTrash []*mount) {
 				mnts = []*mount{mnt}
 			}
 
+			if !t.keepstore.blockOps.start(li.hash, blockOpTrash) {
+				logger.Info("skipping trash request because a pull operation on the same block is in progress")
+				return
+			}
+			defer t.keepstore.blockOps.done(li.hash)
+
 			for _, mnt := range mnts {
 				logger := logger.WithField("mount", mnt.UUID)
 				mtime, err := mnt.Mtime(li.hash)
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	. "gopkg.in/check.v1"
 )
 
@@ -89,6 +90,7 @@ func (s *routerSuite) TestTrashList_Execute(c *C) {
 		comment        string
 		storeMtime     []time.Time
 		trashListItems []TrashListItem
+		pulling        bool
 		expectData     []bool
 	}{
 		{
@@ -155,6 +157,18 @@ func (s *routerSuite) TestTrashList_Execute(c *C) {
 			},
 			expectData: []bool{true, true, true},
 		},
+		{
+			comment:    "timestamp matches and is old enough, but a pull is in progress for the same block => skip",
+			storeMtime: []time.Time{tOld},
+			trashListItems: []TrashListItem{
+				{
+					BlockMtime: tOld.UnixNano(),
+					MountUUID:  mounts[0].UUID,
+				},
+			},
+			pulling:    true,
+			expectData: []bool{true},
+		},
 	} {
 		trial := trial
 		data := []byte(fmt.Sprintf("trial %+v", trial))
@@ -168,6 +182,10 @@ func (s *routerSuite) TestTrashList_Execute(c *C) {
 			err = vols[i].blockTouchWithTime(hash, t)
 			c.Assert(err, IsNil)
 		}
+		if trial.pulling {
+			c.Assert(router.keepstore.blockOps.start(hash, blockOpPull), Equals, true)
+			defer router.keepstore.blockOps.done(hash)
+		}
 		for _, item := range trial.trashListItems {
 			item.Locator = fmt.Sprintf("%s+%d", hash, len(data))
 			trashList = append(trashList, item)
@@ -199,4 +217,5 @@ func (s *routerSuite) TestTrashList_Execute(c *C) {
 	for _, check := range checks {
 		check()
 	}
+	c.Check(testutil.ToFloat64(router.keepstore.blockOps.conflicts.WithLabelValues("trash")), Equals, float64(1))
 }
@@ -0,0 +1,168 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+// Values for the FsyncPolicy driver parameter.
+const (
+	// Don't fsync. A block that was written shortly before a
+	// crash or power failure can be lost (or left empty), even
+	// though the client was told it was stored. Rely on other
+	// replicas to recover it.
+	fsyncPolicyNone = "none"
+
+	// Fsync the volume's filesystem every FsyncInterval in the
+	// background. Writes return before their data is synced, so
+	// blocks written in the last FsyncInterval before a crash
+	// can be lost.
+	fsyncPolicyBatch = "batch"
+
+	// Fsync each block file (and its directory) before reporting
+	// success. Slowest, but a block is never lost after the
+	// client is told it was stored.
+	fsyncPolicyBlock = "block"
+)
+
+const defaultFsyncInterval = 200 * time.Millisecond
+
+// unixFsyncer implements the FsyncPolicy of a unixVolume.
+type unixFsyncer struct {
+	v        *unixVolume
+	policy   string
+	unsynced int64 // bytes written since the last batch sync started
+
+	// Serializes batch syncs, so barrier() doesn't return while
+	// a sync that started before it is still in progress.
+	syncMtx sync.Mutex
+
+	mSeconds  prometheus.Observer
+	mUnsynced prometheus.Gauge
+}
+
+// newUnixFsyncer checks the volume's FsyncPolicy and, for the batch
+// policy, starts a goroutine that syncs every FsyncInterval.
+func newUnixFsyncer(v *unixVolume, lbls prometheus.Labels) (*unixFsyncer, error) {
+	fs := &unixFsyncer{
+		v:         v,
+		policy:    v.FsyncPolicy,
+		mSeconds:  v.metrics.fsyncSeconds.With(lbls),
+		mUnsynced: v.metrics.unsyncedBytes.With(lbls),
+	}
+	switch fs.policy {
+	case "":
+		fs.policy = fsyncPolicyNone
+	case fsyncPolicyNone, fsyncPolicyBlock:
+	case fsyncPolicyBatch:
+		interval := v.FsyncInterval.Duration()
+		if interval <= 0 {
+			interval = defaultFsyncInterval
+		}
+		go fs.runBatchSync(interval)
+	default:
+		return nil, fmt.Errorf("DriverParameters.FsyncPolicy %q is not one of %q, %q, %q", v.FsyncPolicy, fsyncPolicyNone, fsyncPolicyBatch, fsyncPolicyBlock)
+	}
+	return fs, nil
+}
+
+// wrote is called after writing n bytes to f. With the block policy,
+// it syncs f before returning.
+//
+// It is safe to call on a nil unixFsyncer (i.e., a read-only
+// volume).
+func (fs *unixFsyncer) wrote(f *os.File, n int) error {
+	if fs == nil {
+		return nil
+	}
+	switch fs.policy {
+	case fsyncPolicyBlock:
+		return fs.timed(f.Sync)
+	case fsyncPolicyBatch:
+		fs.mUnsynced.Set(float64(atomic.AddInt64(&fs.unsynced, int64(n))))
+	}
+	return nil
+}
+
+// dirChanged is called after creating or renaming a file in dir.
+// With the block policy, it syncs dir so the new name survives a
+// crash.
+func (fs *unixFsyncer) dirChanged(dir string) error {
+	if fs == nil || fs.policy != fsyncPolicyBlock {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return fs.timed(d.Sync)
+}
+
+// barrier ensures everything written so far is synced, even with
+// the batch policy. It is used before deleting journal files whose
+// blocks have been copied to block files.
+func (fs *unixFsyncer) barrier() error {
+	if fs == nil || fs.policy != fsyncPolicyBatch {
+		return nil
+	}
+	return fs.syncAll()
+}
+
+func (fs *unixFsyncer) runBatchSync(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadInt64(&fs.unsynced) == 0 {
+			continue
+		}
+		if err := fs.syncAll(); err != nil {
+			fs.v.logger.WithError(err).Warn("error syncing volume")
+		}
+	}
+}
+
+// syncAll syncs the filesystem containing the volume.
+func (fs *unixFsyncer) syncAll() error {
+	fs.syncMtx.Lock()
+	defer fs.syncMtx.Unlock()
+	// Bytes written while the sync is in progress may or may
+	// not be synced by it, so they are still counted as unsynced
+	// afterward.
+	n := atomic.SwapInt64(&fs.unsynced, 0)
+	err := fs.timed(func() error {
+		d, err := os.Open(fs.v.Root)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		return unix.Syncfs(int(d.Fd()))
+	})
+	if err != nil {
+		// Try again next time.
+		n = atomic.AddInt64(&fs.unsynced, n)
+	} else {
+		n = atomic.LoadInt64(&fs.unsynced)
+	}
+	fs.mUnsynced.Set(float64(n))
+	return err
+}
+
+func (fs *unixFsyncer) timed(sync func() error) error {
+	t0 := time.Now()
+	fs.v.os.stats.TickOps("fsync")
+	err := sync()
+	fs.v.os.stats.TickErr(err)
+	fs.mSeconds.Observe(time.Since(t0).Seconds())
+	return err
+}
@@ -0,0 +1,396 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default interval between journal compactions, if
+// JournalCompactInterval is not configured.
+const defaultJournalCompactInterval = 10 * time.Second
+
+// A journal file is closed, and a new one started, when it reaches
+// this size.
+var journalFileMaxSize int64 = 64 << 20
+
+// unixJournal aggregates small block writes on a unixVolume into
+// sequential appends to a journal file, instead of creating a
+// separate file for each block. Periodically, the current journal
+// file is closed, each block in it is copied to its own block file
+// ("compacted"), and the journal file is deleted.
+//
+// Journal files are stored in {Root}/journal/ and named by a
+// sequence number. Each record is a header line "{hash} {size}
+// {mtime}\n" followed by the block data. Blocks in the journal are
+// found using an in-memory index, which is rebuilt from the journal
+// files when the volume starts. Records with truncated or corrupt
+// data (e.g., due to a crash during a write) are skipped.
+type unixJournal struct {
+	v   *unixVolume
+	dir string
+
+	mtx      sync.Mutex
+	current  *os.File // journal file being appended to, or nil
+	size     int64    // size of current journal file
+	nextSeq  int64    // sequence number for next journal file
+	retired  []string // journal files waiting to be compacted
+	entries  map[string]journalEntry
+	compactC chan struct{}
+}
+
+// journalEntry is the location of a block in a journal file.
+type journalEntry struct {
+	path   string
+	offset int64
+	size   int
+	mtime  time.Time
+}
+
+// newUnixJournal loads existing journal files (if any) and starts a
+// goroutine that compacts them periodically until v.ctx is canceled.
+func newUnixJournal(v *unixVolume) (*unixJournal, error) {
+	j := &unixJournal{
+		v:        v,
+		dir:      filepath.Join(v.Root, "journal"),
+		entries:  map[string]journalEntry{},
+		compactC: make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	interval := v.JournalCompactInterval.Duration()
+	if interval <= 0 {
+		interval = defaultJournalCompactInterval
+	}
+	ctx := v.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	go j.runCompactor(ctx, interval)
+	return j, nil
+}
+
+// load adds the blocks in existing journal files to the index, and
+// marks the files for compaction.
+func (j *unixJournal) load() error {
+	dirents, err := os.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, dirent := range dirents {
+		if seq, err := strconv.ParseInt(dirent.Name(), 16, 64); err == nil {
+			names = append(names, dirent.Name())
+			if seq >= j.nextSeq {
+				j.nextSeq = seq + 1
+			}
+		}
+	}
+	// Names are zero-padded, so lexical order is sequence order,
+	// and later records for a given block replace earlier ones.
+	sort.Strings(names)
+	for _, name := range names {
+		path := filepath.Join(j.dir, name)
+		if err := j.loadFile(path); err != nil {
+			return err
+		}
+		j.retired = append(j.retired, path)
+	}
+	if len(j.entries) > 0 {
+		j.v.logger.Infof("loaded %d blocks from %d journal files", len(j.entries), len(names))
+	}
+	return nil
+}
+
+func (j *unixJournal) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rdr := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := rdr.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+		var hash string
+		var size int
+		var mtime int64
+		if _, err := fmt.Sscanf(line, "%s %d %d\n", &hash, &size, &mtime); err != nil || !blockFileRe.MatchString(hash) || size < 0 || size > BlockSize {
+			j.v.logger.Warnf("stopped reading journal file %s at corrupt record header %q", path, line)
+			return nil
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(rdr, data); err != nil {
+			j.v.logger.Warnf("stopped reading journal file %s at truncated record for %s", path, hash)
+			return nil
+		}
+		if fmt.Sprintf("%x", md5.Sum(data)) == hash {
+			j.entries[hash] = journalEntry{
+				path:   path,
+				offset: offset,
+				size:   size,
+				mtime:  time.Unix(0, mtime),
+			}
+		} else {
+			j.v.logger.Warnf("skipping corrupt record for %s in journal file %s", hash, path)
+		}
+		offset += int64(size)
+	}
+}
+
+// append adds a block to the journal.
+func (j *unixJournal) append(hash string, data []byte) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if j.current == nil {
+		path := filepath.Join(j.dir, fmt.Sprintf("%016x", j.nextSeq))
+		f, err := j.v.os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("error creating journal file: %w", err)
+		}
+		if err := j.v.fsync.dirChanged(j.dir); err != nil {
+			f.Close()
+			return fmt.Errorf("error syncing journal directory: %w", err)
+		}
+		j.nextSeq++
+		j.current, j.size = f, 0
+	}
+	mtime := time.Now()
+	hdr := fmt.Sprintf("%s %d %d\n", hash, len(data), mtime.UnixNano())
+	j.v.os.stats.TickOps("write")
+	j.v.os.stats.Tick(&j.v.os.stats.WriteOps)
+	n, err := j.current.Write(append([]byte(hdr), data...))
+	j.v.os.stats.TickOutBytes(uint64(n))
+	j.v.os.stats.TickErr(err)
+	if err != nil {
+		// The partial record will be skipped by load(), but
+		// anything appended after it would be lost, so start
+		// a new file for the next write.
+		j.retireCurrent()
+		return fmt.Errorf("error writing journal file: %w", err)
+	}
+	if err := j.v.fsync.wrote(j.current, n); err != nil {
+		j.retireCurrent()
+		return fmt.Errorf("error syncing journal file: %w", err)
+	}
+	j.entries[hash] = journalEntry{
+		path:   j.current.Name(),
+		offset: j.size + int64(len(hdr)),
+		size:   len(data),
+		mtime:  mtime,
+	}
+	j.size += int64(n)
+	if j.size >= journalFileMaxSize {
+		j.retireCurrent()
+		select {
+		case j.compactC <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// retireCurrent closes the current journal file, if any, and marks
+// it for compaction. Caller must have lock.
+func (j *unixJournal) retireCurrent() {
+	if j.current == nil {
+		return
+	}
+	if err := j.current.Close(); err != nil {
+		j.v.logger.WithError(err).Warnf("error closing journal file %s", j.current.Name())
+	}
+	j.retired = append(j.retired, j.current.Name())
+	j.current = nil
+}
+
+// get returns the journal entry for the given block, if any. It is
+// safe to call on a nil journal.
+func (j *unixJournal) get(hash string) (journalEntry, bool) {
+	if j == nil {
+		return journalEntry{}, false
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	ent, ok := j.entries[hash]
+	return ent, ok
+}
+
+// readRange copies length bytes of the given block, starting at
+// offset, from the journal to w. If length is negative, it copies
+// everything after offset. It returns os.ErrNotExist if the block is
+// not in the journal (possibly because it was compacted after get()
+// returned).
+func (j *unixJournal) readRange(ent journalEntry, offset, length int64, w io.WriterAt) error {
+	if length < 0 {
+		length = int64(ent.size) - offset
+	}
+	if offset < 0 || length < 0 || offset+length > int64(ent.size) {
+		return io.ErrUnexpectedEOF
+	}
+	f, err := j.v.os.Open(ent.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	src := newCountingReader(io.NopCloser(io.NewSectionReader(f, ent.offset+offset, length)), j.v.os.stats.TickInBytes)
+	n, err := io.Copy(io.NewOffsetWriter(w, 0), src)
+	if err == nil && n != length {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readAll returns the data for the given journal entry.
+func (j *unixJournal) readAll(ent journalEntry) ([]byte, error) {
+	f, err := j.v.os.Open(ent.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, ent.size)
+	_, err = f.ReadAt(data, ent.offset)
+	return data, err
+}
+
+// flush moves the given block, if it is in the journal, to its own
+// block file. This must be done before operations (like touch and
+// trash) that act on block files.
+func (j *unixJournal) flush(ctx context.Context, hash string) error {
+	ent, ok := j.get(hash)
+	if !ok {
+		return nil
+	}
+	return j.compactEntry(ctx, hash, ent)
+}
+
+// compactEntry copies a block from the journal to its own block
+// file, then removes it from the index.
+func (j *unixJournal) compactEntry(ctx context.Context, hash string, ent journalEntry) error {
+	data, err := j.readAll(ent)
+	if err != nil {
+		return fmt.Errorf("error reading %s from journal file %s: %w", hash, ent.path, err)
+	}
+	if err := j.v.writeBlockFile(ctx, hash, data, ent.mtime); err != nil {
+		return err
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if j.entries[hash] == ent {
+		delete(j.entries, hash)
+	}
+	return nil
+}
+
+// compact retires the current journal file, then moves the blocks
+// in all retired journal files to their own block files and deletes
+// the journal files.
+func (j *unixJournal) compact(ctx context.Context) error {
+	j.mtx.Lock()
+	j.retireCurrent()
+	retired := j.retired
+	j.retired = nil
+	todo := map[string][]string{}
+	for hash, ent := range j.entries {
+		todo[ent.path] = append(todo[ent.path], hash)
+	}
+	j.mtx.Unlock()
+
+	for i, path := range retired {
+		for _, hash := range todo[path] {
+			ent, ok := j.get(hash)
+			if !ok || ent.path != path {
+				// flushed, or rewritten to a newer
+				// journal file
+				continue
+			}
+			if err := j.compactEntry(ctx, hash, ent); err != nil {
+				// Try again next time.
+				j.mtx.Lock()
+				j.retired = append(retired[i:], j.retired...)
+				j.mtx.Unlock()
+				return err
+			}
+		}
+		// Don't delete the journal file until the block
+		// files copied from it are synced.
+		if err := j.v.fsync.barrier(); err != nil {
+			j.mtx.Lock()
+			j.retired = append(retired[i:], j.retired...)
+			j.mtx.Unlock()
+			return err
+		}
+		if err := j.v.os.Remove(path); err != nil {
+			j.mtx.Lock()
+			j.retired = append(retired[i+1:], j.retired...)
+			j.mtx.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// runCompactor calls compact every interval, or sooner if requested
+// via compactC, until ctx is canceled.
+func (j *unixJournal) runCompactor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-j.compactC:
+		}
+		if err := j.compact(ctx); err != nil {
+			j.v.logger.WithError(err).Warn("error compacting journal")
+		}
+	}
+}
+
+// index writes index entries for blocks in the journal whose hashes
+// start with prefix, and returns the set of hashes written. It is
+// safe to call on a nil journal.
+func (j *unixJournal) index(prefix string, w io.Writer) (map[string]bool, error) {
+	if j == nil {
+		return nil, nil
+	}
+	j.mtx.Lock()
+	var lines []string
+	done := map[string]bool{}
+	for hash, ent := range j.entries {
+		if strings.HasPrefix(hash, prefix) {
+			lines = append(lines, fmt.Sprintf("%s+%d %d\n", hash, ent.size, ent.mtime.UnixNano()))
+			done[hash] = true
+		}
+	}
+	j.mtx.Unlock()
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line); err != nil {
+			return nil, fmt.Errorf("error writing: %s", err)
+		}
+	}
+	return done, nil
+}
@@ -0,0 +1,186 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+func (s *unixVolumeSuite) TestJournal(c *check.C) {
+	s.journalMaxBlockSize = arvados.ByteSize(len(TestBlock))
+	v := s.newTestableUnixVolume(c, s.params, false)
+	ctx := context.Background()
+
+	c.Assert(v.BlockWrite(ctx, TestHash, TestBlock), check.IsNil)
+	// Larger blocks are not journaled.
+	big := append(append([]byte{}, TestBlock...), TestBlock...)
+	bigHash := fmt.Sprintf("%x", md5.Sum(big))
+	c.Assert(v.BlockWrite(ctx, bigHash, big), check.IsNil)
+
+	_, err := os.Stat(v.blockPath(TestHash))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	_, err = os.Stat(v.blockPath(bigHash))
+	c.Check(err, check.IsNil)
+
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(ctx, TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock))
+	mtime, err := v.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+
+	var index bytes.Buffer
+	c.Check(v.Index(ctx, "", &index), check.IsNil)
+	c.Check(strings.Count(index.String(), TestHash+"+"), check.Equals, 1)
+	c.Check(strings.Count(index.String(), bigHash+"+"), check.Equals, 1)
+
+	// After compaction, the block is in its own file, with the
+	// original mtime, and the journal file is gone.
+	c.Assert(v.journal.compact(ctx), check.IsNil)
+	fi, err := os.Stat(v.blockPath(TestHash))
+	c.Assert(err, check.IsNil)
+	c.Check(fi.ModTime().Equal(mtime), check.Equals, true, check.Commentf("%v != %v", fi.ModTime(), mtime))
+	_, ok := v.journal.get(TestHash)
+	c.Check(ok, check.Equals, false)
+	journalFiles, err := filepath.Glob(filepath.Join(v.Root, "journal", "*"))
+	c.Check(err, check.IsNil)
+	c.Check(journalFiles, check.HasLen, 0)
+
+	buf = &brbuffer{}
+	c.Check(v.BlockRead(ctx, TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock))
+	index.Reset()
+	c.Check(v.Index(ctx, "", &index), check.IsNil)
+	c.Check(strings.Count(index.String(), TestHash+"+"), check.Equals, 1)
+}
+
+func (s *unixVolumeSuite) TestJournalFlushOnTouch(c *check.C) {
+	s.journalMaxBlockSize = BlockSize
+	v := s.newTestableUnixVolume(c, s.params, false)
+	ctx := context.Background()
+
+	c.Assert(v.BlockWrite(ctx, TestHash, TestBlock), check.IsNil)
+	c.Assert(v.BlockTouch(TestHash), check.IsNil)
+	_, err := os.Stat(v.blockPath(TestHash))
+	c.Check(err, check.IsNil)
+	_, ok := v.journal.get(TestHash)
+	c.Check(ok, check.Equals, false)
+}
+
+func (s *unixVolumeSuite) TestJournalReload(c *check.C) {
+	s.journalMaxBlockSize = BlockSize
+	v := s.newTestableUnixVolume(c, s.params, false)
+	ctx := context.Background()
+
+	c.Assert(v.BlockWrite(ctx, TestHash, TestBlock), check.IsNil)
+	c.Assert(v.BlockWrite(ctx, TestHash2, TestBlock2), check.IsNil)
+	// Simulate a crash during a write: the last record is
+	// truncated.
+	f, err := os.OpenFile(v.journal.current.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	c.Assert(err, check.IsNil)
+	_, err = f.Write([]byte(TestHash3 + " 44 1234\nThe quick"))
+	c.Assert(err, check.IsNil)
+	c.Assert(f.Close(), check.IsNil)
+
+	// A new volume with the same root directory finds the
+	// complete records.
+	v2 := &testableUnixVolume{
+		unixVolume: unixVolume{
+			Root:                v.Root,
+			JournalMaxBlockSize: v.JournalMaxBlockSize,
+			cluster:             v.cluster,
+			logger:              v.logger,
+			metrics:             v.metrics,
+			bufferPool:          v.bufferPool,
+			ctx:                 v.ctx,
+		},
+		t: c,
+	}
+	c.Assert(v2.check(), check.IsNil)
+	for _, trial := range []struct {
+		hash string
+		data []byte
+	}{
+		{TestHash, TestBlock},
+		{TestHash2, TestBlock2},
+	} {
+		buf := &brbuffer{}
+		c.Check(v2.BlockRead(ctx, trial.hash, buf), check.IsNil)
+		c.Check(buf.String(), check.Equals, string(trial.data))
+	}
+	err = v2.BlockRead(ctx, TestHash3, &brbuffer{})
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	// New writes go to a new journal file.
+	c.Assert(v2.BlockWrite(ctx, TestHash3, TestBlock3), check.IsNil)
+	c.Check(v2.journal.current.Name(), check.Not(check.Equals), v.journal.current.Name())
+
+	c.Assert(v2.journal.compact(ctx), check.IsNil)
+	for _, hash := range []string{TestHash, TestHash2, TestHash3} {
+		_, err := os.Stat(v2.blockPath(hash))
+		c.Check(err, check.IsNil)
+	}
+}
+
+func (s *unixVolumeSuite) TestJournalCompactRemoveError(c *check.C) {
+	s.journalMaxBlockSize = BlockSize
+	v := s.newTestableUnixVolume(c, s.params, false)
+	ctx := context.Background()
+
+	// TestHash goes in the first journal file, TestHash2 in the
+	// second.
+	c.Assert(v.BlockWrite(ctx, TestHash, TestBlock), check.IsNil)
+	first := v.journal.current.Name()
+	v.journal.mtx.Lock()
+	v.journal.retireCurrent()
+	v.journal.mtx.Unlock()
+	c.Assert(v.BlockWrite(ctx, TestHash2, TestBlock2), check.IsNil)
+	second := v.journal.current.Name()
+
+	// Nothing is left to compact in the first journal file, but
+	// deleting it fails.
+	c.Assert(v.journal.flush(ctx, TestHash), check.IsNil)
+	c.Assert(os.Remove(first), check.IsNil)
+	c.Check(v.journal.compact(ctx), check.NotNil)
+
+	// The second journal file has not been compacted, and is
+	// still waiting for the next attempt.
+	c.Check(v.journal.retired, check.DeepEquals, []string{second})
+	_, ok := v.journal.get(TestHash2)
+	c.Check(ok, check.Equals, true)
+
+	c.Assert(v.journal.compact(ctx), check.IsNil)
+	_, err := os.Stat(v.blockPath(TestHash2))
+	c.Check(err, check.IsNil)
+	_, err = os.Stat(second)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *unixVolumeSuite) TestJournalCompactorStops(c *check.C) {
+	s.journalMaxBlockSize = BlockSize
+	v := s.newTestableUnixVolume(c, s.params, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v.journal.runCompactor(ctx, time.Hour)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		c.Error("timed out waiting for runCompactor to return")
+	}
+}
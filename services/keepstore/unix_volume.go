@@ -33,12 +33,14 @@ func init() {
 
 func newUnixVolume(params newVolumeParams) (volume, error) {
 	v := &unixVolume{
-		uuid:       params.UUID,
-		cluster:    params.Cluster,
-		volume:     params.ConfigVolume,
-		logger:     params.Logger,
-		metrics:    params.MetricsVecs,
-		bufferPool: params.BufferPool,
+		uuid:           params.UUID,
+		cluster:        params.Cluster,
+		volume:         params.ConfigVolume,
+		logger:         params.Logger,
+		metrics:        params.MetricsVecs,
+		bufferPool:     params.BufferPool,
+		deleteVerifier: params.DeleteVerifier,
+		ctx:            params.Context,
 	}
 	err := json.Unmarshal(params.ConfigVolume.DriverParameters, &v)
 	if err != nil {
@@ -53,7 +55,7 @@ func (v *unixVolume) check() error {
 		return errors.New("DriverParameters.Root was not provided")
 	}
 	if v.Serialize {
-		v.locker = &sync.Mutex{}
+		v.locker = &priorityLock{}
 	}
 	if !strings.HasPrefix(v.Root, "/") {
 		return fmt.Errorf("DriverParameters.Root %q does not start with '/'", v.Root)
@@ -64,6 +66,18 @@ func (v *unixVolume) check() error {
 	v.os.stats.opsCounters, v.os.stats.errCounters, v.os.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
 
 	_, err := v.os.Stat(v.Root)
+	if err != nil {
+		return err
+	}
+	if !v.volume.ReadOnly {
+		v.fsync, err = newUnixFsyncer(v, lbls)
+		if err != nil {
+			return err
+		}
+	}
+	if v.JournalMaxBlockSize > 0 && !v.volume.ReadOnly {
+		v.journal, err = newUnixJournal(v)
+	}
 	return err
 }
 
@@ -72,16 +86,38 @@ type unixVolume struct {
 	Root      string // path to the volume's root directory
 	Serialize bool
 
-	uuid       string
-	cluster    *arvados.Cluster
-	volume     arvados.Volume
-	logger     logrus.FieldLogger
-	metrics    *volumeMetricsVecs
-	bufferPool *bufferPool
+	// Blocks up to this size are appended to a journal instead
+	// of being written to individual files, and moved to
+	// individual files later (see unixJournal). Zero disables
+	// the journal.
+	JournalMaxBlockSize    arvados.ByteSize
+	JournalCompactInterval arvados.Duration
 
-	// something to lock during IO, typically a sync.Mutex (or nil
-	// to skip locking)
-	locker sync.Locker
+	// Write durability: fsyncPolicyNone (default),
+	// fsyncPolicyBatch, or fsyncPolicyBlock. FsyncInterval is the
+	// time between syncs with fsyncPolicyBatch.
+	FsyncPolicy   string
+	FsyncInterval arvados.Duration
+
+	uuid           string
+	cluster        *arvados.Cluster
+	volume         arvados.Volume
+	logger         logrus.FieldLogger
+	metrics        *volumeMetricsVecs
+	bufferPool     *bufferPool
+	deleteVerifier *deleteVerifier
+
+	// canceled when the service shuts down (nil means never)
+	ctx context.Context
+
+	// something to lock during IO (or nil to skip locking)
+	locker *priorityLock
+
+	// nil if JournalMaxBlockSize is zero
+	journal *unixJournal
+
+	// nil if the volume is read-only
+	fsync *unixFsyncer
 
 	os osWithStats
 }
@@ -166,6 +202,9 @@ func (v *unixVolume) DeviceID() string {
 
 // BlockTouch sets the timestamp for the given locator to the current time
 func (v *unixVolume) BlockTouch(hash string) error {
+	if err := v.journal.flush(context.TODO(), hash); err != nil {
+		return err
+	}
 	p := v.blockPath(hash)
 	f, err := v.os.OpenFile(p, os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
@@ -190,6 +229,9 @@ func (v *unixVolume) BlockTouch(hash string) error {
 
 // Mtime returns the stored timestamp for the given locator.
 func (v *unixVolume) Mtime(loc string) (time.Time, error) {
+	if ent, ok := v.journal.get(loc); ok {
+		return ent.mtime, nil
+	}
 	p := v.blockPath(loc)
 	fi, err := v.os.Stat(p)
 	if err != nil {
@@ -213,6 +255,25 @@ func (v *unixVolume) stat(path string) (os.FileInfo, error) {
 
 // BlockRead reads a block from the volume.
 func (v *unixVolume) BlockRead(ctx context.Context, hash string, w io.WriterAt) error {
+	return v.BlockReadRange(ctx, hash, 0, -1, w)
+}
+
+// BlockReadRange reads length bytes of a block from the volume,
+// starting at offset. If length is negative, it reads to the end of
+// the block.
+func (v *unixVolume) BlockReadRange(ctx context.Context, hash string, offset, length int64, w io.WriterAt) error {
+	if ent, ok := v.journal.get(hash); ok {
+		if err := v.lock(ctx); err != nil {
+			return err
+		}
+		err := v.journal.readRange(ent, offset, length, w)
+		v.unlock()
+		if !os.IsNotExist(err) {
+			return err
+		}
+		// The journal file was deleted after compaction, so
+		// the block is now in its own file.
+	}
 	path := v.blockPath(hash)
 	stat, err := v.stat(path)
 	if err != nil {
@@ -227,10 +288,16 @@ func (v *unixVolume) BlockRead(ctx context.Context, hash string, w io.WriterAt)
 		return err
 	}
 	defer f.Close()
-	src := newCountingReader(ioutil.NopCloser(f), v.os.stats.TickInBytes)
+	if length < 0 {
+		length = stat.Size() - offset
+	}
+	if offset < 0 || length < 0 || offset+length > stat.Size() {
+		return io.ErrUnexpectedEOF
+	}
+	src := newCountingReader(ioutil.NopCloser(io.NewSectionReader(f, offset, length)), v.os.stats.TickInBytes)
 	dst := io.NewOffsetWriter(w, 0)
 	n, err := io.Copy(dst, src)
-	if err == nil && n != stat.Size() {
+	if err == nil && n != length {
 		err = io.ErrUnexpectedEOF
 	}
 	return err
@@ -242,6 +309,20 @@ func (v *unixVolume) BlockWrite(ctx context.Context, hash string, data []byte) e
 	if v.isFull() {
 		return errFull
 	}
+	if v.journal != nil && len(data) <= int(v.JournalMaxBlockSize) && blockFileRe.MatchString(hash) {
+		return v.journal.append(hash, data)
+	}
+	// ext4 uses a low-precision clock and effectively backdates
+	// files by up to 10 ms, sometimes across a 1-second boundary,
+	// which produces confusing results in logs and tests.  We
+	// avoid this by setting the output file's timestamps
+	// explicitly, using a higher resolution clock.
+	return v.writeBlockFile(ctx, hash, data, time.Now())
+}
+
+// writeBlockFile stores a block in its own file, with the given
+// modification time.
+func (v *unixVolume) writeBlockFile(ctx context.Context, hash string, data []byte, ts time.Time) error {
 	bdir := v.blockDir(hash)
 	if err := os.MkdirAll(bdir, 0755); err != nil {
 		return fmt.Errorf("error creating directory %s: %s", bdir, err)
@@ -264,15 +345,12 @@ func (v *unixVolume) BlockWrite(ctx context.Context, hash string, data []byte) e
 	if err != nil {
 		return fmt.Errorf("error writing %s: %s", bpath, err)
 	}
+	if err = v.fsync.wrote(tmpfile, n); err != nil {
+		return fmt.Errorf("error syncing %s: %s", tmpfile.Name(), err)
+	}
 	if err = tmpfile.Close(); err != nil {
 		return fmt.Errorf("error closing %s: %s", tmpfile.Name(), err)
 	}
-	// ext4 uses a low-precision clock and effectively backdates
-	// files by up to 10 ms, sometimes across a 1-second boundary,
-	// which produces confusing results in logs and tests.  We
-	// avoid this by setting the output file's timestamps
-	// explicitly, using a higher resolution clock.
-	ts := time.Now()
 	v.os.stats.TickOps("utimes")
 	v.os.stats.Tick(&v.os.stats.UtimesOps)
 	if err = os.Chtimes(tmpfile.Name(), ts, ts); err != nil {
@@ -281,6 +359,9 @@ func (v *unixVolume) BlockWrite(ctx context.Context, hash string, data []byte) e
 	if err = v.os.Rename(tmpfile.Name(), bpath); err != nil {
 		return fmt.Errorf("error renaming %s to %s: %s", tmpfile.Name(), bpath, err)
 	}
+	if err = v.fsync.dirChanged(bdir); err != nil {
+		return fmt.Errorf("error syncing %s: %s", bdir, err)
+	}
 	return nil
 }
 
@@ -288,6 +369,12 @@ var blockDirRe = regexp.MustCompile(`^[0-9a-f]+$`)
 var blockFileRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
 
 func (v *unixVolume) Index(ctx context.Context, prefix string, w io.Writer) error {
+	// Blocks in the journal are listed first, and skipped below
+	// if they are compacted while we are reading directories.
+	journaled, err := v.journal.index(prefix, w)
+	if err != nil {
+		return err
+	}
 	rootdir, err := v.os.Open(v.Root)
 	if err != nil {
 		return err
@@ -348,7 +435,7 @@ func (v *unixVolume) Index(ctx context.Context, prefix string, w io.Writer) erro
 			if !strings.HasPrefix(name, prefix) {
 				continue
 			}
-			if !blockFileRe.MatchString(name) {
+			if !blockFileRe.MatchString(name) || journaled[name] {
 				continue
 			}
 			_, err = fmt.Fprint(w,
@@ -376,6 +463,9 @@ func (v *unixVolume) BlockTrash(loc string) error {
 	// be re-written), or (b) Touch() will update the file's timestamp and
 	// Trash() will read the correct up-to-date timestamp and choose not to
 	// trash the file.
+	if err := v.journal.flush(context.TODO(), loc); err != nil {
+		return err
+	}
 	if err := v.lock(context.TODO()); err != nil {
 		return err
 	}
@@ -502,30 +592,20 @@ func (v *unixVolume) InternalStats() interface{} {
 	return &v.os.stats
 }
 
-// lock acquires the serialize lock, if one is in use. If ctx is done
-// before the lock is acquired, lock returns ctx.Err() instead of
-// acquiring the lock.
+// lock acquires the serialize lock, if one is in use. Interactive
+// requests waiting for the lock get it before batch requests (see
+// priorityFromContext). If ctx is done before the lock is acquired,
+// lock returns ctx.Err() instead of acquiring the lock.
 func (v *unixVolume) lock(ctx context.Context) error {
 	if v.locker == nil {
 		return nil
 	}
 	t0 := time.Now()
-	locked := make(chan struct{})
-	go func() {
-		v.locker.Lock()
-		close(locked)
-	}()
-	select {
-	case <-ctx.Done():
+	err := v.locker.LockContext(ctx)
+	if err != nil {
 		v.logger.Infof("client hung up while waiting for Serialize lock (%s)", time.Since(t0))
-		go func() {
-			<-locked
-			v.locker.Unlock()
-		}()
-		return ctx.Err()
-	case <-locked:
-		return nil
 	}
+	return err
 }
 
 // unlock releases the serialize lock, if one is in use.
@@ -590,6 +670,9 @@ func (v *unixVolume) EmptyTrash() {
 		if deadline > time.Now().Unix() {
 			return
 		}
+		if !v.deleteVerifier.okToDelete(matches[1]) {
+			return
+		}
 		err = v.os.Remove(path)
 		if err != nil {
 			v.logger.WithError(err).Errorf("EmptyTrash: Remove(%q) failed", path)
@@ -650,6 +733,7 @@ type unixStats struct {
 	FlockOps   uint64
 	UtimesOps  uint64
 	CreateOps  uint64
+	WriteOps   uint64
 	RenameOps  uint64
 	UnlinkOps  uint64
 	ReaddirOps uint64
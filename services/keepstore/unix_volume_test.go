@@ -9,14 +9,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"sync"
 	"syscall"
 	"time"
 
+	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	check "gopkg.in/check.v1"
 )
 
@@ -26,7 +28,11 @@ type testableUnixVolume struct {
 }
 
 func (v *testableUnixVolume) TouchWithDate(locator string, lastPut time.Time) {
-	err := syscall.Utime(v.blockPath(locator), &syscall.Utimbuf{Actime: lastPut.Unix(), Modtime: lastPut.Unix()})
+	err := v.journal.flush(context.Background(), locator)
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	err = syscall.Utime(v.blockPath(locator), &syscall.Utimbuf{Actime: lastPut.Unix(), Modtime: lastPut.Unix()})
 	if err != nil {
 		v.t.Fatal(err)
 	}
@@ -39,6 +45,9 @@ func (v *testableUnixVolume) Teardown() {
 }
 
 func (v *testableUnixVolume) ReadWriteOperationLabelValues() (r, w string) {
+	if v.journal != nil {
+		return "open", "write"
+	}
 	return "open", "create"
 }
 
@@ -46,22 +55,34 @@ var _ = check.Suite(&unixVolumeSuite{})
 
 type unixVolumeSuite struct {
 	params  newVolumeParams
+	cancel  context.CancelFunc
 	volumes []*testableUnixVolume
+
+	// JournalMaxBlockSize and FsyncPolicy for volumes created
+	// by newTestableUnixVolume
+	journalMaxBlockSize arvados.ByteSize
+	fsyncPolicy         string
 }
 
 func (s *unixVolumeSuite) SetUpTest(c *check.C) {
 	logger := ctxlog.TestLogger(c)
 	reg := prometheus.NewRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
 	s.params = newVolumeParams{
 		UUID:        "zzzzz-nyw5e-999999999999999",
 		Cluster:     testCluster(c),
 		Logger:      logger,
 		MetricsVecs: newVolumeMetricsVecs(reg),
 		BufferPool:  newBufferPool(logger, 8, reg),
+		Context:     ctx,
 	}
+	s.journalMaxBlockSize = 0
+	s.fsyncPolicy = ""
 }
 
 func (s *unixVolumeSuite) TearDownTest(c *check.C) {
+	s.cancel()
 	for _, v := range s.volumes {
 		v.Teardown()
 	}
@@ -70,20 +91,23 @@ func (s *unixVolumeSuite) TearDownTest(c *check.C) {
 func (s *unixVolumeSuite) newTestableUnixVolume(c *check.C, params newVolumeParams, serialize bool) *testableUnixVolume {
 	d, err := ioutil.TempDir("", "volume_test")
 	c.Check(err, check.IsNil)
-	var locker sync.Locker
+	var locker *priorityLock
 	if serialize {
-		locker = &sync.Mutex{}
+		locker = &priorityLock{}
 	}
 	v := &testableUnixVolume{
 		unixVolume: unixVolume{
-			Root:       d,
-			locker:     locker,
-			uuid:       params.UUID,
-			cluster:    params.Cluster,
-			logger:     params.Logger,
-			volume:     params.ConfigVolume,
-			metrics:    params.MetricsVecs,
-			bufferPool: params.BufferPool,
+			Root:                d,
+			locker:              locker,
+			JournalMaxBlockSize: s.journalMaxBlockSize,
+			FsyncPolicy:         s.fsyncPolicy,
+			uuid:                params.UUID,
+			cluster:             params.Cluster,
+			logger:              params.Logger,
+			volume:              params.ConfigVolume,
+			metrics:             params.MetricsVecs,
+			bufferPool:          params.BufferPool,
+			ctx:                 params.Context,
 		},
 		t: c,
 	}
@@ -116,6 +140,74 @@ func (s *unixVolumeSuite) TestUnixVolumeWithGenericTests_Readonly_Serialized(c *
 	})
 }
 
+func (s *unixVolumeSuite) TestUnixVolumeWithGenericTests_Journal(c *check.C) {
+	s.journalMaxBlockSize = BlockSize
+	DoGenericVolumeTests(c, false, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableUnixVolume(c, params, false)
+	})
+}
+
+func (s *unixVolumeSuite) TestUnixVolumeWithGenericTests_FsyncBlock(c *check.C) {
+	s.fsyncPolicy = fsyncPolicyBlock
+	DoGenericVolumeTests(c, false, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableUnixVolume(c, params, false)
+	})
+}
+
+func (s *unixVolumeSuite) TestFsyncPolicy(c *check.C) {
+	ctx := context.Background()
+	fsyncOps := func(v *testableUnixVolume) float64 {
+		return testutil.ToFloat64(v.os.stats.opsCounters.With(prometheus.Labels{"operation": "fsync"}))
+	}
+
+	v := s.newTestableUnixVolume(c, s.params, false)
+	c.Check(v.fsync.policy, check.Equals, fsyncPolicyNone)
+	c.Assert(v.BlockWrite(ctx, TestHash, TestBlock), check.IsNil)
+	c.Check(fsyncOps(v), check.Equals, float64(0))
+
+	// Block file and directory are synced before BlockWrite
+	// returns.
+	s.fsyncPolicy = fsyncPolicyBlock
+	v = s.newTestableUnixVolume(c, s.params, false)
+	c.Assert(v.BlockWrite(ctx, TestHash, TestBlock), check.IsNil)
+	c.Check(fsyncOps(v), check.Equals, float64(2))
+	c.Check(testutil.CollectAndCount(v.metrics.fsyncSeconds), check.Not(check.Equals), 0)
+
+	// Journal records are synced too.
+	s.journalMaxBlockSize = BlockSize
+	v = s.newTestableUnixVolume(c, s.params, false)
+	c.Assert(v.BlockWrite(ctx, TestHash, TestBlock), check.IsNil)
+	c.Check(fsyncOps(v), check.Equals, float64(2)) // journal dir, journal file
+	c.Assert(v.BlockWrite(ctx, TestHash2, TestBlock2), check.IsNil)
+	c.Check(fsyncOps(v), check.Equals, float64(3))
+	s.journalMaxBlockSize = 0
+
+	// Writes are counted as unsynced until the next batch sync.
+	v = &testableUnixVolume{
+		unixVolume: unixVolume{
+			Root:          c.MkDir(),
+			FsyncPolicy:   fsyncPolicyBatch,
+			FsyncInterval: arvados.Duration(time.Hour),
+			cluster:       s.params.Cluster,
+			logger:        s.params.Logger,
+			metrics:       s.params.MetricsVecs,
+			bufferPool:    s.params.BufferPool,
+		},
+		t: c,
+	}
+	c.Assert(v.check(), check.IsNil)
+	unsynced := v.metrics.unsyncedBytes.With(prometheus.Labels{"device_id": v.DeviceID()})
+	c.Assert(v.BlockWrite(ctx, TestHash, TestBlock), check.IsNil)
+	c.Check(fsyncOps(v), check.Equals, float64(0))
+	c.Check(testutil.ToFloat64(unsynced), check.Equals, float64(len(TestBlock)))
+	c.Check(v.fsync.barrier(), check.IsNil)
+	c.Check(fsyncOps(v), check.Equals, float64(1))
+	c.Check(testutil.ToFloat64(unsynced), check.Equals, float64(0))
+
+	bad := &unixVolume{Root: c.MkDir(), FsyncPolicy: "sometimes", logger: s.params.Logger, metrics: s.params.MetricsVecs}
+	c.Check(bad.check(), check.ErrorMatches, `DriverParameters.FsyncPolicy "sometimes" is not one of.*`)
+}
+
 func (s *unixVolumeSuite) TestGetNotFound(c *check.C) {
 	v := s.newTestableUnixVolume(c, s.params, true)
 	defer v.Teardown()
@@ -126,6 +218,37 @@ func (s *unixVolumeSuite) TestGetNotFound(c *check.C) {
 	c.Check(err, check.FitsTypeOf, os.ErrNotExist)
 }
 
+func (s *unixVolumeSuite) TestBlockReadRange(c *check.C) {
+	for _, journal := range []bool{false, true} {
+		c.Logf("=== journal %v", journal)
+		s.journalMaxBlockSize = 0
+		if journal {
+			s.journalMaxBlockSize = 1024
+		}
+		v := s.newTestableUnixVolume(c, s.params, false)
+		err := v.BlockWrite(context.Background(), TestHash, TestBlock)
+		c.Assert(err, check.IsNil)
+		_, err = os.Stat(v.blockPath(TestHash))
+		c.Check(os.IsNotExist(err), check.Equals, journal)
+
+		buf := &brbuffer{}
+		err = v.BlockReadRange(context.Background(), TestHash, 4, 5, buf)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf.Bytes()), check.Equals, "quick")
+
+		buf = &brbuffer{}
+		err = v.BlockReadRange(context.Background(), TestHash, 40, -1, buf)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf.Bytes()), check.Equals, "dog.")
+
+		err = v.BlockReadRange(context.Background(), TestHash, 40, 10, &brbuffer{})
+		c.Check(err, check.Equals, io.ErrUnexpectedEOF)
+
+		err = v.BlockReadRange(context.Background(), TestHash2, 0, 1, &brbuffer{})
+		c.Check(os.IsNotExist(err), check.Equals, true)
+	}
+}
+
 func (s *unixVolumeSuite) TestPut(c *check.C) {
 	v := s.newTestableUnixVolume(c, s.params, false)
 	defer v.Teardown()
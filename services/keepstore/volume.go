@@ -84,6 +84,38 @@ type volume interface {
 	Index(ctx context.Context, prefix string, writeTo io.Writer) error
 }
 
+// A streamingVolume can store a block while its data is still being
+// received from the client (see Collections.BlobStreamingWrites).
+type streamingVolume interface {
+	// Store a block of the given size, reading the data from r,
+	// and set its timestamp to the current time.
+	//
+	// If r returns an error other than io.EOF (e.g., because the
+	// data does not match the hash, in which case the error is
+	// returned instead of the last part of the data), the write
+	// must be aborted. As with BlockWrite, a partially written
+	// block must not be left behind.
+	//
+	// BlockWriteStream must not read from r after returning.
+	BlockWriteStream(ctx context.Context, hash string, size int, r io.Reader) error
+}
+
+// A rangeReadingVolume can read part of a block without reading the
+// rest of it from the backend device (see keepstore.BlockReadRange).
+type rangeReadingVolume interface {
+	// Copy length bytes of the indicated block, starting at the
+	// given offset, from the backend device to writeTo. Data is
+	// written at offsets relative to the start of the range,
+	// i.e., the first byte of the range is written at offset 0.
+	//
+	// As with BlockRead, data can be written in any order, data
+	// integrity is not verified, and if the block does not
+	// exist, BlockReadRange must return os.ErrNotExist. If the
+	// block is shorter than offset+length, BlockReadRange must
+	// return an error.
+	BlockReadRange(ctx context.Context, hash string, offset, length int64, writeTo io.WriterAt) error
+}
+
 type volumeDriver func(newVolumeParams) (volume, error)
 
 type newVolumeParams struct {
@@ -93,6 +125,14 @@ type newVolumeParams struct {
 	Logger       logrus.FieldLogger
 	MetricsVecs  *volumeMetricsVecs
 	BufferPool   *bufferPool
+
+	// Checks trashed blocks before EmptyTrash deletes them. May
+	// be nil.
+	DeleteVerifier *deleteVerifier
+
+	// Canceled when the service shuts down, to stop the volume's
+	// background goroutines (if any). May be nil.
+	Context context.Context
 }
 
 // ioStats tracks I/O statistics for a volume or server